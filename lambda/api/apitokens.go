@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// API tokens let scripts call the API without a login. They are stored in
+// the ApiTokens map on the owner's Users row, so the token names its owner:
+// "kst_<base64url username>.<token ID>.<secret>". Only a SHA-256 of the
+// secret is kept. A token acts with its owner's current role, further
+// limited to its scopes, and stops working when the owner is disabled.
+
+const (
+	apiTokenPrefix = "kst_"
+
+	scopeImagesRead     = "images:read"
+	scopeImagesWrite    = "images:write"
+	scopeProjectsExport = "projects:export"
+
+	maxAPITokensPerUser = 20
+	maxAPITokenNameLen  = 64
+
+	// Last-used times are recorded at most this often per token
+	apiTokenLastUsedGranularity = time.Minute
+)
+
+// apiTokenScopeRoles maps each scope to the least role allowed to mint it.
+var apiTokenScopeRoles = map[string]string{
+	scopeImagesRead:     roleViewer,
+	scopeImagesWrite:    roleReviewer,
+	scopeProjectsExport: roleViewer,
+}
+
+// APIToken is an entry of the ApiTokens map on a Users row.
+type APIToken struct {
+	Name       string   `dynamodbav:"Name"`
+	SecretHash string   `dynamodbav:"SecretHash"`
+	Scopes     []string `dynamodbav:"Scopes"`
+	CreatedAt  string   `dynamodbav:"CreatedAt"`
+	ExpiresAt  string   `dynamodbav:"ExpiresAt,omitempty"`
+	LastUsedAt string   `dynamodbav:"LastUsedAt,omitempty"`
+}
+
+func (t APIToken) expired(now time.Time) bool {
+	if t.ExpiresAt == "" {
+		return false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, t.ExpiresAt)
+	return err != nil || !now.Before(expiresAt)
+}
+
+// APITokenResponse describes a token to its owner. Token is only set when
+// the token is minted.
+type APITokenResponse struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"createdAt"`
+	ExpiresAt  string   `json:"expiresAt,omitempty"`
+	LastUsedAt string   `json:"lastUsedAt,omitempty"`
+	Token      string   `json:"token,omitempty"`
+}
+
+type CreateAPITokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays,omitempty"` // 0 means no expiry
+}
+
+func isAPIToken(token string) bool {
+	return strings.HasPrefix(token, apiTokenPrefix)
+}
+
+// splitAPIToken returns the owner, token ID and secret of an API token.
+func splitAPIToken(token string) (username, id, secret string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(token, apiTokenPrefix), ".")
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return "", "", "", false
+	}
+	user, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(user) == 0 {
+		return "", "", "", false
+	}
+	return string(user), parts[1], parts[2], true
+}
+
+func hashAPITokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// userAPITokens returns the API tokens stored on a Users row by ID.
+func userAPITokens(userItem map[string]*dynamodb.AttributeValue) map[string]APIToken {
+	tokens := make(map[string]APIToken)
+	if attr := userItem["ApiTokens"]; attr != nil && attr.M != nil {
+		dynamodbattribute.UnmarshalMap(attr.M, &tokens)
+	}
+	return tokens
+}
+
+// authenticateAPIToken resolves an API token to its owner and records its
+// last-used time.
+func authenticateAPIToken(token string) (*Caller, bool) {
+	username, id, secret, ok := splitAPIToken(token)
+	if !ok {
+		return nil, false
+	}
+	userItem, err := withRetry(func() (Item, error) {
+		return userStore.GetUser(username)
+	})
+	if err != nil {
+		fmt.Printf("Failed to check API token for %s: %v\n", username, err)
+		return nil, false
+	}
+	if userItem == nil {
+		return nil, false
+	}
+	user := userFromItem(userItem)
+	stored, ok := userAPITokens(userItem)[id]
+	if !ok || user.Disabled {
+		return nil, false
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPITokenSecret(secret)), []byte(stored.SecretHash)) != 1 {
+		return nil, false
+	}
+	now := time.Now()
+	if stored.expired(now) {
+		return nil, false
+	}
+
+	if lastUsed, err := time.Parse(time.RFC3339, stored.LastUsedAt); err != nil || now.Sub(lastUsed) >= apiTokenLastUsedGranularity {
+		_, err := userStore.UpdateUser(username, ItemUpdate{
+			Expression: "SET ApiTokens.#id.LastUsedAt = :now",
+			Condition:  "attribute_exists(ApiTokens.#id)",
+			Names:      map[string]*string{"#id": aws.String(id)},
+			Values: map[string]*dynamodb.AttributeValue{
+				":now": {S: aws.String(now.Format(time.RFC3339))},
+			},
+		})
+		if err != nil {
+			fmt.Printf("Failed to record API token use for %s: %v\n", username, err)
+		}
+	}
+
+	return &Caller{Username: username, Role: user.Role, APIToken: true, Scopes: stored.Scopes}, true
+}
+
+// routeScopes returns the scopes that allow a route. Routes outside the list,
+// such as account and token management, cannot be called with API tokens.
+func routeScopes(method, path string) []string {
+	isProject := strings.HasPrefix(path, "/api/projects/")
+	switch {
+	case method == "GET" && (path == "/api/images" || path == "/api/stats" || path == "/api/search" || path == "/api/timeline" || strings.HasPrefix(path, "/api/images/") ||
+		path == "/api/collections" || strings.HasPrefix(path, "/api/collections/") || path == "/api/changes"):
+		return []string{scopeImagesRead}
+	case method == "GET" && (path == "/api/projects" || (isProject && strings.HasSuffix(path, "/images")) ||
+		path == "/api/jobs" || strings.HasPrefix(path, "/api/jobs/")):
+		return []string{scopeImagesRead, scopeProjectsExport}
+	case isProject && (strings.HasSuffix(path, "/generate-zip") || strings.HasSuffix(path, "/zip-logs") ||
+		(method == "GET" && strings.Contains(path, "/zips/"))):
+		return []string{scopeProjectsExport}
+	case method != "GET" && strings.HasPrefix(path, "/api/images/"):
+		return []string{scopeImagesWrite}
+	case method == "POST" && isProject && strings.HasSuffix(path, "/images"):
+		return []string{scopeImagesWrite}
+	}
+	return nil
+}
+
+// scopesAllow reports whether any of the granted scopes allows the route.
+func scopesAllow(granted []string, method, path string) bool {
+	for _, needed := range routeScopes(method, path) {
+		for _, scope := range granted {
+			if scope == needed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func handleListAPITokens(token string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	username, ok := getUsernameFromToken(token)
+	if !ok {
+		return errorResponse(401, "Invalid token", headers)
+	}
+	userItem, err := userStore.GetUser(username)
+	if err != nil {
+		fmt.Printf("Failed to get user %s: %v\n", username, err)
+		return errorResponse(500, "Failed to list tokens", headers)
+	}
+
+	tokens := make([]APITokenResponse, 0)
+	for id, t := range userAPITokens(userItem) {
+		tokens = append(tokens, APITokenResponse{
+			ID:         id,
+			Name:       t.Name,
+			Scopes:     t.Scopes,
+			CreatedAt:  t.CreatedAt,
+			ExpiresAt:  t.ExpiresAt,
+			LastUsedAt: t.LastUsedAt,
+		})
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt < tokens[j].CreatedAt })
+
+	body, _ := json.Marshal(tokens)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// handleCreateAPIToken mints a token for the caller. The secret is only
+// returned here.
+func handleCreateAPIToken(token string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	username, ok := getUsernameFromToken(token)
+	if !ok {
+		return errorResponse(401, "Invalid token", headers)
+	}
+
+	var req CreateAPITokenRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return errorResponse(400, "Invalid request body", headers)
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxAPITokenNameLen {
+		return errorResponse(400, fmt.Sprintf("Token name must be 1-%d characters", maxAPITokenNameLen), headers)
+	}
+	if len(req.Scopes) == 0 {
+		return errorResponse(400, "At least one scope is required", headers)
+	}
+	if req.ExpiresInDays < 0 {
+		return errorResponse(400, "expiresInDays must not be negative", headers)
+	}
+
+	userItem, err := userStore.GetUser(username)
+	if err != nil || userItem == nil {
+		fmt.Printf("Failed to get user %s: %v\n", username, err)
+		return errorResponse(500, "Failed to create token", headers)
+	}
+	user := userFromItem(userItem)
+	seen := make(map[string]bool)
+	var scopes []string
+	for _, scope := range req.Scopes {
+		minRole, known := apiTokenScopeRoles[scope]
+		if !known {
+			return errorResponse(400, fmt.Sprintf("Unknown scope %q", scope), headers)
+		}
+		if !roleAllows(user.Role, minRole) {
+			return errorResponse(403, fmt.Sprintf("Your role cannot grant %s", scope), headers)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	existing := userAPITokens(userItem)
+	if len(existing) >= maxAPITokensPerUser {
+		return errorResponse(400, fmt.Sprintf("A user can have at most %d tokens", maxAPITokensPerUser), headers)
+	}
+
+	id, err := randomToken(9)
+	if err != nil {
+		return errorResponse(500, "Failed to create token", headers)
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return errorResponse(500, "Failed to create token", headers)
+	}
+	now := time.Now()
+	stored := APIToken{
+		Name:       req.Name,
+		SecretHash: hashAPITokenSecret(secret),
+		Scopes:     scopes,
+		CreatedAt:  now.Format(time.RFC3339),
+	}
+	if req.ExpiresInDays > 0 {
+		stored.ExpiresAt = now.AddDate(0, 0, req.ExpiresInDays).Format(time.RFC3339)
+	}
+	storedAV, err := dynamodbattribute.MarshalMap(stored)
+	if err != nil {
+		return errorResponse(500, "Failed to create token", headers)
+	}
+
+	if userItem["ApiTokens"] == nil {
+		// Nested SETs need the map to exist first
+		_, err = userStore.UpdateUser(username, ItemUpdate{
+			Expression: "SET ApiTokens = if_not_exists(ApiTokens, :empty)",
+			Condition:  "attribute_exists(Username)",
+			Values: map[string]*dynamodb.AttributeValue{
+				":empty": {M: map[string]*dynamodb.AttributeValue{}},
+			},
+		})
+		if err != nil {
+			fmt.Printf("Failed to create token for %s: %v\n", username, err)
+			return errorResponse(500, "Failed to create token", headers)
+		}
+	}
+	_, err = userStore.UpdateUser(username, ItemUpdate{
+		Expression: "SET ApiTokens.#id = :token",
+		Condition:  "attribute_exists(Username)",
+		Names:      map[string]*string{"#id": aws.String(id)},
+		Values: map[string]*dynamodb.AttributeValue{
+			":token": {M: storedAV},
+		},
+	})
+	if err != nil {
+		fmt.Printf("Failed to create token for %s: %v\n", username, err)
+		return errorResponse(500, "Failed to create token", headers)
+	}
+
+	body, _ := json.Marshal(APITokenResponse{
+		ID:        id,
+		Name:      stored.Name,
+		Scopes:    stored.Scopes,
+		CreatedAt: stored.CreatedAt,
+		ExpiresAt: stored.ExpiresAt,
+		Token:     apiTokenPrefix + base64.RawURLEncoding.EncodeToString([]byte(username)) + "." + id + "." + secret,
+	})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 201,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+func handleRevokeAPIToken(token, id string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	username, ok := getUsernameFromToken(token)
+	if !ok {
+		return errorResponse(401, "Invalid token", headers)
+	}
+
+	_, err := userStore.UpdateUser(username, ItemUpdate{
+		Expression: "REMOVE ApiTokens.#id",
+		Condition:  "attribute_exists(ApiTokens.#id)",
+		Names:      map[string]*string{"#id": aws.String(id)},
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "ConditionalCheckFailed") {
+			return errorResponse(404, "Token not found", headers)
+		}
+		fmt.Printf("Failed to revoke token %s for %s: %v\n", id, username, err)
+		return errorResponse(500, "Failed to revoke token", headers)
+	}
+
+	body, _ := json.Marshal(map[string]bool{"success": true})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// mintToken creates an API token as the currently logged-in user.
+func (env *testEnv) mintToken(body string) APITokenResponse {
+	env.t.Helper()
+	resp := env.call("POST", "/api/user/tokens", body)
+	if resp.StatusCode != 201 {
+		env.t.Fatalf("mint token: %d %s", resp.StatusCode, resp.Body)
+	}
+	var tr APITokenResponse
+	json.Unmarshal([]byte(resp.Body), &tr)
+	return tr
+}
+
+func TestAPITokenScopes(t *testing.T) {
+	tests := []struct {
+		scopes       string
+		method, path string
+		body         string
+		wantCode     int
+	}{
+		{`["images:read"]`, "GET", "/api/images", "", 200},
+		{`["images:read"]`, "GET", "/api/projects/trip/images", "", 200},
+		{`["images:read"]`, "GET", "/api/changes", "", 200},
+		{`["images:read"]`, "PUT", "/api/images/img1", `{"groupNumber":1}`, 403},
+		{`["images:read"]`, "POST", "/api/projects/trip/generate-zip", "", 403},
+		{`["images:write"]`, "PUT", "/api/images/img1", `{"groupNumber":1}`, 200},
+		{`["images:write"]`, "GET", "/api/images", "", 403},
+		{`["projects:export"]`, "GET", "/api/projects", "", 200},
+		{`["projects:export"]`, "POST", "/api/projects/trip/generate-zip", "", 200},
+		{`["projects:export"]`, "GET", "/api/images", "", 403},
+		// Account management is never available to API tokens
+		{`["images:read","images:write","projects:export"]`, "GET", "/api/user/tokens", "", 403},
+		{`["images:read","images:write","projects:export"]`, "POST", "/api/user/tokens", `{"name":"x","scopes":["images:read"]}`, 403},
+		{`["images:read","images:write","projects:export"]`, "GET", "/api/users", "", 403},
+		{`["images:read","images:write","projects:export"]`, "DELETE", "/api/projects/trip", "", 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scopes+" "+tt.method+" "+tt.path, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.seedImage("img1", nil)
+			env.seedProject("trip", 1)
+			env.login()
+			env.token = env.mintToken(`{"name":"script","scopes":` + tt.scopes + `}`).Token
+
+			resp := env.call(tt.method, tt.path, tt.body)
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, tt.wantCode, resp.Body)
+			}
+		})
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	t.Run("mint, list and revoke", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.login()
+		loginToken := env.token
+		tr := env.mintToken(`{"name":"backup","scopes":["images:read"],"expiresInDays":30}`)
+		if !strings.HasPrefix(tr.Token, apiTokenPrefix) || tr.ExpiresAt == "" {
+			t.Fatalf("minted token = %+v", tr)
+		}
+
+		env.token = tr.Token
+		if resp := env.call("GET", "/api/images", ""); resp.StatusCode != 200 {
+			t.Fatalf("API token rejected: %d %s", resp.StatusCode, resp.Body)
+		}
+
+		env.token = loginToken
+		resp := env.call("GET", "/api/user/tokens", "")
+		if strings.Contains(resp.Body, tr.Token) || strings.Contains(resp.Body, "SecretHash") {
+			t.Errorf("token list leaks secrets: %s", resp.Body)
+		}
+		var listed []APITokenResponse
+		json.Unmarshal([]byte(resp.Body), &listed)
+		if len(listed) != 1 || listed[0].ID != tr.ID || listed[0].LastUsedAt == "" {
+			t.Fatalf("tokens = %+v", listed)
+		}
+
+		if resp := env.call("DELETE", "/api/user/tokens/"+tr.ID, ""); resp.StatusCode != 200 {
+			t.Fatalf("revoke: %d %s", resp.StatusCode, resp.Body)
+		}
+		if resp := env.call("DELETE", "/api/user/tokens/"+tr.ID, ""); resp.StatusCode != 404 {
+			t.Errorf("revoke twice: status = %d, want 404", resp.StatusCode)
+		}
+		env.token = tr.Token
+		if resp := env.call("GET", "/api/images", ""); resp.StatusCode != 401 {
+			t.Errorf("revoked token: status = %d, want 401", resp.StatusCode)
+		}
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.seedUser("val", roleViewer)
+		env.loginAs("val", testPassword)
+		for body, want := range map[string]int{
+			`{"name":"","scopes":["images:read"]}`:                     400,
+			`{"name":"x","scopes":[]}`:                                 400,
+			`{"name":"x","scopes":["images:delete"]}`:                  400,
+			`{"name":"x","scopes":["images:read"],"expiresInDays":-1}`: 400,
+			`{"name":"x","scopes":["images:read","images:write"]}`:     403,
+			`{"name":"x","scopes":["images:read","projects:export"]}`:  201,
+		} {
+			if resp := env.call("POST", "/api/user/tokens", body); resp.StatusCode != want {
+				t.Errorf("%s: status = %d, want %d: %s", body, resp.StatusCode, want, resp.Body)
+			}
+		}
+	})
+
+	t.Run("tampered, expired and disabled-owner tokens are rejected", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.seedUser("ann", roleReviewer)
+		env.loginAs("ann", testPassword)
+		good := env.mintToken(`{"name":"a","scopes":["images:read"]}`)
+		expiring := env.mintToken(`{"name":"b","scopes":["images:read"],"expiresInDays":1}`)
+
+		past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+		userStore.UpdateUser("ann", ItemUpdate{
+			Expression: "SET ApiTokens.#id.ExpiresAt = :past",
+			Names:      map[string]*string{"#id": aws.String(expiring.ID)},
+			Values:     map[string]*dynamodb.AttributeValue{":past": {S: aws.String(past)}},
+		})
+
+		for name, token := range map[string]string{
+			"tampered": good.Token[:len(good.Token)-2] + "xx",
+			"expired":  expiring.Token,
+			"garbage":  apiTokenPrefix + "nope",
+		} {
+			env.token = token
+			if resp := env.call("GET", "/api/images", ""); resp.StatusCode != 401 {
+				t.Errorf("%s token: status = %d, want 401", name, resp.StatusCode)
+			}
+		}
+
+		env.login()
+		env.call("PUT", "/api/users/ann", `{"disabled":true}`)
+		env.token = good.Token
+		if resp := env.call("GET", "/api/images", ""); resp.StatusCode != 401 {
+			t.Errorf("disabled owner's token: status = %d, want 401", resp.StatusCode)
+		}
+	})
+
+	t.Run("tokens follow the owner's current role", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.seedImage("img1", nil)
+		env.seedUser("ann", roleReviewer)
+		env.loginAs("ann", testPassword)
+		tr := env.mintToken(`{"name":"a","scopes":["images:write"]}`)
+
+		env.login()
+		env.call("PUT", "/api/users/ann", `{"role":"viewer"}`)
+		env.token = tr.Token
+		if resp := env.call("PUT", "/api/images/img1", `{"groupNumber":1}`); resp.StatusCode != 403 {
+			t.Errorf("demoted owner's token: status = %d, want 403", resp.StatusCode)
+		}
+	})
+}
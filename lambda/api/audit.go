@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/google/uuid"
+)
+
+// Every change made through the API, and every login, is appended to the
+// audit log with who made it, what it changed and the API Gateway request
+// ID, so an event can be matched with the request logs. The API's IAM policy
+// only allows PutItem and Query on the table.
+
+// Audit actions
+const (
+	auditImageUpdate         = "image.update"
+	auditImageDelete         = "image.delete"
+	auditImageUndelete       = "image.undelete"
+	auditImageUndo           = "image.undo"
+	auditProjectCreate       = "project.create"
+	auditProjectUpdate       = "project.update"
+	auditProjectDelete       = "project.delete"
+	auditProjectAddImages    = "project.add_images"
+	auditProjectMemberSet    = "project.member_set"
+	auditProjectMemberRemove = "project.member_remove"
+	auditZipGenerate         = "zip.generate"
+	auditZipDelete           = "zip.delete"
+	auditLogin               = "login"
+	auditLoginFailed         = "login.failed"
+)
+
+const (
+	// Timestamps are fixed width so they sort as strings
+	auditTimeFormat  = "2006-01-02T15:04:05.000000Z"
+	auditMonthFormat = "2006-01"
+
+	auditDefaultLimit = 50
+	auditMaxLimit     = 200
+	// Queries without a user, image or project walk the log month by month,
+	// and without a from date stop after a year.
+	auditDefaultSpan = 365 * 24 * time.Hour
+)
+
+// auditClock is replaced in tests.
+var auditClock = time.Now
+
+// AuditEvent is one audit log entry. ImageGUID and ProjectID are set when the
+// event concerns an image or project, so the log can be queried by them.
+type AuditEvent struct {
+	EventID   string                 `json:"eventId" dynamodbav:"EventID"`
+	Timestamp string                 `json:"timestamp" dynamodbav:"Timestamp"`
+	Month     string                 `json:"-" dynamodbav:"Month"`
+	Actor     string                 `json:"actor" dynamodbav:"Actor"`
+	Action    string                 `json:"action" dynamodbav:"Action"`
+	Target    string                 `json:"target" dynamodbav:"Target"` // e.g. "image:<id>", "project:<id>", "user:<name>"
+	ImageGUID string                 `json:"imageGUID,omitempty" dynamodbav:"ImageGUID,omitempty"`
+	ProjectID string                 `json:"projectId,omitempty" dynamodbav:"ProjectID,omitempty"`
+	Before    map[string]interface{} `json:"before,omitempty" dynamodbav:"Before,omitempty"`
+	After     map[string]interface{} `json:"after,omitempty" dynamodbav:"After,omitempty"`
+	RequestID string                 `json:"requestId,omitempty" dynamodbav:"RequestID,omitempty"`
+	SourceIP  string                 `json:"sourceIp,omitempty" dynamodbav:"SourceIP,omitempty"`
+}
+
+// withRequest records the request's ID and source address on the caller for
+// the audit log.
+func (c *Caller) withRequest(request events.APIGatewayProxyRequest) *Caller {
+	c.RequestID = request.RequestContext.RequestID
+	c.SourceIP = request.RequestContext.Identity.SourceIP
+	return c
+}
+
+// recordAudit appends an event for the caller. Failing to write it is logged
+// but does not fail the request, which has already made its change.
+func recordAudit(caller *Caller, event AuditEvent) {
+	now := auditClock().UTC()
+	event.EventID = uuid.New().String()
+	event.Timestamp = now.Format(auditTimeFormat)
+	event.Month = now.Format(auditMonthFormat)
+	event.Actor = caller.Username
+	event.RequestID = caller.RequestID
+	event.SourceIP = caller.SourceIP
+	if event.Target == "" {
+		if event.ImageGUID != "" {
+			event.Target = "image:" + event.ImageGUID
+		} else if event.ProjectID != "" {
+			event.Target = "project:" + event.ProjectID
+		}
+	}
+
+	item, err := dynamodbattribute.MarshalMap(event)
+	if err == nil {
+		err = withRetryNoResult(func() error {
+			return auditStore.PutAuditEvent(item)
+		})
+	}
+	if err != nil {
+		fmt.Printf("Failed to write audit event %s %s by %s: %v\n", event.Action, event.Target, event.Actor, err)
+	}
+}
+
+// recordLogin audits a login attempt, which has no authenticated caller.
+func recordLogin(request events.APIGatewayProxyRequest, username, action string, after map[string]interface{}) {
+	caller := (&Caller{Username: username}).withRequest(request)
+	recordAudit(caller, AuditEvent{Action: action, Target: "user:" + username, After: after})
+}
+
+// imageAuditFields is the part of an image the audit log tracks.
+func imageAuditFields(img ImageResponse) map[string]interface{} {
+	return map[string]interface{}{
+		"status":       img.Status,
+		"reviewed":     img.Reviewed,
+		"groupNumber":  img.GroupNumber,
+		"colorCode":    img.ColorCode,
+		"rating":       img.Rating,
+		"promoted":     img.Promoted,
+		"keywords":     img.Keywords,
+		"projectId":    img.ProjectID,
+		"originalFile": img.OriginalFile,
+	}
+}
+
+// projectAuditFields is the part of a project the audit log tracks.
+func projectAuditFields(p Project) map[string]interface{} {
+	return map[string]interface{}{
+		"name":     p.Name,
+		"keywords": p.Keywords,
+		"archived": p.Archived,
+	}
+}
+
+// auditDiff returns only the fields that changed between before and after.
+func auditDiff(before, after map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	b := make(map[string]interface{})
+	a := make(map[string]interface{})
+	for k, v := range after {
+		if !reflect.DeepEqual(before[k], v) {
+			b[k] = before[k]
+			a[k] = v
+		}
+	}
+	return b, a
+}
+
+// AuditResponse is one page of audit events, newest first.
+type AuditResponse struct {
+	Events     []AuditEvent `json:"events"`
+	HasMore    bool         `json:"hasMore"`
+	NextCursor string       `json:"nextCursor,omitempty"`
+}
+
+// auditCursor resumes a query. Month is set while walking the log by month.
+type auditCursor struct {
+	Month string `json:"m,omitempty"`
+	Key   Item   `json:"k,omitempty"`
+}
+
+func encodeAuditCursor(c *auditCursor) string {
+	if c == nil {
+		return ""
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeAuditCursor(s string) (*auditCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c auditCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// parseAuditTime accepts an RFC 3339 time or a date. A date means the start
+// of the day, or its end when endOfDay is set.
+func parseAuditTime(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Microsecond)
+	}
+	return t, nil
+}
+
+// queryAuditPage reads up to limit matching events, continuing past pages
+// that the filter emptied. The returned key resumes after the last event.
+func queryAuditPage(q ItemQuery, limit int) ([]Item, Item, error) {
+	var items []Item
+	for len(items) < limit {
+		q.Limit = int64(limit - len(items))
+		page, err := auditStore.QueryAuditEvents(q)
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, page.Items...)
+		if page.LastKey == nil {
+			return items, nil, nil
+		}
+		q.StartKey = page.LastKey
+	}
+	return items, q.StartKey, nil
+}
+
+// handleQueryAudit serves GET /api/audit. Filters: user, image, project,
+// action, from and to (RFC 3339 times or dates), plus limit and cursor. It
+// queries the index of the most selective filter and applies the rest as a
+// filter expression.
+func handleQueryAudit(params map[string]string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	limit := auditDefaultLimit
+	if s := params["limit"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return errorResponse(400, "limit must be a positive number", headers)
+		}
+		if n > auditMaxLimit {
+			n = auditMaxLimit
+		}
+		limit = n
+	}
+
+	to := auditClock().UTC()
+	if s := params["to"]; s != "" {
+		t, err := parseAuditTime(s, true)
+		if err != nil {
+			return errorResponse(400, "to must be an RFC 3339 time or a YYYY-MM-DD date", headers)
+		}
+		to = t
+	}
+	var from time.Time
+	if s := params["from"]; s != "" {
+		t, err := parseAuditTime(s, false)
+		if err != nil {
+			return errorResponse(400, "from must be an RFC 3339 time or a YYYY-MM-DD date", headers)
+		}
+		from = t
+	}
+	if from.After(to) {
+		return errorResponse(400, "from must not be after to", headers)
+	}
+
+	var cursor *auditCursor
+	if s := params["cursor"]; s != "" {
+		c, err := decodeAuditCursor(s)
+		if err != nil {
+			return errorResponse(400, "Invalid cursor", headers)
+		}
+		cursor = c
+	}
+
+	q := ItemQuery{
+		Descending: true,
+		Names:      map[string]*string{"#ts": aws.String("Timestamp")},
+		Values: map[string]*dynamodb.AttributeValue{
+			":from": {S: aws.String(from.Format(auditTimeFormat))},
+			":to":   {S: aws.String(to.Format(auditTimeFormat))},
+		},
+	}
+	keyRange := " AND #ts BETWEEN :from AND :to"
+	var filters []string
+	for _, f := range []struct{ param, attr, index string }{
+		{"image", "ImageGUID", "ImageIndex"},
+		{"project", "ProjectID", "ProjectIndex"},
+		{"user", "Actor", "ActorIndex"},
+		{"action", "Action", ""},
+	} {
+		value := params[f.param]
+		if value == "" {
+			continue
+		}
+		// Action is a reserved word, so name every attribute
+		cond := "#" + f.param + " = :" + f.param
+		q.Names["#"+f.param] = aws.String(f.attr)
+		q.Values[":"+f.param] = &dynamodb.AttributeValue{S: aws.String(value)}
+		if q.Index == "" && f.index != "" {
+			q.Index = f.index
+			q.KeyCondition = cond + keyRange
+		} else {
+			filters = append(filters, cond)
+		}
+	}
+	q.Filter = strings.Join(filters, " AND ")
+
+	var items []Item
+	var next *auditCursor
+	if q.Index != "" {
+		if cursor != nil {
+			q.StartKey = cursor.Key
+		}
+		page, lastKey, err := queryAuditPage(q, limit)
+		if err != nil {
+			fmt.Printf("Error querying audit log: %v\n", err)
+			return errorResponse(500, "Failed to query audit log", headers)
+		}
+		items = page
+		if lastKey != nil {
+			next = &auditCursor{Key: lastKey}
+		}
+	} else {
+		// Walk the month partitions from newest to oldest
+		if params["from"] == "" {
+			from = to.Add(-auditDefaultSpan)
+			q.Values[":from"] = &dynamodb.AttributeValue{S: aws.String(from.Format(auditTimeFormat))}
+		}
+		q.Index = "MonthIndex"
+		q.KeyCondition = "#month = :month" + keyRange
+		q.Names["#month"] = aws.String("Month")
+		month := time.Date(to.Year(), to.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if cursor != nil {
+			m, err := time.Parse(auditMonthFormat, cursor.Month)
+			if err != nil {
+				return errorResponse(400, "Invalid cursor", headers)
+			}
+			month = m
+			q.StartKey = cursor.Key
+		}
+		first := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC)
+		for !month.Before(first) && len(items) < limit {
+			q.Values[":month"] = &dynamodb.AttributeValue{S: aws.String(month.Format(auditMonthFormat))}
+			page, lastKey, err := queryAuditPage(q, limit-len(items))
+			if err != nil {
+				fmt.Printf("Error querying audit log: %v\n", err)
+				return errorResponse(500, "Failed to query audit log", headers)
+			}
+			items = append(items, page...)
+			if lastKey != nil {
+				next = &auditCursor{Month: month.Format(auditMonthFormat), Key: lastKey}
+				break
+			}
+			month = month.AddDate(0, -1, 0)
+			q.StartKey = nil
+			if len(items) == limit && !month.Before(first) {
+				next = &auditCursor{Month: month.Format(auditMonthFormat)}
+			}
+		}
+	}
+
+	response := AuditResponse{Events: make([]AuditEvent, 0, len(items))}
+	for _, item := range items {
+		var e AuditEvent
+		dynamodbattribute.UnmarshalMap(item, &e)
+		response.Events = append(response.Events, e)
+	}
+	response.HasMore = next != nil
+	response.NextCursor = encodeAuditCursor(next)
+
+	body, _ := json.Marshal(response)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// imageHistory returns a page of the audit events for one image, newest
+// first. Callers other than admins don't see where requests came from.
+func imageHistory(caller *Caller, imageID string, cursor *auditCursor, limit int) (AuditResponse, error) {
+	q := ItemQuery{
+		Index:        "ImageIndex",
+		KeyCondition: "ImageGUID = :image",
+		Descending:   true,
+		Values: map[string]*dynamodb.AttributeValue{
+			":image": {S: aws.String(imageID)},
+		},
+	}
+	if cursor != nil {
+		q.StartKey = cursor.Key
+	}
+	items, lastKey, err := queryAuditPage(q, limit)
+	if err != nil {
+		return AuditResponse{}, err
+	}
+
+	response := AuditResponse{Events: make([]AuditEvent, 0, len(items)), HasMore: lastKey != nil}
+	for _, item := range items {
+		var e AuditEvent
+		dynamodbattribute.UnmarshalMap(item, &e)
+		if caller.Role != roleAdmin {
+			e.SourceIP = ""
+		}
+		response.Events = append(response.Events, e)
+	}
+	if lastKey != nil {
+		response.NextCursor = encodeAuditCursor(&auditCursor{Key: lastKey})
+	}
+	return response, nil
+}
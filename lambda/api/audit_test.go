@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func (env *testEnv) audit(query string) AuditResponse {
+	env.t.Helper()
+	resp := env.call("GET", "/api/audit?"+query, "")
+	var page AuditResponse
+	if err := json.Unmarshal([]byte(resp.Body), &page); err != nil || resp.StatusCode != 200 {
+		env.t.Fatalf("audit %s: %d %s", query, resp.StatusCode, resp.Body)
+	}
+	return page
+}
+
+func actions(events []AuditEvent) []string {
+	var out []string
+	for _, e := range events {
+		out = append(out, e.Action)
+	}
+	return out
+}
+
+func TestAuditLog(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedUser("ann", roleReviewer)
+	env.seedImage("img1", nil)
+	env.call("POST", "/api/login", `{"username":"ann","password":"wrong"}`)
+	env.loginAs("ann", testPassword)
+
+	if resp := env.call("PUT", "/api/images/img1", `{"groupNumber":2,"reviewed":"true","rating":4}`); resp.StatusCode != 200 {
+		t.Fatalf("update: %d %s", resp.StatusCode, resp.Body)
+	}
+	env.runAsyncMoves()
+	if resp := env.call("DELETE", "/api/images/img1", ""); resp.StatusCode != 200 {
+		t.Fatalf("delete: %d %s", resp.StatusCode, resp.Body)
+	}
+	if resp := env.call("GET", "/api/audit", ""); resp.StatusCode != 403 {
+		t.Errorf("reviewer reading audit log: status = %d, want 403", resp.StatusCode)
+	}
+
+	env.login()
+	resp := env.call("POST", "/api/projects", `{"name":"Gala"}`)
+	var p Project
+	json.Unmarshal([]byte(resp.Body), &p)
+	env.call("PUT", "/api/projects/"+p.ProjectID, `{"name":"Spring Gala"}`)
+
+	page := env.audit("image=img1")
+	if got := fmt.Sprint(actions(page.Events)); got != "[image.delete image.update]" {
+		t.Fatalf("image events = %s", got)
+	}
+	update := page.Events[1]
+	if update.Actor != "ann" || update.RequestID == "" || update.Target != "image:img1" {
+		t.Errorf("update event = %+v", update)
+	}
+	if update.Before["groupNumber"] != 0.0 || update.After["groupNumber"] != 2.0 ||
+		update.Before["rating"] != 0.0 || update.After["rating"] != 4.0 || update.After["reviewed"] != "true" {
+		t.Errorf("update before %v after %v", update.Before, update.After)
+	}
+	if _, ok := update.After["keywords"]; ok {
+		t.Errorf("unchanged field recorded: %v", update.After)
+	}
+	if del := page.Events[0]; del.After["status"] != "deleted" {
+		t.Errorf("delete after = %v", del.After)
+	}
+
+	page = env.audit("project=" + p.ProjectID)
+	if got := fmt.Sprint(actions(page.Events)); got != "[project.update project.create]" {
+		t.Fatalf("project events = %s", got)
+	}
+	if rename := page.Events[0]; rename.Before["name"] != "Gala" || rename.After["name"] != "Spring Gala" || rename.Actor != testUser {
+		t.Errorf("rename event = %+v", rename)
+	}
+
+	page = env.audit("user=ann&action=" + url.QueryEscape(auditLoginFailed))
+	if len(page.Events) != 1 || page.Events[0].After["reason"] != "wrong password" {
+		t.Errorf("failed logins = %+v", page.Events)
+	}
+	if page := env.audit("action=login"); len(page.Events) != 2 {
+		t.Errorf("logins = %+v", page.Events)
+	}
+	if page := env.audit("from=2000-01-01&to=2000-12-31"); len(page.Events) != 0 {
+		t.Errorf("events outside the range: %+v", page.Events)
+	}
+	if resp := env.call("GET", "/api/audit?from=yesterday", ""); resp.StatusCode != 400 {
+		t.Errorf("bad from: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestAuditPagination(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	now := time.Date(2024, 1, 20, 12, 0, 0, 0, time.UTC)
+	saved := auditClock
+	auditClock = func() time.Time { return now }
+	t.Cleanup(func() { auditClock = saved })
+
+	// Five events spread over three months, with an empty month between
+	var want []string
+	for _, at := range []string{"2024-01-20", "2024-01-21", "2024-03-02", "2024-04-10", "2024-04-11"} {
+		now, _ = time.Parse("2006-01-02", at)
+		env.seedProject("p-"+at, 0)
+		recordAudit(&Caller{Username: testUser}, AuditEvent{Action: auditProjectCreate, ProjectID: "p-" + at})
+		want = append([]string{"p-" + at}, want...)
+	}
+
+	for _, query := range []string{"limit=2", "limit=2&user=" + testUser} {
+		var got []string
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatalf("%s: cursor never ran out", query)
+			}
+			page := env.audit(query + "&to=2024-04-30&cursor=" + cursor)
+			for _, e := range page.Events {
+				if e.Action == auditProjectCreate {
+					got = append(got, e.ProjectID)
+				}
+			}
+			if !page.HasMore {
+				break
+			}
+			cursor = page.NextCursor
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: events = %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestReviewRecordsDoNotCollide(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedImage("img1", nil)
+	env.login()
+	env.call("PUT", "/api/images/img1", `{"groupNumber":1}`)
+	env.call("PUT", "/api/images/img1", `{"groupNumber":2}`)
+
+	page, err := imageStore.(*memImageStore).reviews.scan(ItemScan{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 2 {
+		t.Fatalf("review records = %d, want 2", len(page.Items))
+	}
+	for _, item := range page.Items {
+		if item["Reviewer"] == nil || *item["Reviewer"].S != testUser {
+			t.Errorf("review record without reviewer: %v", item)
+		}
+	}
+}
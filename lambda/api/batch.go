@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/google/uuid"
+)
+
+// POST /api/images/batch applies one patch to many images. The updates are
+// written in transactions of batchTransactSize images. A transaction a
+// condition fails in is retried without the images that failed, so every
+// image gets its own result and the client only has to retry the failures.
+
+const (
+	// maxBatchImages keeps a batch to one BatchGetItem request, and the
+	// writes and moves after it well inside API Gateway's timeout.
+	maxBatchImages    = batchGetSize
+	batchTransactSize = 25
+)
+
+// BatchImagePatch is the change applied to every image of a batch. Unset
+// fields are left alone.
+type BatchImagePatch struct {
+	GroupNumber    *int     `json:"groupNumber,omitempty"`
+	ColorCode      string   `json:"colorCode,omitempty"`
+	Rating         *int     `json:"rating,omitempty"`
+	Promoted       *bool    `json:"promoted,omitempty"`
+	Reviewed       string   `json:"reviewed,omitempty"`
+	AddKeywords    []string `json:"addKeywords,omitempty"`
+	RemoveKeywords []string `json:"removeKeywords,omitempty"`
+}
+
+type BatchUpdateRequest struct {
+	ImageGUIDs []string        `json:"imageGUIDs"`
+	Patch      BatchImagePatch `json:"patch"`
+}
+
+// BatchItemResult is the outcome for one image. Status is the HTTP status
+// a single update of the image would have returned.
+type BatchItemResult struct {
+	ImageGUID string `json:"imageGUID"`
+	Success   bool   `json:"success"`
+	Status    int    `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+type BatchUpdateResponse struct {
+	Results   []BatchItemResult `json:"results"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+}
+
+func (p BatchImagePatch) validate() error {
+	if p.GroupNumber == nil && p.ColorCode == "" && p.Rating == nil && p.Promoted == nil &&
+		p.Reviewed == "" && len(p.AddKeywords) == 0 && len(p.RemoveKeywords) == 0 {
+		return errors.New("Patch must change at least one field")
+	}
+	if p.GroupNumber != nil && (*p.GroupNumber < 0 || *p.GroupNumber > 5) {
+		return errors.New("groupNumber must be between 0 and 5")
+	}
+	if p.Rating != nil && (*p.Rating < 0 || *p.Rating > 5) {
+		return errors.New("rating must be between 0 and 5")
+	}
+	if p.Reviewed != "" && p.Reviewed != "true" && p.Reviewed != "false" {
+		return errors.New("reviewed must be true or false")
+	}
+	return nil
+}
+
+// apply returns the image as it is after the patch.
+func (p BatchImagePatch) apply(img ImageResponse) ImageResponse {
+	if p.GroupNumber != nil {
+		img.GroupNumber = *p.GroupNumber
+	}
+	if p.ColorCode != "" {
+		img.ColorCode = p.ColorCode
+	}
+	if p.Rating != nil {
+		img.Rating = *p.Rating
+	}
+	if p.Promoted != nil {
+		img.Promoted = *p.Promoted
+	}
+	if p.Reviewed != "" {
+		img.Reviewed = p.Reviewed
+	}
+	if len(p.AddKeywords) > 0 || len(p.RemoveKeywords) > 0 {
+		remove := make(map[string]bool)
+		for _, kw := range p.RemoveKeywords {
+			remove[strings.ToLower(kw)] = true
+		}
+		seen := make(map[string]bool)
+		var keywords []string
+		for _, kw := range append(append([]string{}, img.Keywords...), p.AddKeywords...) {
+			lower := strings.ToLower(kw)
+			if kw == "" || remove[lower] || seen[lower] {
+				continue
+			}
+			seen[lower] = true
+			keywords = append(keywords, kw)
+		}
+		img.Keywords = keywords
+	}
+	return img
+}
+
+// batchItem is one image of a batch on its way to being written.
+type batchItem struct {
+	img     ImageResponse
+	updated ImageResponse
+	update  ItemUpdate
+	// Set when the update approves or rejects the image
+	destPrefix string
+	newStatus  string
+}
+
+// prepareBatchItem builds the update of one image. Its condition fails if
+// the image was deleted or changed by someone else in the meantime; being
+// reviewed meanwhile is checked on its own too, since that decides whether
+// its files move.
+func prepareBatchItem(img ImageResponse, patch BatchImagePatch) batchItem {
+	item := batchItem{img: img, updated: patch.apply(img)}
+	updated := item.updated
+
+	sets := []string{"UpdatedDateTime = :updated"}
+	var removes []string
+	values := map[string]*dynamodb.AttributeValue{
+		":updated": {S: aws.String(time.Now().Format(time.RFC3339))},
+	}
+	if patch.GroupNumber != nil {
+		sets = append(sets, "GroupNumber = :group")
+		values[":group"] = &dynamodb.AttributeValue{N: aws.String(fmt.Sprintf("%d", updated.GroupNumber))}
+	}
+	if patch.ColorCode != "" {
+		sets = append(sets, "ColorCode = :color")
+		values[":color"] = &dynamodb.AttributeValue{S: aws.String(updated.ColorCode)}
+	}
+	if patch.Rating != nil {
+		sets = append(sets, "Rating = :rating")
+		values[":rating"] = &dynamodb.AttributeValue{N: aws.String(fmt.Sprintf("%d", updated.Rating))}
+	}
+	if patch.Promoted != nil {
+		sets = append(sets, "Promoted = :promoted")
+		values[":promoted"] = &dynamodb.AttributeValue{BOOL: aws.Bool(updated.Promoted)}
+	}
+	if len(patch.AddKeywords) > 0 || len(patch.RemoveKeywords) > 0 {
+		if len(updated.Keywords) > 0 {
+			keywordsList := make([]*dynamodb.AttributeValue, len(updated.Keywords))
+			for i, kw := range updated.Keywords {
+				keywordsList[i] = &dynamodb.AttributeValue{S: aws.String(kw)}
+			}
+			sets = append(sets, "Keywords = :keywords")
+			values[":keywords"] = &dynamodb.AttributeValue{L: keywordsList}
+		} else {
+			removes = append(removes, "Keywords")
+		}
+	}
+	if patch.Reviewed != "" {
+		sets = append(sets, "Reviewed = :reviewed")
+		values[":reviewed"] = &dynamodb.AttributeValue{S: aws.String(updated.Reviewed)}
+	}
+	if updated.Reviewed == "true" && img.Reviewed == "false" {
+		item.destPrefix, item.newStatus = reviewDestination(img, updated.GroupNumber)
+		sets = append(sets, "MoveStatus = :moveStatus")
+		values[":moveStatus"] = &dynamodb.AttributeValue{S: aws.String("pending")}
+	}
+
+	expr := "SET " + strings.Join(sets, ", ")
+	if len(removes) > 0 {
+		expr += " REMOVE " + strings.Join(removes, ", ")
+	}
+	condition := "attribute_exists(ImageGUID) AND attribute_not_exists(Reviewed)"
+	if img.Reviewed != "" {
+		condition = "Reviewed = :wasReviewed"
+		values[":wasReviewed"] = &dynamodb.AttributeValue{S: aws.String(img.Reviewed)}
+	}
+	item.update = versioned(ItemUpdate{
+		Expression: expr,
+		Condition:  condition,
+		Values:     values,
+	}, img.Version)
+	return item
+}
+
+// writeBatch writes the items in one transaction, dropping items whose
+// condition failed and trying again with the rest. It returns the error for
+// each item that was not written.
+func writeBatch(items []batchItem) map[string]BatchItemResult {
+	failed := make(map[string]BatchItemResult)
+	pending := items
+	for round := 0; len(pending) > 0; round++ {
+		updates := make([]KeyedUpdate, len(pending))
+		for i, item := range pending {
+			updates[i] = KeyedUpdate{ID: item.img.ImageGUID, ItemUpdate: item.update}
+		}
+		err := withRetryNoResult(func() error {
+			return imageStore.UpdateImages(updates)
+		})
+		if err == nil {
+			return failed
+		}
+
+		var canceled *dynamodb.TransactionCanceledException
+		if !errors.As(err, &canceled) || round >= maxRetries {
+			fmt.Printf("Error writing batch of %d images: %v\n", len(pending), err)
+			for _, item := range pending {
+				failed[item.img.ImageGUID] = BatchItemResult{ImageGUID: item.img.ImageGUID, Status: 500, Error: "Failed to update image"}
+			}
+			return failed
+		}
+		// Images that lost a race with another request fail; the rest,
+		// including any cancelled by a conflicting transaction, go again
+		var retry []batchItem
+		for i, item := range pending {
+			if i < len(canceled.CancellationReasons) && aws.StringValue(canceled.CancellationReasons[i].Code) == "ConditionalCheckFailed" {
+				failed[item.img.ImageGUID] = BatchItemResult{ImageGUID: item.img.ImageGUID, Status: 409, Error: "Image changed during the update, try again"}
+				continue
+			}
+			retry = append(retry, item)
+		}
+		pending = retry
+	}
+	return failed
+}
+
+func handleBatchUpdateImages(caller *Caller, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	var req BatchUpdateRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return errorResponse(400, "Invalid request body", headers)
+	}
+	if len(req.ImageGUIDs) == 0 {
+		return errorResponse(400, "imageGUIDs is required", headers)
+	}
+	if len(req.ImageGUIDs) > maxBatchImages {
+		return errorResponse(400, fmt.Sprintf("At most %d images can be updated at once", maxBatchImages), headers)
+	}
+	if err := req.Patch.validate(); err != nil {
+		return errorResponse(400, err.Error(), headers)
+	}
+
+	results := make([]BatchItemResult, len(req.ImageGUIDs))
+	first := make(map[string]int)
+	var ids []string
+	for i, imageID := range req.ImageGUIDs {
+		results[i] = BatchItemResult{ImageGUID: imageID, Status: 200}
+		if _, dup := first[imageID]; !dup {
+			first[imageID] = i
+			ids = append(ids, imageID)
+		}
+	}
+	read, err := withRetry(func() ([]Item, error) {
+		return imageStore.GetImages(ids, "", nil)
+	})
+	if err != nil {
+		fmt.Printf("Error getting %d images: %v\n", len(ids), err)
+		return errorResponse(500, "Failed to load images", headers)
+	}
+	byID := make(map[string]Item, len(read))
+	for _, item := range read {
+		byID[aws.StringValue(item["ImageGUID"].S)] = item
+	}
+
+	var items []batchItem
+	access := make(map[string]error) // by project ID
+	for _, imageID := range ids {
+		i := first[imageID]
+		imgItem := byID[imageID]
+		if imgItem == nil {
+			results[i] = BatchItemResult{ImageGUID: imageID, Status: 404, Error: "Image not found"}
+			continue
+		}
+		var img ImageResponse
+		dynamodbattribute.UnmarshalMap(imgItem, &img)
+		accessErr, checked := access[img.ProjectID]
+		if !checked {
+			accessErr = checkImageAccess(caller, img, projectEditor)
+			access[img.ProjectID] = accessErr
+		}
+		if accessErr != nil {
+			status, message := projectAccessStatus(accessErr)
+			results[i] = BatchItemResult{ImageGUID: imageID, Status: status, Error: message}
+			continue
+		}
+		items = append(items, prepareBatchItem(img, req.Patch))
+	}
+
+	failed := make(map[string]BatchItemResult)
+	for start := 0; start < len(items); start += batchTransactSize {
+		end := start + batchTransactSize
+		if end > len(items) {
+			end = len(items)
+		}
+		for id, result := range writeBatch(items[start:end]) {
+			failed[id] = result
+		}
+	}
+
+	var steps []UndoStep
+	for _, item := range items {
+		imageID := item.img.ImageGUID
+		if _, ok := failed[imageID]; ok {
+			continue
+		}
+		steps = append(steps, undoStepFor(item.img))
+		before, after := auditDiff(imageAuditFields(item.img), imageAuditFields(item.updated))
+		recordAudit(caller, AuditEvent{Action: auditImageUpdate, ImageGUID: imageID, ProjectID: item.img.ProjectID, Before: before, After: after})
+		withRetryNoResult(func() error {
+			return imageStore.PutReviewRecord(map[string]*dynamodb.AttributeValue{
+				"ReviewID":    {S: aws.String(fmt.Sprintf("review_%d_%s", time.Now().Unix(), uuid.New().String()))},
+				"ImageGUID":   {S: aws.String(imageID)},
+				"GroupNumber": {N: aws.String(fmt.Sprintf("%d", item.updated.GroupNumber))},
+				"ColorCode":   {S: aws.String(item.updated.ColorCode)},
+				"Promoted":    {BOOL: aws.Bool(item.updated.Promoted)},
+				"Reviewer":    {S: aws.String(caller.Username)},
+				"Timestamp":   {S: aws.String(time.Now().Format(time.RFC3339))},
+			})
+		})
+		if item.destPrefix != "" {
+			if _, err := triggerAsyncMove(imageID, item.destPrefix, item.newStatus, bucketName, caller.Username); err != nil {
+				fmt.Printf("Error triggering async move for %s: %v\n", imageID, err)
+				// The image stays pending like a single update would
+			}
+		}
+	}
+	if err := pushUndoSteps(caller, steps...); err != nil {
+		fmt.Printf("Failed to record undo steps for batch: %v\n", err)
+	}
+
+	response := BatchUpdateResponse{Results: results}
+	for i, result := range results {
+		if f, ok := failed[result.ImageGUID]; ok {
+			results[i] = f
+		} else if j := first[result.ImageGUID]; j != i {
+			// A repeated GUID shares the result of its first occurrence
+			results[i] = results[j]
+		}
+		if results[i].Success = results[i].Status == 200; results[i].Success {
+			response.Succeeded++
+		} else {
+			response.Failed++
+		}
+	}
+
+	body, _ := json.Marshal(response)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func (env *testEnv) batch(body string) BatchUpdateResponse {
+	env.t.Helper()
+	resp := env.call("POST", "/api/images/batch", body)
+	var out BatchUpdateResponse
+	if err := json.Unmarshal([]byte(resp.Body), &out); err != nil || resp.StatusCode != 200 {
+		env.t.Fatalf("batch: %d %s", resp.StatusCode, resp.Body)
+	}
+	return out
+}
+
+func statuses(results []BatchItemResult) string {
+	var out []string
+	for _, r := range results {
+		out = append(out, fmt.Sprintf("%s:%d", r.ImageGUID, r.Status))
+	}
+	return fmt.Sprint(out)
+}
+
+// racingImageStore runs race just before the first transaction, like
+// another request landing between the batch's reads and its writes.
+type racingImageStore struct {
+	ImageStore
+	race func()
+}
+
+func (s *racingImageStore) UpdateImages(updates []KeyedUpdate) error {
+	if s.race != nil {
+		s.race()
+		s.race = nil
+	}
+	return s.ImageStore.UpdateImages(updates)
+}
+
+func TestBatchUpdate(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedImage("a", nil)
+	env.seedImage("b", nil)
+	env.seedImage("c", map[string]interface{}{"Keywords": []string{"Bird", "sky"}})
+	env.login()
+
+	out := env.batch(`{"imageGUIDs":["a","b","c","missing","a"],"patch":{"groupNumber":2,"colorCode":"yellow","reviewed":"true","addKeywords":["bird","Kite"],"removeKeywords":["SKY"]}}`)
+	if got := statuses(out.Results); got != "[a:200 b:200 c:200 missing:404 a:200]" {
+		t.Fatalf("results = %s", got)
+	}
+	if out.Succeeded != 4 || out.Failed != 1 || out.Results[3].Success || out.Results[3].Error != "Image not found" {
+		t.Errorf("response = %+v", out)
+	}
+	if moves := env.runAsyncMoves(); moves != 3 {
+		t.Errorf("async moves = %d, want 3", moves)
+	}
+	img := env.image("c")
+	if img.Status != "approved" || img.GroupNumber != 2 || fmt.Sprint(img.Keywords) != "[Bird Kite]" {
+		t.Errorf("c = %+v", img)
+	}
+	env.assertFilesUnder("c", "approved/yellow/"+testDatePath)
+	if steps := env.undoStack(); len(steps) != 3 {
+		t.Errorf("undo steps = %d, want 3", len(steps))
+	}
+	if page := env.audit("image=b"); len(page.Events) != 1 || page.Events[0].After["reviewed"] != "true" {
+		t.Errorf("audit = %+v", page.Events)
+	}
+
+	// Rating reviewed images moves nothing
+	out = env.batch(`{"imageGUIDs":["a","b"],"patch":{"rating":5}}`)
+	if out.Succeeded != 2 || env.runAsyncMoves() != 0 || env.image("a").Rating != 5 || env.image("a").GroupNumber != 2 {
+		t.Errorf("rating batch = %+v, a = %+v", out, env.image("a"))
+	}
+
+	tooMany, _ := json.Marshal(BatchUpdateRequest{ImageGUIDs: make([]string, maxBatchImages+1), Patch: BatchImagePatch{Rating: aws.Int(1)}})
+	for _, body := range []string{
+		string(tooMany),
+		`{"imageGUIDs":[],"patch":{"rating":1}}`,
+		`{"imageGUIDs":["a"],"patch":{}}`,
+		`{"imageGUIDs":["a"],"patch":{"rating":9}}`,
+		`{"imageGUIDs":["a"],"patch":{"reviewed":"maybe"}}`,
+	} {
+		if resp := env.call("POST", "/api/images/batch", body); resp.StatusCode != 400 {
+			t.Errorf("%s: status = %d, want 400", body, resp.StatusCode)
+		}
+	}
+}
+
+func TestBatchUpdateReportsFailures(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedUser("ann", roleReviewer)
+	env.seedProject("theirs", 1)
+	env.seedImage("a", nil)
+	env.seedImage("b", nil)
+	env.seedImage("c", nil)
+	env.seedImage("p", map[string]interface{}{"Status": "project", "ProjectID": "theirs"})
+	env.loginAs("ann", testPassword)
+
+	// Someone else rejects b after the batch read it
+	imageStore = &racingImageStore{ImageStore: imageStore, race: func() {
+		imageStore.(*racingImageStore).ImageStore.UpdateImage("b", ItemUpdate{
+			Expression: "SET Reviewed = :r",
+			Values:     map[string]*dynamodb.AttributeValue{":r": {S: aws.String("true")}},
+		})
+	}}
+
+	out := env.batch(`{"imageGUIDs":["a","b","c","p"],"patch":{"groupNumber":1,"reviewed":"true"}}`)
+	if got := statuses(out.Results); got != "[a:200 b:409 c:200 p:403]" {
+		t.Fatalf("results = %s", got)
+	}
+	if moves := env.runAsyncMoves(); moves != 2 {
+		t.Errorf("async moves = %d, want 2", moves)
+	}
+	if img := env.image("b"); img.GroupNumber != 0 || img.MoveStatus != "" {
+		t.Errorf("failed image was written: %+v", img)
+	}
+	if img := env.image("a"); img.Status != "approved" {
+		t.Errorf("a = %+v", img)
+	}
+}
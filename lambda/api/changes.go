@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Every write to an image or project reaches the change log through the
+// tables' streams (in self-hosted mode and the tests, straight from the
+// stores), so clients can keep a cache current with GET /api/changes instead
+// of reloading whole listings.
+//
+// The log is one partition of the changes table, numbered from 1 by Seq.
+// A change is appended by a conditional put of the number after the newest
+// one, retried when another writer took it, so numbers are never skipped
+// and a change is never visible before the ones numbered below it. A token
+// is the number of the last change a client has seen. Changes expire after
+// changeRetention; a gap in the numbers means some did, and the client must
+// reload. A head item, Seq 0, keeps the newest number once they all have.
+//
+// Numbering through one partition serializes the log: appends take turns at
+// about a thousand writes a second, a partition's limit, and fewer when
+// writers collide on a number. Image and project writes aren't held up by
+// it, since the streams feed the log, but past that rate the streams fall
+// behind and the feed lags. Reads of the log are strongly consistent, or a
+// change just appended could look like a gap.
+//
+// A stream batch that fails is delivered again, so its changes can be
+// logged twice. Each carries the item as it was written, so applying them
+// again in order is harmless.
+
+const (
+	changeFeed      = "changes"
+	changeRetention = 14 * 24 * time.Hour
+
+	// appendChange gives up after this many numbers are taken under it
+	maxChangeAttempts = 20
+)
+
+// Change is one entry of the change feed. Images carry the grid fields and
+// projects the whole project, except when deleted.
+type Change struct {
+	Kind      string         `json:"kind"`   // image or project
+	ID        string         `json:"id"`     // ImageGUID or ProjectID
+	Action    string         `json:"action"` // created, updated, moved (images only) or deleted
+	ChangedAt string         `json:"changedAt"`
+	Image     *ImageResponse `json:"image,omitempty"`
+	Project   *Project       `json:"project,omitempty"`
+}
+
+// ChangesResponse is a page of GET /api/changes. NextToken is the since of
+// the next request.
+type ChangesResponse struct {
+	Changes   []Change `json:"changes"`
+	NextToken string   `json:"nextToken"`
+	HasMore   bool     `json:"hasMore"`
+}
+
+// changeAction names a write: created or deleted, moved for an image that
+// changed status or project, which its files follow, or else updated.
+func changeAction(before, after Item) string {
+	switch {
+	case before == nil:
+		return "created"
+	case after == nil:
+		return "deleted"
+	}
+	for _, attr := range []string{"Status", "ProjectID"} {
+		if attrString(before[attr]) != attrString(after[attr]) {
+			return "moved"
+		}
+	}
+	return "updated"
+}
+
+// imageChange is the change log item for a write to an image, less its
+// number. It keeps the projects before and after so the feed can tell who
+// could see the image.
+func imageChange(before, after Item) Item {
+	c := Item{
+		"Kind":   {S: aws.String("image")},
+		"Action": {S: aws.String(changeAction(before, after))},
+	}
+	if after != nil {
+		c["ID"] = after["ImageGUID"]
+		grid := make(Item)
+		for _, attr := range gridAttrs {
+			if av, ok := after[attr]; ok {
+				grid[attr] = av
+			}
+		}
+		c["Item"] = &dynamodb.AttributeValue{M: grid}
+		if projectID := attrString(after["ProjectID"]); projectID != "" {
+			c["ProjectID"] = after["ProjectID"]
+		}
+	} else {
+		c["ID"] = before["ImageGUID"]
+	}
+	if projectID := attrString(before["ProjectID"]); projectID != "" {
+		c["OldProjectID"] = before["ProjectID"]
+	}
+	return c
+}
+
+// projectChange is the change log item for a write to a project, less its
+// number. It keeps the members before so those who lose access are told.
+func projectChange(before, after Item) Item {
+	action := changeAction(before, after)
+	if action == "moved" {
+		action = "updated"
+	}
+	c := Item{
+		"Kind":   {S: aws.String("project")},
+		"Action": {S: aws.String(action)},
+	}
+	if after != nil {
+		c["ID"] = after["ProjectID"]
+		c["Item"] = &dynamodb.AttributeValue{M: after}
+	} else {
+		c["ID"] = before["ProjectID"]
+	}
+	if members := before["Members"]; members != nil && members.M != nil {
+		c["OldMembers"] = members
+	}
+	return c
+}
+
+func changeKey(seq int64) Item {
+	return Item{
+		"Feed": {S: aws.String(changeFeed)},
+		"Seq":  {N: aws.String(strconv.FormatInt(seq, 10))},
+	}
+}
+
+func changeSeq(item Item) int64 {
+	n, _ := strconv.ParseInt(attrString(item["Seq"]), 10, 64)
+	return n
+}
+
+// lastChangeSeq returns the number of the newest change, 0 before the first.
+func lastChangeSeq() (int64, error) {
+	var last int64
+	for _, q := range []ItemQuery{
+		{KeyCondition: "#feed = :feed", Descending: true, Limit: 1},
+		{KeyCondition: "#feed = :feed AND #seq = :head"},
+	} {
+		q.ConsistentRead = true
+		q.Names = map[string]*string{"#feed": aws.String("Feed")}
+		q.Values = Item{":feed": {S: aws.String(changeFeed)}}
+		if strings.Contains(q.KeyCondition, ":head") {
+			q.Names["#seq"] = aws.String("Seq")
+			q.Values[":head"] = &dynamodb.AttributeValue{N: aws.String("0")}
+		}
+		page, err := changeStore.QueryChanges(q)
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range page.Items {
+			if n := changeSeq(item); n > last {
+				last = n
+			}
+			if n, err := strconv.ParseInt(attrString(item["LastSeq"]), 10, 64); err == nil && n > last {
+				last = n
+			}
+		}
+	}
+	return last, nil
+}
+
+// appendChanges adds changes to the end of the log in order.
+func appendChanges(changes []Item) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	last, err := lastChangeSeq()
+	if err != nil {
+		return fmt.Errorf("failed to read the last change: %v", err)
+	}
+	now := time.Now().UTC()
+	for _, c := range changes {
+		c["ChangedAt"] = &dynamodb.AttributeValue{S: aws.String(now.Format(time.RFC3339))}
+		c["ExpiresAt"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(changeRetention).Unix(), 10))}
+		for attempt := 1; ; attempt++ {
+			for k, av := range changeKey(last + 1) {
+				c[k] = av
+			}
+			err := changeStore.PutChange(c, "attribute_not_exists(Feed)", nil)
+			if err == nil {
+				last++
+				break
+			}
+			if !strings.Contains(err.Error(), "ConditionalCheckFailed") || attempt == maxChangeAttempts {
+				return fmt.Errorf("failed to append change %d: %v", last+1, err)
+			}
+			// Another writer took the number
+			if last, err = lastChangeSeq(); err != nil {
+				return fmt.Errorf("failed to read the last change: %v", err)
+			}
+		}
+	}
+
+	head := changeKey(0)
+	head["LastSeq"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(last, 10))}
+	err = changeStore.PutChange(head, "attribute_not_exists(LastSeq) OR LastSeq < :last", Item{":last": head["LastSeq"]})
+	if err != nil && !strings.Contains(err.Error(), "ConditionalCheckFailed") {
+		return fmt.Errorf("failed to update the change log head: %v", err)
+	}
+	return nil
+}
+
+// projectChanged logs a write to a project in self-hosted mode or the tests.
+// before is nil for a new project and after is nil for a deleted one.
+func projectChanged(before, after Item) {
+	if err := appendChanges([]Item{projectChange(before, after)}); err != nil {
+		fmt.Printf("Error logging project change: %v\n", err)
+	}
+}
+
+// visibleChange turns a change log item into the change the caller sees:
+// nothing when they can see the item neither before nor after, created when
+// it comes into view and deleted when it goes out of it.
+func visibleChange(caller *Caller, canSeeProject func(string) bool, item Item) (Change, bool) {
+	c := Change{
+		Kind:      attrString(item["Kind"]),
+		ID:        attrString(item["ID"]),
+		Action:    attrString(item["Action"]),
+		ChangedAt: attrString(item["ChangedAt"]),
+	}
+	var snapshot Item
+	if av := item["Item"]; av != nil {
+		snapshot = av.M
+	}
+
+	var was, is bool
+	var project Project
+	switch c.Kind {
+	case "image":
+		was = canSeeProject(attrString(item["OldProjectID"]))
+		is = canSeeProject(attrString(item["ProjectID"]))
+	case "project":
+		var old Project
+		if av := item["OldMembers"]; av != nil {
+			dynamodbattribute.Unmarshal(av, &old.Members)
+		}
+		was = projectRole(caller, old) != ""
+		if snapshot != nil {
+			dynamodbattribute.UnmarshalMap(snapshot, &project)
+			is = projectRole(caller, project) != ""
+		}
+	default:
+		return c, false
+	}
+
+	switch {
+	case c.Action == "created":
+		if !is {
+			return c, false
+		}
+	case c.Action == "deleted":
+		if !was {
+			return c, false
+		}
+	case !was && !is:
+		return c, false
+	case !is:
+		c.Action = "deleted"
+	case !was:
+		c.Action = "created"
+	}
+	if c.Action == "deleted" || snapshot == nil {
+		return c, true
+	}
+
+	if c.Kind == "image" {
+		var img ImageResponse
+		dynamodbattribute.UnmarshalMap(snapshot, &img)
+		c.Image = &img
+	} else {
+		project.MyRole = projectRole(caller, project)
+		c.Project = &project
+	}
+	return c, true
+}
+
+// handleGetChanges returns the changes after the since token that the
+// caller can see, oldest first. Without since it returns just the token of
+// the newest change, for a client to start from after loading everything.
+func handleGetChanges(caller *Caller, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	params := request.QueryStringParameters
+	// Read before the changes: every change up to last is in the log then
+	last, err := lastChangeSeq()
+	if err != nil {
+		fmt.Printf("Error reading the last change: %v\n", err)
+		return errorResponse(500, "Failed to read changes", headers)
+	}
+	if params["since"] == "" {
+		return listResponse(request, ChangesResponse{Changes: []Change{}, NextToken: strconv.FormatInt(last, 10)}, headers)
+	}
+	since, err := strconv.ParseInt(params["since"], 10, 64)
+	if err != nil || since < 0 {
+		return errorResponse(400, "Invalid since token", headers)
+	}
+	if since >= last {
+		return listResponse(request, ChangesResponse{Changes: []Change{}, NextToken: params["since"]}, headers)
+	}
+
+	page, err := changeStore.QueryChanges(ItemQuery{
+		KeyCondition: "#feed = :feed AND #seq > :since",
+		Names:        map[string]*string{"#feed": aws.String("Feed"), "#seq": aws.String("Seq")},
+		Values: Item{
+			":feed":  {S: aws.String(changeFeed)},
+			":since": {N: aws.String(strconv.FormatInt(since, 10))},
+		},
+		Limit:          int64(listLimit(params)),
+		ConsistentRead: true,
+	})
+	if err != nil {
+		fmt.Printf("Error querying changes: %v\n", err)
+		return errorResponse(500, "Failed to read changes", headers)
+	}
+
+	expired := func() (events.APIGatewayProxyResponse, error) {
+		return errorResponse(410, "Changes since this token have expired; reload and start again without since", headers)
+	}
+	response := ChangesResponse{Changes: []Change{}, HasMore: page.LastKey != nil}
+	canSeeProject := projectFilter(caller)
+	next := since
+	for _, item := range page.Items {
+		if changeSeq(item) != next+1 {
+			return expired()
+		}
+		next++
+		if c, ok := visibleChange(caller, canSeeProject, item); ok {
+			response.Changes = append(response.Changes, c)
+		}
+	}
+	if !response.HasMore && next < last {
+		return expired()
+	}
+	response.NextToken = strconv.FormatInt(next, 10)
+	return listResponse(request, response, headers)
+}
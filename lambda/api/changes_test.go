@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// changes pages through GET /api/changes from since and returns the changes
+// as "kind id action" and the token to continue from.
+func (env *testEnv) changes(since, params string) ([]string, []Change, string) {
+	env.t.Helper()
+	var summary []string
+	var all []Change
+	for pages := 1; ; pages++ {
+		resp := env.call("GET", "/api/changes?since="+since+"&"+params, "")
+		var page ChangesResponse
+		if err := json.Unmarshal([]byte(resp.Body), &page); err != nil || resp.StatusCode != 200 || pages > 50 {
+			env.t.Fatalf("changes since %s page %d: %d %s", since, pages, resp.StatusCode, resp.Body)
+		}
+		for _, c := range page.Changes {
+			summary = append(summary, c.Kind+" "+c.ID+" "+c.Action)
+		}
+		all = append(all, page.Changes...)
+		since = page.NextToken
+		if !page.HasMore {
+			return summary, all, since
+		}
+	}
+}
+
+// changeToken starts a client off at the newest change.
+func (env *testEnv) changeToken() string {
+	env.t.Helper()
+	resp := env.call("GET", "/api/changes", "")
+	var page ChangesResponse
+	if err := json.Unmarshal([]byte(resp.Body), &page); err != nil || resp.StatusCode != 200 || len(page.Changes) != 0 {
+		env.t.Fatalf("change token: %d %s", resp.StatusCode, resp.Body)
+	}
+	return page.NextToken
+}
+
+func TestChangeFeed(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedImage("old", nil)
+	env.login()
+	start := env.changeToken()
+
+	env.seedImage("a", map[string]interface{}{"Description": "A heron"})
+	env.seedProject("p1", 0)
+	if resp := env.call("PUT", "/api/images/a", `{"groupNumber":1,"reviewed":"true"}`); resp.StatusCode != 200 {
+		t.Fatalf("review: %d %s", resp.StatusCode, resp.Body)
+	}
+	env.runAsyncMoves()
+	if err := imageStore.DeleteImage("old"); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, changes, token := env.changes(start, "")
+	got := strings.Join(summary, ", ")
+	if !strings.HasPrefix(got, "image a created, project p1 created, image a updated") ||
+		!strings.Contains(got, "image a moved") || !strings.HasSuffix(got, "image old deleted") {
+		t.Errorf("changes = %s", got)
+	}
+	for _, c := range changes {
+		if c.Kind == "image" && c.Action != "deleted" && (c.Image == nil || c.Image.ImageGUID != c.ID || c.Image.Description != "") {
+			t.Errorf("%s %s carries %+v", c.ID, c.Action, c.Image)
+		}
+	}
+	if last := changes[len(changes)-2].Image; last.Status != "approved" || !strings.HasPrefix(last.OriginalFile, "approved/") {
+		t.Errorf("last change to a = %+v", last)
+	}
+
+	// Small pages list the same changes
+	if paged, _, pagedToken := env.changes(start, "limit=1"); strings.Join(paged, ", ") != got || pagedToken != token {
+		t.Errorf("paged changes = %v to %s, want %s to %s", paged, pagedToken, got, token)
+	}
+	if caughtUp, _, next := env.changes(token, ""); len(caughtUp) != 0 || next != token {
+		t.Errorf("caught up: %v to %s", caughtUp, next)
+	}
+	for _, since := range []string{"abc", "-1"} {
+		if resp := env.call("GET", "/api/changes?since="+since, ""); resp.StatusCode != 400 {
+			t.Errorf("since=%s: status = %d, want 400", since, resp.StatusCode)
+		}
+	}
+	// A token ahead of the log read is one it hasn't caught up with yet
+	if ahead, _, next := env.changes(token+"0", ""); len(ahead) != 0 || next != token+"0" {
+		t.Errorf("ahead: %v to %s", ahead, next)
+	}
+
+	// A gap means changes expired before the client caught up
+	first, _ := strconv.ParseInt(start, 10, 64)
+	first++
+	if err := changeStore.(*memChangeStore).changes.deleteKey(changeKey(first + 1)); err != nil {
+		t.Fatal(err)
+	}
+	if resp := env.call("GET", "/api/changes?since="+start, ""); resp.StatusCode != 410 {
+		t.Errorf("expired: status = %d, want 410", resp.StatusCode)
+	}
+	if rest, _, _ := env.changes(fmt.Sprint(first+1), ""); strings.Join(rest, ", ") != strings.Join(summary[2:], ", ") {
+		t.Errorf("after the gap = %v", rest)
+	}
+}
+
+func TestChangeFeedAccess(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedUser("fred", roleViewer)
+	env.seedProject("p1", 1)
+	env.seedImage("in-p1", map[string]interface{}{"Status": "project", "ProjectID": "p1"})
+	env.loginAs("fred", testPassword)
+	start := env.changeToken()
+
+	env.seedImage("loose", nil)
+	env.seedImage("hidden", map[string]interface{}{"Status": "project", "ProjectID": "p1"})
+	summary, _, token := env.changes(start, "")
+	if got := strings.Join(summary, ", "); got != "image loose created" {
+		t.Errorf("changes = %s", got)
+	}
+
+	env.addMember("p1", "fred", projectViewer)
+	if _, err := imageStore.UpdateImage("in-p1", ItemUpdate{Expression: "SET Rating = :r", Values: Item{":r": {N: aws.String("4")}}}); err != nil {
+		t.Fatal(err)
+	}
+	summary, changes, token := env.changes(token, "")
+	if got := strings.Join(summary, ", "); got != "project p1 created, image in-p1 updated" {
+		t.Errorf("changes = %s", got)
+	}
+	if p := changes[0].Project; p == nil || p.MyRole != projectViewer {
+		t.Errorf("project = %+v", p)
+	}
+
+	// Losing access to a project reads as its deletion
+	if _, err := projectStore.UpdateProject("p1", ItemUpdate{Expression: "REMOVE Members"}); err != nil {
+		t.Fatal(err)
+	}
+	if summary, _, _ := env.changes(token, ""); strings.Join(summary, ", ") != "project p1 deleted" {
+		t.Errorf("changes after removal = %v", summary)
+	}
+}
+
+func TestStreamRecordsLogChanges(t *testing.T) {
+	env := newTestEnv(t)
+	savedImages, savedProjects := imageTable, projectsTable
+	defer func() { imageTable, projectsTable = savedImages, savedProjects }()
+	imageTable, projectsTable = "kill-snap-ImageMetadata", "kill-snap-Projects"
+	env.login()
+	start := env.changeToken()
+
+	record := func(id, name, table, oldImage, newImage string) string {
+		return fmt.Sprintf(`{"eventID": %q, "eventName": %q, "eventSource": "aws:dynamodb",
+			"eventSourceARN": "arn:aws:dynamodb:us-east-1:123456789012:table/%s/stream/2025-01-01T00:00:00.000",
+			"dynamodb": {"Keys": {}, "OldImage": %s, "NewImage": %s}}`, id, name, table, oldImage, newImage)
+	}
+	inbox := `{"ImageGUID": {"S": "a"}, "Status": {"S": "inbox"}, "OriginalFile": {"S": "images/a.jpg"}, "Description": {"S": "long"}}`
+	project := `{"ImageGUID": {"S": "a"}, "Status": {"S": "project"}, "ProjectID": {"S": "p1"}, "OriginalFile": {"S": "p1/a.jpg"}}`
+	batch := `{"Records": [` + strings.Join([]string{
+		record("1", "INSERT", "kill-snap-ImageMetadata", "null", inbox),
+		record("2", "INSERT", "kill-snap-Projects", "null", `{"ProjectID": {"S": "p1"}, "Name": {"S": "Trip"}}`),
+		record("3", "MODIFY", "kill-snap-ImageMetadata", inbox, project),
+		record("4", "REMOVE", "kill-snap-Projects", `{"ProjectID": {"S": "p1"}, "Name": {"S": "Trip"}}`, "null"),
+		record("5", "INSERT", "kill-snap-Users", "null", `{"Username": {"S": "fred"}}`),
+	}, ",") + `]}`
+	if _, err := handleEvent(context.Background(), json.RawMessage(batch)); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, changes, _ := env.changes(start, "")
+	if got := strings.Join(summary, ", "); got != "image a created, project p1 created, image a moved, project p1 deleted" {
+		t.Errorf("changes = %s", got)
+	}
+	if img := changes[2].Image; img == nil || img.OriginalFile != "p1/a.jpg" || img.ProjectID != "p1" {
+		t.Errorf("moved image = %+v", img)
+	}
+	if img := changes[0].Image; img == nil || img.Description != "" {
+		t.Errorf("created image = %+v", img)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Smart collections are named image filters a user saves, kept in the
+// Collections map on their Users row. A collection stores the filter, not
+// its images: each time it is listed the filter is turned into a q query
+// for GET /api/images, so relative dates such as "this month" move on and
+// newly matching images show up.
+
+const (
+	maxCollectionsPerUser = 50
+	maxCollectionNameLen  = 64
+	maxCollectionValueLen = 100
+	maxCollectionQueryLen = 500
+)
+
+// collectionClock is replaced in tests.
+var collectionClock = time.Now
+
+// collectionPeriods are the relative date ranges TakenWithin accepts.
+var collectionPeriods = []string{"today", "this-week", "this-month", "this-year", "last-7-days", "last-30-days"}
+
+// CollectionFilter is what a smart collection matches. Every field set must
+// match. State is an image status, or "unreviewed" for inbox. Dates are
+// YYYY, YYYY-MM or YYYY-MM-DD; TakenWithin is a relative range and can't be
+// combined with them. Query is any further q expression.
+type CollectionFilter struct {
+	State       string   `json:"state,omitempty" dynamodbav:"State,omitempty"`
+	Group       int      `json:"group,omitempty" dynamodbav:"Group,omitempty"`
+	MinRating   *int     `json:"minRating,omitempty" dynamodbav:"MinRating,omitempty"`
+	MaxRating   *int     `json:"maxRating,omitempty" dynamodbav:"MaxRating,omitempty"`
+	Keywords    []string `json:"keywords,omitempty" dynamodbav:"Keywords,omitempty"`
+	TakenFrom   string   `json:"takenFrom,omitempty" dynamodbav:"TakenFrom,omitempty"`
+	TakenTo     string   `json:"takenTo,omitempty" dynamodbav:"TakenTo,omitempty"`
+	TakenWithin string   `json:"takenWithin,omitempty" dynamodbav:"TakenWithin,omitempty"`
+	Camera      string   `json:"camera,omitempty" dynamodbav:"Camera,omitempty"`
+	InProject   *bool    `json:"inProject,omitempty" dynamodbav:"InProject,omitempty"`
+	Query       string   `json:"query,omitempty" dynamodbav:"Query,omitempty"`
+}
+
+// Collection is an entry of the Collections map on a Users row.
+type Collection struct {
+	Name      string           `dynamodbav:"Name"`
+	Filter    CollectionFilter `dynamodbav:"Filter"`
+	CreatedAt string           `dynamodbav:"CreatedAt"`
+	UpdatedAt string           `dynamodbav:"UpdatedAt,omitempty"`
+}
+
+// CollectionResponse describes a collection to its owner. Q is the query
+// the filter stands for right now.
+type CollectionResponse struct {
+	ID        string           `json:"id"`
+	Name      string           `json:"name"`
+	Filter    CollectionFilter `json:"filter"`
+	Q         string           `json:"q"`
+	CreatedAt string           `json:"createdAt"`
+	UpdatedAt string           `json:"updatedAt,omitempty"`
+}
+
+type CollectionRequest struct {
+	Name   string           `json:"name"`
+	Filter CollectionFilter `json:"filter"`
+}
+
+// quoteQueryValue quotes a value for the q language unless it is a plain
+// word. The language has no escapes, so values can't contain quotes.
+func quoteQueryValue(s string) string {
+	if strings.IndexFunc(s, func(r rune) bool {
+		return r == ' ' || r == '(' || r == ')' || r == '=' || r == '<' || r == '>' || r == '!' || r == ':'
+	}) >= 0 {
+		return `"` + s + `"`
+	}
+	return s
+}
+
+// collectionPeriod returns the taken range a relative period covers on the
+// given day.
+func collectionPeriod(period string, now time.Time) string {
+	day := func(t time.Time) string { return t.Format("2006-01-02") }
+	switch period {
+	case "today":
+		return day(now)
+	case "this-week":
+		// Weeks start on Monday
+		offset := (int(now.Weekday()) + 6) % 7
+		return day(now.AddDate(0, 0, -offset)) + ".." + day(now)
+	case "this-month":
+		return now.Format("2006-01")
+	case "this-year":
+		return now.Format("2006")
+	case "last-7-days":
+		return day(now.AddDate(0, 0, -6)) + ".." + day(now)
+	case "last-30-days":
+		return day(now.AddDate(0, 0, -29)) + ".." + day(now)
+	}
+	return ""
+}
+
+// collectionQuery turns a filter into a q query as of now, checking it
+// plans.
+func collectionQuery(f CollectionFilter, now time.Time) (string, error) {
+	var terms []string
+	for _, s := range append([]string{f.Camera, f.TakenFrom, f.TakenTo}, f.Keywords...) {
+		if strings.Contains(s, `"`) {
+			return "", fmt.Errorf("filter values can't contain quotes")
+		}
+		if len(s) > maxCollectionValueLen {
+			return "", fmt.Errorf("filter values must be at most %d characters", maxCollectionValueLen)
+		}
+	}
+
+	switch f.State {
+	case "":
+	case "unreviewed":
+		terms = append(terms, "status:inbox")
+	default:
+		if !containsString(queryStatuses, f.State) {
+			return "", fmt.Errorf("state must be unreviewed or one of %s", strings.Join(queryStatuses, ", "))
+		}
+		terms = append(terms, "status:"+f.State)
+	}
+	if f.Group != 0 {
+		terms = append(terms, fmt.Sprintf("group:%d", f.Group))
+	}
+	if f.MinRating != nil || f.MaxRating != nil {
+		lo, hi := "", ""
+		if f.MinRating != nil {
+			lo = fmt.Sprint(*f.MinRating)
+		}
+		if f.MaxRating != nil {
+			hi = fmt.Sprint(*f.MaxRating)
+		}
+		terms = append(terms, "rating:"+lo+".."+hi)
+	}
+	for _, kw := range f.Keywords {
+		if kw = strings.TrimSpace(kw); kw != "" {
+			terms = append(terms, "keyword:"+quoteQueryValue(kw))
+		}
+	}
+	if f.TakenWithin != "" {
+		if f.TakenFrom != "" || f.TakenTo != "" {
+			return "", fmt.Errorf("takenWithin can't be combined with takenFrom or takenTo")
+		}
+		if !containsString(collectionPeriods, f.TakenWithin) {
+			return "", fmt.Errorf("takenWithin must be one of %s", strings.Join(collectionPeriods, ", "))
+		}
+		terms = append(terms, "taken:"+collectionPeriod(f.TakenWithin, now))
+	} else if f.TakenFrom != "" || f.TakenTo != "" {
+		terms = append(terms, "taken:"+f.TakenFrom+".."+f.TakenTo)
+	}
+	if camera := strings.TrimSpace(f.Camera); camera != "" {
+		terms = append(terms, "camera:"+quoteQueryValue(camera))
+	}
+	if f.InProject != nil {
+		if *f.InProject {
+			terms = append(terms, "project")
+		} else {
+			terms = append(terms, "NOT project")
+		}
+	}
+	if q := strings.TrimSpace(f.Query); q != "" {
+		if len(q) > maxCollectionQueryLen {
+			return "", fmt.Errorf("query must be at most %d characters", maxCollectionQueryLen)
+		}
+		terms = append(terms, "("+q+")")
+	}
+	if len(terms) == 0 {
+		return "", fmt.Errorf("a collection needs at least one filter")
+	}
+
+	q := strings.Join(terms, " AND ")
+	if _, err := planImageQuery(q); err != nil {
+		return "", err
+	}
+	return q, nil
+}
+
+// userCollections returns the collections stored on a Users row by ID.
+func userCollections(userItem map[string]*dynamodb.AttributeValue) map[string]Collection {
+	collections := make(map[string]Collection)
+	if attr := userItem["Collections"]; attr != nil && attr.M != nil {
+		dynamodbattribute.UnmarshalMap(attr.M, &collections)
+	}
+	return collections
+}
+
+func collectionResponse(id string, c Collection) CollectionResponse {
+	// Filters are checked when saved, so only a relative date changes q
+	q, _ := collectionQuery(c.Filter, collectionClock())
+	return CollectionResponse{
+		ID:        id,
+		Name:      c.Name,
+		Filter:    c.Filter,
+		Q:         q,
+		CreatedAt: c.CreatedAt,
+		UpdatedAt: c.UpdatedAt,
+	}
+}
+
+// getCollection loads one of the caller's collections. ok is false when it
+// doesn't exist.
+func getCollection(caller *Caller, id string) (c Collection, ok bool, err error) {
+	userItem, err := userStore.GetUser(caller.Username)
+	if err != nil || userItem == nil {
+		return c, false, err
+	}
+	c, ok = userCollections(userItem)[id]
+	return c, ok, nil
+}
+
+// parseCollectionRequest reads and checks a create or update body.
+func parseCollectionRequest(body string) (CollectionRequest, error) {
+	var req CollectionRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		return req, fmt.Errorf("Invalid request body")
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxCollectionNameLen {
+		return req, fmt.Errorf("Collection name must be 1-%d characters", maxCollectionNameLen)
+	}
+	if _, err := collectionQuery(req.Filter, collectionClock()); err != nil {
+		return req, err
+	}
+	return req, nil
+}
+
+func handleListCollections(caller *Caller, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	userItem, err := userStore.GetUser(caller.Username)
+	if err != nil {
+		fmt.Printf("Failed to get user %s: %v\n", caller.Username, err)
+		return errorResponse(500, "Failed to list collections", headers)
+	}
+
+	collections := make([]CollectionResponse, 0)
+	for id, c := range userCollections(userItem) {
+		collections = append(collections, collectionResponse(id, c))
+	}
+	sort.Slice(collections, func(i, j int) bool {
+		return strings.ToLower(collections[i].Name) < strings.ToLower(collections[j].Name)
+	})
+
+	body, _ := json.Marshal(collections)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+func handleCreateCollection(caller *Caller, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	req, err := parseCollectionRequest(request.Body)
+	if err != nil {
+		return errorResponse(400, err.Error(), headers)
+	}
+
+	userItem, err := userStore.GetUser(caller.Username)
+	if err != nil || userItem == nil {
+		fmt.Printf("Failed to get user %s: %v\n", caller.Username, err)
+		return errorResponse(500, "Failed to create collection", headers)
+	}
+	if len(userCollections(userItem)) >= maxCollectionsPerUser {
+		return errorResponse(400, fmt.Sprintf("A user can have at most %d collections", maxCollectionsPerUser), headers)
+	}
+
+	id, err := randomToken(9)
+	if err != nil {
+		return errorResponse(500, "Failed to create collection", headers)
+	}
+	stored := Collection{
+		Name:      req.Name,
+		Filter:    req.Filter,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+	storedAV, err := dynamodbattribute.MarshalMap(stored)
+	if err != nil {
+		return errorResponse(500, "Failed to create collection", headers)
+	}
+
+	if userItem["Collections"] == nil {
+		// Nested SETs need the map to exist first
+		_, err = userStore.UpdateUser(caller.Username, ItemUpdate{
+			Expression: "SET Collections = if_not_exists(Collections, :empty)",
+			Condition:  "attribute_exists(Username)",
+			Values: map[string]*dynamodb.AttributeValue{
+				":empty": {M: map[string]*dynamodb.AttributeValue{}},
+			},
+		})
+		if err != nil {
+			fmt.Printf("Failed to create collection for %s: %v\n", caller.Username, err)
+			return errorResponse(500, "Failed to create collection", headers)
+		}
+	}
+	_, err = userStore.UpdateUser(caller.Username, ItemUpdate{
+		Expression: "SET Collections.#id = :collection",
+		Condition:  "attribute_exists(Username)",
+		Names:      map[string]*string{"#id": aws.String(id)},
+		Values: map[string]*dynamodb.AttributeValue{
+			":collection": {M: storedAV},
+		},
+	})
+	if err != nil {
+		fmt.Printf("Failed to create collection for %s: %v\n", caller.Username, err)
+		return errorResponse(500, "Failed to create collection", headers)
+	}
+
+	body, _ := json.Marshal(collectionResponse(id, stored))
+	return events.APIGatewayProxyResponse{
+		StatusCode: 201,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+func handleGetCollection(caller *Caller, id string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	c, ok, err := getCollection(caller, id)
+	if err != nil {
+		fmt.Printf("Failed to get collection %s for %s: %v\n", id, caller.Username, err)
+		return errorResponse(500, "Failed to get collection", headers)
+	}
+	if !ok {
+		return errorResponse(404, "Collection not found", headers)
+	}
+
+	body, _ := json.Marshal(collectionResponse(id, c))
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// handleUpdateCollection replaces a collection's name and filter.
+func handleUpdateCollection(caller *Caller, id string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	req, err := parseCollectionRequest(request.Body)
+	if err != nil {
+		return errorResponse(400, err.Error(), headers)
+	}
+	filterAV, err := dynamodbattribute.MarshalMap(req.Filter)
+	if err != nil {
+		return errorResponse(500, "Failed to update collection", headers)
+	}
+
+	updatedItem, err := userStore.UpdateUser(caller.Username, ItemUpdate{
+		Expression: "SET Collections.#id.#name = :name, Collections.#id.#filter = :filter, Collections.#id.UpdatedAt = :now",
+		Condition:  "attribute_exists(Collections.#id)",
+		Names:      map[string]*string{"#id": aws.String(id), "#name": aws.String("Name"), "#filter": aws.String("Filter")},
+		Values: map[string]*dynamodb.AttributeValue{
+			":name":   {S: aws.String(req.Name)},
+			":filter": {M: filterAV},
+			":now":    {S: aws.String(time.Now().Format(time.RFC3339))},
+		},
+		ReturnValues: dynamodb.ReturnValueAllNew,
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "ConditionalCheckFailed") {
+			return errorResponse(404, "Collection not found", headers)
+		}
+		fmt.Printf("Failed to update collection %s for %s: %v\n", id, caller.Username, err)
+		return errorResponse(500, "Failed to update collection", headers)
+	}
+
+	body, _ := json.Marshal(collectionResponse(id, userCollections(updatedItem)[id]))
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+func handleDeleteCollection(caller *Caller, id string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	_, err := userStore.UpdateUser(caller.Username, ItemUpdate{
+		Expression: "REMOVE Collections.#id",
+		Condition:  "attribute_exists(Collections.#id)",
+		Names:      map[string]*string{"#id": aws.String(id)},
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "ConditionalCheckFailed") {
+			return errorResponse(404, "Collection not found", headers)
+		}
+		fmt.Printf("Failed to delete collection %s for %s: %v\n", id, caller.Username, err)
+		return errorResponse(500, "Failed to delete collection", headers)
+	}
+
+	body, _ := json.Marshal(map[string]bool{"success": true})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// handleListCollectionImages serves GET /api/collections/{id}/images: the
+// collection's filter as of now, listed by handleListImages with the
+// request's cursor, limit, sort and fields.
+func handleListCollectionImages(caller *Caller, id string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	c, ok, err := getCollection(caller, id)
+	if err != nil {
+		fmt.Printf("Failed to get collection %s for %s: %v\n", id, caller.Username, err)
+		return errorResponse(500, "Failed to get collection", headers)
+	}
+	if !ok {
+		return errorResponse(404, "Collection not found", headers)
+	}
+	q, err := collectionQuery(c.Filter, collectionClock())
+	if err != nil {
+		return errorResponse(400, fmt.Sprintf("Collection filter is no longer valid: %v", err), headers)
+	}
+
+	list := request
+	list.QueryStringParameters = map[string]string{"q": q}
+	for _, param := range []string{"cursor", "limit", "sort", "order", "fields"} {
+		if v := request.QueryStringParameters[param]; v != "" {
+			list.QueryStringParameters[param] = v
+		}
+	}
+	return handleListImages(caller, list, headers)
+}
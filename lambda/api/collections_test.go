@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createCollection saves a collection and returns it.
+func (env *testEnv) createCollection(body string) CollectionResponse {
+	env.t.Helper()
+	resp := env.call("POST", "/api/collections", body)
+	var c CollectionResponse
+	if err := json.Unmarshal([]byte(resp.Body), &c); err != nil || resp.StatusCode != 201 {
+		env.t.Fatalf("create collection: %d %s", resp.StatusCode, resp.Body)
+	}
+	return c
+}
+
+func TestCollectionQuery(t *testing.T) {
+	now := time.Date(2025, 7, 17, 9, 0, 0, 0, time.UTC) // a Thursday
+	four, five := 4, 5
+	no := false
+	for _, tc := range []struct {
+		filter CollectionFilter
+		want   string
+	}{
+		{CollectionFilter{MinRating: &four, InProject: &no, TakenWithin: "this-month"}, "rating:4.. AND taken:2025-07 AND NOT project"},
+		{CollectionFilter{State: "unreviewed", Group: 2}, "status:inbox AND group:2"},
+		{CollectionFilter{MaxRating: &five, Keywords: []string{"heron", "grey heron"}}, `rating:..5 AND keyword:heron AND keyword:"grey heron"`},
+		{CollectionFilter{TakenFrom: "2025-06", Camera: "X-T5", Query: "promoted OR rating:5"}, "taken:2025-06.. AND camera:X-T5 AND (promoted OR rating:5)"},
+		{CollectionFilter{TakenWithin: "this-week"}, "taken:2025-07-14..2025-07-17"},
+		{CollectionFilter{TakenWithin: "last-30-days"}, "taken:2025-06-18..2025-07-17"},
+	} {
+		if got, err := collectionQuery(tc.filter, now); err != nil || got != tc.want {
+			t.Errorf("%+v: got %q, %v, want %q", tc.filter, got, err, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		filter CollectionFilter
+		want   string
+	}{
+		{CollectionFilter{}, "at least one filter"},
+		{CollectionFilter{State: "lost"}, "state must be"},
+		{CollectionFilter{TakenWithin: "someday"}, "takenWithin must be one of"},
+		{CollectionFilter{TakenWithin: "today", TakenFrom: "2025"}, "can't be combined"},
+		{CollectionFilter{Camera: `X"T5`}, "can't contain quotes"},
+		{CollectionFilter{MinRating: &five, MaxRating: &four}, "range 5..4 is empty"},
+		{CollectionFilter{Query: "rating>"}, "invalid query"},
+	} {
+		if _, err := collectionQuery(tc.filter, now); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%+v: error %v, want %q", tc.filter, err, tc.want)
+		}
+	}
+}
+
+func TestCollectionsCRUD(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedUser("fred", roleViewer)
+	env.loginAs("fred", testPassword)
+
+	c := env.createCollection(`{"name":"Keepers","filter":{"minRating":4}}`)
+	if c.ID == "" || c.Q != "rating:4.." {
+		t.Fatalf("created %+v", c)
+	}
+	env.createCollection(`{"name":"all herons","filter":{"keywords":["heron"]}}`)
+
+	resp := env.call("PUT", "/api/collections/"+c.ID, `{"name":"Best","filter":{"minRating":5,"state":"approved"}}`)
+	var updated CollectionResponse
+	json.Unmarshal([]byte(resp.Body), &updated)
+	if resp.StatusCode != 200 || updated.Name != "Best" || updated.Q != "status:approved AND rating:5.." || updated.CreatedAt != c.CreatedAt {
+		t.Fatalf("update: %d %s", resp.StatusCode, resp.Body)
+	}
+
+	resp = env.call("GET", "/api/collections", "")
+	var list []CollectionResponse
+	json.Unmarshal([]byte(resp.Body), &list)
+	if len(list) != 2 || list[0].Name != "all herons" || list[1].Name != "Best" {
+		t.Fatalf("list: %s", resp.Body)
+	}
+
+	for _, tc := range []struct{ method, body string }{
+		{"POST", `{"name":"","filter":{"minRating":4}}`},
+		{"POST", `{"name":"Empty","filter":{}}`},
+		{"PUT", `{"name":"Bad","filter":{"takenFrom":"June"}}`},
+	} {
+		path := "/api/collections"
+		if tc.method == "PUT" {
+			path += "/" + c.ID
+		}
+		if resp := env.call(tc.method, path, tc.body); resp.StatusCode != 400 {
+			t.Errorf("%s %s: status = %d, want 400", tc.method, tc.body, resp.StatusCode)
+		}
+	}
+
+	// Collections are private to their owner
+	env.login()
+	if resp := env.call("GET", "/api/collections/"+c.ID, ""); resp.StatusCode != 404 {
+		t.Errorf("other user's collection: status = %d, want 404", resp.StatusCode)
+	}
+	if resp := env.call("DELETE", "/api/collections/"+c.ID, ""); resp.StatusCode != 404 {
+		t.Errorf("delete other user's collection: status = %d, want 404", resp.StatusCode)
+	}
+
+	env.loginAs("fred", testPassword)
+	if resp := env.call("DELETE", "/api/collections/"+c.ID, ""); resp.StatusCode != 200 {
+		t.Errorf("delete: status = %d", resp.StatusCode)
+	}
+	if resp := env.call("GET", "/api/collections/"+c.ID, ""); resp.StatusCode != 404 {
+		t.Errorf("deleted collection: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestCollectionImages(t *testing.T) {
+	env := newTestEnv(t)
+	defer func(clock func() time.Time) { collectionClock = clock }(collectionClock)
+	collectionClock = func() time.Time { return time.Date(2025, 7, 17, 9, 0, 0, 0, time.UTC) }
+
+	env.seedProject("p1", 1)
+	thisMonth := map[string]string{"DateTimeOriginal": "2025:07:02 08:00:00"}
+	env.seedImage("a", map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 1, "Rating": 4, "EXIFData": thisMonth})
+	env.seedImage("b", map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 1, "Rating": 5, "EXIFData": thisMonth})
+	env.seedImage("c", map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 1, "Rating": 5, "EXIFData": thisMonth})
+	env.seedImage("lastmonth", map[string]interface{}{"Status": "approved", "Rating": 5})
+	env.seedImage("low", map[string]interface{}{"Status": "approved", "Rating": 2, "EXIFData": thisMonth})
+	env.seedImage("inproject", map[string]interface{}{"Status": "project", "ProjectID": "p1", "Rating": 5, "EXIFData": thisMonth})
+	env.login()
+
+	c := env.createCollection(`{"name":"Morning","filter":{"minRating":4,"inProject":false,"takenWithin":"this-month"}}`)
+
+	var ids []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		resp := env.call("GET", "/api/collections/"+c.ID+"/images?limit=2&cursor="+cursor, "")
+		var page PaginatedImageResponse
+		if err := json.Unmarshal([]byte(resp.Body), &page); err != nil || resp.StatusCode != 200 || pages > 3 {
+			t.Fatalf("page %d: %d %s", pages, resp.StatusCode, resp.Body)
+		}
+		for _, img := range page.Images {
+			ids = append(ids, img.ImageGUID)
+		}
+		if !page.HasMore {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	sort.Strings(ids)
+	if got := fmt.Sprint(ids); got != "[a b c]" {
+		t.Errorf("collection images = %s, want [a b c]", got)
+	}
+
+	if resp := env.call("GET", "/api/collections/nope/images", ""); resp.StatusCode != 404 {
+		t.Errorf("missing collection: status = %d, want 404", resp.StatusCode)
+	}
+}
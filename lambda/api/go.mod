@@ -7,7 +7,11 @@ require (
 	github.com/aws/aws-sdk-go v1.50.0
 	github.com/golang-jwt/jwt/v5 v5.2.0
 	github.com/google/uuid v1.6.0
+	go.etcd.io/bbolt v1.3.8
 	golang.org/x/crypto v0.18.0
 )
 
-require github.com/jmespath/go-jmespath v0.4.0 // indirect
+require (
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+)
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/google/uuid"
+)
+
+// Work that outlives a request runs as a job: file moves after review, zip
+// generation, the keyword backfill, the reconciling of interrupted moves
+// (moves.go), adding images to projects (projectqueue.go) and rebuilding the
+// search index (search.go). A job is
+// created queued in the jobs table and handed to the function that runs it
+// (this one, through an async self-invoke, or the zip Lambda), which claims
+// it by moving it to running, records progress and per-item errors as it
+// goes, stops early when it is canceled and finally records how it ended.
+// A job that queues its items for workers is instead finished by the worker
+// that does its last item, and one too long for an invocation requeues itself
+// to carry on in the next. /api/jobs lists, cancels and retries them.
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded" // ran to the end, possibly with item errors
+	jobFailed    = "failed"    // stopped on an error
+	jobCanceled  = "canceled"
+
+	jobMove             = "move"
+	jobZip              = "zip"
+	jobBackfillKeywords = "backfill-keywords"
+	jobReconcileMoves   = "reconcile-moves"
+	jobAddToProject     = "add-to-project"
+	jobReindexSearch    = "reindex-search"
+
+	// systemRequester requests the scheduled jobs
+	systemRequester = "system"
+
+	jobRetention = 30 * 24 * time.Hour
+	// A running job not updated for this long has died with its function
+	// (the zip Lambda's timeout is 15 minutes) and can be retried.
+	jobStaleAfter = 20 * time.Minute
+	// Only the first errors of a job are kept
+	maxJobErrors = 100
+
+	jobDefaultLimit = 50
+	jobMaxLimit     = 200
+)
+
+var errJobCanceled = errors.New("job canceled")
+
+// errJobItemsQueued is returned by a runner that has queued the job's items;
+// the job runs on until they are done.
+var errJobItemsQueued = errors.New("job items queued")
+
+// errJobContinues is returned by a runner that has requeued its job to carry
+// on in another invocation.
+var errJobContinues = errors.New("job continues")
+
+// JobError is the failure of one item of a job.
+type JobError struct {
+	Item  string `json:"item" dynamodbav:"Item"`
+	Error string `json:"error" dynamodbav:"Error"`
+	At    string `json:"at" dynamodbav:"At"`
+}
+
+// Job is a Jobs table row. Total, Done and Failed count the job's items
+// (images for moves and the backfill, images zipped for zips).
+type Job struct {
+	JobID       string `json:"jobId" dynamodbav:"JobID"`
+	Type        string `json:"type" dynamodbav:"Type"`
+	Status      string `json:"status" dynamodbav:"Status"`
+	RequestedBy string `json:"requestedBy" dynamodbav:"RequestedBy"`
+	ImageGUID   string `json:"imageGUID,omitempty" dynamodbav:"ImageGUID,omitempty"`
+	ProjectID   string `json:"projectId,omitempty" dynamodbav:"ProjectID,omitempty"`
+	// Params is the job's input as JSON, e.g. an AsyncMoveRequest
+	Params   string     `json:"-" dynamodbav:"Params,omitempty"`
+	Total    int        `json:"total" dynamodbav:"Total"`
+	Done     int        `json:"done" dynamodbav:"Done"`
+	Failed   int        `json:"failed" dynamodbav:"Failed"`
+	Errors   []JobError `json:"errors,omitempty" dynamodbav:"Errors,omitempty"`
+	Message  string     `json:"message,omitempty" dynamodbav:"Message,omitempty"`
+	Attempts int        `json:"attempts" dynamodbav:"Attempts"`
+	// Resume is where a job that requeued itself carries on from
+	Resume          string `json:"-" dynamodbav:"Resume,omitempty"`
+	CancelRequested bool   `json:"cancelRequested,omitempty" dynamodbav:"CancelRequested,omitempty"`
+	CreatedAt       string `json:"createdAt" dynamodbav:"CreatedAt"`
+	StartedAt       string `json:"startedAt,omitempty" dynamodbav:"StartedAt,omitempty"`
+	FinishedAt      string `json:"finishedAt,omitempty" dynamodbav:"FinishedAt,omitempty"`
+	UpdatedAt       string `json:"updatedAt" dynamodbav:"UpdatedAt"`
+	ExpiresAt       int64  `json:"-" dynamodbav:"ExpiresAt"`
+}
+
+// JobRequest runs a job in this function, through an async self-invoke.
+type JobRequest struct {
+	Action string `json:"action"` // "run_job"
+	JobID  string `json:"jobId"`
+}
+
+// JobsResponse is one page of jobs, newest first.
+type JobsResponse struct {
+	Jobs       []Job  `json:"jobs"`
+	HasMore    bool   `json:"hasMore"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// newJob returns a queued job. params, if not nil, is stored as its input.
+func newJob(jobType, requestedBy string, params interface{}) Job {
+	now := time.Now()
+	job := Job{
+		JobID:       uuid.New().String(),
+		Type:        jobType,
+		Status:      jobQueued,
+		RequestedBy: requestedBy,
+		CreatedAt:   now.UTC().Format(time.RFC3339),
+		UpdatedAt:   now.UTC().Format(time.RFC3339),
+		ExpiresAt:   now.Add(jobRetention).Unix(),
+	}
+	if params != nil {
+		data, _ := json.Marshal(params)
+		job.Params = string(data)
+	}
+	return job
+}
+
+func putJob(job Job) error {
+	item, err := dynamodbattribute.MarshalMap(job)
+	if err != nil {
+		return err
+	}
+	return jobStore.PutJob(item)
+}
+
+// startJob stores a new job and hands it to the function that runs it. A
+// job that can't be handed over is recorded as failed.
+func startJob(job Job) error {
+	if err := putJob(job); err != nil {
+		return fmt.Errorf("failed to store job: %v", err)
+	}
+	if err := dispatchJob(job); err != nil {
+		finishJob(job.JobID, err)
+		return err
+	}
+	return nil
+}
+
+// dispatchJob invokes the function that runs a queued job.
+func dispatchJob(job Job) error {
+	if job.Type == jobZip {
+		payload, _ := json.Marshal(map[string]string{"projectId": job.ProjectID, "jobId": job.JobID})
+		if err := invokeAsync(zipLambdaName, payload); err != nil {
+			return fmt.Errorf("failed to invoke zip lambda: %v", err)
+		}
+		return nil
+	}
+	payload, _ := json.Marshal(JobRequest{Action: "run_job", JobID: job.JobID})
+	// Wrap payload in API Gateway format for the handler
+	wrapped, _ := json.Marshal(map[string]string{"body": string(payload)})
+	if err := invokeAsync(functionName, wrapped); err != nil {
+		return fmt.Errorf("failed to invoke lambda: %v", err)
+	}
+	return nil
+}
+
+func getJob(jobID string) (*Job, error) {
+	item, err := jobStore.GetJob(jobID)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	var job Job
+	dynamodbattribute.UnmarshalMap(item, &job)
+	return &job, nil
+}
+
+// jobRun is a job being run, for its runner to report on.
+type jobRun struct {
+	job Job
+}
+
+// update applies an update expression of SET or ADD clauses, stamping
+// UpdatedAt.
+func (r *jobRun) update(expression string, values Item) {
+	values[":updated"] = &dynamodb.AttributeValue{S: aws.String(time.Now().UTC().Format(time.RFC3339))}
+	_, err := jobStore.UpdateJob(r.job.JobID, ItemUpdate{
+		Expression: stampUpdated(expression),
+		Values:     values,
+	})
+	if err != nil {
+		fmt.Printf("Error updating job %s: %v\n", r.job.JobID, err)
+	}
+}
+
+// stampUpdated adds UpdatedAt = :updated to the SET clause of expression.
+func stampUpdated(expression string) string {
+	if rest, ok := strings.CutPrefix(expression, "SET "); ok {
+		return "SET UpdatedAt = :updated, " + rest
+	}
+	return "SET UpdatedAt = :updated " + expression
+}
+
+func jobCount(n int) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(fmt.Sprint(n))}
+}
+
+// setTotal records how many items the job has.
+func (r *jobRun) setTotal(n int) {
+	r.update("SET Total = :n", Item{":n": jobCount(n)})
+}
+
+// progress counts items done and failed.
+func (r *jobRun) progress(done, failed int) {
+	r.update("ADD Done :done, Failed :failed", Item{":done": jobCount(done), ":failed": jobCount(failed)})
+}
+
+// itemFailed counts a failed item and records why.
+func (r *jobRun) itemFailed(item string, err error) {
+	r.recordError(item, err)
+	r.progress(0, 1)
+}
+
+// recordError records why an item failed without counting it. Only the
+// first maxJobErrors are kept.
+func (r *jobRun) recordError(item string, err error) {
+	fmt.Printf("Job %s: %s failed: %v\n", r.job.JobID, item, err)
+	now := time.Now().UTC().Format(time.RFC3339)
+	entry, _ := dynamodbattribute.MarshalMap(JobError{Item: item, Error: err.Error(), At: now})
+	_, updateErr := jobStore.UpdateJob(r.job.JobID, ItemUpdate{
+		Expression: "SET Errors = list_append(if_not_exists(Errors, :none), :error), UpdatedAt = :updated",
+		Condition:  "attribute_not_exists(Errors) OR size(Errors) < :max",
+		Values: Item{
+			":none":    {L: []*dynamodb.AttributeValue{}},
+			":error":   {L: []*dynamodb.AttributeValue{{M: entry}}},
+			":updated": {S: aws.String(now)},
+			":max":     jobCount(maxJobErrors),
+		},
+	})
+	if updateErr != nil && !isConditionFailed(updateErr) {
+		fmt.Printf("Error updating job %s: %v\n", r.job.JobID, updateErr)
+	}
+}
+
+// note records a message about the outcome.
+func (r *jobRun) note(message string) {
+	r.update("SET Message = :message", Item{":message": {S: aws.String(message)}})
+}
+
+// continueAt requeues the job to carry on from resume in another invocation
+// and dispatches it, returning errJobContinues for the runner to return.
+// Claiming it again counts no new attempt.
+func (r *jobRun) continueAt(resume string) error {
+	_, err := jobStore.UpdateJob(r.job.JobID, ItemUpdate{
+		Expression: "SET #status = :queued, Resume = :resume, UpdatedAt = :now ADD Attempts :minus",
+		Condition:  "#status = :running",
+		Names:      map[string]*string{"#status": aws.String("Status")},
+		Values: Item{
+			":queued":  {S: aws.String(jobQueued)},
+			":running": {S: aws.String(jobRunning)},
+			":resume":  {S: aws.String(resume)},
+			":now":     {S: aws.String(time.Now().UTC().Format(time.RFC3339))},
+			":minus":   jobCount(-1),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to requeue job: %v", err)
+	}
+	if err := dispatchJob(r.job); err != nil {
+		return err
+	}
+	return errJobContinues
+}
+
+// canceled reports whether cancellation has been requested. Runners check
+// it between items and return errJobCanceled.
+func (r *jobRun) canceled() bool {
+	job, err := getJob(r.job.JobID)
+	return err == nil && job != nil && job.CancelRequested
+}
+
+// runJob claims a queued job and runs it, returning how it ended. A job
+// that is not queued, e.g. canceled before it started, is left alone.
+func runJob(jobID string) (*Job, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	claimed, err := jobStore.UpdateJob(jobID, ItemUpdate{
+		Expression: "SET #status = :running, StartedAt = :now, UpdatedAt = :now ADD Attempts :one",
+		Condition:  "#status = :queued",
+		Names:      map[string]*string{"#status": aws.String("Status")},
+		Values: Item{
+			":running": {S: aws.String(jobRunning)},
+			":queued":  {S: aws.String(jobQueued)},
+			":now":     {S: aws.String(now)},
+			":one":     jobCount(1),
+		},
+		ReturnValues: dynamodb.ReturnValueAllNew,
+	})
+	if isConditionFailed(err) {
+		fmt.Printf("Job %s is not queued, not running it\n", jobID)
+		return getJob(jobID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim job %s: %v", jobID, err)
+	}
+
+	run := &jobRun{}
+	dynamodbattribute.UnmarshalMap(claimed, &run.job)
+	fmt.Printf("Job %s (%s) started for %s\n", jobID, run.job.Type, run.job.RequestedBy)
+	switch run.job.Type {
+	case jobMove:
+		err = runMoveJob(run)
+	case jobBackfillKeywords:
+		err = runBackfillJob(run)
+	case jobReconcileMoves:
+		err = runReconcileMovesJob(run)
+	case jobAddToProject:
+		err = runAddToProjectJob(run)
+	case jobReindexSearch:
+		err = runReindexSearchJob(run)
+	case jobZip:
+		// Only in self-hosted mode; the zip Lambda runs its own
+		err = generateLocalZip(run)
+	default:
+		err = fmt.Errorf("unknown job type %q", run.job.Type)
+	}
+	if errors.Is(err, errJobItemsQueued) || errors.Is(err, errJobContinues) {
+		return getJob(jobID)
+	}
+	finishJob(jobID, err)
+	return getJob(jobID)
+}
+
+// runScheduledJob runs a job for a scheduled event, within the event's
+// invocation rather than dispatched. what names it in the response.
+func runScheduledJob(jobType, what string) (events.APIGatewayProxyResponse, error) {
+	job := newJob(jobType, systemRequester, nil)
+	if err := putJob(job); err != nil {
+		fmt.Printf("%s error: %v\n", what, err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf(`{"error": "%s"}`, err.Error()),
+		}, nil
+	}
+	finished, err := runJob(job.JobID)
+	if err != nil || finished == nil || finished.Status == jobFailed {
+		if err == nil && finished != nil {
+			err = errors.New(finished.Message)
+		}
+		fmt.Printf("%s error: %v\n", what, err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf(`{"error": "%s"}`, err),
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       fmt.Sprintf(`{"message": "%s completed"}`, what),
+	}, nil
+}
+
+// finishJob records how a job ended: succeeded without an error, canceled
+// with errJobCanceled and otherwise failed.
+func finishJob(jobID string, err error) {
+	status, message := jobSucceeded, ""
+	if errors.Is(err, errJobCanceled) {
+		status = jobCanceled
+	} else if err != nil {
+		status, message = jobFailed, err.Error()
+	}
+	fmt.Printf("Job %s %s %s\n", jobID, status, message)
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	update := ItemUpdate{
+		Expression: "SET #status = :status, FinishedAt = :now, UpdatedAt = :now",
+		Names:      map[string]*string{"#status": aws.String("Status")},
+		Values: Item{
+			":status": {S: aws.String(status)},
+			":now":    {S: aws.String(now)},
+		},
+	}
+	if message != "" {
+		update.Expression += ", Message = :message"
+		update.Values[":message"] = &dynamodb.AttributeValue{S: aws.String(message)}
+	}
+	if _, err := jobStore.UpdateJob(jobID, update); err != nil {
+		fmt.Printf("Error finishing job %s: %v\n", jobID, err)
+	}
+}
+
+// runMoveJob moves an image's files for an AsyncMoveRequest.
+func runMoveJob(run *jobRun) error {
+	var req AsyncMoveRequest
+	if err := json.Unmarshal([]byte(run.job.Params), &req); err != nil {
+		return fmt.Errorf("invalid move parameters: %v", err)
+	}
+	run.setTotal(1)
+	if run.canceled() {
+		return errJobCanceled
+	}
+	note, err := runAsyncMove(req)
+	if err != nil {
+		run.itemFailed(req.ImageGUID, err)
+		return err
+	}
+	run.progress(1, 0)
+	if note != "" {
+		run.note(note)
+	}
+	return nil
+}
+
+// jobResponse is the body of a job run through an async self-invoke.
+func jobResponse(job *Job, err error, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	if err != nil {
+		fmt.Printf("Job error: %v\n", err)
+		body, _ := json.Marshal(map[string]interface{}{"success": false, "error": err.Error()})
+		return events.APIGatewayProxyResponse{StatusCode: 200, Headers: headers, Body: string(body)}, nil
+	}
+	// A job whose items were queued is running on in the workers, and one
+	// that requeued itself carries on in another invocation
+	if job == nil || (job.Status != jobSucceeded && job.Status != jobRunning && job.Status != jobQueued) {
+		body, _ := json.Marshal(map[string]interface{}{"success": false, "job": job})
+		return events.APIGatewayProxyResponse{StatusCode: 200, Headers: headers, Body: string(body)}, nil
+	}
+	return events.APIGatewayProxyResponse{StatusCode: 200, Headers: headers, Body: `{"success": true}`}, nil
+}
+
+// jobFor loads a job the caller may see: their own, or any for admins.
+func jobFor(caller *Caller, jobID string, headers map[string]string) (*Job, *events.APIGatewayProxyResponse) {
+	job, err := getJob(jobID)
+	if err != nil {
+		fmt.Printf("Error getting job %s: %v\n", jobID, err)
+		resp, _ := errorResponse(500, "Failed to get job", headers)
+		return nil, &resp
+	}
+	if job == nil || (job.RequestedBy != caller.Username && caller.Role != roleAdmin) {
+		resp, _ := errorResponse(404, "Job not found", headers)
+		return nil, &resp
+	}
+	return job, nil
+}
+
+func jsonResponse(statusCode int, v interface{}, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	body, _ := json.Marshal(v)
+	return events.APIGatewayProxyResponse{StatusCode: statusCode, Headers: headers, Body: string(body)}, nil
+}
+
+// handleListJobs serves GET /api/jobs: the caller's jobs, newest first, or
+// for admins those of ?user= (system for the scheduled jobs). type= and
+// status= filter them, so a page can come back short.
+func handleListJobs(caller *Caller, params map[string]string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	user := caller.Username
+	if u := params["user"]; u != "" && u != user {
+		if caller.Role != roleAdmin {
+			return errorResponse(403, "Only admins can list other users' jobs", headers)
+		}
+		user = u
+	}
+	limit := jobDefaultLimit
+	if s := params["limit"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return errorResponse(400, "limit must be a positive number", headers)
+		}
+		if limit = n; limit > jobMaxLimit {
+			limit = jobMaxLimit
+		}
+	}
+
+	q := ItemQuery{
+		Index:        "RequesterIndex",
+		KeyCondition: "RequestedBy = :user",
+		Names:        map[string]*string{},
+		Values:       Item{":user": {S: aws.String(user)}},
+		Limit:        int64(limit),
+		Descending:   true,
+	}
+	var filters []string
+	for _, f := range []struct{ param, attr string }{{"type", "Type"}, {"status", "Status"}} {
+		if value := params[f.param]; value != "" {
+			// Both are reserved words
+			filters = append(filters, "#"+f.param+" = :"+f.param)
+			q.Names["#"+f.param] = aws.String(f.attr)
+			q.Values[":"+f.param] = &dynamodb.AttributeValue{S: aws.String(value)}
+		}
+	}
+	q.Filter = strings.Join(filters, " AND ")
+	if s := params["cursor"]; s != "" {
+		data, err := base64.RawURLEncoding.DecodeString(s)
+		if err == nil {
+			err = json.Unmarshal(data, &q.StartKey)
+		}
+		if err != nil || q.StartKey == nil {
+			return errorResponse(400, "Invalid cursor", headers)
+		}
+	}
+
+	page, err := jobStore.QueryJobs(q)
+	if err != nil {
+		fmt.Printf("Error listing jobs: %v\n", err)
+		return errorResponse(500, "Failed to list jobs", headers)
+	}
+	response := JobsResponse{Jobs: make([]Job, 0, len(page.Items)), HasMore: page.LastKey != nil}
+	for _, item := range page.Items {
+		var job Job
+		dynamodbattribute.UnmarshalMap(item, &job)
+		response.Jobs = append(response.Jobs, job)
+	}
+	if page.LastKey != nil {
+		data, _ := json.Marshal(page.LastKey)
+		response.NextCursor = base64.RawURLEncoding.EncodeToString(data)
+	}
+	return jsonResponse(200, response, headers)
+}
+
+// handleGetJob serves GET /api/jobs/{id}.
+func handleGetJob(caller *Caller, jobID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	job, errResp := jobFor(caller, jobID, headers)
+	if errResp != nil {
+		return *errResp, nil
+	}
+	return jsonResponse(200, job, headers)
+}
+
+// handleCancelJob serves POST /api/jobs/{id}/cancel. A queued job is
+// canceled at once; a running one stops at its next item.
+func handleCancelJob(caller *Caller, jobID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	job, errResp := jobFor(caller, jobID, headers)
+	if errResp != nil {
+		return *errResp, nil
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	update := ItemUpdate{
+		Expression: "SET CancelRequested = :true, UpdatedAt = :now",
+		Condition:  "#status = :status",
+		Names:      map[string]*string{"#status": aws.String("Status")},
+		Values: Item{
+			":true":   {BOOL: aws.Bool(true)},
+			":now":    {S: aws.String(now)},
+			":status": {S: aws.String(job.Status)},
+		},
+		ReturnValues: dynamodb.ReturnValueAllNew,
+	}
+	switch job.Status {
+	case jobQueued:
+		update.Expression += ", #status = :canceled, FinishedAt = :now"
+		update.Values[":canceled"] = &dynamodb.AttributeValue{S: aws.String(jobCanceled)}
+	case jobRunning:
+	default:
+		return errorResponse(409, fmt.Sprintf("Job is already %s", job.Status), headers)
+	}
+	item, err := jobStore.UpdateJob(jobID, update)
+	if isConditionFailed(err) {
+		return errorResponse(409, "Job changed, try again", headers)
+	}
+	if err != nil {
+		fmt.Printf("Error canceling job %s: %v\n", jobID, err)
+		return errorResponse(500, "Failed to cancel job", headers)
+	}
+	dynamodbattribute.UnmarshalMap(item, job)
+	return jsonResponse(200, job, headers)
+}
+
+// handleRetryJob serves POST /api/jobs/{id}/retry: a failed or canceled job,
+// or a running one that has stopped updating, is queued and run again from
+// the start with its counters reset.
+func handleRetryJob(caller *Caller, jobID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	job, errResp := jobFor(caller, jobID, headers)
+	if errResp != nil {
+		return *errResp, nil
+	}
+	switch job.Status {
+	case jobFailed, jobCanceled:
+	case jobRunning:
+		updated, err := time.Parse(time.RFC3339, job.UpdatedAt)
+		if err == nil && time.Since(updated) < jobStaleAfter {
+			return errorResponse(409, "Job is still running", headers)
+		}
+	default:
+		return errorResponse(409, fmt.Sprintf("Job is %s", job.Status), headers)
+	}
+
+	now := time.Now()
+	item, err := jobStore.UpdateJob(jobID, ItemUpdate{
+		Expression: "SET #status = :queued, Total = :zero, Done = :zero, Failed = :zero, UpdatedAt = :now, ExpiresAt = :expires " +
+			"REMOVE Errors, Message, CancelRequested, StartedAt, FinishedAt, Resume",
+		Condition: "#status = :status AND UpdatedAt = :updated",
+		Names:     map[string]*string{"#status": aws.String("Status")},
+		Values: Item{
+			":queued":  {S: aws.String(jobQueued)},
+			":zero":    jobCount(0),
+			":now":     {S: aws.String(now.UTC().Format(time.RFC3339))},
+			":expires": {N: aws.String(fmt.Sprint(now.Add(jobRetention).Unix()))},
+			":status":  {S: aws.String(job.Status)},
+			":updated": {S: aws.String(job.UpdatedAt)},
+		},
+		ReturnValues: dynamodb.ReturnValueAllNew,
+	})
+	if isConditionFailed(err) {
+		return errorResponse(409, "Job changed, try again", headers)
+	}
+	if err != nil {
+		fmt.Printf("Error requeueing job %s: %v\n", jobID, err)
+		return errorResponse(500, "Failed to retry job", headers)
+	}
+	dynamodbattribute.UnmarshalMap(item, job)
+	if err := dispatchJob(*job); err != nil {
+		finishJob(jobID, err)
+		return errorResponse(500, "Failed to start job", headers)
+	}
+	return jsonResponse(202, job, headers)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// failingCopies is an object store whose copies fail.
+type failingCopies struct{ ObjectStore }
+
+func (failingCopies) Copy(srcKey, dstKey string) error { return errors.New("copy failed") }
+
+// jobs lists the caller's jobs, failing the test on an error.
+func (env *testEnv) jobs(query string) []Job {
+	env.t.Helper()
+	resp := env.call("GET", "/api/jobs"+query, "")
+	if resp.StatusCode != 200 {
+		env.t.Fatalf("list jobs: %d %s", resp.StatusCode, resp.Body)
+	}
+	var jr JobsResponse
+	if err := json.Unmarshal([]byte(resp.Body), &jr); err != nil {
+		env.t.Fatal(err)
+	}
+	return jr.Jobs
+}
+
+func (env *testEnv) job(id string) Job {
+	env.t.Helper()
+	resp := env.call("GET", "/api/jobs/"+id, "")
+	if resp.StatusCode != 200 {
+		env.t.Fatalf("get job %s: %d %s", id, resp.StatusCode, resp.Body)
+	}
+	var job Job
+	json.Unmarshal([]byte(resp.Body), &job)
+	return job
+}
+
+func TestMoveRunsAsJob(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	env.seedImage("img1", nil)
+
+	if resp := env.call("PUT", "/api/images/img1", `{"groupNumber":2,"reviewed":"true"}`); resp.StatusCode != 200 {
+		t.Fatalf("update: %d %s", resp.StatusCode, resp.Body)
+	}
+	jobs := env.jobs("")
+	if len(jobs) != 1 || jobs[0].Type != jobMove || jobs[0].Status != jobQueued || jobs[0].ImageGUID != "img1" || jobs[0].RequestedBy != testUser {
+		t.Fatalf("jobs = %+v, want one queued move of img1 by %s", jobs, testUser)
+	}
+
+	env.runAsyncMoves()
+	job := env.job(jobs[0].JobID)
+	if job.Status != jobSucceeded || job.Total != 1 || job.Done != 1 || job.Failed != 0 || job.Attempts != 1 {
+		t.Errorf("job = %+v, want succeeded with 1 of 1 done", job)
+	}
+	env.assertFilesUnder("img1", "approved/yellow/"+testDatePath)
+
+	// A job runs once however often it is delivered
+	if finished, err := runJob(job.JobID); err != nil || finished.Attempts != 1 {
+		t.Errorf("rerun: %v, attempts %+v", err, finished)
+	}
+}
+
+func TestJobFailureAndRetry(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	env.seedImage("img1", nil)
+	if _, err := triggerAsyncMove("img1", "approved/red", "approved", bucketName, testUser); err != nil {
+		t.Fatal(err)
+	}
+	id := env.jobs("")[0].JobID
+	objects := objectStore
+	objectStore = failingCopies{objects}
+
+	if resp := env.call("POST", "/api/jobs/"+id+"/retry", ""); resp.StatusCode != 409 {
+		t.Errorf("retry queued job: %d, want 409", resp.StatusCode)
+	}
+	env.invoked = nil
+	runJob(id)
+	objectStore = objects
+	job := env.job(id)
+	if job.Status != jobFailed || job.Failed != 1 || len(job.Errors) != 1 || job.Errors[0].Item != "img1" || job.Message == "" {
+		t.Fatalf("job = %+v, want failed with an error for img1", job)
+	}
+	if jobs := env.jobs("?status=" + jobFailed); len(jobs) != 1 {
+		t.Errorf("failed jobs = %+v, want 1", jobs)
+	}
+	if jobs := env.jobs("?status=" + jobSucceeded); len(jobs) != 0 {
+		t.Errorf("succeeded jobs = %+v, want none", jobs)
+	}
+
+	resp := env.call("POST", "/api/jobs/"+id+"/retry", "")
+	if resp.StatusCode != 202 {
+		t.Fatalf("retry: %d %s", resp.StatusCode, resp.Body)
+	}
+	job = env.job(id)
+	if job.Status != jobQueued || job.Failed != 0 || len(job.Errors) != 0 || job.Message != "" {
+		t.Errorf("retried job = %+v, want queued and reset", job)
+	}
+	if len(env.invoked) != 1 || env.invoked[0].name != testFunction {
+		t.Errorf("invocations = %v, want the job dispatched again", env.invoked)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	env.seedImage("img1", nil)
+	if _, err := triggerAsyncMove("img1", "approved/red/"+testDatePath, "approved", bucketName, testUser); err != nil {
+		t.Fatal(err)
+	}
+	id := env.jobs("")[0].JobID
+
+	resp := env.call("POST", "/api/jobs/"+id+"/cancel", "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("cancel: %d %s", resp.StatusCode, resp.Body)
+	}
+	runJob(id)
+	if job := env.job(id); job.Status != jobCanceled || job.Attempts != 0 {
+		t.Errorf("job = %+v, want canceled before it ran", job)
+	}
+	if img := env.image("img1"); img.OriginalFile != "images/img1.jpg" {
+		t.Errorf("OriginalFile = %q, want the image left where it was", img.OriginalFile)
+	}
+	if resp := env.call("POST", "/api/jobs/"+id+"/cancel", ""); resp.StatusCode != 409 {
+		t.Errorf("cancel again: %d, want 409", resp.StatusCode)
+	}
+
+	// A running job is asked to stop and stops at its next item
+	job := newJob(jobBackfillKeywords, testUser, nil)
+	job.Status = jobRunning
+	putJob(job)
+	if resp := env.call("POST", "/api/jobs/"+job.JobID+"/cancel", ""); resp.StatusCode != 200 {
+		t.Fatalf("cancel running: %d %s", resp.StatusCode, resp.Body)
+	}
+	if got := env.job(job.JobID); got.Status != jobRunning || !got.CancelRequested {
+		t.Errorf("job = %+v, want running with cancel requested", got)
+	}
+	if run := (&jobRun{job: job}); !run.canceled() {
+		t.Error("canceled() = false after cancel")
+	}
+	if resp := env.call("POST", "/api/jobs/"+job.JobID+"/retry", ""); resp.StatusCode != 409 {
+		t.Errorf("retry running job: %d, want 409", resp.StatusCode)
+	}
+}
+
+func TestJobAccess(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedUser("fred", roleReviewer)
+	if _, err := triggerAsyncMove("img1", "approved/red", "approved", bucketName, testUser); err != nil {
+		t.Fatal(err)
+	}
+	mine := newJob(jobMove, "fred", nil)
+	putJob(mine)
+	theirs := newJob(jobZip, testUser, nil)
+	putJob(theirs)
+
+	env.loginAs("fred", testPassword)
+	if jobs := env.jobs(""); len(jobs) != 1 || jobs[0].JobID != mine.JobID {
+		t.Errorf("fred's jobs = %+v, want only his own", jobs)
+	}
+	if resp := env.call("GET", "/api/jobs/"+theirs.JobID, ""); resp.StatusCode != 404 {
+		t.Errorf("get another's job: %d, want 404", resp.StatusCode)
+	}
+	if resp := env.call("POST", "/api/jobs/"+theirs.JobID+"/cancel", ""); resp.StatusCode != 404 {
+		t.Errorf("cancel another's job: %d, want 404", resp.StatusCode)
+	}
+	if resp := env.call("GET", "/api/jobs?user="+testUser, ""); resp.StatusCode != 403 {
+		t.Errorf("list another's jobs: %d, want 403", resp.StatusCode)
+	}
+
+	env.login()
+	if jobs := env.jobs("?user=fred"); len(jobs) != 1 {
+		t.Errorf("admin listing fred's jobs = %+v, want 1", jobs)
+	}
+	if jobs := env.jobs("?type=" + jobZip); len(jobs) != 1 || jobs[0].JobID != theirs.JobID {
+		t.Errorf("zip jobs = %+v, want 1", jobs)
+	}
+	if got := env.job(mine.JobID); got.RequestedBy != "fred" {
+		t.Errorf("admin reading fred's job = %+v", got)
+	}
+
+	first := env.call("GET", "/api/jobs?limit=1", "")
+	var page JobsResponse
+	json.Unmarshal([]byte(first.Body), &page)
+	if len(page.Jobs) != 1 || !page.HasMore || page.NextCursor == "" {
+		t.Fatalf("first page = %+v, want one job and a cursor", page)
+	}
+	if jobs := env.jobs("?limit=1&cursor=" + page.NextCursor); len(jobs) != 1 || jobs[0].JobID == page.Jobs[0].JobID {
+		t.Errorf("second page = %+v", jobs)
+	}
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Image listings come back in a stable order, sort= and order=, a page at a
+// time with an opaque cursor. A listing is the union of some GSI queries,
+// one per partition. Status partitions, which hold most of the library, are
+// read through a GSI per sort attribute (StatusCaptureDateIndex and so on)
+// that keeps each status in order, and merged, so a page only reads about a
+// page per status. Those GSIs hold only the keys, to keep image writes
+// cheap, so the images listed from them are read from the table after. Images
+// without the sort attribute aren't in those indexes; they come last, read
+// from StatusIndex. Smaller partitions
+// (projects, groups, capture date ranges sorted by something else) are read
+// whole and sorted in memory.
+
+// imageSort is a sort= option: the attribute images are ordered by, the GSI
+// that keeps each status partition in that order, and the order it lists
+// in unless order= says otherwise.
+type imageSort struct {
+	attr  string
+	index string
+	desc  bool
+}
+
+var imageSorts = map[string]imageSort{
+	"captured": {"CaptureDate", "StatusCaptureDateIndex", true},
+	"inserted": {"InsertedDateTime", "StatusInsertedDateTimeIndex", true},
+	"rating":   {"Rating", "StatusRatingIndex", true},
+	"filename": {"OriginalFilename", "StatusOriginalFilenameIndex", false},
+}
+
+// imageIndexOrder is the order the GSIs added to ImageMetadata since its
+// first release are created in, one per deploy; see ImageIndexes in
+// template.yaml.
+var imageIndexOrder = []string{
+	"CaptureDateIndex",
+	"StatusCaptureDateIndex",
+	"StatusInsertedDateTimeIndex",
+	"StatusRatingIndex",
+	"StatusOriginalFilenameIndex",
+	"MoveStateIndex",
+}
+
+// missingImageIndexes holds those of imageIndexOrder not created yet.
+var missingImageIndexes = map[string]bool{}
+
+// initImageIndexes records that only the first n of imageIndexOrder have
+// been created, when n is set. The sorts whose GSI is missing list status
+// partitions by reading them whole and sorting.
+func initImageIndexes(n string) {
+	count, err := strconv.Atoi(n)
+	if err != nil {
+		return
+	}
+	for i, name := range imageIndexOrder {
+		if i >= count {
+			missingImageIndexes[name] = true
+		}
+	}
+	for name, s := range imageSorts {
+		if missingImageIndexes[s.index] {
+			s.index = ""
+			imageSorts[name] = s
+		}
+	}
+}
+
+// hasImageIndex reports whether the ImageMetadata GSI has been created.
+func hasImageIndex(name string) bool {
+	return !missingImageIndexes[name]
+}
+
+// imageOrder is the order a listing comes back in.
+type imageOrder struct {
+	sort string
+	imageSort
+}
+
+func (o imageOrder) String() string {
+	if o.desc {
+		return o.sort + ":desc"
+	}
+	return o.sort + ":asc"
+}
+
+// parseImageOrder reads sort= (default captured) and order= (asc or desc,
+// default newest, best or A first).
+func parseImageOrder(params map[string]string) (imageOrder, error) {
+	name := params["sort"]
+	if name == "" {
+		name = "captured"
+	}
+	s, ok := imageSorts[name]
+	if !ok {
+		return imageOrder{}, fmt.Errorf("sort must be captured, inserted, rating or filename")
+	}
+	switch params["order"] {
+	case "":
+	case "asc":
+		s.desc = false
+	case "desc":
+		s.desc = true
+	default:
+		return imageOrder{}, fmt.Errorf("order must be asc or desc")
+	}
+	return imageOrder{name, s}, nil
+}
+
+// listLimit reads limit= (default 500, at most 1000).
+func listLimit(params map[string]string) int {
+	limit := 500
+	if l, err := strconv.Atoi(params["limit"]); err == nil && l > 0 {
+		limit = l
+		if limit > 1000 {
+			limit = 1000
+		}
+	}
+	return limit
+}
+
+// listPage bounds a page: at most items images, and at most bytes of them
+// by itemSize. A page always lists at least one image if there is one.
+type listPage struct {
+	items int
+	bytes int
+}
+
+// listReadBudget is the most queries one page may make. A page that runs out
+// before it fills, because filters are skipping most of what it reads, is
+// returned short with a cursor to carry on from.
+const listReadBudget = 25
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// listKey is a position in a listing: an image and its sort value.
+type listKey struct {
+	ID      string `json:"i"`
+	Value   string `json:"v,omitempty"`
+	Missing bool   `json:"m,omitempty"` // the image has no sort attribute
+	Done    bool   `json:"d,omitempty"` // merged listings: the query has been read to the end
+}
+
+// listCursor is what a nextCursor holds.
+type listCursor struct {
+	Order   string     `json:"o"`
+	Phase   int        `json:"p,omitempty"` // merged listings: 1 once listing images without the sort attribute
+	Sources []*listKey `json:"s,omitempty"` // merged listings: where each query carries on from
+	After   *listKey   `json:"a,omitempty"` // sorted listings: the last image listed
+}
+
+func encodeListCursor(c listCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(s string, order imageOrder) (listCursor, error) {
+	var c listCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(data, &c) != nil || c.Order != order.String() {
+		return c, errInvalidCursor
+	}
+	return c, nil
+}
+
+// listImages returns the next page of images from the union of queries, all
+// of them "#key = :key" queries, and the cursor for the page after it, ""
+// after the last. A bad cursor is errInvalidCursor.
+func listImages(queries []ItemQuery, order imageOrder, page listPage, cursor string) ([]Item, string, error) {
+	var c listCursor
+	if cursor != "" {
+		var err error
+		if c, err = decodeListCursor(cursor, order); err != nil {
+			return nil, "", err
+		}
+	}
+	merged := len(queries) > 0
+	for _, q := range queries {
+		if !(q.Index == "StatusIndex" && order.index != "") && !(q.Index == "CaptureDateIndex" && order.sort == "captured") {
+			merged = false
+		}
+	}
+	if merged {
+		return mergeImages(queries, order, page, c)
+	}
+	return sortImages(queries, order, page, c)
+}
+
+// mergeSource is one query of a merged listing.
+type mergeSource struct {
+	query     ItemQuery
+	rangeAttr string
+	filter    exprCond // applied here when it tests one of the index's keys
+	keysOnly  bool     // the index holds only keys; images are read after
+	fetch     ItemQuery
+	listed    *listKey // the last image listed from it, or where the cursor started
+	read      *listKey // where its next query page starts
+	buf       []Item   // read but not yet listed
+	end       bool     // read to the end
+}
+
+// mergePhases returns the queries a merged listing reads, in phases: its
+// status queries on the sort's GSI, then on StatusIndex for the images
+// without the sort attribute. Capture date queries are already in order.
+func mergePhases(queries []ItemQuery, order imageOrder) ([][]*mergeSource, error) {
+	var sorted, missing []*mergeSource
+	for _, q := range queries {
+		q.Descending = order.desc
+		if q.Index == "CaptureDateIndex" {
+			sorted = append(sorted, &mergeSource{query: q, rangeAttr: "CaptureDate"})
+			continue
+		}
+		q.Index = order.index
+		sorted = append(sorted, &mergeSource{query: q, rangeAttr: order.attr, keysOnly: true})
+
+		q = copyQuery(q)
+		q.Index, q.Descending = "StatusIndex", false
+		q.Names["#sortAttr"] = aws.String(order.attr)
+		if q.Filter != "" {
+			q.Filter = "(" + q.Filter + ") AND "
+		}
+		q.Filter += "attribute_not_exists(#sortAttr)"
+		missing = append(missing, &mergeSource{query: q, rangeAttr: "ImageGUID"})
+	}
+	phases := [][]*mergeSource{sorted}
+	if len(missing) > 0 {
+		phases = append(phases, missing)
+	}
+
+	for _, phase := range phases {
+		for _, s := range phase {
+			if s.keysOnly {
+				// The query reads keys; the filter and projection apply to
+				// the images read after
+				s.fetch = s.query
+				s.query.Filter, s.query.Projection = "", ""
+				s.query.Names = map[string]*string{"#key": s.fetch.Names["#key"]}
+				s.query.Values = Item{":key": s.fetch.Values[":key"]}
+			}
+			// DynamoDB won't filter on the key attributes of the index
+			// queried, nor on attributes a keys-only one doesn't hold
+			if s.fetch.Filter == "" && (s.query.Filter == "" || !(filtersOn(s.query, aws.StringValue(s.query.Names["#key"])) || filtersOn(s.query, s.rangeAttr))) {
+				continue
+			}
+			if s.keysOnly {
+				filter, err := parseConditionExpr(aws.String(s.fetch.Filter), s.fetch.Names, s.fetch.Values)
+				if err != nil {
+					return nil, err
+				}
+				s.filter = filter
+				continue
+			}
+			filter, err := parseConditionExpr(aws.String(s.query.Filter), s.query.Names, s.query.Values)
+			if err != nil {
+				return nil, err
+			}
+			s.filter, s.query.Filter = filter, ""
+		}
+	}
+	return phases, nil
+}
+
+// mergeImages lists queries that each come back in order by merging them.
+func mergeImages(queries []ItemQuery, order imageOrder, page listPage, c listCursor) ([]Item, string, error) {
+	phases, err := mergePhases(queries, order)
+	if err != nil {
+		return nil, "", err
+	}
+	if c.Phase >= len(phases) || (c.Sources != nil && len(c.Sources) != len(queries)) {
+		return nil, "", errInvalidCursor
+	}
+	sources := phases[c.Phase]
+	for i, pos := range c.Sources {
+		sources[i].listed, sources[i].read = pos, pos
+		sources[i].end = pos != nil && pos.Done
+	}
+
+	var items []Item
+	reads, size := 0, 0
+	for len(items) < page.items {
+		// Every source still being read needs its next item buffered to
+		// know which comes first
+		stalled := false
+		for _, s := range sources {
+			for len(s.buf) == 0 && !s.end && !stalled {
+				if reads == listReadBudget {
+					stalled = true
+					break
+				}
+				reads++
+				if err := s.readPage(page.items); err != nil {
+					return nil, "", err
+				}
+			}
+		}
+		if stalled {
+			break
+		}
+
+		var next *mergeSource
+		for _, s := range sources {
+			if len(s.buf) > 0 && (next == nil || s.before(s.buf[0], next.buf[0], order.desc)) {
+				next = s
+			}
+		}
+		if next == nil {
+			// This phase is finished; carry on with the next one
+			if c.Phase+1 == len(phases) {
+				return items, "", nil
+			}
+			c.Phase++
+			sources = phases[c.Phase]
+			continue
+		}
+		n := itemSize(next.buf[0])
+		if len(items) > 0 && size+n > page.bytes {
+			break
+		}
+		size += n
+		items = append(items, next.buf[0])
+		next.listed = next.keyOf(next.buf[0])
+		next.buf = next.buf[1:]
+	}
+
+	c.Order, c.Sources = order.String(), nil
+	finished := c.Phase+1 == len(phases)
+	for _, s := range sources {
+		switch {
+		case len(s.buf) > 0:
+			c.Sources = append(c.Sources, s.listed)
+			finished = false
+		case s.end:
+			c.Sources = append(c.Sources, &listKey{Done: true})
+		default:
+			// Everything read was listed or filtered out
+			c.Sources = append(c.Sources, s.read)
+			finished = false
+		}
+	}
+	if finished {
+		return items, "", nil
+	}
+	return items, encodeListCursor(c), nil
+}
+
+// readPage buffers the source's next query page.
+func (s *mergeSource) readPage(limit int) error {
+	q := s.query
+	q.Limit = int64(limit)
+	if s.read != nil {
+		q.StartKey = s.startKey(s.read)
+	}
+	page, err := imageStore.QueryImages(q)
+	if err != nil {
+		return err
+	}
+	items := page.Items
+	if s.keysOnly {
+		if items, err = s.readImages(items); err != nil {
+			return err
+		}
+	}
+	if s.filter != nil {
+		if items, err = filterPage(items, s.filter, nil); err != nil {
+			return err
+		}
+	}
+	s.buf = items
+	if page.LastKey == nil {
+		s.end = true
+	} else {
+		s.read = s.keyOf(page.LastKey)
+	}
+	return nil
+}
+
+// readImages reads the images of a page of index keys, in its order. Images
+// that left the status or changed their sort attribute since the index was
+// read are left out; the listing meets them where they are now.
+func (s *mergeSource) readImages(keys []Item) ([]Item, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = aws.StringValue(key["ImageGUID"].S)
+	}
+	read, err := imageStore.GetImages(ids, s.fetch.Projection, s.fetch.Names)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Item, len(read))
+	for _, item := range read {
+		byID[aws.StringValue(item["ImageGUID"].S)] = item
+	}
+	hashAttr := aws.StringValue(s.query.Names["#key"])
+	var items []Item
+	for i, key := range keys {
+		item := byID[ids[i]]
+		if item == nil || attrString(item[hashAttr]) != attrString(key[hashAttr]) || attrString(item[s.rangeAttr]) != attrString(key[s.rangeAttr]) {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// before reports whether a, the head of s, comes before b, the head of a
+// later source.
+func (s *mergeSource) before(a, b Item, desc bool) bool {
+	if s.rangeAttr == "ImageGUID" {
+		return aws.StringValue(a["ImageGUID"].S) < aws.StringValue(b["ImageGUID"].S)
+	}
+	cmp, _ := compareAttributeValues(a[s.rangeAttr], b[s.rangeAttr])
+	if desc {
+		cmp = -cmp
+	}
+	return cmp < 0
+}
+
+func (s *mergeSource) keyOf(item Item) *listKey {
+	return &listKey{ID: aws.StringValue(item["ImageGUID"].S), Value: attrString(item[s.rangeAttr])}
+}
+
+// startKey is the ExclusiveStartKey that carries on after pos.
+func (s *mergeSource) startKey(pos *listKey) Item {
+	hashAttr := aws.StringValue(s.query.Names["#key"])
+	key := Item{
+		hashAttr:    s.query.Values[":key"],
+		"ImageGUID": {S: aws.String(pos.ID)},
+	}
+	if s.rangeAttr != "ImageGUID" {
+		key[s.rangeAttr] = sortAttrValue(s.rangeAttr, pos.Value)
+	}
+	return key
+}
+
+// sortImages lists queries by reading them whole and sorting.
+func sortImages(queries []ItemQuery, order imageOrder, page listPage, c listCursor) ([]Item, string, error) {
+	if c.Sources != nil {
+		return nil, "", errInvalidCursor
+	}
+	var items []Item
+	for _, q := range queries {
+		page, err := queryAllPages(q)
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, page...)
+	}
+	keys := make(map[string]listKey, len(items))
+	for _, item := range items {
+		keys[aws.StringValue(item["ImageGUID"].S)] = order.keyOf(item)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return order.compare(keys[aws.StringValue(items[i]["ImageGUID"].S)], keys[aws.StringValue(items[j]["ImageGUID"].S)]) < 0
+	})
+
+	start := 0
+	if c.After != nil {
+		start = sort.Search(len(items), func(i int) bool {
+			return order.compare(keys[aws.StringValue(items[i]["ImageGUID"].S)], *c.After) > 0
+		})
+	}
+	end, size := start, 0
+	for end < len(items) && end-start < page.items {
+		n := itemSize(items[end])
+		if end > start && size+n > page.bytes {
+			break
+		}
+		size += n
+		end++
+	}
+	if end == len(items) {
+		return items[start:], "", nil
+	}
+	last := keys[aws.StringValue(items[end-1]["ImageGUID"].S)]
+	return items[start:end], encodeListCursor(listCursor{Order: order.String(), After: &last}), nil
+}
+
+func (o imageOrder) keyOf(item Item) listKey {
+	k := listKey{ID: aws.StringValue(item["ImageGUID"].S)}
+	if av := item[o.attr]; av != nil && (av.S != nil || av.N != nil) {
+		k.Value = attrString(av)
+	} else {
+		k.Missing = true
+	}
+	return k
+}
+
+// compare orders positions the way merged listings do: by the sort
+// attribute, images without it last by ID.
+func (o imageOrder) compare(a, b listKey) int {
+	if a.Missing != b.Missing {
+		if a.Missing {
+			return 1
+		}
+		return -1
+	}
+	if !a.Missing {
+		cmp, _ := compareAttributeValues(sortAttrValue(o.attr, a.Value), sortAttrValue(o.attr, b.Value))
+		if o.desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	cmp := strings.Compare(a.ID, b.ID)
+	if o.desc && !a.Missing {
+		cmp = -cmp
+	}
+	return cmp
+}
+
+// filtersOn reports whether q's filter tests attr.
+func filtersOn(q ItemQuery, attr string) bool {
+	for placeholder, name := range q.Names {
+		if aws.StringValue(name) == attr && strings.Contains(q.Filter, placeholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyQuery copies q with its own names and values.
+func copyQuery(q ItemQuery) ItemQuery {
+	names := make(map[string]*string, len(q.Names))
+	for k, v := range q.Names {
+		names[k] = v
+	}
+	values := make(Item, len(q.Values))
+	for k, v := range q.Values {
+		values[k] = v
+	}
+	q.Names, q.Values = names, values
+	return q
+}
+
+// itemSize estimates the size of an item as JSON.
+func itemSize(item Item) int {
+	n := 2
+	for name, av := range item {
+		n += len(name) + 4 + attrSize(av)
+	}
+	return n
+}
+
+func attrSize(av *dynamodb.AttributeValue) int {
+	switch {
+	case av == nil:
+		return 4
+	case av.S != nil:
+		return len(*av.S) + 2
+	case av.N != nil:
+		return len(*av.N)
+	case av.M != nil:
+		return itemSize(av.M)
+	case av.L != nil:
+		n := 2
+		for _, v := range av.L {
+			n += attrSize(v) + 1
+		}
+		return n
+	case av.SS != nil || av.NS != nil:
+		n := 2
+		for _, v := range append(av.SS, av.NS...) {
+			n += len(*v) + 3
+		}
+		return n
+	}
+	return 5 // booleans and nulls
+}
+
+func attrString(av *dynamodb.AttributeValue) string {
+	if av == nil {
+		return ""
+	}
+	if av.N != nil {
+		return *av.N
+	}
+	return aws.StringValue(av.S)
+}
+
+// sortAttrValue is the attribute value of a sort attribute stored as s.
+func sortAttrValue(attr, s string) *dynamodb.AttributeValue {
+	if attr == "Rating" {
+		return &dynamodb.AttributeValue{N: aws.String(s)}
+	}
+	return &dynamodb.AttributeValue{S: aws.String(s)}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// listAll pages through a listing and returns the image IDs in order and the
+// number of pages it took.
+func (env *testEnv) listAll(path, params string) ([]string, int) {
+	env.t.Helper()
+	var ids []string
+	cursor := ""
+	for pages := 1; ; pages++ {
+		resp := env.call("GET", path+"?"+params+"&cursor="+cursor, "")
+		var page PaginatedImageResponse
+		if err := json.Unmarshal([]byte(resp.Body), &page); err != nil || resp.StatusCode != 200 || pages > 50 {
+			env.t.Fatalf("%s?%s page %d: %d %s", path, params, pages, resp.StatusCode, resp.Body)
+		}
+		for _, img := range page.Images {
+			ids = append(ids, img.ImageGUID)
+		}
+		if !page.HasMore {
+			return ids, pages
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// seedListedImages seeds one image of each status, and one without a
+// capture date, for the sort tests.
+func (env *testEnv) seedListedImages() {
+	env.t.Helper()
+	env.seedProject("p1", 1)
+	env.seedImage("a", map[string]interface{}{
+		"Rating": 3, "OriginalFilename": "IMG_0003", "InsertedDateTime": "2025-07-01T00:00:00Z",
+		"EXIFData": map[string]string{"DateTimeOriginal": "2025:06:01 10:00:00"},
+	})
+	env.seedImage("b", map[string]interface{}{
+		"Status": "approved", "Reviewed": "true", "GroupNumber": 1, "Rating": 5, "OriginalFilename": "IMG_0001",
+		"InsertedDateTime": "2025-07-02T00:00:00Z", "EXIFData": map[string]string{"DateTimeOriginal": "2025:06:02 10:00:00"},
+	})
+	env.seedImage("c", map[string]interface{}{
+		"Status": "rejected", "Reviewed": "true", "OriginalFilename": "DSC_0100",
+		"InsertedDateTime": "2025-07-03T00:00:00Z", "EXIFData": map[string]string{"DateTimeOriginal": "2025:05:01 10:00:00"},
+	})
+	env.seedImage("d", map[string]interface{}{
+		"Status": "project", "ProjectID": "p1", "Rating": 1, "OriginalFilename": "IMG_0002",
+		"InsertedDateTime": "2025-07-04T00:00:00Z", "EXIFData": map[string]string{"DateTimeOriginal": "2025:06:03 10:00:00"},
+	})
+	env.seedImage("e", nil)
+	if _, err := imageStore.UpdateImage("e", ItemUpdate{Expression: "REMOVE CaptureDate, CaptureYear"}); err != nil {
+		env.t.Fatal(err)
+	}
+	env.seedImage("trashed", map[string]interface{}{"Status": "deleted", "Rating": 5})
+}
+
+func TestListImagesSorted(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedListedImages()
+	env.login()
+
+	for _, tc := range []struct{ params, want string }{
+		// Images without the sort attribute come last
+		{"state=all", "[d b a c e]"},
+		{"state=all&sort=captured&order=asc", "[c a b d e]"},
+		{"state=all&sort=rating", "[b a d c e]"},
+		{"state=all&sort=rating&order=asc", "[d a b c e]"},
+		{"state=all&sort=filename", "[c b d a e]"},
+		{"state=all&sort=inserted", "[d c b a e]"},
+		{"state=unreviewed&sort=inserted&order=asc", "[e a]"},
+		{"state=approved&group=1", "[b]"},
+		{"q=" + url.QueryEscape("rating>=3") + "&sort=rating", "[b a]"},
+		{"q=" + url.QueryEscape("rating:0") + "&sort=rating", "[c e]"},
+		{"q=" + url.QueryEscape("project:p1 OR status:rejected") + "&sort=filename", "[c d]"},
+		{"q=" + url.QueryEscape("taken:2025-05..2025-06") + "&order=asc", "[c a b d]"},
+	} {
+		for _, limit := range []string{"1", "2", "500"} {
+			ids, _ := env.listAll("/api/images", tc.params+"&limit="+limit)
+			if got := fmt.Sprint(ids); got != tc.want {
+				t.Errorf("%s limit %s: got %s, want %s", tc.params, limit, got, tc.want)
+			}
+		}
+	}
+
+	// Sorts whose index isn't created yet list the same
+	restore := useImageIndexes(t, 2)
+	for _, tc := range []struct{ params, want string }{
+		{"state=all", "[d b a c e]"},
+		{"state=all&sort=rating", "[b a d c e]"},
+		{"state=all&sort=filename", "[c b d a e]"},
+	} {
+		for _, limit := range []string{"1", "500"} {
+			ids, _ := env.listAll("/api/images", tc.params+"&limit="+limit)
+			if got := fmt.Sprint(ids); got != tc.want {
+				t.Errorf("%s limit %s with one sort index: got %s, want %s", tc.params, limit, got, tc.want)
+			}
+		}
+	}
+	restore()
+
+	resp := env.call("GET", "/api/images?state=all&sort=rating&limit=2", "")
+	var page PaginatedImageResponse
+	json.Unmarshal([]byte(resp.Body), &page)
+	for _, params := range []string{
+		"sort=size", "order=up", "cursor=!", "cursor=" + page.NextCursor + "&sort=filename",
+	} {
+		if resp := env.call("GET", "/api/images?state=all&"+params, ""); resp.StatusCode != 400 {
+			t.Errorf("%s: status = %d, want 400", params, resp.StatusCode)
+		}
+	}
+}
+
+// missingIndexStore is an image store whose queries on the image indexes
+// not created yet fail, as they do in DynamoDB.
+type missingIndexStore struct {
+	ImageStore
+}
+
+func (s missingIndexStore) QueryImages(q ItemQuery) (*ItemPage, error) {
+	if !hasImageIndex(q.Index) {
+		return nil, fmt.Errorf("ValidationException: The table does not have the specified index: %s", q.Index)
+	}
+	return s.ImageStore.QueryImages(q)
+}
+
+// useImageIndexes makes only the first n of imageIndexOrder exist, until
+// restore is called or the test ends.
+func useImageIndexes(t *testing.T, n int) (restore func()) {
+	savedSorts := make(map[string]imageSort)
+	for name, s := range imageSorts {
+		savedSorts[name] = s
+	}
+	savedStore := imageStore
+	restore = func() {
+		imageSorts, missingImageIndexes, imageStore = savedSorts, map[string]bool{}, savedStore
+	}
+	t.Cleanup(restore)
+	initImageIndexes(strconv.Itoa(n))
+	imageStore = missingIndexStore{imageStore}
+	return restore
+}
+
+func TestListImagesShortPages(t *testing.T) {
+	env := newTestEnv(t)
+	for i := 0; i < 40; i++ {
+		env.seedImage(fmt.Sprintf("i%02d", i), nil)
+	}
+	env.seedImage("i00", map[string]interface{}{"GroupNumber": 3})
+	env.login()
+
+	// Filtering 40 images one at a time runs out of reads before the match
+	resp := env.call("GET", "/api/images?group=3&limit=1", "")
+	var page PaginatedImageResponse
+	if err := json.Unmarshal([]byte(resp.Body), &page); err != nil || len(page.Images) != 0 || !page.HasMore {
+		t.Fatalf("first page: %d %s", resp.StatusCode, resp.Body)
+	}
+	if ids, pages := env.listAll("/api/images", "group=3&limit=1"); fmt.Sprint(ids) != "[i00]" || pages < 2 {
+		t.Errorf("got %v in %d pages", ids, pages)
+	}
+}
+
+func TestGetProjectImagesPaged(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedProject("p1", 3)
+	for _, id := range []string{"x", "y", "z"} {
+		env.seedImage(id, map[string]interface{}{"Status": "project", "ProjectID": "p1", "OriginalFilename": "IMG_" + strings.ToUpper(id)})
+	}
+	env.seedImage("elsewhere", nil)
+	env.login()
+
+	if ids, pages := env.listAll("/api/projects/p1/images", "sort=filename&order=desc&limit=2"); fmt.Sprint(ids) != "[z y x]" || pages != 2 {
+		t.Errorf("got %v in %d pages", ids, pages)
+	}
+	if resp := env.call("GET", "/api/projects/p1/images?limit=1&cursor=nope", ""); resp.StatusCode != 400 {
+		t.Errorf("bad cursor: status = %d, want 400", resp.StatusCode)
+	}
+}
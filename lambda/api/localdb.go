@@ -0,0 +1,999 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	bolt "go.etcd.io/bbolt"
+)
+
+// localKeySchema names the partition (and optional sort) key of a table or index.
+type localKeySchema struct {
+	HashKey  string
+	RangeKey string
+	// KeysOnly marks an index that projects only the keys
+	KeysOnly bool
+}
+
+// localTableSchema mirrors the KeySchema and GlobalSecondaryIndexes of a table
+// in template.yaml.
+type localTableSchema struct {
+	localKeySchema
+	Indexes map[string]localKeySchema
+}
+
+// Key schemas of the tables the API touches. Keep these in sync with
+// template.yaml.
+var (
+	imageTableSchema = localTableSchema{
+		localKeySchema: localKeySchema{HashKey: "ImageGUID"},
+		Indexes: map[string]localKeySchema{
+			"StatusIndex":           {HashKey: "Status", RangeKey: "ImageGUID"},
+			"ProjectIndex":          {HashKey: "ProjectID", RangeKey: "ImageGUID"},
+			"OriginalFilenameIndex": {HashKey: "OriginalFilename"},
+			"GroupStatusIndex":      {HashKey: "GroupNumber", RangeKey: "ImageGUID"},
+			"CaptureDateIndex":      {HashKey: "CaptureYear", RangeKey: "CaptureDate"},
+			// Each status in the order of a listing sort; see listing.go
+			"StatusCaptureDateIndex":      {HashKey: "Status", RangeKey: "CaptureDate", KeysOnly: true},
+			"StatusInsertedDateTimeIndex": {HashKey: "Status", RangeKey: "InsertedDateTime", KeysOnly: true},
+			"StatusRatingIndex":           {HashKey: "Status", RangeKey: "Rating", KeysOnly: true},
+			"StatusOriginalFilenameIndex": {HashKey: "Status", RangeKey: "OriginalFilename", KeysOnly: true},
+			// Images with an unfinished or failed file move; see moves.go
+			"MoveStateIndex": {HashKey: "MoveState", RangeKey: "ImageGUID"},
+		},
+	}
+	usersTableSchema        = localTableSchema{localKeySchema: localKeySchema{HashKey: "Username"}}
+	reviewGroupsTableSchema = localTableSchema{localKeySchema: localKeySchema{HashKey: "ReviewID", RangeKey: "ImageGUID"}}
+	projectsTableSchema     = localTableSchema{localKeySchema: localKeySchema{HashKey: "ProjectID"}}
+	rateLimitsTableSchema   = localTableSchema{localKeySchema: localKeySchema{HashKey: "CounterKey"}}
+	auditTableSchema        = localTableSchema{
+		localKeySchema: localKeySchema{HashKey: "EventID"},
+		Indexes: map[string]localKeySchema{
+			"ActorIndex":   {HashKey: "Actor", RangeKey: "Timestamp"},
+			"ImageIndex":   {HashKey: "ImageGUID", RangeKey: "Timestamp"},
+			"ProjectIndex": {HashKey: "ProjectID", RangeKey: "Timestamp"},
+			"MonthIndex":   {HashKey: "Month", RangeKey: "Timestamp"},
+		},
+	}
+	searchTableSchema  = localTableSchema{localKeySchema: localKeySchema{HashKey: "TermPrefix", RangeKey: "Entry"}}
+	statsTableSchema   = localTableSchema{localKeySchema: localKeySchema{HashKey: "StatKey"}}
+	changesTableSchema = localTableSchema{localKeySchema: localKeySchema{HashKey: "Feed", RangeKey: "Seq"}}
+	jobsTableSchema    = localTableSchema{
+		localKeySchema: localKeySchema{HashKey: "JobID"},
+		Indexes: map[string]localKeySchema{
+			"RequesterIndex": {HashKey: "RequestedBy", RangeKey: "CreatedAt"},
+		},
+	}
+)
+
+// localTableSchemas returns the schema of every table keyed by its configured
+// table name.
+func localTableSchemas() map[string]localTableSchema {
+	return map[string]localTableSchema{
+		imageTable:        imageTableSchema,
+		usersTable:        usersTableSchema,
+		reviewGroupsTable: reviewGroupsTableSchema,
+		projectsTable:     projectsTableSchema,
+		rateLimitTable:    rateLimitsTableSchema,
+		auditTable:        auditTableSchema,
+		searchTable:       searchTableSchema,
+		statsTable:        statsTableSchema,
+		changesTable:      changesTableSchema,
+		jobsTable:         jobsTableSchema,
+	}
+}
+
+// localDynamoDB implements the parts of dynamodbiface.DynamoDBAPI used by this
+// service on top of an embedded bbolt database. Each table is a bucket of
+// items keyed by their encoded primary key, and each global secondary index is
+// a companion bucket mapping encoded index keys to primary keys. Calling an
+// operation that is not implemented here panics via the nil embedded interface.
+type localDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	db      *bolt.DB
+	schemas map[string]localTableSchema
+	// mu serializes read-modify-write operations so condition expressions see
+	// a consistent view; bbolt already serializes writers but we evaluate
+	// conditions in Go between reads and writes.
+	mu sync.Mutex
+	// watchers stand in for DynamoDB streams: each is called with the old and
+	// new item after every committed write to its table.
+	watchers map[string]func(before, after Item)
+}
+
+// localChange is a committed write waiting to be passed to its watcher.
+type localChange struct {
+	table         string
+	before, after exprItem
+}
+
+// watch calls fn after every write to table. It must be set up before the
+// database is used.
+func (l *localDynamoDB) watch(table string, fn func(before, after Item)) {
+	if l.watchers == nil {
+		l.watchers = make(map[string]func(before, after Item))
+	}
+	l.watchers[table] = fn
+}
+
+// notify passes committed writes to their watchers. Writes defer it before
+// taking mu, so watchers run after it is released and can write themselves.
+func (l *localDynamoDB) notify(changes *[]localChange) {
+	for _, c := range *changes {
+		if fn := l.watchers[c.table]; fn != nil {
+			fn(c.before, c.after)
+		}
+	}
+}
+
+func newLocalDynamoDB(path string, schemas map[string]localTableSchema) (*localDynamoDB, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local database %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for table, schema := range schemas {
+			if _, err := tx.CreateBucketIfNotExists([]byte(table)); err != nil {
+				return err
+			}
+			for index, ks := range schema.Indexes {
+				if tx.Bucket([]byte(localIndexBucket(table, index))) != nil {
+					continue
+				}
+				// An index added since the database was created starts with
+				// the items already in the table, as a new GSI backfills
+				bucket, err := tx.CreateBucket([]byte(localIndexBucket(table, index)))
+				if err != nil {
+					return err
+				}
+				err = tx.Bucket([]byte(table)).ForEach(func(key, data []byte) error {
+					item, err := unmarshalStoredItem(data)
+					if err != nil {
+						return err
+					}
+					if entry, ok := indexEntryKey(item, ks, key); ok {
+						return bucket.Put(entry, key)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize local tables: %v", err)
+	}
+	return &localDynamoDB{db: db, schemas: schemas}, nil
+}
+
+func localIndexBucket(table, index string) string {
+	return table + "#" + index
+}
+
+func (l *localDynamoDB) schema(table *string) (localTableSchema, error) {
+	schema, ok := l.schemas[aws.StringValue(table)]
+	if !ok {
+		return schema, awserr.New(dynamodb.ErrCodeResourceNotFoundException,
+			fmt.Sprintf("Requested resource not found: Table: %s not found", aws.StringValue(table)), nil)
+	}
+	return schema, nil
+}
+
+// encodeKeyPart produces a byte string that identifies a key attribute value.
+func encodeKeyPart(av *dynamodb.AttributeValue) ([]byte, bool) {
+	switch {
+	case av == nil:
+		return nil, false
+	case av.S != nil:
+		return []byte("S" + *av.S), true
+	case av.N != nil:
+		return []byte("N" + formatExprNumber(parseExprNumber(*av.N))), true
+	case av.B != nil:
+		return append([]byte("B"), av.B...), true
+	}
+	return nil, false
+}
+
+// encodeKey builds the storage key for an item under the given key schema. It
+// returns false if the item lacks one of the key attributes.
+func encodeKey(item exprItem, ks localKeySchema) ([]byte, bool) {
+	hash, ok := encodeKeyPart(item[ks.HashKey])
+	if !ok {
+		return nil, false
+	}
+	if ks.RangeKey == "" {
+		return hash, true
+	}
+	rng, ok := encodeKeyPart(item[ks.RangeKey])
+	if !ok {
+		return nil, false
+	}
+	return append(append(hash, 0), rng...), true
+}
+
+func indexEntryKey(item exprItem, ks localKeySchema, primary []byte) ([]byte, bool) {
+	hash, ok := encodeKeyPart(item[ks.HashKey])
+	if !ok {
+		return nil, false
+	}
+	if ks.RangeKey != "" {
+		if _, ok := encodeKeyPart(item[ks.RangeKey]); !ok {
+			// Items without the index sort key are not projected into the index.
+			return nil, false
+		}
+	}
+	return append(append(hash, 0), primary...), true
+}
+
+// indexEntry is what an index holds of item: only its keys and the table's
+// for a KeysOnly index.
+func indexEntry(item exprItem, ks, table localKeySchema) exprItem {
+	if !ks.KeysOnly {
+		return item
+	}
+	return keyOnly(item, ks, table)
+}
+
+func keyOnly(item exprItem, schemas ...localKeySchema) exprItem {
+	out := make(exprItem)
+	for _, ks := range schemas {
+		for _, name := range []string{ks.HashKey, ks.RangeKey} {
+			if name != "" && item[name] != nil {
+				out[name] = cloneAttributeValue(item[name])
+			}
+		}
+	}
+	return out
+}
+
+// storedAttributeValue is the compact JSON form used on disk; the SDK type
+// serializes every nil field.
+type storedAttributeValue struct {
+	T    string                          `json:"t"`
+	S    string                          `json:"s,omitempty"`
+	B    []byte                          `json:"b,omitempty"`
+	BOOL bool                            `json:"bool,omitempty"`
+	L    []storedAttributeValue          `json:"l,omitempty"`
+	M    map[string]storedAttributeValue `json:"m,omitempty"`
+	SS   []string                        `json:"ss,omitempty"`
+	BS   [][]byte                        `json:"bs,omitempty"`
+}
+
+func toStoredAttributeValue(av *dynamodb.AttributeValue) storedAttributeValue {
+	out := storedAttributeValue{T: attributeTypeOf(av)}
+	switch out.T {
+	case "S":
+		out.S = *av.S
+	case "N":
+		out.S = *av.N
+	case "B":
+		out.B = av.B
+	case "BOOL":
+		out.BOOL = *av.BOOL
+	case "NULL":
+		out.BOOL = *av.NULL
+	case "L":
+		for _, el := range av.L {
+			out.L = append(out.L, toStoredAttributeValue(el))
+		}
+	case "M":
+		out.M = make(map[string]storedAttributeValue, len(av.M))
+		for k, v := range av.M {
+			out.M[k] = toStoredAttributeValue(v)
+		}
+	case "SS", "NS":
+		for _, s := range append(av.SS, av.NS...) {
+			out.SS = append(out.SS, *s)
+		}
+	case "BS":
+		out.BS = av.BS
+	}
+	return out
+}
+
+func fromStoredAttributeValue(s storedAttributeValue) *dynamodb.AttributeValue {
+	av := &dynamodb.AttributeValue{}
+	switch s.T {
+	case "S":
+		av.S = aws.String(s.S)
+	case "N":
+		av.N = aws.String(s.S)
+	case "B":
+		av.B = s.B
+	case "BOOL":
+		av.BOOL = aws.Bool(s.BOOL)
+	case "NULL":
+		av.NULL = aws.Bool(s.BOOL)
+	case "L":
+		av.L = make([]*dynamodb.AttributeValue, 0, len(s.L))
+		for _, el := range s.L {
+			av.L = append(av.L, fromStoredAttributeValue(el))
+		}
+	case "M":
+		av.M = make(map[string]*dynamodb.AttributeValue, len(s.M))
+		for k, v := range s.M {
+			av.M[k] = fromStoredAttributeValue(v)
+		}
+	case "SS":
+		av.SS = aws.StringSlice(s.SS)
+	case "NS":
+		av.NS = aws.StringSlice(s.SS)
+	case "BS":
+		av.BS = s.BS
+	}
+	return av
+}
+
+func marshalStoredItem(item exprItem) ([]byte, error) {
+	stored := make(map[string]storedAttributeValue, len(item))
+	for k, v := range item {
+		if v == nil {
+			continue
+		}
+		stored[k] = toStoredAttributeValue(v)
+	}
+	return json.Marshal(stored)
+}
+
+func unmarshalStoredItem(data []byte) (exprItem, error) {
+	var stored map[string]storedAttributeValue
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	item := make(exprItem, len(stored))
+	for k, v := range stored {
+		item[k] = fromStoredAttributeValue(v)
+	}
+	return item, nil
+}
+
+func conditionFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+// transactionCanceled is the error for a transaction a condition failed in.
+func transactionCanceled(reasons []*dynamodb.CancellationReason) error {
+	codes := make([]string, len(reasons))
+	for i, r := range reasons {
+		codes[i] = aws.StringValue(r.Code)
+	}
+	return &dynamodb.TransactionCanceledException{
+		Message_:            aws.String(fmt.Sprintf("Transaction cancelled, please refer cancellation reasons for specific reasons [%s]", strings.Join(codes, ", "))),
+		CancellationReasons: reasons,
+	}
+}
+
+// checkTransactConditions runs check for each of n transaction items. It
+// returns the cancellation reasons if any condition failed, or nil if all
+// passed.
+func checkTransactConditions(n int, check func(i int) error) ([]*dynamodb.CancellationReason, error) {
+	reasons := make([]*dynamodb.CancellationReason, n)
+	failed := false
+	for i := range reasons {
+		err := check(i)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			reasons[i] = &dynamodb.CancellationReason{Code: aws.String("ConditionalCheckFailed"), Message: aws.String(aerr.Message())}
+			failed = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		reasons[i] = &dynamodb.CancellationReason{Code: aws.String("None")}
+	}
+	if !failed {
+		return nil, nil
+	}
+	return reasons, nil
+}
+
+func validationError(err error) error {
+	return awserr.New("ValidationException", err.Error(), nil)
+}
+
+func (l *localDynamoDB) getItemTx(tx *bolt.Tx, table string, key []byte) (exprItem, error) {
+	data := tx.Bucket([]byte(table)).Get(key)
+	if data == nil {
+		return nil, nil
+	}
+	return unmarshalStoredItem(data)
+}
+
+// writeItemTx stores (or deletes, when item is nil) an item and keeps the
+// index buckets in step with it.
+func (l *localDynamoDB) writeItemTx(tx *bolt.Tx, table string, schema localTableSchema, key []byte, old, item exprItem) error {
+	for index, ks := range schema.Indexes {
+		bucket := tx.Bucket([]byte(localIndexBucket(table, index)))
+		if old != nil {
+			if entry, ok := indexEntryKey(old, ks, key); ok {
+				if err := bucket.Delete(entry); err != nil {
+					return err
+				}
+			}
+		}
+		if item != nil {
+			if entry, ok := indexEntryKey(item, ks, key); ok {
+				if err := bucket.Put(entry, key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if item == nil {
+		return tx.Bucket([]byte(table)).Delete(key)
+	}
+	data, err := marshalStoredItem(item)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(table)).Put(key, data)
+}
+
+func checkCondition(expr *string, names map[string]*string, values map[string]*dynamodb.AttributeValue, item exprItem) error {
+	cond, err := parseConditionExpr(expr, names, values)
+	if err != nil {
+		return validationError(err)
+	}
+	if cond == nil {
+		return nil
+	}
+	if item == nil {
+		item = exprItem{}
+	}
+	ok, err := cond.test(item)
+	if err != nil {
+		return validationError(err)
+	}
+	if !ok {
+		return conditionFailed()
+	}
+	return nil
+}
+
+func (l *localDynamoDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	schema, err := l.schema(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := encodeKey(input.Key, schema.localKeySchema)
+	if !ok {
+		return nil, validationError(fmt.Errorf("the provided key element does not match the schema"))
+	}
+	projection, err := parseProjectionExpr(input.ProjectionExpression, input.ExpressionAttributeNames)
+	if err != nil {
+		return nil, validationError(err)
+	}
+	out := &dynamodb.GetItemOutput{}
+	err = l.db.View(func(tx *bolt.Tx) error {
+		item, err := l.getItemTx(tx, *input.TableName, key)
+		if item != nil {
+			out.Item = projectItem(item, projection)
+		}
+		return err
+	})
+	return out, err
+}
+
+func (l *localDynamoDB) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	out := &dynamodb.BatchGetItemOutput{Responses: make(map[string][]map[string]*dynamodb.AttributeValue)}
+	for table, request := range input.RequestItems {
+		projection, err := parseProjectionExpr(request.ProjectionExpression, request.ExpressionAttributeNames)
+		if err != nil {
+			return nil, validationError(err)
+		}
+		for _, key := range request.Keys {
+			got, err := l.GetItem(&dynamodb.GetItemInput{TableName: aws.String(table), Key: key})
+			if err != nil {
+				return nil, err
+			}
+			if got.Item != nil {
+				out.Responses[table] = append(out.Responses[table], projectItem(got.Item, projection))
+			}
+		}
+	}
+	return out, nil
+}
+
+func (l *localDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	schema, err := l.schema(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := encodeKey(input.Item, schema.localKeySchema)
+	if !ok {
+		return nil, validationError(fmt.Errorf("one or more parameter values were invalid: missing the key"))
+	}
+	var changes []localChange
+	defer l.notify(&changes)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := &dynamodb.PutItemOutput{}
+	var written []localChange
+	err = l.db.Update(func(tx *bolt.Tx) error {
+		old, err := l.getItemTx(tx, *input.TableName, key)
+		if err != nil {
+			return err
+		}
+		if err := checkCondition(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, old); err != nil {
+			return err
+		}
+		if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld && old != nil {
+			out.Attributes = old
+		}
+		item := cloneItem(input.Item)
+		written = append(written, localChange{*input.TableName, old, item})
+		return l.writeItemTx(tx, *input.TableName, schema, key, old, item)
+	})
+	if err != nil {
+		return nil, err
+	}
+	changes = written
+	return out, nil
+}
+
+func (l *localDynamoDB) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	schema, err := l.schema(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := encodeKey(input.Key, schema.localKeySchema)
+	if !ok {
+		return nil, validationError(fmt.Errorf("the provided key element does not match the schema"))
+	}
+	var actions []updateAction
+	if input.UpdateExpression != nil {
+		actions, err = parseUpdateExpr(*input.UpdateExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+		if err != nil {
+			return nil, validationError(err)
+		}
+	}
+	for _, a := range actions {
+		if a.path[0].name == schema.HashKey || a.path[0].name == schema.RangeKey {
+			return nil, validationError(fmt.Errorf("cannot update attribute %s. This attribute is part of the key", a.path[0].name))
+		}
+	}
+	var changes []localChange
+	defer l.notify(&changes)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := &dynamodb.UpdateItemOutput{}
+	var written []localChange
+	err = l.db.Update(func(tx *bolt.Tx) error {
+		old, err := l.getItemTx(tx, *input.TableName, key)
+		if err != nil {
+			return err
+		}
+		if err := checkCondition(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, old); err != nil {
+			return err
+		}
+		item := cloneItem(old)
+		if item == nil {
+			// UpdateItem upserts: start from the key attributes alone.
+			item = keyOnly(input.Key, schema.localKeySchema)
+		}
+		if err := applyUpdate(item, actions); err != nil {
+			return validationError(err)
+		}
+		switch aws.StringValue(input.ReturnValues) {
+		case dynamodb.ReturnValueAllNew, dynamodb.ReturnValueUpdatedNew:
+			out.Attributes = cloneItem(item)
+		case dynamodb.ReturnValueAllOld, dynamodb.ReturnValueUpdatedOld:
+			out.Attributes = old
+		}
+		written = append(written, localChange{*input.TableName, old, cloneItem(item)})
+		return l.writeItemTx(tx, *input.TableName, schema, key, old, item)
+	})
+	if err != nil {
+		return nil, err
+	}
+	changes = written
+	return out, nil
+}
+
+// TransactWriteItems supports Update items. Every condition is checked before
+// anything is written.
+func (l *localDynamoDB) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	type write struct {
+		update  *dynamodb.Update
+		schema  localTableSchema
+		key     []byte
+		actions []updateAction
+	}
+	writes := make([]write, len(input.TransactItems))
+	seen := make(map[string]bool)
+	for i, ti := range input.TransactItems {
+		u := ti.Update
+		if u == nil {
+			return nil, validationError(fmt.Errorf("only Update transaction items are supported"))
+		}
+		schema, err := l.schema(u.TableName)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := encodeKey(u.Key, schema.localKeySchema)
+		if !ok {
+			return nil, validationError(fmt.Errorf("the provided key element does not match the schema"))
+		}
+		id := aws.StringValue(u.TableName) + "/" + string(key)
+		if seen[id] {
+			return nil, validationError(fmt.Errorf("transaction request cannot include multiple operations on one item"))
+		}
+		seen[id] = true
+		actions, err := parseUpdateExpr(aws.StringValue(u.UpdateExpression), u.ExpressionAttributeNames, u.ExpressionAttributeValues)
+		if err != nil {
+			return nil, validationError(err)
+		}
+		for _, a := range actions {
+			if a.path[0].name == schema.HashKey || a.path[0].name == schema.RangeKey {
+				return nil, validationError(fmt.Errorf("cannot update attribute %s. This attribute is part of the key", a.path[0].name))
+			}
+		}
+		writes[i] = write{u, schema, key, actions}
+	}
+
+	var changes []localChange
+	defer l.notify(&changes)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var written []localChange
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		olds := make([]exprItem, len(writes))
+		reasons, err := checkTransactConditions(len(writes), func(i int) error {
+			w := writes[i]
+			old, err := l.getItemTx(tx, *w.update.TableName, w.key)
+			if err != nil {
+				return err
+			}
+			olds[i] = old
+			return checkCondition(w.update.ConditionExpression, w.update.ExpressionAttributeNames, w.update.ExpressionAttributeValues, old)
+		})
+		if err != nil {
+			return err
+		}
+		if reasons != nil {
+			return transactionCanceled(reasons)
+		}
+		for i, w := range writes {
+			item := cloneItem(olds[i])
+			if item == nil {
+				item = keyOnly(w.update.Key, w.schema.localKeySchema)
+			}
+			if err := applyUpdate(item, w.actions); err != nil {
+				return validationError(err)
+			}
+			written = append(written, localChange{*w.update.TableName, olds[i], cloneItem(item)})
+			if err := l.writeItemTx(tx, *w.update.TableName, w.schema, w.key, olds[i], item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	changes = written
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func (l *localDynamoDB) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	schema, err := l.schema(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := encodeKey(input.Key, schema.localKeySchema)
+	if !ok {
+		return nil, validationError(fmt.Errorf("the provided key element does not match the schema"))
+	}
+	var changes []localChange
+	defer l.notify(&changes)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := &dynamodb.DeleteItemOutput{}
+	var written []localChange
+	err = l.db.Update(func(tx *bolt.Tx) error {
+		old, err := l.getItemTx(tx, *input.TableName, key)
+		if err != nil {
+			return err
+		}
+		if err := checkCondition(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, old); err != nil {
+			return err
+		}
+		if old == nil {
+			return nil
+		}
+		if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld {
+			out.Attributes = old
+		}
+		written = append(written, localChange{*input.TableName, old, nil})
+		return l.writeItemTx(tx, *input.TableName, schema, key, old, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	changes = written
+	return out, nil
+}
+
+// keyConditionHash finds the "hashKey = :value" term of a key condition.
+func keyConditionHash(cond exprCond, hashKey string) *dynamodb.AttributeValue {
+	switch c := cond.(type) {
+	case andCond:
+		if av := keyConditionHash(c.a, hashKey); av != nil {
+			return av
+		}
+		return keyConditionHash(c.b, hashKey)
+	case compareCond:
+		if c.op != "=" {
+			return nil
+		}
+		p, isPath := c.a.(pathOperand)
+		v, isValue := c.b.(valueOperand)
+		if !isPath || !isValue {
+			p, isPath = c.b.(pathOperand)
+			v, isValue = c.a.(valueOperand)
+		}
+		if isPath && isValue && len(p.path) == 1 && p.path[0].name == hashKey {
+			return v.av
+		}
+	}
+	return nil
+}
+
+// sortItems orders items by the sort key of ks and then by primary key, which
+// is the order DynamoDB returns them within a partition.
+func sortItems(items []exprItem, ks localKeySchema, table localKeySchema) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return compareItemPosition(items[i], items[j], ks, table) < 0
+	})
+}
+
+func compareItemPosition(a, b exprItem, ks localKeySchema, table localKeySchema) int {
+	if ks.RangeKey != "" {
+		if cmp, ok := compareAttributeValues(a[ks.RangeKey], b[ks.RangeKey]); ok && cmp != 0 {
+			return cmp
+		}
+	}
+	ka, _ := encodeKey(a, table)
+	kb, _ := encodeKey(b, table)
+	return bytes.Compare(ka, kb)
+}
+
+// paginate applies ExclusiveStartKey and Limit to an ordered list of items and
+// returns the evaluated page plus the LastEvaluatedKey to continue from.
+func paginate(items []exprItem, startKey exprItem, limit *int64, ks localKeySchema, table localKeySchema, forward bool) ([]exprItem, exprItem) {
+	if startKey != nil {
+		idx := len(items)
+		for i, item := range items {
+			cmp := compareItemPosition(item, startKey, ks, table)
+			if (forward && cmp > 0) || (!forward && cmp < 0) {
+				idx = i
+				break
+			}
+		}
+		items = items[idx:]
+	}
+	if limit != nil && *limit > 0 && int64(len(items)) > *limit {
+		page := items[:*limit]
+		return page, keyOnly(page[len(page)-1], table, ks)
+	}
+	return items, nil
+}
+
+func (l *localDynamoDB) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	schema, err := l.schema(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	ks := schema.localKeySchema
+	if input.IndexName != nil {
+		var ok bool
+		if ks, ok = schema.Indexes[*input.IndexName]; !ok {
+			return nil, validationError(fmt.Errorf("the table does not have the specified index: %s", *input.IndexName))
+		}
+	}
+	keyCond, err := parseConditionExpr(input.KeyConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil || keyCond == nil {
+		return nil, validationError(fmt.Errorf("invalid KeyConditionExpression: %v", err))
+	}
+	hashValue := keyConditionHash(keyCond, ks.HashKey)
+	hashPrefix, ok := encodeKeyPart(hashValue)
+	if !ok {
+		return nil, validationError(fmt.Errorf("query condition missed key schema element: %s", ks.HashKey))
+	}
+	filter, err := parseConditionExpr(input.FilterExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, validationError(err)
+	}
+	projection, err := parseProjectionExpr(input.ProjectionExpression, input.ExpressionAttributeNames)
+	if err != nil {
+		return nil, validationError(err)
+	}
+
+	var candidates []exprItem
+	err = l.db.View(func(tx *bolt.Tx) error {
+		table := tx.Bucket([]byte(*input.TableName))
+		if input.IndexName == nil {
+			prefix := hashPrefix
+			if ks.RangeKey != "" {
+				prefix = append(append([]byte{}, hashPrefix...), 0)
+			}
+			c := table.Cursor()
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				if ks.RangeKey == "" && !bytes.Equal(k, hashPrefix) {
+					continue
+				}
+				item, err := unmarshalStoredItem(v)
+				if err != nil {
+					return err
+				}
+				candidates = append(candidates, item)
+			}
+			return nil
+		}
+		prefix := append(append([]byte{}, hashPrefix...), 0)
+		c := tx.Bucket([]byte(localIndexBucket(*input.TableName, *input.IndexName))).Cursor()
+		for k, primary := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, primary = c.Next() {
+			data := table.Get(primary)
+			if data == nil {
+				continue
+			}
+			item, err := unmarshalStoredItem(data)
+			if err != nil {
+				return err
+			}
+			candidates = append(candidates, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	matched := candidates[:0]
+	for _, item := range candidates {
+		ok, err := keyCond.test(item)
+		if err != nil {
+			return nil, validationError(err)
+		}
+		if ok {
+			matched = append(matched, item)
+		}
+	}
+	sortItems(matched, ks, schema.localKeySchema)
+	forward := input.ScanIndexForward == nil || *input.ScanIndexForward
+	if !forward {
+		for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+			matched[i], matched[j] = matched[j], matched[i]
+		}
+	}
+	page, lastKey := paginate(matched, input.ExclusiveStartKey, input.Limit, ks, schema.localKeySchema, forward)
+
+	out := &dynamodb.QueryOutput{ScannedCount: aws.Int64(int64(len(page))), LastEvaluatedKey: lastKey}
+	var count int64
+	for _, item := range page {
+		item = indexEntry(item, ks, schema.localKeySchema)
+		if filter != nil {
+			ok, err := filter.test(item)
+			if err != nil {
+				return nil, validationError(err)
+			}
+			if !ok {
+				continue
+			}
+		}
+		count++
+		if aws.StringValue(input.Select) != dynamodb.SelectCount {
+			out.Items = append(out.Items, projectItem(item, projection))
+		}
+	}
+	out.Count = aws.Int64(count)
+	return out, nil
+}
+
+func (l *localDynamoDB) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	in := *input
+	for {
+		out, err := l.Query(&in)
+		if err != nil {
+			return err
+		}
+		lastPage := out.LastEvaluatedKey == nil
+		if !fn(out, lastPage) || lastPage {
+			return nil
+		}
+		in.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+func (l *localDynamoDB) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	schema, err := l.schema(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := parseConditionExpr(input.FilterExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, validationError(err)
+	}
+	projection, err := parseProjectionExpr(input.ProjectionExpression, input.ExpressionAttributeNames)
+	if err != nil {
+		return nil, validationError(err)
+	}
+
+	out := &dynamodb.ScanOutput{}
+	var scanned, count int64
+	err = l.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(*input.TableName)).Cursor()
+		k, v := c.First()
+		if input.ExclusiveStartKey != nil {
+			start, ok := encodeKey(input.ExclusiveStartKey, schema.localKeySchema)
+			if !ok {
+				return validationError(fmt.Errorf("the provided starting key is invalid"))
+			}
+			k, v = c.Seek(start)
+			if k != nil && bytes.Equal(k, start) {
+				k, v = c.Next()
+			}
+		}
+		var lastKey exprItem
+		for ; k != nil; k, v = c.Next() {
+			if input.Limit != nil && *input.Limit > 0 && scanned == *input.Limit {
+				// More items remain past this page.
+				out.LastEvaluatedKey = lastKey
+				break
+			}
+			item, err := unmarshalStoredItem(v)
+			if err != nil {
+				return err
+			}
+			scanned++
+			lastKey = keyOnly(item, schema.localKeySchema)
+			if filter != nil {
+				ok, err := filter.test(item)
+				if err != nil {
+					return validationError(err)
+				}
+				if !ok {
+					continue
+				}
+			}
+			count++
+			if aws.StringValue(input.Select) != dynamodb.SelectCount {
+				out.Items = append(out.Items, projectItem(item, projection))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	out.Count = aws.Int64(count)
+	out.ScannedCount = aws.Int64(scanned)
+	return out, nil
+}
+
+func (l *localDynamoDB) ScanPages(input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	in := *input
+	for {
+		out, err := l.Scan(&in)
+		if err != nil {
+			return err
+		}
+		lastPage := out.LastEvaluatedKey == nil
+		if !fn(out, lastPage) || lastPage {
+			return nil
+		}
+		in.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
@@ -0,0 +1,1199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// This file contains a small evaluator for the DynamoDB expression language
+// (condition, filter, key condition, projection and update expressions). It is
+// used by the embedded table store in localdb.go and only needs to understand
+// the expressions this service actually issues, but it follows the documented
+// grammar closely enough that new handlers rarely need changes here.
+
+type exprItem = map[string]*dynamodb.AttributeValue
+
+type exprToken struct {
+	kind string // "ident", "name", "value", "number", "op", "eof"
+	text string
+}
+
+func tokenizeExpr(s string) ([]exprToken, error) {
+	var toks []exprToken
+	i := 0
+	for i < len(s) {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '#' || c == ':':
+			j := i + 1
+			for j < len(s) && isExprIdentChar(rune(s[j])) {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("invalid placeholder at position %d", i)
+			}
+			kind := "name"
+			if c == ':' {
+				kind = "value"
+			}
+			toks = append(toks, exprToken{kind: kind, text: s[i:j]})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			toks = append(toks, exprToken{kind: "number", text: s[i:j]})
+			i = j
+		case isExprIdentChar(c):
+			j := i
+			for j < len(s) && isExprIdentChar(rune(s[j])) {
+				j++
+			}
+			toks = append(toks, exprToken{kind: "ident", text: s[i:j]})
+			i = j
+		case c == '<' || c == '>':
+			if i+1 < len(s) && (s[i+1] == '=' || (c == '<' && s[i+1] == '>')) {
+				toks = append(toks, exprToken{kind: "op", text: s[i : i+2]})
+				i += 2
+			} else {
+				toks = append(toks, exprToken{kind: "op", text: string(c)})
+				i++
+			}
+		case strings.ContainsRune("=(),.[]+-", c):
+			toks = append(toks, exprToken{kind: "op", text: string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+		}
+	}
+	return append(toks, exprToken{kind: "eof"}), nil
+}
+
+func isExprIdentChar(c rune) bool {
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// exprPathElem is one step of a document path: either a map key or a list index.
+type exprPathElem struct {
+	name  string
+	index int
+	isIdx bool
+}
+
+type exprPath []exprPathElem
+
+func (p exprPath) String() string {
+	var sb strings.Builder
+	for i, e := range p {
+		if e.isIdx {
+			fmt.Fprintf(&sb, "[%d]", e.index)
+			continue
+		}
+		if i > 0 {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(e.name)
+	}
+	return sb.String()
+}
+
+// resolve returns the attribute at the path, or nil if any step is missing.
+func (p exprPath) resolve(item exprItem) *dynamodb.AttributeValue {
+	if len(p) == 0 || p[0].isIdx {
+		return nil
+	}
+	cur := item[p[0].name]
+	for _, e := range p[1:] {
+		if cur == nil {
+			return nil
+		}
+		if e.isIdx {
+			if cur.L == nil || e.index >= len(cur.L) {
+				return nil
+			}
+			cur = cur.L[e.index]
+		} else {
+			if cur.M == nil {
+				return nil
+			}
+			cur = cur.M[e.name]
+		}
+	}
+	return cur
+}
+
+// set stores av at the path. Intermediate maps and lists must already exist,
+// as in DynamoDB.
+func (p exprPath) set(item exprItem, av *dynamodb.AttributeValue) error {
+	if len(p) == 1 {
+		item[p[0].name] = av
+		return nil
+	}
+	parent := exprPath(p[:len(p)-1]).resolve(item)
+	last := p[len(p)-1]
+	if parent == nil {
+		return fmt.Errorf("the document path provided in the update expression is invalid for update: %s", p)
+	}
+	if last.isIdx {
+		if parent.L == nil {
+			return fmt.Errorf("path %s is not a list", p)
+		}
+		if last.index >= len(parent.L) {
+			parent.L = append(parent.L, av)
+		} else {
+			parent.L[last.index] = av
+		}
+		return nil
+	}
+	if parent.M == nil {
+		return fmt.Errorf("path %s is not a map", p)
+	}
+	parent.M[last.name] = av
+	return nil
+}
+
+func (p exprPath) remove(item exprItem) {
+	if len(p) == 1 {
+		delete(item, p[0].name)
+		return
+	}
+	parent := exprPath(p[:len(p)-1]).resolve(item)
+	if parent == nil {
+		return
+	}
+	last := p[len(p)-1]
+	if last.isIdx {
+		if parent.L != nil && last.index < len(parent.L) {
+			parent.L = append(parent.L[:last.index], parent.L[last.index+1:]...)
+		}
+		return
+	}
+	if parent.M != nil {
+		delete(parent.M, last.name)
+	}
+}
+
+// exprOperand evaluates to an attribute value (nil when the attribute is absent).
+type exprOperand interface {
+	eval(item exprItem) (*dynamodb.AttributeValue, error)
+}
+
+type pathOperand struct{ path exprPath }
+
+func (o pathOperand) eval(item exprItem) (*dynamodb.AttributeValue, error) {
+	return o.path.resolve(item), nil
+}
+
+type valueOperand struct{ av *dynamodb.AttributeValue }
+
+func (o valueOperand) eval(exprItem) (*dynamodb.AttributeValue, error) { return o.av, nil }
+
+type sizeOperand struct{ path exprPath }
+
+func (o sizeOperand) eval(item exprItem) (*dynamodb.AttributeValue, error) {
+	av := o.path.resolve(item)
+	if av == nil {
+		return nil, nil
+	}
+	var n int
+	switch {
+	case av.S != nil:
+		n = len(*av.S)
+	case av.B != nil:
+		n = len(av.B)
+	case av.L != nil:
+		n = len(av.L)
+	case av.M != nil:
+		n = len(av.M)
+	case av.SS != nil:
+		n = len(av.SS)
+	case av.NS != nil:
+		n = len(av.NS)
+	case av.BS != nil:
+		n = len(av.BS)
+	default:
+		return nil, nil
+	}
+	return &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(n))}, nil
+}
+
+type ifNotExistsOperand struct {
+	path     exprPath
+	fallback exprOperand
+}
+
+func (o ifNotExistsOperand) eval(item exprItem) (*dynamodb.AttributeValue, error) {
+	if av := o.path.resolve(item); av != nil {
+		return av, nil
+	}
+	return o.fallback.eval(item)
+}
+
+type listAppendOperand struct{ a, b exprOperand }
+
+func (o listAppendOperand) eval(item exprItem) (*dynamodb.AttributeValue, error) {
+	a, err := o.a.eval(item)
+	if err != nil {
+		return nil, err
+	}
+	b, err := o.b.eval(item)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil || b == nil || a.L == nil || b.L == nil {
+		return nil, fmt.Errorf("list_append requires two list operands")
+	}
+	out := make([]*dynamodb.AttributeValue, 0, len(a.L)+len(b.L))
+	out = append(out, a.L...)
+	out = append(out, b.L...)
+	return &dynamodb.AttributeValue{L: out}, nil
+}
+
+type arithOperand struct {
+	op   string
+	a, b exprOperand
+}
+
+func (o arithOperand) eval(item exprItem) (*dynamodb.AttributeValue, error) {
+	a, err := o.a.eval(item)
+	if err != nil {
+		return nil, err
+	}
+	b, err := o.b.eval(item)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil || b == nil || a.N == nil || b.N == nil {
+		return nil, fmt.Errorf("an operand in the update expression has an incorrect data type")
+	}
+	x, y := parseExprNumber(*a.N), parseExprNumber(*b.N)
+	if o.op == "+" {
+		x.Add(x, y)
+	} else {
+		x.Sub(x, y)
+	}
+	return &dynamodb.AttributeValue{N: aws.String(formatExprNumber(x))}, nil
+}
+
+// exprCond is a parsed condition/filter/key-condition expression.
+type exprCond interface {
+	test(item exprItem) (bool, error)
+}
+
+type andCond struct{ a, b exprCond }
+
+func (c andCond) test(item exprItem) (bool, error) {
+	ok, err := c.a.test(item)
+	if err != nil || !ok {
+		return false, err
+	}
+	return c.b.test(item)
+}
+
+type orCond struct{ a, b exprCond }
+
+func (c orCond) test(item exprItem) (bool, error) {
+	ok, err := c.a.test(item)
+	if err != nil || ok {
+		return ok, err
+	}
+	return c.b.test(item)
+}
+
+type notCond struct{ c exprCond }
+
+func (c notCond) test(item exprItem) (bool, error) {
+	ok, err := c.c.test(item)
+	return !ok, err
+}
+
+type compareCond struct {
+	op   string
+	a, b exprOperand
+}
+
+func (c compareCond) test(item exprItem) (bool, error) {
+	a, err := c.a.eval(item)
+	if err != nil {
+		return false, err
+	}
+	b, err := c.b.eval(item)
+	if err != nil {
+		return false, err
+	}
+	if a == nil || b == nil {
+		// DynamoDB treats a comparison against a missing attribute as false,
+		// which makes "<>" true.
+		return c.op == "<>", nil
+	}
+	if c.op == "=" {
+		return attributeValuesEqual(a, b), nil
+	}
+	if c.op == "<>" {
+		return !attributeValuesEqual(a, b), nil
+	}
+	cmp, ok := compareAttributeValues(a, b)
+	if !ok {
+		return false, nil
+	}
+	switch c.op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	}
+	return false, fmt.Errorf("unknown comparator %s", c.op)
+}
+
+type betweenCond struct{ a, lo, hi exprOperand }
+
+func (c betweenCond) test(item exprItem) (bool, error) {
+	lower, err := compareCond{op: ">=", a: c.a, b: c.lo}.test(item)
+	if err != nil || !lower {
+		return false, err
+	}
+	return compareCond{op: "<=", a: c.a, b: c.hi}.test(item)
+}
+
+type inCond struct {
+	a    exprOperand
+	list []exprOperand
+}
+
+func (c inCond) test(item exprItem) (bool, error) {
+	for _, candidate := range c.list {
+		ok, err := compareCond{op: "=", a: c.a, b: candidate}.test(item)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+type funcCond struct {
+	name string
+	path exprPath
+	arg  exprOperand
+}
+
+func (c funcCond) test(item exprItem) (bool, error) {
+	av := c.path.resolve(item)
+	switch c.name {
+	case "attribute_exists":
+		return av != nil, nil
+	case "attribute_not_exists":
+		return av == nil, nil
+	}
+	if av == nil {
+		return false, nil
+	}
+	arg, err := c.arg.eval(item)
+	if err != nil || arg == nil {
+		return false, err
+	}
+	switch c.name {
+	case "begins_with":
+		if av.S != nil && arg.S != nil {
+			return strings.HasPrefix(*av.S, *arg.S), nil
+		}
+		if av.B != nil && arg.B != nil {
+			return bytes.HasPrefix(av.B, arg.B), nil
+		}
+		return false, nil
+	case "contains":
+		switch {
+		case av.S != nil && arg.S != nil:
+			return strings.Contains(*av.S, *arg.S), nil
+		case av.SS != nil && arg.S != nil:
+			for _, s := range av.SS {
+				if *s == *arg.S {
+					return true, nil
+				}
+			}
+		case av.NS != nil && arg.N != nil:
+			for _, n := range av.NS {
+				if attributeValuesEqual(&dynamodb.AttributeValue{N: n}, arg) {
+					return true, nil
+				}
+			}
+		case av.L != nil:
+			for _, el := range av.L {
+				if attributeValuesEqual(el, arg) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "attribute_type":
+		if arg.S == nil {
+			return false, nil
+		}
+		return attributeTypeOf(av) == *arg.S, nil
+	}
+	return false, fmt.Errorf("unsupported function %s", c.name)
+}
+
+func attributeTypeOf(av *dynamodb.AttributeValue) string {
+	switch {
+	case av.S != nil:
+		return "S"
+	case av.N != nil:
+		return "N"
+	case av.B != nil:
+		return "B"
+	case av.BOOL != nil:
+		return "BOOL"
+	case av.NULL != nil:
+		return "NULL"
+	case av.L != nil:
+		return "L"
+	case av.M != nil:
+		return "M"
+	case av.SS != nil:
+		return "SS"
+	case av.NS != nil:
+		return "NS"
+	case av.BS != nil:
+		return "BS"
+	}
+	return ""
+}
+
+// exprParser is a recursive-descent parser over the token stream, resolving
+// #name and :value placeholders as it goes.
+type exprParser struct {
+	toks   []exprToken
+	pos    int
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+}
+
+// maxExprBytes is the longest expression DynamoDB takes.
+const maxExprBytes = 4096
+
+func newExprParser(expr string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (*exprParser, error) {
+	if len(expr) > maxExprBytes {
+		return nil, fmt.Errorf("expression is %d bytes, longer than %d", len(expr), maxExprBytes)
+	}
+	toks, err := tokenizeExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &exprParser{toks: toks, names: names, values: values}, nil
+}
+
+func (p *exprParser) peek() exprToken { return p.toks[p.pos] }
+
+func (p *exprParser) next() exprToken {
+	t := p.toks[p.pos]
+	if t.kind != "eof" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) isKeyword(words ...string) bool {
+	t := p.peek()
+	if t.kind != "ident" {
+		return false
+	}
+	for _, w := range words {
+		if strings.EqualFold(t.text, w) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == "op" && t.text == op
+}
+
+func (p *exprParser) expectOp(op string) error {
+	if !p.isOp(op) {
+		return fmt.Errorf("syntax error: expected %q near %q", op, p.peek().text)
+	}
+	p.next()
+	return nil
+}
+
+func (p *exprParser) atEnd() bool { return p.peek().kind == "eof" }
+
+func (p *exprParser) parsePath() (exprPath, error) {
+	var path exprPath
+	name, err := p.parsePathName()
+	if err != nil {
+		return nil, err
+	}
+	path = append(path, exprPathElem{name: name})
+	for {
+		switch {
+		case p.isOp("."):
+			p.next()
+			name, err := p.parsePathName()
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, exprPathElem{name: name})
+		case p.isOp("["):
+			p.next()
+			t := p.next()
+			if t.kind != "number" {
+				return nil, fmt.Errorf("syntax error: expected list index near %q", t.text)
+			}
+			idx, _ := strconv.Atoi(t.text)
+			if err := p.expectOp("]"); err != nil {
+				return nil, err
+			}
+			path = append(path, exprPathElem{index: idx, isIdx: true})
+		default:
+			return path, nil
+		}
+	}
+}
+
+func (p *exprParser) parsePathName() (string, error) {
+	t := p.next()
+	switch t.kind {
+	case "ident":
+		return t.text, nil
+	case "name":
+		name, ok := p.names[t.text]
+		if !ok || name == nil {
+			return "", fmt.Errorf("an expression attribute name used in the document path is not defined: %s", t.text)
+		}
+		return *name, nil
+	}
+	return "", fmt.Errorf("syntax error: expected attribute name near %q", t.text)
+}
+
+func (p *exprParser) parseOperand() (exprOperand, error) {
+	t := p.peek()
+	if t.kind == "value" {
+		p.next()
+		av, ok := p.values[t.text]
+		if !ok || av == nil {
+			return nil, fmt.Errorf("an expression attribute value used in expression is not defined: %s", t.text)
+		}
+		return valueOperand{av: av}, nil
+	}
+	if t.kind == "ident" && p.toks[p.pos+1].kind == "op" && p.toks[p.pos+1].text == "(" {
+		fn := strings.ToLower(t.text)
+		p.next()
+		p.next()
+		var op exprOperand
+		switch fn {
+		case "size":
+			path, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			op = sizeOperand{path: path}
+		case "if_not_exists":
+			path, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOp(","); err != nil {
+				return nil, err
+			}
+			fallback, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			op = ifNotExistsOperand{path: path, fallback: fallback}
+		case "list_append":
+			a, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOp(","); err != nil {
+				return nil, err
+			}
+			b, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			op = listAppendOperand{a: a, b: b}
+		default:
+			return nil, fmt.Errorf("invalid function name: %s", t.text)
+		}
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		return op, nil
+	}
+	path, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	return pathOperand{path: path}, nil
+}
+
+func (p *exprParser) parseCondition() (exprCond, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orCond{a: left, b: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprCond, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andCond{a: left, b: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (exprCond, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notCond{c: c}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprCond, error) {
+	if p.isOp("(") {
+		p.next()
+		c, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		return c, p.expectOp(")")
+	}
+
+	t := p.peek()
+	if t.kind == "ident" && p.toks[p.pos+1].kind == "op" && p.toks[p.pos+1].text == "(" {
+		fn := strings.ToLower(t.text)
+		switch fn {
+		case "attribute_exists", "attribute_not_exists", "begins_with", "contains", "attribute_type":
+			p.next()
+			p.next()
+			path, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			c := funcCond{name: fn, path: path}
+			if fn != "attribute_exists" && fn != "attribute_not_exists" {
+				if err := p.expectOp(","); err != nil {
+					return nil, err
+				}
+				if c.arg, err = p.parseOperand(); err != nil {
+					return nil, err
+				}
+			}
+			return c, p.expectOp(")")
+		}
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case p.isKeyword("BETWEEN"):
+		p.next()
+		lo, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isKeyword("AND") {
+			return nil, fmt.Errorf("syntax error: expected AND in BETWEEN")
+		}
+		p.next()
+		hi, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return betweenCond{a: left, lo: lo, hi: hi}, nil
+	case p.isKeyword("IN"):
+		p.next()
+		if err := p.expectOp("("); err != nil {
+			return nil, err
+		}
+		var list []exprOperand
+		for {
+			op, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, op)
+			if !p.isOp(",") {
+				break
+			}
+			p.next()
+		}
+		return inCond{a: left, list: list}, p.expectOp(")")
+	}
+	op := p.next()
+	if op.kind != "op" || !isExprComparator(op.text) {
+		return nil, fmt.Errorf("syntax error: expected comparator near %q", op.text)
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return compareCond{op: op.text, a: left, b: right}, nil
+}
+
+func isExprComparator(s string) bool {
+	switch s {
+	case "=", "<>", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+// parseConditionExpr parses a condition, filter or key condition expression.
+func parseConditionExpr(expr *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (exprCond, error) {
+	if expr == nil || strings.TrimSpace(*expr) == "" {
+		return nil, nil
+	}
+	p, err := newExprParser(*expr, names, values)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.parseCondition()
+	if err != nil {
+		return nil, err
+	}
+	if !p.atEnd() {
+		return nil, fmt.Errorf("syntax error: unexpected token %q", p.peek().text)
+	}
+	return c, nil
+}
+
+// parseProjectionExpr returns the paths named in a projection expression.
+func parseProjectionExpr(expr *string, names map[string]*string) ([]exprPath, error) {
+	if expr == nil || strings.TrimSpace(*expr) == "" {
+		return nil, nil
+	}
+	p, err := newExprParser(*expr, names, nil)
+	if err != nil {
+		return nil, err
+	}
+	var paths []exprPath
+	for {
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	if !p.atEnd() {
+		return nil, fmt.Errorf("syntax error: unexpected token %q", p.peek().text)
+	}
+	return paths, nil
+}
+
+// projectItem keeps only the attributes named by the projection. A path into
+// a map keeps just the entries named, as DynamoDB does; a path into a list
+// keeps the whole list.
+func projectItem(item exprItem, paths []exprPath) exprItem {
+	if paths == nil {
+		return item
+	}
+	out := make(exprItem)
+	for _, path := range paths {
+		projectPath(item, out, path)
+	}
+	return out
+}
+
+func projectPath(from, to exprItem, path exprPath) {
+	av, ok := from[path[0].name]
+	if !ok {
+		return
+	}
+	rest := path[1:]
+	switch {
+	case len(rest) == 0 || (rest[0].isIdx && av.L != nil):
+		to[path[0].name] = av
+	case !rest[0].isIdx && av.M != nil:
+		sub := to[path[0].name]
+		if sub == av {
+			return // already projected whole
+		}
+		if sub == nil {
+			sub = &dynamodb.AttributeValue{M: make(exprItem)}
+			to[path[0].name] = sub
+		}
+		projectPath(av.M, sub.M, rest)
+	}
+}
+
+type updateAction struct {
+	verb  string // SET, REMOVE, ADD, DELETE
+	path  exprPath
+	value exprOperand
+}
+
+// parseUpdateExpr parses an update expression into the ordered list of actions.
+func parseUpdateExpr(expr string, names map[string]*string, values map[string]*dynamodb.AttributeValue) ([]updateAction, error) {
+	p, err := newExprParser(expr, names, values)
+	if err != nil {
+		return nil, err
+	}
+	var actions []updateAction
+	for !p.atEnd() {
+		if !p.isKeyword("SET", "REMOVE", "ADD", "DELETE") {
+			return nil, fmt.Errorf("syntax error: unexpected token %q in update expression", p.peek().text)
+		}
+		verb := strings.ToUpper(p.next().text)
+		for {
+			path, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			action := updateAction{verb: verb, path: path}
+			switch verb {
+			case "SET":
+				if err := p.expectOp("="); err != nil {
+					return nil, err
+				}
+				val, err := p.parseOperand()
+				if err != nil {
+					return nil, err
+				}
+				if p.isOp("+") || p.isOp("-") {
+					op := p.next().text
+					rhs, err := p.parseOperand()
+					if err != nil {
+						return nil, err
+					}
+					val = arithOperand{op: op, a: val, b: rhs}
+				}
+				action.value = val
+			case "ADD", "DELETE":
+				val, err := p.parseOperand()
+				if err != nil {
+					return nil, err
+				}
+				action.value = val
+			}
+			actions = append(actions, action)
+			if !p.isOp(",") {
+				break
+			}
+			p.next()
+		}
+	}
+	return actions, nil
+}
+
+// applyUpdate evaluates all right-hand sides against the original item before
+// mutating it, matching DynamoDB's semantics for expressions such as
+// "SET a = b, b = a".
+func applyUpdate(item exprItem, actions []updateAction) error {
+	original := cloneItem(item)
+	type pending struct {
+		action updateAction
+		value  *dynamodb.AttributeValue
+	}
+	var resolved []pending
+	for _, a := range actions {
+		var val *dynamodb.AttributeValue
+		if a.value != nil {
+			v, err := a.value.eval(original)
+			if err != nil {
+				return err
+			}
+			if v == nil {
+				return fmt.Errorf("the provided expression refers to an attribute that does not exist in the item")
+			}
+			val = v
+		}
+		resolved = append(resolved, pending{action: a, value: val})
+	}
+	for _, r := range resolved {
+		path := r.action.path
+		switch r.action.verb {
+		case "SET":
+			if err := path.set(item, cloneAttributeValue(r.value)); err != nil {
+				return err
+			}
+		case "REMOVE":
+			path.remove(item)
+		case "ADD":
+			cur := path.resolve(item)
+			switch {
+			case r.value.N != nil:
+				sum := parseExprNumber(*r.value.N)
+				if cur != nil {
+					if cur.N == nil {
+						return fmt.Errorf("an operand in the update expression has an incorrect data type")
+					}
+					sum.Add(sum, parseExprNumber(*cur.N))
+				}
+				if err := path.set(item, &dynamodb.AttributeValue{N: aws.String(formatExprNumber(sum))}); err != nil {
+					return err
+				}
+			case r.value.SS != nil || r.value.NS != nil:
+				merged := cloneAttributeValue(r.value)
+				if cur != nil {
+					merged = unionSets(cur, r.value)
+				}
+				if err := path.set(item, merged); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("ADD only supports numbers and sets")
+			}
+		case "DELETE":
+			if cur := path.resolve(item); cur != nil {
+				remaining := subtractSets(cur, r.value)
+				if remaining == nil {
+					path.remove(item)
+				} else if err := path.set(item, remaining); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func unionSets(a, b *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	out := cloneAttributeValue(a)
+	if b.SS != nil {
+		seen := make(map[string]bool)
+		for _, s := range out.SS {
+			seen[*s] = true
+		}
+		for _, s := range b.SS {
+			if !seen[*s] {
+				out.SS = append(out.SS, aws.String(*s))
+				seen[*s] = true
+			}
+		}
+	}
+	if b.NS != nil {
+		for _, n := range b.NS {
+			found := false
+			for _, existing := range out.NS {
+				if parseExprNumber(*existing).Cmp(parseExprNumber(*n)) == 0 {
+					found = true
+					break
+				}
+			}
+			if !found {
+				out.NS = append(out.NS, aws.String(*n))
+			}
+		}
+	}
+	return out
+}
+
+func subtractSets(a, b *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	out := &dynamodb.AttributeValue{}
+	if a.SS != nil {
+		remove := make(map[string]bool)
+		for _, s := range b.SS {
+			remove[*s] = true
+		}
+		for _, s := range a.SS {
+			if !remove[*s] {
+				out.SS = append(out.SS, aws.String(*s))
+			}
+		}
+		if len(out.SS) == 0 {
+			return nil
+		}
+		return out
+	}
+	if a.NS != nil {
+		for _, n := range a.NS {
+			keep := true
+			for _, r := range b.NS {
+				if parseExprNumber(*n).Cmp(parseExprNumber(*r)) == 0 {
+					keep = false
+					break
+				}
+			}
+			if keep {
+				out.NS = append(out.NS, aws.String(*n))
+			}
+		}
+		if len(out.NS) == 0 {
+			return nil
+		}
+		return out
+	}
+	return a
+}
+
+func parseExprNumber(s string) *big.Float {
+	f, _, err := big.ParseFloat(strings.TrimSpace(s), 10, 128, big.ToNearestEven)
+	if err != nil {
+		return new(big.Float).SetPrec(128)
+	}
+	return f
+}
+
+func formatExprNumber(f *big.Float) string {
+	if f.IsInt() {
+		i, _ := f.Int(nil)
+		return i.String()
+	}
+	return f.Text('g', -1)
+}
+
+// attributeValuesEqual reports whether two attribute values are identical in
+// type and value.
+func attributeValuesEqual(a, b *dynamodb.AttributeValue) bool {
+	if attributeTypeOf(a) != attributeTypeOf(b) {
+		return false
+	}
+	switch {
+	case a.S != nil:
+		return *a.S == *b.S
+	case a.N != nil:
+		return parseExprNumber(*a.N).Cmp(parseExprNumber(*b.N)) == 0
+	case a.B != nil:
+		return bytes.Equal(a.B, b.B)
+	case a.BOOL != nil:
+		return *a.BOOL == *b.BOOL
+	case a.NULL != nil:
+		return true
+	case a.L != nil:
+		if len(a.L) != len(b.L) {
+			return false
+		}
+		for i := range a.L {
+			if !attributeValuesEqual(a.L[i], b.L[i]) {
+				return false
+			}
+		}
+		return true
+	case a.M != nil:
+		if len(a.M) != len(b.M) {
+			return false
+		}
+		for k, v := range a.M {
+			w, ok := b.M[k]
+			if !ok || !attributeValuesEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case a.SS != nil:
+		return len(subtractSetsOrEmpty(a, b).SS) == 0 && len(a.SS) == len(b.SS)
+	case a.NS != nil:
+		return len(subtractSetsOrEmpty(a, b).NS) == 0 && len(a.NS) == len(b.NS)
+	}
+	return false
+}
+
+func subtractSetsOrEmpty(a, b *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if out := subtractSets(a, b); out != nil {
+		return out
+	}
+	return &dynamodb.AttributeValue{}
+}
+
+// compareAttributeValues orders two scalar values of the same type. The second
+// result is false when the values are not comparable.
+func compareAttributeValues(a, b *dynamodb.AttributeValue) (int, bool) {
+	switch {
+	case a.S != nil && b.S != nil:
+		return strings.Compare(*a.S, *b.S), true
+	case a.N != nil && b.N != nil:
+		return parseExprNumber(*a.N).Cmp(parseExprNumber(*b.N)), true
+	case a.B != nil && b.B != nil:
+		return bytes.Compare(a.B, b.B), true
+	}
+	return 0, false
+}
+
+func cloneAttributeValue(av *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if av == nil {
+		return nil
+	}
+	out := &dynamodb.AttributeValue{}
+	if av.S != nil {
+		out.S = aws.String(*av.S)
+	}
+	if av.N != nil {
+		out.N = aws.String(*av.N)
+	}
+	if av.B != nil {
+		out.B = append([]byte{}, av.B...)
+	}
+	if av.BOOL != nil {
+		out.BOOL = aws.Bool(*av.BOOL)
+	}
+	if av.NULL != nil {
+		out.NULL = aws.Bool(*av.NULL)
+	}
+	if av.L != nil {
+		out.L = make([]*dynamodb.AttributeValue, len(av.L))
+		for i, el := range av.L {
+			out.L[i] = cloneAttributeValue(el)
+		}
+	}
+	if av.M != nil {
+		out.M = cloneItem(av.M)
+	}
+	for _, s := range av.SS {
+		out.SS = append(out.SS, aws.String(*s))
+	}
+	for _, n := range av.NS {
+		out.NS = append(out.NS, aws.String(*n))
+	}
+	for _, b := range av.BS {
+		out.BS = append(out.BS, append([]byte{}, b...))
+	}
+	return out
+}
+
+func cloneItem(item exprItem) exprItem {
+	if item == nil {
+		return nil
+	}
+	out := make(exprItem, len(item))
+	for k, v := range item {
+		out[k] = cloneAttributeValue(v)
+	}
+	return out
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// localS3 implements the parts of s3iface.S3API used by this service on top of
+// a directory. Object keys map directly to relative file paths under root, so
+// the bucket layout (incoming/, images/, approved/, projects/, ...) is
+// preserved on disk. The bucket argument of each call is ignored.
+type localS3 struct {
+	s3iface.S3API
+	root string
+	// publicURL is the externally reachable base URL of the server, used to
+	// build download links. Empty means links are relative to the API host.
+	publicURL string
+	// signingKey authenticates download links handed out by ObjectStore.PresignGet.
+	signingKey []byte
+}
+
+func newLocalS3(root, publicURL string, signingKey []byte) (*localS3, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create object directory %s: %v", root, err)
+	}
+	return &localS3{root: root, publicURL: strings.TrimRight(publicURL, "/"), signingKey: signingKey}, nil
+}
+
+// objectPath maps an object key to a file path, refusing keys that would
+// escape the root directory.
+func (l *localS3) objectPath(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || strings.HasSuffix(key, "/") {
+		return "", awserr.New("InvalidArgument", "invalid object key: "+key, nil)
+	}
+	return filepath.Join(l.root, filepath.FromSlash(strings.TrimPrefix(cleaned, "/"))), nil
+}
+
+func noSuchKey(key string) error {
+	return awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist: "+key, nil)
+}
+
+func (l *localS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	p, err := l.objectPath(aws.StringValue(input.Key))
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, noSuchKey(aws.StringValue(input.Key))
+		}
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &s3.GetObjectOutput{
+		Body:          f,
+		ContentLength: aws.Int64(info.Size()),
+		LastModified:  aws.Time(info.ModTime()),
+	}, nil
+}
+
+func (l *localS3) GetObjectWithContext(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	return l.GetObject(input)
+}
+
+func (l *localS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	p, err := l.objectPath(aws.StringValue(input.Key))
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, awserr.New("NotFound", "Not Found", nil)
+		}
+		return nil, err
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(info.Size()),
+		LastModified:  aws.Time(info.ModTime()),
+	}, nil
+}
+
+// writeFile writes atomically so readers never observe a partial object.
+func (l *localS3) writeFile(key string, body io.Reader) error {
+	p, err := l.objectPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (l *localS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	var body io.Reader = bytes.NewReader(nil)
+	if input.Body != nil {
+		body = input.Body
+	}
+	if err := l.writeFile(aws.StringValue(input.Key), body); err != nil {
+		return nil, err
+	}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (l *localS3) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	// CopySource is the URL-escaped "bucket/key".
+	source, err := url.PathUnescape(aws.StringValue(input.CopySource))
+	if err != nil {
+		return nil, awserr.New("InvalidArgument", "invalid copy source", err)
+	}
+	source = strings.TrimPrefix(source, "/")
+	if i := strings.Index(source, "/"); i >= 0 {
+		source = source[i+1:]
+	}
+	src, err := l.GetObject(&s3.GetObjectInput{Key: aws.String(source)})
+	if err != nil {
+		return nil, err
+	}
+	defer src.Body.Close()
+	if err := l.writeFile(aws.StringValue(input.Key), src.Body); err != nil {
+		return nil, err
+	}
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (l *localS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	p, err := l.objectPath(aws.StringValue(input.Key))
+	if err != nil {
+		return nil, err
+	}
+	// S3 deletes are idempotent.
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l.pruneEmptyDirs(filepath.Dir(p))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// pruneEmptyDirs removes directories left empty by a delete, since S3 has no
+// directories and an empty "approved/red/2024/01/01" would otherwise linger.
+func (l *localS3) pruneEmptyDirs(dir string) {
+	for dir != l.root && strings.HasPrefix(dir, l.root) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (l *localS3) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	prefix := aws.StringValue(input.Prefix)
+	maxKeys := 1000
+	if input.MaxKeys != nil && *input.MaxKeys > 0 && *input.MaxKeys < 1000 {
+		maxKeys = int(*input.MaxKeys)
+	}
+	after := aws.StringValue(input.StartAfter)
+	if input.ContinuationToken != nil {
+		after = *input.ContinuationToken
+	}
+
+	// Only walk the deepest directory that can contain matching keys.
+	walkRoot := l.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		walkRoot = filepath.Join(l.root, filepath.FromSlash(prefix[:i]))
+	}
+	var keys []string
+	err := filepath.WalkDir(walkRoot, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	out := &s3.ListObjectsV2Output{Prefix: input.Prefix, IsTruncated: aws.Bool(false)}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		out.IsTruncated = aws.Bool(true)
+		out.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+	for _, key := range keys {
+		info, err := os.Stat(filepath.Join(l.root, filepath.FromSlash(key)))
+		if err != nil {
+			continue
+		}
+		out.Contents = append(out.Contents, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(info.Size()),
+			LastModified: aws.Time(info.ModTime()),
+		})
+	}
+	out.KeyCount = aws.Int64(int64(len(out.Contents)))
+	return out, nil
+}
+
+func (l *localS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	in := *input
+	for {
+		out, err := l.ListObjectsV2(&in)
+		if err != nil {
+			return err
+		}
+		lastPage := !aws.BoolValue(out.IsTruncated)
+		if !fn(out, lastPage) || lastPage {
+			return nil
+		}
+		in.ContinuationToken = out.NextContinuationToken
+	}
+}
+
+// signMediaURL returns the signature query parameter for a download link.
+func (l *localS3) signMediaURL(key string, expires int64, filename string) string {
+	mac := hmac.New(sha256.New, l.signingKey)
+	fmt.Fprintf(mac, "%s\n%d\n%s", key, expires, filename)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// presign builds a time-limited /media/ link, the local stand-in for an S3
+// presigned GET URL.
+func (l *localS3) presign(key, filename string, expiry time.Duration) string {
+	expires := time.Now().Add(expiry).Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	if filename != "" {
+		q.Set("filename", filename)
+	}
+	q.Set("sig", l.signMediaURL(key, expires, filename))
+	return l.publicURL + "/media/" + (&url.URL{Path: key}).EscapedPath() + "?" + q.Encode()
+}
+
+// verifyMediaURL checks a link produced by presign.
+func (l *localS3) verifyMediaURL(key string, q url.Values) bool {
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := l.signMediaURL(key, expires, q.Get("filename"))
+	return hmac.Equal([]byte(expected), []byte(q.Get("sig")))
+}
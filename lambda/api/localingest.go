@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/google/uuid"
+)
+
+// Self-hosted ingest is a reduced port of the thumbnail Lambda: files dropped
+// into incoming/ are picked up by polling instead of S3 notifications. JPGs
+// get the same images/{uuid}.jpg layout and thumbnails; RAW files are linked
+// to the JPG with the same base name. EXIF extraction, embedded RAW previews
+// and AI analysis at ingest are not available.
+
+const localIngestPrefix = "incoming/"
+
+// runLocalIngest polls incoming/ until the process exits.
+func runLocalIngest(interval time.Duration) {
+	for {
+		if err := ingestLocalIncoming(); err != nil {
+			fmt.Printf("Local ingest error: %v\n", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func ingestLocalIncoming() error {
+	objects, err := objectStore.List(localIngestPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to list incoming files: %v", err)
+	}
+	var jpgs, raws []string
+	for _, obj := range objects {
+		ext := strings.ToLower(filepath.Ext(obj.Key))
+		if ext == ".jpg" || ext == ".jpeg" {
+			jpgs = append(jpgs, obj.Key)
+			continue
+		}
+		for _, rawExt := range rawExtensions {
+			if ext == rawExt {
+				raws = append(raws, obj.Key)
+				break
+			}
+		}
+	}
+
+	// JPGs first so RAW files in the same batch find their record.
+	for _, key := range jpgs {
+		if err := ingestLocalJpg(key); err != nil {
+			fmt.Printf("Failed to ingest %s: %v\n", key, err)
+		}
+	}
+	for _, key := range raws {
+		if err := ingestLocalRaw(key); err != nil {
+			fmt.Printf("Failed to ingest %s: %v\n", key, err)
+		}
+	}
+	return nil
+}
+
+// findImageByOriginalFilename looks up an image record by its original base filename
+func findImageByOriginalFilename(baseName string) (map[string]*dynamodb.AttributeValue, error) {
+	result, err := imageStore.QueryImages(ItemQuery{
+		Index:        "OriginalFilenameIndex",
+		KeyCondition: "OriginalFilename = :name",
+		Values: map[string]*dynamodb.AttributeValue{
+			":name": {S: aws.String(baseName)},
+		},
+		Limit: 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Items) == 0 {
+		return nil, nil
+	}
+	return result.Items[0], nil
+}
+
+func ingestLocalJpg(key string) error {
+	originalFilename := strings.TrimSuffix(filepath.Base(key), filepath.Ext(key))
+
+	existing, err := findImageByOriginalFilename(originalFilename)
+	if err != nil {
+		return fmt.Errorf("idempotency check failed: %v", err)
+	}
+	if existing != nil {
+		fmt.Printf("Skipping already processed file: %s\n", key)
+		deleteS3Object(key)
+		return nil
+	}
+
+	body, err := objectStore.Get(key)
+	if err != nil {
+		return fmt.Errorf("failed to get object: %v", err)
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read file data: %v", err)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		// Same treatment as the thumbnail Lambda: park it so it isn't retried forever
+		fmt.Printf("Corrupted/unsupported image detected: %s - %v\n", key, err)
+		if err := copyS3Object(key, "corrupted/"+filepath.Base(key)); err != nil {
+			return err
+		}
+		deleteS3Object(key)
+		return nil
+	}
+
+	imageGUID := uuid.New().String()
+	newKey := fmt.Sprintf("images/%s.jpg", imageGUID)
+	thumb50Key := fmt.Sprintf("images/%s.50.jpg", imageGUID)
+	thumb400Key := fmt.Sprintf("images/%s.400.jpg", imageGUID)
+
+	uploads := []struct {
+		key  string
+		data []byte
+	}{{newKey, data}}
+	for _, t := range []struct {
+		key    string
+		height int
+	}{{thumb50Key, 150}, {thumb400Key, 800}} {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resizeToHeight(img, t.height), &jpeg.Options{Quality: 80}); err != nil {
+			return fmt.Errorf("failed to encode thumbnail: %v", err)
+		}
+		uploads = append(uploads, struct {
+			key  string
+			data []byte
+		}{t.key, buf.Bytes()})
+	}
+	for _, u := range uploads {
+		if err := objectStore.Put(u.key, bytes.NewReader(u.data), "image/jpeg"); err != nil {
+			return fmt.Errorf("failed to write %s: %v", u.key, err)
+		}
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	captureDate, captureYear := captureDateFields(time.Now())
+	bounds := img.Bounds()
+	item, err := dynamodbattribute.MarshalMap(map[string]interface{}{
+		"ImageGUID":        imageGUID,
+		"OriginalFile":     newKey,
+		"OriginalFilename": originalFilename,
+		"Bucket":           bucketName,
+		"Thumbnail50":      thumb50Key,
+		"Thumbnail400":     thumb400Key,
+		"RelatedFiles":     []string{},
+		"EXIFData":         map[string]string{},
+		"Width":            bounds.Dx(),
+		"Height":           bounds.Dy(),
+		"FileSize":         len(data),
+		"Reviewed":         "false",
+		"Status":           "inbox",
+		"InsertedDateTime": now,
+		"UpdatedDateTime":  now,
+		"CaptureDate":      captureDate,
+		"CaptureYear":      captureYear,
+	})
+	if err != nil {
+		return err
+	}
+	if err := imageStore.PutImage(item); err != nil {
+		return fmt.Errorf("failed to store metadata: %v", err)
+	}
+	indexImageItem(item)
+
+	fmt.Printf("Ingested %s -> %s (GUID: %s)\n", key, newKey, imageGUID)
+	deleteS3Object(key)
+	return nil
+}
+
+// ingestLocalRaw links a RAW file to the JPG record with the same base name.
+// RAW files without a JPG stay in incoming/ until one arrives.
+func ingestLocalRaw(key string) error {
+	originalFilename := strings.TrimSuffix(filepath.Base(key), filepath.Ext(key))
+	existing, err := findImageByOriginalFilename(originalFilename)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return nil
+	}
+	imageGUID := aws.StringValue(existing["ImageGUID"].S)
+	if existing["RawFile"] != nil && aws.StringValue(existing["RawFile"].S) != "" {
+		fmt.Printf("RAW file already linked for %s\n", originalFilename)
+		deleteS3Object(key)
+		return nil
+	}
+
+	newKey := fmt.Sprintf("images/%s%s", imageGUID, filepath.Ext(key))
+	if err := copyS3Object(key, newKey); err != nil {
+		return err
+	}
+	_, err = imageStore.UpdateImage(imageGUID, bumpVersion(ItemUpdate{
+		Expression: "SET RawFile = :rawFile, UpdatedDateTime = :updated",
+		Values: map[string]*dynamodb.AttributeValue{
+			":rawFile": {S: aws.String(newKey)},
+			":updated": {S: aws.String(time.Now().Format(time.RFC3339))},
+		},
+	}))
+	if err != nil {
+		return fmt.Errorf("failed to link RAW file: %v", err)
+	}
+	fmt.Printf("Linked RAW %s -> %s (GUID: %s)\n", key, newKey, imageGUID)
+	deleteS3Object(key)
+	return nil
+}
+
+// resizeToHeight scales an image to the given height with a box filter,
+// keeping the aspect ratio. Images already smaller are returned unchanged.
+func resizeToHeight(src image.Image, height int) image.Image {
+	b := src.Bounds()
+	if b.Dy() <= height {
+		return src
+	}
+	width := b.Dx() * height / b.Dy()
+	if width < 1 {
+		width = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := b.Min.Y + (y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := b.Min.X + (x+1)*b.Dx()/width
+			var r, g, bl, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, _ := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					n++
+				}
+			}
+			if n == 0 {
+				n = 1
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), 0xffff})
+		}
+	}
+	return dst
+}
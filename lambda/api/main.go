@@ -26,18 +26,19 @@ import (
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	lambdasvc "github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/sqs"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var (
 	sess              *session.Session
-	ddbClient         *dynamodb.DynamoDB
-	s3Client          *s3.S3
+	ddbClient         dynamodbiface.DynamoDBAPI
+	s3Client          s3iface.S3API
 	lambdaClient      *lambdasvc.Lambda
 	cwLogsClient      *cloudwatchlogs.CloudWatchLogs
 	sqsClient         *sqs.SQS
@@ -46,6 +47,12 @@ var (
 	usersTable        string
 	reviewGroupsTable string
 	projectsTable     string
+	rateLimitTable    string
+	auditTable        string
+	searchTable       string
+	statsTable        string
+	changesTable      string
+	jobsTable         string
 	adminUsername     string
 	adminPassword     string
 	functionName      string
@@ -53,7 +60,10 @@ var (
 	zipLambdaName     string
 	sqsQueueURL       string
 	sqsDLQURL         string
-	jwtSecret         = []byte("kill-snap-secret-key-change-in-production")
+	require2FA        bool
+
+	// Images queued to be added to projects (projectqueue.go)
+	projectImageQueueURL string
 )
 
 func init() {
@@ -68,6 +78,12 @@ func init() {
 	usersTable = os.Getenv("USERS_TABLE")
 	reviewGroupsTable = os.Getenv("REVIEW_GROUPS_TABLE")
 	projectsTable = os.Getenv("PROJECTS_TABLE")
+	rateLimitTable = os.Getenv("RATE_LIMIT_TABLE")
+	auditTable = os.Getenv("AUDIT_TABLE")
+	searchTable = os.Getenv("SEARCH_TABLE")
+	statsTable = os.Getenv("STATS_TABLE")
+	changesTable = os.Getenv("CHANGES_TABLE")
+	jobsTable = os.Getenv("JOBS_TABLE")
 	adminUsername = os.Getenv("ADMIN_USERNAME")
 	adminPassword = os.Getenv("ADMIN_PASSWORD")
 	functionName = os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
@@ -75,6 +91,21 @@ func init() {
 	zipLambdaName = os.Getenv("ZIP_LAMBDA_NAME")
 	sqsQueueURL = os.Getenv("SQS_QUEUE_URL")
 	sqsDLQURL = os.Getenv("SQS_DLQ_URL")
+	projectImageQueueURL = os.Getenv("PROJECT_IMAGE_QUEUE_URL")
+	initImageIndexes(os.Getenv("IMAGE_INDEXES"))
+	require2FA = os.Getenv("REQUIRE_2FA") == "true"
+	dataDir = os.Getenv("DATA_DIR")
+	serverAddr = os.Getenv("SERVER_ADDR")
+	publicURL = os.Getenv("PUBLIC_URL")
+	webDir = os.Getenv("WEB_DIR")
+	initJWTKeys(os.Getenv("JWT_SIGNING_KEYS"))
+	initOIDC(os.Getenv)
+
+	// Self-hosted mode: swap the AWS clients for local backends
+	if dataDir != "" {
+		initLocalBackends()
+	}
+	initStores()
 
 	// Initialize admin user if it doesn't exist
 	if adminUsername != "" && adminPassword != "" {
@@ -88,14 +119,20 @@ type LoginRequest struct {
 }
 
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int    `json:"expiresIn"` // Access token lifetime in seconds
+	Username     string `json:"username"`
+	Role         string `json:"role"`
+	// Set once, when two-factor authentication is enabled during login
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
 }
 
 type ImageResponse struct {
 	ImageGUID        string            `json:"imageGUID"`
-	OriginalFile     string            `json:"originalFile"`     // S3 key (UUID-based: images/{uuid}.jpg)
+	OriginalFile     string            `json:"originalFile"`               // S3 key (UUID-based: images/{uuid}.jpg)
 	OriginalFilename string            `json:"originalFilename,omitempty"` // Original base filename without extension
-	RawFile          string            `json:"rawFile,omitempty"` // S3 key of linked RAW file
+	RawFile          string            `json:"rawFile,omitempty"`          // S3 key of linked RAW file
 	Thumbnail50      string            `json:"thumbnail50"`
 	Thumbnail400     string            `json:"thumbnail400"`
 	Bucket           string            `json:"bucket"`
@@ -113,9 +150,15 @@ type ImageResponse struct {
 	RelatedFiles     []string          `json:"relatedFiles,omitempty"`
 	InsertedDateTime string            `json:"insertedDateTime,omitempty"`
 	UpdatedDateTime  string            `json:"updatedDateTime,omitempty"`
-	MoveStatus       string            `json:"moveStatus,omitempty"` // "pending", "moving", "complete", "failed"
-	Status           string            `json:"status,omitempty"`     // "inbox", "approved", "rejected", "deleted", "project"
+	CaptureDate      string            `json:"captureDate,omitempty"` // When the photo was taken; see timeline.go
+	MoveStatus       string            `json:"moveStatus,omitempty"`  // "pending", "moving", "complete", "failed"
+	Status           string            `json:"status,omitempty"`      // "inbox", "approved", "rejected", "deleted", "project"
 	ProjectID        string            `json:"projectId,omitempty"`
+	Version          int               `json:"version"` // Bumped by every change; see versions.go
+	MoveJournal      *MoveJournal      `json:"moveJournal,omitempty"`
+	// MoveState is "moving" or "failed" while a move is unfinished; it only
+	// keys MoveStateIndex, see moves.go
+	MoveState string `json:"-" dynamodbav:"MoveState,omitempty"`
 }
 
 type UpdateImageRequest struct {
@@ -136,6 +179,12 @@ type Project struct {
 	Keywords   []string  `json:"keywords,omitempty" dynamodbav:"Keywords,omitempty"`
 	ZipFiles   []ZipFile `json:"zipFiles,omitempty" dynamodbav:"ZipFiles,omitempty"`
 	Archived   bool      `json:"archived,omitempty" dynamodbav:"Archived,omitempty"`
+	// Members maps usernames to their project role (owner, editor or viewer)
+	Members map[string]string `json:"members,omitempty" dynamodbav:"Members,omitempty"`
+	// Version is bumped by changes to the project's settings and members
+	Version int `json:"version" dynamodbav:"Version,omitempty"`
+	// MyRole is the caller's role on the project, filled in per request
+	MyRole string `json:"myRole,omitempty" dynamodbav:"-"`
 }
 
 // ZipFile represents a generated zip file for a project
@@ -167,11 +216,11 @@ type AddToProjectRequest struct {
 
 // AsyncMoveRequest is used for async Lambda invocation to move files
 type AsyncMoveRequest struct {
-	Action      string `json:"action"` // "move_files"
-	ImageGUID   string `json:"imageGUID"`
-	DestPrefix  string `json:"destPrefix"`
-	NewStatus   string `json:"newStatus"` // "approved", "rejected", "deleted"
-	Bucket      string `json:"bucket"`
+	Action     string `json:"action"` // "move_files"
+	ImageGUID  string `json:"imageGUID"`
+	DestPrefix string `json:"destPrefix"`
+	NewStatus  string `json:"newStatus"` // "approved", "rejected", "deleted"
+	Bucket     string `json:"bucket"`
 }
 
 // OpenAI API types for GPT-4o vision analysis
@@ -278,19 +327,13 @@ func initializeAdminUser() {
 	fmt.Printf("Initializing admin user: %s\n", adminUsername)
 
 	// Check if admin user exists
-	result, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(usersTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"Username": {S: aws.String(adminUsername)},
-		},
-	})
-
+	existing, err := userStore.GetUser(adminUsername)
 	if err != nil {
 		fmt.Printf("Error checking for admin user: %v\n", err)
 		return
 	}
 
-	if result.Item == nil {
+	if existing == nil {
 		fmt.Println("Admin user doesn't exist, creating...")
 		// Create admin user
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(adminPassword), bcrypt.DefaultCost)
@@ -303,15 +346,10 @@ func initializeAdminUser() {
 			"Username":     {S: aws.String(adminUsername)},
 			"PasswordHash": {S: aws.String(string(hashedPassword))},
 			"CreatedAt":    {S: aws.String(time.Now().Format(time.RFC3339))},
-			"Role":         {S: aws.String("admin")},
+			"Role":         {S: aws.String(roleAdmin)},
 		}
 
-		_, err = ddbClient.PutItem(&dynamodb.PutItemInput{
-			TableName: aws.String(usersTable),
-			Item:      item,
-		})
-
-		if err != nil {
+		if err := userStore.PutUser(item); err != nil {
 			fmt.Printf("Error creating admin user: %v\n", err)
 		} else {
 			fmt.Println("Admin user created successfully!")
@@ -321,24 +359,13 @@ func initializeAdminUser() {
 	}
 }
 
-// getImageDate extracts date from EXIF or falls back to InsertedDateTime
+// getImageDate returns the image's CaptureDate, working it out from EXIF
+// or InsertedDateTime for images that don't have one yet
 func getImageDate(img ImageResponse) time.Time {
-	// Try EXIF DateTimeOriginal first
-	if dateStr, ok := img.EXIFData["DateTimeOriginal"]; ok {
-		cleaned := strings.Trim(dateStr, "\"")
-		if t, err := time.Parse("2006:01:02 15:04:05", cleaned); err == nil {
-			return t
-		}
-	}
-	// Try DateTime
-	if dateStr, ok := img.EXIFData["DateTime"]; ok {
-		cleaned := strings.Trim(dateStr, "\"")
-		if t, err := time.Parse("2006:01:02 15:04:05", cleaned); err == nil {
-			return t
-		}
+	if t, err := time.Parse(captureDateFormat, img.CaptureDate); err == nil {
+		return t
 	}
-	// Fall back to InsertedDateTime
-	if t, err := time.Parse(time.RFC3339, img.InsertedDateTime); err == nil {
+	if t, ok := captureTime(img.EXIFData, img.InsertedDateTime); ok {
 		return t
 	}
 	return time.Now()
@@ -400,7 +427,7 @@ var rawExtensions = []string{
 }
 
 // findRawFiles looks for RAW files with the same base name as the original file
-func findRawFiles(bucket string, originalFile string) []string {
+func findRawFiles(originalFile string) []string {
 	var rawFiles []string
 
 	// Get the directory and base name without extension
@@ -410,17 +437,14 @@ func findRawFiles(bucket string, originalFile string) []string {
 
 	// List objects in the same directory
 	prefix := dir + "/"
-	listResult, err := s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(bucket),
-		Prefix: aws.String(prefix),
-	})
+	objects, err := objectStore.List(prefix)
 	if err != nil {
 		fmt.Printf("Warning: failed to list S3 objects for raw file search: %v\n", err)
 		return rawFiles
 	}
 
-	for _, obj := range listResult.Contents {
-		key := *obj.Key
+	for _, obj := range objects {
+		key := obj.Key
 		fileName := filepath.Base(key)
 		fileNameLower := strings.ToLower(fileName)
 		fileExt := strings.ToLower(filepath.Ext(fileName))
@@ -447,96 +471,27 @@ func findRawFiles(bucket string, originalFile string) []string {
 }
 
 // moveImageFiles moves original, thumbnails, and related files to new location
-// Returns ErrSourceFileMissing if the original file doesn't exist in S3
-func moveImageFiles(bucket string, img ImageResponse, destPrefix string) (map[string]string, error) {
-	newPaths := make(map[string]string)
-
-	// Move original file
-	origFilename := filepath.Base(img.OriginalFile)
-	newOriginal := destPrefix + "/" + origFilename
-	// Skip if source and destination are the same (already in correct location)
-	if img.OriginalFile != newOriginal {
-		if err := copyS3Object(bucket, img.OriginalFile, newOriginal); err != nil {
-			// Check if this is a NoSuchKey error (file doesn't exist)
-			if isNoSuchKeyError(err) {
-				return nil, ErrSourceFileMissing
-			}
-			return nil, fmt.Errorf("failed to copy original: %v", err)
-		}
-		deleteS3Object(bucket, img.OriginalFile)
-	}
-	newPaths["original"] = newOriginal
-
-	// Move thumbnails
-	thumb50Name := filepath.Base(img.Thumbnail50)
-	newThumb50 := destPrefix + "/" + thumb50Name
-	if img.Thumbnail50 != newThumb50 {
-		copyS3Object(bucket, img.Thumbnail50, newThumb50)
-		deleteS3Object(bucket, img.Thumbnail50)
-	}
-	newPaths["thumbnail50"] = newThumb50
-
-	thumb400Name := filepath.Base(img.Thumbnail400)
-	newThumb400 := destPrefix + "/" + thumb400Name
-	if img.Thumbnail400 != newThumb400 {
-		copyS3Object(bucket, img.Thumbnail400, newThumb400)
-		deleteS3Object(bucket, img.Thumbnail400)
-	}
-	newPaths["thumbnail400"] = newThumb400
-
-	// Find and move RAW files (same base name, different extension)
-	rawFiles := findRawFiles(bucket, img.OriginalFile)
-	var movedRawFiles []string
-	for _, rawFile := range rawFiles {
-		rawFilename := filepath.Base(rawFile)
-		newRawPath := destPrefix + "/" + rawFilename
-		// Skip if source and destination are the same
-		if rawFile == newRawPath {
-			movedRawFiles = append(movedRawFiles, newRawPath)
-			continue
-		}
-		fmt.Printf("  Moving RAW file: %s -> %s\n", rawFile, newRawPath)
-		if err := copyS3Object(bucket, rawFile, newRawPath); err != nil {
-			fmt.Printf("  Warning: failed to copy RAW file %s: %v\n", rawFile, err)
-			continue
-		}
-		deleteS3Object(bucket, rawFile)
-		movedRawFiles = append(movedRawFiles, newRawPath)
-	}
-	newPaths["rawFiles"] = strings.Join(movedRawFiles, ",")
-
-	// Move any existing related files
-	for _, relFile := range img.RelatedFiles {
-		relName := filepath.Base(relFile)
-		newRelPath := destPrefix + "/" + relName
-		// Skip if source and destination are the same
-		if relFile != newRelPath {
-			copyS3Object(bucket, relFile, newRelPath)
-			deleteS3Object(bucket, relFile)
-		}
+// Returns ErrSourceFileMissing if the original file doesn't exist in S3, and
+// errMoveConflict if the image is being moved by someone else. The move is
+// journaled (see moves.go) and the caller closes it with closeMoveJournal in
+// the write of the new paths; a move that fails part way is rolled back.
+func moveImageFiles(img ImageResponse, destPrefix string) (map[string]string, error) {
+	newPaths, err := journaledMove(img, destPrefix, "")
+	if err != nil && !errors.Is(err, ErrSourceFileMissing) && !errors.Is(err, errMoveConflict) {
+		rollbackMoveOf(img.ImageGUID, destPrefix)
 	}
-
-	return newPaths, nil
+	return newPaths, err
 }
 
-func copyS3Object(bucket, srcKey, dstKey string) error {
+func copyS3Object(srcKey, dstKey string) error {
 	return s3OperationWithRetry(func() error {
-		_, err := s3Client.CopyObject(&s3.CopyObjectInput{
-			Bucket:     aws.String(bucket),
-			CopySource: aws.String(url.PathEscape(bucket + "/" + srcKey)),
-			Key:        aws.String(dstKey),
-		})
-		return err
+		return objectStore.Copy(srcKey, dstKey)
 	})
 }
 
-func deleteS3Object(bucket, key string) {
+func deleteS3Object(key string) {
 	s3OperationWithRetry(func() error {
-		_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(key),
-		})
-		return err
+		return objectStore.Delete(key)
 	})
 }
 
@@ -600,12 +555,8 @@ func isNoSuchKeyError(err error) bool {
 }
 
 // s3ObjectExists checks if an object exists in S3
-func s3ObjectExists(bucket, key string) bool {
-	_, err := s3Client.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
-	return err == nil
+func s3ObjectExists(key string) bool {
+	return objectStore.Exists(key)
 }
 
 // ErrSourceFileMissing indicates the source file doesn't exist in S3
@@ -614,45 +565,30 @@ var ErrSourceFileMissing = errors.New("source file missing from S3")
 // deleteImageFromDB removes an image record from DynamoDB and decrements project ImageCount if applicable
 func deleteImageFromDB(imageGUID string) error {
 	// First get the image to check if it belongs to a project
-	result, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(imageTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ImageGUID": {S: aws.String(imageGUID)},
-		},
-		ProjectionExpression: aws.String("ProjectID"),
-	})
+	item, err := imageStore.GetImage(imageGUID)
 	if err != nil {
 		return err
 	}
 
 	// Extract ProjectID if present
 	var projectID string
-	if result.Item != nil {
-		if pidAttr, ok := result.Item["ProjectID"]; ok && pidAttr.S != nil {
+	if item != nil {
+		if pidAttr, ok := item["ProjectID"]; ok && pidAttr.S != nil {
 			projectID = *pidAttr.S
 		}
 	}
 
 	// Delete the image record
-	_, err = ddbClient.DeleteItem(&dynamodb.DeleteItemInput{
-		TableName: aws.String(imageTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ImageGUID": {S: aws.String(imageGUID)},
-		},
-	})
-	if err != nil {
+	if err := imageStore.DeleteImage(imageGUID); err != nil {
 		return err
 	}
+	indexImageForSearch(imageGUID)
 
 	// Decrement project ImageCount if image belonged to a project
 	if projectID != "" {
-		_, err = ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-			TableName: aws.String(projectsTable),
-			Key: map[string]*dynamodb.AttributeValue{
-				"ProjectID": {S: aws.String(projectID)},
-			},
-			UpdateExpression: aws.String("ADD ImageCount :dec"),
-			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+		_, err = projectStore.UpdateProject(projectID, ItemUpdate{
+			Expression: "ADD ImageCount :dec",
+			Values: map[string]*dynamodb.AttributeValue{
 				":dec": {N: aws.String("-1")},
 			},
 		})
@@ -672,22 +608,19 @@ const (
 )
 
 // analyzeImageWithGPT4o sends the image to OpenAI GPT-4o for keyword and description generation
-func analyzeImageWithGPT4o(bucket, thumbnailKey string) (*AIAnalysisResult, error) {
+func analyzeImageWithGPT4o(thumbnailKey string) (*AIAnalysisResult, error) {
 	if openaiAPIKey == "" {
 		return nil, fmt.Errorf("OpenAI API key not configured")
 	}
 
 	// Download thumbnail from S3
-	getResult, err := s3Client.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(thumbnailKey),
-	})
+	body, err := objectStore.Get(thumbnailKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to download thumbnail: %v", err)
 	}
-	defer getResult.Body.Close()
+	defer body.Close()
 
-	imageData, err := io.ReadAll(getResult.Body)
+	imageData, err := io.ReadAll(body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read thumbnail data: %v", err)
 	}
@@ -832,186 +765,134 @@ Respond in JSON format exactly like this:
 	return &result, nil
 }
 
-// handleAsyncMoveFiles processes async file move requests
+// handleAsyncMoveFiles processes a move_files request, as invoked before
+// moves ran as jobs.
 func handleAsyncMoveFiles(req AsyncMoveRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	note, err := runAsyncMove(req)
+	body := map[string]interface{}{"success": err == nil}
+	if err != nil {
+		body["error"] = err.Error()
+	} else if note != "" {
+		body["skipped"], body["reason"] = true, note
+	}
+	data, _ := json.Marshal(body)
+	return events.APIGatewayProxyResponse{StatusCode: 200, Headers: headers, Body: string(data)}, nil
+}
+
+// runAsyncMove moves an image's files to req.DestPrefix and records its new
+// paths and status. When the move wasn't needed, because someone else moved
+// the image or its files are gone, it returns why.
+func runAsyncMove(req AsyncMoveRequest) (string, error) {
 	fmt.Printf("Async move started for image %s to %s\n", req.ImageGUID, req.DestPrefix)
 
 	// Update status to "moving"
 	err := withRetryNoResult(func() error {
-		_, updateErr := ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-			TableName: aws.String(imageTable),
-			Key: map[string]*dynamodb.AttributeValue{
-				"ImageGUID": {S: aws.String(req.ImageGUID)},
-			},
-			UpdateExpression: aws.String("SET MoveStatus = :status"),
-			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-				":status": {S: aws.String("moving")},
-			},
-		})
-		return updateErr
+		return setMoveStatus(req.ImageGUID, "moving")
 	})
 	if err != nil {
 		fmt.Printf("Error updating move status to moving: %v\n", err)
 	}
 
 	// Get current image metadata
-	getResult, err := withRetry(func() (*dynamodb.GetItemOutput, error) {
-		return ddbClient.GetItem(&dynamodb.GetItemInput{
-			TableName: aws.String(imageTable),
-			Key: map[string]*dynamodb.AttributeValue{
-				"ImageGUID": {S: aws.String(req.ImageGUID)},
-			},
-		})
+	imgItem, err := withRetry(func() (Item, error) {
+		return imageStore.GetImage(req.ImageGUID)
 	})
-	if err != nil || getResult.Item == nil {
+	if err != nil || imgItem == nil {
 		// Update status to failed
 		withRetryNoResult(func() error {
-			_, updateErr := ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-				TableName: aws.String(imageTable),
-				Key: map[string]*dynamodb.AttributeValue{
-					"ImageGUID": {S: aws.String(req.ImageGUID)},
-				},
-				UpdateExpression: aws.String("SET MoveStatus = :status"),
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":status": {S: aws.String("failed")},
-				},
-			})
-			return updateErr
+			return setMoveStatus(req.ImageGUID, "failed")
 		})
-		return events.APIGatewayProxyResponse{StatusCode: 200, Headers: headers, Body: `{"success": false, "error": "Image not found"}`}, nil
+		return "", fmt.Errorf("image not found")
 	}
 
 	var img ImageResponse
-	dynamodbattribute.UnmarshalMap(getResult.Item, &img)
+	dynamodbattribute.UnmarshalMap(imgItem, &img)
 
 	// Check if the image has already progressed to a project (add-to-project ran while this async move was pending).
 	// In that case, skip the move to avoid overwriting project data.
 	if img.Status == "project" {
 		fmt.Printf("Image %s is already in a project (Status=%s, ProjectID=%s), skipping async move to prevent overwriting\n", req.ImageGUID, img.Status, img.ProjectID)
 		withRetryNoResult(func() error {
-			_, updateErr := ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-				TableName: aws.String(imageTable),
-				Key: map[string]*dynamodb.AttributeValue{
-					"ImageGUID": {S: aws.String(req.ImageGUID)},
-				},
-				UpdateExpression: aws.String("SET MoveStatus = :status"),
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":status": {S: aws.String("complete")},
-				},
-			})
-			return updateErr
+			return setMoveStatus(req.ImageGUID, "complete")
 		})
-		return events.APIGatewayProxyResponse{StatusCode: 200, Headers: headers, Body: `{"success": true, "skipped": true, "reason": "already in project"}`}, nil
+		return "already in project", nil
 	}
 
-	// Move the files
-	newPaths, err := moveImageFiles(req.Bucket, img, req.DestPrefix)
+	// Move the files, resuming an earlier attempt's move
+	newPaths, err := journaledMove(img, req.DestPrefix, req.NewStatus)
 	if err != nil {
 		fmt.Printf("Error moving files: %v\n", err)
 		// If the source file is missing, another process (add-to-project) may have already moved it.
 		// Re-check the DB before taking destructive action.
-		if errors.Is(err, ErrSourceFileMissing) {
+		if errors.Is(err, ErrSourceFileMissing) || errors.Is(err, errMoveConflict) {
 			// Re-fetch to see if another process already moved the files
-			recheckResult, recheckErr := ddbClient.GetItem(&dynamodb.GetItemInput{
-				TableName: aws.String(imageTable),
-				Key: map[string]*dynamodb.AttributeValue{
-					"ImageGUID": {S: aws.String(req.ImageGUID)},
-				},
-			})
-			if recheckErr == nil && recheckResult.Item != nil {
+			recheckItem, recheckErr := imageStore.GetImage(req.ImageGUID)
+			if recheckErr == nil && recheckItem != nil {
 				var currentImg ImageResponse
-				dynamodbattribute.UnmarshalMap(recheckResult.Item, &currentImg)
+				dynamodbattribute.UnmarshalMap(recheckItem, &currentImg)
 				// If Status changed (e.g., to "project"), another process handled it
 				if currentImg.Status == "project" || currentImg.OriginalFile != img.OriginalFile {
 					fmt.Printf("Image %s was already moved by another process (Status=%s), skipping async move\n", req.ImageGUID, currentImg.Status)
 					withRetryNoResult(func() error {
-						_, updateErr := ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-							TableName: aws.String(imageTable),
-							Key: map[string]*dynamodb.AttributeValue{
-								"ImageGUID": {S: aws.String(req.ImageGUID)},
-							},
-							UpdateExpression: aws.String("SET MoveStatus = :status"),
-							ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-								":status": {S: aws.String("complete")},
-							},
-						})
-						return updateErr
+						return setMoveStatus(req.ImageGUID, "complete")
 					})
-					return events.APIGatewayProxyResponse{StatusCode: 200, Headers: headers, Body: `{"success": true, "skipped": true, "reason": "already moved by another process"}`}, nil
+					return "already moved by another process", nil
 				}
 			}
+		}
+		if errors.Is(err, ErrSourceFileMissing) {
 			// Image truly has missing source files and wasn't moved by another process
 			fmt.Printf("Source file truly missing for image %s, deleting from database\n", req.ImageGUID)
 			if delErr := deleteImageFromDB(req.ImageGUID); delErr != nil {
 				fmt.Printf("Error deleting image from DB: %v\n", delErr)
 			}
-			return events.APIGatewayProxyResponse{StatusCode: 200, Headers: headers, Body: `{"success": true, "deleted": true, "reason": "source file missing"}`}, nil
+			return "source file missing, image deleted", nil
 		}
 		// Update status to failed
 		withRetryNoResult(func() error {
-			_, updateErr := ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-				TableName: aws.String(imageTable),
-				Key: map[string]*dynamodb.AttributeValue{
-					"ImageGUID": {S: aws.String(req.ImageGUID)},
-				},
-				UpdateExpression: aws.String("SET MoveStatus = :status"),
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":status": {S: aws.String("failed")},
-				},
-			})
-			return updateErr
+			return setMoveStatus(req.ImageGUID, "failed")
 		})
-		return events.APIGatewayProxyResponse{StatusCode: 200, Headers: headers, Body: fmt.Sprintf(`{"success": false, "error": "%v"}`, err)}, nil
-	}
-
-	// Update DynamoDB with new paths and complete status.
-	// Use a condition expression to prevent overwriting if the image was concurrently added to a project.
-	err = withRetryNoResult(func() error {
-		_, updateErr := ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-			TableName: aws.String(imageTable),
-			Key: map[string]*dynamodb.AttributeValue{
-				"ImageGUID": {S: aws.String(req.ImageGUID)},
+		return "", err
+	}
+
+	// Update DynamoDB with new paths and complete status. The write is
+	// conditional on the version read above; if the image changed meanwhile
+	// it is re-read, and left alone if it was added to a project or its files
+	// were moved by someone else (the copies we made are then orphaned, but
+	// won't affect theirs).
+	updated, err := updateImageVersioned(img, func(cur ImageResponse) (ItemUpdate, bool) {
+		if cur.Status == "project" || cur.OriginalFile != img.OriginalFile {
+			return ItemUpdate{}, false
+		}
+		return closeMoveJournal(ItemUpdate{
+			Expression: "SET OriginalFile = :orig, Thumbnail50 = :t50, Thumbnail400 = :t400, #status = :newStatus, MoveStatus = :moveStatus, UpdatedDateTime = :updated",
+			Values: map[string]*dynamodb.AttributeValue{
+				":orig":       {S: aws.String(newPaths["original"])},
+				":t50":        {S: aws.String(newPaths["thumbnail50"])},
+				":t400":       {S: aws.String(newPaths["thumbnail400"])},
+				":newStatus":  {S: aws.String(req.NewStatus)},
+				":moveStatus": {S: aws.String("complete")},
+				":updated":    {S: aws.String(time.Now().Format(time.RFC3339))},
 			},
-			UpdateExpression:    aws.String("SET OriginalFile = :orig, Thumbnail50 = :t50, Thumbnail400 = :t400, #status = :newStatus, MoveStatus = :moveStatus, UpdatedDateTime = :updated"),
-			ConditionExpression: aws.String("#status <> :projectStatus"),
-			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-				":orig":          {S: aws.String(newPaths["original"])},
-				":t50":           {S: aws.String(newPaths["thumbnail50"])},
-				":t400":          {S: aws.String(newPaths["thumbnail400"])},
-				":newStatus":     {S: aws.String(req.NewStatus)},
-				":moveStatus":    {S: aws.String("complete")},
-				":updated":       {S: aws.String(time.Now().Format(time.RFC3339))},
-				":projectStatus": {S: aws.String("project")},
-			},
-			ExpressionAttributeNames: map[string]*string{
+			Names: map[string]*string{
 				"#status": aws.String("Status"),
 			},
-		})
-		return updateErr
+		}), true
 	})
 	if err != nil {
-		// Check if this was a condition check failure (image was added to project during our move)
-		if strings.Contains(err.Error(), "ConditionalCheckFailed") {
-			fmt.Printf("Image %s was added to project during async move, skipping DB update to preserve project data\n", req.ImageGUID)
-			// The S3 files were already copied to the approved/ path, but that's OK - they'll be
-			// orphaned but won't affect the project copy. Just update MoveStatus to complete.
-			withRetryNoResult(func() error {
-				_, updateErr := ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-					TableName: aws.String(imageTable),
-					Key: map[string]*dynamodb.AttributeValue{
-						"ImageGUID": {S: aws.String(req.ImageGUID)},
-					},
-					UpdateExpression: aws.String("SET MoveStatus = :status"),
-					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-						":status": {S: aws.String("complete")},
-					},
-				})
-				return updateErr
-			})
-			return events.APIGatewayProxyResponse{StatusCode: 200, Headers: headers, Body: `{"success": true, "skipped": true, "reason": "concurrently added to project"}`}, nil
-		}
 		fmt.Printf("Error updating image after move: %v\n", err)
-		return events.APIGatewayProxyResponse{StatusCode: 200, Headers: headers, Body: fmt.Sprintf(`{"success": false, "error": "%v"}`, err)}, nil
+		withRetryNoResult(func() error {
+			return setMoveStatus(req.ImageGUID, "failed")
+		})
+		return "", err
+	}
+	if updated == nil {
+		fmt.Printf("Image %s was added to a project or moved during async move, skipping DB update to preserve its data\n", req.ImageGUID)
+		rollbackMoveOf(req.ImageGUID, req.DestPrefix)
+		withRetryNoResult(func() error {
+			return setMoveStatus(req.ImageGUID, "complete")
+		})
+		return "concurrently added to project", nil
 	}
 
 	// For approved images, analyze with GPT-4o to generate keywords and description
@@ -1019,96 +900,121 @@ func handleAsyncMoveFiles(req AsyncMoveRequest, headers map[string]string) (even
 		fmt.Printf("Starting GPT-4o analysis for approved image %s\n", req.ImageGUID)
 
 		// Use the new thumbnail path after move
-		aiResult, err := analyzeImageWithGPT4o(req.Bucket, newPaths["thumbnail400"])
+		aiResult, err := analyzeImageWithGPT4o(newPaths["thumbnail400"])
 		if err != nil {
 			fmt.Printf("GPT-4o analysis failed for image %s: %v\n", req.ImageGUID, err)
 			// Don't fail the whole operation, just log the error
 		} else {
-			// Merge AI keywords with existing user keywords (case-insensitive deduplication)
-			existingKeywordsLower := make(map[string]bool)
-			for _, kw := range img.Keywords {
-				existingKeywordsLower[strings.ToLower(kw)] = true
-			}
-
-			mergedKeywords := append([]string{}, img.Keywords...) // Start with existing
-			for _, kw := range aiResult.Keywords {
-				if !existingKeywordsLower[strings.ToLower(kw)] {
-					mergedKeywords = append(mergedKeywords, kw)
-					existingKeywordsLower[strings.ToLower(kw)] = true
-				}
-			}
-
-			// Build update expression for keywords and description
-			updateExpr := "SET #desc = :desc, UpdatedDateTime = :updated"
-			exprAttrValues := map[string]*dynamodb.AttributeValue{
-				":desc":    {S: aws.String(aiResult.Description)},
-				":updated": {S: aws.String(time.Now().Format(time.RFC3339))},
-			}
-			exprAttrNames := map[string]*string{
-				"#desc": aws.String("Description"),
-			}
-
-			if len(mergedKeywords) > 0 {
-				keywordsList := make([]*dynamodb.AttributeValue, len(mergedKeywords))
-				for i, kw := range mergedKeywords {
-					keywordsList[i] = &dynamodb.AttributeValue{S: aws.String(kw)}
-				}
-				updateExpr += ", Keywords = :keywords"
-				exprAttrValues[":keywords"] = &dynamodb.AttributeValue{L: keywordsList}
-			}
-
-			updateErr := withRetryNoResult(func() error {
-				_, err := ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-					TableName: aws.String(imageTable),
-					Key: map[string]*dynamodb.AttributeValue{
-						"ImageGUID": {S: aws.String(req.ImageGUID)},
-					},
-					UpdateExpression:          aws.String(updateExpr),
-					ExpressionAttributeValues: exprAttrValues,
-					ExpressionAttributeNames:  exprAttrNames,
-				})
-				return err
+			var moved ImageResponse
+			dynamodbattribute.UnmarshalMap(updated, &moved)
+			saved, updateErr := updateImageVersioned(moved, func(cur ImageResponse) (ItemUpdate, bool) {
+				return aiAnalysisUpdate(cur.Keywords, aiResult), true
 			})
 			if updateErr != nil {
 				fmt.Printf("Error updating image with AI analysis: %v\n", updateErr)
-			} else {
-				fmt.Printf("GPT-4o analysis saved for image %s: %d keywords\n", req.ImageGUID, len(mergedKeywords))
+			} else if saved != nil {
+				fmt.Printf("GPT-4o analysis saved for image %s\n", req.ImageGUID)
+				indexImageItem(saved)
 			}
 		}
 	}
 
 	fmt.Printf("Async move completed for image %s\n", req.ImageGUID)
-	return events.APIGatewayProxyResponse{StatusCode: 200, Headers: headers, Body: `{"success": true}`}, nil
+	return "", nil
 }
 
-// triggerAsyncMove invokes Lambda asynchronously to move files
-func triggerAsyncMove(imageGUID, destPrefix, newStatus, bucket string) error {
-	payload, err := json.Marshal(AsyncMoveRequest{
-		Action:     "move_files",
-		ImageGUID:  imageGUID,
-		DestPrefix: destPrefix,
-		NewStatus:  newStatus,
-		Bucket:     bucket,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to marshal async request: %v", err)
+// aiAnalysisUpdate stores an AI description and merges the AI keywords into
+// the image's keywords (case-insensitive deduplication).
+func aiAnalysisUpdate(keywords []string, aiResult *AIAnalysisResult) ItemUpdate {
+	existingKeywordsLower := make(map[string]bool)
+	for _, kw := range keywords {
+		existingKeywordsLower[strings.ToLower(kw)] = true
 	}
 
-	// Wrap payload in API Gateway format for the handler
-	wrappedPayload, _ := json.Marshal(map[string]string{
-		"body": string(payload),
-	})
+	mergedKeywords := append([]string{}, keywords...) // Start with existing
+	for _, kw := range aiResult.Keywords {
+		if !existingKeywordsLower[strings.ToLower(kw)] {
+			mergedKeywords = append(mergedKeywords, kw)
+			existingKeywordsLower[strings.ToLower(kw)] = true
+		}
+	}
+
+	// Build update expression for keywords and description
+	updateExpr := "SET #desc = :desc, UpdatedDateTime = :updated"
+	exprAttrValues := map[string]*dynamodb.AttributeValue{
+		":desc":    {S: aws.String(aiResult.Description)},
+		":updated": {S: aws.String(time.Now().Format(time.RFC3339))},
+	}
+	if len(mergedKeywords) > 0 {
+		keywordsList := make([]*dynamodb.AttributeValue, len(mergedKeywords))
+		for i, kw := range mergedKeywords {
+			keywordsList[i] = &dynamodb.AttributeValue{S: aws.String(kw)}
+		}
+		updateExpr += ", Keywords = :keywords"
+		exprAttrValues[":keywords"] = &dynamodb.AttributeValue{L: keywordsList}
+	}
+	return ItemUpdate{
+		Expression: updateExpr,
+		Values:     exprAttrValues,
+		Names:      map[string]*string{"#desc": aws.String("Description")},
+	}
+}
+
+// setMoveStatus records the progress of an async file move on the image.
+// Unless the image has a journaled move open, which keeps it "moving" in
+// MoveStateIndex, a failure also puts it there as "failed" and any other
+// end takes it out.
+func setMoveStatus(imageGUID, status string) error {
+	update := ItemUpdate{
+		Expression: "SET MoveStatus = :status",
+		Values: map[string]*dynamodb.AttributeValue{
+			":status": {S: aws.String(status)},
+		},
+	}
+	withState := update
+	switch status {
+	case "failed":
+		withState.Expression += ", MoveState = :state"
+		withState.Values = withValues(update.Values, Item{":state": {S: aws.String(moveStateFailed)}})
+	case "pending", "complete":
+		withState.Expression += " REMOVE MoveState"
+	default:
+		_, err := imageStore.UpdateImage(imageGUID, update)
+		return err
+	}
+	withState.Condition = "attribute_not_exists(MoveJournal)"
+	_, err := imageStore.UpdateImage(imageGUID, withState)
+	if isConditionFailed(err) {
+		_, err = imageStore.UpdateImage(imageGUID, update)
+	}
+	return err
+}
 
-	_, err = lambdaClient.Invoke(&lambdasvc.InvokeInput{
-		FunctionName:   aws.String(functionName),
+// invokeAsync starts a function without waiting for its result. It is a
+// variable so self-hosted mode can run the work in-process instead.
+var invokeAsync = invokeLambdaAsync
+
+// invokeLambdaAsync invokes a Lambda function with the Event invocation type
+func invokeLambdaAsync(name string, payload []byte) error {
+	_, err := lambdaClient.Invoke(&lambdasvc.InvokeInput{
+		FunctionName:   aws.String(name),
 		InvocationType: aws.String("Event"), // Async invocation
-		Payload:        wrappedPayload,
+		Payload:        payload,
 	})
-	if err != nil {
-		return fmt.Errorf("failed to invoke lambda: %v", err)
-	}
+	return err
+}
 
-	return nil
+// triggerAsyncMove starts a job to move an image's files
+func triggerAsyncMove(imageGUID, destPrefix, newStatus, bucket, requestedBy string) (*Job, error) {
+	job := newJob(jobMove, requestedBy, AsyncMoveRequest{
+		Action:     "move_files",
+		ImageGUID:  imageGUID,
+		DestPrefix: destPrefix,
+		NewStatus:  newStatus,
+		Bucket:     bucket,
+	})
+	job.ImageGUID = imageGUID
+	return &job, startJob(job)
 }
 
 func getColorName(groupNumber int) string {
@@ -1133,14 +1039,16 @@ type ScheduledEvent struct {
 
 // BackfillConfig controls the nightly keyword backfill
 const (
-	backfillBatchSize    = 50 // Max images to process per run
+	backfillBatchSize    = 50              // Max images to process per run
 	backfillDelayBetween = 2 * time.Second // Delay between API calls
 )
 
-// handleBackfillKeywords processes images without keywords
-func handleBackfillKeywords() error {
+// runBackfillJob adds AI keywords to images that have none, up to
+// backfillBatchSize per run.
+func runBackfillJob(run *jobRun) error {
 	if openaiAPIKey == "" {
 		fmt.Println("Backfill: OpenAI API key not configured, skipping")
+		run.note("OpenAI API key not configured")
 		return nil
 	}
 
@@ -1148,29 +1056,35 @@ func handleBackfillKeywords() error {
 
 	// Scan for images without description (which means no AI analysis was done)
 	// We scan for Description being empty or not existing
-	scanInput := &dynamodb.ScanInput{
-		TableName: aws.String(imageTable),
-		FilterExpression: aws.String("attribute_not_exists(Description) OR Description = :empty"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+	result, err := imageStore.ScanImages(ItemScan{
+		Filter: "attribute_not_exists(Description) OR Description = :empty",
+		Values: map[string]*dynamodb.AttributeValue{
 			":empty": {S: aws.String("")},
 		},
-		Limit: aws.Int64(backfillBatchSize),
-	}
-
-	result, err := ddbClient.Scan(scanInput)
+		Limit: backfillBatchSize,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to scan for images without keywords: %v", err)
 	}
 
 	fmt.Printf("Backfill: Found %d images without keywords to process\n", len(result.Items))
+	run.setTotal(len(result.Items))
 
 	processedCount := 0
 	errorCount := 0
 
-	for _, item := range result.Items {
+	for i, item := range result.Items {
+		if run.canceled() {
+			return errJobCanceled
+		}
+		if i > 0 {
+			// Add delay between API calls to avoid rate limits
+			time.Sleep(backfillDelayBetween)
+		}
+
 		var img ImageResponse
 		if err := dynamodbattribute.UnmarshalMap(item, &img); err != nil {
-			fmt.Printf("Backfill: Failed to unmarshal image: %v\n", err)
+			run.itemFailed(attrString(item["ImageGUID"]), fmt.Errorf("failed to unmarshal image: %v", err))
 			errorCount++
 			continue
 		}
@@ -1178,12 +1092,11 @@ func handleBackfillKeywords() error {
 		fmt.Printf("Backfill: Processing image %s (%s)\n", img.ImageGUID, img.OriginalFile)
 
 		// Call GPT-4o to analyze the image
-		aiResult, err := analyzeImageWithGPT4o(img.Bucket, img.Thumbnail400)
+		aiResult, err := analyzeImageWithGPT4o(img.Thumbnail400)
 		if err != nil {
-			fmt.Printf("Backfill: AI analysis failed for %s: %v\n", img.ImageGUID, err)
-			errorCount++
 			// Continue to next image instead of stopping
-			time.Sleep(backfillDelayBetween)
+			run.itemFailed(img.ImageGUID, fmt.Errorf("AI analysis failed: %v", err))
+			errorCount++
 			continue
 		}
 
@@ -1204,25 +1117,20 @@ func handleBackfillKeywords() error {
 			exprAttrValues[":keywords"] = &dynamodb.AttributeValue{L: keywordsList}
 		}
 
-		_, err = ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-			TableName: aws.String(imageTable),
-			Key: map[string]*dynamodb.AttributeValue{
-				"ImageGUID": {S: aws.String(img.ImageGUID)},
-			},
-			UpdateExpression:          aws.String(updateExpr),
-			ExpressionAttributeValues: exprAttrValues,
-		})
+		_, err = imageStore.UpdateImage(img.ImageGUID, bumpVersion(ItemUpdate{
+			Expression: updateExpr,
+			Values:     exprAttrValues,
+		}))
 
 		if err != nil {
-			fmt.Printf("Backfill: Failed to update image %s: %v\n", img.ImageGUID, err)
+			run.itemFailed(img.ImageGUID, fmt.Errorf("failed to update image: %v", err))
 			errorCount++
 		} else {
 			fmt.Printf("Backfill: Successfully added keywords to %s\n", img.ImageGUID)
+			indexImageForSearch(img.ImageGUID)
+			run.progress(1, 0)
 			processedCount++
 		}
-
-		// Add delay between API calls to avoid rate limits
-		time.Sleep(backfillDelayBetween)
 	}
 
 	fmt.Printf("Backfill complete: %d processed, %d errors\n", processedCount, errorCount)
@@ -1231,10 +1139,11 @@ func handleBackfillKeywords() error {
 
 func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	headers := map[string]string{
-		"Content-Type":                "application/json",
-		"Access-Control-Allow-Origin": "*",
-		"Access-Control-Allow-Headers": "Content-Type,Authorization",
-		"Access-Control-Allow-Methods": "GET,POST,PUT,DELETE,OPTIONS",
+		"Content-Type":                  "application/json",
+		"Access-Control-Allow-Origin":   "*",
+		"Access-Control-Allow-Headers":  "Content-Type,Authorization,If-Match",
+		"Access-Control-Allow-Methods":  "GET,POST,PUT,DELETE,OPTIONS",
+		"Access-Control-Expose-Headers": "Retry-After,ETag",
 	}
 
 	// Check if this is a scheduled event (EventBridge)
@@ -1243,10 +1152,9 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 	if request.HTTPMethod == "" && request.Path == "" && request.Body != "" {
 		var scheduledEvent ScheduledEvent
 		if err := json.Unmarshal([]byte(request.Body), &scheduledEvent); err == nil {
-			if scheduledEvent.Source == "aws.events" || scheduledEvent.DetailType == "Scheduled Event" {
-				fmt.Println("Received scheduled event, running keyword backfill...")
-				if err := handleBackfillKeywords(); err != nil {
-					fmt.Printf("Backfill error: %v\n", err)
+			if (scheduledEvent.Source == "aws.events" || scheduledEvent.DetailType == "Scheduled Event") && scheduledEvent.Detail.Action == "reconcile-stats" {
+				if err := handleReconcileStats(); err != nil {
+					fmt.Printf("Stats reconcile error: %v\n", err)
 					return events.APIGatewayProxyResponse{
 						StatusCode: 500,
 						Body:       fmt.Sprintf(`{"error": "%s"}`, err.Error()),
@@ -1254,14 +1162,26 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 				}
 				return events.APIGatewayProxyResponse{
 					StatusCode: 200,
-					Body:       `{"message": "Backfill completed"}`,
+					Body:       `{"message": "Stats reconcile completed"}`,
 				}, nil
 			}
+			if (scheduledEvent.Source == "aws.events" || scheduledEvent.DetailType == "Scheduled Event") && scheduledEvent.Detail.Action == "reconcile-moves" {
+				return runScheduledJob(jobReconcileMoves, "Move reconcile")
+			}
+			if scheduledEvent.Source == "aws.events" || scheduledEvent.DetailType == "Scheduled Event" {
+				fmt.Println("Received scheduled event, running keyword backfill...")
+				return runScheduledJob(jobBackfillKeywords, "Backfill")
+			}
 		}
 	}
 
-	// Check if this is an async move request (direct Lambda invocation)
+	// Check if this is a job or async move request (direct Lambda invocation)
 	if request.Body != "" && request.HTTPMethod == "" && request.Path == "" {
+		var jobReq JobRequest
+		if err := json.Unmarshal([]byte(request.Body), &jobReq); err == nil && jobReq.Action == "run_job" {
+			job, err := runJob(jobReq.JobID)
+			return jobResponse(job, err, headers)
+		}
 		var asyncReq AsyncMoveRequest
 		if err := json.Unmarshal([]byte(request.Body), &asyncReq); err == nil && asyncReq.Action == "move_files" {
 			return handleAsyncMoveFiles(asyncReq, headers)
@@ -1279,10 +1199,25 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 	path := request.Path
 	method := request.HTTPMethod
 
-	// Login endpoint doesn't require authentication
+	// Login, refresh and single sign-on endpoints don't require authentication
 	if path == "/api/login" && method == "POST" {
 		return handleLogin(request, headers)
 	}
+	if path == "/api/refresh" && method == "POST" {
+		return handleRefresh(request, headers)
+	}
+	if path == "/api/login/mfa" && method == "POST" {
+		return handleLoginMFA(request, headers)
+	}
+	if path == "/api/auth/oidc/config" && method == "GET" {
+		return handleOIDCConfig(headers)
+	}
+	if path == "/api/auth/oidc/start" && method == "POST" {
+		return handleOIDCStart(request, headers)
+	}
+	if path == "/api/auth/oidc/callback" && method == "POST" {
+		return handleOIDCCallback(request, headers)
+	}
 
 	// All other endpoints require authentication
 	token := extractToken(request.Headers)
@@ -1290,52 +1225,147 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		return errorResponse(401, "Unauthorized", headers)
 	}
 
-	if !validateToken(token) {
+	caller, ok := authenticate(token)
+	if !ok {
 		return errorResponse(401, "Invalid token", headers)
 	}
+	caller.withRequest(request)
+
+	if !roleAllows(caller.Role, requiredRole(method, path)) {
+		return errorResponse(403, "Insufficient permissions", headers)
+	}
+	if caller.APIToken && !scopesAllow(caller.Scopes, method, path) {
+		return errorResponse(403, "Token scope does not allow this request", headers)
+	}
 
 	// Route requests
 	switch {
 	case path == "/api/stats" && method == "GET":
-		return handleGetStats(headers)
+		return handleGetStats(caller, request.QueryStringParameters, headers)
+	case path == "/api/changes" && method == "GET":
+		return handleGetChanges(caller, request, headers)
+	case path == "/api/jobs" && method == "GET":
+		return handleListJobs(caller, request.QueryStringParameters, headers)
+	case strings.HasPrefix(path, "/api/jobs/") && strings.HasSuffix(path, "/cancel") && method == "POST":
+		return handleCancelJob(caller, strings.TrimSuffix(strings.TrimPrefix(path, "/api/jobs/"), "/cancel"), headers)
+	case strings.HasPrefix(path, "/api/jobs/") && strings.HasSuffix(path, "/retry") && method == "POST":
+		return handleRetryJob(caller, strings.TrimSuffix(strings.TrimPrefix(path, "/api/jobs/"), "/retry"), headers)
+	case strings.HasPrefix(path, "/api/jobs/") && !strings.Contains(path[len("/api/jobs/"):], "/") && method == "GET":
+		return handleGetJob(caller, strings.TrimPrefix(path, "/api/jobs/"), headers)
 	case path == "/api/user/settings" && method == "GET":
 		return handleGetUserSettings(token, headers)
 	case path == "/api/user/settings" && method == "PUT":
 		return handlePutUserSettings(token, request, headers)
+	case path == "/api/user/password" && method == "PUT":
+		return handleChangePassword(token, request, headers)
+	case path == "/api/logout" && method == "POST":
+		return handleLogout(token, headers)
+	case path == "/api/user/tokens" && method == "GET":
+		return handleListAPITokens(token, headers)
+	case path == "/api/user/tokens" && method == "POST":
+		return handleCreateAPIToken(token, request, headers)
+	case strings.HasPrefix(path, "/api/user/tokens/") && method == "DELETE":
+		return handleRevokeAPIToken(token, strings.TrimPrefix(path, "/api/user/tokens/"), headers)
+	case path == "/api/user/undo" && method == "GET":
+		return handleGetUndoStack(caller, headers)
+	case path == "/api/user/totp" && method == "GET":
+		return handleGetTOTPStatus(token, headers)
+	case path == "/api/user/totp" && method == "POST":
+		return handleBeginTOTP(token, headers)
+	case path == "/api/user/totp" && method == "DELETE":
+		return handleDisableTOTP(token, request, headers)
+	case path == "/api/user/totp/confirm" && method == "POST":
+		return handleConfirmTOTP(token, request, headers)
+	case path == "/api/user/totp/recovery-codes" && method == "POST":
+		return handleRegenerateRecoveryCodes(token, request, headers)
+	// Smart collections, each user's own
+	case path == "/api/collections" && method == "GET":
+		return handleListCollections(caller, headers)
+	case path == "/api/collections" && method == "POST":
+		return handleCreateCollection(caller, request, headers)
+	case strings.HasPrefix(path, "/api/collections/") && strings.HasSuffix(path, "/images") && method == "GET":
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/api/collections/"), "/images")
+		return handleListCollectionImages(caller, id, request, headers)
+	case strings.HasPrefix(path, "/api/collections/") && !strings.Contains(path[len("/api/collections/"):], "/") && method == "GET":
+		return handleGetCollection(caller, strings.TrimPrefix(path, "/api/collections/"), headers)
+	case strings.HasPrefix(path, "/api/collections/") && !strings.Contains(path[len("/api/collections/"):], "/") && method == "PUT":
+		return handleUpdateCollection(caller, strings.TrimPrefix(path, "/api/collections/"), request, headers)
+	case strings.HasPrefix(path, "/api/collections/") && !strings.Contains(path[len("/api/collections/"):], "/") && method == "DELETE":
+		return handleDeleteCollection(caller, strings.TrimPrefix(path, "/api/collections/"), headers)
+	// User management routes (admin only)
+	case path == "/api/users" && method == "GET":
+		return handleListUsers(headers)
+	case path == "/api/users" && method == "POST":
+		return handleCreateUser(request, headers)
+	case strings.HasPrefix(path, "/api/users/") && strings.HasSuffix(path, "/totp") && method == "DELETE":
+		username := strings.TrimSuffix(strings.TrimPrefix(path, "/api/users/"), "/totp")
+		return handleResetUserTOTP(username, headers)
+	case strings.HasPrefix(path, "/api/users/") && strings.HasSuffix(path, "/sessions") && method == "DELETE":
+		username := strings.TrimSuffix(strings.TrimPrefix(path, "/api/users/"), "/sessions")
+		return handleRevokeUserSessions(username, headers)
+	case strings.HasPrefix(path, "/api/users/") && strings.HasSuffix(path, "/password") && method == "PUT":
+		username := strings.TrimSuffix(strings.TrimPrefix(path, "/api/users/"), "/password")
+		return handleResetPassword(username, request, headers)
+	case strings.HasPrefix(path, "/api/users/") && !strings.Contains(path[len("/api/users/"):], "/") && method == "PUT":
+		username := strings.TrimPrefix(path, "/api/users/")
+		return handleUpdateUser(token, username, request, headers)
 	case path == "/api/images" && method == "GET":
-		return handleListImages(request, headers)
+		return handleListImages(caller, request, headers)
+	case path == "/api/images/batch" && method == "POST":
+		return handleBatchUpdateImages(caller, request, headers)
+	case path == "/api/images/failed-moves" && method == "GET":
+		return handleListFailedMoves(caller, headers)
+	case strings.HasPrefix(path, "/api/images/") && !strings.Contains(path[len("/api/images/"):], "/") && method == "GET":
+		imageID := strings.TrimPrefix(path, "/api/images/")
+		return handleGetImage(caller, imageID, request.QueryStringParameters, headers)
 	case strings.HasPrefix(path, "/api/images/") && method == "PUT":
 		imageID := strings.TrimPrefix(path, "/api/images/")
-		return handleUpdateImage(imageID, request, headers)
+		return handleUpdateImage(caller, imageID, request, headers)
 	case strings.HasPrefix(path, "/api/images/") && strings.HasSuffix(path, "/download") && method == "GET":
 		imageID := strings.TrimSuffix(strings.TrimPrefix(path, "/api/images/"), "/download")
-		return handleDownload(imageID, headers)
+		return handleDownload(caller, imageID, headers)
 	case strings.HasPrefix(path, "/api/images/") && strings.HasSuffix(path, "/regenerate-ai") && method == "POST":
 		imageID := strings.TrimSuffix(strings.TrimPrefix(path, "/api/images/"), "/regenerate-ai")
-		return handleRegenerateAI(imageID, headers)
+		return handleRegenerateAI(caller, imageID, headers)
 	case strings.HasPrefix(path, "/api/images/") && strings.HasSuffix(path, "/undelete") && method == "POST":
 		imageID := strings.TrimSuffix(strings.TrimPrefix(path, "/api/images/"), "/undelete")
-		return handleUndeleteImage(imageID, headers)
+		return handleUndeleteImage(caller, imageID, headers)
+	case strings.HasPrefix(path, "/api/images/") && strings.HasSuffix(path, "/undo") && method == "POST":
+		imageID := strings.TrimSuffix(strings.TrimPrefix(path, "/api/images/"), "/undo")
+		return handleUndoImage(caller, imageID, headers)
+	case strings.HasPrefix(path, "/api/images/") && strings.HasSuffix(path, "/retry-move") && method == "POST":
+		imageID := strings.TrimSuffix(strings.TrimPrefix(path, "/api/images/"), "/retry-move")
+		return handleRetryMove(caller, imageID, headers)
 	case strings.HasPrefix(path, "/api/images/") && method == "DELETE":
 		imageID := strings.TrimPrefix(path, "/api/images/")
-		return handleDeleteImage(imageID, headers)
+		return handleDeleteImage(caller, imageID, headers)
 	// Project routes
 	case path == "/api/projects" && method == "GET":
-		return handleListProjects(request, headers)
+		return handleListProjects(caller, request, headers)
 	case path == "/api/projects" && method == "POST":
-		return handleCreateProject(request, headers)
+		return handleCreateProject(caller, request, headers)
 	case strings.HasPrefix(path, "/api/projects/") && !strings.Contains(path[len("/api/projects/"):], "/") && method == "PUT":
 		projectID := strings.TrimPrefix(path, "/api/projects/")
-		return handleUpdateProject(projectID, request, headers)
+		return handleUpdateProject(caller, projectID, request, headers)
 	case strings.HasPrefix(path, "/api/projects/") && strings.HasSuffix(path, "/images") && method == "POST":
 		projectID := strings.TrimSuffix(strings.TrimPrefix(path, "/api/projects/"), "/images")
-		return handleAddToProject(projectID, request, headers)
+		return handleAddToProject(caller, projectID, request, headers)
 	case strings.HasPrefix(path, "/api/projects/") && strings.HasSuffix(path, "/images") && method == "GET":
 		projectID := strings.TrimSuffix(strings.TrimPrefix(path, "/api/projects/"), "/images")
-		return handleGetProjectImages(projectID, headers)
+		return handleGetProjectImages(caller, projectID, request, headers)
+	case strings.HasPrefix(path, "/api/projects/") && strings.HasSuffix(path, "/members") && method == "GET":
+		projectID := strings.TrimSuffix(strings.TrimPrefix(path, "/api/projects/"), "/members")
+		return handleListProjectMembers(caller, projectID, headers)
+	case strings.HasPrefix(path, "/api/projects/") && strings.Contains(path, "/members/") && (method == "PUT" || method == "DELETE"):
+		// /api/projects/{projectId}/members/{username}
+		projectID, username, _ := strings.Cut(strings.TrimPrefix(path, "/api/projects/"), "/members/")
+		if method == "PUT" {
+			return handleSetProjectMember(caller, projectID, username, request, headers)
+		}
+		return handleRemoveProjectMember(caller, projectID, username, headers)
 	case strings.HasPrefix(path, "/api/projects/") && strings.HasSuffix(path, "/generate-zip") && method == "POST":
 		projectID := strings.TrimSuffix(strings.TrimPrefix(path, "/api/projects/"), "/generate-zip")
-		return handleGenerateZip(projectID, headers)
+		return handleGenerateZip(caller, projectID, headers)
 	case strings.HasPrefix(path, "/api/projects/") && strings.Contains(path, "/zips/") && strings.HasSuffix(path, "/download") && method == "GET":
 		// Extract projectID and zipKey from path: /api/projects/{projectId}/zips/{zipKey}/download
 		parts := strings.Split(path, "/")
@@ -1347,16 +1377,16 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 			if err != nil {
 				zipKey = zipKeyEncoded // Fall back to encoded version if decode fails
 			}
-			return handleGetZipDownload(projectID, zipKey, headers)
+			return handleGetZipDownload(caller, projectID, zipKey, headers)
 		}
 		return errorResponse(400, "Invalid zip download path", headers)
 	case strings.HasPrefix(path, "/api/projects/") && strings.HasSuffix(path, "/zip-logs") && method == "GET":
 		projectID := strings.TrimSuffix(strings.TrimPrefix(path, "/api/projects/"), "/zip-logs")
-		return handleGetZipLogs(projectID, headers)
+		return handleGetZipLogs(caller, projectID, headers)
 	case strings.HasPrefix(path, "/api/projects/") && strings.HasSuffix(path, "/zips") && method == "DELETE":
 		// Delete all zips: /api/projects/{projectId}/zips
 		projectID := strings.TrimSuffix(strings.TrimPrefix(path, "/api/projects/"), "/zips")
-		return handleDeleteAllZips(projectID, headers)
+		return handleDeleteAllZips(caller, projectID, headers)
 	case strings.HasPrefix(path, "/api/projects/") && strings.Contains(path, "/zips/") && method == "DELETE":
 		// Extract projectID and zipKey from path: /api/projects/{projectId}/zips/{zipKey}
 		parts := strings.Split(path, "/")
@@ -1367,13 +1397,21 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 			if err != nil {
 				zipKey = zipKeyEncoded
 			}
-			return handleDeleteZip(projectID, zipKey, headers)
+			return handleDeleteZip(caller, projectID, zipKey, headers)
 		}
 		return errorResponse(400, "Invalid zip delete path", headers)
 	case strings.HasPrefix(path, "/api/projects/") && !strings.Contains(path[len("/api/projects/"):], "/") && method == "DELETE":
 		// Delete project: /api/projects/{projectId}
 		projectID := strings.TrimPrefix(path, "/api/projects/")
-		return handleDeleteProject(projectID, headers)
+		return handleDeleteProject(caller, projectID, headers)
+	case path == "/api/timeline" && method == "GET":
+		return handleGetTimeline(caller, request.QueryStringParameters, headers)
+	case path == "/api/search" && method == "GET":
+		return handleSearch(caller, request.QueryStringParameters, headers)
+	case path == "/api/search/reindex" && method == "POST":
+		return handleReindexSearch(caller, headers)
+	case path == "/api/audit" && method == "GET":
+		return handleQueryAudit(request.QueryStringParameters, headers)
 	// Logs route
 	case path == "/api/logs" && method == "GET":
 		return handleGetLogs(request.QueryStringParameters, headers)
@@ -1388,40 +1426,56 @@ func handleLogin(request events.APIGatewayProxyRequest, headers map[string]strin
 		return errorResponse(400, "Invalid request body", headers)
 	}
 
-	// Get user from DynamoDB
-	result, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(usersTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"Username": {S: aws.String(loginReq.Username)},
-		},
-	})
+	// Locked accounts are refused before the password is checked
+	if wait := loginLockout(loginReq.Username); wait > 0 {
+		recordLogin(request, loginReq.Username, auditLoginFailed, map[string]interface{}{"reason": "locked out"})
+		return rateLimitedResponse(wait, "Too many failed login attempts, try again later", headers)
+	}
 
-	if err != nil || result.Item == nil {
+	// Get user from DynamoDB
+	user, err := userStore.GetUser(loginReq.Username)
+	if err != nil {
+		return errorResponse(401, "Invalid credentials", headers)
+	}
+	if user == nil {
+		// Unknown names are counted too, so lockouts don't reveal which accounts exist
+		recordLoginFailure(loginReq.Username)
+		recordLogin(request, loginReq.Username, auditLoginFailed, map[string]interface{}{"reason": "unknown user"})
 		return errorResponse(401, "Invalid credentials", headers)
 	}
 
 	var passwordHash string
-	if result.Item["PasswordHash"] != nil {
-		passwordHash = *result.Item["PasswordHash"].S
+	if user["PasswordHash"] != nil {
+		passwordHash = *user["PasswordHash"].S
 	}
 
 	// Verify password
 	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(loginReq.Password)); err != nil {
+		recordLoginFailure(loginReq.Username)
+		recordLogin(request, loginReq.Username, auditLoginFailed, map[string]interface{}{"reason": "wrong password"})
 		return errorResponse(401, "Invalid credentials", headers)
 	}
 
-	// Generate JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": loginReq.Username,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(),
-	})
+	account := userFromItem(user)
+	if account.Disabled {
+		recordLogin(request, loginReq.Username, auditLoginFailed, map[string]interface{}{"reason": "account disabled"})
+		return errorResponse(403, "Account disabled", headers)
+	}
 
-	tokenString, err := token.SignedString(jwtSecret)
+	// With two-factor authentication the session starts after the code step
+	if account.TOTPEnabled || require2FA {
+		return startMFAChallenge(account, headers)
+	}
+	clearLoginFailures(loginReq.Username)
+
+	// Start a session and issue tokens carrying the role the router enforces
+	response, err := startSession(account, user)
 	if err != nil {
+		fmt.Printf("Failed to start session for %s: %v\n", loginReq.Username, err)
 		return errorResponse(500, "Failed to generate token", headers)
 	}
+	recordLogin(request, loginReq.Username, auditLogin, map[string]interface{}{"method": "password", "role": account.Role})
 
-	response := LoginResponse{Token: tokenString}
 	body, _ := json.Marshal(response)
 
 	return events.APIGatewayProxyResponse{
@@ -1432,80 +1486,40 @@ func handleLogin(request events.APIGatewayProxyRequest, headers map[string]strin
 }
 
 // queryAllPages executes a DynamoDB query and handles pagination to return all results
-func queryAllPages(input *dynamodb.QueryInput) ([]map[string]*dynamodb.AttributeValue, error) {
+func queryAllPages(query ItemQuery) ([]map[string]*dynamodb.AttributeValue, error) {
 	var allItems []map[string]*dynamodb.AttributeValue
 
 	for {
-		result, err := ddbClient.Query(input)
+		result, err := imageStore.QueryImages(query)
 		if err != nil {
 			return nil, err
 		}
 		allItems = append(allItems, result.Items...)
 
 		// Check if there are more pages
-		if result.LastEvaluatedKey == nil {
+		if result.LastKey == nil {
 			break
 		}
 		// Set the start key for the next page
-		input.ExclusiveStartKey = result.LastEvaluatedKey
+		query.StartKey = result.LastKey
 	}
 
 	return allItems, nil
 }
 
-// queryWithLimit executes a DynamoDB query with a limit and returns items plus the last evaluated key
-func queryWithLimit(input *dynamodb.QueryInput, limit int, startKey map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, map[string]*dynamodb.AttributeValue, error) {
-	var allItems []map[string]*dynamodb.AttributeValue
-
-	if startKey != nil {
-		input.ExclusiveStartKey = startKey
-	}
-
-	// Query until we have enough items or no more pages
-	for len(allItems) < limit {
-		result, err := ddbClient.Query(input)
+// scanAllImages scans the image table page by page, passing each page to fn
+func scanAllImages(scan ItemScan, fn func(items []map[string]*dynamodb.AttributeValue)) error {
+	for {
+		result, err := imageStore.ScanImages(scan)
 		if err != nil {
-			return nil, nil, err
+			return err
 		}
-		allItems = append(allItems, result.Items...)
-
-		if result.LastEvaluatedKey == nil {
-			// No more pages
-			return allItems, nil, nil
+		fn(result.Items)
+		if result.LastKey == nil {
+			return nil
 		}
-		input.ExclusiveStartKey = result.LastEvaluatedKey
-	}
-
-	// We have enough items, return with the last key for next page
-	return allItems[:limit], input.ExclusiveStartKey, nil
-}
-
-// encodeCursor encodes a DynamoDB key as a base64 cursor
-func encodeCursor(key map[string]*dynamodb.AttributeValue) string {
-	if key == nil {
-		return ""
-	}
-	data, err := json.Marshal(key)
-	if err != nil {
-		return ""
+		scan.StartKey = result.LastKey
 	}
-	return base64.StdEncoding.EncodeToString(data)
-}
-
-// decodeCursor decodes a base64 cursor back to a DynamoDB key
-func decodeCursor(cursor string) map[string]*dynamodb.AttributeValue {
-	if cursor == "" {
-		return nil
-	}
-	data, err := base64.StdEncoding.DecodeString(cursor)
-	if err != nil {
-		return nil
-	}
-	var key map[string]*dynamodb.AttributeValue
-	if err := json.Unmarshal(data, &key); err != nil {
-		return nil
-	}
-	return key
 }
 
 // PaginatedImageResponse wraps images with pagination metadata
@@ -1516,349 +1530,219 @@ type PaginatedImageResponse struct {
 	Total      int             `json:"total,omitempty"` // Only set on first page
 }
 
-func handleListImages(request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+// stateQueries returns the StatusIndex queries that list a state= filter,
+// narrowed to a group when groupNum is set. ok is false for an unknown
+// state.
+func stateQueries(state string, groupNum int) ([]ItemQuery, bool) {
+	statusQuery := func(status, filter string, values map[string]*dynamodb.AttributeValue) ItemQuery {
+		q := ItemQuery{
+			Index:        "StatusIndex",
+			KeyCondition: "#key = :key",
+			Filter:       filter,
+			Names:        map[string]*string{"#key": aws.String("Status")},
+			Values:       map[string]*dynamodb.AttributeValue{":key": {S: aws.String(status)}},
+		}
+		for k, v := range values {
+			q.Values[k] = v
+		}
+		if groupNum > 0 {
+			if q.Filter != "" {
+				q.Filter += " AND "
+			}
+			q.Filter += "GroupNumber = :group"
+			q.Values[":group"] = &dynamodb.AttributeValue{N: aws.String(fmt.Sprintf("%d", groupNum))}
+		}
+		return q
+	}
+
+	switch state {
+	case "unreviewed":
+		return []ItemQuery{statusQuery("inbox", "", nil)}, true
+	case "approved":
+		// Also inbox images that have been reviewed with a group (async move not yet complete)
+		pending := "Reviewed = :reviewed"
+		values := map[string]*dynamodb.AttributeValue{":reviewed": {S: aws.String("true")}}
+		if groupNum == 0 {
+			pending += " AND GroupNumber > :zero"
+			values[":zero"] = &dynamodb.AttributeValue{N: aws.String("0")}
+		}
+		return []ItemQuery{statusQuery("approved", "", nil), statusQuery("inbox", pending, values)}, true
+	case "rejected", "deleted":
+		return []ItemQuery{statusQuery(state, "", nil)}, true
+	case "all":
+		// Every status but deleted
+		var queries []ItemQuery
+		for _, status := range []string{"inbox", "approved", "rejected", "project"} {
+			queries = append(queries, statusQuery(status, "", nil))
+		}
+		return queries, true
+	}
+	return nil, false
+}
+
+func handleListImages(caller *Caller, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
 	// Get filter parameters from query string
 	stateFilter := request.QueryStringParameters["state"]
 	groupFilter := request.QueryStringParameters["group"]
-	cursor := request.QueryStringParameters["cursor"]
-	limitStr := request.QueryStringParameters["limit"]
 
-	// Default to unreviewed if no state specified
+	// Default to unreviewed if no state specified; a q filter replaces both
+	// state and group, and a from/to capture date range is listed as one
 	if stateFilter == "" {
 		stateFilter = "unreviewed"
 	}
+	q := request.QueryStringParameters["q"]
+	if from, to := request.QueryStringParameters["from"], request.QueryStringParameters["to"]; from != "" || to != "" {
+		var err error
+		if q, err = takenRangeQuery(q, stateFilter, groupFilter, from, to); err != nil {
+			return errorResponse(400, err.Error(), headers)
+		}
+	}
+	order, err := parseImageOrder(request.QueryStringParameters)
+	if err != nil {
+		return errorResponse(400, err.Error(), headers)
+	}
+	fields, err := parseImageFields(request.QueryStringParameters, "review")
+	if err != nil {
+		return errorResponse(400, err.Error(), headers)
+	}
 
-	// Parse limit (default 500, max 1000)
-	limit := 500
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
-			if limit > 1000 {
-				limit = 1000
-			}
+	var queries []ItemQuery
+	if q != "" {
+		plan, err := planImageQuery(q)
+		if err != nil {
+			return errorResponse(400, err.Error(), headers)
+		}
+		queries, stateFilter = plan.queries, "query"
+	} else {
+		groupNum := 0
+		if groupFilter != "" && groupFilter != "all" {
+			fmt.Sscanf(groupFilter, "%d", &groupNum)
+		}
+		var ok bool
+		if queries, ok = stateQueries(stateFilter, groupNum); !ok {
+			return errorResponse(400, "Invalid state filter", headers)
 		}
 	}
 
-	var allItems []map[string]*dynamodb.AttributeValue
-	var lastKey map[string]*dynamodb.AttributeValue
-	var err error
+	page := listPage{items: listLimit(request.QueryStringParameters), bytes: listMaxBytes}
+	items, nextCursor, err := listImages(fields.project(queries, order), order, page, request.QueryStringParameters["cursor"])
+	if err == errInvalidCursor {
+		return errorResponse(400, "Invalid cursor", headers)
+	}
+	if err != nil {
+		fmt.Printf("Error querying images: %v\n", err)
+		return errorResponse(500, "Failed to list images", headers)
+	}
 
-	// Decode cursor if provided
-	startKey := decodeCursor(cursor)
+	// Deduplicate by OriginalFile, keeping the most recent entry where the
+	// first one was listed
+	images := make([]ImageResponse, 0, len(items))
+	seenFiles := make(map[string]int)
+	canSeeProject := projectFilter(caller)
+	for _, item := range items {
+		var img ImageResponse
+		dynamodbattribute.UnmarshalMap(item, &img)
 
-	// Parse group filter once for all cases
-	groupNum := 0
-	if groupFilter != "" && groupFilter != "all" {
-		fmt.Sscanf(groupFilter, "%d", &groupNum)
-	}
+		// Skip images that are already in a project (unless querying specifically for projects)
+		if img.ProjectID != "" && stateFilter != "all" && stateFilter != "query" {
+			continue
+		}
+		// and project images the caller can't see
+		if !canSeeProject(img.ProjectID) {
+			continue
+		}
 
-	// Determine query based on state filter using StatusIndex
-	switch stateFilter {
-	case "unreviewed":
-		var input *dynamodb.QueryInput
-		if groupNum > 0 {
-			// Query GroupStatusIndex (smaller partition) and filter by Status
-			input = &dynamodb.QueryInput{
-				TableName:              aws.String(imageTable),
-				IndexName:              aws.String("GroupStatusIndex"),
-				KeyConditionExpression: aws.String("GroupNumber = :group"),
-				FilterExpression:       aws.String("#status = :status"),
-				ExpressionAttributeNames: map[string]*string{
-					"#status": aws.String("Status"),
-				},
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":group":  {N: aws.String(fmt.Sprintf("%d", groupNum))},
-					":status": {S: aws.String("inbox")},
-				},
-			}
-		} else {
-			// No group filter — query StatusIndex as before
-			input = &dynamodb.QueryInput{
-				TableName:              aws.String(imageTable),
-				IndexName:              aws.String("StatusIndex"),
-				KeyConditionExpression: aws.String("#status = :status"),
-				ExpressionAttributeNames: map[string]*string{
-					"#status": aws.String("Status"),
-				},
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":status": {S: aws.String("inbox")},
-				},
+		if i, found := seenFiles[img.OriginalFile]; found {
+			// Compare timestamps - keep the newer one
+			if imageChangedAt(img).After(imageChangedAt(images[i])) {
+				images[i] = img
 			}
+			continue
 		}
-		allItems, lastKey, err = queryWithLimit(input, limit, startKey)
-	case "approved":
-		// Query for approved images, also include inbox images that have been reviewed with a group (async move pending)
-		var approvedInput *dynamodb.QueryInput
-		if groupNum > 0 {
-			// Query GroupStatusIndex (smaller partition) and filter by Status
-			approvedInput = &dynamodb.QueryInput{
-				TableName:              aws.String(imageTable),
-				IndexName:              aws.String("GroupStatusIndex"),
-				KeyConditionExpression: aws.String("GroupNumber = :group"),
-				FilterExpression:       aws.String("#status = :status"),
-				ExpressionAttributeNames: map[string]*string{
-					"#status": aws.String("Status"),
-				},
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":group":  {N: aws.String(fmt.Sprintf("%d", groupNum))},
-					":status": {S: aws.String("approved")},
-				},
-			}
-		} else {
-			approvedInput = &dynamodb.QueryInput{
-				TableName:              aws.String(imageTable),
-				IndexName:              aws.String("StatusIndex"),
-				KeyConditionExpression: aws.String("#status = :status"),
-				ExpressionAttributeNames: map[string]*string{
-					"#status": aws.String("Status"),
-				},
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":status": {S: aws.String("approved")},
-				},
-			}
-		}
-		allItems, lastKey, err = queryWithLimit(approvedInput, limit, startKey)
-
-		// Also query inbox images that have been reviewed and grouped (async move not yet complete)
-		if err == nil {
-			var inboxInput *dynamodb.QueryInput
-			if groupNum > 0 {
-				// Query GroupStatusIndex and filter by Status + Reviewed
-				inboxInput = &dynamodb.QueryInput{
-					TableName:              aws.String(imageTable),
-					IndexName:              aws.String("GroupStatusIndex"),
-					KeyConditionExpression: aws.String("GroupNumber = :group"),
-					FilterExpression:       aws.String("#status = :status AND Reviewed = :reviewed"),
-					ExpressionAttributeNames: map[string]*string{
-						"#status": aws.String("Status"),
-					},
-					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-						":group":    {N: aws.String(fmt.Sprintf("%d", groupNum))},
-						":status":   {S: aws.String("inbox")},
-						":reviewed": {S: aws.String("true")},
-					},
-				}
-			} else {
-				inboxInput = &dynamodb.QueryInput{
-					TableName:              aws.String(imageTable),
-					IndexName:              aws.String("StatusIndex"),
-					KeyConditionExpression: aws.String("#status = :status"),
-					ExpressionAttributeNames: map[string]*string{
-						"#status": aws.String("Status"),
-					},
-					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-						":status":   {S: aws.String("inbox")},
-						":reviewed": {S: aws.String("true")},
-					},
-					FilterExpression: aws.String("Reviewed = :reviewed AND GroupNumber > :zero"),
-				}
-				inboxInput.ExpressionAttributeValues[":zero"] = &dynamodb.AttributeValue{N: aws.String("0")}
-			}
-			inboxItems, _, inboxErr := queryWithLimit(inboxInput, limit, nil)
-			if inboxErr != nil {
-				err = inboxErr
-			} else {
-				allItems = append(allItems, inboxItems...)
-			}
-		}
-	case "rejected":
-		var input *dynamodb.QueryInput
-		if groupNum > 0 {
-			input = &dynamodb.QueryInput{
-				TableName:              aws.String(imageTable),
-				IndexName:              aws.String("GroupStatusIndex"),
-				KeyConditionExpression: aws.String("GroupNumber = :group"),
-				FilterExpression:       aws.String("#status = :status"),
-				ExpressionAttributeNames: map[string]*string{
-					"#status": aws.String("Status"),
-				},
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":group":  {N: aws.String(fmt.Sprintf("%d", groupNum))},
-					":status": {S: aws.String("rejected")},
-				},
-			}
-		} else {
-			input = &dynamodb.QueryInput{
-				TableName:              aws.String(imageTable),
-				IndexName:              aws.String("StatusIndex"),
-				KeyConditionExpression: aws.String("#status = :status"),
-				ExpressionAttributeNames: map[string]*string{
-					"#status": aws.String("Status"),
-				},
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":status": {S: aws.String("rejected")},
-				},
-			}
-		}
-		allItems, lastKey, err = queryWithLimit(input, limit, startKey)
-	case "deleted":
-		var input *dynamodb.QueryInput
-		if groupNum > 0 {
-			input = &dynamodb.QueryInput{
-				TableName:              aws.String(imageTable),
-				IndexName:              aws.String("GroupStatusIndex"),
-				KeyConditionExpression: aws.String("GroupNumber = :group"),
-				FilterExpression:       aws.String("#status = :status"),
-				ExpressionAttributeNames: map[string]*string{
-					"#status": aws.String("Status"),
-				},
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":group":  {N: aws.String(fmt.Sprintf("%d", groupNum))},
-					":status": {S: aws.String("deleted")},
-				},
-			}
-		} else {
-			input = &dynamodb.QueryInput{
-				TableName:              aws.String(imageTable),
-				IndexName:              aws.String("StatusIndex"),
-				KeyConditionExpression: aws.String("#status = :status"),
-				ExpressionAttributeNames: map[string]*string{
-					"#status": aws.String("Status"),
-				},
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":status": {S: aws.String("deleted")},
-				},
-			}
-		}
-		allItems, lastKey, err = queryWithLimit(input, limit, startKey)
-	case "all":
-		if groupNum > 0 {
-			// Single query on GroupStatusIndex, exclude deleted
-			queryInput := &dynamodb.QueryInput{
-				TableName:              aws.String(imageTable),
-				IndexName:              aws.String("GroupStatusIndex"),
-				KeyConditionExpression: aws.String("GroupNumber = :group"),
-				FilterExpression:       aws.String("#status <> :deleted"),
-				ExpressionAttributeNames: map[string]*string{
-					"#status": aws.String("Status"),
-				},
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":group":   {N: aws.String(fmt.Sprintf("%d", groupNum))},
-					":deleted": {S: aws.String("deleted")},
-				},
-			}
-			allItems, err = queryAllPages(queryInput)
-		} else {
-			// No group filter — query each status and merge results (excluding deleted)
-			statuses := []string{"inbox", "approved", "rejected", "project"}
-			for _, status := range statuses {
-				queryInput := &dynamodb.QueryInput{
-					TableName:              aws.String(imageTable),
-					IndexName:              aws.String("StatusIndex"),
-					KeyConditionExpression: aws.String("#status = :status"),
-					ExpressionAttributeNames: map[string]*string{
-						"#status": aws.String("Status"),
-					},
-					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-						":status": {S: aws.String(status)},
-					},
-				}
-				items, queryErr := queryAllPages(queryInput)
-				if queryErr != nil {
-					err = queryErr
-					break
-				}
-				allItems = append(allItems, items...)
-			}
-		}
-		lastKey = nil // No pagination for "all"
-	default:
-		return errorResponse(400, "Invalid state filter", headers)
+		seenFiles[img.OriginalFile] = len(images)
+		images = append(images, img)
 	}
 
-	if err != nil {
-		fmt.Printf("Error querying images: %v\n", err)
-		return errorResponse(500, "Failed to list images", headers)
+	// Filters can read more than the field set returns
+	for i := range images {
+		images[i] = fields.trim(images[i])
 	}
 
-	// Use a map to deduplicate by OriginalFile, keeping the most recent entry
-	seenFiles := make(map[string]ImageResponse)
-	for _, item := range allItems {
-		var img ImageResponse
-		dynamodbattribute.UnmarshalMap(item, &img)
-
-		// Skip images that are already in a project (unless querying specifically for projects)
-		if img.ProjectID != "" && stateFilter != "all" {
-			continue
-		}
+	// Build paginated response
+	response := PaginatedImageResponse{
+		Images:     images,
+		HasMore:    nextCursor != "",
+		NextCursor: nextCursor,
+	}
+	return listResponse(request, response, headers)
+}
 
-		// Deduplicate by OriginalFile - keep the most recently updated entry
-		if existing, found := seenFiles[img.OriginalFile]; found {
-			// Compare timestamps - keep the newer one
-			existingTime, _ := time.Parse(time.RFC3339, existing.UpdatedDateTime)
-			if existing.UpdatedDateTime == "" {
-				existingTime, _ = time.Parse(time.RFC3339, existing.InsertedDateTime)
-			}
-			newTime, _ := time.Parse(time.RFC3339, img.UpdatedDateTime)
-			if img.UpdatedDateTime == "" {
-				newTime, _ = time.Parse(time.RFC3339, img.InsertedDateTime)
-			}
-			if newTime.After(existingTime) {
-				seenFiles[img.OriginalFile] = img
-			}
-		} else {
-			seenFiles[img.OriginalFile] = img
-		}
+// imageChangedAt is when an image was last updated, or else inserted.
+func imageChangedAt(img ImageResponse) time.Time {
+	if img.UpdatedDateTime == "" {
+		t, _ := time.Parse(time.RFC3339, img.InsertedDateTime)
+		return t
 	}
+	t, _ := time.Parse(time.RFC3339, img.UpdatedDateTime)
+	return t
+}
 
-	// Convert map to slice, stripping heavy fields to reduce payload size
-	// Keep: DateTimeOriginal (for date grouping), Keywords (for search)
-	// Strip: Description, RelatedFiles, verbose EXIF fields
-	images := make([]ImageResponse, 0, len(seenFiles))
-	for _, img := range seenFiles {
-		// Keep only essential EXIF fields for date grouping
-		if img.EXIFData != nil {
-			essentialExif := make(map[string]string)
-			if v, ok := img.EXIFData["DateTimeOriginal"]; ok {
-				essentialExif["DateTimeOriginal"] = v
-			}
-			if v, ok := img.EXIFData["DateTime"]; ok {
-				essentialExif["DateTime"] = v
-			}
-			img.EXIFData = essentialExif
+// listedImage strips an image down to the review fields: the EXIF dates
+// (for date grouping) and keywords, without the description, related files
+// and the rest of the EXIF data.
+func listedImage(img ImageResponse) ImageResponse {
+	// Keep only essential EXIF fields for date grouping
+	if img.EXIFData != nil {
+		essentialExif := make(map[string]string)
+		if v, ok := img.EXIFData["DateTimeOriginal"]; ok {
+			essentialExif["DateTimeOriginal"] = v
 		}
-		// Clear heavy fields to keep response under Lambda's 6MB limit
-		img.Description = ""
-		img.RelatedFiles = nil
-		images = append(images, img)
+		if v, ok := img.EXIFData["DateTime"]; ok {
+			essentialExif["DateTime"] = v
+		}
+		img.EXIFData = essentialExif
 	}
+	// Clear heavy fields to keep response under Lambda's 6MB limit
+	img.Description = ""
+	img.RelatedFiles = nil
+	return img
+}
 
-	// Build paginated response
-	response := PaginatedImageResponse{
-		Images:     images,
-		HasMore:    lastKey != nil,
-		NextCursor: encodeCursor(lastKey),
+// reviewDestination returns where a newly reviewed image's files go and its
+// new status: approved/<color>/YYYY/MM/DD with a group, rejected/YYYY/MM/DD
+// without one.
+func reviewDestination(img ImageResponse, groupNumber int) (string, string) {
+	datePath := buildDatePath(getImageDate(img))
+	if groupNumber > 0 {
+		return fmt.Sprintf("approved/%s/%s", getColorName(groupNumber), datePath), "approved"
 	}
-
-	body, _ := json.Marshal(response)
-	return events.APIGatewayProxyResponse{
-		StatusCode: 200,
-		Headers:    headers,
-		Body:       string(body),
-	}, nil
+	return "rejected/" + datePath, "rejected"
 }
 
-func handleUpdateImage(imageID string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+func handleUpdateImage(caller *Caller, imageID string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
 	var updateReq UpdateImageRequest
 	if err := json.Unmarshal([]byte(request.Body), &updateReq); err != nil {
 		return errorResponse(400, "Invalid request body", headers)
 	}
 
 	// Get current image metadata to check if this is a new review
-	getResult, err := withRetry(func() (*dynamodb.GetItemOutput, error) {
-		return ddbClient.GetItem(&dynamodb.GetItemInput{
-			TableName: aws.String(imageTable),
-			Key: map[string]*dynamodb.AttributeValue{
-				"ImageGUID": {S: aws.String(imageID)},
-			},
-		})
+	imgItem, err := withRetry(func() (Item, error) {
+		return imageStore.GetImage(imageID)
 	})
-	if err != nil || getResult.Item == nil {
+	if err != nil || imgItem == nil {
 		return errorResponse(404, "Image not found", headers)
 	}
 
 	var img ImageResponse
-	dynamodbattribute.UnmarshalMap(getResult.Item, &img)
+	dynamodbattribute.UnmarshalMap(imgItem, &img)
+	if err := checkImageAccess(caller, img, projectEditor); err != nil {
+		return projectAccessError(err, headers)
+	}
+	if version, ok, err := ifMatchVersion(request); err != nil {
+		return errorResponse(400, err.Error(), headers)
+	} else if ok && version != img.Version {
+		return versionConflictResponse("Image was changed by another request", img, img.Version, headers)
+	}
 
 	// Check if this is a new review (moving from unreviewed to reviewed)
 	var triggerMove bool
@@ -1866,21 +1750,8 @@ func handleUpdateImage(imageID string, request events.APIGatewayProxyRequest, he
 	var newStatus string
 
 	if updateReq.Reviewed == "true" && img.Reviewed == "false" {
-		imageDate := getImageDate(img)
-		datePath := buildDatePath(imageDate)
-
-		if updateReq.GroupNumber > 0 {
-			// Approved with a group - move to approved/<color>/YYYY/MM/DD
-			colorName := getColorName(updateReq.GroupNumber)
-			destPrefix = fmt.Sprintf("approved/%s/%s", colorName, datePath)
-			newStatus = "approved"
-			triggerMove = true
-		} else {
-			// Rejected (group 0) - move to rejected/YYYY/MM/DD
-			destPrefix = "rejected/" + datePath
-			newStatus = "rejected"
-			triggerMove = true
-		}
+		destPrefix, newStatus = reviewDestination(img, updateReq.GroupNumber)
+		triggerMove = true
 	}
 
 	// Build update expression
@@ -1890,6 +1761,7 @@ func handleUpdateImage(imageID string, request events.APIGatewayProxyRequest, he
 		":updated": {S: aws.String(time.Now().Format(time.RFC3339))},
 	}
 	exprAttrNames := make(map[string]*string)
+	removeExpr := ""
 
 	if updateReq.ColorCode != "" {
 		updateExpr += ", ColorCode = :color"
@@ -1918,7 +1790,7 @@ func handleUpdateImage(imageID string, request events.APIGatewayProxyRequest, he
 			exprAttrValues[":keywords"] = &dynamodb.AttributeValue{L: keywordsList}
 		} else {
 			// Empty array means remove keywords
-			updateExpr += " REMOVE Keywords"
+			removeExpr = " REMOVE Keywords"
 		}
 	}
 
@@ -1933,50 +1805,55 @@ func handleUpdateImage(imageID string, request events.APIGatewayProxyRequest, he
 		exprAttrValues[":moveStatus"] = &dynamodb.AttributeValue{S: aws.String("pending")}
 	}
 
-	// Update the image metadata
-	updateInput := &dynamodb.UpdateItemInput{
-		TableName: aws.String(imageTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ImageGUID": {S: aws.String(imageID)},
-		},
-		UpdateExpression:          aws.String(updateExpr),
-		ExpressionAttributeValues: exprAttrValues,
-	}
-	if len(exprAttrNames) > 0 {
-		updateInput.ExpressionAttributeNames = exprAttrNames
-	}
-
-	err = withRetryNoResult(func() error {
-		_, updateErr := ddbClient.UpdateItem(updateInput)
-		return updateErr
+	// Update the image metadata, as long as nobody else changed it since we read it
+	updatedItem, err := withRetry(func() (Item, error) {
+		return imageStore.UpdateImage(imageID, versioned(ItemUpdate{
+			Expression:   updateExpr + removeExpr,
+			Values:       exprAttrValues,
+			Names:        exprAttrNames,
+			ReturnValues: dynamodb.ReturnValueAllNew,
+		}, img.Version))
 	})
+	if isConditionFailed(err) {
+		return imageConflictResponse(imageID, headers)
+	}
 	if err != nil {
 		fmt.Printf("Error updating image: %v\n", err)
 		return errorResponse(500, "Failed to update image", headers)
 	}
 
-	// Store review decision
-	reviewID := fmt.Sprintf("review_%d", time.Now().Unix())
+	var updated ImageResponse
+	dynamodbattribute.UnmarshalMap(updatedItem, &updated)
+	before, after := auditDiff(imageAuditFields(img), imageAuditFields(updated))
+	recordAudit(caller, AuditEvent{Action: auditImageUpdate, ImageGUID: imageID, ProjectID: img.ProjectID, Before: before, After: after})
+	if updateReq.Keywords != nil {
+		indexImageItem(updatedItem)
+	}
+
+	// Store review decision. The random suffix keeps two reviews in the
+	// same second from overwriting each other.
+	reviewID := fmt.Sprintf("review_%d_%s", time.Now().Unix(), uuid.New().String())
 	reviewItem := map[string]*dynamodb.AttributeValue{
 		"ReviewID":    {S: aws.String(reviewID)},
 		"ImageGUID":   {S: aws.String(imageID)},
 		"GroupNumber": {N: aws.String(fmt.Sprintf("%d", updateReq.GroupNumber))},
 		"ColorCode":   {S: aws.String(updateReq.ColorCode)},
 		"Promoted":    {BOOL: aws.Bool(updateReq.Promoted)},
+		"Reviewer":    {S: aws.String(caller.Username)},
 		"Timestamp":   {S: aws.String(time.Now().Format(time.RFC3339))},
 	}
 
 	withRetryNoResult(func() error {
-		_, putErr := ddbClient.PutItem(&dynamodb.PutItemInput{
-			TableName: aws.String(reviewGroupsTable),
-			Item:      reviewItem,
-		})
-		return putErr
+		return imageStore.PutReviewRecord(reviewItem)
 	})
 
+	if err := pushUndoSteps(caller, undoStepFor(img)); err != nil {
+		fmt.Printf("Failed to record undo step for image %s: %v\n", imageID, err)
+	}
+
 	// Trigger async file move if needed
 	if triggerMove {
-		if err := triggerAsyncMove(imageID, destPrefix, newStatus, bucketName); err != nil {
+		if _, err := triggerAsyncMove(imageID, destPrefix, newStatus, bucketName, caller.Username); err != nil {
 			fmt.Printf("Error triggering async move: %v\n", err)
 			// Don't fail the request - the move status will show the issue
 		}
@@ -1984,34 +1861,35 @@ func handleUpdateImage(imageID string, request events.APIGatewayProxyRequest, he
 
 	return events.APIGatewayProxyResponse{
 		StatusCode: 200,
-		Headers:    headers,
-		Body:       `{"success": true}`,
+		Headers:    withETag(headers, updated.Version),
+		Body:       fmt.Sprintf(`{"success": true, "version": %d}`, updated.Version),
 	}, nil
 }
 
-func handleRegenerateAI(imageID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+func handleRegenerateAI(caller *Caller, imageID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
 	// Check if OpenAI API key is configured
 	if openaiAPIKey == "" {
 		return errorResponse(400, "AI content generation is not configured", headers)
 	}
 
 	// Get image metadata
-	result, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(imageTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ImageGUID": {S: aws.String(imageID)},
-		},
-	})
+	imgItem, err := imageStore.GetImage(imageID)
 
-	if err != nil || result.Item == nil {
+	if err != nil || imgItem == nil {
 		return errorResponse(404, "Image not found", headers)
 	}
 
 	var img ImageResponse
-	dynamodbattribute.UnmarshalMap(result.Item, &img)
+	dynamodbattribute.UnmarshalMap(imgItem, &img)
+	if err := checkImageAccess(caller, img, projectEditor); err != nil {
+		return projectAccessError(err, headers)
+	}
+	if wait, ok := takeQuota(quotaRegenerateAI, caller.Username); !ok {
+		return rateLimitedResponse(wait, "AI regeneration limit reached, try again later", headers)
+	}
 
 	// Call GPT-4o to analyze the image
-	aiResult, err := analyzeImageWithGPT4o(img.Bucket, img.Thumbnail400)
+	aiResult, err := analyzeImageWithGPT4o(img.Thumbnail400)
 	if err != nil {
 		fmt.Printf("Error analyzing image with GPT-4o: %v\n", err)
 		return errorResponse(500, fmt.Sprintf("Failed to analyze image: %v", err), headers)
@@ -2052,18 +1930,15 @@ func handleRegenerateAI(imageID string, headers map[string]string) (events.APIGa
 	}
 
 	// Update the image in DynamoDB
-	_, err = ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-		TableName: aws.String(imageTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ImageGUID": {S: aws.String(imageID)},
-		},
-		UpdateExpression:          aws.String(updateExpr),
-		ExpressionAttributeValues: exprAttrValues,
-	})
+	_, err = imageStore.UpdateImage(imageID, bumpVersion(ItemUpdate{
+		Expression: updateExpr,
+		Values:     exprAttrValues,
+	}))
 	if err != nil {
 		fmt.Printf("Error updating image with AI content: %v\n", err)
 		return errorResponse(500, "Failed to save AI content", headers)
 	}
+	indexImageForSearch(imageID)
 
 	// Return the updated content
 	response := map[string]interface{}{
@@ -2079,29 +1954,22 @@ func handleRegenerateAI(imageID string, headers map[string]string) (events.APIGa
 	}, nil
 }
 
-func handleDownload(imageID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+func handleDownload(caller *Caller, imageID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
 	// Get image metadata
-	result, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(imageTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ImageGUID": {S: aws.String(imageID)},
-		},
-	})
+	imgItem, err := imageStore.GetImage(imageID)
 
-	if err != nil || result.Item == nil {
+	if err != nil || imgItem == nil {
 		return errorResponse(404, "Image not found", headers)
 	}
 
 	var img ImageResponse
-	dynamodbattribute.UnmarshalMap(result.Item, &img)
+	dynamodbattribute.UnmarshalMap(imgItem, &img)
+	if err := checkImageAccess(caller, img, projectViewer); err != nil {
+		return projectAccessError(err, headers)
+	}
 
 	// Generate presigned URL
-	req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(img.OriginalFile),
-	})
-
-	url, err := req.Presign(15 * time.Minute)
+	url, err := objectStore.PresignGet(img.OriginalFile, "", 15*time.Minute)
 	if err != nil {
 		return errorResponse(500, "Failed to generate download URL", headers)
 	}
@@ -2114,21 +1982,119 @@ func handleDownload(imageID string, headers map[string]string) (events.APIGatewa
 	}, nil
 }
 
-func handleDeleteImage(imageID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+// ImageURLs are time-limited download links for an image's files.
+type ImageURLs struct {
+	Original     string `json:"original"`
+	Thumbnail50  string `json:"thumbnail50"`
+	Thumbnail400 string `json:"thumbnail400"`
+	Raw          string `json:"raw,omitempty"`
+}
+
+// ImageProject is the project an image belongs to and the caller's role on it.
+type ImageProject struct {
+	ProjectID string `json:"projectId"`
+	Name      string `json:"name"`
+	MyRole    string `json:"myRole"`
+}
+
+// ImageDetailResponse is a single image with everything the list strips out.
+type ImageDetailResponse struct {
+	ImageResponse
+	URLs    ImageURLs     `json:"urls"`
+	Project *ImageProject `json:"project,omitempty"`
+	History AuditResponse `json:"history"`
+}
+
+const imageDetailURLExpiry = 15 * time.Minute
+
+// handleGetImage returns an image's full metadata, download links for its
+// files and its audit history. historyCursor pages further back in the
+// history.
+func handleGetImage(caller *Caller, imageID string, params map[string]string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	var historyCursor *auditCursor
+	if s := params["historyCursor"]; s != "" {
+		c, err := decodeAuditCursor(s)
+		if err != nil {
+			return errorResponse(400, "Invalid historyCursor", headers)
+		}
+		historyCursor = c
+	}
+
+	imgItem, err := imageStore.GetImage(imageID)
+	if err != nil || imgItem == nil {
+		return errorResponse(404, "Image not found", headers)
+	}
+
+	var detail ImageDetailResponse
+	dynamodbattribute.UnmarshalMap(imgItem, &detail.ImageResponse)
+	img := &detail.ImageResponse
+	if img.ProjectID != "" {
+		project, err := getProjectFor(caller, img.ProjectID, projectViewer)
+		switch err {
+		case nil:
+			detail.Project = &ImageProject{ProjectID: project.ProjectID, Name: project.Name, MyRole: project.MyRole}
+		case errProjectNotFound:
+			// The project was deleted out from under the image
+		default:
+			return projectAccessError(err, headers)
+		}
+	}
+
+	// RawFile is set at ingest and not kept up to date by moves, so look
+	// next to the original where moves put it
+	if raws := findRawFiles(img.OriginalFile); len(raws) > 0 {
+		img.RawFile = raws[0]
+	} else if img.RawFile != "" && !objectStore.Exists(img.RawFile) {
+		img.RawFile = ""
+	}
+
+	for _, link := range []struct {
+		key string
+		url *string
+	}{
+		{img.OriginalFile, &detail.URLs.Original},
+		{img.Thumbnail50, &detail.URLs.Thumbnail50},
+		{img.Thumbnail400, &detail.URLs.Thumbnail400},
+		{img.RawFile, &detail.URLs.Raw},
+	} {
+		if link.key == "" {
+			continue
+		}
+		url, err := objectStore.PresignGet(link.key, "", imageDetailURLExpiry)
+		if err != nil {
+			fmt.Printf("Error presigning %s: %v\n", link.key, err)
+			return errorResponse(500, "Failed to generate download URLs", headers)
+		}
+		*link.url = url
+	}
+
+	detail.History, err = imageHistory(caller, imageID, historyCursor, auditDefaultLimit)
+	if err != nil {
+		fmt.Printf("Error loading history for image %s: %v\n", imageID, err)
+		return errorResponse(500, "Failed to load image history", headers)
+	}
+
+	body, _ := json.Marshal(detail)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    withETag(headers, detail.Version),
+		Body:       string(body),
+	}, nil
+}
+
+func handleDeleteImage(caller *Caller, imageID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
 	// Get image metadata first
-	result, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(imageTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ImageGUID": {S: aws.String(imageID)},
-		},
-	})
+	imgItem, err := imageStore.GetImage(imageID)
 
-	if err != nil || result.Item == nil {
+	if err != nil || imgItem == nil {
 		return errorResponse(404, "Image not found", headers)
 	}
 
 	var img ImageResponse
-	dynamodbattribute.UnmarshalMap(result.Item, &img)
+	dynamodbattribute.UnmarshalMap(imgItem, &img)
+	if err := checkImageAccess(caller, img, projectEditor); err != nil {
+		return projectAccessError(err, headers)
+	}
 
 	// Check if image is already deleted
 	if img.Status == "deleted" {
@@ -2145,7 +2111,7 @@ func handleDeleteImage(imageID string, headers map[string]string) (events.APIGat
 	destPrefix := "deleted/" + datePath
 
 	// Move all files to deleted folder
-	newPaths, err := moveImageFiles(bucketName, img, destPrefix)
+	newPaths, err := moveImageFiles(img, destPrefix)
 	if err != nil {
 		fmt.Printf("Error moving files: %v\n", err)
 		// If the source file is missing from S3, delete the image record from DynamoDB
@@ -2155,48 +2121,52 @@ func handleDeleteImage(imageID string, headers map[string]string) (events.APIGat
 				fmt.Printf("Error deleting image from DB: %v\n", delErr)
 				return errorResponse(500, "Failed to delete orphaned image record", headers)
 			}
+			recordAudit(caller, AuditEvent{Action: auditImageDelete, ImageGUID: imageID, ProjectID: img.ProjectID,
+				Before: imageAuditFields(img), After: map[string]interface{}{"recordDeleted": true}})
 			return events.APIGatewayProxyResponse{
 				StatusCode: 200,
 				Headers:    headers,
 				Body:       `{"success": true, "deleted": true, "reason": "source file missing"}`,
 			}, nil
 		}
+		if errors.Is(err, errMoveConflict) {
+			return errorResponse(409, "The image's files are being moved, try again shortly", headers)
+		}
 		return errorResponse(500, fmt.Sprintf("Failed to move files: %v", err), headers)
 	}
 
 	// Update DynamoDB with new paths and status (instead of deleting)
-	_, err = ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-		TableName: aws.String(imageTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ImageGUID": {S: aws.String(imageID)},
-		},
-		UpdateExpression: aws.String("SET OriginalFile = :orig, Thumbnail50 = :t50, Thumbnail400 = :t400, #status = :status, UpdatedDateTime = :updated"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+	updatedItem, err := imageStore.UpdateImage(imageID, bumpVersion(closeMoveJournal(ItemUpdate{
+		Expression: "SET OriginalFile = :orig, Thumbnail50 = :t50, Thumbnail400 = :t400, #status = :status, UpdatedDateTime = :updated",
+		Values: map[string]*dynamodb.AttributeValue{
 			":orig":    {S: aws.String(newPaths["original"])},
 			":t50":     {S: aws.String(newPaths["thumbnail50"])},
 			":t400":    {S: aws.String(newPaths["thumbnail400"])},
 			":status":  {S: aws.String("deleted")},
 			":updated": {S: aws.String(time.Now().Format(time.RFC3339))},
 		},
-		ExpressionAttributeNames: map[string]*string{
+		Names: map[string]*string{
 			"#status": aws.String("Status"),
 		},
-	})
+		ReturnValues: dynamodb.ReturnValueAllNew,
+	})))
 
 	if err != nil {
 		fmt.Printf("Error updating metadata: %v\n", err)
+		rollbackMoveOf(imageID, destPrefix)
 		return errorResponse(500, "Failed to update metadata", headers)
 	}
 
+	var updated ImageResponse
+	dynamodbattribute.UnmarshalMap(updatedItem, &updated)
+	before, after := auditDiff(imageAuditFields(img), imageAuditFields(updated))
+	recordAudit(caller, AuditEvent{Action: auditImageDelete, ImageGUID: imageID, ProjectID: img.ProjectID, Before: before, After: after})
+
 	// Decrement project ImageCount if image was in a project
 	if img.ProjectID != "" {
-		_, err = ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-			TableName: aws.String(projectsTable),
-			Key: map[string]*dynamodb.AttributeValue{
-				"ProjectID": {S: aws.String(img.ProjectID)},
-			},
-			UpdateExpression: aws.String("ADD ImageCount :dec"),
-			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+		_, err = projectStore.UpdateProject(img.ProjectID, ItemUpdate{
+			Expression: "ADD ImageCount :dec",
+			Values: map[string]*dynamodb.AttributeValue{
 				":dec": {N: aws.String("-1")},
 			},
 		})
@@ -2212,21 +2182,19 @@ func handleDeleteImage(imageID string, headers map[string]string) (events.APIGat
 	}, nil
 }
 
-func handleUndeleteImage(imageID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+func handleUndeleteImage(caller *Caller, imageID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
 	// Get image metadata first
-	result, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(imageTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ImageGUID": {S: aws.String(imageID)},
-		},
-	})
+	imgItem, err := imageStore.GetImage(imageID)
 
-	if err != nil || result.Item == nil {
+	if err != nil || imgItem == nil {
 		return errorResponse(404, "Image not found", headers)
 	}
 
 	var img ImageResponse
-	dynamodbattribute.UnmarshalMap(result.Item, &img)
+	dynamodbattribute.UnmarshalMap(imgItem, &img)
+	if err := checkImageAccess(caller, img, projectEditor); err != nil {
+		return projectAccessError(err, headers)
+	}
 
 	// Verify image is deleted
 	if img.Status != "deleted" {
@@ -2239,7 +2207,7 @@ func handleUndeleteImage(imageID string, headers map[string]string) (events.APIG
 	destPrefix := "inbox/" + datePath
 
 	// Move all files back to inbox folder
-	newPaths, err := moveImageFiles(bucketName, img, destPrefix)
+	newPaths, err := moveImageFiles(img, destPrefix)
 	if err != nil {
 		fmt.Printf("Error moving files: %v\n", err)
 		// If the source file is missing from S3, delete the image record from DynamoDB
@@ -2249,50 +2217,54 @@ func handleUndeleteImage(imageID string, headers map[string]string) (events.APIG
 				fmt.Printf("Error deleting image from DB: %v\n", delErr)
 				return errorResponse(500, "Failed to delete orphaned image record", headers)
 			}
+			recordAudit(caller, AuditEvent{Action: auditImageDelete, ImageGUID: imageID, ProjectID: img.ProjectID,
+				Before: imageAuditFields(img), After: map[string]interface{}{"recordDeleted": true}})
 			return events.APIGatewayProxyResponse{
 				StatusCode: 200,
 				Headers:    headers,
 				Body:       `{"success": true, "deleted": true, "reason": "source file missing"}`,
 			}, nil
 		}
+		if errors.Is(err, errMoveConflict) {
+			return errorResponse(409, "The image's files are being moved, try again shortly", headers)
+		}
 		return errorResponse(500, fmt.Sprintf("Failed to move files: %v", err), headers)
 	}
 
 	// Update DynamoDB with new paths and reset status
-	_, err = ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-		TableName: aws.String(imageTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ImageGUID": {S: aws.String(imageID)},
-		},
-		UpdateExpression: aws.String("SET OriginalFile = :orig, Thumbnail50 = :t50, Thumbnail400 = :t400, Reviewed = :reviewed, UpdatedDateTime = :updated REMOVE #status"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+	updatedItem, err := imageStore.UpdateImage(imageID, bumpVersion(closeMoveJournal(ItemUpdate{
+		Expression: "SET OriginalFile = :orig, Thumbnail50 = :t50, Thumbnail400 = :t400, Reviewed = :reviewed, UpdatedDateTime = :updated REMOVE #status",
+		Values: map[string]*dynamodb.AttributeValue{
 			":orig":     {S: aws.String(newPaths["original"])},
 			":t50":      {S: aws.String(newPaths["thumbnail50"])},
 			":t400":     {S: aws.String(newPaths["thumbnail400"])},
 			":reviewed": {S: aws.String("false")},
 			":updated":  {S: aws.String(time.Now().Format(time.RFC3339))},
 		},
-		ExpressionAttributeNames: map[string]*string{
+		Names: map[string]*string{
 			"#status": aws.String("Status"),
 		},
-	})
+		ReturnValues: dynamodb.ReturnValueAllNew,
+	})))
 
 	if err != nil {
 		fmt.Printf("Error updating metadata: %v\n", err)
+		rollbackMoveOf(imageID, destPrefix)
 		return errorResponse(500, "Failed to update metadata", headers)
 	}
 
+	var updated ImageResponse
+	dynamodbattribute.UnmarshalMap(updatedItem, &updated)
+	before, after := auditDiff(imageAuditFields(img), imageAuditFields(updated))
+	recordAudit(caller, AuditEvent{Action: auditImageUndelete, ImageGUID: imageID, ProjectID: img.ProjectID, Before: before, After: after})
+
 	// Re-increment project ImageCount: handleDeleteImage decremented it, so
 	// undelete must put it back. Without this, the stored counter drifts low
 	// permanently (and we no longer reconcile on every list call).
 	if img.ProjectID != "" {
-		_, err = ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-			TableName: aws.String(projectsTable),
-			Key: map[string]*dynamodb.AttributeValue{
-				"ProjectID": {S: aws.String(img.ProjectID)},
-			},
-			UpdateExpression: aws.String("ADD ImageCount :inc"),
-			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+		_, err = projectStore.UpdateProject(img.ProjectID, ItemUpdate{
+			Expression: "ADD ImageCount :inc",
+			Values: map[string]*dynamodb.AttributeValue{
 				":inc": {N: aws.String("1")},
 			},
 		})
@@ -2310,13 +2282,11 @@ func handleUndeleteImage(imageID string, headers map[string]string) (events.APIG
 
 // Project handlers
 
-func handleListProjects(request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+func handleListProjects(caller *Caller, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
 	// Check if we should include archived projects
 	includeArchived := request.QueryStringParameters["includeArchived"] == "true"
 
-	result, err := ddbClient.Scan(&dynamodb.ScanInput{
-		TableName: aws.String(projectsTable),
-	})
+	result, err := projectStore.ScanProjects(ItemScan{})
 	if err != nil {
 		fmt.Printf("Error listing projects: %v\n", err)
 		return errorResponse(500, "Failed to list projects", headers)
@@ -2332,6 +2302,11 @@ func handleListProjects(request events.APIGatewayProxyRequest, headers map[strin
 			continue
 		}
 
+		// Only list projects the caller is a member of
+		if p.MyRole = projectRole(caller, p); p.MyRole == "" {
+			continue
+		}
+
 		projects = append(projects, p)
 	}
 
@@ -2348,7 +2323,7 @@ func handleListProjects(request events.APIGatewayProxyRequest, headers map[strin
 	}, nil
 }
 
-func handleCreateProject(request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+func handleCreateProject(caller *Caller, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
 	var req CreateProjectRequest
 	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
 		return errorResponse(400, "Invalid request body", headers)
@@ -2368,18 +2343,18 @@ func handleCreateProject(request events.APIGatewayProxyRequest, headers map[stri
 		CreatedAt:  time.Now().Format(time.RFC3339),
 		ImageCount: 0,
 		Keywords:   req.Keywords,
+		Members:    map[string]string{caller.Username: projectOwner},
 	}
 
 	av, _ := dynamodbattribute.MarshalMap(project)
-	_, err := ddbClient.PutItem(&dynamodb.PutItemInput{
-		TableName: aws.String(projectsTable),
-		Item:      av,
-	})
-	if err != nil {
+	if err := projectStore.PutProject(av); err != nil {
 		fmt.Printf("Error creating project: %v\n", err)
 		return errorResponse(500, "Failed to create project", headers)
 	}
+	recordAudit(caller, AuditEvent{Action: auditProjectCreate, ProjectID: project.ProjectID, After: projectAuditFields(project)})
+	indexProjectForSearch(project.ProjectID)
 
+	project.MyRole = projectOwner
 	body, _ := json.Marshal(project)
 	return events.APIGatewayProxyResponse{
 		StatusCode: 201,
@@ -2388,28 +2363,26 @@ func handleCreateProject(request events.APIGatewayProxyRequest, headers map[stri
 	}, nil
 }
 
-func handleUpdateProject(projectID string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+func handleUpdateProject(caller *Caller, projectID string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
 	var req UpdateProjectRequest
 	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
 		return errorResponse(400, "Invalid request body", headers)
 	}
 
-	// Get existing project
-	getResult, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(projectsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ProjectID": {S: aws.String(projectID)},
-		},
-	})
-	if err != nil || getResult.Item == nil {
-		return errorResponse(404, "Project not found", headers)
+	project, err := getProjectFor(caller, projectID, projectEditor)
+	if err != nil {
+		return projectAccessError(err, headers)
 	}
-
-	var project Project
-	dynamodbattribute.UnmarshalMap(getResult.Item, &project)
+	if version, ok, err := ifMatchVersion(request); err != nil {
+		return errorResponse(400, err.Error(), headers)
+	} else if ok && version != project.Version {
+		return versionConflictResponse("Project was changed by another request", project, project.Version, headers)
+	}
+	before := projectAuditFields(project)
 
 	// Build update expression
 	updateExpr := "SET UpdatedAt = :updated"
+	removeExpr := ""
 	exprAttrValues := map[string]*dynamodb.AttributeValue{
 		":updated": {S: aws.String(time.Now().Format(time.RFC3339))},
 	}
@@ -2432,7 +2405,7 @@ func handleUpdateProject(projectID string, request events.APIGatewayProxyRequest
 			exprAttrValues[":keywords"] = &dynamodb.AttributeValue{L: keywordsList}
 		} else {
 			// Remove keywords if empty array
-			updateExpr += " REMOVE Keywords"
+			removeExpr = " REMOVE Keywords"
 		}
 		project.Keywords = req.Keywords
 	}
@@ -2444,309 +2417,98 @@ func handleUpdateProject(projectID string, request events.APIGatewayProxyRequest
 		project.Archived = *req.Archived
 	}
 
-	updateInput := &dynamodb.UpdateItemInput{
-		TableName: aws.String(projectsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ProjectID": {S: aws.String(projectID)},
-		},
-		UpdateExpression:          aws.String(updateExpr),
-		ExpressionAttributeValues: exprAttrValues,
+	update := ItemUpdate{
+		Expression: updateExpr + removeExpr,
+		Values:     exprAttrValues,
 	}
 
 	// Add expression attribute names if we're updating name
 	if req.Name != "" {
-		updateInput.ExpressionAttributeNames = map[string]*string{
+		update.Names = map[string]*string{
 			"#name": aws.String("Name"),
 		}
 	}
 
-	_, err = ddbClient.UpdateItem(updateInput)
+	_, err = projectStore.UpdateProject(projectID, versioned(update, project.Version))
+	if isConditionFailed(err) {
+		current, err := getProjectFor(caller, projectID, projectViewer)
+		if err != nil {
+			return projectAccessError(err, headers)
+		}
+		return versionConflictResponse("Project was changed by another request", current, current.Version, headers)
+	}
 	if err != nil {
 		fmt.Printf("Error updating project: %v\n", err)
 		return errorResponse(500, "Failed to update project", headers)
 	}
+	project.Version++
+	changedBefore, changedAfter := auditDiff(before, projectAuditFields(project))
+	recordAudit(caller, AuditEvent{Action: auditProjectUpdate, ProjectID: projectID, Before: changedBefore, After: changedAfter})
+	if req.Name != "" || req.Keywords != nil {
+		indexProjectForSearch(projectID)
+	}
 
 	body, _ := json.Marshal(project)
 	return events.APIGatewayProxyResponse{
 		StatusCode: 200,
-		Headers:    headers,
+		Headers:    withETag(headers, project.Version),
 		Body:       string(body),
 	}, nil
 }
 
-func handleAddToProject(projectID string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+func handleAddToProject(caller *Caller, projectID string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
 	var req AddToProjectRequest
 	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
 		return errorResponse(400, "Invalid request body", headers)
 	}
 
-	// Get project to verify it exists
-	projResult, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(projectsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ProjectID": {S: aws.String(projectID)},
-		},
-	})
-	if err != nil || projResult.Item == nil {
-		return errorResponse(404, "Project not found", headers)
+	project, err := getProjectFor(caller, projectID, projectEditor)
+	if err != nil {
+		return projectAccessError(err, headers)
 	}
 
-	var project Project
-	dynamodbattribute.UnmarshalMap(projResult.Item, &project)
-
-	var imagesToProcess []map[string]*dynamodb.AttributeValue
-
-	// If a specific imageGUID is provided, add just that image
-	if req.ImageGUID != "" {
-		imgResult, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-			TableName: aws.String(imageTable),
-			Key: map[string]*dynamodb.AttributeValue{
-				"ImageGUID": {S: aws.String(req.ImageGUID)},
-			},
-		})
-		if err != nil || imgResult.Item == nil {
-			return errorResponse(404, "Image not found", headers)
+	// A group, or all approved images, is added by a job whose workers
+	// move the images, so the request returns at once
+	if req.ImageGUID == "" {
+		job := newJob(jobAddToProject, caller.Username, req)
+		job.ProjectID = projectID
+		if err := startJob(job); err != nil {
+			fmt.Printf("Error starting add to project job: %v\n", err)
+			return errorResponse(500, "Failed to start adding images", headers)
 		}
-		imagesToProcess = append(imagesToProcess, imgResult.Item)
-	} else {
-		// Query approved images (Status = 'approved')
-		// Also query inbox images with a group assigned (async move may not have completed yet)
-		if !req.All && req.Group > 0 {
-			// Use GroupStatusIndex for efficient group-scoped queries
-			// 1. Approved images in this group
-			approvedInput := &dynamodb.QueryInput{
-				TableName:              aws.String(imageTable),
-				IndexName:              aws.String("GroupStatusIndex"),
-				KeyConditionExpression: aws.String("GroupNumber = :group"),
-				FilterExpression:       aws.String("#status = :status"),
-				ExpressionAttributeNames: map[string]*string{
-					"#status": aws.String("Status"),
-				},
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":group":  {N: aws.String(fmt.Sprintf("%d", req.Group))},
-					":status": {S: aws.String("approved")},
-				},
-			}
-			items, err := queryAllPages(approvedInput)
-			if err != nil {
-				fmt.Printf("Error querying approved images: %v\n", err)
-				return errorResponse(500, "Failed to query images", headers)
-			}
-			imagesToProcess = append(imagesToProcess, items...)
-
-			// 2. Inbox images in this group that are reviewed (pending move)
-			inboxInput := &dynamodb.QueryInput{
-				TableName:              aws.String(imageTable),
-				IndexName:              aws.String("GroupStatusIndex"),
-				KeyConditionExpression: aws.String("GroupNumber = :group"),
-				FilterExpression:       aws.String("#status = :status AND Reviewed = :reviewed"),
-				ExpressionAttributeNames: map[string]*string{
-					"#status": aws.String("Status"),
-				},
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":group":    {N: aws.String(fmt.Sprintf("%d", req.Group))},
-					":status":   {S: aws.String("inbox")},
-					":reviewed": {S: aws.String("true")},
-				},
-			}
-			items, err = queryAllPages(inboxInput)
-			if err != nil {
-				fmt.Printf("Error querying inbox images: %v\n", err)
-				return errorResponse(500, "Failed to query images", headers)
-			}
-			imagesToProcess = append(imagesToProcess, items...)
-		} else {
-			// No group filter — use StatusIndex as before
-			statusesToQuery := []string{"approved", "inbox"}
-			for _, status := range statusesToQuery {
-				queryInput := &dynamodb.QueryInput{
-					TableName:              aws.String(imageTable),
-					IndexName:              aws.String("StatusIndex"),
-					KeyConditionExpression: aws.String("#status = :status"),
-					ExpressionAttributeNames: map[string]*string{
-						"#status": aws.String("Status"),
-					},
-					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-						":status": {S: aws.String(status)},
-					},
-				}
-
-				if status == "inbox" {
-					queryInput.FilterExpression = aws.String("Reviewed = :reviewed AND GroupNumber > :zero")
-					queryInput.ExpressionAttributeValues[":reviewed"] = &dynamodb.AttributeValue{S: aws.String("true")}
-					queryInput.ExpressionAttributeValues[":zero"] = &dynamodb.AttributeValue{N: aws.String("0")}
-				}
+		recordAudit(caller, AuditEvent{Action: auditProjectAddImages, ProjectID: projectID, After: map[string]interface{}{
+			"all": req.All, "group": req.Group, "jobId": job.JobID,
+		}})
+		return jsonResponse(202, job, headers)
+	}
 
-				items, err := queryAllPages(queryInput)
-				if err != nil {
-					fmt.Printf("Error querying %s images: %v\n", status, err)
-					return errorResponse(500, "Failed to query images", headers)
-				}
-				imagesToProcess = append(imagesToProcess, items...)
-			}
+	imgItem, err := imageStore.GetImage(req.ImageGUID)
+	if err != nil || imgItem == nil {
+		return errorResponse(404, "Image not found", headers)
+	}
+	// Taking an image out of another project needs access to that one too
+	var img ImageResponse
+	dynamodbattribute.UnmarshalMap(imgItem, &img)
+	if img.ProjectID != projectID {
+		if err := checkImageAccess(caller, img, projectEditor); err != nil {
+			return projectAccessError(err, headers)
 		}
 	}
+	if version, ok, err := ifMatchVersion(request); err != nil {
+		return errorResponse(400, err.Error(), headers)
+	} else if ok && version != img.Version {
+		return versionConflictResponse("Image was changed by another request", img, img.Version, headers)
+	}
 
-	// Move each image to project folder using sanitized S3 prefix
-	s3Prefix := getProjectS3Prefix(project)
 	movedCount := 0
-	for _, item := range imagesToProcess {
-		var img ImageResponse
-		dynamodbattribute.UnmarshalMap(item, &img)
-
-		imageDate := getImageDate(img)
-		datePath := buildDatePath(imageDate)
-		destPrefix := fmt.Sprintf("projects/%s/%s", s3Prefix, datePath)
-
-		fmt.Printf("Moving image %s: src=%s -> dest=%s/\n", img.ImageGUID, img.OriginalFile, destPrefix)
-		newPaths, err := moveImageFiles(bucketName, img, destPrefix)
-		if err != nil {
-			fmt.Printf("Failed to move image %s: %v\n", img.ImageGUID, err)
-			// If the source file is missing, the async move may have relocated it.
-			// Re-fetch the image metadata from DynamoDB and retry with updated paths.
-			if errors.Is(err, ErrSourceFileMissing) {
-				fmt.Printf("Source file missing for image %s, re-fetching metadata for retry\n", img.ImageGUID)
-				retryResult, retryErr := ddbClient.GetItem(&dynamodb.GetItemInput{
-					TableName: aws.String(imageTable),
-					Key: map[string]*dynamodb.AttributeValue{
-						"ImageGUID": {S: aws.String(img.ImageGUID)},
-					},
-				})
-				if retryErr != nil || retryResult.Item == nil {
-	
-					fmt.Printf("Image %s no longer exists in database, skipping\n", img.ImageGUID)
-					continue
-				}
-				var refreshedImg ImageResponse
-				dynamodbattribute.UnmarshalMap(retryResult.Item, &refreshedImg)
-				// If paths changed, retry the move with updated paths
-				if refreshedImg.OriginalFile != img.OriginalFile {
-					fmt.Printf("Image %s paths updated by async move, retrying with new paths\n", img.ImageGUID)
-					img = refreshedImg
-					// Recalculate destination in case date info changed
-					imageDate = getImageDate(img)
-					datePath = buildDatePath(imageDate)
-					destPrefix = fmt.Sprintf("projects/%s/%s", s3Prefix, datePath)
-					newPaths, err = moveImageFiles(bucketName, img, destPrefix)
-					if err != nil {
-	
-						fmt.Printf("Retry failed for image %s: %v\n", img.ImageGUID, err)
-						continue
-					}
-				} else {
-	
-					fmt.Printf("Image %s paths unchanged, source truly missing, skipping\n", img.ImageGUID)
-					continue
-				}
-			} else {
-	
-				continue
-			}
-		}
-
-		// Build list of raw files for DynamoDB
-		var rawFilesList []*dynamodb.AttributeValue
-		if rawFilesStr := newPaths["rawFiles"]; rawFilesStr != "" {
-			for _, rf := range strings.Split(rawFilesStr, ",") {
-				if rf != "" {
-					rawFilesList = append(rawFilesList, &dynamodb.AttributeValue{S: aws.String(rf)})
-				}
-			}
-		}
-
-		// Generate AI keywords and description if not already present
-		var aiKeywords []string
-		var aiDescription string
-		if img.Description == "" && openaiAPIKey != "" {
-			fmt.Printf("Generating AI analysis for image %s (added to project)\n", img.ImageGUID)
-			aiResult, err := analyzeImageWithGPT4o(bucketName, newPaths["thumbnail400"])
-			if err != nil {
-				fmt.Printf("AI analysis failed for image %s: %v\n", img.ImageGUID, err)
-			} else {
-				// Merge AI keywords with existing user keywords (case-insensitive deduplication)
-				existingKeywordsLower := make(map[string]bool)
-				for _, kw := range img.Keywords {
-					existingKeywordsLower[strings.ToLower(kw)] = true
-				}
-				aiKeywords = append([]string{}, img.Keywords...)
-				for _, kw := range aiResult.Keywords {
-					if !existingKeywordsLower[strings.ToLower(kw)] {
-						aiKeywords = append(aiKeywords, kw)
-						existingKeywordsLower[strings.ToLower(kw)] = true
-					}
-				}
-				aiDescription = aiResult.Description
-				fmt.Printf("AI analysis complete for image %s: %d keywords\n", img.ImageGUID, len(aiKeywords))
-			}
-		}
-
-		// Update image record
-		updateExpr := "SET OriginalFile = :orig, Thumbnail50 = :t50, Thumbnail400 = :t400, #status = :status, ProjectID = :proj, UpdatedDateTime = :updated"
-		exprValues := map[string]*dynamodb.AttributeValue{
-			":orig":    {S: aws.String(newPaths["original"])},
-			":t50":     {S: aws.String(newPaths["thumbnail50"])},
-			":t400":    {S: aws.String(newPaths["thumbnail400"])},
-			":status":  {S: aws.String("project")},
-			":proj":    {S: aws.String(projectID)},
-			":updated": {S: aws.String(time.Now().Format(time.RFC3339))},
-		}
-
-		// Add RelatedFiles if we found any RAW files
-		if len(rawFilesList) > 0 {
-			updateExpr += ", RelatedFiles = :rawFiles"
-			exprValues[":rawFiles"] = &dynamodb.AttributeValue{L: rawFilesList}
-		}
-
-		// Add AI-generated description if available
-		if aiDescription != "" {
-			updateExpr += ", #desc = :desc"
-			exprValues[":desc"] = &dynamodb.AttributeValue{S: aws.String(aiDescription)}
-		}
-
-		// Add merged keywords if available
-		if len(aiKeywords) > 0 {
-			keywordsList := make([]*dynamodb.AttributeValue, len(aiKeywords))
-			for i, kw := range aiKeywords {
-				keywordsList[i] = &dynamodb.AttributeValue{S: aws.String(kw)}
-			}
-			updateExpr += ", Keywords = :keywords"
-			exprValues[":keywords"] = &dynamodb.AttributeValue{L: keywordsList}
-		}
-
-		exprNames := map[string]*string{
-			"#status": aws.String("Status"),
-		}
-		if aiDescription != "" {
-			exprNames["#desc"] = aws.String("Description")
-		}
-
-		_, err = ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-			TableName: aws.String(imageTable),
-			Key: map[string]*dynamodb.AttributeValue{
-				"ImageGUID": {S: aws.String(img.ImageGUID)},
-			},
-			UpdateExpression:          aws.String(updateExpr),
-			ExpressionAttributeValues: exprValues,
-			ExpressionAttributeNames:  exprNames,
-		})
-		if err != nil {
-			fmt.Printf("Failed to update image record %s: %v\n", img.ImageGUID, err)
-			continue
-		}
-		movedCount++
+	if added, err := addImageToProject(img, project); err != nil {
+		fmt.Printf("Failed to add image %s to project %s: %v\n", img.ImageGUID, projectID, err)
+	} else if added {
+		movedCount = 1
 	}
-
-	// Update project image count
-	ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-		TableName: aws.String(projectsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ProjectID": {S: aws.String(projectID)},
-		},
-		UpdateExpression: aws.String("ADD ImageCount :count"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":count": {N: aws.String(fmt.Sprintf("%d", movedCount))},
-		},
-	})
+	recordAudit(caller, AuditEvent{Action: auditProjectAddImages, ProjectID: projectID, ImageGUID: req.ImageGUID, After: map[string]interface{}{
+		"imageGUID": req.ImageGUID, "movedCount": movedCount,
+	}})
 
 	body, _ := json.Marshal(map[string]int{"movedCount": movedCount})
 	return events.APIGatewayProxyResponse{
@@ -2756,57 +2518,67 @@ func handleAddToProject(projectID string, request events.APIGatewayProxyRequest,
 	}, nil
 }
 
-func handleGetProjectImages(projectID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
-	result, err := ddbClient.Query(&dynamodb.QueryInput{
-		TableName:              aws.String(imageTable),
-		IndexName:              aws.String("ProjectIndex"),
-		KeyConditionExpression: aws.String("ProjectID = :pid"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":pid": {S: aws.String(projectID)},
+func handleGetProjectImages(caller *Caller, projectID string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	if _, err := getProjectFor(caller, projectID, projectViewer); err != nil {
+		return projectAccessError(err, headers)
+	}
+	params := request.QueryStringParameters
+	order, err := parseImageOrder(params)
+	if err != nil {
+		return errorResponse(400, err.Error(), headers)
+	}
+	fields, err := parseImageFields(params, "full")
+	if err != nil {
+		return errorResponse(400, err.Error(), headers)
+	}
+
+	queries := fields.project([]ItemQuery{{
+		Index:        "ProjectIndex",
+		KeyCondition: "#key = :key",
+		Names:        map[string]*string{"#key": aws.String("ProjectID")},
+		Values: map[string]*dynamodb.AttributeValue{
+			":key": {S: aws.String(projectID)},
 		},
-	})
+	}}, order)
+	items, nextCursor, err := listImages(queries, order, listPage{items: listLimit(params), bytes: listMaxBytes}, params["cursor"])
+	if err == errInvalidCursor {
+		return errorResponse(400, "Invalid cursor", headers)
+	}
 	if err != nil {
 		fmt.Printf("Error querying project images: %v\n", err)
 		return errorResponse(500, "Failed to query images", headers)
 	}
 
-	images := make([]ImageResponse, 0)
-	for _, item := range result.Items {
+	images := make([]ImageResponse, 0, len(items))
+	for _, item := range items {
 		var img ImageResponse
 		dynamodbattribute.UnmarshalMap(item, &img)
-		images = append(images, img)
+		images = append(images, fields.trim(img))
 	}
 
-	body, _ := json.Marshal(images)
-	return events.APIGatewayProxyResponse{
-		StatusCode: 200,
-		Headers:    headers,
-		Body:       string(body),
-	}, nil
+	return listResponse(request, PaginatedImageResponse{
+		Images:     images,
+		HasMore:    nextCursor != "",
+		NextCursor: nextCursor,
+	}, headers)
 }
 
-func handleGenerateZip(projectID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+func handleGenerateZip(caller *Caller, projectID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
 	if zipLambdaName == "" {
 		return errorResponse(500, "Zip generation not configured", headers)
 	}
 
-	// Get project to verify it exists and has images
-	projResult, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(projectsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ProjectID": {S: aws.String(projectID)},
-		},
-	})
-	if err != nil || projResult.Item == nil {
-		return errorResponse(404, "Project not found", headers)
+	project, err := getProjectFor(caller, projectID, projectEditor)
+	if err != nil {
+		return projectAccessError(err, headers)
 	}
 
-	var project Project
-	dynamodbattribute.UnmarshalMap(projResult.Item, &project)
-
 	if project.ImageCount == 0 {
 		return errorResponse(400, "Project has no images to zip", headers)
 	}
+	if wait, ok := takeQuota(quotaGenerateZip, caller.Username); !ok {
+		return rateLimitedResponse(wait, "Zip generation limit reached, try again later", headers)
+	}
 
 	// Mark as generating by adding a placeholder zip entry
 	placeholderZip := ZipFile{
@@ -2818,13 +2590,9 @@ func handleGenerateZip(projectID string, headers map[string]string) (events.APIG
 	}
 
 	zipFilesList, _ := dynamodbattribute.MarshalList([]ZipFile{placeholderZip})
-	_, err = ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-		TableName: aws.String(projectsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ProjectID": {S: aws.String(projectID)},
-		},
-		UpdateExpression: aws.String("SET ZipFiles = :zips"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+	_, err = projectStore.UpdateProject(projectID, ItemUpdate{
+		Expression: "SET ZipFiles = :zips",
+		Values: map[string]*dynamodb.AttributeValue{
 			":zips": {L: zipFilesList},
 		},
 	})
@@ -2832,22 +2600,19 @@ func handleGenerateZip(projectID string, headers map[string]string) (events.APIG
 		fmt.Printf("Error setting zip status: %v\n", err)
 	}
 
-	// Invoke the zip Lambda asynchronously
-	payload, _ := json.Marshal(map[string]string{"projectId": projectID})
-
-	_, err = lambdaClient.Invoke(&lambdasvc.InvokeInput{
-		FunctionName:   aws.String(zipLambdaName),
-		InvocationType: aws.String("Event"), // Async invocation
-		Payload:        payload,
-	})
-	if err != nil {
-		fmt.Printf("Error invoking zip lambda: %v\n", err)
+	// Run the zip Lambda asynchronously as a job
+	job := newJob(jobZip, caller.Username, nil)
+	job.ProjectID = projectID
+	if err := startJob(job); err != nil {
+		fmt.Printf("Error starting zip job: %v\n", err)
 		return errorResponse(500, "Failed to start zip generation", headers)
 	}
+	recordAudit(caller, AuditEvent{Action: auditZipGenerate, ProjectID: projectID, After: map[string]interface{}{"imageCount": project.ImageCount}})
 
 	body, _ := json.Marshal(map[string]interface{}{
 		"success": true,
 		"message": "Zip generation started",
+		"jobId":   job.JobID,
 	})
 	return events.APIGatewayProxyResponse{
 		StatusCode: 200,
@@ -2856,21 +2621,12 @@ func handleGenerateZip(projectID string, headers map[string]string) (events.APIG
 	}, nil
 }
 
-func handleGetZipDownload(projectID string, zipKey string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
-	// Get project to verify the zip exists
-	projResult, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(projectsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ProjectID": {S: aws.String(projectID)},
-		},
-	})
-	if err != nil || projResult.Item == nil {
-		return errorResponse(404, "Project not found", headers)
+func handleGetZipDownload(caller *Caller, projectID string, zipKey string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	project, err := getProjectFor(caller, projectID, projectViewer)
+	if err != nil {
+		return projectAccessError(err, headers)
 	}
 
-	var project Project
-	dynamodbattribute.UnmarshalMap(projResult.Item, &project)
-
 	// Find the zip file in the project's zip files list
 	var targetZip *ZipFile
 	for _, zf := range project.ZipFiles {
@@ -2887,13 +2643,7 @@ func handleGetZipDownload(projectID string, zipKey string, headers map[string]st
 
 	// Generate presigned URL for download
 	filename := targetZip.Key[strings.LastIndex(targetZip.Key, "/")+1:]
-	req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
-		Bucket:                     aws.String(bucketName),
-		Key:                        aws.String(targetZip.Key),
-		ResponseContentDisposition: aws.String(fmt.Sprintf("attachment; filename=\"%s\"", filename)),
-	})
-
-	url, err := req.Presign(60 * time.Minute) // 1 hour for large downloads
+	url, err := objectStore.PresignGet(targetZip.Key, filename, 60*time.Minute) // 1 hour for large downloads
 	if err != nil {
 		return errorResponse(500, "Failed to generate download URL", headers)
 	}
@@ -2910,21 +2660,12 @@ func handleGetZipDownload(projectID string, zipKey string, headers map[string]st
 	}, nil
 }
 
-func handleGetZipLogs(projectID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
-	// Get project to verify it exists
-	projResult, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(projectsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ProjectID": {S: aws.String(projectID)},
-		},
-	})
-	if err != nil || projResult.Item == nil {
-		return errorResponse(404, "Project not found", headers)
+func handleGetZipLogs(caller *Caller, projectID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	project, err := getProjectFor(caller, projectID, projectViewer)
+	if err != nil {
+		return projectAccessError(err, headers)
 	}
 
-	var project Project
-	dynamodbattribute.UnmarshalMap(projResult.Item, &project)
-
 	// Check if there's a generating zip
 	var generatingZip *ZipFile
 	for i, zf := range project.ZipFiles {
@@ -2982,8 +2723,10 @@ func handleGetZipLogs(projectID string, headers map[string]string) (events.APIGa
 	}
 
 	var errorMessages []string
-	filterResult, err := cwLogsClient.FilterLogEvents(filterInput)
-	if err != nil {
+	if localMode {
+		// No CloudWatch in self-hosted mode; zip errors go to the server log
+		errorMessages = append(errorMessages, "Zip generation timed out. Check the server log for errors.")
+	} else if filterResult, err := cwLogsClient.FilterLogEvents(filterInput); err != nil {
 		fmt.Printf("Failed to query CloudWatch logs: %v\n", err)
 		// Still mark as failed even if we can't get logs
 		errorMessages = append(errorMessages, "Zip generation timed out. Unable to retrieve error logs.")
@@ -3009,13 +2752,9 @@ func handleGetZipLogs(projectID string, headers map[string]string) (events.APIGa
 	}
 
 	zipFilesList, _ := dynamodbattribute.MarshalList(updatedZipFiles)
-	ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-		TableName: aws.String(projectsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ProjectID": {S: aws.String(projectID)},
-		},
-		UpdateExpression: aws.String("SET ZipFiles = :zips"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+	projectStore.UpdateProject(projectID, ItemUpdate{
+		Expression: "SET ZipFiles = :zips",
+		Values: map[string]*dynamodb.AttributeValue{
 			":zips": {L: zipFilesList},
 		},
 	})
@@ -3032,21 +2771,12 @@ func handleGetZipLogs(projectID string, headers map[string]string) (events.APIGa
 	}, nil
 }
 
-func handleDeleteZip(projectID string, zipKey string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
-	// Get project to verify it exists and find the zip
-	projResult, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(projectsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ProjectID": {S: aws.String(projectID)},
-		},
-	})
-	if err != nil || projResult.Item == nil {
-		return errorResponse(404, "Project not found", headers)
+func handleDeleteZip(caller *Caller, projectID string, zipKey string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	project, err := getProjectFor(caller, projectID, projectEditor)
+	if err != nil {
+		return projectAccessError(err, headers)
 	}
 
-	var project Project
-	dynamodbattribute.UnmarshalMap(projResult.Item, &project)
-
 	// Find and remove the zip from the list
 	var updatedZipFiles []ZipFile
 	var foundZip *ZipFile
@@ -3063,10 +2793,7 @@ func handleDeleteZip(projectID string, zipKey string, headers map[string]string)
 	}
 
 	// Delete the file from S3
-	_, err = s3Client.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(zipKey),
-	})
+	err = objectStore.Delete(zipKey)
 	if err != nil {
 		fmt.Printf("Warning: Failed to delete zip from S3: %v\n", err)
 		// Continue anyway to remove from database
@@ -3075,30 +2802,23 @@ func handleDeleteZip(projectID string, zipKey string, headers map[string]string)
 	// Update project record to remove the zip from the list
 	if len(updatedZipFiles) > 0 {
 		zipFilesList, _ := dynamodbattribute.MarshalList(updatedZipFiles)
-		_, err = ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-			TableName: aws.String(projectsTable),
-			Key: map[string]*dynamodb.AttributeValue{
-				"ProjectID": {S: aws.String(projectID)},
-			},
-			UpdateExpression: aws.String("SET ZipFiles = :zips"),
-			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+		_, err = projectStore.UpdateProject(projectID, ItemUpdate{
+			Expression: "SET ZipFiles = :zips",
+			Values: map[string]*dynamodb.AttributeValue{
 				":zips": {L: zipFilesList},
 			},
 		})
 	} else {
 		// Remove ZipFiles attribute entirely if no zips left
-		_, err = ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-			TableName: aws.String(projectsTable),
-			Key: map[string]*dynamodb.AttributeValue{
-				"ProjectID": {S: aws.String(projectID)},
-			},
-			UpdateExpression: aws.String("REMOVE ZipFiles"),
+		_, err = projectStore.UpdateProject(projectID, ItemUpdate{
+			Expression: "REMOVE ZipFiles",
 		})
 	}
 
 	if err != nil {
 		return errorResponse(500, "Failed to update project", headers)
 	}
+	recordAudit(caller, AuditEvent{Action: auditZipDelete, ProjectID: projectID, Before: map[string]interface{}{"zipKeys": []string{zipKey}}})
 
 	body, _ := json.Marshal(map[string]interface{}{
 		"success": true,
@@ -3111,44 +2831,33 @@ func handleDeleteZip(projectID string, zipKey string, headers map[string]string)
 	}, nil
 }
 
-func handleDeleteAllZips(projectID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
-	// Get project to find all zips
-	projResult, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(projectsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ProjectID": {S: aws.String(projectID)},
-		},
-	})
-	if err != nil || projResult.Item == nil {
-		return errorResponse(404, "Project not found", headers)
+func handleDeleteAllZips(caller *Caller, projectID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	project, err := getProjectFor(caller, projectID, projectEditor)
+	if err != nil {
+		return projectAccessError(err, headers)
 	}
 
-	var project Project
-	dynamodbattribute.UnmarshalMap(projResult.Item, &project)
-
 	// Delete all zip files from S3
 	for _, zf := range project.ZipFiles {
-		_, err = s3Client.DeleteObject(&s3.DeleteObjectInput{
-			Bucket: aws.String(bucketName),
-			Key:    aws.String(zf.Key),
-		})
+		err = objectStore.Delete(zf.Key)
 		if err != nil {
 			fmt.Printf("Warning: Failed to delete zip %s from S3: %v\n", zf.Key, err)
 		}
 	}
 
 	// Remove ZipFiles attribute from project
-	_, err = ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-		TableName: aws.String(projectsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ProjectID": {S: aws.String(projectID)},
-		},
-		UpdateExpression: aws.String("REMOVE ZipFiles"),
+	_, err = projectStore.UpdateProject(projectID, ItemUpdate{
+		Expression: "REMOVE ZipFiles",
 	})
 
 	if err != nil {
 		return errorResponse(500, "Failed to update project", headers)
 	}
+	zipKeys := make([]string, 0, len(project.ZipFiles))
+	for _, zf := range project.ZipFiles {
+		zipKeys = append(zipKeys, zf.Key)
+	}
+	recordAudit(caller, AuditEvent{Action: auditZipDelete, ProjectID: projectID, Before: map[string]interface{}{"zipKeys": zipKeys}})
 
 	body, _ := json.Marshal(map[string]interface{}{
 		"success": true,
@@ -3161,27 +2870,15 @@ func handleDeleteAllZips(projectID string, headers map[string]string) (events.AP
 	}, nil
 }
 
-func handleDeleteProject(projectID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
-	// Get project to find all associated data
-	projResult, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(projectsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ProjectID": {S: aws.String(projectID)},
-		},
-	})
-	if err != nil || projResult.Item == nil {
-		return errorResponse(404, "Project not found", headers)
+func handleDeleteProject(caller *Caller, projectID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	project, err := getProjectFor(caller, projectID, projectOwner)
+	if err != nil {
+		return projectAccessError(err, headers)
 	}
 
-	var project Project
-	dynamodbattribute.UnmarshalMap(projResult.Item, &project)
-
 	// Delete all zip files from S3
 	for _, zf := range project.ZipFiles {
-		_, err = s3Client.DeleteObject(&s3.DeleteObjectInput{
-			Bucket: aws.String(bucketName),
-			Key:    aws.String(zf.Key),
-		})
+		err = objectStore.Delete(zf.Key)
 		if err != nil {
 			fmt.Printf("Warning: Failed to delete zip %s from S3: %v\n", zf.Key, err)
 		}
@@ -3189,28 +2886,23 @@ func handleDeleteProject(projectID string, headers map[string]string) (events.AP
 
 	// Update all images in this project to remove project association
 	// Query images with this projectId
-	queryInput := &dynamodb.QueryInput{
-		TableName:              aws.String(imageTable),
-		IndexName:              aws.String("ProjectIndex"),
-		KeyConditionExpression: aws.String("ProjectID = :pid"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+	queryInput := ItemQuery{
+		Index:        "ProjectIndex",
+		KeyCondition: "ProjectID = :pid",
+		Values: map[string]*dynamodb.AttributeValue{
 			":pid": {S: aws.String(projectID)},
 		},
 	}
 
-	queryResult, err := ddbClient.Query(queryInput)
+	queryResult, err := imageStore.QueryImages(queryInput)
 	if err == nil {
 		for _, item := range queryResult.Items {
 			imageGUID := item["ImageGUID"].S
 			if imageGUID != nil {
 				// Remove project association from image
-				_, err = ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-					TableName: aws.String(imageTable),
-					Key: map[string]*dynamodb.AttributeValue{
-						"ImageGUID": {S: imageGUID},
-					},
-					UpdateExpression: aws.String("REMOVE ProjectID"),
-				})
+				_, err = imageStore.UpdateImage(*imageGUID, bumpVersion(ItemUpdate{
+					Expression: "REMOVE ProjectID",
+				}))
 				if err != nil {
 					fmt.Printf("Warning: Failed to update image %s: %v\n", *imageGUID, err)
 				}
@@ -3219,16 +2911,15 @@ func handleDeleteProject(projectID string, headers map[string]string) (events.AP
 	}
 
 	// Delete the project record
-	_, err = ddbClient.DeleteItem(&dynamodb.DeleteItemInput{
-		TableName: aws.String(projectsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ProjectID": {S: aws.String(projectID)},
-		},
-	})
-
+	err = projectStore.DeleteProject(projectID)
 	if err != nil {
 		return errorResponse(500, "Failed to delete project", headers)
 	}
+	indexProjectForSearch(projectID)
+	deleted := projectAuditFields(project)
+	deleted["imageCount"] = project.ImageCount
+	deleted["members"] = project.Members
+	recordAudit(caller, AuditEvent{Action: auditProjectDelete, ProjectID: projectID, Before: deleted})
 
 	body, _ := json.Marshal(map[string]interface{}{
 		"success": true,
@@ -3252,31 +2943,44 @@ func extractToken(headers map[string]string) string {
 	return ""
 }
 
-func validateToken(tokenString string) bool {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-
-	return err == nil && token.Valid
+// Caller is the account a request is authenticated as.
+type Caller struct {
+	Username string
+	Role     string
+	APIToken bool // API token callers are limited to Scopes
+	Scopes   []string
+	// The login session, for its undo stack. Empty for API tokens.
+	SessionID string
+	// Where the request came from, for the audit log
+	RequestID string
+	SourceIP  string
 }
 
-// getUsernameFromToken extracts the username claim from a validated JWT.
-func getUsernameFromToken(tokenString string) (string, bool) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-	if err != nil || !token.Valid {
-		return "", false
+// authenticate resolves a login access token or an API token to its caller.
+// Revoked sessions and revoked, expired or disabled-owner API tokens fail.
+func authenticate(tokenString string) (*Caller, bool) {
+	if isAPIToken(tokenString) {
+		return authenticateAPIToken(tokenString)
 	}
-	claims, ok := token.Claims.(jwt.MapClaims)
+	claims, ok := parseToken(tokenString, tokenTypeAccess)
 	if !ok {
-		return "", false
+		return nil, false
+	}
+	user, ok := sessionUser(claims)
+	if !ok {
+		return nil, false
 	}
-	username, ok := claims["username"].(string)
-	if !ok || username == "" {
+	sid, _ := claims["sid"].(string)
+	return &Caller{Username: user.Username, Role: user.Role, SessionID: sid}, true
+}
+
+// getUsernameFromToken returns the username of a valid access or API token.
+func getUsernameFromToken(tokenString string) (string, bool) {
+	caller, ok := authenticate(tokenString)
+	if !ok {
 		return "", false
 	}
-	return username, true
+	return caller.Username, true
 }
 
 // UserSettings holds per-user UI preferences stored on the Users table row.
@@ -3303,25 +3007,20 @@ func handleGetUserSettings(token string, headers map[string]string) (events.APIG
 		return errorResponse(401, "Invalid token", headers)
 	}
 
-	result, err := ddbClient.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(usersTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"Username": {S: aws.String(username)},
-		},
-	})
+	userItem, err := userStore.GetUser(username)
 	if err != nil {
 		fmt.Printf("Failed to get user settings for %s: %v\n", username, err)
 		return errorResponse(500, "Failed to get user settings", headers)
 	}
-	if result.Item == nil {
+	if userItem == nil {
 		return errorResponse(404, "User not found", headers)
 	}
 
 	var settings UserSettings
-	if attr := result.Item["ThemeColor"]; attr != nil && attr.S != nil {
+	if attr := userItem["ThemeColor"]; attr != nil && attr.S != nil {
 		settings.ThemeColor = *attr.S
 	}
-	if attr := result.Item["ThemeStyle"]; attr != nil && attr.S != nil {
+	if attr := userItem["ThemeStyle"]; attr != nil && attr.S != nil {
 		settings.ThemeStyle = *attr.S
 	}
 
@@ -3347,18 +3046,14 @@ func handlePutUserSettings(token string, request events.APIGatewayProxyRequest,
 		return errorResponse(400, "Invalid theme settings", headers)
 	}
 
-	_, err := ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
-		TableName: aws.String(usersTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"Username": {S: aws.String(username)},
-		},
-		UpdateExpression: aws.String("SET ThemeColor = :color, ThemeStyle = :style"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+	_, err := userStore.UpdateUser(username, ItemUpdate{
+		Expression: "SET ThemeColor = :color, ThemeStyle = :style",
+		Values: map[string]*dynamodb.AttributeValue{
 			":color": {S: aws.String(settings.ThemeColor)},
 			":style": {S: aws.String(settings.ThemeStyle)},
 		},
 		// Never upsert a user row that doesn't exist (e.g. token for a deleted user)
-		ConditionExpression: aws.String("attribute_exists(Username)"),
+		Condition: "attribute_exists(Username)",
 	})
 	if err != nil {
 		if strings.Contains(err.Error(), "ConditionalCheckFailed") {
@@ -3378,93 +3073,42 @@ func handlePutUserSettings(token string, request events.APIGatewayProxyRequest,
 
 // StatsResponse represents the system health stats
 type StatsResponse struct {
-	IncomingCount   int    `json:"incomingCount"`
-	ProcessedCount  int    `json:"processedCount"`
-	UnreviewedCount int    `json:"unreviewedCount"`
-	ReviewedCount   int    `json:"reviewedCount"`
-	ApprovedCount   int    `json:"approvedCount"`
-	RejectedCount   int    `json:"rejectedCount"`
-	DeletedCount    int    `json:"deletedCount"`
-	SQSQueueDepth   int    `json:"sqsQueueDepth"`
-	SQSDLQDepth     int    `json:"sqsDlqDepth"`
-	LastUpdated     string `json:"lastUpdated"`
-}
-
-func handleGetStats(headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	IncomingCount   int           `json:"incomingCount"`
+	ProcessedCount  int           `json:"processedCount"`
+	UnreviewedCount int           `json:"unreviewedCount"`
+	ReviewedCount   int           `json:"reviewedCount"`
+	ApprovedCount   int           `json:"approvedCount"`
+	RejectedCount   int           `json:"rejectedCount"`
+	DeletedCount    int           `json:"deletedCount"`
+	ProjectCount    int           `json:"projectCount"` // Images in projects
+	Groups          []GroupStat   `json:"groups"`
+	Projects        []ProjectStat `json:"projects"`
+	Ingest          []IngestStat  `json:"ingest"` // Images added per day, most recent last
+	SQSQueueDepth   int           `json:"sqsQueueDepth"`
+	SQSDLQDepth     int           `json:"sqsDlqDepth"`
+	ReconciledAt    string        `json:"reconciledAt,omitempty"`
+	LastUpdated     string        `json:"lastUpdated"`
+}
+
+func handleGetStats(caller *Caller, params map[string]string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
 	stats := StatsResponse{
 		LastUpdated: time.Now().UTC().Format(time.RFC3339),
 	}
 
-	// Count incoming items in S3 (objects in incoming/ prefix)
-	listInput := &s3.ListObjectsV2Input{
-		Bucket: aws.String(bucketName),
-		Prefix: aws.String("incoming/"),
-	}
-
-	incomingCount := 0
-	err := s3Client.ListObjectsV2Pages(listInput, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
-		incomingCount += len(page.Contents)
-		return true
-	})
-	if err != nil {
-		fmt.Printf("Error listing incoming objects: %v\n", err)
-	}
-	stats.IncomingCount = incomingCount
-
-	// Count images by status from DynamoDB
-	// Scan the table and count by status
-	scanInput := &dynamodb.ScanInput{
-		TableName: aws.String(imageTable),
-		ProjectionExpression: aws.String("#s, #r"),
-		ExpressionAttributeNames: map[string]*string{
-			"#s": aws.String("Status"),
-			"#r": aws.String("Reviewed"),
-		},
-	}
-
-	var unreviewedCount, approvedCount, rejectedCount, deletedCount int
-
-	err = ddbClient.ScanPages(scanInput, func(page *dynamodb.ScanOutput, lastPage bool) bool {
-		for _, item := range page.Items {
-			status := ""
-			reviewed := ""
-			if item["Status"] != nil && item["Status"].S != nil {
-				status = *item["Status"].S
-			}
-			if item["Reviewed"] != nil && item["Reviewed"].S != nil {
-				reviewed = *item["Reviewed"].S
-			}
-
-			switch status {
-			case "deleted":
-				deletedCount++
-			case "approved":
-				approvedCount++
-			case "rejected":
-				rejectedCount++
-			default:
-				// Check if reviewed
-				if reviewed == "no" || reviewed == "" {
-					unreviewedCount++
-				} else if status == "inbox" || status == "" {
-					// Reviewed but still in inbox - could be approved or rejected based on groupNumber
-					// For simplicity, count as reviewed
-					approvedCount++
-				}
-			}
+	days := defaultStatsDays
+	if params["days"] != "" {
+		n, err := strconv.Atoi(params["days"])
+		if err != nil || n < 1 || n > maxStatsDays {
+			return errorResponse(400, fmt.Sprintf("days must be between 1 and %d", maxStatsDays), headers)
 		}
-		return true
-	})
-	if err != nil {
-		fmt.Printf("Error scanning DynamoDB: %v\n", err)
+		days = n
 	}
 
-	stats.UnreviewedCount = unreviewedCount
-	stats.ApprovedCount = approvedCount
-	stats.RejectedCount = rejectedCount
-	stats.DeletedCount = deletedCount
-	stats.ProcessedCount = unreviewedCount + approvedCount + rejectedCount + deletedCount
-	stats.ReviewedCount = approvedCount + rejectedCount + deletedCount
+	// Image counts are kept up to date in the stats table
+	if err := loadLibraryStats(caller, days, &stats); err != nil {
+		fmt.Printf("Error loading stats: %v\n", err)
+		return errorResponse(500, "Failed to load stats", headers)
+	}
 
 	// Get SQS queue depth
 	if sqsQueueURL != "" {
@@ -3540,6 +3184,10 @@ type LogsResponse struct {
 }
 
 func handleGetLogs(params map[string]string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	if localMode {
+		return errorResponse(501, "Logs are not available in self-hosted mode; see the server output", headers)
+	}
+
 	// Validate required function parameter
 	functionName := params["function"]
 	if functionName == "" {
@@ -3633,5 +3281,12 @@ func handleGetLogs(params map[string]string, headers map[string]string) (events.
 }
 
 func main() {
-	lambda.Start(handler)
+	if serverAddr != "" {
+		if err := runServer(serverAddr); err != nil {
+			fmt.Printf("Server error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	lambda.Start(handleEvent)
 }
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testUser     = "admin"
+	testPassword = "correct horse"
+	testFunction = "kill-snap-api"
+	testZipFn    = "kill-snap-zip"
+	testTakenAt  = "2024:05:06 10:00:00"
+	testDatePath = "2024/05/06"
+)
+
+type invocation struct {
+	name    string
+	payload []byte
+}
+
+// testEnv swaps the stores and async invocation for in-memory versions and
+// restores the originals when the test ends.
+type testEnv struct {
+	t        *testing.T
+	token    string
+	invoked  []invocation
+	queued   []ProjectImageMessage // on the project image queue
+	requests int                   // numbers the request IDs
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	env := &testEnv{t: t}
+
+	savedImages, savedProjects, savedUsers, savedObjects := imageStore, projectStore, userStore, objectStore
+	savedCounters, savedAudit, savedSearch, savedStats, savedChanges, savedJobs := counterStore, auditStore, searchStore, statsStore, changeStore, jobStore
+	savedInvoke, savedFunction, savedZip, savedOpenAI := invokeAsync, functionName, zipLambdaName, openaiAPIKey
+	savedEnqueue := enqueueProjectImages
+	t.Cleanup(func() {
+		imageStore, projectStore, userStore, objectStore = savedImages, savedProjects, savedUsers, savedObjects
+		counterStore, auditStore, searchStore, statsStore, changeStore, jobStore = savedCounters, savedAudit, savedSearch, savedStats, savedChanges, savedJobs
+		invokeAsync, functionName, zipLambdaName, openaiAPIKey = savedInvoke, savedFunction, savedZip, savedOpenAI
+		enqueueProjectImages = savedEnqueue
+	})
+
+	projects := newMemProjectStore()
+	projects.projects.watch = projectChanged
+	projectStore = projects
+	images := newMemImageStore(projects)
+	images.images.watch = imageChanged
+	imageStore = images
+	userStore = newMemUserStore()
+	counterStore = newMemCounterStore()
+	auditStore = newMemAuditStore()
+	searchStore = newMemSearchStore()
+	statsStore = newMemStatsStore()
+	changeStore = newMemChangeStore()
+	jobStore = newMemJobStore()
+	objectStore = newMemObjectStore()
+	functionName = testFunction
+	zipLambdaName = testZipFn
+	openaiAPIKey = ""
+	invokeAsync = func(name string, payload []byte) error {
+		env.invoked = append(env.invoked, invocation{name, payload})
+		return nil
+	}
+	enqueueProjectImages = func(msgs []ProjectImageMessage) map[string]error {
+		env.queued = append(env.queued, msgs...)
+		return nil
+	}
+
+	env.seedUser(testUser, roleAdmin)
+	return env
+}
+
+// seedUser stores a user with testPassword.
+func (env *testEnv) seedUser(username, role string) {
+	env.t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	if err := userStore.PutUser(map[string]*dynamodb.AttributeValue{
+		"Username":     {S: aws.String(username)},
+		"PasswordHash": {S: aws.String(string(hash))},
+		"Role":         {S: aws.String(role)},
+	}); err != nil {
+		env.t.Fatal(err)
+	}
+}
+
+// call sends a request through handler, authenticated once login has run.
+// A query string in path becomes the request's query parameters.
+func (env *testEnv) call(method, path, body string) events.APIGatewayProxyResponse {
+	env.t.Helper()
+	return env.callWithHeaders(method, path, body, nil)
+}
+
+// callWithHeaders is call with extra request headers.
+func (env *testEnv) callWithHeaders(method, path, body string, headers map[string]string) events.APIGatewayProxyResponse {
+	env.t.Helper()
+	req := events.APIGatewayProxyRequest{HTTPMethod: method, Path: path, Body: body, Headers: map[string]string{}}
+	for k, v := range headers {
+		req.Headers[k] = v
+	}
+	env.requests++
+	req.RequestContext.RequestID = fmt.Sprintf("req-%d", env.requests)
+	if p, query, ok := strings.Cut(path, "?"); ok {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			env.t.Fatal(err)
+		}
+		req.Path = p
+		req.QueryStringParameters = map[string]string{}
+		for k := range values {
+			req.QueryStringParameters[k] = values.Get(k)
+		}
+	}
+	if env.token != "" {
+		req.Headers["Authorization"] = "Bearer " + env.token
+	}
+	resp, err := handler(context.Background(), req)
+	if err != nil {
+		env.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp
+}
+
+func (env *testEnv) login() {
+	env.t.Helper()
+	env.loginAs(testUser, testPassword)
+}
+
+// loginAs logs in, makes later calls use the access token and returns the
+// full login response.
+func (env *testEnv) loginAs(username, password string) LoginResponse {
+	env.t.Helper()
+	env.token = ""
+	resp := env.call("POST", "/api/login", fmt.Sprintf(`{"username":%q,"password":%q}`, username, password))
+	if resp.StatusCode != 200 {
+		env.t.Fatalf("login: status %d: %s", resp.StatusCode, resp.Body)
+	}
+	var lr LoginResponse
+	if err := json.Unmarshal([]byte(resp.Body), &lr); err != nil {
+		env.t.Fatal(err)
+	}
+	env.token = lr.Token
+	return lr
+}
+
+// runAsyncMoves replays queued async moves through handler the way Lambda
+// delivers them, and returns how many ran.
+func (env *testEnv) runAsyncMoves() int {
+	env.t.Helper()
+	var rest []invocation
+	var moves []invocation
+	for _, inv := range env.invoked {
+		if inv.name == testFunction {
+			moves = append(moves, inv)
+		} else {
+			rest = append(rest, inv)
+		}
+	}
+	env.invoked = rest
+	for _, inv := range moves {
+		var req events.APIGatewayProxyRequest
+		if err := json.Unmarshal(inv.payload, &req); err != nil {
+			env.t.Fatal(err)
+		}
+		resp, err := handler(context.Background(), req)
+		if err != nil || !strings.Contains(resp.Body, `"success": true`) {
+			env.t.Fatalf("async move: %v %s", err, resp.Body)
+		}
+	}
+	return len(moves)
+}
+
+// seedImage stores an unreviewed inbox image with its files, including a RAW.
+func (env *testEnv) seedImage(id string, fields map[string]interface{}) {
+	env.t.Helper()
+	img := map[string]interface{}{
+		"ImageGUID":        id,
+		"OriginalFile":     "images/" + id + ".jpg",
+		"OriginalFilename": "IMG_" + id,
+		"Thumbnail50":      "images/" + id + ".50.jpg",
+		"Thumbnail400":     "images/" + id + ".400.jpg",
+		"EXIFData":         map[string]string{"DateTimeOriginal": testTakenAt},
+		"Reviewed":         "false",
+		"Status":           "inbox",
+		"InsertedDateTime": "2024-06-01T00:00:00Z",
+	}
+	for k, v := range fields {
+		img[k] = v
+	}
+	// Set at ingest or by the backfill
+	if _, ok := img["CaptureDate"]; !ok {
+		exifData, _ := img["EXIFData"].(map[string]string)
+		inserted, _ := img["InsertedDateTime"].(string)
+		if t, ok := captureTime(exifData, inserted); ok {
+			img["CaptureDate"], img["CaptureYear"] = captureDateFields(t)
+		}
+	}
+	item, err := dynamodbattribute.MarshalMap(img)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	if err := imageStore.PutImage(item); err != nil {
+		env.t.Fatal(err)
+	}
+	for _, key := range []string{".jpg", ".50.jpg", ".400.jpg", ".cr2"} {
+		if err := objectStore.Put("images/"+id+key, strings.NewReader(id), "image/jpeg"); err != nil {
+			env.t.Fatal(err)
+		}
+	}
+}
+
+func (env *testEnv) seedProject(id string, imageCount int) {
+	env.t.Helper()
+	item, _ := dynamodbattribute.MarshalMap(Project{ProjectID: id, Name: id, S3Prefix: id, ImageCount: imageCount})
+	if err := projectStore.PutProject(item); err != nil {
+		env.t.Fatal(err)
+	}
+}
+
+func (env *testEnv) image(id string) ImageResponse {
+	env.t.Helper()
+	item, err := imageStore.GetImage(id)
+	if err != nil || item == nil {
+		env.t.Fatalf("image %s: %v", id, err)
+	}
+	var img ImageResponse
+	dynamodbattribute.UnmarshalMap(item, &img)
+	return img
+}
+
+func (env *testEnv) project(id string) Project {
+	env.t.Helper()
+	item, err := projectStore.GetProject(id)
+	if err != nil || item == nil {
+		env.t.Fatalf("project %s: %v", id, err)
+	}
+	var p Project
+	dynamodbattribute.UnmarshalMap(item, &p)
+	return p
+}
+
+// assertFilesUnder checks every file of the image, RAW included, lives under prefix.
+func (env *testEnv) assertFilesUnder(id, prefix string) {
+	env.t.Helper()
+	for _, suffix := range []string{".jpg", ".50.jpg", ".400.jpg", ".cr2"} {
+		key := prefix + "/" + id + suffix
+		if !objectStore.Exists(key) {
+			env.t.Errorf("missing %s", key)
+		}
+		if objectStore.Exists("images/" + id + suffix) {
+			env.t.Errorf("images/%s%s was not moved", id, suffix)
+		}
+	}
+	if img := env.image(id); img.OriginalFile != prefix+"/"+id+".jpg" {
+		env.t.Errorf("OriginalFile = %s, want under %s", img.OriginalFile, prefix)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"valid credentials", fmt.Sprintf(`{"username":%q,"password":%q}`, testUser, testPassword), 200},
+		{"wrong password", fmt.Sprintf(`{"username":%q,"password":"nope"}`, testUser), 401},
+		{"unknown user", `{"username":"ghost","password":"x"}`, 401},
+		{"malformed body", `{`, 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			resp := env.call("POST", "/api/login", tt.body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+			if tt.wantStatus != 200 {
+				return
+			}
+			var lr LoginResponse
+			json.Unmarshal([]byte(resp.Body), &lr)
+			env.token = lr.Token
+			if resp := env.call("GET", "/api/projects", ""); resp.StatusCode != 200 {
+				t.Errorf("token rejected: %d %s", resp.StatusCode, resp.Body)
+			}
+		})
+	}
+
+	t.Run("missing token", func(t *testing.T) {
+		env := newTestEnv(t)
+		if resp := env.call("GET", "/api/projects", ""); resp.StatusCode != 401 {
+			t.Errorf("status = %d, want 401", resp.StatusCode)
+		}
+	})
+}
+
+func TestReviewMovesFiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		reviewed   string // Reviewed on the stored image
+		body       string
+		wantStatus string
+		wantPrefix string // empty when no move should happen
+	}{
+		{"approve into group", "false", `{"groupNumber":2,"reviewed":"true"}`, "approved", "approved/yellow/" + testDatePath},
+		{"reject", "false", `{"groupNumber":0,"reviewed":"true"}`, "rejected", "rejected/" + testDatePath},
+		{"regroup after review", "true", `{"groupNumber":3,"reviewed":"true"}`, "inbox", ""},
+		{"rate only", "false", `{"groupNumber":0,"rating":4}`, "inbox", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.login()
+			env.seedImage("img1", map[string]interface{}{"Reviewed": tt.reviewed})
+
+			resp := env.call("PUT", "/api/images/img1", tt.body)
+			if resp.StatusCode != 200 {
+				t.Fatalf("update: %d %s", resp.StatusCode, resp.Body)
+			}
+			moves := env.runAsyncMoves()
+			if tt.wantPrefix == "" {
+				if moves != 0 {
+					t.Errorf("%d moves queued, want none", moves)
+				}
+			} else {
+				if moves != 1 {
+					t.Fatalf("%d moves queued, want 1", moves)
+				}
+				env.assertFilesUnder("img1", tt.wantPrefix)
+				if img := env.image("img1"); img.MoveStatus != "complete" {
+					t.Errorf("MoveStatus = %q, want complete", img.MoveStatus)
+				}
+			}
+			if img := env.image("img1"); img.Status != tt.wantStatus {
+				t.Errorf("Status = %q, want %q", img.Status, tt.wantStatus)
+			}
+		})
+	}
+
+	t.Run("unknown image", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.login()
+		if resp := env.call("PUT", "/api/images/nope", `{"groupNumber":1,"reviewed":"true"}`); resp.StatusCode != 404 {
+			t.Errorf("status = %d, want 404", resp.StatusCode)
+		}
+	})
+}
+
+func TestAddToProject(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantCode  int
+		wantMoved []string
+	}{
+		{"single image", `{"imageGUID":"a"}`, 200, []string{"a"}},
+		{"group", `{"group":1}`, 202, []string{"a", "c"}},
+		{"all approved and reviewed", `{"all":true}`, 202, []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.login()
+			env.seedProject("trip", 0)
+			env.seedImage("a", map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 1})
+			env.seedImage("b", map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 2})
+			// Reviewed but its async move has not run yet
+			env.seedImage("c", map[string]interface{}{"Reviewed": "true", "GroupNumber": 1})
+			env.seedImage("d", nil)
+
+			resp := env.call("POST", "/api/projects/trip/images", tt.body)
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("add: %d %s", resp.StatusCode, resp.Body)
+			}
+			if resp.StatusCode == 202 {
+				// Queued for the workers
+				var job Job
+				json.Unmarshal([]byte(resp.Body), &job)
+				env.runAsyncMoves()
+				env.deliverProjectImages()
+				if job = env.job(job.JobID); job.Status != jobSucceeded || job.Total != len(tt.wantMoved) || job.Done != len(tt.wantMoved) {
+					t.Errorf("job = %+v, want %d of %d done", job, len(tt.wantMoved), len(tt.wantMoved))
+				}
+			} else {
+				var result map[string]int
+				json.Unmarshal([]byte(resp.Body), &result)
+				if result["movedCount"] != len(tt.wantMoved) {
+					t.Errorf("movedCount = %d, want %d", result["movedCount"], len(tt.wantMoved))
+				}
+			}
+			if got := env.project("trip").ImageCount; got != len(tt.wantMoved) {
+				t.Errorf("ImageCount = %d, want %d", got, len(tt.wantMoved))
+			}
+			for _, id := range tt.wantMoved {
+				img := env.image(id)
+				if img.Status != "project" || img.ProjectID != "trip" {
+					t.Errorf("%s: Status=%q ProjectID=%q", id, img.Status, img.ProjectID)
+				}
+				env.assertFilesUnder(id, "projects/trip/"+testDatePath)
+			}
+			if img := env.image("d"); img.Status != "inbox" {
+				t.Errorf("unreviewed image was moved: Status=%q", img.Status)
+			}
+		})
+	}
+
+	t.Run("pending async move is skipped", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.login()
+		env.seedProject("trip", 0)
+		env.seedImage("a", nil)
+		env.call("PUT", "/api/images/a", `{"groupNumber":1,"reviewed":"true"}`)
+		env.call("POST", "/api/projects/trip/images", `{"imageGUID":"a"}`)
+		env.runAsyncMoves()
+		if img := env.image("a"); img.Status != "project" {
+			t.Errorf("Status = %q, want project", img.Status)
+		}
+		env.assertFilesUnder("a", "projects/trip/"+testDatePath)
+	})
+}
+
+func TestDeleteUndelete(t *testing.T) {
+	steps := []struct {
+		method, path string
+		wantCode     int
+		wantStatus   string
+		wantPrefix   string
+		wantCount    int
+	}{
+		{"POST", "/api/images/a/undelete", 400, "project", "projects/trip/" + testDatePath, 1},
+		{"DELETE", "/api/images/a", 200, "deleted", "deleted/" + testDatePath, 0},
+		{"DELETE", "/api/images/a", 200, "deleted", "deleted/" + testDatePath, 0},
+		{"POST", "/api/images/a/undelete", 200, "", "inbox/" + testDatePath, 1},
+		{"DELETE", "/api/images/missing", 404, "", "inbox/" + testDatePath, 1},
+	}
+	env := newTestEnv(t)
+	env.login()
+	env.seedProject("trip", 0)
+	env.seedImage("a", map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 1})
+	env.call("POST", "/api/projects/trip/images", `{"imageGUID":"a"}`)
+
+	for i, s := range steps {
+		resp := env.call(s.method, s.path, "")
+		if resp.StatusCode != s.wantCode {
+			t.Fatalf("step %d %s %s: status %d, want %d: %s", i, s.method, s.path, resp.StatusCode, s.wantCode, resp.Body)
+		}
+		img := env.image("a")
+		if img.Status != s.wantStatus {
+			t.Errorf("step %d: Status = %q, want %q", i, img.Status, s.wantStatus)
+		}
+		env.assertFilesUnder("a", s.wantPrefix)
+		if got := env.project("trip").ImageCount; got != s.wantCount {
+			t.Errorf("step %d: ImageCount = %d, want %d", i, got, s.wantCount)
+		}
+	}
+	if img := env.image("a"); img.Reviewed != "false" {
+		t.Errorf("Reviewed = %q after undelete, want false", img.Reviewed)
+	}
+}
+
+func TestGetImage(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedUser("fred", roleViewer)
+	env.seedProject("trip", 0)
+	env.addMember("trip", "fred", projectViewer)
+	env.seedImage("a", map[string]interface{}{
+		"Status": "approved", "Reviewed": "true", "GroupNumber": 1,
+		"Description": "A red kite", "RawFile": "images/a.cr2",
+		"EXIFData": map[string]string{"DateTimeOriginal": testTakenAt, "Make": "Canon", "FNumber": "2.8"},
+	})
+	env.login()
+	env.call("PUT", "/api/images/a", `{"groupNumber":1,"rating":5}`)
+	env.call("POST", "/api/projects/trip/images", `{"imageGUID":"a"}`)
+
+	env.loginAs("fred", testPassword)
+	resp := env.call("GET", "/api/images/a", "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("get image: %d %s", resp.StatusCode, resp.Body)
+	}
+	var detail ImageDetailResponse
+	json.Unmarshal([]byte(resp.Body), &detail)
+	if detail.Description != "A red kite" || detail.EXIFData["FNumber"] != "2.8" || detail.Rating != 5 {
+		t.Errorf("metadata stripped: %+v", detail.ImageResponse)
+	}
+	// The RAW followed the image into the project
+	rawKey := "projects/trip/" + testDatePath + "/a.cr2"
+	if detail.RawFile != rawKey || detail.URLs.Raw == "" || detail.URLs.Original == "" || detail.URLs.Thumbnail400 == "" {
+		t.Errorf("raw %q, urls %+v", detail.RawFile, detail.URLs)
+	}
+	if detail.Project == nil || detail.Project.ProjectID != "trip" || detail.Project.MyRole != projectViewer {
+		t.Errorf("project = %+v", detail.Project)
+	}
+	if got := fmt.Sprint(actions(detail.History.Events)); got != "[project.add_images image.update]" {
+		t.Errorf("history = %s", got)
+	}
+	if detail.History.Events[0].Actor != testUser || detail.History.Events[0].SourceIP != "" {
+		t.Errorf("history event = %+v", detail.History.Events[0])
+	}
+
+	env.seedProject("other", 0)
+	env.seedImage("b", map[string]interface{}{"Status": "project", "ProjectID": "other"})
+	for path, want := range map[string]int{"/api/images/b": 403, "/api/images/missing": 404, "/api/images/a?historyCursor=not-a-cursor": 400} {
+		if resp := env.call("GET", path, ""); resp.StatusCode != want {
+			t.Errorf("GET %s: status = %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestGenerateZip(t *testing.T) {
+	tests := []struct {
+		name       string
+		project    string
+		imageCount int
+		zipLambda  string
+		wantCode   int
+		wantInvoke bool
+	}{
+		{"starts zip lambda", "trip", 3, testZipFn, 200, true},
+		{"empty project", "trip", 0, testZipFn, 400, false},
+		{"unknown project", "nope", 3, testZipFn, 404, false},
+		{"not configured", "trip", 3, "", 500, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.login()
+			env.seedProject("trip", tt.imageCount)
+			zipLambdaName = tt.zipLambda
+
+			resp := env.call("POST", "/api/projects/"+tt.project+"/generate-zip", "")
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantCode, resp.Body)
+			}
+			if !tt.wantInvoke {
+				if len(env.invoked) != 0 {
+					t.Errorf("unexpected invocations: %v", env.invoked)
+				}
+				return
+			}
+			if len(env.invoked) != 1 || env.invoked[0].name != testZipFn {
+				t.Fatalf("invocations = %v, want one of %s", env.invoked, testZipFn)
+			}
+			var payload map[string]string
+			json.Unmarshal(env.invoked[0].payload, &payload)
+			if payload["projectId"] != "trip" {
+				t.Errorf("payload = %s", env.invoked[0].payload)
+			}
+			zips := env.project("trip").ZipFiles
+			if len(zips) != 1 || zips[0].Status != "generating" {
+				t.Errorf("ZipFiles = %+v, want one generating placeholder", zips)
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Project roles, from least to most privileged. Viewers can see a project,
+// its images and its zips, editors can also add images, rename it and
+// generate or delete zips, and owners can also delete it and manage its
+// members. Admins act as owners of every project; everyone else only sees
+// projects they are a member of.
+const (
+	projectViewer = "viewer"
+	projectEditor = "editor"
+	projectOwner  = "owner"
+)
+
+var projectRoleRank = map[string]int{projectViewer: 1, projectEditor: 2, projectOwner: 3}
+
+func isValidProjectRole(role string) bool {
+	_, ok := projectRoleRank[role]
+	return ok
+}
+
+// projectRole returns the caller's role on the project, or "" when they
+// have no access to it.
+func projectRole(caller *Caller, project Project) string {
+	if caller.Role == roleAdmin {
+		return projectOwner
+	}
+	role := project.Members[caller.Username]
+	if !isValidProjectRole(role) {
+		return ""
+	}
+	return role
+}
+
+// projectAllows reports whether the caller's role on the project is at
+// least as privileged as required.
+func projectAllows(caller *Caller, project Project, required string) bool {
+	role := projectRole(caller, project)
+	return role != "" && projectRoleRank[role] >= projectRoleRank[required]
+}
+
+var (
+	errProjectNotFound  = errors.New("project not found")
+	errProjectForbidden = errors.New("project access denied")
+)
+
+// getProjectFor loads a project and checks the caller has at least the
+// required role on it.
+func getProjectFor(caller *Caller, projectID, required string) (Project, error) {
+	var project Project
+	item, err := projectStore.GetProject(projectID)
+	if err != nil {
+		return project, err
+	}
+	if item == nil {
+		return project, errProjectNotFound
+	}
+	dynamodbattribute.UnmarshalMap(item, &project)
+	if !projectAllows(caller, project, required) {
+		return project, errProjectForbidden
+	}
+	project.MyRole = projectRole(caller, project)
+	return project, nil
+}
+
+// checkImageAccess checks the caller may act on an image with the required
+// project role. Images outside projects are governed by the caller's
+// account role alone.
+func checkImageAccess(caller *Caller, img ImageResponse, required string) error {
+	if img.ProjectID == "" {
+		return nil
+	}
+	_, err := getProjectFor(caller, img.ProjectID, required)
+	if err == errProjectNotFound {
+		// The project was deleted out from under the image
+		return nil
+	}
+	return err
+}
+
+// projectFilter returns a check for filtering image lists by project
+// membership. Each project is looked up at most once.
+func projectFilter(caller *Caller) func(projectID string) bool {
+	visible := make(map[string]bool)
+	return func(projectID string) bool {
+		if projectID == "" || caller.Role == roleAdmin {
+			return true
+		}
+		ok, seen := visible[projectID]
+		if !seen {
+			_, err := getProjectFor(caller, projectID, projectViewer)
+			ok = err == nil || err == errProjectNotFound
+			visible[projectID] = ok
+		}
+		return ok
+	}
+}
+
+// projectAccessStatus maps an error from getProjectFor or checkImageAccess
+// to a status code and message.
+func projectAccessStatus(err error) (int, string) {
+	switch err {
+	case errProjectNotFound:
+		return 404, "Project not found"
+	case errProjectForbidden:
+		return 403, "You do not have access to this project"
+	}
+	fmt.Printf("Error loading project: %v\n", err)
+	return 500, "Failed to load project"
+}
+
+// projectAccessError turns an error from getProjectFor or checkImageAccess
+// into a response.
+func projectAccessError(err error, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	status, message := projectAccessStatus(err)
+	return errorResponse(status, message, headers)
+}
+
+// ProjectMember is one entry of a project's member list.
+type ProjectMember struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type SetProjectMemberRequest struct {
+	Role string `json:"role"`
+}
+
+func handleListProjectMembers(caller *Caller, projectID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	project, err := getProjectFor(caller, projectID, projectViewer)
+	if err != nil {
+		return projectAccessError(err, headers)
+	}
+
+	members := make([]ProjectMember, 0, len(project.Members))
+	for username, role := range project.Members {
+		members = append(members, ProjectMember{Username: username, Role: role})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return strings.ToLower(members[i].Username) < strings.ToLower(members[j].Username)
+	})
+
+	body, _ := json.Marshal(members)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// countOwners returns how many members own the project, leaving out username.
+func countOwners(project Project, except string) int {
+	n := 0
+	for username, role := range project.Members {
+		if role == projectOwner && username != except {
+			n++
+		}
+	}
+	return n
+}
+
+// handleSetProjectMember adds a member or changes their role. Only owners
+// can manage members, and the last owner cannot be demoted.
+func handleSetProjectMember(caller *Caller, projectID, username string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	var req SetProjectMemberRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return errorResponse(400, "Invalid request body", headers)
+	}
+	if !isValidProjectRole(req.Role) {
+		return errorResponse(400, "Role must be owner, editor or viewer", headers)
+	}
+
+	project, err := getProjectFor(caller, projectID, projectOwner)
+	if err != nil {
+		return projectAccessError(err, headers)
+	}
+	userItem, err := userStore.GetUser(username)
+	if err != nil {
+		fmt.Printf("Failed to get user %s: %v\n", username, err)
+		return errorResponse(500, "Failed to update project members", headers)
+	}
+	if userItem == nil {
+		return errorResponse(404, "User not found", headers)
+	}
+	if project.Members[username] == projectOwner && req.Role != projectOwner && countOwners(project, username) == 0 {
+		return errorResponse(400, "A project needs at least one owner", headers)
+	}
+
+	// As on removal, the owner check above holds only if the members are
+	// still as read
+	update := ItemUpdate{
+		Expression: "SET Members.#user = :role, UpdatedAt = :updated",
+		Condition:  "attribute_exists(Members)",
+		Names:      map[string]*string{"#user": aws.String(username)},
+		Values: map[string]*dynamodb.AttributeValue{
+			":role":    {S: aws.String(req.Role)},
+			":updated": {S: aws.String(time.Now().Format(time.RFC3339))},
+		},
+	}
+	if project.Members == nil {
+		// Projects created before membership existed have no map to set into
+		update = ItemUpdate{
+			Expression: "SET Members = :members, UpdatedAt = :updated",
+			Condition:  "attribute_exists(ProjectID) AND attribute_not_exists(Members)",
+			Values: map[string]*dynamodb.AttributeValue{
+				":members": {M: map[string]*dynamodb.AttributeValue{username: {S: aws.String(req.Role)}}},
+				":updated": {S: aws.String(time.Now().Format(time.RFC3339))},
+			},
+		}
+	}
+	if _, err := projectStore.UpdateProject(projectID, versioned(update, project.Version)); err != nil {
+		if isConditionFailed(err) {
+			return errorResponse(409, "Project members changed, try again", headers)
+		}
+		fmt.Printf("Error setting member %s on project %s: %v\n", username, projectID, err)
+		return errorResponse(500, "Failed to update project members", headers)
+	}
+	var before map[string]interface{}
+	if previous, ok := project.Members[username]; ok {
+		before = map[string]interface{}{"role": previous}
+	}
+	recordAudit(caller, AuditEvent{Action: auditProjectMemberSet, ProjectID: projectID, Target: "user:" + username,
+		Before: before, After: map[string]interface{}{"role": req.Role}})
+
+	body, _ := json.Marshal(ProjectMember{Username: username, Role: req.Role})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+func handleRemoveProjectMember(caller *Caller, projectID, username string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	project, err := getProjectFor(caller, projectID, projectOwner)
+	if err != nil {
+		return projectAccessError(err, headers)
+	}
+	role, ok := project.Members[username]
+	if !ok {
+		return errorResponse(404, "Not a member of this project", headers)
+	}
+	if role == projectOwner && countOwners(project, username) == 0 {
+		return errorResponse(400, "A project needs at least one owner", headers)
+	}
+
+	// The owner check above holds only if the members are still as read
+	_, err = projectStore.UpdateProject(projectID, versioned(ItemUpdate{
+		Expression: "SET UpdatedAt = :updated REMOVE Members.#user",
+		Names:      map[string]*string{"#user": aws.String(username)},
+		Values: map[string]*dynamodb.AttributeValue{
+			":updated": {S: aws.String(time.Now().Format(time.RFC3339))},
+		},
+	}, project.Version))
+	if err != nil {
+		if isConditionFailed(err) {
+			return errorResponse(409, "Project members changed, try again", headers)
+		}
+		fmt.Printf("Error removing member %s from project %s: %v\n", username, projectID, err)
+		return errorResponse(500, "Failed to update project members", headers)
+	}
+	recordAudit(caller, AuditEvent{Action: auditProjectMemberRemove, ProjectID: projectID, Target: "user:" + username,
+		Before: map[string]interface{}{"role": role}})
+
+	body, _ := json.Marshal(map[string]bool{"success": true})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// addMember gives username a role on the project directly in the store.
+func (env *testEnv) addMember(projectID, username, role string) {
+	env.t.Helper()
+	p := env.project(projectID)
+	members := map[string]*dynamodb.AttributeValue{username: {S: aws.String(role)}}
+	for u, r := range p.Members {
+		members[u] = &dynamodb.AttributeValue{S: aws.String(r)}
+	}
+	if _, err := projectStore.UpdateProject(projectID, ItemUpdate{
+		Expression: "SET Members = :members",
+		Values:     map[string]*dynamodb.AttributeValue{":members": {M: members}},
+	}); err != nil {
+		env.t.Fatal(err)
+	}
+}
+
+// racingProjectWrites is a project store that applies race, once, just
+// before the next update, like a request that lands in between.
+type racingProjectWrites struct {
+	ProjectStore
+	race func()
+}
+
+func (s *racingProjectWrites) UpdateProject(projectID string, u ItemUpdate) (Item, error) {
+	if race := s.race; race != nil {
+		s.race = nil
+		race()
+	}
+	return s.ProjectStore.UpdateProject(projectID, u)
+}
+
+func (env *testEnv) listProjects() []Project {
+	env.t.Helper()
+	resp := env.call("GET", "/api/projects", "")
+	var projects []Project
+	if err := json.Unmarshal([]byte(resp.Body), &projects); err != nil || resp.StatusCode != 200 {
+		env.t.Fatalf("list projects: %d %s", resp.StatusCode, resp.Body)
+	}
+	return projects
+}
+
+func TestProjectMembership(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedUser("fred", roleViewer)
+	env.seedProject("smith-wedding", 1)
+	env.seedProject("jones-wedding", 1)
+	env.seedImage("ours", map[string]interface{}{"Status": "project", "ProjectID": "smith-wedding", "Reviewed": "true"})
+	env.seedImage("theirs", map[string]interface{}{"Status": "project", "ProjectID": "jones-wedding", "Reviewed": "true"})
+	env.login()
+
+	// Projects created before membership existed get their first member
+	resp := env.call("PUT", "/api/projects/smith-wedding/members/fred", `{"role":"viewer"}`)
+	if resp.StatusCode != 200 {
+		t.Fatalf("add member: %d %s", resp.StatusCode, resp.Body)
+	}
+	if resp := env.call("PUT", "/api/projects/smith-wedding/members/ghost", `{"role":"viewer"}`); resp.StatusCode != 404 {
+		t.Errorf("unknown user: status = %d, want 404", resp.StatusCode)
+	}
+	if resp := env.call("PUT", "/api/projects/smith-wedding/members/fred", `{"role":"boss"}`); resp.StatusCode != 400 {
+		t.Errorf("bad role: status = %d, want 400", resp.StatusCode)
+	}
+
+	// The second shooter only sees their own job and its images
+	env.loginAs("fred", testPassword)
+	projects := env.listProjects()
+	if len(projects) != 1 || projects[0].ProjectID != "smith-wedding" || projects[0].MyRole != projectViewer {
+		t.Fatalf("projects = %+v", projects)
+	}
+	resp = env.call("GET", "/api/images?state=all", "")
+	var page PaginatedImageResponse
+	json.Unmarshal([]byte(resp.Body), &page)
+	if len(page.Images) != 1 || page.Images[0].ImageGUID != "ours" {
+		t.Errorf("images = %+v", page.Images)
+	}
+	for _, path := range []string{"/api/projects/jones-wedding/images", "/api/images/theirs/download", "/api/projects/jones-wedding/members"} {
+		if resp := env.call("GET", path, ""); resp.StatusCode != 403 {
+			t.Errorf("GET %s: status = %d, want 403", path, resp.StatusCode)
+		}
+	}
+	if resp := env.call("GET", "/api/images/ours/download", ""); resp.StatusCode != 200 {
+		t.Errorf("download own image: status = %d", resp.StatusCode)
+	}
+	if resp := env.call("PUT", "/api/projects/smith-wedding/members/fred", `{"role":"owner"}`); resp.StatusCode != 403 {
+		t.Errorf("viewer promoting self: status = %d, want 403", resp.StatusCode)
+	}
+
+	// Removing the member takes the project away again
+	env.login()
+	if resp := env.call("DELETE", "/api/projects/smith-wedding/members/fred", ""); resp.StatusCode != 200 {
+		t.Fatalf("remove member: %d %s", resp.StatusCode, resp.Body)
+	}
+	env.loginAs("fred", testPassword)
+	if projects := env.listProjects(); len(projects) != 0 {
+		t.Errorf("after removal: projects = %+v", projects)
+	}
+}
+
+func TestProjectOwners(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedUser("ann", roleReviewer)
+	env.login()
+
+	// The creator owns a new project
+	resp := env.call("POST", "/api/projects", `{"name":"Gala"}`)
+	var p Project
+	json.Unmarshal([]byte(resp.Body), &p)
+	if p.Members[testUser] != projectOwner || p.MyRole != projectOwner {
+		t.Fatalf("created project = %+v", p)
+	}
+	members := fmt.Sprintf("/api/projects/%s/members/", p.ProjectID)
+
+	if resp := env.call("PUT", members+testUser, `{"role":"editor"}`); resp.StatusCode != 400 {
+		t.Errorf("demote last owner: status = %d, want 400", resp.StatusCode)
+	}
+	if resp := env.call("DELETE", members+testUser, ""); resp.StatusCode != 400 {
+		t.Errorf("remove last owner: status = %d, want 400", resp.StatusCode)
+	}
+
+	// A second owner can manage members and hand the project over
+	env.call("PUT", members+"ann", `{"role":"owner"}`)
+	env.loginAs("ann", testPassword)
+	if resp := env.call("DELETE", members+testUser, ""); resp.StatusCode != 200 {
+		t.Fatalf("remove first owner: %d %s", resp.StatusCode, resp.Body)
+	}
+	resp = env.call("GET", fmt.Sprintf("/api/projects/%s/members", p.ProjectID), "")
+	var list []ProjectMember
+	json.Unmarshal([]byte(resp.Body), &list)
+	if len(list) != 1 || list[0] != (ProjectMember{"ann", projectOwner}) {
+		t.Errorf("members = %+v", list)
+	}
+}
+
+func TestProjectOwnersDemotedTogether(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedUser("ann", roleReviewer)
+	env.login()
+	resp := env.call("POST", "/api/projects", `{"name":"Gala"}`)
+	var p Project
+	json.Unmarshal([]byte(resp.Body), &p)
+	members := fmt.Sprintf("/api/projects/%s/members/", p.ProjectID)
+	env.call("PUT", members+"ann", `{"role":"owner"}`)
+
+	// Each owner demotes the other at once: the second to land is refused
+	store := &racingProjectWrites{ProjectStore: projectStore}
+	projectStore = store
+	store.race = func() {
+		env.loginAs("ann", testPassword)
+		if resp := env.call("PUT", members+testUser, `{"role":"editor"}`); resp.StatusCode != 200 {
+			t.Errorf("ann demoting admin: %d %s", resp.StatusCode, resp.Body)
+		}
+		env.login()
+	}
+	if resp := env.call("PUT", members+"ann", `{"role":"editor"}`); resp.StatusCode != 409 {
+		t.Errorf("admin demoting ann: status = %d, want 409", resp.StatusCode)
+	}
+	if got := env.project(p.ProjectID).Members; got["ann"] != projectOwner || got[testUser] != projectEditor {
+		t.Errorf("members = %v, want ann left the owner", got)
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// File moves are journaled on the image. Before touching any file a move
+// writes where each of the image's files goes to its MoveJournal, then copies
+// and deletes them one by one, which can be repeated from the start after an
+// interruption, and the write that records the new paths removes the
+// journal. So an image whose function died mid-move keeps its journal, and
+// MoveState "moving" puts it in MoveStateIndex. The reconcile-moves schedule
+// resumes such moves after review, up to maxMoveAttempts times, and rolls
+// back the others, copying the files back to where the record says they are.
+//
+// A review move that failed for good has MoveState "failed" instead.
+// GET /api/images/failed-moves lists those and the stuck ones, and
+// POST /api/images/{id}/retry-move retries them.
+
+const (
+	moveStateMoving = "moving"
+	moveStateFailed = "failed"
+
+	// A journal not touched for this long belongs to a move that died with
+	// its function (the API function's timeout is well under it)
+	moveStaleAfter = 10 * time.Minute
+	// How often the reconciler resumes a review move before rolling it back
+	maxMoveAttempts = 3
+	// The most moves one reconcile run handles
+	reconcileBatchSize = 25
+)
+
+// errMoveConflict is returned for a move of an image that another move is
+// under way for, or whose files moved since it was read.
+var errMoveConflict = errors.New("image is being moved by another request")
+
+// MoveFile is one file of a move.
+type MoveFile struct {
+	Kind string `json:"kind" dynamodbav:"Kind"` // original, thumbnail50, thumbnail400, raw or related
+	Src  string `json:"src" dynamodbav:"Src"`
+	Dst  string `json:"dst" dynamodbav:"Dst"`
+}
+
+// MoveJournal is an image's move in progress.
+type MoveJournal struct {
+	DestPrefix string `json:"destPrefix" dynamodbav:"DestPrefix"`
+	// NewStatus is set for moves after review, which can be resumed
+	NewStatus string     `json:"newStatus,omitempty" dynamodbav:"NewStatus,omitempty"`
+	Files     []MoveFile `json:"files" dynamodbav:"Files"`
+	StartedAt string     `json:"startedAt" dynamodbav:"StartedAt"`
+	// UpdatedAt changes when a reconcile or retry takes the move over
+	UpdatedAt string `json:"updatedAt" dynamodbav:"UpdatedAt"`
+	Attempts  int    `json:"attempts" dynamodbav:"Attempts"`
+}
+
+// planMove journals the move of img's files to destPrefix.
+func planMove(img ImageResponse, destPrefix, newStatus string) *MoveJournal {
+	now := time.Now().UTC().Format(time.RFC3339)
+	journal := &MoveJournal{DestPrefix: destPrefix, NewStatus: newStatus, StartedAt: now, UpdatedAt: now}
+	seen := make(map[string]bool)
+	add := func(kind, src string) {
+		if src == "" || seen[src] {
+			return
+		}
+		seen[src] = true
+		journal.Files = append(journal.Files, MoveFile{Kind: kind, Src: src, Dst: destPrefix + "/" + filepath.Base(src)})
+	}
+	add("original", img.OriginalFile)
+	add("thumbnail50", img.Thumbnail50)
+	add("thumbnail400", img.Thumbnail400)
+	for _, raw := range findRawFiles(img.OriginalFile) {
+		add("raw", raw)
+	}
+	for _, rel := range img.RelatedFiles {
+		add("related", rel)
+	}
+	return journal
+}
+
+// moves reports whether any file changes place.
+func (j *MoveJournal) moves() bool {
+	for _, f := range j.Files {
+		if f.Src != f.Dst {
+			return true
+		}
+	}
+	return false
+}
+
+// newPaths returns the paths the files moved to, in the form moveImageFiles
+// returns them. RAW files that were missing are left out.
+func (j *MoveJournal) newPaths(missing map[string]bool) map[string]string {
+	paths := make(map[string]string)
+	var raws []string
+	for _, f := range j.Files {
+		switch f.Kind {
+		case "original", "thumbnail50", "thumbnail400":
+			paths[f.Kind] = f.Dst
+		case "raw":
+			if !missing[f.Src] {
+				raws = append(raws, f.Dst)
+			}
+		}
+	}
+	paths["rawFiles"] = strings.Join(raws, ",")
+	return paths
+}
+
+// stale reports whether the move has been left alone for moveStaleAfter.
+func (j *MoveJournal) stale() bool {
+	updated, err := time.Parse(time.RFC3339, j.UpdatedAt)
+	return err != nil || time.Since(updated) > moveStaleAfter
+}
+
+// journaledMove moves img's files to destPrefix, resuming the move img's
+// journal records if it is to the same place. The journal stays open for the
+// caller to close with the write of the new paths.
+func journaledMove(img ImageResponse, destPrefix, newStatus string) (map[string]string, error) {
+	journal := img.MoveJournal
+	if journal != nil && journal.DestPrefix != destPrefix {
+		return nil, errMoveConflict
+	}
+	if journal == nil {
+		journal = planMove(img, destPrefix, newStatus)
+		if !journal.moves() {
+			return journal.newPaths(nil), nil
+		}
+		if err := openMoveJournal(img, journal); err != nil {
+			return nil, err
+		}
+	} else {
+		fmt.Printf("Resuming move of image %s to %s\n", img.ImageGUID, destPrefix)
+	}
+	missing, err := applyMove(journal)
+	if err != nil {
+		return nil, err
+	}
+	return journal.newPaths(missing), nil
+}
+
+// openMoveJournal records journal on img, provided no other move has started
+// and its files are still where img says.
+func openMoveJournal(img ImageResponse, journal *MoveJournal) error {
+	av, err := dynamodbattribute.MarshalMap(journal)
+	if err != nil {
+		return err
+	}
+	_, err = withRetry(func() (Item, error) {
+		return imageStore.UpdateImage(img.ImageGUID, ItemUpdate{
+			Expression: "SET MoveJournal = :journal, MoveState = :moving",
+			Condition:  "attribute_not_exists(MoveJournal) AND OriginalFile = :orig",
+			Values: map[string]*dynamodb.AttributeValue{
+				":journal": {M: av},
+				":moving":  {S: aws.String(moveStateMoving)},
+				":orig":    {S: aws.String(img.OriginalFile)},
+			},
+		})
+	})
+	if isConditionFailed(err) {
+		return errMoveConflict
+	}
+	if err != nil {
+		return fmt.Errorf("failed to journal move: %v", err)
+	}
+	return nil
+}
+
+// applyMove copies each file of journal to its destination and deletes the
+// source. A file whose source is gone but whose copy exists was moved by an
+// earlier attempt. It returns the sources that are missing altogether, and
+// ErrSourceFileMissing if the original is one of them.
+func applyMove(journal *MoveJournal) (map[string]bool, error) {
+	missing := make(map[string]bool)
+	for _, f := range journal.Files {
+		if f.Src == f.Dst {
+			continue
+		}
+		if err := copyS3Object(f.Src, f.Dst); err != nil {
+			if !isNoSuchKeyError(err) {
+				return nil, fmt.Errorf("failed to copy %s: %v", f.Kind, err)
+			}
+			if !objectStore.Exists(f.Dst) {
+				if f.Kind == "original" {
+					return nil, ErrSourceFileMissing
+				}
+				fmt.Printf("  Warning: %s is missing, not moving it\n", f.Src)
+				missing[f.Src] = true
+				continue
+			}
+		}
+		err := s3OperationWithRetry(func() error {
+			return objectStore.Delete(f.Src)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete %s: %v", f.Src, err)
+		}
+	}
+	return missing, nil
+}
+
+// closeMoveJournal makes u, the write of an image's moved paths, also close
+// its move.
+func closeMoveJournal(u ItemUpdate) ItemUpdate {
+	if strings.Contains(u.Expression, " REMOVE ") {
+		u.Expression += ", MoveJournal, MoveState"
+	} else {
+		u.Expression += " REMOVE MoveJournal, MoveState"
+	}
+	return u
+}
+
+// rollbackMove puts the files of img's open move back where img's record
+// says they are and closes the move. A review move is marked failed.
+func rollbackMove(img ImageResponse) error {
+	journal := img.MoveJournal
+	fmt.Printf("Rolling back move of image %s to %s\n", img.ImageGUID, journal.DestPrefix)
+	for i := len(journal.Files) - 1; i >= 0; i-- {
+		f := journal.Files[i]
+		if f.Src == f.Dst {
+			continue
+		}
+		if err := copyS3Object(f.Dst, f.Src); err != nil {
+			if isNoSuchKeyError(err) {
+				// Never copied, or missing to begin with
+				continue
+			}
+			return fmt.Errorf("failed to copy back %s: %v", f.Kind, err)
+		}
+		err := s3OperationWithRetry(func() error {
+			return objectStore.Delete(f.Dst)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %v", f.Dst, err)
+		}
+	}
+
+	update := ItemUpdate{
+		Expression: "REMOVE MoveJournal, MoveState",
+		Condition:  "MoveJournal.StartedAt = :started",
+		Values: map[string]*dynamodb.AttributeValue{
+			":started": {S: aws.String(journal.StartedAt)},
+		},
+	}
+	if journal.NewStatus != "" {
+		update.Expression = "SET MoveState = :failed, MoveStatus = :failed REMOVE MoveJournal"
+		update.Values[":failed"] = &dynamodb.AttributeValue{S: aws.String(moveStateFailed)}
+	}
+	_, err := withRetry(func() (Item, error) {
+		return imageStore.UpdateImage(img.ImageGUID, update)
+	})
+	if err != nil && !isConditionFailed(err) {
+		return fmt.Errorf("failed to close rolled back move: %v", err)
+	}
+	return nil
+}
+
+// rollbackMoveOf rolls back the image's open move to destPrefix, if it has
+// one. Failures are left for the reconciler.
+func rollbackMoveOf(imageGUID, destPrefix string) {
+	item, err := imageStore.GetImage(imageGUID)
+	if err != nil || item == nil {
+		return
+	}
+	var img ImageResponse
+	dynamodbattribute.UnmarshalMap(item, &img)
+	if img.MoveJournal == nil || img.MoveJournal.DestPrefix != destPrefix {
+		return
+	}
+	if err := rollbackMove(img); err != nil {
+		fmt.Printf("Error rolling back move of image %s: %v\n", imageGUID, err)
+	}
+}
+
+// claimMove takes img's move over for a reconcile or retry, counting the
+// attempt, and reloads img. It reports false when someone else took it over
+// first.
+func claimMove(img *ImageResponse) (bool, error) {
+	item, err := withRetry(func() (Item, error) {
+		return imageStore.UpdateImage(img.ImageGUID, ItemUpdate{
+			Expression: "SET MoveJournal.UpdatedAt = :now, MoveJournal.Attempts = MoveJournal.Attempts + :one",
+			Condition:  "MoveJournal.UpdatedAt = :seen",
+			Values: map[string]*dynamodb.AttributeValue{
+				":now":  {S: aws.String(time.Now().UTC().Format(time.RFC3339))},
+				":one":  {N: aws.String("1")},
+				":seen": {S: aws.String(img.MoveJournal.UpdatedAt)},
+			},
+			ReturnValues: dynamodb.ReturnValueAllNew,
+		})
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	*img = ImageResponse{}
+	dynamodbattribute.UnmarshalMap(item, img)
+	return true, nil
+}
+
+// imagesInMoveState returns the images whose MoveState is state from
+// MoveStateIndex, or by scanning the table until that index is created.
+func imagesInMoveState(state string) ([]Item, error) {
+	values := map[string]*dynamodb.AttributeValue{":state": {S: aws.String(state)}}
+	if hasImageIndex("MoveStateIndex") {
+		return queryAllPages(ItemQuery{
+			Index:        "MoveStateIndex",
+			KeyCondition: "MoveState = :state",
+			Values:       values,
+		})
+	}
+	var items []Item
+	err := scanAllImages(ItemScan{Filter: "MoveState = :state", Values: values}, func(page []map[string]*dynamodb.AttributeValue) {
+		items = append(items, page...)
+	})
+	return items, err
+}
+
+// runReconcileMovesJob resumes or rolls back the moves that have been left
+// unfinished for moveStaleAfter.
+func runReconcileMovesJob(run *jobRun) error {
+	items, err := imagesInMoveState(moveStateMoving)
+	if err != nil {
+		return fmt.Errorf("failed to query moves: %v", err)
+	}
+	var stale []ImageResponse
+	for _, item := range items {
+		var img ImageResponse
+		dynamodbattribute.UnmarshalMap(item, &img)
+		if img.MoveJournal != nil && img.MoveJournal.stale() {
+			stale = append(stale, img)
+		}
+		if len(stale) == reconcileBatchSize {
+			break
+		}
+	}
+
+	run.setTotal(len(stale))
+	for _, img := range stale {
+		if run.canceled() {
+			return errJobCanceled
+		}
+		outcome, err := reconcileMove(img)
+		if err != nil {
+			run.itemFailed(img.ImageGUID, err)
+			continue
+		}
+		fmt.Printf("Move of image %s %s\n", img.ImageGUID, outcome)
+		run.progress(1, 0)
+	}
+	return nil
+}
+
+// reconcileMove resumes img's stale move after review, unless it has been
+// tried maxMoveAttempts times, and rolls back any other. It says which.
+func reconcileMove(img ImageResponse) (string, error) {
+	claimed, err := claimMove(&img)
+	if err != nil {
+		return "", err
+	}
+	if !claimed || img.MoveJournal == nil {
+		return "taken over by another request", nil
+	}
+	journal := img.MoveJournal
+	if journal.NewStatus != "" && journal.Attempts <= maxMoveAttempts {
+		_, err := runAsyncMove(AsyncMoveRequest{
+			Action:     "move_files",
+			ImageGUID:  img.ImageGUID,
+			DestPrefix: journal.DestPrefix,
+			NewStatus:  journal.NewStatus,
+			Bucket:     bucketName,
+		})
+		if err != nil {
+			return "", fmt.Errorf("resume failed: %v", err)
+		}
+		return "resumed", nil
+	}
+	if err := rollbackMove(img); err != nil {
+		return "", err
+	}
+	return "rolled back", nil
+}
+
+// reviewedInbox reports whether img waits in the inbox for its move after
+// review.
+func reviewedInbox(img ImageResponse) bool {
+	return (img.Status == "" || img.Status == "inbox") && img.Reviewed == "true"
+}
+
+// moveStatusStale reports whether img's move after review was queued or
+// started moveStaleAfter ago without being journaled, i.e. its job was lost.
+func moveStatusStale(img ImageResponse) bool {
+	if img.MoveStatus != "pending" && img.MoveStatus != "moving" {
+		return false
+	}
+	updated, err := time.Parse(time.RFC3339, img.UpdatedDateTime)
+	return err != nil || time.Since(updated) > moveStaleAfter
+}
+
+// handleRetryMove serves POST /api/images/{id}/retry-move. A failed or stale
+// move after review is resumed where it left off, or started again for an
+// image whose move never got going; either runs as a move job, which is
+// returned. Another stale move, or one to where the image no longer goes, is
+// rolled back first.
+func handleRetryMove(caller *Caller, imageID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	imgItem, err := imageStore.GetImage(imageID)
+	if err != nil || imgItem == nil {
+		return errorResponse(404, "Image not found", headers)
+	}
+	var img ImageResponse
+	dynamodbattribute.UnmarshalMap(imgItem, &img)
+	if err := checkImageAccess(caller, img, projectEditor); err != nil {
+		return projectAccessError(err, headers)
+	}
+
+	rolledBack := false
+	if journal := img.MoveJournal; journal != nil {
+		if img.MoveStatus != "failed" && !journal.stale() {
+			return errorResponse(409, "The image's files are still being moved, try again shortly", headers)
+		}
+		if claimed, err := claimMove(&img); err != nil {
+			fmt.Printf("Error taking over move of image %s: %v\n", imageID, err)
+			return errorResponse(500, "Failed to retry move", headers)
+		} else if !claimed || img.MoveJournal == nil {
+			return errorResponse(409, "The move was taken over by another request", headers)
+		}
+		journal = img.MoveJournal
+		if dest, _ := reviewDestination(img, img.GroupNumber); journal.NewStatus != "" && reviewedInbox(img) && dest == journal.DestPrefix {
+			job, err := triggerAsyncMove(imageID, journal.DestPrefix, journal.NewStatus, bucketName, caller.Username)
+			if err != nil {
+				fmt.Printf("Error starting move of image %s: %v\n", imageID, err)
+				return errorResponse(500, "Failed to retry move", headers)
+			}
+			return jsonResponse(202, job, headers)
+		}
+		if err := rollbackMove(img); err != nil {
+			fmt.Printf("Error rolling back move of image %s: %v\n", imageID, err)
+			return errorResponse(500, fmt.Sprintf("Failed to roll back move: %v", err), headers)
+		}
+		rolledBack = true
+	} else if img.MoveStatus != "failed" && !moveStatusStale(img) {
+		return errorResponse(409, "Image has no failed move", headers)
+	}
+
+	if !reviewedInbox(img) {
+		if rolledBack {
+			return jsonResponse(200, map[string]interface{}{"success": true, "rolledBack": true}, headers)
+		}
+		return errorResponse(409, "Image is not waiting to be moved after review", headers)
+	}
+	destPrefix, newStatus := reviewDestination(img, img.GroupNumber)
+	if err := setMoveStatus(imageID, "pending"); err != nil {
+		fmt.Printf("Error updating move status of image %s: %v\n", imageID, err)
+	}
+	job, err := triggerAsyncMove(imageID, destPrefix, newStatus, bucketName, caller.Username)
+	if err != nil {
+		fmt.Printf("Error starting move of image %s: %v\n", imageID, err)
+		return errorResponse(500, "Failed to retry move", headers)
+	}
+	return jsonResponse(202, job, headers)
+}
+
+// handleListFailedMoves serves GET /api/images/failed-moves: the images
+// whose move after review failed and those with a move that has been
+// unfinished for moveStaleAfter, which the reconciler will get to.
+func handleListFailedMoves(caller *Caller, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	canSee := projectFilter(caller)
+	images := []ImageResponse{}
+	for _, state := range []string{moveStateFailed, moveStateMoving} {
+		items, err := imagesInMoveState(state)
+		if err != nil {
+			fmt.Printf("Error querying %s moves: %v\n", state, err)
+			return errorResponse(500, "Failed to query images", headers)
+		}
+		for _, item := range items {
+			var img ImageResponse
+			dynamodbattribute.UnmarshalMap(item, &img)
+			if state == moveStateMoving && img.MoveStatus != "failed" && (img.MoveJournal == nil || !img.MoveJournal.stale()) {
+				continue
+			}
+			if canSee(img.ProjectID) {
+				images = append(images, img)
+			}
+		}
+	}
+	return jsonResponse(200, PaginatedImageResponse{Images: images}, headers)
+}
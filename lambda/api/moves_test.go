@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// flakyCopies is an object store whose copies fail after the first n, up to
+// failures times, like a function dying part way through a move.
+type flakyCopies struct {
+	ObjectStore
+	n, failures *int
+}
+
+func (s flakyCopies) Copy(srcKey, dstKey string) error {
+	if *s.n == 0 && *s.failures > 0 {
+		*s.failures--
+		return errors.New("copy failed")
+	}
+	*s.n--
+	return s.ObjectStore.Copy(srcKey, dstKey)
+}
+
+// failCopiesAfter makes copies fail after the first n, failures times, until
+// the test restores the store.
+func (env *testEnv) failCopiesAfter(n, failures int) (restore func()) {
+	objects := objectStore
+	objectStore = flakyCopies{objects, &n, &failures}
+	return func() { objectStore = objects }
+}
+
+// assertFilesBack checks that the image's files are all in images/.
+func (env *testEnv) assertFilesBack(id string) {
+	env.t.Helper()
+	for _, suffix := range []string{".jpg", ".50.jpg", ".400.jpg", ".cr2"} {
+		if !objectStore.Exists("images/" + id + suffix) {
+			env.t.Errorf("missing images/%s%s", id, suffix)
+		}
+	}
+	if img := env.image(id); img.OriginalFile != "images/"+id+".jpg" {
+		env.t.Errorf("OriginalFile = %s, want under images", img.OriginalFile)
+	}
+}
+
+// ageMove makes the image's open move look abandoned.
+func (env *testEnv) ageMove(id string) {
+	env.t.Helper()
+	_, err := imageStore.UpdateImage(id, ItemUpdate{
+		Expression: "SET MoveJournal.UpdatedAt = :old",
+		Values: map[string]*dynamodb.AttributeValue{
+			":old": {S: aws.String(time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))},
+		},
+	})
+	if err != nil {
+		env.t.Fatal(err)
+	}
+}
+
+func (env *testEnv) reconcileMoves() {
+	env.t.Helper()
+	resp, err := handleEvent(context.Background(), json.RawMessage(`{"source": "aws.events", "detail-type": "Scheduled Event", "detail": {"action": "reconcile-moves"}}`))
+	if proxy, ok := resp.(events.APIGatewayProxyResponse); err != nil || !ok || proxy.StatusCode != 200 {
+		env.t.Fatalf("reconcile moves: %v %+v", err, resp)
+	}
+}
+
+func (env *testEnv) failedMoves() []ImageResponse {
+	env.t.Helper()
+	resp := env.call("GET", "/api/images/failed-moves", "")
+	if resp.StatusCode != 200 {
+		env.t.Fatalf("failed moves: %d %s", resp.StatusCode, resp.Body)
+	}
+	var page PaginatedImageResponse
+	json.Unmarshal([]byte(resp.Body), &page)
+	return page.Images
+}
+
+func TestReconcileResumesMove(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	env.seedImage("img1", nil)
+	dest := "approved/red/" + testDatePath
+	job, err := triggerAsyncMove("img1", dest, "approved", bucketName, testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The original is moved, then the move stops
+	restore := env.failCopiesAfter(1, 1)
+	runJob(job.JobID)
+	restore()
+	img := env.image("img1")
+	if img.MoveJournal == nil || img.MoveState != moveStateMoving || img.MoveStatus != "failed" || img.OriginalFile != "images/img1.jpg" {
+		t.Fatalf("image = %+v, want a failed move with its journal open", img)
+	}
+	if !objectStore.Exists(dest+"/img1.jpg") || !objectStore.Exists("images/img1.50.jpg") {
+		t.Fatal("want the image split between images/ and " + dest)
+	}
+	if failed := env.failedMoves(); len(failed) != 1 || failed[0].MoveJournal == nil || len(failed[0].MoveJournal.Files) != 4 {
+		t.Errorf("failed moves = %+v, want img1 with the four files journaled", failed)
+	}
+
+	// Left alone until it is stale
+	env.reconcileMoves()
+	if img := env.image("img1"); img.MoveJournal == nil {
+		t.Fatal("reconciler took over a fresh move")
+	}
+	env.ageMove("img1")
+	env.reconcileMoves()
+	env.assertFilesUnder("img1", dest)
+	img = env.image("img1")
+	if img.Status != "approved" || img.MoveStatus != "complete" || img.MoveJournal != nil || img.MoveState != "" {
+		t.Errorf("image = %+v, want the move finished", img)
+	}
+	if failed := env.failedMoves(); len(failed) != 0 {
+		t.Errorf("failed moves = %+v, want none", failed)
+	}
+	jobs := env.jobs("?user=" + systemRequester + "&type=" + jobReconcileMoves)
+	if len(jobs) != 2 || jobs[0].Total+jobs[1].Total != 1 || jobs[0].Done+jobs[1].Done != 1 {
+		t.Errorf("reconcile jobs = %+v, want one that resumed the move", jobs)
+	}
+}
+
+func TestReconcileWithoutMoveStateIndex(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	useImageIndexes(t, len(imageIndexOrder)-1)
+	env.seedImage("img1", nil)
+	env.seedImage("img2", nil)
+	dest := "approved/red/" + testDatePath
+	job, _ := triggerAsyncMove("img1", dest, "approved", bucketName, testUser)
+	restore := env.failCopiesAfter(1, 1)
+	runJob(job.JobID)
+	restore()
+
+	// Until the index is created the moves are found by scanning
+	if failed := env.failedMoves(); len(failed) != 1 || failed[0].ImageGUID != "img1" {
+		t.Errorf("failed moves = %+v, want img1", failed)
+	}
+	env.ageMove("img1")
+	env.reconcileMoves()
+	env.assertFilesUnder("img1", dest)
+	if img := env.image("img1"); img.Status != "approved" || img.MoveJournal != nil {
+		t.Errorf("image = %+v, want the move finished", img)
+	}
+}
+
+func TestReconcileRollsBackMove(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	env.seedImage("img1", nil)
+
+	// A delete that fails part way is put back at once
+	restore := env.failCopiesAfter(2, 1)
+	if resp := env.call("DELETE", "/api/images/img1", ""); resp.StatusCode != 500 {
+		t.Fatalf("delete: %d %s", resp.StatusCode, resp.Body)
+	}
+	restore()
+	env.assertFilesBack("img1")
+	if img := env.image("img1"); img.MoveJournal != nil || img.MoveState != "" || img.Status != "inbox" {
+		t.Errorf("image = %+v, want the delete rolled back", img)
+	}
+
+	// One whose function died is rolled back by the reconciler, e.g. an undo
+	dest := "approved/red/" + testDatePath
+	img := env.image("img1")
+	journal := planMove(img, dest, "")
+	if err := openMoveJournal(img, journal); err != nil {
+		t.Fatal(err)
+	}
+	objectStore.Copy("images/img1.jpg", dest+"/img1.jpg")
+	objectStore.Delete("images/img1.jpg")
+	if resp := env.call("DELETE", "/api/images/img1", ""); resp.StatusCode != 409 {
+		t.Errorf("delete during a move: %d, want 409", resp.StatusCode)
+	}
+	if failed := env.failedMoves(); len(failed) != 0 {
+		t.Errorf("failed moves = %+v, want none before the move is stale", failed)
+	}
+	env.ageMove("img1")
+	if failed := env.failedMoves(); len(failed) != 1 {
+		t.Errorf("failed moves = %+v, want the stale move", failed)
+	}
+	env.reconcileMoves()
+	env.assertFilesBack("img1")
+	if objectStore.Exists(dest + "/img1.jpg") {
+		t.Error("copy at the destination was left behind")
+	}
+	if img := env.image("img1"); img.MoveJournal != nil || img.MoveState != "" || img.MoveStatus != "" {
+		t.Errorf("image = %+v, want the move rolled back", img)
+	}
+	if resp := env.call("DELETE", "/api/images/img1", ""); resp.StatusCode != 200 {
+		t.Errorf("delete after rollback: %d %s", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestReconcileGivesUpOnMove(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	env.seedImage("img1", map[string]interface{}{"Reviewed": "true", "GroupNumber": 1})
+	job, _ := triggerAsyncMove("img1", "approved/red/"+testDatePath, "approved", bucketName, testUser)
+	env.invoked = nil
+	restore := env.failCopiesAfter(1, 100)
+	defer restore()
+	runJob(job.JobID)
+
+	for i := 0; i < maxMoveAttempts; i++ {
+		env.ageMove("img1")
+		env.reconcileMoves()
+		if img := env.image("img1"); img.MoveJournal == nil || img.MoveJournal.Attempts != i+1 {
+			t.Fatalf("attempt %d: image = %+v, want the move resumed", i+1, img)
+		}
+	}
+	restore()
+	env.ageMove("img1")
+	env.reconcileMoves()
+	env.assertFilesBack("img1")
+	img := env.image("img1")
+	if img.MoveJournal != nil || img.MoveState != moveStateFailed || img.MoveStatus != "failed" || img.Status != "inbox" {
+		t.Fatalf("image = %+v, want the move rolled back and failed", img)
+	}
+	if resp := env.call("GET", "/api/images/img1", ""); strings.Contains(resp.Body, "moveState") {
+		t.Errorf("image response has the index key: %s", resp.Body)
+	}
+	if failed := env.failedMoves(); len(failed) != 1 || failed[0].ImageGUID != "img1" {
+		t.Errorf("failed moves = %+v, want img1", failed)
+	}
+
+	// Retrying starts it again
+	resp := env.call("POST", "/api/images/img1/retry-move", "")
+	if resp.StatusCode != 202 {
+		t.Fatalf("retry move: %d %s", resp.StatusCode, resp.Body)
+	}
+	var retried Job
+	json.Unmarshal([]byte(resp.Body), &retried)
+	if retried.Type != jobMove || retried.ImageGUID != "img1" {
+		t.Errorf("retry returned %+v, want a move job", retried)
+	}
+	if img := env.image("img1"); img.MoveStatus != "pending" || img.MoveState != "" {
+		t.Errorf("image = %+v, want the move pending", img)
+	}
+	env.runAsyncMoves()
+	env.assertFilesUnder("img1", "approved/red/"+testDatePath)
+}
+
+func TestRetryMove(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	env.seedImage("img1", map[string]interface{}{"Reviewed": "true", "GroupNumber": 2})
+	env.seedImage("img2", nil)
+
+	if resp := env.call("POST", "/api/images/img2/retry-move", ""); resp.StatusCode != 409 {
+		t.Errorf("retry without a failed move: %d, want 409", resp.StatusCode)
+	}
+	if resp := env.call("POST", "/api/images/nope/retry-move", ""); resp.StatusCode != 404 {
+		t.Errorf("retry missing image: %d, want 404", resp.StatusCode)
+	}
+
+	// A failed move is resumed where it stopped
+	dest := "approved/yellow/" + testDatePath
+	job, _ := triggerAsyncMove("img1", dest, "approved", bucketName, testUser)
+	env.invoked = nil
+	restore := env.failCopiesAfter(2, 1)
+	runJob(job.JobID)
+	restore()
+	if resp := env.call("POST", "/api/images/img1/retry-move", ""); resp.StatusCode != 202 {
+		t.Fatalf("retry move: %d %s", resp.StatusCode, resp.Body)
+	}
+	if img := env.image("img1"); img.MoveJournal == nil || img.MoveJournal.Attempts != 1 {
+		t.Errorf("image = %+v, want the journaled move taken over", img)
+	}
+	if n := env.runAsyncMoves(); n != 1 {
+		t.Fatalf("%d moves ran, want 1", n)
+	}
+	env.assertFilesUnder("img1", dest)
+	if img := env.image("img1"); img.MoveJournal != nil || img.Status != "approved" {
+		t.Errorf("image = %+v, want the move finished", img)
+	}
+
+	// A move whose job never ran
+	env.seedImage("img3", map[string]interface{}{"Reviewed": "true", "GroupNumber": 0, "MoveStatus": "pending",
+		"UpdatedDateTime": time.Now().Format(time.RFC3339)})
+	if resp := env.call("POST", "/api/images/img3/retry-move", ""); resp.StatusCode != 409 {
+		t.Errorf("retry recently queued move: %d, want 409", resp.StatusCode)
+	}
+	imageStore.UpdateImage("img3", ItemUpdate{
+		Expression: "SET UpdatedDateTime = :old",
+		Values:     map[string]*dynamodb.AttributeValue{":old": {S: aws.String(time.Now().Add(-time.Hour).Format(time.RFC3339))}},
+	})
+	if resp := env.call("POST", "/api/images/img3/retry-move", ""); resp.StatusCode != 202 {
+		t.Fatalf("retry lost move: %d %s", resp.StatusCode, resp.Body)
+	}
+	env.runAsyncMoves()
+	env.assertFilesUnder("img3", "rejected/"+testDatePath)
+
+	env.seedUser("viewer", roleViewer)
+	env.loginAs("viewer", testPassword)
+	if resp := env.call("POST", "/api/images/img2/retry-move", ""); resp.StatusCode != 403 {
+		t.Errorf("viewer retry: %d, want 403", resp.StatusCode)
+	}
+}
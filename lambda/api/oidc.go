@@ -0,0 +1,523 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Single sign-on with an OpenID Connect provider, using the authorization
+// code flow with PKCE. The web app keeps the PKCE verifier: it asks
+// /api/auth/oidc/start for the provider URL with its code challenge, and
+// after the provider redirects back it posts the code and verifier to
+// /api/auth/oidc/callback, which exchanges them, verifies the ID token and
+// starts a normal session. The state parameter is a short-lived signed token
+// carrying the nonce, so the API keeps no state between the two calls.
+//
+// Users are provisioned on first login with the role their IdP groups map
+// to, and their role follows the groups on every later login. SSO accounts
+// are bound to the provider's subject, so an IdP user can never sign in as a
+// local password account of the same name. Two-factor authentication is left
+// to the provider.
+
+const (
+	tokenTypeOIDCState = "oidc-state"
+	oidcStateTTL       = 10 * time.Minute
+	oidcDiscoveryTTL   = time.Hour
+	authProviderOIDC   = "oidc"
+)
+
+// OIDCConfig is the provider configuration, read from OIDC_* variables.
+type OIDCConfig struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string // Empty for public clients
+	RedirectURL   string // Where the provider sends the browser back to; the web app
+	Scopes        string
+	UsernameClaim string
+	GroupsClaim   string
+	// Groups to roles; a user gets the most privileged role of their groups
+	RoleMap map[string]string
+	// Role for users in no mapped group; empty refuses them
+	DefaultRole string
+	DisplayName string
+}
+
+var (
+	oidcConfig     *OIDCConfig
+	oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// parseOIDCRoleMap parses "group:role,group:role".
+func parseOIDCRoleMap(spec string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		// Group names may contain colons, so split on the last one
+		i := strings.LastIndex(entry, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("role mapping %q must be group:role", entry)
+		}
+		group, role := strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		if !isValidRole(role) {
+			return nil, fmt.Errorf("role mapping %q: role must be admin, reviewer or viewer", entry)
+		}
+		roles[group] = role
+	}
+	return roles, nil
+}
+
+// loadOIDCConfig returns nil when SSO is not configured.
+func loadOIDCConfig(getenv func(string) string) (*OIDCConfig, error) {
+	issuer := strings.TrimSuffix(getenv("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil, nil
+	}
+	cfg := &OIDCConfig{
+		Issuer:        issuer,
+		ClientID:      getenv("OIDC_CLIENT_ID"),
+		ClientSecret:  getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:   getenv("OIDC_REDIRECT_URL"),
+		Scopes:        getenv("OIDC_SCOPES"),
+		UsernameClaim: getenv("OIDC_USERNAME_CLAIM"),
+		GroupsClaim:   getenv("OIDC_GROUPS_CLAIM"),
+		DefaultRole:   getenv("OIDC_DEFAULT_ROLE"),
+		DisplayName:   getenv("OIDC_DISPLAY_NAME"),
+	}
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required with OIDC_ISSUER")
+	}
+	if cfg.DefaultRole != "" && !isValidRole(cfg.DefaultRole) {
+		return nil, fmt.Errorf("OIDC_DEFAULT_ROLE must be admin, reviewer or viewer")
+	}
+	roles, err := parseOIDCRoleMap(getenv("OIDC_ROLE_MAP"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.RoleMap = roles
+	if cfg.Scopes == "" {
+		cfg.Scopes = "openid profile email"
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	if cfg.DisplayName == "" {
+		cfg.DisplayName = "SSO"
+	}
+	return cfg, nil
+}
+
+func initOIDC(getenv func(string) string) {
+	cfg, err := loadOIDCConfig(getenv)
+	if err != nil {
+		panic(fmt.Sprintf("invalid OIDC configuration: %v", err))
+	}
+	oidcConfig = cfg
+}
+
+// role returns the role for a user's groups, or "" if none applies.
+func (c *OIDCConfig) role(groups []string) string {
+	best := ""
+	for _, g := range groups {
+		if role, ok := c.RoleMap[g]; ok && roleRank[role] > roleRank[best] {
+			best = role
+		}
+	}
+	if best == "" {
+		return c.DefaultRole
+	}
+	return best
+}
+
+// oidcProvider is the discovered provider metadata and signing keys.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	fetchedAt time.Time
+	keys      map[string]*rsa.PublicKey
+}
+
+var (
+	oidcProviderMu     sync.Mutex
+	oidcProviderCached *oidcProvider
+)
+
+func oidcGetJSON(u string, v interface{}) error {
+	resp, err := oidcHTTPClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discoverOIDC returns the provider metadata, cached for oidcDiscoveryTTL.
+func discoverOIDC() (*oidcProvider, error) {
+	oidcProviderMu.Lock()
+	defer oidcProviderMu.Unlock()
+	if p := oidcProviderCached; p != nil && strings.TrimSuffix(p.Issuer, "/") == oidcConfig.Issuer && time.Since(p.fetchedAt) < oidcDiscoveryTTL {
+		return p, nil
+	}
+
+	var p oidcProvider
+	if err := oidcGetJSON(oidcConfig.Issuer+"/.well-known/openid-configuration", &p); err != nil {
+		return nil, fmt.Errorf("discovery failed: %v", err)
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != oidcConfig.Issuer {
+		return nil, fmt.Errorf("discovery returned issuer %q, want %q", p.Issuer, oidcConfig.Issuer)
+	}
+	if err := p.loadKeys(); err != nil {
+		return nil, err
+	}
+	p.fetchedAt = time.Now()
+	oidcProviderCached = &p
+	return &p, nil
+}
+
+// loadKeys fetches the provider's RSA signing keys. Callers hold oidcProviderMu.
+func (p *oidcProvider) loadKeys() error {
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := oidcGetJSON(p.JWKSURI, &jwks); err != nil {
+		return fmt.Errorf("failed to fetch signing keys: %v", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("provider publishes no RSA signing keys")
+	}
+	p.keys = keys
+	return nil
+}
+
+// verifyIDToken checks the ID token's signature, issuer, audience, expiry and
+// nonce. Unknown key IDs trigger one refetch of the keys, for rotation.
+func (p *oidcProvider) verifyIDToken(idToken, nonce string) (jwt.MapClaims, error) {
+	refetched := false
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		oidcProviderMu.Lock()
+		defer oidcProviderMu.Unlock()
+		key, ok := p.keys[kid]
+		if !ok && !refetched {
+			refetched = true
+			if err := p.loadKeys(); err != nil {
+				return nil, err
+			}
+			key, ok = p.keys[kid]
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}
+	token, err := jwt.Parse(idToken, keyFunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(oidcConfig.ClientID),
+		jwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if got, _ := claims["nonce"].(string); got == "" || got != nonce {
+		return nil, fmt.Errorf("ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+// exchangeCode redeems an authorization code for the provider's ID token.
+func (p *oidcProvider) exchangeCode(code, codeVerifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcConfig.RedirectURL},
+		"client_id":     {oidcConfig.ClientID},
+		"code_verifier": {codeVerifier},
+	}
+	if oidcConfig.ClientSecret != "" {
+		form.Set("client_secret", oidcConfig.ClientSecret)
+	}
+	resp, err := oidcHTTPClient.PostForm(p.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result)
+	if resp.StatusCode != http.StatusOK || result.IDToken == "" {
+		return "", fmt.Errorf("token exchange failed: %s %s %s", resp.Status, result.Error, result.ErrorDescription)
+	}
+	return result.IDToken, nil
+}
+
+// claimStrings reads a claim that may be a string or a list of strings.
+func claimStrings(claims jwt.MapClaims, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+type OIDCConfigResponse struct {
+	Enabled     bool   `json:"enabled"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+type OIDCStartRequest struct {
+	CodeChallenge string `json:"codeChallenge"`
+}
+
+type OIDCStartResponse struct {
+	AuthorizationURL string `json:"authorizationUrl"`
+	State            string `json:"state"`
+}
+
+type OIDCCallbackRequest struct {
+	Code         string `json:"code"`
+	State        string `json:"state"`
+	CodeVerifier string `json:"codeVerifier"`
+}
+
+func handleOIDCConfig(headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	resp := OIDCConfigResponse{Enabled: oidcConfig != nil}
+	if oidcConfig != nil {
+		resp.DisplayName = oidcConfig.DisplayName
+	}
+	body, _ := json.Marshal(resp)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// handleOIDCStart returns the provider URL to send the browser to.
+func handleOIDCStart(request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	if oidcConfig == nil {
+		return errorResponse(404, "Single sign-on is not configured", headers)
+	}
+	var req OIDCStartRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return errorResponse(400, "Invalid request body", headers)
+	}
+	// base64url of a SHA-256 digest
+	if len(req.CodeChallenge) != 43 {
+		return errorResponse(400, "codeChallenge must be an S256 PKCE challenge", headers)
+	}
+	provider, err := discoverOIDC()
+	if err != nil {
+		fmt.Printf("OIDC discovery for %s failed: %v\n", oidcConfig.Issuer, err)
+		return errorResponse(502, "Identity provider unavailable", headers)
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return errorResponse(500, "Failed to start sign-in", headers)
+	}
+	now := time.Now()
+	state, err := signToken(jwt.MapClaims{
+		"typ":   tokenTypeOIDCState,
+		"nonce": base64.RawURLEncoding.EncodeToString(nonce),
+		"jti":   uuid.New().String(),
+		"iat":   now.Unix(),
+		"exp":   now.Add(oidcStateTTL).Unix(),
+	})
+	if err != nil {
+		return errorResponse(500, "Failed to start sign-in", headers)
+	}
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidcConfig.ClientID},
+		"redirect_uri":          {oidcConfig.RedirectURL},
+		"scope":                 {oidcConfig.Scopes},
+		"state":                 {state},
+		"nonce":                 {base64.RawURLEncoding.EncodeToString(nonce)},
+		"code_challenge":        {req.CodeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	body, _ := json.Marshal(OIDCStartResponse{
+		AuthorizationURL: provider.AuthorizationEndpoint + sep + params.Encode(),
+		State:            state,
+	})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// parseOIDCState verifies a state token and returns its nonce.
+func parseOIDCState(state string) (string, bool) {
+	token, err := jwt.Parse(state, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := jwtKeys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		return "", false
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if typ, _ := claims["typ"].(string); typ != tokenTypeOIDCState {
+		return "", false
+	}
+	nonce, _ := claims["nonce"].(string)
+	return nonce, nonce != ""
+}
+
+// handleOIDCCallback completes SSO: it redeems the code, provisions or
+// updates the user and starts a session.
+func handleOIDCCallback(request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	if oidcConfig == nil {
+		return errorResponse(404, "Single sign-on is not configured", headers)
+	}
+	var req OIDCCallbackRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return errorResponse(400, "Invalid request body", headers)
+	}
+	if req.Code == "" || req.CodeVerifier == "" {
+		return errorResponse(400, "code and codeVerifier are required", headers)
+	}
+	nonce, ok := parseOIDCState(req.State)
+	if !ok {
+		return errorResponse(401, "Sign-in expired, try again", headers)
+	}
+
+	provider, err := discoverOIDC()
+	if err != nil {
+		fmt.Printf("OIDC discovery for %s failed: %v\n", oidcConfig.Issuer, err)
+		return errorResponse(502, "Identity provider unavailable", headers)
+	}
+	idToken, err := provider.exchangeCode(req.Code, req.CodeVerifier)
+	if err != nil {
+		fmt.Printf("OIDC code exchange failed: %v\n", err)
+		return errorResponse(401, "Sign-in failed", headers)
+	}
+	claims, err := provider.verifyIDToken(idToken, nonce)
+	if err != nil {
+		fmt.Printf("OIDC login rejected: %v\n", err)
+		return errorResponse(401, "Sign-in failed", headers)
+	}
+
+	subject, _ := claims["sub"].(string)
+	username, _ := claims[oidcConfig.UsernameClaim].(string)
+	if subject == "" || !isValidUsername(username) {
+		fmt.Printf("OIDC login rejected: unusable sub %q or %s %q\n", subject, oidcConfig.UsernameClaim, username)
+		return errorResponse(403, "Your identity provider account has no usable username", headers)
+	}
+	role := oidcConfig.role(claimStrings(claims, oidcConfig.GroupsClaim))
+	if role == "" {
+		fmt.Printf("OIDC login rejected for %s: no group maps to a role\n", username)
+		recordLogin(request, username, auditLoginFailed, map[string]interface{}{"reason": "no mapped role"})
+		return errorResponse(403, "Your account is not authorized for kill-snap", headers)
+	}
+
+	// Create the user on first login; afterwards only the same subject may
+	// use the account, and its role follows the IdP groups
+	now := time.Now().Format(time.RFC3339)
+	userItem, err := userStore.UpdateUser(username, ItemUpdate{
+		Expression: "SET #role = :role, AuthProvider = :provider, OIDCSubject = :sub, " +
+			"CreatedAt = if_not_exists(CreatedAt, :now), UpdatedAt = :now",
+		Condition: "attribute_not_exists(Username) OR OIDCSubject = :sub",
+		Names:     map[string]*string{"#role": aws.String("Role")},
+		Values: map[string]*dynamodb.AttributeValue{
+			":role":     {S: aws.String(role)},
+			":provider": {S: aws.String(authProviderOIDC)},
+			":sub":      {S: aws.String(oidcConfig.Issuer + "|" + subject)},
+			":now":      {S: aws.String(now)},
+		},
+		ReturnValues: dynamodb.ReturnValueAllNew,
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "ConditionalCheckFailed") {
+			recordLogin(request, username, auditLoginFailed, map[string]interface{}{"reason": "subject mismatch"})
+			return errorResponse(409, "A local account with this username already exists", headers)
+		}
+		fmt.Printf("Failed to provision SSO user %s: %v\n", username, err)
+		return errorResponse(500, "Sign-in failed", headers)
+	}
+
+	account := userFromItem(userItem)
+	if account.Disabled {
+		recordLogin(request, username, auditLoginFailed, map[string]interface{}{"reason": "account disabled"})
+		return errorResponse(403, "Account disabled", headers)
+	}
+	response, err := startSession(account, userItem)
+	if err != nil {
+		fmt.Printf("Failed to start session for %s: %v\n", username, err)
+		return errorResponse(500, "Failed to generate token", headers)
+	}
+	recordLogin(request, username, auditLogin, map[string]interface{}{"method": "sso", "role": account.Role})
+
+	body, _ := json.Marshal(response)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// mockOIDCProvider is an in-process OpenID provider. Tests play the browser:
+// they take the authorization URL from /api/auth/oidc/start, have the mock
+// issue a code for it, and post the code back to the callback.
+type mockOIDCProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu    sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+type mockAuthorization struct {
+	challenge   string
+	redirectURI string
+	claims      jwt.MapClaims
+}
+
+const (
+	testOIDCClient   = "kill-snap-web"
+	testOIDCSecret   = "client-secret"
+	testOIDCRedirect = "https://photos.example.com/"
+)
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockOIDCProvider{t: t, key: key, kid: "mock-1", codes: make(map[string]mockAuthorization)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"kid": m.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", m.token)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func (m *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	m.mu.Lock()
+	auth, ok := m.codes[r.Form.Get("code")]
+	delete(m.codes, r.Form.Get("code"))
+	m.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	switch {
+	case !ok, r.Form.Get("grant_type") != "authorization_code":
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	case r.Form.Get("client_id") != testOIDCClient || r.Form.Get("client_secret") != testOIDCSecret:
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	case base64.RawURLEncoding.EncodeToString(verifier[:]) != auth.challenge || r.Form.Get("redirect_uri") != auth.redirectURI:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(auth.claims), "token_type": "Bearer"})
+}
+
+func (m *mockOIDCProvider) sign(claims jwt.MapClaims) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = m.kid
+	signed, err := token.SignedString(m.key)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return signed
+}
+
+// authorize stands in for the user signing in at the provider. It returns
+// the code for an authorization URL, issuing an ID token with claims.
+func (m *mockOIDCProvider) authorize(authorizationURL string, claims jwt.MapClaims) string {
+	m.t.Helper()
+	u, err := url.Parse(authorizationURL)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != testOIDCClient || q.Get("response_type") != "code" {
+		m.t.Fatalf("bad authorization request: %s", authorizationURL)
+	}
+	now := time.Now()
+	full := jwt.MapClaims{
+		"iss":   m.server.URL,
+		"aud":   testOIDCClient,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": q.Get("nonce"),
+	}
+	for k, v := range claims {
+		full[k] = v
+	}
+	code := uuid.New().String()
+	m.mu.Lock()
+	m.codes[code] = mockAuthorization{challenge: q.Get("code_challenge"), redirectURI: q.Get("redirect_uri"), claims: full}
+	m.mu.Unlock()
+	return code
+}
+
+// useOIDC points the API at a fresh mock provider.
+func useOIDC(t *testing.T, extra map[string]string) *mockOIDCProvider {
+	m := newMockOIDCProvider(t)
+	env := map[string]string{
+		"OIDC_ISSUER":        m.server.URL,
+		"OIDC_CLIENT_ID":     testOIDCClient,
+		"OIDC_CLIENT_SECRET": testOIDCSecret,
+		"OIDC_REDIRECT_URL":  testOIDCRedirect,
+		"OIDC_ROLE_MAP":      "photo-admins:admin,photo-team:reviewer,staff:viewer",
+	}
+	for k, v := range extra {
+		env[k] = v
+	}
+	savedConfig, savedProvider := oidcConfig, oidcProviderCached
+	t.Cleanup(func() { oidcConfig, oidcProviderCached = savedConfig, savedProvider })
+	oidcProviderCached = nil
+	initOIDC(func(k string) string { return env[k] })
+	return m
+}
+
+// ssoLogin runs the browser side of the flow and returns the callback response.
+func (env *testEnv) ssoLogin(m *mockOIDCProvider, claims jwt.MapClaims) (LoginResponse, int) {
+	env.t.Helper()
+	verifier := "verifier-0123456789-0123456789-0123456789-abcdef"
+	challenge := sha256.Sum256([]byte(verifier))
+	body, _ := json.Marshal(OIDCStartRequest{CodeChallenge: base64.RawURLEncoding.EncodeToString(challenge[:])})
+	env.token = ""
+	resp := env.call("POST", "/api/auth/oidc/start", string(body))
+	var start OIDCStartResponse
+	json.Unmarshal([]byte(resp.Body), &start)
+	if resp.StatusCode != 200 {
+		env.t.Fatalf("start: %d %s", resp.StatusCode, resp.Body)
+	}
+
+	code := m.authorize(start.AuthorizationURL, claims)
+	body, _ = json.Marshal(OIDCCallbackRequest{Code: code, State: start.State, CodeVerifier: verifier})
+	resp = env.call("POST", "/api/auth/oidc/callback", string(body))
+	var lr LoginResponse
+	json.Unmarshal([]byte(resp.Body), &lr)
+	env.token = lr.Token
+	return lr, resp.StatusCode
+}
+
+func TestOIDCLogin(t *testing.T) {
+	env := newTestEnv(t)
+	m := useOIDC(t, nil)
+
+	resp := env.call("GET", "/api/auth/oidc/config", "")
+	var cfg OIDCConfigResponse
+	json.Unmarshal([]byte(resp.Body), &cfg)
+	if !cfg.Enabled || cfg.DisplayName != "SSO" {
+		t.Errorf("config = %+v", cfg)
+	}
+
+	// First login provisions the user with the highest mapped role
+	claims := jwt.MapClaims{"sub": "u-1", "preferred_username": "ann", "groups": []string{"staff", "photo-team"}}
+	lr, code := env.ssoLogin(m, claims)
+	if code != 200 || lr.Username != "ann" || lr.Role != roleReviewer {
+		t.Fatalf("first login: %d %+v", code, lr)
+	}
+	if resp := env.call("PUT", "/api/images/missing", `{"groupNumber":1}`); resp.StatusCode == 401 || resp.StatusCode == 403 {
+		t.Errorf("SSO session rejected: %d", resp.StatusCode)
+	}
+
+	// The role follows the groups on later logins
+	claims["groups"] = []string{"staff"}
+	if lr, code := env.ssoLogin(m, claims); code != 200 || lr.Role != roleViewer {
+		t.Errorf("second login: %d %+v", code, lr)
+	}
+
+	// SSO users have no password to log in with
+	if resp := env.call("POST", "/api/login", `{"username":"ann","password":""}`); resp.StatusCode != 401 {
+		t.Errorf("password login for SSO user: status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestOIDCLoginRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		claims   jwt.MapClaims
+		wantCode int
+	}{
+		{"no mapped group", jwt.MapClaims{"sub": "u-2", "preferred_username": "bob", "groups": []string{"contractors"}}, 403},
+		{"unusable username", jwt.MapClaims{"sub": "u-3", "preferred_username": "bob smith", "groups": "staff"}, 403},
+		{"local account with the same name", jwt.MapClaims{"sub": "u-4", "preferred_username": testUser, "groups": "photo-admins"}, 409},
+		{"wrong audience", jwt.MapClaims{"sub": "u-5", "preferred_username": "eve", "groups": "staff", "aud": "other-app"}, 401},
+		{"wrong nonce", jwt.MapClaims{"sub": "u-6", "preferred_username": "eve", "groups": "staff", "nonce": "replayed"}, 401},
+		{"expired", jwt.MapClaims{"sub": "u-7", "preferred_username": "eve", "groups": "staff", "exp": time.Now().Add(-time.Minute).Unix()}, 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			m := useOIDC(t, nil)
+			if _, code := env.ssoLogin(m, tt.claims); code != tt.wantCode {
+				t.Errorf("status = %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+
+	t.Run("default role", func(t *testing.T) {
+		env := newTestEnv(t)
+		m := useOIDC(t, map[string]string{"OIDC_DEFAULT_ROLE": roleViewer})
+		claims := jwt.MapClaims{"sub": "u-8", "preferred_username": "bob", "groups": []string{"contractors"}}
+		if lr, code := env.ssoLogin(m, claims); code != 200 || lr.Role != roleViewer {
+			t.Errorf("login: %d %+v", code, lr)
+		}
+	})
+
+	t.Run("another subject cannot take over an SSO account", func(t *testing.T) {
+		env := newTestEnv(t)
+		m := useOIDC(t, nil)
+		env.ssoLogin(m, jwt.MapClaims{"sub": "u-9", "preferred_username": "cat", "groups": "staff"})
+		if _, code := env.ssoLogin(m, jwt.MapClaims{"sub": "u-10", "preferred_username": "cat", "groups": "photo-admins"}); code != 409 {
+			t.Errorf("status = %d, want 409", code)
+		}
+	})
+
+	t.Run("tampered state and bad verifier", func(t *testing.T) {
+		env := newTestEnv(t)
+		m := useOIDC(t, nil)
+		body := `{"code":"x","state":"not-a-token","codeVerifier":"v"}`
+		if resp := env.call("POST", "/api/auth/oidc/callback", body); resp.StatusCode != 401 {
+			t.Errorf("tampered state: status = %d, want 401", resp.StatusCode)
+		}
+
+		challenge := sha256.Sum256([]byte("the-real-verifier"))
+		resp := env.call("POST", "/api/auth/oidc/start", `{"codeChallenge":"`+base64.RawURLEncoding.EncodeToString(challenge[:])+`"}`)
+		var start OIDCStartResponse
+		json.Unmarshal([]byte(resp.Body), &start)
+		code := m.authorize(start.AuthorizationURL, jwt.MapClaims{"sub": "u-11", "preferred_username": "eve", "groups": "staff"})
+		cb, _ := json.Marshal(OIDCCallbackRequest{Code: code, State: start.State, CodeVerifier: "an-intercepted-code-needs-this"})
+		if resp := env.call("POST", "/api/auth/oidc/callback", string(cb)); resp.StatusCode != 401 {
+			t.Errorf("bad verifier: status = %d, want 401", resp.StatusCode)
+		}
+	})
+
+	t.Run("not configured", func(t *testing.T) {
+		env := newTestEnv(t)
+		saved := oidcConfig
+		oidcConfig = nil
+		t.Cleanup(func() { oidcConfig = saved })
+		if resp := env.call("POST", "/api/auth/oidc/start", `{}`); resp.StatusCode != 404 {
+			t.Errorf("status = %d, want 404", resp.StatusCode)
+		}
+	})
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	env := newTestEnv(t)
+	m := useOIDC(t, nil)
+	claims := jwt.MapClaims{"sub": "u-1", "preferred_username": "ann", "groups": "staff"}
+	if _, code := env.ssoLogin(m, claims); code != 200 {
+		t.Fatalf("login: %d", code)
+	}
+
+	// The provider rotates its key; the cached keys are refetched
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	m.mu.Lock()
+	m.key, m.kid = key, "mock-2"
+	m.mu.Unlock()
+	if _, code := env.ssoLogin(m, claims); code != 200 {
+		t.Errorf("login after rotation: %d", code)
+	}
+}
+
+func TestParseOIDCRoleMap(t *testing.T) {
+	roles, err := parseOIDCRoleMap("urn:group:admins:admin, team:reviewer")
+	if err != nil || roles["urn:group:admins"] != roleAdmin || roles["team"] != roleReviewer {
+		t.Errorf("roles = %v, %v", roles, err)
+	}
+	if _, err := parseOIDCRoleMap("team:owner"); err == nil {
+		t.Error("unknown role accepted")
+	}
+}
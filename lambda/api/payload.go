@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Lambda responses can't be larger than 6MB. Image listings stay well under
+// it: they read only the attributes of the field set the client asks for
+// with fields=, stop a page early once its images would pass listMaxBytes,
+// and are gzipped for clients that accept it.
+
+const (
+	// listMaxBytes bounds the images on a page, as JSON, leaving room under
+	// the limit for the rest of the response when it isn't compressed.
+	listMaxBytes = 4 << 20
+
+	// Responses smaller than this go uncompressed
+	gzipMinBytes = 1024
+)
+
+// imageFields is a fields= option: the image attributes a listing reads,
+// all of them when attrs is nil, and how listed images are trimmed to it.
+type imageFields struct {
+	attrs []string
+	trim  func(ImageResponse) ImageResponse
+}
+
+// gridAttrs are what a thumbnail grid shows and acts on.
+var gridAttrs = []string{
+	"ImageGUID", "OriginalFile", "OriginalFilename", "RawFile", "Thumbnail50", "Thumbnail400", "Bucket",
+	"Width", "Height", "FileSize", "Reviewed", "GroupNumber", "ColorCode", "Rating", "Promoted",
+	"InsertedDateTime", "UpdatedDateTime", "CaptureDate", "MoveStatus", "Status", "ProjectID", "Version",
+}
+
+var imageFieldSets = map[string]imageFields{
+	"grid": {gridAttrs, gridImage},
+	// review adds what the review screens filter and group by
+	"review": {append(append([]string{}, gridAttrs...), "Keywords", "EXIFData.DateTimeOriginal", "EXIFData.DateTime"), listedImage},
+	"full":   {nil, func(img ImageResponse) ImageResponse { return img }},
+}
+
+// parseImageFields reads fields= (grid, review or full), defaulting to def.
+func parseImageFields(params map[string]string, def string) (imageFields, error) {
+	name := params["fields"]
+	if name == "" {
+		name = def
+	}
+	fields, ok := imageFieldSets[name]
+	if !ok {
+		return imageFields{}, fmt.Errorf("fields must be grid, review or full")
+	}
+	return fields, nil
+}
+
+// gridImage strips an image down to the grid fields. Filters can read other
+// attributes, which aren't returned.
+func gridImage(img ImageResponse) ImageResponse {
+	img = listedImage(img)
+	img.Keywords, img.EXIFData = nil, nil
+	return img
+}
+
+// listedAttrs are read whatever the field set, for listImages to order and
+// page by and for the handlers to deduplicate and hide project images.
+var listedAttrs = []string{
+	"ImageGUID", "Status", "ProjectID", "OriginalFile", "InsertedDateTime", "UpdatedDateTime", "CaptureDate", "CaptureYear",
+}
+
+// project makes queries read only the field set's attributes, plus those
+// listing needs: listedAttrs, the sort attribute and whatever the queries
+// name, which their filters may test after reading.
+func (f imageFields) project(queries []ItemQuery, order imageOrder) []ItemQuery {
+	if f.attrs == nil {
+		return queries
+	}
+	projected := make([]ItemQuery, len(queries))
+	for i, q := range queries {
+		q = copyQuery(q)
+		attrs := append(append(append([]string{}, f.attrs...), listedAttrs...), order.attr)
+		for _, name := range q.Names {
+			attrs = append(attrs, aws.StringValue(name))
+		}
+
+		whole := make(map[string]bool)
+		for _, attr := range attrs {
+			whole[attr] = true
+		}
+		var paths []string
+		seen := make(map[string]bool)
+		placeholders := make(map[string]string)
+		for _, attr := range attrs {
+			// DynamoDB rejects paths that overlap
+			top, _, nested := strings.Cut(attr, ".")
+			if seen[attr] || (nested && whole[top]) {
+				continue
+			}
+			seen[attr] = true
+			var path []string
+			for _, part := range strings.Split(attr, ".") {
+				if placeholders[part] == "" {
+					placeholders[part] = fmt.Sprintf("#f%d", len(placeholders))
+					q.Names[placeholders[part]] = aws.String(part)
+				}
+				path = append(path, placeholders[part])
+			}
+			paths = append(paths, strings.Join(path, "."))
+		}
+		q.Projection = strings.Join(paths, ", ")
+		projected[i] = q
+	}
+	return projected
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(request events.APIGatewayProxyRequest) bool {
+	value := request.Headers["Accept-Encoding"]
+	if value == "" {
+		value = request.Headers["accept-encoding"]
+	}
+	for _, coding := range strings.Split(value, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		// q=0 means not acceptable
+		if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// listResponse is a 200 response with v as its JSON body, gzipped when the
+// request accepts it and the body is large enough to be worth it.
+func listResponse(request events.APIGatewayProxyRequest, v interface{}, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	body, _ := json.Marshal(v)
+	responseHeaders := make(map[string]string, len(headers)+2)
+	for k, h := range headers {
+		responseHeaders[k] = h
+	}
+	responseHeaders["Vary"] = "Accept-Encoding"
+	if len(body) < gzipMinBytes || !acceptsGzip(request) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 200,
+			Headers:    responseHeaders,
+			Body:       string(body),
+		}, nil
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(body)
+	zw.Close()
+	responseHeaders["Content-Encoding"] = "gzip"
+	return events.APIGatewayProxyResponse{
+		StatusCode:      200,
+		Headers:         responseHeaders,
+		Body:            base64.StdEncoding.EncodeToString(compressed.Bytes()),
+		IsBase64Encoded: true,
+	}, nil
+}
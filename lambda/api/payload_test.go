@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestListImageFields(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedImage("a", map[string]interface{}{
+		"Keywords": []string{"beach"}, "Description": "A beach at dusk",
+		"EXIFData": map[string]string{"DateTimeOriginal": "2025:06:01 10:00:00", "Model": "X100V"},
+	})
+	env.login()
+
+	for _, tc := range []struct {
+		fields      string
+		keywords    bool
+		exif        map[string]string
+		description string
+	}{
+		{"grid", false, nil, ""},
+		{"", true, map[string]string{"DateTimeOriginal": "2025:06:01 10:00:00"}, ""},
+		{"review", true, map[string]string{"DateTimeOriginal": "2025:06:01 10:00:00"}, ""},
+		{"full", true, map[string]string{"DateTimeOriginal": "2025:06:01 10:00:00", "Model": "X100V"}, "A beach at dusk"},
+	} {
+		resp := env.call("GET", "/api/images?state=all&fields="+tc.fields, "")
+		var page PaginatedImageResponse
+		if err := json.Unmarshal([]byte(resp.Body), &page); err != nil || len(page.Images) != 1 {
+			t.Fatalf("fields=%s: %d %s", tc.fields, resp.StatusCode, resp.Body)
+		}
+		img := page.Images[0]
+		if img.OriginalFile == "" || (len(img.Keywords) > 0) != tc.keywords ||
+			fmt.Sprint(img.EXIFData) != fmt.Sprint(tc.exif) || img.Description != tc.description {
+			t.Errorf("fields=%s: got %+v", tc.fields, img)
+		}
+	}
+
+	if resp := env.call("GET", "/api/images?fields=everything", ""); resp.StatusCode != 400 {
+		t.Errorf("fields=everything: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestListImagesGzip(t *testing.T) {
+	env := newTestEnv(t)
+	for i := 0; i < 20; i++ {
+		env.seedImage(fmt.Sprintf("i%02d", i), nil)
+	}
+	env.login()
+
+	for _, tc := range []struct {
+		accept string
+		gzip   bool
+	}{
+		{"gzip, deflate, br", true},
+		{"br;q=1.0, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"", false},
+	} {
+		resp := env.callWithHeaders("GET", "/api/images?state=all", "", map[string]string{"Accept-Encoding": tc.accept})
+		body := []byte(resp.Body)
+		if resp.IsBase64Encoded != tc.gzip || (resp.Headers["Content-Encoding"] == "gzip") != tc.gzip {
+			t.Errorf("%q: base64 %v, headers %v", tc.accept, resp.IsBase64Encoded, resp.Headers)
+			continue
+		}
+		if tc.gzip {
+			compressed, err := base64.StdEncoding.DecodeString(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body, err = io.ReadAll(zr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var page PaginatedImageResponse
+		if err := json.Unmarshal(body, &page); err != nil || len(page.Images) != 20 {
+			t.Errorf("%q: %d images, %v", tc.accept, len(page.Images), err)
+		}
+	}
+
+	// Small responses aren't worth compressing
+	resp := env.callWithHeaders("GET", "/api/images?state=all&limit=1&fields=grid", "", map[string]string{"accept-encoding": "gzip"})
+	if resp.IsBase64Encoded || resp.Headers["Vary"] != "Accept-Encoding" {
+		t.Errorf("small page: base64 %v, headers %v", resp.IsBase64Encoded, resp.Headers)
+	}
+}
+
+func TestListImagesByteBudget(t *testing.T) {
+	env := newTestEnv(t)
+	// Five 1MB descriptions don't fit on one page
+	for i := 0; i < 5; i++ {
+		env.seedImage(fmt.Sprintf("i%d", i), map[string]interface{}{"Description": strings.Repeat("x", 1<<20)})
+	}
+	env.login()
+
+	for _, params := range []string{"fields=full&limit=100", "fields=full&limit=100&sort=filename"} {
+		ids, pages := env.listAll("/api/images", params)
+		if len(ids) != 5 || pages < 2 {
+			t.Errorf("%s: got %v in %d pages", params, ids, pages)
+		}
+	}
+	// The grid leaves descriptions out, so it fits
+	if ids, pages := env.listAll("/api/images", "fields=grid&limit=100"); len(ids) != 5 || pages != 1 {
+		t.Errorf("grid: got %v in %d pages", ids, pages)
+	}
+}
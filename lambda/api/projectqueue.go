@@ -0,0 +1,461 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Adding a group, or all approved images, to a project runs as an
+// add-to-project job. The job selects the images and queues a message per
+// image on the project image queue. Workers, this function through the
+// queue's event source with bounded concurrency, each move an image into
+// the project. The image record and the project's ImageCount are written
+// in one transaction, so however often a message is delivered the image is
+// counted once; the job counts it once too, through a marker item. The
+// worker that does the job's last image finishes it.
+
+const (
+	// projectImageBatch is the most messages SendMessageBatch takes.
+	projectImageBatch = 10
+	// maxProjectImageReceives is the queue's maxReceiveCount in
+	// template.yaml: an image failing on its last delivery counts as failed.
+	maxProjectImageReceives = 3
+)
+
+// ProjectImageMessage asks a worker to add an image to a project for a job.
+// Attempt is the run of the job that queued it; messages still queued from
+// a run before a retry are dropped.
+type ProjectImageMessage struct {
+	JobID     string `json:"jobId"`
+	Attempt   int    `json:"attempt"`
+	ProjectID string `json:"projectId"`
+	ImageGUID string `json:"imageGUID"`
+}
+
+// enqueueProjectImages queues up to projectImageBatch messages, returning
+// why each image that could not be queued failed. It is a variable so
+// self-hosted mode can run the workers in-process instead.
+var enqueueProjectImages = sendProjectImageMessages
+
+func sendProjectImageMessages(msgs []ProjectImageMessage) map[string]error {
+	entries := make([]*sqs.SendMessageBatchRequestEntry, len(msgs))
+	for i, msg := range msgs {
+		body, _ := json.Marshal(msg)
+		entries[i] = &sqs.SendMessageBatchRequestEntry{
+			Id:          aws.String(strconv.Itoa(i)),
+			MessageBody: aws.String(string(body)),
+		}
+	}
+	result, err := sqsClient.SendMessageBatch(&sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(projectImageQueueURL),
+		Entries:  entries,
+	})
+	failed := map[string]error{}
+	if err != nil {
+		for _, msg := range msgs {
+			failed[msg.ImageGUID] = err
+		}
+		return failed
+	}
+	for _, f := range result.Failed {
+		if i, err := strconv.Atoi(aws.StringValue(f.Id)); err == nil && i < len(msgs) {
+			failed[msgs[i].ImageGUID] = errors.New(aws.StringValue(f.Message))
+		}
+	}
+	return failed
+}
+
+// projectImageCandidates returns the images an add of a group or of all
+// approved images takes: approved ones, and reviewed inbox ones whose async
+// move may not have completed yet.
+func projectImageCandidates(req AddToProjectRequest) ([]Item, error) {
+	var queries []ItemQuery
+	if !req.All && req.Group > 0 {
+		// Use GroupStatusIndex for efficient group-scoped queries
+		for _, status := range []string{"approved", "inbox"} {
+			q := ItemQuery{
+				Index:        "GroupStatusIndex",
+				KeyCondition: "GroupNumber = :group",
+				Filter:       "#status = :status",
+				Names:        map[string]*string{"#status": aws.String("Status")},
+				Values: map[string]*dynamodb.AttributeValue{
+					":group":  {N: aws.String(fmt.Sprintf("%d", req.Group))},
+					":status": {S: aws.String(status)},
+				},
+			}
+			if status == "inbox" {
+				q.Filter += " AND Reviewed = :reviewed"
+				q.Values[":reviewed"] = &dynamodb.AttributeValue{S: aws.String("true")}
+			}
+			queries = append(queries, q)
+		}
+	} else {
+		for _, status := range []string{"approved", "inbox"} {
+			q := ItemQuery{
+				Index:        "StatusIndex",
+				KeyCondition: "#status = :status",
+				Names:        map[string]*string{"#status": aws.String("Status")},
+				Values: map[string]*dynamodb.AttributeValue{
+					":status": {S: aws.String(status)},
+				},
+			}
+			if status == "inbox" {
+				q.Filter = "Reviewed = :reviewed AND GroupNumber > :zero"
+				q.Values[":reviewed"] = &dynamodb.AttributeValue{S: aws.String("true")}
+				q.Values[":zero"] = &dynamodb.AttributeValue{N: aws.String("0")}
+			}
+			queries = append(queries, q)
+		}
+	}
+
+	var images []Item
+	for _, q := range queries {
+		items, err := queryAllPages(q)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, items...)
+	}
+	return images, nil
+}
+
+// runAddToProjectJob queues the images of an AddToProjectRequest for the
+// workers. Images that can't be queued count as failed.
+func runAddToProjectJob(run *jobRun) error {
+	var req AddToProjectRequest
+	if err := json.Unmarshal([]byte(run.job.Params), &req); err != nil {
+		return fmt.Errorf("invalid add to project parameters: %v", err)
+	}
+	items, err := projectImageCandidates(req)
+	if err != nil {
+		return fmt.Errorf("failed to query images: %v", err)
+	}
+	// The total is set before any image is queued, so no worker can find
+	// the job done early
+	run.setTotal(len(items))
+	for start := 0; start < len(items); start += projectImageBatch {
+		if run.canceled() {
+			return errJobCanceled
+		}
+		var msgs []ProjectImageMessage
+		for _, item := range items[start:min(start+projectImageBatch, len(items))] {
+			msgs = append(msgs, ProjectImageMessage{
+				JobID:     run.job.JobID,
+				Attempt:   run.job.Attempts,
+				ProjectID: run.job.ProjectID,
+				ImageGUID: attrString(item["ImageGUID"]),
+			})
+		}
+		for imageGUID, err := range enqueueProjectImages(msgs) {
+			run.recordError(imageGUID, fmt.Errorf("failed to queue: %v", err))
+			if err := countQueuedItems(run, imageGUID, 0, 1); err != nil {
+				fmt.Printf("Error counting image %s that failed to queue: %v\n", imageGUID, err)
+			}
+		}
+	}
+	fmt.Printf("Job %s queued %d images for project %s\n", run.job.JobID, len(items), run.job.ProjectID)
+	// Every image may be done, or have failed to queue, already
+	if err := countQueuedItems(run, "", 0, 0); err != nil {
+		return err
+	}
+	return errJobItemsQueued
+}
+
+// countQueuedItems counts items of a job whose items were queued as done and
+// failed, and finishes the job once each has been counted. Counts for a run
+// the job has been retried since are dropped. An item's count is made once
+// for the run, however often its message is delivered: it is written in one
+// transaction with a marker item for the item and run, and skipped when the
+// marker exists. Without imageGUID only the finish is checked.
+func countQueuedItems(run *jobRun, imageGUID string, done, failed int) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	attempt := Item{":attempt": jobCount(run.job.Attempts), ":updated": {S: aws.String(now)}}
+	count := ItemUpdate{
+		Expression: "SET UpdatedAt = :updated ADD Done :done, Failed :failed",
+		Condition:  "Attempts = :attempt",
+		Values:     withValues(attempt, Item{":done": jobCount(done), ":failed": jobCount(failed)}),
+	}
+	if imageGUID != "" {
+		err := jobStore.UpdateJobs([]KeyedUpdate{
+			{ID: queuedItemMarker(run, imageGUID), ItemUpdate: ItemUpdate{
+				Expression: "SET ExpiresAt = :expires",
+				Condition:  "attribute_not_exists(JobID)",
+				Values:     Item{":expires": {N: aws.String(strconv.FormatInt(run.job.ExpiresAt, 10))}},
+			}},
+			{ID: run.job.JobID, ItemUpdate: count},
+		})
+		if isConditionFailed(err) {
+			fmt.Printf("Job %s counted image %s of attempt %d already, or has been retried\n", run.job.JobID, imageGUID, run.job.Attempts)
+		} else if err != nil {
+			return fmt.Errorf("failed to count image %s on job %s: %v", imageGUID, run.job.JobID, err)
+		}
+		// Read the counts back through an update, which sees all of them,
+		// including when this delivery's count was made by an earlier one
+		count = ItemUpdate{Expression: "SET UpdatedAt = :updated", Condition: "Attempts = :attempt", Values: attempt}
+	}
+	count.ReturnValues = dynamodb.ReturnValueAllNew
+	counted, err := jobStore.UpdateJob(run.job.JobID, count)
+	if isConditionFailed(err) {
+		fmt.Printf("Job %s has been retried, not counting items of attempt %d\n", run.job.JobID, run.job.Attempts)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update job %s: %v", run.job.JobID, err)
+	}
+	var job Job
+	dynamodbattribute.UnmarshalMap(counted, &job)
+	if job.Status == jobRunning && job.Done+job.Failed >= job.Total {
+		finishJob(job.JobID, nil)
+	}
+	return nil
+}
+
+// queuedItemMarker is the ID of the item in the jobs table that records an
+// image of a run of a job has been counted.
+func queuedItemMarker(run *jobRun, imageGUID string) string {
+	return fmt.Sprintf("%s#%d#%s", run.job.JobID, run.job.Attempts, imageGUID)
+}
+
+// handleProjectImageMessages runs a batch of messages from the project image
+// queue, reporting the ones to deliver again.
+func handleProjectImageMessages(records []events.SQSMessage) events.SQSEventResponse {
+	var resp events.SQSEventResponse
+	for _, r := range records {
+		var msg ProjectImageMessage
+		if err := json.Unmarshal([]byte(r.Body), &msg); err != nil {
+			fmt.Printf("Dropping malformed project image message %s: %v\n", r.MessageId, err)
+			continue
+		}
+		receives, _ := strconv.Atoi(r.Attributes["ApproximateReceiveCount"])
+		if err := addQueuedProjectImage(msg, receives); err != nil {
+			fmt.Printf("Adding image %s to project %s failed, delivery %d: %v\n", msg.ImageGUID, msg.ProjectID, receives, err)
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: r.MessageId})
+		}
+	}
+	return resp
+}
+
+// addQueuedProjectImage adds a queued image to its project and counts it on
+// the job. It returns an error for the queue to deliver the message again,
+// until its last delivery, when the image is counted as failed.
+func addQueuedProjectImage(msg ProjectImageMessage, receives int) error {
+	job, err := getJob(msg.JobID)
+	if err != nil {
+		return fmt.Errorf("failed to get job: %v", err)
+	}
+	if job == nil || job.Status != jobRunning {
+		fmt.Printf("Job %s is not running, dropping image %s\n", msg.JobID, msg.ImageGUID)
+		return nil
+	}
+	if job.Attempts != msg.Attempt {
+		fmt.Printf("Job %s has been retried, dropping image %s from attempt %d\n", msg.JobID, msg.ImageGUID, msg.Attempt)
+		return nil
+	}
+	run := &jobRun{job: *job}
+	if job.CancelRequested {
+		finishJob(job.JobID, errJobCanceled)
+		return nil
+	}
+
+	// Delivered again after it was counted, the image is in the project
+	// already and its count is skipped
+	_, err = addProjectImage(msg.ProjectID, msg.ImageGUID)
+	if err != nil && receives < maxProjectImageReceives {
+		return err
+	}
+	if err != nil {
+		run.recordError(msg.ImageGUID, err)
+		return countQueuedItems(run, msg.ImageGUID, 0, 1)
+	}
+	return countQueuedItems(run, msg.ImageGUID, 1, 0)
+}
+
+// addProjectImage is addImageToProject for IDs, as queued.
+func addProjectImage(projectID, imageGUID string) (bool, error) {
+	projItem, err := projectStore.GetProject(projectID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get project: %v", err)
+	}
+	if projItem == nil {
+		return false, fmt.Errorf("project not found: %s", projectID)
+	}
+	var project Project
+	dynamodbattribute.UnmarshalMap(projItem, &project)
+	imgItem, err := imageStore.GetImage(imageGUID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get image: %v", err)
+	}
+	if imgItem == nil {
+		fmt.Printf("Image %s no longer exists, skipping\n", imageGUID)
+		return false, nil
+	}
+	var img ImageResponse
+	dynamodbattribute.UnmarshalMap(imgItem, &img)
+	return addImageToProject(img, project)
+}
+
+// addImageToProject moves an image's files into the project, generating AI
+// keywords and a description if it has none, and saves it there. It reports
+// false when the image was not added: it is in the project already, has gone
+// or another project took it meanwhile.
+func addImageToProject(img ImageResponse, project Project) (bool, error) {
+	var destPrefix string
+	var newPaths map[string]string
+	for attempt := 0; ; attempt++ {
+		if img.Status == "project" && img.ProjectID == project.ProjectID && img.MoveJournal == nil {
+			fmt.Printf("Image %s is in project %s already\n", img.ImageGUID, project.ProjectID)
+			return false, nil
+		}
+		destPrefix = fmt.Sprintf("projects/%s/%s", getProjectS3Prefix(project), buildDatePath(getImageDate(img)))
+		fmt.Printf("Moving image %s: src=%s -> dest=%s/\n", img.ImageGUID, img.OriginalFile, destPrefix)
+		var err error
+		newPaths, err = moveImageFiles(img, destPrefix)
+		if err == nil {
+			break
+		}
+		// If the source file is missing, the async move may have relocated
+		// it, or it may be relocating it now. Re-read the image and retry
+		// with its new paths.
+		if attempt > 0 || !(errors.Is(err, ErrSourceFileMissing) || errors.Is(err, errMoveConflict)) {
+			return false, err
+		}
+		item, getErr := imageStore.GetImage(img.ImageGUID)
+		if getErr != nil {
+			return false, getErr
+		}
+		if item == nil {
+			fmt.Printf("Image %s no longer exists, skipping\n", img.ImageGUID)
+			return false, nil
+		}
+		var refreshed ImageResponse
+		dynamodbattribute.UnmarshalMap(item, &refreshed)
+		if refreshed.OriginalFile == img.OriginalFile {
+			return false, err
+		}
+		fmt.Printf("Image %s paths updated by async move, retrying with new paths\n", img.ImageGUID)
+		img = refreshed
+	}
+
+	// Build list of raw files for DynamoDB
+	var rawFilesList []*dynamodb.AttributeValue
+	if rawFilesStr := newPaths["rawFiles"]; rawFilesStr != "" {
+		for _, rf := range strings.Split(rawFilesStr, ",") {
+			if rf != "" {
+				rawFilesList = append(rawFilesList, &dynamodb.AttributeValue{S: aws.String(rf)})
+			}
+		}
+	}
+
+	// Generate AI keywords and description if not already present
+	var aiResult *AIAnalysisResult
+	if img.Description == "" && openaiAPIKey != "" {
+		fmt.Printf("Generating AI analysis for image %s (added to project)\n", img.ImageGUID)
+		var err error
+		aiResult, err = analyzeImageWithGPT4o(newPaths["thumbnail400"])
+		if err != nil {
+			fmt.Printf("AI analysis failed for image %s: %v\n", img.ImageGUID, err)
+		} else {
+			fmt.Printf("AI analysis complete for image %s: %d keywords\n", img.ImageGUID, len(aiResult.Keywords))
+		}
+	}
+
+	saved, err := saveProjectImage(img, project.ProjectID, func(cur ImageResponse) ItemUpdate {
+		update := ItemUpdate{
+			Expression: "SET OriginalFile = :orig, Thumbnail50 = :t50, Thumbnail400 = :t400, #status = :status, ProjectID = :proj, UpdatedDateTime = :updated",
+			Values: map[string]*dynamodb.AttributeValue{
+				":orig":    {S: aws.String(newPaths["original"])},
+				":t50":     {S: aws.String(newPaths["thumbnail50"])},
+				":t400":    {S: aws.String(newPaths["thumbnail400"])},
+				":status":  {S: aws.String("project")},
+				":proj":    {S: aws.String(project.ProjectID)},
+				":updated": {S: aws.String(time.Now().Format(time.RFC3339))},
+			},
+			Names: map[string]*string{
+				"#status": aws.String("Status"),
+			},
+		}
+
+		// Add RelatedFiles if we found any RAW files
+		if len(rawFilesList) > 0 {
+			update.Expression += ", RelatedFiles = :rawFiles"
+			update.Values[":rawFiles"] = &dynamodb.AttributeValue{L: rawFilesList}
+		}
+
+		// Add the AI description and keywords merged into the current ones
+		if aiResult != nil {
+			ai := aiAnalysisUpdate(cur.Keywords, aiResult)
+			update.Expression += ", " + strings.TrimPrefix(ai.Expression, "SET ")
+			for k, v := range ai.Values {
+				update.Values[k] = v
+			}
+			for k, v := range ai.Names {
+				update.Names[k] = v
+			}
+		}
+		return closeMoveJournal(update)
+	})
+	if err != nil {
+		fmt.Printf("Failed to update image record %s: %v\n", img.ImageGUID, err)
+		rollbackMoveOf(img.ImageGUID, destPrefix)
+		return false, err
+	}
+	if !saved {
+		fmt.Printf("Image %s was added to another project meanwhile, skipping\n", img.ImageGUID)
+		rollbackMoveOf(img.ImageGUID, destPrefix)
+		return false, nil
+	}
+	if aiResult != nil {
+		indexImageForSearch(img.ImageGUID)
+	}
+	return true, nil
+}
+
+// saveProjectImage writes the update build makes of an image into the
+// project and adds it to the project's ImageCount, in one transaction. The
+// files now live under the project, so a change made since img was read
+// (say the async move landing) is re-read and the update written over it,
+// as in updateImageVersioned, unless another project took the image
+// meanwhile. It reports whether the image was saved.
+func saveProjectImage(img ImageResponse, projectID string, build func(cur ImageResponse) ItemUpdate) (bool, error) {
+	fromProject := img.ProjectID
+	count := KeyedUpdate{ID: projectID, ItemUpdate: ItemUpdate{
+		Expression: "ADD ImageCount :one",
+		Values:     map[string]*dynamodb.AttributeValue{":one": {N: aws.String("1")}},
+	}}
+	for attempt := 0; ; attempt++ {
+		if img.Status == "project" && img.ProjectID != fromProject {
+			return false, nil
+		}
+		update := KeyedUpdate{ID: img.ImageGUID, ItemUpdate: versioned(build(img), img.Version)}
+		err := withRetryNoResult(func() error {
+			return imageStore.UpdateImageAndProject(update, count)
+		})
+		if !isConditionFailed(err) {
+			return err == nil, err
+		}
+		if attempt+1 >= versionRetries {
+			return false, errVersionConflict
+		}
+		current, err := withRetry(func() (Item, error) {
+			return imageStore.GetImage(img.ImageGUID)
+		})
+		if err != nil {
+			return false, err
+		}
+		if current == nil {
+			return false, nil
+		}
+		img = ImageResponse{}
+		dynamodbattribute.UnmarshalMap(current, &img)
+	}
+}
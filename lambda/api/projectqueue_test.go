@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// failingProjectSaves is an image store whose project transactions fail
+// failures times, first applying them when commit is set, like a write that
+// times out after it landed.
+type failingProjectSaves struct {
+	ImageStore
+	failures int
+	commit   bool
+}
+
+func (s *failingProjectSaves) UpdateImageAndProject(image, project KeyedUpdate) error {
+	if s.failures == 0 {
+		return s.ImageStore.UpdateImageAndProject(image, project)
+	}
+	s.failures--
+	if s.commit {
+		if err := s.ImageStore.UpdateImageAndProject(image, project); err != nil {
+			return err
+		}
+	}
+	return errors.New("request timed out")
+}
+
+// failingJobCounts is a job store whose transactions fail failures times
+// after applying them, like a count that times out after it landed.
+type failingJobCounts struct {
+	JobStore
+	failures int
+}
+
+func (s *failingJobCounts) UpdateJobs(updates []KeyedUpdate) error {
+	if err := s.JobStore.UpdateJobs(updates); err != nil || s.failures == 0 {
+		return err
+	}
+	s.failures--
+	return errors.New("request timed out")
+}
+
+// deliverProjectImages delivers the first n queued images, or all of them
+// without n, to the workers through handleEvent in batches of five, as the
+// queue's event source does. Failed ones are delivered again, like SQS,
+// until they run out of receives. It returns the number of deliveries.
+func (env *testEnv) deliverProjectImages(n ...int) int {
+	env.t.Helper()
+	limit := len(env.queued)
+	if len(n) > 0 && n[0] < limit {
+		limit = n[0]
+	}
+	pending := append([]ProjectImageMessage(nil), env.queued[:limit]...)
+	rest := env.queued[limit:]
+	receives := map[string]int{}
+	deliveries := 0
+	for len(pending) > 0 {
+		batch := pending[:min(5, len(pending))]
+		pending = pending[len(batch):]
+		byID := map[string]ProjectImageMessage{}
+		var records []events.SQSMessage
+		for _, msg := range batch {
+			id := msg.JobID + "/" + msg.ImageGUID
+			receives[id]++
+			byID[id] = msg
+			body, _ := json.Marshal(msg)
+			records = append(records, events.SQSMessage{
+				MessageId:   id,
+				Body:        string(body),
+				EventSource: "aws:sqs",
+				Attributes:  map[string]string{"ApproximateReceiveCount": strconv.Itoa(receives[id])},
+			})
+		}
+		event, _ := json.Marshal(events.SQSEvent{Records: records})
+		resp, err := handleEvent(context.Background(), event)
+		if err != nil {
+			env.t.Fatalf("deliver project images: %v", err)
+		}
+		deliveries += len(batch)
+		for _, f := range resp.(events.SQSEventResponse).BatchItemFailures {
+			if receives[f.ItemIdentifier] < maxProjectImageReceives {
+				pending = append(pending, byID[f.ItemIdentifier])
+			}
+		}
+	}
+	env.queued = rest
+	return deliveries
+}
+
+// addGroup adds group 1 to project trip, returning the queued job after it
+// has queued the images.
+func (env *testEnv) addGroup() Job {
+	env.t.Helper()
+	resp := env.call("POST", "/api/projects/trip/images", `{"group":1}`)
+	if resp.StatusCode != 202 {
+		env.t.Fatalf("add group: %d %s", resp.StatusCode, resp.Body)
+	}
+	var job Job
+	json.Unmarshal([]byte(resp.Body), &job)
+	if job.Type != jobAddToProject || job.ProjectID != "trip" || job.Status != jobQueued {
+		env.t.Fatalf("job = %+v, want a queued add to trip", job)
+	}
+	env.runAsyncMoves()
+	return env.job(job.JobID)
+}
+
+func TestAddToProjectQueuesImages(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	env.seedProject("trip", 0)
+	for i := 0; i < 12; i++ {
+		env.seedImage(fmt.Sprintf("img%02d", i), map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 1})
+	}
+	var batches []int
+	enqueue := enqueueProjectImages
+	enqueueProjectImages = func(msgs []ProjectImageMessage) map[string]error {
+		batches = append(batches, len(msgs))
+		return enqueue(msgs)
+	}
+
+	job := env.addGroup()
+	if job.Status != jobRunning || job.Total != 12 || len(env.queued) != 12 || fmt.Sprint(batches) != "[10 2]" {
+		t.Fatalf("job = %+v, %d queued in %v, want 12 running in batches of 10", job, len(env.queued), batches)
+	}
+	if img := env.image("img00"); img.Status != "approved" {
+		t.Errorf("Status = %q before the workers ran, want approved", img.Status)
+	}
+
+	// Progress is reported as the workers go
+	queued := append([]ProjectImageMessage(nil), env.queued...)
+	env.deliverProjectImages(5)
+	if job := env.job(job.JobID); job.Status != jobRunning || job.Done != 5 {
+		t.Errorf("job = %+v, want running with 5 done", job)
+	}
+	if got := env.project("trip").ImageCount; got != 5 {
+		t.Errorf("ImageCount = %d, want 5", got)
+	}
+
+	// Done images delivered again while the rest wait aren't counted twice,
+	// which would finish the job early
+	env.queued = append(append([]ProjectImageMessage(nil), queued[:5]...), env.queued...)
+	env.deliverProjectImages(5)
+	if job := env.job(job.JobID); job.Status != jobRunning || job.Done != 5 {
+		t.Errorf("job = %+v after redelivery, want running with 5 done", job)
+	}
+	env.deliverProjectImages()
+	if job := env.job(job.JobID); job.Status != jobSucceeded || job.Done != 12 || job.Failed != 0 {
+		t.Errorf("job = %+v, want succeeded with 12 done", job)
+	}
+	for _, msg := range queued {
+		env.assertFilesUnder(msg.ImageGUID, "projects/trip/"+testDatePath)
+	}
+
+	// Messages delivered again count nothing twice
+	env.queued = queued
+	env.deliverProjectImages()
+	if got := env.project("trip").ImageCount; got != 12 {
+		t.Errorf("ImageCount = %d after redelivery, want 12", got)
+	}
+	if job := env.job(job.JobID); job.Done != 12 {
+		t.Errorf("job = %+v after redelivery, want 12 done", job)
+	}
+
+	// Viewers can't add images
+	env.seedUser("viewer", roleViewer)
+	env.loginAs("viewer", testPassword)
+	if resp := env.call("POST", "/api/projects/trip/images", `{"all":true}`); resp.StatusCode != 403 {
+		t.Errorf("viewer add: %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestQueuedProjectImageRetried(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	env.seedProject("trip", 0)
+	env.seedImage("a", map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 1})
+	env.seedImage("b", map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 1})
+	env.seedImage("c", map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 1})
+	env.seedImage("d", map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 1})
+	store := &failingProjectSaves{ImageStore: imageStore}
+	imageStore = store
+	job := env.addGroup()
+
+	// Saved, but the worker never heard: delivered again, it is counted
+	// once on the job and in the project
+	store.failures, store.commit = 1, true
+	if n := env.deliverProjectImages(1); n != 2 {
+		t.Errorf("%d deliveries, want the first image delivered twice", n)
+	}
+	if got := env.project("trip").ImageCount; got != 1 {
+		t.Errorf("ImageCount = %d, want 1", got)
+	}
+
+	// Counted, but the worker never heard: delivered again, it is counted
+	// once on the job
+	jobStore = &failingJobCounts{JobStore: jobStore, failures: 1}
+	if n := env.deliverProjectImages(1); n != 2 {
+		t.Errorf("%d deliveries, want the second image delivered twice", n)
+	}
+	if job := env.job(job.JobID); job.Status != jobRunning || job.Done != 2 {
+		t.Errorf("job = %+v, want running with 2 done", job)
+	}
+	if got := env.project("trip").ImageCount; got != 2 {
+		t.Errorf("ImageCount = %d, want 2", got)
+	}
+
+	// Not saved: the move is rolled back and done again
+	id := env.queued[0].ImageGUID
+	store.failures, store.commit = 1, false
+	env.deliverProjectImages(1)
+	env.assertFilesUnder(id, "projects/trip/"+testDatePath)
+	if got := env.project("trip").ImageCount; got != 3 {
+		t.Errorf("ImageCount = %d, want 3", got)
+	}
+
+	// Failing on every delivery: rolled back and counted as failed
+	id = env.queued[0].ImageGUID
+	store.failures = maxProjectImageReceives
+	if n := env.deliverProjectImages(); n != maxProjectImageReceives {
+		t.Errorf("%d deliveries, want %d", n, maxProjectImageReceives)
+	}
+	env.assertFilesBack(id)
+	if img := env.image(id); img.Status != "approved" || img.MoveJournal != nil {
+		t.Errorf("image = %+v, want left approved", img)
+	}
+	job = env.job(job.JobID)
+	if job.Status != jobSucceeded || job.Done != 3 || job.Failed != 1 || len(job.Errors) != 1 || job.Errors[0].Item != id {
+		t.Errorf("job = %+v, want 3 done and %s failed", job, id)
+	}
+	if got := env.project("trip").ImageCount; got != 3 {
+		t.Errorf("ImageCount = %d, want 3", got)
+	}
+}
+
+func TestAddToProjectJobCanceledOrEmpty(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	env.seedProject("trip", 0)
+	env.seedImage("a", map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 1})
+	env.seedImage("b", map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 1})
+	failed := map[string]error{}
+	enqueue := enqueueProjectImages
+	enqueueProjectImages = func(msgs []ProjectImageMessage) map[string]error {
+		if len(failed) > 0 {
+			return failed
+		}
+		return enqueue(msgs)
+	}
+
+	// Stopped between images
+	job := env.addGroup()
+	env.deliverProjectImages(1)
+	if resp := env.call("POST", "/api/jobs/"+job.JobID+"/cancel", ""); resp.StatusCode != 200 {
+		t.Fatalf("cancel: %d %s", resp.StatusCode, resp.Body)
+	}
+	left := env.queued[0].ImageGUID
+	env.deliverProjectImages()
+	if job := env.job(job.JobID); job.Status != jobCanceled || job.Done != 1 {
+		t.Errorf("job = %+v, want canceled after 1 done", job)
+	}
+	if img := env.image(left); img.Status != "approved" {
+		t.Errorf("Status = %q, want the canceled image left alone", img.Status)
+	}
+
+	// Images that can't be queued fail; when none could be, the job ends
+	failed[left] = errors.New("queue unavailable")
+	job = env.addGroup()
+	if job.Status != jobSucceeded || job.Total != 1 || job.Failed != 1 || len(job.Errors) != 1 {
+		t.Errorf("job = %+v, want finished with its image failed to queue", job)
+	}
+
+	// Nothing to add
+	delete(failed, left)
+	env.call("DELETE", "/api/images/"+left, "")
+	if job := env.addGroup(); job.Status != jobSucceeded || job.Total != 0 {
+		t.Errorf("job = %+v, want succeeded with nothing to do", job)
+	}
+	if got := env.project("trip").ImageCount; got != 1 {
+		t.Errorf("ImageCount = %d, want 1", got)
+	}
+}
+
+func TestAddToProjectRetryDropsStaleImages(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	env.seedProject("trip", 0)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		env.seedImage(id, map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 1})
+	}
+	job := env.addGroup()
+	env.deliverProjectImages(1)
+	env.call("POST", "/api/jobs/"+job.JobID+"/cancel", "")
+	env.deliverProjectImages(1)
+	if job := env.job(job.JobID); job.Status != jobCanceled || len(env.queued) != 2 {
+		t.Fatalf("job = %+v with %d queued, want canceled with 2 left", job, len(env.queued))
+	}
+
+	// The images still queued from the first run count nothing on the retry
+	if resp := env.call("POST", "/api/jobs/"+job.JobID+"/retry", ""); resp.StatusCode != 202 {
+		t.Fatalf("retry: %d %s", resp.StatusCode, resp.Body)
+	}
+	env.runAsyncMoves()
+	if len(env.queued) != 5 || env.queued[2].Attempt != 2 {
+		t.Fatalf("queued = %+v, want 3 more for attempt 2", env.queued)
+	}
+	env.deliverProjectImages(2)
+	if job := env.job(job.JobID); job.Status != jobRunning || job.Total != 3 || job.Done != 0 {
+		t.Errorf("job = %+v after stale images, want running with none done", job)
+	}
+	env.deliverProjectImages()
+	if job := env.job(job.JobID); job.Status != jobSucceeded || job.Done != 3 || job.Failed != 0 {
+		t.Errorf("job = %+v, want succeeded with 3 done", job)
+	}
+	if got := env.project("trip").ImageCount; got != 4 {
+		t.Errorf("ImageCount = %d, want 4", got)
+	}
+}
@@ -0,0 +1,753 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// The q parameter of GET /api/images is a small filter language, e.g.
+//
+//	rating>=4 AND keyword:heron AND camera:"X-T5" AND taken:2025-06..2025-08 AND NOT project
+//
+// Terms are field:value (or field=value, !=, <, <=, >, >= where they make
+// sense), combined with AND, OR, NOT and parentheses; AND may be left out.
+// A query is planned as one GSI query when a top-level term pins Status,
+// GroupNumber or ProjectID, and otherwise as a query per status; everything
+// else becomes the filter expression. Deleted images only match queries that
+// ask for them with status:deleted.
+
+// queryFields lists the fields in the order parse errors name them.
+var queryFields = []string{"rating", "group", "keyword", "camera", "make", "model", "taken", "status", "project", "promoted"}
+
+// queryStatuses are the values status: accepts.
+var queryStatuses = []string{"inbox", "approved", "rejected", "deleted", "project"}
+
+// queryError is a parse error at a position in the query.
+type queryError struct {
+	pos int
+	msg string
+}
+
+func (e *queryError) Error() string {
+	return fmt.Sprintf("invalid query at position %d: %s", e.pos+1, e.msg)
+}
+
+type queryToken struct {
+	kind string // "word", "string", "op", "(", ")", "end"
+	text string
+	pos  int
+}
+
+func lexQuery(q string) ([]queryToken, error) {
+	var toks []queryToken
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			toks = append(toks, queryToken{kind: string(c), text: string(c), pos: i})
+			i++
+		case c == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(q) && q[j] != '"'; j++ {
+				if q[j] == '\\' && j+1 < len(q) {
+					j++
+				}
+				sb.WriteByte(q[j])
+			}
+			if j >= len(q) {
+				return nil, &queryError{i, "unterminated quoted string"}
+			}
+			toks = append(toks, queryToken{kind: "string", text: sb.String(), pos: i})
+			i = j + 1
+		case strings.ContainsRune(":=<>!", rune(c)):
+			op := string(c)
+			if i+1 < len(q) && q[i+1] == '=' && c != ':' && c != '=' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, &queryError{i, `expected "!="`}
+			}
+			toks = append(toks, queryToken{kind: "op", text: op, pos: i})
+			i += len(op)
+		default:
+			j := i
+			for j < len(q) && !strings.ContainsRune(" \t\n()\":=<>!", rune(q[j])) {
+				j++
+			}
+			toks = append(toks, queryToken{kind: "word", text: q[i:j], pos: i})
+			i = j
+		}
+	}
+	return append(toks, queryToken{kind: "end", pos: len(q)}), nil
+}
+
+// queryNode is a parsed query: queryAnd, queryOr, queryNot or queryTerm.
+type queryNode interface{}
+
+type queryAnd []queryNode
+type queryOr []queryNode
+type queryNot struct{ node queryNode }
+
+// queryTerm is one field test. op is empty for a bare field like "project".
+type queryTerm struct {
+	field string
+	op    string
+	value string
+	pos   int
+}
+
+type queryParser struct {
+	toks []queryToken
+	pos  int
+}
+
+func (p *queryParser) peek() queryToken { return p.toks[p.pos] }
+func (p *queryParser) next() queryToken {
+	t := p.toks[p.pos]
+	if t.kind != "end" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *queryParser) isWord(word string) bool {
+	t := p.peek()
+	return t.kind == "word" && strings.EqualFold(t.text, word)
+}
+
+// parseImageQuery parses a q parameter.
+func parseImageQuery(q string) (queryNode, error) {
+	toks, err := lexQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{toks: toks}
+	if p.peek().kind == "end" {
+		return nil, &queryError{0, "empty query"}
+	}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "end" {
+		return nil, &queryError{t.pos, fmt.Sprintf("unexpected %q", t.text)}
+	}
+	return node, nil
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	var terms queryOr
+	for {
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, node)
+		if !p.isWord("OR") {
+			break
+		}
+		p.next()
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return terms, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	var terms queryAnd
+	for {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, node)
+		if p.isWord("AND") {
+			p.next()
+			continue
+		}
+		// Juxtaposed terms are ANDed too
+		if t := p.peek(); t.kind == "end" || t.kind == ")" || p.isWord("OR") {
+			break
+		}
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return terms, nil
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	if p.isWord("NOT") {
+		p.next()
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return queryNot{node}, nil
+	}
+	t := p.next()
+	switch t.kind {
+	case "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != ")" {
+			return nil, &queryError{closing.pos, `expected ")"`}
+		}
+		return node, nil
+	case "word":
+		if strings.EqualFold(t.text, "AND") || strings.EqualFold(t.text, "OR") {
+			return nil, &queryError{t.pos, fmt.Sprintf("expected a term before %s", strings.ToUpper(t.text))}
+		}
+		return p.parseTerm(t)
+	case "end":
+		return nil, &queryError{t.pos, "unexpected end of query"}
+	}
+	return nil, &queryError{t.pos, fmt.Sprintf("unexpected %q", t.text)}
+}
+
+func (p *queryParser) parseTerm(field queryToken) (queryNode, error) {
+	term := queryTerm{field: strings.ToLower(field.text), pos: field.pos}
+	known := false
+	for _, f := range queryFields {
+		known = known || f == term.field
+	}
+	if !known {
+		return nil, &queryError{field.pos, fmt.Sprintf("unknown field %q; fields are %s", field.text, strings.Join(queryFields, ", "))}
+	}
+	if p.peek().kind != "op" {
+		if term.field != "project" && term.field != "promoted" {
+			return nil, &queryError{field.pos, fmt.Sprintf("%s needs a value, e.g. %s:...", term.field, term.field)}
+		}
+		return term, nil
+	}
+	term.op = p.next().text
+	value := p.next()
+	if value.kind != "word" && value.kind != "string" {
+		return nil, &queryError{value.pos, fmt.Sprintf("expected a value after %s%s", field.text, term.op)}
+	}
+	term.value = value.text
+	return term, nil
+}
+
+// queryFilter builds a filter expression and its names and values.
+type queryFilter struct {
+	names  map[string]*string
+	values Item
+}
+
+// name returns the expression name for a dotted attribute path.
+func (f *queryFilter) name(path string) string {
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		f.names["#"+part] = aws.String(part)
+		parts[i] = "#" + part
+	}
+	return strings.Join(parts, ".")
+}
+
+func (f *queryFilter) value(av *dynamodb.AttributeValue) string {
+	placeholder := fmt.Sprintf(":q%d", len(f.values))
+	f.values[placeholder] = av
+	return placeholder
+}
+
+func (f *queryFilter) str(s string) string {
+	return f.value(&dynamodb.AttributeValue{S: aws.String(s)})
+}
+func (f *queryFilter) num(n int) string {
+	return f.value(&dynamodb.AttributeValue{N: aws.String(strconv.Itoa(n))})
+}
+
+func orJoin(conds []string) string {
+	if len(conds) == 1 {
+		return conds[0]
+	}
+	return "(" + strings.Join(conds, " OR ") + ")"
+}
+
+// compile returns the filter expression for node.
+func (f *queryFilter) compile(node queryNode) (string, error) {
+	switch n := node.(type) {
+	case queryAnd, queryOr:
+		var parts []queryNode
+		joiner := " AND "
+		if or, ok := n.(queryOr); ok {
+			parts, joiner = or, " OR "
+		} else {
+			parts = n.(queryAnd)
+		}
+		conds := make([]string, len(parts))
+		for i, part := range parts {
+			cond, err := f.compile(part)
+			if err != nil {
+				return "", err
+			}
+			conds[i] = cond
+		}
+		return "(" + strings.Join(conds, joiner) + ")", nil
+	case queryNot:
+		cond, err := f.compile(n.node)
+		if err != nil {
+			return "", err
+		}
+		return "(NOT " + cond + ")", nil
+	case queryTerm:
+		if n.op == "!=" {
+			n.op = "="
+			cond, err := f.compileTerm(n)
+			if err != nil {
+				return "", err
+			}
+			return "(NOT " + cond + ")", nil
+		}
+		return f.compileTerm(n)
+	}
+	return "", fmt.Errorf("unknown query node %T", node)
+}
+
+func (f *queryFilter) compileTerm(t queryTerm) (string, error) {
+	bad := func(msg string) error { return &queryError{t.pos, msg} }
+	onlyEquals := func() error {
+		if t.op != ":" && t.op != "=" {
+			return bad(fmt.Sprintf("%s can't be compared with %s", t.field, t.op))
+		}
+		return nil
+	}
+
+	switch t.field {
+	case "rating", "group":
+		attr := "Rating"
+		if t.field == "group" {
+			attr = "GroupNumber"
+		}
+		lo, hi, err := parseQueryRange(t)
+		if err != nil {
+			return "", err
+		}
+		// A missing rating or group is 0
+		var conds []string
+		if lo == 0 {
+			conds = append(conds, "attribute_not_exists("+f.name(attr)+")")
+		}
+		if lo == hi {
+			conds = append(conds, f.name(attr)+" = "+f.num(lo))
+		} else {
+			conds = append(conds, f.name(attr)+" BETWEEN "+f.num(lo)+" AND "+f.num(hi))
+		}
+		return orJoin(conds), nil
+
+	case "keyword":
+		if err := onlyEquals(); err != nil {
+			return "", err
+		}
+		// Keywords are matched whole. DynamoDB compares case-sensitively, so
+		// the common spellings of the keyword are tried.
+		var conds []string
+		seen := map[string]bool{}
+		for _, kw := range []string{t.value, strings.ToLower(t.value), titleCase(t.value)} {
+			if !seen[kw] {
+				seen[kw] = true
+				conds = append(conds, "contains("+f.name("Keywords")+", "+f.str(kw)+")")
+			}
+		}
+		return orJoin(conds), nil
+
+	case "camera", "make", "model":
+		if err := onlyEquals(); err != nil {
+			return "", err
+		}
+		attrs := []string{"EXIFData.Make", "EXIFData.Model"}
+		if t.field == "make" {
+			attrs = attrs[:1]
+		} else if t.field == "model" {
+			attrs = attrs[1:]
+		}
+		value := f.str(t.value)
+		var conds []string
+		for _, attr := range attrs {
+			conds = append(conds, "contains("+f.name(attr)+", "+value+")")
+		}
+		return orJoin(conds), nil
+
+	case "taken":
+		return f.compileTaken(t)
+
+	case "status":
+		if err := onlyEquals(); err != nil {
+			return "", err
+		}
+		status := strings.ToLower(t.value)
+		if !containsString(queryStatuses, status) {
+			return "", bad(fmt.Sprintf("status must be one of %s, got %q", strings.Join(queryStatuses, ", "), t.value))
+		}
+		return f.name("Status") + " = " + f.str(status), nil
+
+	case "project":
+		if t.op == "" {
+			return "attribute_exists(" + f.name("ProjectID") + ")", nil
+		}
+		if err := onlyEquals(); err != nil {
+			return "", err
+		}
+		return f.name("ProjectID") + " = " + f.str(t.value), nil
+
+	case "promoted":
+		promoted := true
+		if t.op != "" {
+			if err := onlyEquals(); err != nil {
+				return "", err
+			}
+			b, err := strconv.ParseBool(t.value)
+			if err != nil {
+				return "", bad(fmt.Sprintf("promoted must be true or false, got %q", t.value))
+			}
+			promoted = b
+		}
+		cond := f.name("Promoted") + " = " + f.value(&dynamodb.AttributeValue{BOOL: aws.Bool(true)})
+		if !promoted {
+			cond = "(NOT " + cond + ")"
+		}
+		return cond, nil
+	}
+	return "", bad(fmt.Sprintf("unknown field %q", t.field))
+}
+
+// queryMaxNumber is the highest rating and group number.
+const queryMaxNumber = 5
+
+// parseQueryRange turns a rating or group term into an inclusive range: 3,
+// 2..4, ..4, 2.., or a comparison such as >=3.
+func parseQueryRange(t queryTerm) (int, int, error) {
+	parse := func(s string) (int, error) {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > queryMaxNumber {
+			return 0, &queryError{t.pos, fmt.Sprintf("%s needs a whole number from 0 to %d, got %q", t.field, queryMaxNumber, s)}
+		}
+		return n, nil
+	}
+	if t.op == ":" || t.op == "=" {
+		if a, b, ok := strings.Cut(t.value, ".."); ok {
+			lo, hi := 0, queryMaxNumber
+			var err error
+			if a != "" {
+				if lo, err = parse(a); err != nil {
+					return 0, 0, err
+				}
+			}
+			if b != "" {
+				if hi, err = parse(b); err != nil {
+					return 0, 0, err
+				}
+			}
+			if lo > hi {
+				return 0, 0, &queryError{t.pos, fmt.Sprintf("%s range %s is empty", t.field, t.value)}
+			}
+			return lo, hi, nil
+		}
+	}
+	n, err := parse(t.value)
+	if err != nil {
+		return 0, 0, err
+	}
+	lo, hi := n, n
+	switch t.op {
+	case "<":
+		lo, hi = 0, n-1
+	case "<=":
+		lo, hi = 0, n
+	case ">":
+		lo, hi = n+1, queryMaxNumber
+	case ">=":
+		lo, hi = n, queryMaxNumber
+	}
+	if lo > hi {
+		return 0, 0, &queryError{t.pos, fmt.Sprintf("%s%s%s matches nothing", t.field, t.op, t.value)}
+	}
+	return lo, hi, nil
+}
+
+// takenRange returns the dates a taken term covers; until is exclusive and
+// either may be zero for an open range. Dates are YYYY, YYYY-MM or
+// YYYY-MM-DD, alone, compared or as a range a..b.
+func takenRange(t queryTerm) (from, until time.Time, err error) {
+	if a, b, ok := strings.Cut(t.value, ".."); ok && (t.op == ":" || t.op == "=") {
+		if a != "" {
+			start, _, err := parseQueryDate(t, a)
+			if err != nil {
+				return from, until, err
+			}
+			from = start
+		}
+		if b != "" {
+			_, end, err := parseQueryDate(t, b)
+			if err != nil {
+				return from, until, err
+			}
+			until = end
+		}
+		if a == "" && b == "" {
+			return from, until, &queryError{t.pos, "taken range needs at least one date"}
+		}
+	} else {
+		start, end, err := parseQueryDate(t, t.value)
+		if err != nil {
+			return from, until, err
+		}
+		switch t.op {
+		case ":", "=":
+			from, until = start, end
+		case "<":
+			until = start
+		case "<=":
+			until = end
+		case ">":
+			from = end
+		case ">=":
+			from = start
+		}
+	}
+	if !from.IsZero() && !until.IsZero() && !from.Before(until) {
+		return from, until, &queryError{t.pos, fmt.Sprintf("taken range %s is empty", t.value)}
+	}
+	return from, until, nil
+}
+
+// compileTaken matches the capture date the way getImageDate finds it: EXIF
+// DateTimeOriginal, then DateTime, then when the image was uploaded.
+func (f *queryFilter) compileTaken(t queryTerm) (string, error) {
+	from, until, err := takenRange(t)
+	if err != nil {
+		return "", err
+	}
+
+	// EXIF dates look like 2025:06:01 12:00:00, sometimes quoted
+	exifRange := func(attr string) string {
+		var alts []string
+		for _, quote := range []string{"", `"`} {
+			var conds []string
+			if !from.IsZero() {
+				conds = append(conds, f.name(attr)+" >= "+f.str(quote+from.Format("2006:01:02")))
+			}
+			if !until.IsZero() {
+				conds = append(conds, f.name(attr)+" < "+f.str(quote+until.Format("2006:01:02")))
+			}
+			if quote == "" {
+				// Keep unquoted bounds from matching quoted dates and vice versa
+				conds = append(conds, "NOT begins_with("+f.name(attr)+", "+f.str(`"`)+")")
+			} else {
+				conds = append(conds, "begins_with("+f.name(attr)+", "+f.str(`"`)+")")
+			}
+			alts = append(alts, "("+strings.Join(conds, " AND ")+")")
+		}
+		return orJoin(alts)
+	}
+	var inserted []string
+	if !from.IsZero() {
+		inserted = append(inserted, f.name("InsertedDateTime")+" >= "+f.str(from.Format("2006-01-02")))
+	}
+	if !until.IsZero() {
+		inserted = append(inserted, f.name("InsertedDateTime")+" < "+f.str(until.Format("2006-01-02")))
+	}
+
+	original, dateTime := f.name("EXIFData.DateTimeOriginal"), f.name("EXIFData.DateTime")
+	return "((attribute_exists(" + original + ") AND " + exifRange("EXIFData.DateTimeOriginal") + ")" +
+		" OR (attribute_not_exists(" + original + ") AND attribute_exists(" + dateTime + ") AND " + exifRange("EXIFData.DateTime") + ")" +
+		" OR (attribute_not_exists(" + original + ") AND attribute_not_exists(" + dateTime + ") AND " + strings.Join(inserted, " AND ") + "))", nil
+}
+
+// parseQueryDate returns the start of the day, month or year a date names
+// and the start of the next one.
+func parseQueryDate(t queryTerm, s string) (time.Time, time.Time, error) {
+	for _, layout := range []struct {
+		format string
+		years  int
+		months int
+		days   int
+	}{{"2006-01-02", 0, 0, 1}, {"2006-01", 0, 1, 0}, {"2006", 1, 0, 0}} {
+		if d, err := time.Parse(layout.format, s); err == nil && len(s) == len(layout.format) {
+			return d, d.AddDate(layout.years, layout.months, layout.days), nil
+		}
+	}
+	return time.Time{}, time.Time{}, &queryError{t.pos, fmt.Sprintf("taken needs a date like 2025, 2025-06 or 2025-06-01, got %q", s)}
+}
+
+func titleCase(s string) string {
+	if s == "" {
+		return s
+	}
+	r := []rune(strings.ToLower(s))
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// imageQueryPlan is how a q parameter is run: the queries whose results are
+// listed together, see listImages.
+type imageQueryPlan struct {
+	queries []ItemQuery
+}
+
+// queryMaxTakenYears is the most capture years a taken term may span to be
+// planned on CaptureDateIndex, one query per year.
+const queryMaxTakenYears = 3
+
+// planImageQuery parses q and picks the index to query. A top-level term
+// that pins ProjectID, a bounded capture date range (once CaptureDateIndex
+// is created), GroupNumber or Status,
+// in that order of preference, becomes the key condition, provided no other
+// term tests the same attribute (DynamoDB won't filter on key attributes).
+func planImageQuery(q string) (imageQueryPlan, error) {
+	node, err := parseImageQuery(q)
+	if err != nil {
+		return imageQueryPlan{}, err
+	}
+	counts := map[string]int{}
+	countQueryFields(node, counts)
+
+	top, ok := node.(queryAnd)
+	if !ok {
+		top = queryAnd{node}
+	}
+	keyIndex := -1
+	var keyTerm queryTerm
+	var takenFrom, takenUntil time.Time
+	for _, field := range []string{"project", "taken", "group", "status"} {
+		for i, n := range top {
+			t, ok := n.(queryTerm)
+			if !ok || t.field != field || counts[field] != 1 {
+				continue
+			}
+			if field == "taken" {
+				if !hasImageIndex("CaptureDateIndex") {
+					continue
+				}
+				from, until, err := takenRange(t)
+				if err != nil || from.IsZero() || until.IsZero() || until.Add(-time.Second).Year()-from.Year() >= queryMaxTakenYears {
+					continue
+				}
+				takenFrom, takenUntil = from, until
+			} else if (t.op != ":" && t.op != "=") || strings.Contains(t.value, "..") {
+				continue
+			}
+			keyIndex, keyTerm = i, t
+			break
+		}
+		if keyIndex >= 0 {
+			break
+		}
+	}
+
+	rest := queryAnd{}
+	for i, n := range top {
+		if i != keyIndex {
+			rest = append(rest, n)
+		}
+	}
+	filter := &queryFilter{names: map[string]*string{}, values: Item{}}
+	var conds []string
+	for _, n := range rest {
+		cond, err := filter.compile(n)
+		if err != nil {
+			return imageQueryPlan{}, err
+		}
+		conds = append(conds, cond)
+	}
+	// Validate the key term like any other
+	if keyIndex >= 0 {
+		if _, err := (&queryFilter{names: map[string]*string{}, values: Item{}}).compileTerm(keyTerm); err != nil {
+			return imageQueryPlan{}, err
+		}
+	}
+
+	query := func(index, keyAttr string, key *dynamodb.AttributeValue) ItemQuery {
+		names := map[string]*string{"#key": aws.String(keyAttr)}
+		values := Item{":key": key}
+		for k, v := range filter.names {
+			names[k] = v
+		}
+		for k, v := range filter.values {
+			values[k] = v
+		}
+		conds := conds
+		if counts["status"] == 0 && keyAttr != "Status" {
+			conds = append(append([]string{}, conds...), "#Status <> :deleted")
+			names["#Status"] = aws.String("Status")
+			values[":deleted"] = &dynamodb.AttributeValue{S: aws.String("deleted")}
+		}
+		return ItemQuery{
+			Index:        index,
+			KeyCondition: "#key = :key",
+			Filter:       strings.Join(conds, " AND "),
+			Names:        names,
+			Values:       values,
+		}
+	}
+
+	var plan imageQueryPlan
+	switch keyTerm.field {
+	case "project":
+		plan.queries = []ItemQuery{query("ProjectIndex", "ProjectID", &dynamodb.AttributeValue{S: aws.String(keyTerm.value)})}
+	case "group":
+		n, _ := strconv.Atoi(keyTerm.value)
+		plan.queries = []ItemQuery{query("GroupStatusIndex", "GroupNumber", &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(n))})}
+	case "status":
+		plan.queries = []ItemQuery{query("StatusIndex", "Status", &dynamodb.AttributeValue{S: aws.String(strings.ToLower(keyTerm.value))})}
+	case "taken":
+		// Images without a CaptureDate aren't in the index
+		last := takenUntil.Add(-time.Second)
+		for year := takenFrom.Year(); year <= last.Year(); year++ {
+			q := query("CaptureDateIndex", "CaptureYear", &dynamodb.AttributeValue{S: aws.String(strconv.Itoa(year))})
+			q.KeyCondition += " AND #captured BETWEEN :capturedFrom AND :capturedTo"
+			q.Names["#captured"] = aws.String("CaptureDate")
+			q.Values[":capturedFrom"] = &dynamodb.AttributeValue{S: aws.String(takenFrom.Format(captureDateFormat))}
+			q.Values[":capturedTo"] = &dynamodb.AttributeValue{S: aws.String(last.Format(captureDateFormat))}
+			plan.queries = append(plan.queries, q)
+		}
+	default:
+		statuses := queryStatuses
+		if counts["status"] == 0 {
+			statuses = []string{"inbox", "approved", "rejected", "project"}
+		}
+		for _, status := range statuses {
+			plan.queries = append(plan.queries, query("StatusIndex", "Status", &dynamodb.AttributeValue{S: aws.String(status)}))
+		}
+	}
+	return plan, nil
+}
+
+func countQueryFields(node queryNode, counts map[string]int) {
+	switch n := node.(type) {
+	case queryAnd:
+		for _, part := range n {
+			countQueryFields(part, counts)
+		}
+	case queryOr:
+		for _, part := range n {
+			countQueryFields(part, counts)
+		}
+	case queryNot:
+		countQueryFields(n.node, counts)
+	case queryTerm:
+		counts[n.field]++
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// listQuery lists images matching q and returns their IDs, sorted.
+func (env *testEnv) listQuery(q string) []string {
+	env.t.Helper()
+	resp := env.call("GET", "/api/images?q="+url.QueryEscape(q), "")
+	var page PaginatedImageResponse
+	if err := json.Unmarshal([]byte(resp.Body), &page); err != nil || resp.StatusCode != 200 {
+		env.t.Fatalf("q=%s: %d %s", q, resp.StatusCode, resp.Body)
+	}
+	var ids []string
+	for _, img := range page.Images {
+		ids = append(ids, img.ImageGUID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestListImagesQuery(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedProject("p1", 1)
+	env.seedImage("heron", map[string]interface{}{
+		"Status": "approved", "Reviewed": "true", "GroupNumber": 1, "Rating": 5, "Keywords": []string{"Heron", "lake"},
+		"EXIFData": map[string]string{"DateTimeOriginal": "2025:07:04 06:30:00", "Make": `"FUJIFILM"`, "Model": `"X-T5"`},
+	})
+	env.seedImage("gull", map[string]interface{}{
+		"Status": "approved", "Reviewed": "true", "GroupNumber": 2, "Rating": 4, "Keywords": []string{"gull"},
+		"EXIFData": map[string]string{"DateTimeOriginal": `"2025:09:01 12:00:00"`, "Model": `"X-T5"`},
+	})
+	env.seedImage("old", map[string]interface{}{"EXIFData": map[string]string{}, "InsertedDateTime": "2025-06-15T00:00:00Z"})
+	env.seedImage("inproject", map[string]interface{}{"Status": "project", "ProjectID": "p1", "Rating": 4, "Promoted": true})
+	env.seedImage("trashed", map[string]interface{}{"Status": "deleted", "Rating": 5})
+	env.login()
+
+	for _, tc := range []struct{ q, want string }{
+		{`rating>=4 AND keyword:heron AND camera:"X-T5" AND taken:2025-06..2025-08 AND NOT project`, "[heron]"},
+		{"rating>=4", "[gull heron inproject]"},
+		{"rating<1", "[old]"},
+		{"rating:4..5 NOT project", "[gull heron]"},
+		{"rating!=0 AND group!=1", "[gull inproject]"},
+		{"keyword:LAKE OR keyword:gull", "[gull heron]"},
+		{"model:X-T5 AND make:FUJI", "[heron]"},
+		{"taken:2025-06", "[old]"},
+		{"taken>=2025-07-05", "[gull]"},
+		{"taken:2024", "[inproject]"},
+		{"status:approved group:2", "[gull]"},
+		{"group:1", "[heron]"},
+		{"project:p1", "[inproject]"},
+		{"promoted", "[inproject]"},
+		{"promoted:false AND (status:inbox OR status:deleted)", "[old trashed]"},
+		{"status:deleted", "[trashed]"},
+		{"rating:5", "[heron]"},
+	} {
+		if got := fmt.Sprint(env.listQuery(tc.q)); got != tc.want {
+			t.Errorf("q=%s: got %s, want %s", tc.q, got, tc.want)
+		}
+	}
+}
+
+func TestListImagesQueryErrors(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	for _, tc := range []struct{ q, want string }{
+		{"heron", `unknown field "heron"`},
+		{"rating>=", `position 9: expected a value after rating>=`},
+		{"rating:9", `position 1: rating needs a whole number from 0 to 5, got "9"`},
+		{"status:lost", "status must be one of"},
+		{"taken:June", "taken needs a date like 2025"},
+		{"keyword>heron", "keyword can't be compared with >"},
+		{"(rating:1", `expected ")"`},
+		{`camera:"X-T5`, "position 8: unterminated quoted string"},
+		{"rating:1 AND", "unexpected end of query"},
+		{"rating:5..2", "rating range 5..2 is empty"},
+	} {
+		resp := env.call("GET", "/api/images?q="+url.QueryEscape(tc.q), "")
+		var body struct{ Error string }
+		json.Unmarshal([]byte(resp.Body), &body)
+		if resp.StatusCode != 400 || !strings.Contains(body.Error, tc.want) {
+			t.Errorf("q=%s: %d %s, want error containing %q", tc.q, resp.StatusCode, resp.Body, tc.want)
+		}
+	}
+}
+
+func TestPlanImageQuery(t *testing.T) {
+	for _, tc := range []struct {
+		q       string
+		indexes string
+	}{
+		{"project:p1 AND status:project", "[ProjectIndex]"},
+		{"group:2 rating>3", "[GroupStatusIndex]"},
+		{"status:approved", "[StatusIndex]"},
+		// A bounded taken range is a query per capture year
+		{"taken:2025-06 AND status:inbox", "[CaptureDateIndex]"},
+		{"taken:2024-11..2025-02", "[CaptureDateIndex CaptureDateIndex]"},
+		{"taken:2020..2025", "[StatusIndex StatusIndex StatusIndex StatusIndex]"},
+		{"taken>=2025", "[StatusIndex StatusIndex StatusIndex StatusIndex]"},
+		// The key attribute can't also be filtered on
+		{"group:2 AND NOT group:2", "[StatusIndex StatusIndex StatusIndex StatusIndex]"},
+		{"status:inbox OR status:approved", "[StatusIndex StatusIndex StatusIndex StatusIndex StatusIndex]"},
+	} {
+		plan, err := planImageQuery(tc.q)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.q, err)
+		}
+		var indexes []string
+		for _, q := range plan.queries {
+			indexes = append(indexes, q.Index)
+		}
+		if got := fmt.Sprint(indexes); got != tc.indexes {
+			t.Errorf("%s: indexes %s, want %s", tc.q, got, tc.indexes)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Rate limits are counters in the RateLimits table. Failed logins are counted
+// per username and lock the account out with a doubling backoff; expensive
+// actions have per-user quotas over fixed windows. If the counter table is
+// unavailable requests are allowed rather than locking everyone out.
+
+const (
+	// Failed logins allowed before the account is locked
+	loginMaxFailures = 5
+	// First lockout; each further failure doubles it up to loginLockoutMax
+	loginLockoutBase = time.Minute
+	loginLockoutMax  = time.Hour
+	// Failure counts are forgotten after this long without a failed login
+	loginFailureWindow = 24 * time.Hour
+)
+
+// quota is a per-user allowance of an action over a fixed time window.
+type quota struct {
+	action string
+	limit  int
+	window time.Duration
+}
+
+var (
+	quotaRegenerateAI = quota{action: "regenerate-ai", limit: 30, window: time.Hour}
+	quotaGenerateZip  = quota{action: "generate-zip", limit: 10, window: time.Hour}
+)
+
+// rateLimitClock is the time source for rate limits, replaced in tests.
+var rateLimitClock = time.Now
+
+func loginCounterKey(username string) string {
+	return "login#" + strings.ToLower(username)
+}
+
+func counterNumber(item Item, name string) int64 {
+	if item == nil || item[name] == nil || item[name].N == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(*item[name].N, 10, 64)
+	return n
+}
+
+// takeQuota counts one use of q by username. When the quota is used up it
+// returns false and how long until the window resets.
+func takeQuota(q quota, username string) (time.Duration, bool) {
+	now := rateLimitClock()
+	windowStart := now.Truncate(q.window)
+	windowEnd := windowStart.Add(q.window)
+	key := fmt.Sprintf("quota#%s#%s#%d", q.action, username, windowStart.Unix())
+
+	_, err := counterStore.UpdateCounter(key, ItemUpdate{
+		Expression: "ADD #count :one SET ExpiresAt = :expires",
+		Condition:  "attribute_not_exists(#count) OR #count < :limit",
+		Names:      map[string]*string{"#count": aws.String("Count")},
+		Values: map[string]*dynamodb.AttributeValue{
+			":one":     {N: aws.String("1")},
+			":limit":   {N: aws.String(strconv.Itoa(q.limit))},
+			":expires": {N: aws.String(strconv.FormatInt(windowEnd.Unix(), 10))},
+		},
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "ConditionalCheckFailed") {
+			return windowEnd.Sub(now), false
+		}
+		fmt.Printf("Rate limit check for %s by %s failed, allowing: %v\n", q.action, username, err)
+	}
+	return 0, true
+}
+
+// loginLockout returns how much longer username is locked out for, or zero.
+func loginLockout(username string) time.Duration {
+	item, err := counterStore.GetCounter(loginCounterKey(username))
+	if err != nil {
+		fmt.Printf("Failed to check login lockout for %s: %v\n", username, err)
+		return 0
+	}
+	lockedUntil := time.Unix(counterNumber(item, "LockedUntil"), 0)
+	if wait := lockedUntil.Sub(rateLimitClock()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// recordLoginFailure counts a failed login for username and locks the account
+// once the count reaches loginMaxFailures. It returns the new lockout, if any.
+func recordLoginFailure(username string) time.Duration {
+	now := rateLimitClock()
+	key := loginCounterKey(username)
+	values := map[string]*dynamodb.AttributeValue{
+		":one":     {N: aws.String("1")},
+		":now":     {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		":expires": {N: aws.String(strconv.FormatInt(now.Add(loginFailureWindow).Unix(), 10))},
+	}
+
+	item, err := counterStore.UpdateCounter(key, ItemUpdate{
+		Expression:   "ADD Failures :one SET ExpiresAt = :expires",
+		Condition:    "attribute_not_exists(ExpiresAt) OR ExpiresAt > :now",
+		Values:       values,
+		ReturnValues: dynamodb.ReturnValueAllNew,
+	})
+	if err != nil && strings.Contains(err.Error(), "ConditionalCheckFailed") {
+		// The counter has expired but TTL has not deleted it yet: start over
+		delete(values, ":now")
+		item, err = counterStore.UpdateCounter(key, ItemUpdate{
+			Expression:   "SET Failures = :one, ExpiresAt = :expires REMOVE LockedUntil",
+			Values:       values,
+			ReturnValues: dynamodb.ReturnValueAllNew,
+		})
+	}
+	if err != nil {
+		fmt.Printf("Failed to record login failure for %s: %v\n", username, err)
+		return 0
+	}
+
+	failures := counterNumber(item, "Failures")
+	if failures < loginMaxFailures {
+		return 0
+	}
+	lockout := loginLockoutMax
+	if shift := failures - loginMaxFailures; shift < 16 {
+		if d := loginLockoutBase << shift; d < lockout {
+			lockout = d
+		}
+	}
+	_, err = counterStore.UpdateCounter(key, ItemUpdate{
+		Expression: "SET LockedUntil = :until",
+		Values: map[string]*dynamodb.AttributeValue{
+			":until": {N: aws.String(strconv.FormatInt(now.Add(lockout).Unix(), 10))},
+		},
+	})
+	if err != nil {
+		fmt.Printf("Failed to lock out %s: %v\n", username, err)
+		return 0
+	}
+	fmt.Printf("Locked out %s for %v after %d failed logins\n", username, lockout, failures)
+	return lockout
+}
+
+// clearLoginFailures resets the failed login count after a successful login
+// or an admin password reset.
+func clearLoginFailures(username string) {
+	if err := counterStore.DeleteCounter(loginCounterKey(username)); err != nil {
+		fmt.Printf("Failed to clear login failures for %s: %v\n", username, err)
+	}
+}
+
+// rateLimitedResponse is a 429 telling the client when to retry.
+func rateLimitedResponse(retryAfter time.Duration, message string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	limited := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		limited[k] = v
+	}
+	limited["Retry-After"] = strconv.Itoa(seconds)
+
+	body, _ := json.Marshal(map[string]interface{}{"error": message, "retryAfter": seconds})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 429,
+		Headers:    limited,
+		Body:       string(body),
+	}, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useClock makes rate limits see a fixed time that the test can advance.
+func useClock(t *testing.T) *time.Time {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	saved := rateLimitClock
+	rateLimitClock = func() time.Time { return now }
+	t.Cleanup(func() { rateLimitClock = saved })
+	return &now
+}
+
+func TestLoginLockout(t *testing.T) {
+	env := newTestEnv(t)
+	now := useClock(t)
+	wrong := fmt.Sprintf(`{"username":%q,"password":"nope"}`, testUser)
+	right := fmt.Sprintf(`{"username":%q,"password":%q}`, testUser, testPassword)
+
+	for i := 0; i < loginMaxFailures; i++ {
+		if resp := env.call("POST", "/api/login", wrong); resp.StatusCode != 401 {
+			t.Fatalf("attempt %d: status = %d, want 401", i+1, resp.StatusCode)
+		}
+	}
+
+	// Locked: even the right password is refused until the lockout ends
+	resp := env.call("POST", "/api/login", right)
+	if resp.StatusCode != 429 || resp.Headers["Retry-After"] != "60" {
+		t.Fatalf("locked login: status = %d, Retry-After = %q", resp.StatusCode, resp.Headers["Retry-After"])
+	}
+
+	// Failing again after the lockout doubles it
+	*now = now.Add(loginLockoutBase)
+	env.call("POST", "/api/login", wrong)
+	resp = env.call("POST", "/api/login", right)
+	if resp.StatusCode != 429 || resp.Headers["Retry-After"] != strconv.Itoa(int(2*loginLockoutBase/time.Second)) {
+		t.Fatalf("second lockout: status = %d, Retry-After = %q", resp.StatusCode, resp.Headers["Retry-After"])
+	}
+
+	// A successful login resets the count
+	*now = now.Add(2 * loginLockoutBase)
+	env.loginAs(testUser, testPassword)
+	if resp := env.call("POST", "/api/login", wrong); resp.StatusCode != 401 {
+		t.Errorf("after reset: status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestLoginLockoutUnknownUser(t *testing.T) {
+	env := newTestEnv(t)
+	useClock(t)
+	body := `{"username":"ghost","password":"x"}`
+	for i := 0; i < loginMaxFailures; i++ {
+		env.call("POST", "/api/login", body)
+	}
+	if resp := env.call("POST", "/api/login", body); resp.StatusCode != 429 {
+		t.Errorf("status = %d, want 429", resp.StatusCode)
+	}
+}
+
+func TestLoginFailuresExpire(t *testing.T) {
+	env := newTestEnv(t)
+	now := useClock(t)
+	wrong := fmt.Sprintf(`{"username":%q,"password":"nope"}`, testUser)
+	for i := 0; i < loginMaxFailures-1; i++ {
+		env.call("POST", "/api/login", wrong)
+	}
+	*now = now.Add(loginFailureWindow + time.Second)
+	env.call("POST", "/api/login", wrong)
+	env.loginAs(testUser, testPassword)
+}
+
+func TestAdminResetClearsLockout(t *testing.T) {
+	env := newTestEnv(t)
+	useClock(t)
+	env.seedUser("ann", roleReviewer)
+	env.login()
+	for i := 0; i < loginMaxFailures; i++ {
+		env.call("POST", "/api/login", `{"username":"ann","password":"nope"}`)
+	}
+	if resp := env.call("PUT", "/api/users/ann/password", `{"password":"password2"}`); resp.StatusCode != 200 {
+		t.Fatalf("reset: %d %s", resp.StatusCode, resp.Body)
+	}
+	env.loginAs("ann", "password2")
+}
+
+func TestZipQuota(t *testing.T) {
+	env := newTestEnv(t)
+	now := useClock(t)
+	saved := quotaGenerateZip
+	quotaGenerateZip.limit = 2
+	t.Cleanup(func() { quotaGenerateZip = saved })
+	env.seedProject("trip", 3)
+	env.seedProject("empty", 0)
+	env.login()
+
+	// Requests refused before any work is done use none of it
+	for _, tc := range []struct {
+		project string
+		want    int
+	}{{"missing", 404}, {"empty", 400}, {"empty", 400}} {
+		if resp := env.call("POST", "/api/projects/"+tc.project+"/generate-zip", ""); resp.StatusCode != tc.want {
+			t.Fatalf("%s: status = %d, want %d", tc.project, resp.StatusCode, tc.want)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if resp := env.call("POST", "/api/projects/trip/generate-zip", ""); resp.StatusCode != 200 {
+			t.Fatalf("zip %d: status = %d: %s", i+1, resp.StatusCode, resp.Body)
+		}
+	}
+	resp := env.call("POST", "/api/projects/trip/generate-zip", "")
+	if resp.StatusCode != 429 || resp.Headers["Retry-After"] != "3600" {
+		t.Fatalf("over quota: status = %d, Retry-After = %q", resp.StatusCode, resp.Headers["Retry-After"])
+	}
+	if len(env.invoked) != 2 {
+		t.Errorf("zip lambda invoked %d times, want 2", len(env.invoked))
+	}
+
+	// Quotas are per user
+	env.seedUser("zoe", roleAdmin)
+	env.loginAs("zoe", testPassword)
+	if resp := env.call("POST", "/api/projects/trip/generate-zip", ""); resp.StatusCode != 200 {
+		t.Errorf("other user: status = %d", resp.StatusCode)
+	}
+
+	// And reset with the window
+	env.login()
+	*now = now.Add(quotaGenerateZip.window)
+	if resp := env.call("POST", "/api/projects/trip/generate-zip", ""); resp.StatusCode != 200 {
+		t.Errorf("next window: status = %d", resp.StatusCode)
+	}
+}
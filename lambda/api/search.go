@@ -0,0 +1,638 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Full-text search runs on an inverted index in the SearchIndex table.
+// Images are indexed on their keywords, original filename and description,
+// and projects on their name and keywords. Words are lowercased and stemmed,
+// so "herons" finds "heron", and a search word also matches longer terms
+// that start with it, at half the score.
+//
+// Each (term, document) pair is one item keyed by the term's first two
+// letters and "term#document", so all the terms starting with a search word
+// are one Query. Each document also has a record of its terms and scores,
+// which reindexing diffs against to delete the entries that no longer apply.
+//
+// The API indexes images and projects when it changes them, and the image
+// table's stream indexes images whoever wrote them, including the ones the
+// thumbnail function adds. POST /api/search/reindex rebuilds the index from
+// scratch as a job.
+
+const (
+	searchDefaultLimit = 20
+	searchMaxLimit     = 100
+	// A search word matching more index entries than this is cut off there
+	searchMaxEntries = 2000
+
+	searchKeywordWeight  = 3
+	searchFilenameWeight = 2
+	searchTextWeight     = 1
+
+	searchDocImage   = "image"
+	searchDocProject = "project"
+)
+
+// searchStopWords are too common to be worth indexing.
+var searchStopWords = map[string]bool{
+	"an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"by": true, "for": true, "from": true, "in": true, "is": true, "it": true,
+	"of": true, "on": true, "or": true, "the": true, "to": true, "with": true,
+}
+
+// searchEntry is one term of one document in the index.
+type searchEntry struct {
+	TermPrefix string `dynamodbav:"TermPrefix"`
+	Entry      string `dynamodbav:"Entry"` // term#doc
+	Term       string `dynamodbav:"Term"`
+	Doc        string `dynamodbav:"Doc"` // image:<id> or project:<id>
+	Score      int    `dynamodbav:"Score"`
+}
+
+// searchDocRecord lists a document's indexed terms and their scores.
+type searchDocRecord struct {
+	TermPrefix string         `dynamodbav:"TermPrefix"` // doc:<doc>
+	Entry      string         `dynamodbav:"Entry"`
+	Terms      map[string]int `dynamodbav:"Terms"`
+}
+
+// searchWords splits text into lowercase, stemmed words, leaving out stop
+// words and single letters.
+func searchWords(text string) []string {
+	var words []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if utf8.RuneCountInString(word) < 2 || searchStopWords[word] {
+			continue
+		}
+		words = append(words, stemWord(word))
+	}
+	return words
+}
+
+// stemWord strips common English plural and verb endings: "berries" to
+// "berry", "herons" to "heron", "running" to "run", "walked" to "walk".
+// It is deliberately light; a word is never cut below three letters.
+func stemWord(word string) string {
+	if strings.IndexFunc(word, unicode.IsDigit) >= 0 {
+		return word
+	}
+	n := len(word)
+	switch {
+	case strings.HasSuffix(word, "ies") && n > 4:
+		return word[:n-3] + "y"
+	case strings.HasSuffix(word, "sses"):
+		return word[:n-2]
+	case strings.HasSuffix(word, "s") && n > 3 &&
+		!strings.HasSuffix(word, "ss") && !strings.HasSuffix(word, "us") && !strings.HasSuffix(word, "is"):
+		return word[:n-1]
+	case strings.HasSuffix(word, "ing") && n-3 >= 3 && hasVowel(word[:n-3]):
+		return undouble(word[:n-3])
+	case strings.HasSuffix(word, "ed") && !strings.HasSuffix(word, "eed") && n-2 >= 3 && hasVowel(word[:n-2]):
+		return undouble(word[:n-2])
+	}
+	return word
+}
+
+func hasVowel(s string) bool {
+	return strings.ContainsAny(s, "aeiouy")
+}
+
+// undouble turns "runn" into "run", but leaves "fall" and "buzz".
+func undouble(stem string) string {
+	n := len(stem)
+	if n >= 4 && stem[n-1] == stem[n-2] && !strings.ContainsRune("aeiouylsz", rune(stem[n-1])) {
+		return stem[:n-1]
+	}
+	return stem
+}
+
+// addSearchTerms adds text's words to terms with the given weight.
+func addSearchTerms(terms map[string]int, text string, weight int) {
+	for _, word := range searchWords(text) {
+		terms[word] += weight
+	}
+}
+
+func imageSearchTerms(img ImageResponse) map[string]int {
+	terms := make(map[string]int)
+	for _, kw := range img.Keywords {
+		addSearchTerms(terms, kw, searchKeywordWeight)
+	}
+	addSearchTerms(terms, img.OriginalFilename, searchFilenameWeight)
+	addSearchTerms(terms, img.Description, searchTextWeight)
+	return terms
+}
+
+func projectSearchTerms(p Project) map[string]int {
+	terms := make(map[string]int)
+	addSearchTerms(terms, p.Name, searchKeywordWeight)
+	for _, kw := range p.Keywords {
+		addSearchTerms(terms, kw, searchFilenameWeight)
+	}
+	return terms
+}
+
+func searchDocID(docType, id string) string {
+	return docType + ":" + id
+}
+
+// searchTermPrefix is the partition a term, or a search word, is in.
+func searchTermPrefix(term string) string {
+	if _, size := utf8.DecodeRuneInString(term); size < len(term) {
+		_, next := utf8.DecodeRuneInString(term[size:])
+		return term[:size+next]
+	}
+	return term
+}
+
+func searchDocKey(doc string) Item {
+	return Item{
+		"TermPrefix": {S: aws.String("doc:" + doc)},
+		"Entry":      {S: aws.String("terms")},
+	}
+}
+
+func searchEntryKey(term, doc string) Item {
+	return Item{
+		"TermPrefix": {S: aws.String(searchTermPrefix(term))},
+		"Entry":      {S: aws.String(term + "#" + doc)},
+	}
+}
+
+// indexSearchDoc replaces the document's index entries with terms. Only the
+// entries that changed are written. Two reindexes of the same document
+// racing can leave a stale entry behind until the document is next indexed.
+func indexSearchDoc(doc string, terms map[string]int) error {
+	item, err := searchStore.GetSearchItem(searchDocKey(doc))
+	if err != nil {
+		return err
+	}
+	var old searchDocRecord
+	if item != nil {
+		dynamodbattribute.UnmarshalMap(item, &old)
+	}
+
+	for term := range old.Terms {
+		if _, ok := terms[term]; !ok {
+			if err := searchStore.DeleteSearchItem(searchEntryKey(term, doc)); err != nil {
+				return err
+			}
+		}
+	}
+	for term, score := range terms {
+		if old.Terms[term] == score {
+			continue
+		}
+		entry := searchEntry{
+			TermPrefix: searchTermPrefix(term),
+			Entry:      term + "#" + doc,
+			Term:       term,
+			Doc:        doc,
+			Score:      score,
+		}
+		av, _ := dynamodbattribute.MarshalMap(entry)
+		if err := searchStore.PutSearchItem(av); err != nil {
+			return err
+		}
+	}
+
+	if len(terms) == 0 {
+		if item == nil {
+			return nil
+		}
+		return searchStore.DeleteSearchItem(searchDocKey(doc))
+	}
+	record := searchDocRecord{TermPrefix: "doc:" + doc, Entry: "terms", Terms: terms}
+	av, _ := dynamodbattribute.MarshalMap(record)
+	return searchStore.PutSearchItem(av)
+}
+
+// indexImageForSearch brings the image's index entries up to date, removing
+// them if the image is gone. Failures are logged; the next reindex
+// repairs them.
+func indexImageForSearch(imageGUID string) {
+	item, err := imageStore.GetImage(imageGUID)
+	if err != nil {
+		fmt.Printf("Warning: Failed to index image %s for search: %v\n", imageGUID, err)
+		return
+	}
+	if item == nil {
+		item = Item{"ImageGUID": {S: aws.String(imageGUID)}}
+	}
+	indexImageItem(item)
+}
+
+// indexImageItem indexes an image record the caller has already read or
+// just written. A record with only the image's key removes it from the
+// index.
+func indexImageItem(item Item) {
+	var img ImageResponse
+	dynamodbattribute.UnmarshalMap(item, &img)
+	if err := indexSearchDoc(searchDocID(searchDocImage, img.ImageGUID), imageSearchTerms(img)); err != nil {
+		fmt.Printf("Warning: Failed to index image %s for search: %v\n", img.ImageGUID, err)
+	}
+}
+
+// indexProjectForSearch is indexImageForSearch for projects.
+func indexProjectForSearch(projectID string) {
+	item, err := projectStore.GetProject(projectID)
+	if err == nil {
+		terms := map[string]int{}
+		if item != nil {
+			var project Project
+			dynamodbattribute.UnmarshalMap(item, &project)
+			terms = projectSearchTerms(project)
+		}
+		err = indexSearchDoc(searchDocID(searchDocProject, projectID), terms)
+	}
+	if err != nil {
+		fmt.Printf("Warning: Failed to index project %s for search: %v\n", projectID, err)
+	}
+}
+
+// searchHit is a document matching every search word.
+type searchHit struct {
+	Doc     string
+	Score   int
+	Matched []string
+}
+
+// rankSearch finds the documents matching all words, best first. A word
+// matching a term exactly scores the term's score; matching the start of a
+// longer term scores half of it.
+func rankSearch(words []string, docType string) ([]searchHit, error) {
+	type match struct {
+		score int
+		term  string
+	}
+	var perWord []map[string]match
+	for _, word := range words {
+		q := ItemQuery{
+			KeyCondition: "TermPrefix = :prefix AND begins_with(Entry, :word)",
+			Values: map[string]*dynamodb.AttributeValue{
+				":prefix": {S: aws.String(searchTermPrefix(word))},
+				":word":   {S: aws.String(word)},
+			},
+		}
+		if docType != "" {
+			q.Filter = "begins_with(Doc, :type)"
+			q.Values[":type"] = &dynamodb.AttributeValue{S: aws.String(docType + ":")}
+		}
+		matches := make(map[string]match)
+		count := 0
+		for count < searchMaxEntries {
+			page, err := searchStore.QuerySearch(q)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range page.Items {
+				var entry searchEntry
+				dynamodbattribute.UnmarshalMap(item, &entry)
+				score := entry.Score
+				if entry.Term != word {
+					score = (score + 1) / 2
+				}
+				if score > matches[entry.Doc].score {
+					matches[entry.Doc] = match{score, entry.Term}
+				}
+			}
+			count += len(page.Items)
+			if page.LastKey == nil {
+				break
+			}
+			q.StartKey = page.LastKey
+		}
+		if count >= searchMaxEntries {
+			fmt.Printf("Search: %q matched more than %d entries, ranking the first ones\n", word, searchMaxEntries)
+		}
+		perWord = append(perWord, matches)
+	}
+
+	var hits []searchHit
+	for doc, first := range perWord[0] {
+		hit := searchHit{Doc: doc, Score: first.score, Matched: []string{first.term}}
+		for _, matches := range perWord[1:] {
+			m, ok := matches[doc]
+			if !ok {
+				hit.Score = 0
+				break
+			}
+			hit.Score += m.score
+			if !containsString(hit.Matched, m.term) {
+				hit.Matched = append(hit.Matched, m.term)
+			}
+		}
+		if hit.Score > 0 {
+			hits = append(hits, hit)
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Doc < hits[j].Doc
+	})
+	return hits, nil
+}
+
+// SearchResult is one ranked search result: an image or a project.
+type SearchResult struct {
+	Type    string         `json:"type"`
+	ID      string         `json:"id"`
+	Score   int            `json:"score"`
+	Matched []string       `json:"matched"` // Index terms the search words matched
+	Image   *ImageResponse `json:"image,omitempty"`
+	Project *Project       `json:"project,omitempty"`
+}
+
+// SearchResponse is one page of search results, best first.
+type SearchResponse struct {
+	Results    []SearchResult `json:"results"`
+	HasMore    bool           `json:"hasMore"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+// searchCursor resumes a search at a position in its ranking.
+type searchCursor struct {
+	Offset int `json:"o"`
+}
+
+func encodeSearchCursor(c searchCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSearchCursor(s string) (searchCursor, error) {
+	var c searchCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, err
+	}
+	if c.Offset < 0 {
+		return c, fmt.Errorf("negative offset")
+	}
+	return c, nil
+}
+
+// loadSearchImages reads the images of hits in one request, by ID.
+func loadSearchImages(hits []searchHit) (map[string]Item, error) {
+	var ids []string
+	for _, hit := range hits {
+		if docType, id, _ := strings.Cut(hit.Doc, ":"); docType == searchDocImage {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	read, err := imageStore.GetImages(ids, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	images := make(map[string]Item, len(read))
+	for _, item := range read {
+		images[aws.StringValue(item["ImageGUID"].S)] = item
+	}
+	return images, nil
+}
+
+// loadSearchResult loads a hit's document, returning nil when the caller
+// can't see it or it no longer exists. images holds the hit's image, read
+// by loadSearchImages. Hits on deleted documents are dropped from the index
+// as they are found.
+func loadSearchResult(caller *Caller, hit searchHit, images map[string]Item, visible func(string) bool) (*SearchResult, error) {
+	docType, id, _ := strings.Cut(hit.Doc, ":")
+	result := &SearchResult{Type: docType, ID: id, Score: hit.Score, Matched: hit.Matched}
+	switch docType {
+	case searchDocImage:
+		item := images[id]
+		if item == nil {
+			indexImageForSearch(id)
+			return nil, nil
+		}
+		var img ImageResponse
+		dynamodbattribute.UnmarshalMap(item, &img)
+		if img.Status == "deleted" || !visible(img.ProjectID) {
+			return nil, nil
+		}
+		result.Image = &img
+	case searchDocProject:
+		project, err := getProjectFor(caller, id, projectViewer)
+		switch err {
+		case nil:
+		case errProjectNotFound:
+			indexProjectForSearch(id)
+			return nil, nil
+		case errProjectForbidden:
+			return nil, nil
+		default:
+			return nil, err
+		}
+		result.Project = &project
+	default:
+		return nil, nil
+	}
+	return result, nil
+}
+
+// handleSearch serves GET /api/search. Parameters: q, type (image or
+// project), limit and cursor. Every word in q must match; images in the
+// trash and projects the caller isn't a member of are left out.
+func handleSearch(caller *Caller, params map[string]string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	if strings.TrimSpace(params["q"]) == "" {
+		return errorResponse(400, "q is required", headers)
+	}
+	var words []string
+	for _, word := range searchWords(params["q"]) {
+		if !containsString(words, word) {
+			words = append(words, word)
+		}
+	}
+	if len(words) == 0 {
+		return errorResponse(400, "q has no words to search for", headers)
+	}
+	docType := params["type"]
+	if docType != "" && docType != searchDocImage && docType != searchDocProject {
+		return errorResponse(400, "type must be image or project", headers)
+	}
+
+	limit := searchDefaultLimit
+	if s := params["limit"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return errorResponse(400, "limit must be a positive number", headers)
+		}
+		if n > searchMaxLimit {
+			n = searchMaxLimit
+		}
+		limit = n
+	}
+	var cursor searchCursor
+	if s := params["cursor"]; s != "" {
+		c, err := decodeSearchCursor(s)
+		if err != nil {
+			return errorResponse(400, "Invalid cursor", headers)
+		}
+		cursor = c
+	}
+
+	hits, err := rankSearch(words, docType)
+	if err != nil {
+		fmt.Printf("Error searching for %q: %v\n", params["q"], err)
+		return errorResponse(500, "Failed to search", headers)
+	}
+
+	response := SearchResponse{Results: []SearchResult{}}
+	visible := projectFilter(caller)
+	// Hits are read as many at a time as the page has room for, so hits
+	// left out only cost another read
+	i := min(cursor.Offset, len(hits))
+	for i < len(hits) && len(response.Results) < limit {
+		window := hits[i:min(i+limit-len(response.Results), len(hits))]
+		images, err := loadSearchImages(window)
+		if err != nil {
+			fmt.Printf("Error loading %d search results: %v\n", len(window), err)
+			return errorResponse(500, "Failed to load search results", headers)
+		}
+		for _, hit := range window {
+			result, err := loadSearchResult(caller, hit, images, visible)
+			if err != nil {
+				fmt.Printf("Error loading search result %s: %v\n", hit.Doc, err)
+				return errorResponse(500, "Failed to load search results", headers)
+			}
+			if result != nil {
+				response.Results = append(response.Results, *result)
+			}
+		}
+		i += len(window)
+	}
+	if i < len(hits) {
+		response.HasMore = true
+		response.NextCursor = encodeSearchCursor(searchCursor{Offset: i})
+	}
+
+	body, _ := json.Marshal(response)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// reindexTimeBudget is how long a reindex runs before carrying on in a new
+// invocation, inside the API function's 180s timeout. It reads
+// reindexPageSize images at a time.
+var (
+	reindexTimeBudget = 2 * time.Minute
+	reindexPageSize   = int64(100)
+)
+
+// handleReindexSearch serves POST /api/search/reindex, starting a job that
+// indexes every image and project again.
+func handleReindexSearch(caller *Caller, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	job := newJob(jobReindexSearch, caller.Username, nil)
+	if err := startJob(job); err != nil {
+		fmt.Printf("Error starting search reindex job: %v\n", err)
+		return errorResponse(500, "Failed to start reindexing", headers)
+	}
+	return jsonResponse(202, job, headers)
+}
+
+// runReindexSearchJob indexes every image, then every project. Done counts
+// those indexed. After reindexTimeBudget it carries on from the next image in
+// another invocation.
+func runReindexSearchJob(run *jobRun) error {
+	started := time.Now()
+	scan := ItemScan{Limit: reindexPageSize}
+	if run.job.Resume != "" {
+		scan.StartKey = Item{"ImageGUID": {S: aws.String(run.job.Resume)}}
+	}
+	for {
+		if run.canceled() {
+			return errJobCanceled
+		}
+		page, err := imageStore.ScanImages(scan)
+		if err != nil {
+			return fmt.Errorf("failed to scan images: %v", err)
+		}
+		done := 0
+		for _, item := range page.Items {
+			var img ImageResponse
+			dynamodbattribute.UnmarshalMap(item, &img)
+			if err := indexSearchDoc(searchDocID(searchDocImage, img.ImageGUID), imageSearchTerms(img)); err != nil {
+				run.itemFailed(img.ImageGUID, err)
+				continue
+			}
+			done++
+		}
+		run.progress(done, 0)
+		if page.LastKey == nil {
+			break
+		}
+		scan.StartKey = page.LastKey
+		if time.Since(started) >= reindexTimeBudget {
+			return run.continueAt(attrString(page.LastKey["ImageGUID"]))
+		}
+	}
+
+	projects := ItemScan{}
+	for {
+		page, err := projectStore.ScanProjects(projects)
+		if err != nil {
+			return fmt.Errorf("failed to scan projects: %v", err)
+		}
+		done := 0
+		for _, item := range page.Items {
+			var project Project
+			dynamodbattribute.UnmarshalMap(item, &project)
+			if err := indexSearchDoc(searchDocID(searchDocProject, project.ProjectID), projectSearchTerms(project)); err != nil {
+				run.itemFailed(project.ProjectID, err)
+				continue
+			}
+			done++
+		}
+		run.progress(done, 0)
+		if page.LastKey == nil {
+			return nil
+		}
+		projects.StartKey = page.LastKey
+	}
+}
+
+// indexImageChange brings the search index up to date after a write to an
+// image, from its table stream, when the write changed what the image is
+// found by. That includes the images the thumbnail function adds.
+func indexImageChange(before, after Item) error {
+	var old, img ImageResponse
+	dynamodbattribute.UnmarshalMap(before, &old)
+	dynamodbattribute.UnmarshalMap(after, &img)
+	terms := imageSearchTerms(img)
+	if before != nil && maps.Equal(imageSearchTerms(old), terms) {
+		return nil
+	}
+	id := old.ImageGUID
+	if after != nil {
+		id = img.ImageGUID
+	}
+	return indexSearchDoc(searchDocID(searchDocImage, id), terms)
+}
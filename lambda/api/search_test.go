@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// search runs a search and returns the result IDs in rank order.
+func (env *testEnv) search(params string) ([]string, SearchResponse) {
+	env.t.Helper()
+	resp := env.call("GET", "/api/search?"+params, "")
+	var page SearchResponse
+	if err := json.Unmarshal([]byte(resp.Body), &page); err != nil || resp.StatusCode != 200 {
+		env.t.Fatalf("search %s: %d %s", params, resp.StatusCode, resp.Body)
+	}
+	var ids []string
+	for _, r := range page.Results {
+		ids = append(ids, r.ID)
+	}
+	return ids, page
+}
+
+// countingImageReads is an image store that counts the images it reads
+// one at a time and the batches it reads.
+type countingImageReads struct {
+	ImageStore
+	gets, batches int
+}
+
+func (s *countingImageReads) GetImage(id string) (Item, error) {
+	s.gets++
+	return s.ImageStore.GetImage(id)
+}
+
+func (s *countingImageReads) GetImages(ids []string, projection string, names map[string]*string) ([]Item, error) {
+	s.batches++
+	return s.ImageStore.GetImages(ids, projection, names)
+}
+
+func TestStemWord(t *testing.T) {
+	for word, want := range map[string]string{
+		"herons": "heron", "berries": "berry", "glasses": "glass", "grass": "grass", "cactus": "cactus",
+		"running": "run", "falling": "fall", "walked": "walk", "stopped": "stop", "speed": "speed",
+		"red": "red", "sing": "sing", "dsc0042": "dsc0042",
+	} {
+		if got := stemWord(word); got != want {
+			t.Errorf("stemWord(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedProject("p1", 1)
+	env.seedImage("heron", map[string]interface{}{
+		"Keywords": []string{"Heron", "lake"}, "Description": "A grey heron wading in the shallows",
+	})
+	env.seedImage("herring", map[string]interface{}{"Description": "Herring gulls over the harbour"})
+	env.seedImage("sunset", map[string]interface{}{
+		"Keywords": []string{"sunset"}, "OriginalFilename": "lake_sunset", "Status": "project", "ProjectID": "p1",
+	})
+	env.seedImage("trashed", map[string]interface{}{"Keywords": []string{"heron"}, "Status": "deleted"})
+	env.login()
+
+	// Rebuilt from nothing
+	searchStore = newMemSearchStore()
+	env.reindex(5)
+
+	for _, tc := range []struct{ q, want string }{
+		// Keywords outrank descriptions, and a prefix match scores less
+		{"herons", "[heron]"},
+		{"her", "[heron herring]"},
+		{"lake", "[heron sunset]"},
+		{"wading heron", "[heron]"},
+		{"heron sunset", "[]"},
+		{"SHALLOW", "[heron]"},
+		{"p1", "[p1]"},
+	} {
+		ids, _ := env.search("q=" + url.QueryEscape(tc.q))
+		if got := fmt.Sprint(ids); got != tc.want {
+			t.Errorf("q=%s: got %s, want %s", tc.q, got, tc.want)
+		}
+	}
+
+	// A page's images are read together
+	reads := &countingImageReads{ImageStore: imageStore}
+	imageStore = reads
+	if ids, _ := env.search("q=heron"); fmt.Sprint(ids) != "[heron]" || reads.gets != 0 || reads.batches != 1 {
+		t.Errorf("q=heron: %s in %d reads and %d batches, want [heron] in one batch", ids, reads.gets, reads.batches)
+	}
+	imageStore = reads.ImageStore
+
+	ids, page := env.search("q=lake&type=image&limit=1")
+	if fmt.Sprint(ids) != "[heron]" || !page.HasMore || page.Results[0].Image == nil || page.Results[0].Score != 3 {
+		t.Fatalf("first page: %s %+v", ids, page)
+	}
+	ids, page = env.search("q=lake&type=image&limit=1&cursor=" + page.NextCursor)
+	if fmt.Sprint(ids) != "[sunset]" || page.HasMore || fmt.Sprint(page.Results[0].Matched) != "[lake]" {
+		t.Errorf("second page: %s %+v", ids, page)
+	}
+
+	for _, q := range []string{"q=", "q=a", "q=heron&type=user", "q=heron&limit=0", "q=heron&cursor=!"} {
+		if resp := env.call("GET", "/api/search?"+q, ""); resp.StatusCode != 400 {
+			t.Errorf("%s: status = %d, want 400", q, resp.StatusCode)
+		}
+	}
+}
+
+func TestSearchIndexedOnWrite(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedImage("img1", nil)
+	env.login()
+
+	env.call("PUT", "/api/images/img1", `{"keywords":["Kingfisher"]}`)
+	if ids, _ := env.search("q=kingfisher"); fmt.Sprint(ids) != "[img1]" {
+		t.Errorf("after keywords: %v", ids)
+	}
+	env.call("PUT", "/api/images/img1", `{"keywords":["Robin"]}`)
+	if ids, _ := env.search("q=kingfisher"); len(ids) != 0 {
+		t.Errorf("old keyword still found: %v", ids)
+	}
+
+	resp := env.call("POST", "/api/projects", `{"name":"Garden Birds"}`)
+	var project Project
+	json.Unmarshal([]byte(resp.Body), &project)
+	if ids, _ := env.search("q=garden&type=project"); fmt.Sprint(ids) != fmt.Sprintf("[%s]", project.ProjectID) {
+		t.Errorf("new project: %v", ids)
+	}
+	env.call("PUT", "/api/projects/"+project.ProjectID, `{"name":"Shorebirds"}`)
+	if ids, _ := env.search("q=garden"); len(ids) != 0 {
+		t.Errorf("old name still found: %v", ids)
+	}
+
+	// Other members only find the projects they are in
+	env.seedUser("fred", roleViewer)
+	env.loginAs("fred", testPassword)
+	if ids, _ := env.search("q=shorebird"); len(ids) != 0 {
+		t.Errorf("non-member found %v", ids)
+	}
+
+	env.login()
+	env.call("DELETE", "/api/projects/"+project.ProjectID, "")
+	if item, _ := searchStore.GetSearchItem(searchDocKey(searchDocID(searchDocProject, project.ProjectID))); item != nil {
+		t.Errorf("deleted project still indexed")
+	}
+}
+
+// reindex runs a search reindex job, which should index done documents, and
+// returns the number of invocations it took.
+func (env *testEnv) reindex(done int) int {
+	env.t.Helper()
+	resp := env.call("POST", "/api/search/reindex", "")
+	if resp.StatusCode != 202 {
+		env.t.Fatalf("reindex: %d %s", resp.StatusCode, resp.Body)
+	}
+	var job Job
+	json.Unmarshal([]byte(resp.Body), &job)
+	runs := 0
+	for n := env.runAsyncMoves(); n > 0; n = env.runAsyncMoves() {
+		runs += n
+	}
+	if job = env.job(job.JobID); job.Type != jobReindexSearch || job.Status != jobSucceeded || job.Done != done || job.Failed != 0 {
+		env.t.Fatalf("job = %+v, want succeeded with %d done", job, done)
+	}
+	return runs
+}
+
+func TestReindexContinues(t *testing.T) {
+	env := newTestEnv(t)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		env.seedImage(id, map[string]interface{}{"Keywords": []string{"owl"}})
+	}
+	env.login()
+	budget, size := reindexTimeBudget, reindexPageSize
+	reindexTimeBudget, reindexPageSize = 0, 2
+	t.Cleanup(func() { reindexTimeBudget, reindexPageSize = budget, size })
+
+	// Carried on across invocations, two images at a time
+	searchStore = newMemSearchStore()
+	if runs := env.reindex(5); runs != 3 {
+		t.Errorf("%d invocations, want 3", runs)
+	}
+	if ids, _ := env.search("q=owl"); len(ids) != 5 {
+		t.Errorf("found %v, want all 5", ids)
+	}
+}
+
+func TestImagesIndexedFromStream(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+
+	// Written by the thumbnail function, not the API
+	env.seedImage("img1", map[string]interface{}{"Keywords": []string{"owl"}})
+	if ids, _ := env.search("q=owl"); fmt.Sprint(ids) != "[img1]" {
+		t.Errorf("new image: %v", ids)
+	}
+	item, _ := imageStore.GetImage("img1")
+	item["Keywords"] = &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{{S: aws.String("hawk")}}}
+	imageStore.PutImage(item)
+	if ids, _ := env.search("q=owl"); len(ids) != 0 {
+		t.Errorf("old keyword still found: %v", ids)
+	}
+	if ids, _ := env.search("q=hawk"); fmt.Sprint(ids) != "[img1]" {
+		t.Errorf("changed image: %v", ids)
+	}
+}
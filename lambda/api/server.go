@@ -0,0 +1,431 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/google/uuid"
+)
+
+// Self-hosted mode runs the same handler behind net/http instead of API
+// Gateway, with a directory standing in for the S3 bucket and an embedded
+// bbolt database standing in for the DynamoDB tables. It is enabled by setting
+// DATA_DIR; SERVER_ADDR makes the binary listen for HTTP instead of starting
+// the Lambda runtime.
+
+const (
+	maxServerRequestBody = 10 * 1024 * 1024 // API Gateway's payload limit
+	localIngestInterval  = 30 * time.Second
+	// The stats are kept up to date as images change; the reconcile only
+	// catches drift and counts incoming/
+	localStatsReconcileInterval = 24 * time.Hour
+)
+
+var (
+	localMode  bool
+	dataDir    string
+	serverAddr string
+	publicURL  string
+	webDir     string
+)
+
+// initLocalBackends replaces the AWS clients with the filesystem and embedded
+// database implementations. Table names default to the logical table names so
+// no configuration beyond DATA_DIR is required.
+func initLocalBackends() {
+	localMode = true
+	if bucketName == "" {
+		bucketName = "local"
+	}
+	if imageTable == "" {
+		imageTable = "ImageMetadata"
+	}
+	if usersTable == "" {
+		usersTable = "Users"
+	}
+	if reviewGroupsTable == "" {
+		reviewGroupsTable = "ReviewGroups"
+	}
+	if projectsTable == "" {
+		projectsTable = "Projects"
+	}
+	if rateLimitTable == "" {
+		rateLimitTable = "RateLimits"
+	}
+	if auditTable == "" {
+		auditTable = "AuditLog"
+	}
+	if searchTable == "" {
+		searchTable = "SearchIndex"
+	}
+	if statsTable == "" {
+		statsTable = "Stats"
+	}
+	if changesTable == "" {
+		changesTable = "Changes"
+	}
+	if jobsTable == "" {
+		jobsTable = "Jobs"
+	}
+	if functionName == "" {
+		functionName = "ImageReviewApi"
+	}
+	if zipLambdaName == "" {
+		zipLambdaName = "ProjectZipGenerator"
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		fmt.Printf("Error creating data directory %s: %v\n", dataDir, err)
+		os.Exit(1)
+	}
+	db, err := newLocalDynamoDB(filepath.Join(dataDir, "kill-snap.db"), localTableSchemas())
+	if err != nil {
+		fmt.Printf("Error opening local database: %v\n", err)
+		os.Exit(1)
+	}
+	objects, err := newLocalS3(filepath.Join(dataDir, "objects"), publicURL, jwtKeys[jwtSigningKid])
+	if err != nil {
+		fmt.Printf("Error opening local object store: %v\n", err)
+		os.Exit(1)
+	}
+	db.watch(imageTable, imageChanged)
+	db.watch(projectsTable, projectChanged)
+	ddbClient = db
+	s3Client = objects
+	invokeAsync = invokeLocal
+	enqueueProjectImages = enqueueLocal
+	fmt.Printf("Self-hosted mode: data in %s\n", dataDir)
+}
+
+// localProjectWorkers bounds the in-process project image workers, like the
+// queue's MaximumConcurrency in template.yaml.
+var localProjectWorkers = make(chan struct{}, 5)
+
+// enqueueLocal stands in for the project image queue: each image is added in
+// a goroutine, at most cap(localProjectWorkers) at once, and tried again
+// after a failure like a redelivered message.
+func enqueueLocal(msgs []ProjectImageMessage) map[string]error {
+	for _, msg := range msgs {
+		go func(msg ProjectImageMessage) {
+			localProjectWorkers <- struct{}{}
+			defer func() { <-localProjectWorkers }()
+			for receives := 1; receives <= maxProjectImageReceives; receives++ {
+				err := addQueuedProjectImage(msg, receives)
+				if err == nil {
+					return
+				}
+				fmt.Printf("Adding image %s to project %s failed, delivery %d: %v\n", msg.ImageGUID, msg.ProjectID, receives, err)
+				time.Sleep(time.Duration(receives) * time.Second)
+			}
+		}(msg)
+	}
+	return nil
+}
+
+// invokeLocal stands in for asynchronous Lambda invocations: self-invokes run
+// the handler in a goroutine and zip requests are built in-process.
+func invokeLocal(name string, payload []byte) error {
+	switch name {
+	case functionName:
+		var req events.APIGatewayProxyRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return fmt.Errorf("failed to decode async payload: %v", err)
+		}
+		go func() {
+			if _, err := handler(context.Background(), req); err != nil {
+				fmt.Printf("Async invocation failed: %v\n", err)
+			}
+		}()
+		return nil
+	case zipLambdaName:
+		var req struct {
+			ProjectID string `json:"projectId"`
+			JobID     string `json:"jobId"`
+		}
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return fmt.Errorf("failed to decode zip payload: %v", err)
+		}
+		go func() {
+			if _, err := runJob(req.JobID); err != nil {
+				fmt.Printf("ERROR: local zip generation for project %s failed: %v\n", req.ProjectID, err)
+			}
+		}()
+		return nil
+	}
+	return fmt.Errorf("unknown function %s", name)
+}
+
+// generateLocalZip is a simplified port of the zip Lambda: it stores every
+// project image and its related files (RAW etc.) in a single archive under the
+// project folder and records it on the project. XMP sidecars are not written.
+// It runs as a zip job, reporting progress on run.
+func generateLocalZip(run *jobRun) error {
+	projectID := run.job.ProjectID
+	projItem, err := projectStore.GetProject(projectID)
+	if err != nil || projItem == nil {
+		return fmt.Errorf("project not found: %s", projectID)
+	}
+	var project Project
+	dynamodbattribute.UnmarshalMap(projItem, &project)
+
+	items, err := queryAllPages(ItemQuery{
+		Index:        "ProjectIndex",
+		KeyCondition: "ProjectID = :pid",
+		Values: map[string]*dynamodb.AttributeValue{
+			":pid": {S: aws.String(projectID)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query project images: %v", err)
+	}
+	var images []ImageResponse
+	for _, item := range items {
+		var img ImageResponse
+		dynamodbattribute.UnmarshalMap(item, &img)
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].OriginalFile < images[j].OriginalFile })
+
+	zipKey := fmt.Sprintf("projects/%s/%s_%s.zip", getProjectS3Prefix(project), sanitizeS3Name(project.Name), time.Now().Format("2006-01-02"))
+	tmp, err := os.CreateTemp("", "project-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw := zip.NewWriter(tmp)
+	names := make(map[string]bool)
+	addFile := func(key string) error {
+		body, err := objectStore.Get(key)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		name := filepath.Base(key)
+		for i := 1; names[name]; i++ {
+			ext := filepath.Ext(key)
+			name = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(filepath.Base(key), ext), i, ext)
+		}
+		names[name] = true
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, body)
+		return err
+	}
+	run.setTotal(len(images))
+	added, failed := 0, 0
+	for i, img := range images {
+		// Stop between images when canceled; the zip so far is discarded
+		if i%50 == 0 && run.canceled() {
+			clearZipPlaceholder(projectID)
+			return errJobCanceled
+		}
+		if err := addFile(img.OriginalFile); err != nil {
+			run.itemFailed(img.ImageGUID, fmt.Errorf("failed to add %s to zip: %v", img.OriginalFile, err))
+			failed++
+			continue
+		}
+		run.progress(1, 0)
+		added++
+		for _, rel := range img.RelatedFiles {
+			if err := addFile(rel); err != nil {
+				fmt.Printf("Warning: failed to add related file %s to zip: %v\n", rel, err)
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := objectStore.Put(zipKey, tmp, "application/zip"); err != nil {
+		return err
+	}
+
+	zipFilesList, _ := dynamodbattribute.MarshalList([]ZipFile{{
+		Key:         zipKey,
+		Size:        info.Size(),
+		ImageCount:  added,
+		FailedCount: failed,
+		CreatedAt:   time.Now().Format(time.RFC3339),
+		Status:      "complete",
+	}})
+	_, err = projectStore.UpdateProject(projectID, ItemUpdate{
+		Expression: "SET ZipFiles = :zips",
+		Values: map[string]*dynamodb.AttributeValue{
+			":zips": {L: zipFilesList},
+		},
+	})
+	if err == nil {
+		fmt.Printf("Local zip created: %s (%d images, %d failed)\n", zipKey, added, failed)
+	}
+	return err
+}
+
+// clearZipPlaceholder removes the "generating" entry of a canceled zip.
+func clearZipPlaceholder(projectID string) {
+	if _, err := projectStore.UpdateProject(projectID, ItemUpdate{Expression: "REMOVE ZipFiles"}); err != nil {
+		fmt.Printf("Error clearing zip status for project %s: %v\n", projectID, err)
+	}
+}
+
+// runServer serves the API, signed media links and (optionally) the built web
+// app over plain HTTP.
+func runServer(addr string) error {
+	if localMode {
+		go runLocalIngest(localIngestInterval)
+		go runLocalStatsReconcile(localStatsReconcileInterval)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", serveAPI)
+	if local, ok := s3Client.(*localS3); ok {
+		mux.HandleFunc("/media/", serveMedia(local))
+	}
+	if webDir != "" {
+		mux.Handle("/", serveWebApp(webDir))
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	fmt.Printf("Listening on %s\n", addr)
+	return server.ListenAndServe()
+}
+
+// serveAPI converts an HTTP request to the API Gateway proxy event the handler
+// expects and writes the proxy response back.
+func serveAPI(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxServerRequestBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, `{"error": "Request body too large"}`, http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, `{"error": "Failed to read request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:            r.Method,
+		Path:                  r.URL.Path,
+		Headers:               make(map[string]string),
+		QueryStringParameters: make(map[string]string),
+		Body:                  string(body),
+		RequestContext: events.APIGatewayProxyRequestContext{
+			RequestID: uuid.New().String(),
+		},
+	}
+	for name, values := range r.Header {
+		request.Headers[name] = values[0]
+	}
+	for name, values := range r.URL.Query() {
+		request.QueryStringParameters[name] = values[0]
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		request.RequestContext.Identity.SourceIP = host
+	}
+
+	response, err := handler(r.Context(), request)
+	if err != nil {
+		fmt.Printf("Handler error for %s %s: %v\n", r.Method, r.URL.Path, err)
+		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	for name, value := range response.Headers {
+		w.Header().Set(name, value)
+	}
+	for name, values := range response.MultiValueHeaders {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	payload := []byte(response.Body)
+	if response.IsBase64Encoded {
+		if payload, err = base64.StdEncoding.DecodeString(response.Body); err != nil {
+			http.Error(w, `{"error": "Invalid response encoding"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(response.StatusCode)
+	w.Write(payload)
+}
+
+// thumbnailKeyPattern matches the keys of the thumbnails the thumbnail
+// function writes, <ImageGUID>.50.jpg and <ImageGUID>.400.jpg under images/,
+// and where moves take them.
+var thumbnailKeyPattern = regexp.MustCompile(`^(images|approved|rejected|deleted|projects)/([A-Za-z0-9_-]+/)*[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\.(50|400)\.jpg$`)
+
+// isThumbnailKey matches the thumbnails the web app loads straight from the
+// image CDN. Uploads and originals named like one are not.
+func isThumbnailKey(key string) bool {
+	return thumbnailKeyPattern.MatchString(key)
+}
+
+// serveMedia serves objects from the local store. Thumbnails are public, as
+// they are behind the CloudFront distribution; everything else requires a
+// link signed by ObjectStore.PresignGet.
+func serveMedia(local *localS3) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/media/")
+		if !isThumbnailKey(key) && !local.verifyMediaURL(key, r.URL.Query()) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		p, err := local.objectPath(key)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if _, err := os.Stat(p); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if filename := r.URL.Query().Get("filename"); filename != "" {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+		}
+		http.ServeFile(w, r, p)
+	}
+}
+
+// serveWebApp serves the built React app, falling back to index.html so
+// client-side routes work on reload.
+func serveWebApp(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(filepath.Clean("/"+r.URL.Path)))); os.IsNotExist(err) {
+			http.ServeFile(w, r, filepath.Join(dir, "index.html"))
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
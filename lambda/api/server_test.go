@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeAPIBodyLimit(t *testing.T) {
+	newTestEnv(t)
+	body := strings.NewReader(`{"username":"` + strings.Repeat("a", maxServerRequestBody) + `"}`)
+	w := httptest.NewRecorder()
+	serveAPI(w, httptest.NewRequest("POST", "/api/auth/login", body))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", w.Code)
+	}
+}
+
+func TestIsThumbnailKey(t *testing.T) {
+	const guid = "0b8f2a52-6f1c-4c3e-9a77-2d1e5b4c9f10"
+	for key, want := range map[string]bool{
+		"images/" + guid + ".50.jpg":                            true,
+		"images/" + guid + ".400.jpg":                           true,
+		"approved/green/2024/05/06/" + guid + ".400.jpg":        true,
+		"projects/smith_wedding/2024/05/06/" + guid + ".50.jpg": true,
+		"images/" + guid + ".jpg":                               false,
+		"images/" + guid + ".50.cr2":                            false,
+		"incoming/" + guid + ".50.jpg":                          false,
+		"incoming/holiday.50.jpg":                               false,
+		"projects/trip/zips/export.400.jpg":                     false,
+		"images/../users/" + guid + ".50.jpg":                   false,
+	} {
+		if got := isThumbnailKey(key); got != want {
+			t.Errorf("isThumbnailKey(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Logins create a session on the user's row. The session is referenced by
+// the sid claim of a short-lived access token and a long-lived refresh
+// token; removing it from the row revokes both. Refresh tokens rotate on
+// every use, and presenting a stale one revokes the whole session since it
+// means the token was copied.
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+
+	tokenTypeAccess  = "access"
+	tokenTypeRefresh = "refresh"
+
+	// Used when JWT_SIGNING_KEYS is not set, e.g. in local development
+	developmentJWTSecret = "kill-snap-secret-key-change-in-production"
+	minJWTSecretLength   = 32
+)
+
+// JWT signing keys by kid. New tokens are signed with jwtSigningKid; tokens
+// are verified with the key their kid header names. To rotate, put a new key
+// first in JWT_SIGNING_KEYS and drop the old one once refresh tokens signed
+// with it have expired.
+var (
+	jwtKeys       map[string][]byte
+	jwtSigningKid string
+)
+
+// parseJWTKeys parses "kid:secret,kid:secret". The first key signs.
+func parseJWTKeys(spec string) (map[string][]byte, string, error) {
+	keys := make(map[string][]byte)
+	var signingKid string
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, secret, ok := strings.Cut(entry, ":")
+		if !ok || kid == "" {
+			return nil, "", fmt.Errorf("JWT key %q must be kid:secret", entry)
+		}
+		if len(secret) < minJWTSecretLength {
+			return nil, "", fmt.Errorf("JWT key %q must be at least %d characters", kid, minJWTSecretLength)
+		}
+		if _, dup := keys[kid]; dup {
+			return nil, "", fmt.Errorf("duplicate JWT kid %q", kid)
+		}
+		keys[kid] = []byte(secret)
+		if signingKid == "" {
+			signingKid = kid
+		}
+	}
+	if signingKid == "" {
+		return nil, "", fmt.Errorf("no JWT keys configured")
+	}
+	return keys, signingKid, nil
+}
+
+func initJWTKeys(spec string) {
+	if spec == "" {
+		fmt.Println("WARNING: JWT_SIGNING_KEYS not set, signing tokens with the development key")
+		jwtKeys, jwtSigningKid = map[string][]byte{"dev": []byte(developmentJWTSecret)}, "dev"
+		return
+	}
+	keys, kid, err := parseJWTKeys(spec)
+	if err != nil {
+		// Refuse to start rather than sign with a key nobody configured
+		panic(fmt.Sprintf("invalid JWT_SIGNING_KEYS: %v", err))
+	}
+	jwtKeys, jwtSigningKid = keys, kid
+}
+
+func signToken(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = jwtSigningKid
+	return token.SignedString(jwtKeys[jwtSigningKid])
+}
+
+// parseToken verifies a token's signature, expiry and type. It does not check
+// whether the session behind it has been revoked.
+func parseToken(tokenString, tokenType string) (jwt.MapClaims, bool) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := jwtKeys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		return nil, false
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, false
+	}
+	if typ, _ := claims["typ"].(string); typ != tokenType {
+		return nil, false
+	}
+	if username, _ := claims["username"].(string); username == "" {
+		return nil, false
+	}
+	if sid, _ := claims["sid"].(string); sid == "" {
+		return nil, false
+	}
+	return claims, true
+}
+
+// Session is one login, stored in the Sessions map on the Users row under its ID.
+type Session struct {
+	RefreshID string `dynamodbav:"RefreshID"`
+	CreatedAt string `dynamodbav:"CreatedAt"`
+	ExpiresAt string `dynamodbav:"ExpiresAt"`
+	// Review decisions this session can undo, oldest first
+	Undo []UndoStep `dynamodbav:"Undo,omitempty"`
+}
+
+func (s Session) expired(now time.Time) bool {
+	t, err := time.Parse(time.RFC3339, s.ExpiresAt)
+	return err != nil || !now.Before(t)
+}
+
+// userSessions returns the sessions stored on a Users row.
+func userSessions(userItem map[string]*dynamodb.AttributeValue) map[string]Session {
+	sessions := make(map[string]Session)
+	if attr := userItem["Sessions"]; attr != nil && attr.M != nil {
+		dynamodbattribute.UnmarshalMap(attr.M, &sessions)
+	}
+	return sessions
+}
+
+// sessionUser returns the account of the session a token refers to, if the
+// session still exists and the account is enabled. The account's role, not
+// the token's, is the one that counts, so a role change applies at once.
+func sessionUser(claims jwt.MapClaims) (User, bool) {
+	username, _ := claims["username"].(string)
+	sid, _ := claims["sid"].(string)
+	userItem, err := withRetry(func() (Item, error) {
+		return userStore.GetUser(username)
+	})
+	if err != nil {
+		fmt.Printf("Failed to check session for %s: %v\n", username, err)
+		return User{}, false
+	}
+	if userItem == nil {
+		return User{}, false
+	}
+	user := userFromItem(userItem)
+	if user.Disabled {
+		return User{}, false
+	}
+	session, ok := userSessions(userItem)[sid]
+	return user, ok && !session.expired(time.Now())
+}
+
+// issueTokens signs an access token and a refresh token for a session.
+func issueTokens(user User, sid string, session Session) (LoginResponse, error) {
+	now := time.Now()
+	accessToken, err := signToken(jwt.MapClaims{
+		"typ":      tokenTypeAccess,
+		"username": user.Username,
+		"role":     user.Role,
+		"sid":      sid,
+		"iat":      now.Unix(),
+		"exp":      now.Add(accessTokenTTL).Unix(),
+	})
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	expiresAt, _ := time.Parse(time.RFC3339, session.ExpiresAt)
+	refreshToken, err := signToken(jwt.MapClaims{
+		"typ":      tokenTypeRefresh,
+		"username": user.Username,
+		"sid":      sid,
+		"jti":      session.RefreshID,
+		"iat":      now.Unix(),
+		"exp":      expiresAt.Unix(),
+	})
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	return LoginResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+		Username:     user.Username,
+		Role:         user.Role,
+	}, nil
+}
+
+// startSession records a new session on the user's row, pruning expired
+// ones, and returns its tokens.
+func startSession(user User, userItem map[string]*dynamodb.AttributeValue) (LoginResponse, error) {
+	now := time.Now()
+	if userItem["Sessions"] == nil {
+		// Nested SETs need the map to exist first
+		_, err := userStore.UpdateUser(user.Username, ItemUpdate{
+			Expression: "SET Sessions = if_not_exists(Sessions, :empty)",
+			Condition:  "attribute_exists(Username)",
+			Values: map[string]*dynamodb.AttributeValue{
+				":empty": {M: map[string]*dynamodb.AttributeValue{}},
+			},
+		})
+		if err != nil {
+			return LoginResponse{}, err
+		}
+	}
+
+	sid := uuid.New().String()
+	session := Session{
+		RefreshID: uuid.New().String(),
+		CreatedAt: now.Format(time.RFC3339),
+		ExpiresAt: now.Add(refreshTokenTTL).Format(time.RFC3339),
+	}
+	sessionAV, err := dynamodbattribute.MarshalMap(session)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+
+	updateExpr := "SET Sessions.#sid = :session"
+	exprNames := map[string]*string{"#sid": aws.String(sid)}
+	var expired []string
+	for id, s := range userSessions(userItem) {
+		if s.expired(now) {
+			name := fmt.Sprintf("#old%d", len(expired))
+			exprNames[name] = aws.String(id)
+			expired = append(expired, "Sessions."+name)
+		}
+	}
+	if len(expired) > 0 {
+		updateExpr += " REMOVE " + strings.Join(expired, ", ")
+	}
+
+	_, err = userStore.UpdateUser(user.Username, ItemUpdate{
+		Expression: updateExpr,
+		Condition:  "attribute_exists(Username)",
+		Names:      exprNames,
+		Values: map[string]*dynamodb.AttributeValue{
+			":session": {M: sessionAV},
+		},
+	})
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	return issueTokens(user, sid, session)
+}
+
+// revokeSession removes one session from a user's row.
+func revokeSession(username, sid string) error {
+	_, err := userStore.UpdateUser(username, ItemUpdate{
+		Expression: "REMOVE Sessions.#sid",
+		Condition:  "attribute_exists(Username)",
+		Names:      map[string]*string{"#sid": aws.String(sid)},
+	})
+	return err
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// handleRefresh exchanges a refresh token for a new token pair. The new
+// access token carries the user's current role.
+func handleRefresh(request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	var req RefreshRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return errorResponse(400, "Invalid request body", headers)
+	}
+	claims, ok := parseToken(req.RefreshToken, tokenTypeRefresh)
+	if !ok {
+		return errorResponse(401, "Invalid refresh token", headers)
+	}
+	username, _ := claims["username"].(string)
+	sid, _ := claims["sid"].(string)
+	refreshID, _ := claims["jti"].(string)
+
+	userItem, err := userStore.GetUser(username)
+	if err != nil {
+		fmt.Printf("Failed to get user %s: %v\n", username, err)
+		return errorResponse(500, "Failed to refresh session", headers)
+	}
+	if userItem == nil {
+		return errorResponse(401, "Invalid refresh token", headers)
+	}
+	user := userFromItem(userItem)
+	if user.Disabled {
+		return errorResponse(403, "Account disabled", headers)
+	}
+	session, ok := userSessions(userItem)[sid]
+	if !ok || session.expired(time.Now()) {
+		return errorResponse(401, "Session expired", headers)
+	}
+	if session.RefreshID != refreshID {
+		fmt.Printf("Refresh token reuse for %s session %s, revoking session\n", username, sid)
+		if err := revokeSession(username, sid); err != nil {
+			fmt.Printf("Failed to revoke session %s: %v\n", sid, err)
+		}
+		return errorResponse(401, "Session revoked", headers)
+	}
+
+	session.RefreshID = uuid.New().String()
+	_, err = userStore.UpdateUser(username, ItemUpdate{
+		Expression: "SET Sessions.#sid.RefreshID = :new",
+		// Only one concurrent refresh with the same token may win
+		Condition: "Sessions.#sid.RefreshID = :old",
+		Names:     map[string]*string{"#sid": aws.String(sid)},
+		Values: map[string]*dynamodb.AttributeValue{
+			":new": {S: aws.String(session.RefreshID)},
+			":old": {S: aws.String(refreshID)},
+		},
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "ConditionalCheckFailed") {
+			return errorResponse(401, "Session revoked", headers)
+		}
+		fmt.Printf("Failed to rotate refresh token for %s: %v\n", username, err)
+		return errorResponse(500, "Failed to refresh session", headers)
+	}
+
+	response, err := issueTokens(user, sid, session)
+	if err != nil {
+		return errorResponse(500, "Failed to generate token", headers)
+	}
+	body, _ := json.Marshal(response)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// handleLogout revokes the session of the calling token.
+func handleLogout(token string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	claims, ok := parseToken(token, tokenTypeAccess)
+	if !ok {
+		return errorResponse(401, "Invalid token", headers)
+	}
+	username, _ := claims["username"].(string)
+	sid, _ := claims["sid"].(string)
+	if err := revokeSession(username, sid); err != nil && !strings.Contains(err.Error(), "ConditionalCheckFailed") {
+		fmt.Printf("Failed to revoke session for %s: %v\n", username, err)
+		return errorResponse(500, "Failed to log out", headers)
+	}
+
+	body, _ := json.Marshal(map[string]bool{"success": true})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// handleRevokeUserSessions signs a user out everywhere.
+func handleRevokeUserSessions(username string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	_, err := userStore.UpdateUser(username, ItemUpdate{
+		Expression: "REMOVE Sessions",
+		Condition:  "attribute_exists(Username)",
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "ConditionalCheckFailed") {
+			return errorResponse(404, "User not found", headers)
+		}
+		fmt.Printf("Failed to revoke sessions for %s: %v\n", username, err)
+		return errorResponse(500, "Failed to revoke sessions", headers)
+	}
+
+	body, _ := json.Marshal(map[string]bool{"success": true})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseJWTKeys(t *testing.T) {
+	long := strings.Repeat("s", minJWTSecretLength)
+	tests := []struct {
+		spec       string
+		wantKid    string
+		wantKeys   int
+		wantErrSub string
+	}{
+		{"k1:" + long, "k1", 1, ""},
+		{"k2:" + long + ", k1:" + long + "x", "k2", 2, ""},
+		{"", "", 0, "no JWT keys"},
+		{long, "", 0, "kid:secret"},
+		{":" + long, "", 0, "kid:secret"},
+		{"k1:short", "", 0, "at least"},
+		{"k1:" + long + ",k1:" + long, "", 0, "duplicate"},
+	}
+	for _, tt := range tests {
+		keys, kid, err := parseJWTKeys(tt.spec)
+		if tt.wantErrSub != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErrSub) {
+				t.Errorf("parseJWTKeys(%q) error = %v, want %q", tt.spec, err, tt.wantErrSub)
+			}
+			continue
+		}
+		if err != nil || kid != tt.wantKid || len(keys) != tt.wantKeys {
+			t.Errorf("parseJWTKeys(%q) = %d keys, kid %q, %v", tt.spec, len(keys), kid, err)
+		}
+	}
+}
+
+func (env *testEnv) refresh(refreshToken string) (LoginResponse, int) {
+	env.t.Helper()
+	body, _ := json.Marshal(RefreshRequest{RefreshToken: refreshToken})
+	resp := env.call("POST", "/api/refresh", string(body))
+	var lr LoginResponse
+	json.Unmarshal([]byte(resp.Body), &lr)
+	return lr, resp.StatusCode
+}
+
+func TestSessions(t *testing.T) {
+	t.Run("refresh rotates and detects reuse", func(t *testing.T) {
+		env := newTestEnv(t)
+		first := env.loginAs(testUser, testPassword)
+
+		second, code := env.refresh(first.RefreshToken)
+		if code != 200 || second.Token == "" || second.RefreshToken == first.RefreshToken {
+			t.Fatalf("refresh: %d %+v", code, second)
+		}
+		env.token = second.Token
+		if resp := env.call("GET", "/api/projects", ""); resp.StatusCode != 200 {
+			t.Fatalf("refreshed token rejected: %d", resp.StatusCode)
+		}
+
+		// Replaying the old refresh token revokes the session
+		if _, code := env.refresh(first.RefreshToken); code != 401 {
+			t.Errorf("reused refresh token: status = %d, want 401", code)
+		}
+		if _, code := env.refresh(second.RefreshToken); code != 401 {
+			t.Errorf("refresh after reuse: status = %d, want 401", code)
+		}
+		if resp := env.call("GET", "/api/projects", ""); resp.StatusCode != 401 {
+			t.Errorf("access token after reuse: status = %d, want 401", resp.StatusCode)
+		}
+	})
+
+	t.Run("access token is not a refresh token", func(t *testing.T) {
+		env := newTestEnv(t)
+		lr := env.loginAs(testUser, testPassword)
+		if _, code := env.refresh(lr.Token); code != 401 {
+			t.Errorf("status = %d, want 401", code)
+		}
+		env.token = lr.RefreshToken
+		if resp := env.call("GET", "/api/projects", ""); resp.StatusCode != 401 {
+			t.Errorf("refresh token as access token: status = %d, want 401", resp.StatusCode)
+		}
+	})
+
+	t.Run("logout revokes only that session", func(t *testing.T) {
+		env := newTestEnv(t)
+		other := env.loginAs(testUser, testPassword)
+		lr := env.loginAs(testUser, testPassword)
+
+		if resp := env.call("POST", "/api/logout", ""); resp.StatusCode != 200 {
+			t.Fatalf("logout: %d %s", resp.StatusCode, resp.Body)
+		}
+		if resp := env.call("GET", "/api/projects", ""); resp.StatusCode != 401 {
+			t.Errorf("after logout: status = %d, want 401", resp.StatusCode)
+		}
+		if _, code := env.refresh(lr.RefreshToken); code != 401 {
+			t.Errorf("refresh after logout: status = %d, want 401", code)
+		}
+		env.token = other.Token
+		if resp := env.call("GET", "/api/projects", ""); resp.StatusCode != 200 {
+			t.Errorf("other session: status = %d, want 200", resp.StatusCode)
+		}
+	})
+
+	t.Run("admin revokes all sessions of a user", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.seedUser("ann", roleReviewer)
+		env.loginAs("ann", testPassword)
+		annToken := env.token
+		env.login()
+
+		if resp := env.call("DELETE", "/api/users/ann/sessions", ""); resp.StatusCode != 200 {
+			t.Fatalf("revoke: %d %s", resp.StatusCode, resp.Body)
+		}
+		if resp := env.call("DELETE", "/api/users/ghost/sessions", ""); resp.StatusCode != 404 {
+			t.Errorf("revoke unknown: status = %d, want 404", resp.StatusCode)
+		}
+		env.token = annToken
+		if resp := env.call("GET", "/api/projects", ""); resp.StatusCode != 401 {
+			t.Errorf("revoked token: status = %d, want 401", resp.StatusCode)
+		}
+		if resp := env.call("DELETE", "/api/users/"+testUser+"/sessions", ""); resp.StatusCode != 401 {
+			t.Errorf("revoked reviewer: status = %d, want 401", resp.StatusCode)
+		}
+	})
+
+	t.Run("disabling a user ends their sessions", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.seedUser("ann", roleReviewer)
+		env.loginAs("ann", testPassword)
+		annToken := env.token
+		env.login()
+		env.call("PUT", "/api/users/ann", `{"disabled":true}`)
+		env.token = annToken
+		if resp := env.call("GET", "/api/projects", ""); resp.StatusCode != 401 {
+			t.Errorf("disabled user's token: status = %d, want 401", resp.StatusCode)
+		}
+	})
+
+	t.Run("key rotation", func(t *testing.T) {
+		env := newTestEnv(t)
+		savedKeys, savedKid := jwtKeys, jwtSigningKid
+		t.Cleanup(func() { jwtKeys, jwtSigningKid = savedKeys, savedKid })
+
+		oldKey := strings.Repeat("o", minJWTSecretLength)
+		newKey := strings.Repeat("n", minJWTSecretLength)
+		jwtKeys, jwtSigningKid, _ = parseJWTKeys("old:" + oldKey)
+		old := env.loginAs(testUser, testPassword)
+
+		// New key signs, old key still verifies
+		jwtKeys, jwtSigningKid, _ = parseJWTKeys("new:" + newKey + ",old:" + oldKey)
+		if resp := env.call("GET", "/api/projects", ""); resp.StatusCode != 200 {
+			t.Errorf("old-key token during rotation: status = %d", resp.StatusCode)
+		}
+		rotated, code := env.refresh(old.RefreshToken)
+		if code != 200 {
+			t.Fatalf("refresh during rotation: %d", code)
+		}
+
+		// Once the old key is dropped only new-key tokens work
+		jwtKeys, jwtSigningKid, _ = parseJWTKeys("new:" + newKey)
+		if resp := env.call("GET", "/api/projects", ""); resp.StatusCode != 401 {
+			t.Errorf("old-key token after rotation: status = %d, want 401", resp.StatusCode)
+		}
+		env.token = rotated.Token
+		if resp := env.call("GET", "/api/projects", ""); resp.StatusCode != 200 {
+			t.Errorf("new-key token after rotation: status = %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// The dashboard's image counts are kept in the stats table rather than
+// counted on each request. Every write to ImageMetadata reaches
+// countImageChange through the table's stream (in self-hosted mode and the
+// tests, straight from the store), which takes the counters of the old image
+// from those of the new one and adds the difference. The stats table holds
+// one item per family of counters below, whose attributes are the counts,
+// so /api/stats is a handful of GetItems.
+//
+// A reconcile job recomputes everything from a scan of the images each
+// night, putting right any drift and counting the files in incoming/.
+
+const (
+	statsStatusKey    = "status"    // unreviewed, approved, rejected, deleted and project
+	statsGroupsKey    = "groups"    // by group number, not counting deleted images
+	statsProjectsKey  = "projects"  // by project ID, not counting deleted images
+	statsIngestKey    = "ingest"    // by the UTC day the image was added, 2006-01-02
+	statsReconcileKey = "reconcile" // Incoming and ReconciledAt from the last reconcile
+
+	// A stream record counted is marked so a retried batch doesn't count it
+	// again. Lambda retries records for up to a day, when the stream drops them.
+	statsEventPrefix = "event#"
+	statsEventTTL    = 48 * time.Hour
+
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+)
+
+var statsFamilies = []string{statsStatusKey, statsGroupsKey, statsProjectsKey, statsIngestKey}
+
+// statsClock is replaced in tests.
+var statsClock = time.Now
+
+type GroupStat struct {
+	Group int `json:"group"`
+	Count int `json:"count"`
+}
+
+type ProjectStat struct {
+	ProjectID string `json:"projectId"`
+	Count     int    `json:"count"`
+}
+
+type IngestStat struct {
+	Day   string `json:"day"` // 2006-01-02, UTC
+	Count int    `json:"count"`
+}
+
+// statCounter names one count: an attribute of a stats item.
+type statCounter struct{ key, name string }
+
+// reviewCategory puts an image in one of the dashboard's review counts.
+// Images reviewed in the inbox are approved ones waiting for their files to
+// move.
+func reviewCategory(status, reviewed string) string {
+	switch status {
+	case "approved", "rejected", "deleted", "project":
+		return status
+	}
+	if reviewed == "true" {
+		return "approved"
+	}
+	return "unreviewed"
+}
+
+// imageCounters returns the counters an image adds one to.
+func imageCounters(item Item) []statCounter {
+	if item == nil {
+		return nil
+	}
+	var img struct {
+		Status           string
+		Reviewed         string
+		GroupNumber      int
+		ProjectID        string
+		InsertedDateTime string
+	}
+	dynamodbattribute.UnmarshalMap(item, &img)
+
+	counters := []statCounter{{statsStatusKey, reviewCategory(img.Status, img.Reviewed)}}
+	if img.Status != "deleted" {
+		if img.GroupNumber > 0 {
+			counters = append(counters, statCounter{statsGroupsKey, strconv.Itoa(img.GroupNumber)})
+		}
+		if img.ProjectID != "" {
+			counters = append(counters, statCounter{statsProjectsKey, img.ProjectID})
+		}
+	}
+	if len(img.InsertedDateTime) >= len("2006-01-02") {
+		counters = append(counters, statCounter{statsIngestKey, img.InsertedDateTime[:len("2006-01-02")]})
+	}
+	return counters
+}
+
+// statsUpdates turns counter changes into one ADD per stats item, leaving
+// out counters that didn't change.
+func statsUpdates(deltas map[statCounter]int) []KeyedUpdate {
+	byKey := make(map[string][]statCounter)
+	for c, n := range deltas {
+		if n != 0 {
+			byKey[c.key] = append(byKey[c.key], c)
+		}
+	}
+	var updates []KeyedUpdate
+	for _, key := range statsFamilies {
+		counters := byKey[key]
+		if len(counters) == 0 {
+			continue
+		}
+		sort.Slice(counters, func(i, j int) bool { return counters[i].name < counters[j].name })
+		u := ItemUpdate{Names: make(map[string]*string), Values: make(Item)}
+		for i, c := range counters {
+			if i > 0 {
+				u.Expression += ", "
+			}
+			u.Expression += fmt.Sprintf("#c%d :c%d", i, i)
+			u.Names[fmt.Sprintf("#c%d", i)] = aws.String(c.name)
+			u.Values[fmt.Sprintf(":c%d", i)] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(deltas[c]))}
+		}
+		u.Expression = "ADD " + u.Expression
+		updates = append(updates, KeyedUpdate{ID: key, ItemUpdate: u})
+	}
+	return updates
+}
+
+// countImageChange applies a write to an image to the counters. before is
+// nil for a new image and after is nil for a deleted one. eventID identifies
+// the write: a write already counted is skipped.
+func countImageChange(eventID string, before, after Item) error {
+	deltas := make(map[statCounter]int)
+	for _, c := range imageCounters(before) {
+		deltas[c]--
+	}
+	for _, c := range imageCounters(after) {
+		deltas[c]++
+	}
+	updates := statsUpdates(deltas)
+	if len(updates) == 0 {
+		return nil
+	}
+
+	marker := KeyedUpdate{ID: statsEventPrefix + eventID, ItemUpdate: ItemUpdate{
+		Expression: "SET ExpiresAt = :expires",
+		Condition:  "attribute_not_exists(StatKey)",
+		Values: Item{
+			":expires": {N: aws.String(strconv.FormatInt(statsClock().Add(statsEventTTL).Unix(), 10))},
+		},
+	}}
+	err := statsStore.UpdateStats(append([]KeyedUpdate{marker}, updates...))
+	var canceled *dynamodb.TransactionCanceledException
+	if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 &&
+		aws.StringValue(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+		return nil
+	}
+	return err
+}
+
+// readStats returns the counts in a stats item.
+func readStats(key string) (map[string]int, error) {
+	item, err := statsStore.GetStats(key)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for name, av := range item {
+		if av.N == nil {
+			continue
+		}
+		if n, err := strconv.Atoi(*av.N); err == nil {
+			counts[name] = n
+		}
+	}
+	return counts, nil
+}
+
+// loadLibraryStats fills in the image counts of a stats response, with the
+// ingest counts of the last days days. Projects the caller can't see are
+// left out.
+func loadLibraryStats(caller *Caller, days int, stats *StatsResponse) error {
+	counts := make(map[string]map[string]int)
+	for _, key := range statsFamilies {
+		c, err := readStats(key)
+		if err != nil {
+			return fmt.Errorf("failed to read %s stats: %v", key, err)
+		}
+		counts[key] = c
+	}
+	reconcile, err := statsStore.GetStats(statsReconcileKey)
+	if err != nil {
+		return fmt.Errorf("failed to read reconcile stats: %v", err)
+	}
+	var last struct {
+		Incoming     int
+		ReconciledAt string
+	}
+	dynamodbattribute.UnmarshalMap(reconcile, &last)
+	stats.IncomingCount = last.Incoming
+	stats.ReconciledAt = last.ReconciledAt
+
+	status := counts[statsStatusKey]
+	stats.UnreviewedCount = status["unreviewed"]
+	stats.ApprovedCount = status["approved"]
+	stats.RejectedCount = status["rejected"]
+	stats.DeletedCount = status["deleted"]
+	stats.ProjectCount = status["project"]
+	stats.ReviewedCount = stats.ApprovedCount + stats.RejectedCount + stats.DeletedCount + stats.ProjectCount
+	stats.ProcessedCount = stats.UnreviewedCount + stats.ReviewedCount
+
+	stats.Groups = []GroupStat{}
+	for name, n := range counts[statsGroupsKey] {
+		if group, err := strconv.Atoi(name); err == nil && n > 0 {
+			stats.Groups = append(stats.Groups, GroupStat{Group: group, Count: n})
+		}
+	}
+	sort.Slice(stats.Groups, func(i, j int) bool { return stats.Groups[i].Group < stats.Groups[j].Group })
+
+	visible := projectFilter(caller)
+	stats.Projects = []ProjectStat{}
+	for projectID, n := range counts[statsProjectsKey] {
+		if n > 0 && visible(projectID) {
+			stats.Projects = append(stats.Projects, ProjectStat{ProjectID: projectID, Count: n})
+		}
+	}
+	sort.Slice(stats.Projects, func(i, j int) bool { return stats.Projects[i].ProjectID < stats.Projects[j].ProjectID })
+
+	// Days without new images are left out
+	stats.Ingest = []IngestStat{}
+	today := statsClock().UTC()
+	for ago := days - 1; ago >= 0; ago-- {
+		day := today.AddDate(0, 0, -ago).Format("2006-01-02")
+		if n := counts[statsIngestKey][day]; n > 0 {
+			stats.Ingest = append(stats.Ingest, IngestStat{Day: day, Count: n})
+		}
+	}
+	return nil
+}
+
+// handleReconcileStats recomputes every counter from a scan of the images,
+// for the reconcile-stats scheduled event, and counts the files waiting in
+// incoming/. Changes made while it runs may be counted twice or not at all
+// until the next run, so it is scheduled for a quiet time.
+func handleReconcileStats() error {
+	counts := make(map[string]map[string]int)
+	for _, key := range statsFamilies {
+		counts[key] = make(map[string]int)
+	}
+	err := scanAllImages(ItemScan{
+		Projection: "#status, #reviewed, #group, #project, #inserted",
+		Names: map[string]*string{
+			"#status":   aws.String("Status"),
+			"#reviewed": aws.String("Reviewed"),
+			"#group":    aws.String("GroupNumber"),
+			"#project":  aws.String("ProjectID"),
+			"#inserted": aws.String("InsertedDateTime"),
+		},
+	}, func(items []map[string]*dynamodb.AttributeValue) {
+		for _, item := range items {
+			for _, c := range imageCounters(item) {
+				counts[c.key][c.name]++
+			}
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan images: %v", err)
+	}
+
+	for _, key := range statsFamilies {
+		old, err := readStats(key)
+		if err != nil {
+			return fmt.Errorf("failed to read %s stats: %v", key, err)
+		}
+		for name, n := range old {
+			if counts[key][name] != n {
+				fmt.Printf("Stats reconcile: %s %s was %d, now %d\n", key, name, n, counts[key][name])
+			}
+		}
+		for name, n := range counts[key] {
+			if _, ok := old[name]; !ok {
+				fmt.Printf("Stats reconcile: %s %s was 0, now %d\n", key, name, n)
+			}
+		}
+		item := Item{"StatKey": {S: aws.String(key)}}
+		for name, n := range counts[key] {
+			item[name] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(n))}
+		}
+		if err := statsStore.PutStats(item); err != nil {
+			return fmt.Errorf("failed to write %s stats: %v", key, err)
+		}
+	}
+
+	incoming, err := objectStore.List("incoming/")
+	if err != nil {
+		return fmt.Errorf("failed to list incoming objects: %v", err)
+	}
+	err = statsStore.PutStats(Item{
+		"StatKey":      {S: aws.String(statsReconcileKey)},
+		"Incoming":     {N: aws.String(strconv.Itoa(len(incoming)))},
+		"ReconciledAt": {S: aws.String(statsClock().UTC().Format(time.RFC3339))},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write reconcile stats: %v", err)
+	}
+	fmt.Printf("Stats reconcile complete: %d incoming files\n", len(incoming))
+	return nil
+}
+
+// runLocalStatsReconcile reconciles the stats at start-up and then every
+// interval until the process exits, standing in for the schedule in
+// self-hosted mode.
+func runLocalStatsReconcile(interval time.Duration) {
+	for {
+		if err := handleReconcileStats(); err != nil {
+			fmt.Printf("Stats reconcile error: %v\n", err)
+		}
+		time.Sleep(interval)
+	}
+}
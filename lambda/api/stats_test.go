@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// stats fetches GET /api/stats.
+func (env *testEnv) stats() StatsResponse {
+	env.t.Helper()
+	resp := env.call("GET", "/api/stats", "")
+	var stats StatsResponse
+	if err := json.Unmarshal([]byte(resp.Body), &stats); err != nil || resp.StatusCode != 200 {
+		env.t.Fatalf("stats: %d %s", resp.StatusCode, resp.Body)
+	}
+	stats.LastUpdated = ""
+	return stats
+}
+
+// setStatsClock fixes the day the stats are read on.
+func setStatsClock(t *testing.T) {
+	saved := statsClock
+	t.Cleanup(func() { statsClock = saved })
+	statsClock = func() time.Time { return time.Date(2025, 7, 17, 9, 0, 0, 0, time.UTC) }
+}
+
+func TestStatsFollowImageChanges(t *testing.T) {
+	env := newTestEnv(t)
+	setStatsClock(t)
+	env.seedProject("p1", 1)
+	env.seedImage("a", map[string]interface{}{"InsertedDateTime": "2025-07-16T10:00:00Z"})
+	env.seedImage("b", map[string]interface{}{"InsertedDateTime": "2025-07-16T11:00:00Z"})
+	env.seedImage("c", map[string]interface{}{"InsertedDateTime": "2025-07-17T08:00:00Z", "Status": "approved", "Reviewed": "true", "GroupNumber": 2})
+	env.seedImage("d", map[string]interface{}{"Status": "project", "Reviewed": "true", "GroupNumber": 2, "ProjectID": "p1"})
+	env.seedImage("old", map[string]interface{}{"InsertedDateTime": "2025-05-01T00:00:00Z", "Status": "deleted", "GroupNumber": 1})
+	env.login()
+
+	// Approve a, reject b
+	for id, body := range map[string]string{"a": `{"groupNumber":1,"reviewed":"true"}`, "b": `{"groupNumber":0,"reviewed":"true"}`} {
+		if resp := env.call("PUT", "/api/images/"+id, body); resp.StatusCode != 200 {
+			t.Fatalf("review %s: %d %s", id, resp.StatusCode, resp.Body)
+		}
+	}
+	env.runAsyncMoves()
+
+	stats := env.stats()
+	want := StatsResponse{
+		ProcessedCount: 5, ReviewedCount: 5,
+		ApprovedCount: 2, RejectedCount: 1, DeletedCount: 1, ProjectCount: 1,
+		Groups:   []GroupStat{{1, 1}, {2, 2}},
+		Projects: []ProjectStat{{"p1", 1}},
+		Ingest:   []IngestStat{{"2025-07-16", 2}, {"2025-07-17", 1}},
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("stats = %+v\nwant %+v", stats, want)
+	}
+
+	if resp := env.call("GET", "/api/stats?days=0", ""); resp.StatusCode != 400 {
+		t.Errorf("days=0: status = %d, want 400", resp.StatusCode)
+	}
+	resp := env.call("GET", "/api/stats?days=90", "")
+	var longer StatsResponse
+	json.Unmarshal([]byte(resp.Body), &longer)
+	if len(longer.Ingest) != 3 || longer.Ingest[0] != (IngestStat{"2025-05-01", 1}) {
+		t.Errorf("90 days of ingest = %+v", longer.Ingest)
+	}
+
+	// Projects the caller can't see are left out
+	env.seedUser("fred", roleViewer)
+	env.loginAs("fred", testPassword)
+	if stats := env.stats(); len(stats.Projects) != 0 || stats.ProjectCount != 1 {
+		t.Errorf("viewer's projects = %+v", stats.Projects)
+	}
+}
+
+func TestReconcileStats(t *testing.T) {
+	env := newTestEnv(t)
+	setStatsClock(t)
+	env.seedProject("p1", 1)
+	env.seedImage("a", map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 3})
+	env.seedImage("b", map[string]interface{}{"Status": "project", "Reviewed": "true", "GroupNumber": 3, "ProjectID": "p1"})
+	env.seedImage("c", nil)
+	objectStore.Put("incoming/new.jpg", strings.NewReader("new"), "image/jpeg")
+	env.login()
+	counted := env.stats()
+
+	// Counts drift, e.g. when images changed before the stream was enabled
+	statsStore.PutStats(Item{"StatKey": {S: aws.String(statsStatusKey)}, "approved": {N: aws.String("7")}, "unreviewed": {N: aws.String("-2")}})
+	statsStore.PutStats(Item{"StatKey": {S: aws.String(statsProjectsKey)}, "gone": {N: aws.String("4")}})
+
+	resp, err := handleEvent(context.Background(), json.RawMessage(`{"version": "0", "source": "aws.events", "detail-type": "Scheduled Event", "detail": {"action": "reconcile-stats"}}`))
+	if proxy, ok := resp.(events.APIGatewayProxyResponse); err != nil || !ok || proxy.StatusCode != 200 {
+		t.Fatalf("reconcile: %v %+v", err, resp)
+	}
+	reconciled := env.stats()
+	if reconciled.IncomingCount != 1 || reconciled.ReconciledAt != "2025-07-17T09:00:00Z" {
+		t.Errorf("incoming = %d, reconciled at %q", reconciled.IncomingCount, reconciled.ReconciledAt)
+	}
+	reconciled.IncomingCount, reconciled.ReconciledAt = 0, ""
+	if !reflect.DeepEqual(reconciled, counted) {
+		t.Errorf("reconciled stats = %+v\nwant %+v", reconciled, counted)
+	}
+}
+
+func TestStreamRecords(t *testing.T) {
+	env := newTestEnv(t)
+	setStatsClock(t)
+	saved := imageTable
+	defer func() { imageTable = saved }()
+	imageTable = "kill-snap-ImageMetadata"
+	env.login()
+
+	record := func(id, name, table, oldImage, newImage string) string {
+		return fmt.Sprintf(`{"eventID": %q, "eventName": %q, "eventSource": "aws:dynamodb",
+			"eventSourceARN": "arn:aws:dynamodb:us-east-1:123456789012:table/%s/stream/2025-01-01T00:00:00.000",
+			"dynamodb": {"Keys": {"ImageGUID": {"S": "a"}}, "OldImage": %s, "NewImage": %s}}`, id, name, table, oldImage, newImage)
+	}
+	inbox := `{"ImageGUID": {"S": "a"}, "Status": {"S": "inbox"}, "Reviewed": {"S": "false"}, "InsertedDateTime": {"S": "2025-07-17T08:00:00Z"}}`
+	approved := `{"ImageGUID": {"S": "a"}, "Status": {"S": "approved"}, "Reviewed": {"S": "true"}, "GroupNumber": {"N": "4"}, "InsertedDateTime": {"S": "2025-07-17T08:00:00Z"}}`
+	batch := `{"Records": [` + strings.Join([]string{
+		record("1", "INSERT", "kill-snap-ImageMetadata", "null", inbox),
+		record("2", "MODIFY", "kill-snap-ImageMetadata", inbox, approved),
+		record("3", "INSERT", "kill-snap-Projects", "null", `{"ProjectID": {"S": "p1"}}`),
+	}, ",") + `]}`
+
+	// A batch delivered twice is counted once
+	for i := 0; i < 2; i++ {
+		if _, err := handleEvent(context.Background(), json.RawMessage(batch)); err != nil {
+			t.Fatalf("delivery %d: %v", i, err)
+		}
+	}
+	stats := env.stats()
+	if stats.ApprovedCount != 1 || stats.UnreviewedCount != 0 || !reflect.DeepEqual(stats.Groups, []GroupStat{{4, 1}}) ||
+		!reflect.DeepEqual(stats.Ingest, []IngestStat{{"2025-07-17", 1}}) {
+		t.Errorf("stats = %+v", stats)
+	}
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Handlers reach storage through the stores below rather than the AWS clients,
+// so they can run against DynamoDB/S3 (including the self-hosted backends,
+// which stand in for those clients) or against the in-memory stores used by
+// the tests. Updates, queries and scans keep DynamoDB expression syntax so the
+// condition expressions guarding the review state machine stay in one place.
+
+// Item is a table item or key in DynamoDB attribute-value form.
+type Item = map[string]*dynamodb.AttributeValue
+
+// ItemUpdate is an UpdateItem request without the table and key.
+type ItemUpdate struct {
+	Expression   string
+	Condition    string
+	Names        map[string]*string
+	Values       Item
+	ReturnValues string // e.g. dynamodb.ReturnValueAllNew
+}
+
+// KeyedUpdate is an update of the item with the given hash key, for use in a
+// transaction.
+type KeyedUpdate struct {
+	ID string
+	ItemUpdate
+}
+
+// ItemQuery is a Query against the table or one of its GSIs.
+type ItemQuery struct {
+	Index        string
+	KeyCondition string
+	Filter       string
+	Projection   string
+	Names        map[string]*string
+	Values       Item
+	Limit        int64
+	StartKey     Item
+	Descending   bool
+	// ConsistentRead sees every write made before the query. Indexes
+	// don't support it.
+	ConsistentRead bool
+}
+
+// ItemScan is a Scan of a whole table.
+type ItemScan struct {
+	Filter     string
+	Projection string
+	Names      map[string]*string
+	Values     Item
+	Limit      int64
+	StartKey   Item
+}
+
+// ItemPage is one page of query or scan results. LastKey is nil on the last page.
+type ItemPage struct {
+	Items   []Item
+	LastKey Item
+}
+
+// ImageStore holds image metadata and the review history written alongside it.
+type ImageStore interface {
+	// GetImage returns nil without error when the image does not exist.
+	GetImage(imageGUID string) (Item, error)
+	// GetImages returns those of the images that exist, in no particular
+	// order, with the attributes in projection, or all of them without.
+	GetImages(imageGUIDs []string, projection string, names map[string]*string) ([]Item, error)
+	PutImage(item Item) error
+	UpdateImage(imageGUID string, update ItemUpdate) (Item, error)
+	DeleteImage(imageGUID string) error
+	QueryImages(query ItemQuery) (*ItemPage, error)
+	ScanImages(scan ItemScan) (*ItemPage, error)
+	PutReviewRecord(item Item) error
+	// UpdateImages applies up to 100 updates in one transaction. When any
+	// condition fails nothing is applied and the error is a
+	// *dynamodb.TransactionCanceledException with a reason per update.
+	UpdateImages(updates []KeyedUpdate) error
+	// UpdateImageAndProject applies an update of an image and one of a
+	// project in one transaction, failing like UpdateImages.
+	UpdateImageAndProject(image, project KeyedUpdate) error
+}
+
+// ProjectStore holds projects.
+type ProjectStore interface {
+	// GetProject returns nil without error when the project does not exist.
+	GetProject(projectID string) (Item, error)
+	PutProject(item Item) error
+	UpdateProject(projectID string, update ItemUpdate) (Item, error)
+	DeleteProject(projectID string) error
+	ScanProjects(scan ItemScan) (*ItemPage, error)
+}
+
+// UserStore holds user accounts and their settings.
+type UserStore interface {
+	// GetUser returns nil without error when the user does not exist.
+	GetUser(username string) (Item, error)
+	PutUser(item Item) error
+	UpdateUser(username string, update ItemUpdate) (Item, error)
+	ScanUsers(scan ItemScan) (*ItemPage, error)
+}
+
+// CounterStore holds rate limit counters. Counters carry an ExpiresAt epoch
+// that DynamoDB's TTL uses to delete them; readers must not rely on the
+// deletion being prompt.
+type CounterStore interface {
+	// GetCounter returns nil without error when the counter does not exist.
+	GetCounter(key string) (Item, error)
+	UpdateCounter(key string, update ItemUpdate) (Item, error)
+	DeleteCounter(key string) error
+}
+
+// AuditStore holds the append-only audit log. There is deliberately no way
+// to update or delete events.
+type AuditStore interface {
+	PutAuditEvent(item Item) error
+	QueryAuditEvents(query ItemQuery) (*ItemPage, error)
+}
+
+// SearchStore holds the search index. Its items have a two-part key, so they
+// are read and deleted by the full key item.
+type SearchStore interface {
+	// GetSearchItem returns nil without error when the item does not exist.
+	GetSearchItem(key Item) (Item, error)
+	PutSearchItem(item Item) error
+	DeleteSearchItem(key Item) error
+	QuerySearch(query ItemQuery) (*ItemPage, error)
+}
+
+// StatsStore holds the library statistics counters. Counter updates are
+// applied as a transaction so a change is counted entirely or not at all.
+type StatsStore interface {
+	// GetStats returns nil without error when the item does not exist.
+	GetStats(key string) (Item, error)
+	PutStats(item Item) error
+	// UpdateStats applies up to 100 updates in one transaction, failing like
+	// ImageStore.UpdateImages.
+	UpdateStats(updates []KeyedUpdate) error
+}
+
+// ChangeStore holds the change log, one ordered partition of numbered
+// changes. Its items have a two-part key, like the search index.
+type ChangeStore interface {
+	// PutChange writes an item when condition, if any, holds of the item it
+	// replaces, failing with ConditionalCheckFailedException otherwise.
+	PutChange(item Item, condition string, values Item) error
+	QueryChanges(query ItemQuery) (*ItemPage, error)
+}
+
+// JobStore holds the jobs run in the background and their progress.
+type JobStore interface {
+	// GetJob returns nil without error when the job does not exist.
+	GetJob(jobID string) (Item, error)
+	PutJob(item Item) error
+	UpdateJob(jobID string, update ItemUpdate) (Item, error)
+	// UpdateJobs applies updates to several items of the table in one
+	// transaction, failing like ImageStore.UpdateImages.
+	UpdateJobs(updates []KeyedUpdate) error
+	QueryJobs(query ItemQuery) (*ItemPage, error)
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// ObjectStore holds image files, thumbnails and zips under their bucket keys.
+type ObjectStore interface {
+	Get(key string) (io.ReadCloser, error)
+	Put(key string, body io.Reader, contentType string) error
+	Copy(srcKey, dstKey string) error
+	// Delete succeeds when the object does not exist.
+	Delete(key string) error
+	Exists(key string) bool
+	// List returns every object under prefix in key order.
+	List(prefix string) ([]ObjectInfo, error)
+	// PresignGet returns a time-limited download URL. When filename is set the
+	// download is served as an attachment with that name.
+	PresignGet(key, filename string, expiry time.Duration) (string, error)
+}
+
+var (
+	imageStore   ImageStore
+	projectStore ProjectStore
+	userStore    UserStore
+	counterStore CounterStore
+	auditStore   AuditStore
+	searchStore  SearchStore
+	statsStore   StatsStore
+	changeStore  ChangeStore
+	jobStore     JobStore
+	objectStore  ObjectStore
+)
+
+// initStores binds the stores to the configured tables and bucket. It runs
+// after the self-hosted backends, if any, have replaced the AWS clients.
+func initStores() {
+	imageStore = &dynamoImageStore{
+		images:   dynamoTable{name: imageTable, hashKey: "ImageGUID"},
+		reviews:  dynamoTable{name: reviewGroupsTable, hashKey: "ReviewID"},
+		projects: dynamoTable{name: projectsTable, hashKey: "ProjectID"},
+	}
+	projectStore = &dynamoProjectStore{dynamoTable{name: projectsTable, hashKey: "ProjectID"}}
+	userStore = &dynamoUserStore{dynamoTable{name: usersTable, hashKey: "Username"}}
+	counterStore = &dynamoCounterStore{dynamoTable{name: rateLimitTable, hashKey: "CounterKey"}}
+	auditStore = &dynamoAuditStore{dynamoTable{name: auditTable, hashKey: "EventID"}}
+	searchStore = &dynamoSearchStore{dynamoTable{name: searchTable, hashKey: "TermPrefix"}}
+	statsStore = &dynamoStatsStore{dynamoTable{name: statsTable, hashKey: "StatKey"}}
+	changeStore = &dynamoChangeStore{dynamoTable{name: changesTable, hashKey: "Feed"}}
+	jobStore = &dynamoJobStore{dynamoTable{name: jobsTable, hashKey: "JobID"}}
+	objectStore = &s3ObjectStore{bucket: bucketName}
+}
+
+// dynamoTable performs item operations on one table through ddbClient.
+type dynamoTable struct {
+	name    string
+	hashKey string
+}
+
+func (t dynamoTable) key(id string) Item {
+	return Item{t.hashKey: {S: aws.String(id)}}
+}
+
+func nonEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+func (t dynamoTable) get(id string) (Item, error) {
+	return t.getKey(t.key(id))
+}
+
+func (t dynamoTable) getKey(key Item) (Item, error) {
+	result, err := ddbClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(t.name),
+		Key:       key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Item, nil
+}
+
+// batchGetSize is the most keys BatchGetItem takes.
+const batchGetSize = 100
+
+// batchGet reads the items that exist of those with the IDs, in no
+// particular order. Keys DynamoDB leaves unprocessed are asked for again.
+func (t dynamoTable) batchGet(ids []string, projection string, names map[string]*string) ([]Item, error) {
+	var items []Item
+	for start := 0; start < len(ids); start += batchGetSize {
+		request := &dynamodb.KeysAndAttributes{ProjectionExpression: nonEmpty(projection)}
+		for _, id := range ids[start:min(start+batchGetSize, len(ids))] {
+			request.Keys = append(request.Keys, t.key(id))
+		}
+		// DynamoDB rejects names the expression doesn't use
+		for _, part := range strings.FieldsFunc(projection, func(r rune) bool { return strings.ContainsRune(" ,.[", r) }) {
+			if name, ok := names[part]; ok {
+				if request.ExpressionAttributeNames == nil {
+					request.ExpressionAttributeNames = make(map[string]*string)
+				}
+				request.ExpressionAttributeNames[part] = name
+			}
+		}
+		unprocessed := map[string]*dynamodb.KeysAndAttributes{t.name: request}
+		for attempt := 0; len(unprocessed) > 0; attempt++ {
+			if attempt > maxRetries {
+				return nil, fmt.Errorf("%d keys still unprocessed", len(unprocessed[t.name].Keys))
+			}
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+			}
+			result, err := ddbClient.BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: unprocessed})
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, result.Responses[t.name]...)
+			unprocessed = result.UnprocessedKeys
+		}
+	}
+	return items, nil
+}
+
+func (t dynamoTable) put(item Item) error {
+	_, err := ddbClient.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(t.name),
+		Item:      item,
+	})
+	return err
+}
+
+// putIf is put with a condition on the item replaced.
+func (t dynamoTable) putIf(item Item, condition string, values Item) error {
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String(t.name),
+		Item:                item,
+		ConditionExpression: nonEmpty(condition),
+	}
+	if len(values) > 0 {
+		input.ExpressionAttributeValues = values
+	}
+	_, err := ddbClient.PutItem(input)
+	return err
+}
+
+func (t dynamoTable) update(id string, u ItemUpdate) (Item, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(t.name),
+		Key:                 t.key(id),
+		UpdateExpression:    nonEmpty(u.Expression),
+		ConditionExpression: nonEmpty(u.Condition),
+		ReturnValues:        nonEmpty(u.ReturnValues),
+	}
+	if len(u.Names) > 0 {
+		input.ExpressionAttributeNames = u.Names
+	}
+	if len(u.Values) > 0 {
+		input.ExpressionAttributeValues = u.Values
+	}
+	result, err := ddbClient.UpdateItem(input)
+	if err != nil {
+		return nil, err
+	}
+	return result.Attributes, nil
+}
+
+func (t dynamoTable) transactUpdate(updates []KeyedUpdate) error {
+	items := make([]*dynamodb.TransactWriteItem, len(updates))
+	for i, u := range updates {
+		items[i] = t.transactItem(u)
+	}
+	_, err := ddbClient.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: items})
+	return err
+}
+
+// transactItem is an update of the table for a transaction, which may span
+// tables.
+func (t dynamoTable) transactItem(u KeyedUpdate) *dynamodb.TransactWriteItem {
+	update := &dynamodb.Update{
+		TableName:           aws.String(t.name),
+		Key:                 t.key(u.ID),
+		UpdateExpression:    aws.String(u.Expression),
+		ConditionExpression: nonEmpty(u.Condition),
+	}
+	if len(u.Names) > 0 {
+		update.ExpressionAttributeNames = u.Names
+	}
+	if len(u.Values) > 0 {
+		update.ExpressionAttributeValues = u.Values
+	}
+	return &dynamodb.TransactWriteItem{Update: update}
+}
+
+func (t dynamoTable) delete(id string) error {
+	return t.deleteKey(t.key(id))
+}
+
+func (t dynamoTable) deleteKey(key Item) error {
+	_, err := ddbClient.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(t.name),
+		Key:       key,
+	})
+	return err
+}
+
+func (t dynamoTable) query(q ItemQuery) (*ItemPage, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(t.name),
+		IndexName:              nonEmpty(q.Index),
+		KeyConditionExpression: aws.String(q.KeyCondition),
+		FilterExpression:       nonEmpty(q.Filter),
+		ProjectionExpression:   nonEmpty(q.Projection),
+		ExclusiveStartKey:      q.StartKey,
+	}
+	if len(q.Names) > 0 {
+		input.ExpressionAttributeNames = q.Names
+	}
+	if len(q.Values) > 0 {
+		input.ExpressionAttributeValues = q.Values
+	}
+	if q.Limit > 0 {
+		input.Limit = aws.Int64(q.Limit)
+	}
+	if q.Descending {
+		input.ScanIndexForward = aws.Bool(false)
+	}
+	if q.ConsistentRead {
+		input.ConsistentRead = aws.Bool(true)
+	}
+	result, err := ddbClient.Query(input)
+	if err != nil {
+		return nil, err
+	}
+	return &ItemPage{Items: result.Items, LastKey: result.LastEvaluatedKey}, nil
+}
+
+func (t dynamoTable) scan(s ItemScan) (*ItemPage, error) {
+	input := &dynamodb.ScanInput{
+		TableName:            aws.String(t.name),
+		FilterExpression:     nonEmpty(s.Filter),
+		ProjectionExpression: nonEmpty(s.Projection),
+		ExclusiveStartKey:    s.StartKey,
+	}
+	if len(s.Names) > 0 {
+		input.ExpressionAttributeNames = s.Names
+	}
+	if len(s.Values) > 0 {
+		input.ExpressionAttributeValues = s.Values
+	}
+	if s.Limit > 0 {
+		input.Limit = aws.Int64(s.Limit)
+	}
+	result, err := ddbClient.Scan(input)
+	if err != nil {
+		return nil, err
+	}
+	return &ItemPage{Items: result.Items, LastKey: result.LastEvaluatedKey}, nil
+}
+
+type dynamoImageStore struct {
+	images   dynamoTable
+	reviews  dynamoTable
+	projects dynamoTable
+}
+
+func (s *dynamoImageStore) GetImage(id string) (Item, error) { return s.images.get(id) }
+func (s *dynamoImageStore) PutImage(item Item) error         { return s.images.put(item) }
+func (s *dynamoImageStore) GetImages(ids []string, projection string, names map[string]*string) ([]Item, error) {
+	return s.images.batchGet(ids, projection, names)
+}
+func (s *dynamoImageStore) UpdateImage(id string, u ItemUpdate) (Item, error) {
+	return s.images.update(id, u)
+}
+func (s *dynamoImageStore) DeleteImage(id string) error                { return s.images.delete(id) }
+func (s *dynamoImageStore) QueryImages(q ItemQuery) (*ItemPage, error) { return s.images.query(q) }
+func (s *dynamoImageStore) ScanImages(sc ItemScan) (*ItemPage, error)  { return s.images.scan(sc) }
+func (s *dynamoImageStore) PutReviewRecord(item Item) error            { return s.reviews.put(item) }
+func (s *dynamoImageStore) UpdateImages(updates []KeyedUpdate) error {
+	return s.images.transactUpdate(updates)
+}
+func (s *dynamoImageStore) UpdateImageAndProject(image, project KeyedUpdate) error {
+	_, err := ddbClient.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: []*dynamodb.TransactWriteItem{
+		s.images.transactItem(image),
+		s.projects.transactItem(project),
+	}})
+	return err
+}
+
+type dynamoProjectStore struct{ projects dynamoTable }
+
+func (s *dynamoProjectStore) GetProject(id string) (Item, error) { return s.projects.get(id) }
+func (s *dynamoProjectStore) PutProject(item Item) error         { return s.projects.put(item) }
+func (s *dynamoProjectStore) UpdateProject(id string, u ItemUpdate) (Item, error) {
+	return s.projects.update(id, u)
+}
+func (s *dynamoProjectStore) DeleteProject(id string) error               { return s.projects.delete(id) }
+func (s *dynamoProjectStore) ScanProjects(sc ItemScan) (*ItemPage, error) { return s.projects.scan(sc) }
+
+type dynamoUserStore struct{ users dynamoTable }
+
+func (s *dynamoUserStore) GetUser(username string) (Item, error) { return s.users.get(username) }
+func (s *dynamoUserStore) PutUser(item Item) error               { return s.users.put(item) }
+func (s *dynamoUserStore) UpdateUser(username string, u ItemUpdate) (Item, error) {
+	return s.users.update(username, u)
+}
+func (s *dynamoUserStore) ScanUsers(sc ItemScan) (*ItemPage, error) { return s.users.scan(sc) }
+
+type dynamoCounterStore struct{ counters dynamoTable }
+
+func (s *dynamoCounterStore) GetCounter(key string) (Item, error) { return s.counters.get(key) }
+func (s *dynamoCounterStore) UpdateCounter(key string, u ItemUpdate) (Item, error) {
+	return s.counters.update(key, u)
+}
+func (s *dynamoCounterStore) DeleteCounter(key string) error { return s.counters.delete(key) }
+
+type dynamoAuditStore struct{ events dynamoTable }
+
+func (s *dynamoAuditStore) PutAuditEvent(item Item) error { return s.events.put(item) }
+func (s *dynamoAuditStore) QueryAuditEvents(q ItemQuery) (*ItemPage, error) {
+	return s.events.query(q)
+}
+
+type dynamoSearchStore struct{ entries dynamoTable }
+
+func (s *dynamoSearchStore) GetSearchItem(key Item) (Item, error) { return s.entries.getKey(key) }
+func (s *dynamoSearchStore) PutSearchItem(item Item) error        { return s.entries.put(item) }
+func (s *dynamoSearchStore) DeleteSearchItem(key Item) error      { return s.entries.deleteKey(key) }
+func (s *dynamoSearchStore) QuerySearch(q ItemQuery) (*ItemPage, error) {
+	return s.entries.query(q)
+}
+
+type dynamoStatsStore struct{ stats dynamoTable }
+
+func (s *dynamoStatsStore) GetStats(key string) (Item, error) { return s.stats.get(key) }
+func (s *dynamoStatsStore) PutStats(item Item) error          { return s.stats.put(item) }
+func (s *dynamoStatsStore) UpdateStats(updates []KeyedUpdate) error {
+	return s.stats.transactUpdate(updates)
+}
+
+type dynamoChangeStore struct{ changes dynamoTable }
+
+func (s *dynamoChangeStore) PutChange(item Item, condition string, values Item) error {
+	return s.changes.putIf(item, condition, values)
+}
+func (s *dynamoChangeStore) QueryChanges(q ItemQuery) (*ItemPage, error) {
+	return s.changes.query(q)
+}
+
+type dynamoJobStore struct{ jobs dynamoTable }
+
+func (s *dynamoJobStore) GetJob(jobID string) (Item, error) { return s.jobs.get(jobID) }
+func (s *dynamoJobStore) PutJob(item Item) error            { return s.jobs.put(item) }
+func (s *dynamoJobStore) UpdateJob(jobID string, u ItemUpdate) (Item, error) {
+	return s.jobs.update(jobID, u)
+}
+func (s *dynamoJobStore) UpdateJobs(updates []KeyedUpdate) error {
+	return s.jobs.transactUpdate(updates)
+}
+func (s *dynamoJobStore) QueryJobs(q ItemQuery) (*ItemPage, error) { return s.jobs.query(q) }
+
+// s3ObjectStore keeps objects in one bucket through s3Client.
+type s3ObjectStore struct {
+	bucket string
+}
+
+func (s *s3ObjectStore) Get(key string) (io.ReadCloser, error) {
+	result, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Body, nil
+}
+
+func (s *s3ObjectStore) Put(key string, body io.Reader, contentType string) error {
+	seeker, ok := body.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		seeker = bytes.NewReader(data)
+	}
+	_, err := s3Client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        seeker,
+		ContentType: nonEmpty(contentType),
+	})
+	return err
+}
+
+func (s *s3ObjectStore) Copy(srcKey, dstKey string) error {
+	_, err := s3Client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		CopySource: aws.String(url.PathEscape(s.bucket + "/" + srcKey)),
+		Key:        aws.String(dstKey),
+	})
+	return err
+}
+
+func (s *s3ObjectStore) Delete(key string) error {
+	_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *s3ObjectStore) Exists(key string) bool {
+	_, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err == nil
+}
+
+func (s *s3ObjectStore) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.StringValue(obj.Key),
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	return objects, err
+}
+
+func (s *s3ObjectStore) PresignGet(key, filename string, expiry time.Duration) (string, error) {
+	if local, ok := s3Client.(*localS3); ok {
+		return local.presign(key, filename, expiry), nil
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if filename != "" {
+		input.ResponseContentDisposition = aws.String(fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	}
+	req, _ := s3Client.GetObjectRequest(input)
+	return req.Presign(expiry)
+}
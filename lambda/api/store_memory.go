@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// In-memory stores keep everything in maps and evaluate expressions with the
+// same engine as the self-hosted database, so condition failures surface as
+// ConditionalCheckFailedException just like DynamoDB. They back the handler
+// tests and need no configuration.
+
+// memTable is one table held in memory.
+type memTable struct {
+	schema localTableSchema
+	mu     sync.Mutex
+	items  map[string]Item
+	// watch, when set, is called with the old and new item after each write,
+	// like a DynamoDB stream record. It runs after the lock is released so it
+	// can write to the table.
+	watch func(before, after Item)
+}
+
+// memChange is a write waiting to be passed to watch.
+type memChange struct{ before, after Item }
+
+// notify passes the writes to watch. Writes defer it before taking the lock.
+func (t *memTable) notify(changes *[]memChange) {
+	if t.watch == nil {
+		return
+	}
+	for _, c := range *changes {
+		t.watch(c.before, c.after)
+	}
+}
+
+func newMemTable(schema localTableSchema) *memTable {
+	return &memTable{schema: schema, items: make(map[string]Item)}
+}
+
+func (t *memTable) key(id string) Item {
+	return Item{t.schema.HashKey: {S: &id}}
+}
+
+func (t *memTable) encode(item Item) (string, error) {
+	key, ok := encodeKey(item, t.schema.localKeySchema)
+	if !ok {
+		return "", validationError(fmt.Errorf("the provided key element does not match the schema"))
+	}
+	return string(key), nil
+}
+
+func (t *memTable) get(id string) (Item, error) {
+	return t.getKey(t.key(id))
+}
+
+func (t *memTable) getKey(key Item) (Item, error) {
+	k, err := t.encode(key)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return cloneItem(t.items[k]), nil
+}
+
+func (t *memTable) put(item Item) error {
+	k, err := t.encode(item)
+	if err != nil {
+		return err
+	}
+	var changes []memChange
+	defer t.notify(&changes)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changes = append(changes, memChange{cloneItem(t.items[k]), cloneItem(item)})
+	t.items[k] = cloneItem(item)
+	return nil
+}
+
+// putIf is put with a condition on the item replaced.
+func (t *memTable) putIf(item Item, condition string, values Item) error {
+	k, err := t.encode(item)
+	if err != nil {
+		return err
+	}
+	var changes []memChange
+	defer t.notify(&changes)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := checkCondition(nonEmpty(condition), nil, values, t.items[k]); err != nil {
+		return err
+	}
+	changes = append(changes, memChange{cloneItem(t.items[k]), cloneItem(item)})
+	t.items[k] = cloneItem(item)
+	return nil
+}
+
+func (t *memTable) update(id string, u ItemUpdate) (Item, error) {
+	key := t.key(id)
+	k, err := t.encode(key)
+	if err != nil {
+		return nil, err
+	}
+	var actions []updateAction
+	if u.Expression != "" {
+		if actions, err = parseUpdateExpr(u.Expression, u.Names, u.Values); err != nil {
+			return nil, validationError(err)
+		}
+	}
+	for _, a := range actions {
+		if a.path[0].name == t.schema.HashKey || a.path[0].name == t.schema.RangeKey {
+			return nil, validationError(fmt.Errorf("cannot update attribute %s. This attribute is part of the key", a.path[0].name))
+		}
+	}
+
+	var changes []memChange
+	defer t.notify(&changes)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.items[k]
+	if err := checkCondition(nonEmpty(u.Condition), u.Names, u.Values, old); err != nil {
+		return nil, err
+	}
+	item := cloneItem(old)
+	if item == nil {
+		item = key
+	}
+	if err := applyUpdate(item, actions); err != nil {
+		return nil, validationError(err)
+	}
+	t.items[k] = item
+	changes = append(changes, memChange{cloneItem(old), cloneItem(item)})
+	switch u.ReturnValues {
+	case dynamodb.ReturnValueAllNew, dynamodb.ReturnValueUpdatedNew:
+		return cloneItem(item), nil
+	case dynamodb.ReturnValueAllOld, dynamodb.ReturnValueUpdatedOld:
+		return cloneItem(old), nil
+	}
+	return nil, nil
+}
+
+// transactUpdate applies all updates or, when a condition fails, none.
+func (t *memTable) transactUpdate(updates []KeyedUpdate) error {
+	writes := make([]memWrite, len(updates))
+	for i, u := range updates {
+		writes[i] = memWrite{t, u}
+	}
+	return memTransact(writes)
+}
+
+// memWrite is one update of a transaction and the table it updates.
+type memWrite struct {
+	table *memTable
+	KeyedUpdate
+}
+
+// memTransact applies updates to one or more tables, all of them or, when a
+// condition fails, none. Tables are locked in the order they first appear,
+// so transactions must name tables in the same order.
+func memTransact(updates []memWrite) error {
+	type write struct {
+		k       string
+		key     Item
+		actions []updateAction
+	}
+	type itemKey struct {
+		table *memTable
+		k     string
+	}
+	writes := make([]write, len(updates))
+	seen := make(map[itemKey]bool)
+	var tables []*memTable
+	for i, u := range updates {
+		key := u.table.key(u.ID)
+		k, err := u.table.encode(key)
+		if err != nil {
+			return err
+		}
+		if seen[itemKey{u.table, k}] {
+			return validationError(fmt.Errorf("transaction request cannot include multiple operations on one item"))
+		}
+		seen[itemKey{u.table, k}] = true
+		actions, err := parseUpdateExpr(u.Expression, u.Names, u.Values)
+		if err != nil {
+			return validationError(err)
+		}
+		writes[i] = write{k, key, actions}
+		if !slices.Contains(tables, u.table) {
+			tables = append(tables, u.table)
+		}
+	}
+
+	changes := make(map[*memTable]*[]memChange)
+	for _, t := range tables {
+		changes[t] = new([]memChange)
+		defer t.notify(changes[t])
+	}
+	for _, t := range tables {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+	}
+	reasons, err := checkTransactConditions(len(updates), func(i int) error {
+		u := updates[i]
+		return checkCondition(nonEmpty(u.Condition), u.Names, u.Values, u.table.items[writes[i].k])
+	})
+	if err != nil {
+		return err
+	}
+	if reasons != nil {
+		return transactionCanceled(reasons)
+	}
+	items := make([]Item, len(writes))
+	for i, w := range writes {
+		item := cloneItem(updates[i].table.items[w.k])
+		if item == nil {
+			item = w.key
+		}
+		if err := applyUpdate(item, w.actions); err != nil {
+			return validationError(err)
+		}
+		items[i] = item
+	}
+	for i, w := range writes {
+		t := updates[i].table
+		*changes[t] = append(*changes[t], memChange{cloneItem(t.items[w.k]), cloneItem(items[i])})
+		t.items[w.k] = items[i]
+	}
+	return nil
+}
+
+func (t *memTable) delete(id string) error {
+	return t.deleteKey(t.key(id))
+}
+
+func (t *memTable) deleteKey(key Item) error {
+	k, err := t.encode(key)
+	if err != nil {
+		return err
+	}
+	var changes []memChange
+	defer t.notify(&changes)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old := t.items[k]; old != nil {
+		changes = append(changes, memChange{cloneItem(old), nil})
+	}
+	delete(t.items, k)
+	return nil
+}
+
+// snapshot returns copies of all items in primary key order.
+func (t *memTable) snapshot() []Item {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := make([]string, 0, len(t.items))
+	for k := range t.items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	items := make([]Item, len(keys))
+	for i, k := range keys {
+		items[i] = cloneItem(t.items[k])
+	}
+	return items
+}
+
+// filterPage applies a filter and projection to an evaluated page.
+func filterPage(page []Item, filter exprCond, projection []exprPath) ([]Item, error) {
+	var out []Item
+	for _, item := range page {
+		if filter != nil {
+			ok, err := filter.test(item)
+			if err != nil {
+				return nil, validationError(err)
+			}
+			if !ok {
+				continue
+			}
+		}
+		out = append(out, projectItem(item, projection))
+	}
+	return out, nil
+}
+
+func (t *memTable) query(q ItemQuery) (*ItemPage, error) {
+	ks := t.schema.localKeySchema
+	if q.Index != "" {
+		var ok bool
+		if ks, ok = t.schema.Indexes[q.Index]; !ok {
+			return nil, validationError(fmt.Errorf("the table does not have the specified index: %s", q.Index))
+		}
+	}
+	keyCond, err := parseConditionExpr(nonEmpty(q.KeyCondition), q.Names, q.Values)
+	if err != nil || keyCond == nil {
+		return nil, validationError(fmt.Errorf("invalid KeyConditionExpression: %v", err))
+	}
+	if keyConditionHash(keyCond, ks.HashKey) == nil {
+		return nil, validationError(fmt.Errorf("query condition missed key schema element: %s", ks.HashKey))
+	}
+	filter, err := parseConditionExpr(nonEmpty(q.Filter), q.Names, q.Values)
+	if err != nil {
+		return nil, validationError(err)
+	}
+	projection, err := parseProjectionExpr(nonEmpty(q.Projection), q.Names)
+	if err != nil {
+		return nil, validationError(err)
+	}
+
+	var matched []Item
+	for _, item := range t.snapshot() {
+		// Indexes are sparse: items without the index key are not in them.
+		if _, ok := indexEntryKey(item, ks, nil); !ok {
+			continue
+		}
+		ok, err := keyCond.test(item)
+		if err != nil {
+			return nil, validationError(err)
+		}
+		if ok {
+			matched = append(matched, item)
+		}
+	}
+	sortItems(matched, ks, t.schema.localKeySchema)
+	if q.Descending {
+		for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+			matched[i], matched[j] = matched[j], matched[i]
+		}
+	}
+	var limit *int64
+	if q.Limit > 0 {
+		limit = &q.Limit
+	}
+	page, lastKey := paginate(matched, q.StartKey, limit, ks, t.schema.localKeySchema, !q.Descending)
+	for i, item := range page {
+		page[i] = indexEntry(item, ks, t.schema.localKeySchema)
+	}
+	items, err := filterPage(page, filter, projection)
+	if err != nil {
+		return nil, err
+	}
+	return &ItemPage{Items: items, LastKey: lastKey}, nil
+}
+
+func (t *memTable) scan(s ItemScan) (*ItemPage, error) {
+	filter, err := parseConditionExpr(nonEmpty(s.Filter), s.Names, s.Values)
+	if err != nil {
+		return nil, validationError(err)
+	}
+	projection, err := parseProjectionExpr(nonEmpty(s.Projection), s.Names)
+	if err != nil {
+		return nil, validationError(err)
+	}
+	items := t.snapshot()
+	if s.StartKey != nil {
+		start, err := t.encode(s.StartKey)
+		if err != nil {
+			return nil, err
+		}
+		idx := sort.Search(len(items), func(i int) bool {
+			k, _ := t.encode(items[i])
+			return k > start
+		})
+		items = items[idx:]
+	}
+	var lastKey Item
+	if s.Limit > 0 && int64(len(items)) > s.Limit {
+		items = items[:s.Limit]
+		lastKey = keyOnly(items[len(items)-1], t.schema.localKeySchema)
+	}
+	page, err := filterPage(items, filter, projection)
+	if err != nil {
+		return nil, err
+	}
+	return &ItemPage{Items: page, LastKey: lastKey}, nil
+}
+
+type memImageStore struct {
+	images   *memTable
+	reviews  *memTable
+	projects *memTable
+}
+
+// newMemImageStore returns an image store whose transactions with projects
+// update those in projects.
+func newMemImageStore(projects *memProjectStore) *memImageStore {
+	return &memImageStore{images: newMemTable(imageTableSchema), reviews: newMemTable(reviewGroupsTableSchema), projects: projects.projects}
+}
+
+func (s *memImageStore) GetImage(id string) (Item, error) { return s.images.get(id) }
+func (s *memImageStore) PutImage(item Item) error         { return s.images.put(item) }
+func (s *memImageStore) GetImages(ids []string, projection string, names map[string]*string) ([]Item, error) {
+	paths, err := parseProjectionExpr(nonEmpty(projection), names)
+	if err != nil {
+		return nil, validationError(err)
+	}
+	var items []Item
+	for _, id := range ids {
+		item, err := s.images.get(id)
+		if err != nil {
+			return nil, err
+		}
+		if item != nil {
+			items = append(items, projectItem(item, paths))
+		}
+	}
+	return items, nil
+}
+func (s *memImageStore) UpdateImage(id string, u ItemUpdate) (Item, error) {
+	return s.images.update(id, u)
+}
+func (s *memImageStore) DeleteImage(id string) error                { return s.images.delete(id) }
+func (s *memImageStore) QueryImages(q ItemQuery) (*ItemPage, error) { return s.images.query(q) }
+func (s *memImageStore) ScanImages(sc ItemScan) (*ItemPage, error)  { return s.images.scan(sc) }
+func (s *memImageStore) PutReviewRecord(item Item) error            { return s.reviews.put(item) }
+func (s *memImageStore) UpdateImages(updates []KeyedUpdate) error {
+	return s.images.transactUpdate(updates)
+}
+func (s *memImageStore) UpdateImageAndProject(image, project KeyedUpdate) error {
+	return memTransact([]memWrite{{s.images, image}, {s.projects, project}})
+}
+
+type memProjectStore struct{ projects *memTable }
+
+func newMemProjectStore() *memProjectStore {
+	return &memProjectStore{newMemTable(projectsTableSchema)}
+}
+
+func (s *memProjectStore) GetProject(id string) (Item, error) { return s.projects.get(id) }
+func (s *memProjectStore) PutProject(item Item) error         { return s.projects.put(item) }
+func (s *memProjectStore) UpdateProject(id string, u ItemUpdate) (Item, error) {
+	return s.projects.update(id, u)
+}
+func (s *memProjectStore) DeleteProject(id string) error               { return s.projects.delete(id) }
+func (s *memProjectStore) ScanProjects(sc ItemScan) (*ItemPage, error) { return s.projects.scan(sc) }
+
+type memUserStore struct{ users *memTable }
+
+func newMemUserStore() *memUserStore {
+	return &memUserStore{newMemTable(usersTableSchema)}
+}
+
+func (s *memUserStore) GetUser(username string) (Item, error) { return s.users.get(username) }
+func (s *memUserStore) PutUser(item Item) error               { return s.users.put(item) }
+func (s *memUserStore) UpdateUser(username string, u ItemUpdate) (Item, error) {
+	return s.users.update(username, u)
+}
+func (s *memUserStore) ScanUsers(sc ItemScan) (*ItemPage, error) { return s.users.scan(sc) }
+
+type memCounterStore struct{ counters *memTable }
+
+func newMemCounterStore() *memCounterStore {
+	return &memCounterStore{newMemTable(rateLimitsTableSchema)}
+}
+
+func (s *memCounterStore) GetCounter(key string) (Item, error) { return s.counters.get(key) }
+func (s *memCounterStore) UpdateCounter(key string, u ItemUpdate) (Item, error) {
+	return s.counters.update(key, u)
+}
+func (s *memCounterStore) DeleteCounter(key string) error { return s.counters.delete(key) }
+
+type memAuditStore struct{ events *memTable }
+
+func newMemAuditStore() *memAuditStore {
+	return &memAuditStore{newMemTable(auditTableSchema)}
+}
+
+func (s *memAuditStore) PutAuditEvent(item Item) error { return s.events.put(item) }
+func (s *memAuditStore) QueryAuditEvents(q ItemQuery) (*ItemPage, error) {
+	return s.events.query(q)
+}
+
+type memSearchStore struct{ entries *memTable }
+
+func newMemSearchStore() *memSearchStore {
+	return &memSearchStore{newMemTable(searchTableSchema)}
+}
+
+func (s *memSearchStore) GetSearchItem(key Item) (Item, error) { return s.entries.getKey(key) }
+func (s *memSearchStore) PutSearchItem(item Item) error        { return s.entries.put(item) }
+func (s *memSearchStore) DeleteSearchItem(key Item) error      { return s.entries.deleteKey(key) }
+func (s *memSearchStore) QuerySearch(q ItemQuery) (*ItemPage, error) {
+	return s.entries.query(q)
+}
+
+type memStatsStore struct{ stats *memTable }
+
+func newMemStatsStore() *memStatsStore {
+	return &memStatsStore{newMemTable(statsTableSchema)}
+}
+
+func (s *memStatsStore) GetStats(key string) (Item, error) { return s.stats.get(key) }
+func (s *memStatsStore) PutStats(item Item) error          { return s.stats.put(item) }
+func (s *memStatsStore) UpdateStats(updates []KeyedUpdate) error {
+	return s.stats.transactUpdate(updates)
+}
+
+type memChangeStore struct{ changes *memTable }
+
+func newMemChangeStore() *memChangeStore {
+	return &memChangeStore{newMemTable(changesTableSchema)}
+}
+
+func (s *memChangeStore) PutChange(item Item, condition string, values Item) error {
+	return s.changes.putIf(item, condition, values)
+}
+func (s *memChangeStore) QueryChanges(q ItemQuery) (*ItemPage, error) {
+	return s.changes.query(q)
+}
+
+type memJobStore struct{ jobs *memTable }
+
+func newMemJobStore() *memJobStore {
+	return &memJobStore{newMemTable(jobsTableSchema)}
+}
+
+func (s *memJobStore) GetJob(jobID string) (Item, error) { return s.jobs.get(jobID) }
+func (s *memJobStore) PutJob(item Item) error            { return s.jobs.put(item) }
+func (s *memJobStore) UpdateJob(jobID string, u ItemUpdate) (Item, error) {
+	return s.jobs.update(jobID, u)
+}
+func (s *memJobStore) UpdateJobs(updates []KeyedUpdate) error   { return s.jobs.transactUpdate(updates) }
+func (s *memJobStore) QueryJobs(q ItemQuery) (*ItemPage, error) { return s.jobs.query(q) }
+
+// memObjectStore holds object contents in a map.
+type memObjectStore struct {
+	mu      sync.Mutex
+	objects map[string]memObject
+}
+
+type memObject struct {
+	data     []byte
+	modified time.Time
+}
+
+func newMemObjectStore() *memObjectStore {
+	return &memObjectStore{objects: make(map[string]memObject)}
+}
+
+func (s *memObjectStore) Get(key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist: "+key, nil)
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (s *memObjectStore) Put(key string, body io.Reader, contentType string) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = memObject{data: data, modified: time.Now()}
+	return nil
+}
+
+func (s *memObjectStore) Copy(srcKey, dstKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[srcKey]
+	if !ok {
+		return awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist: "+srcKey, nil)
+	}
+	s.objects[dstKey] = memObject{data: obj.data, modified: time.Now()}
+	return nil
+}
+
+func (s *memObjectStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memObjectStore) Exists(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.objects[key]
+	return ok
+}
+
+func (s *memObjectStore) List(prefix string) ([]ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var objects []ObjectInfo
+	for key, obj := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: int64(len(obj.data)), LastModified: obj.modified})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *memObjectStore) PresignGet(key, filename string, expiry time.Duration) (string, error) {
+	q := url.Values{}
+	q.Set("expires", time.Now().Add(expiry).UTC().Format(time.RFC3339))
+	if filename != "" {
+		q.Set("filename", filename)
+	}
+	return "memory:///" + key + "?" + q.Encode(), nil
+}
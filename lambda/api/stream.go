@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+// The API function also consumes the ImageMetadata and Projects tables'
+// DynamoDB streams, which carry every write whoever made it, including the
+// thumbnail function. Lambda delivers stream batches, project image queue
+// batches (projectqueue.go), schedules and API Gateway requests to the same
+// entry point, so handleEvent tells them apart.
+// There are no streams in self-hosted mode or the tests: the stores call
+// imageChanged and projectChanged after each write instead.
+
+// streamRecord is a DynamoDB stream record as Lambda delivers it. The
+// images use the same attribute value JSON as the DynamoDB API, so they
+// decode straight into Items.
+type streamRecord struct {
+	EventID        string `json:"eventID"`
+	EventName      string `json:"eventName"` // INSERT, MODIFY or REMOVE
+	EventSource    string `json:"eventSource"`
+	EventSourceARN string `json:"eventSourceARN"`
+	DynamoDB       struct {
+		Keys           Item   `json:"Keys"`
+		OldImage       Item   `json:"OldImage"`
+		NewImage       Item   `json:"NewImage"`
+		SequenceNumber string `json:"SequenceNumber"`
+	} `json:"dynamodb"`
+}
+
+// handleEvent is the Lambda entry point.
+func handleEvent(ctx context.Context, event json.RawMessage) (interface{}, error) {
+	var stream struct {
+		Records []streamRecord `json:"Records"`
+	}
+	if err := json.Unmarshal(event, &stream); err == nil && len(stream.Records) > 0 {
+		switch stream.Records[0].EventSource {
+		case "aws:dynamodb":
+			return nil, handleStreamRecords(stream.Records)
+		case "aws:sqs":
+			var batch events.SQSEvent
+			if err := json.Unmarshal(event, &batch); err != nil {
+				return nil, err
+			}
+			return handleProjectImageMessages(batch.Records), nil
+		}
+	}
+
+	var request events.APIGatewayProxyRequest
+	if err := json.Unmarshal(event, &request); err != nil {
+		return nil, err
+	}
+	// Scheduled events aren't proxy requests; the handler finds them in the body
+	if request.HTTPMethod == "" && request.Body == "" {
+		request.Body = string(event)
+	}
+	// API Gateway passes every body base64 encoded, as it treats all media
+	// types as binary so that gzipped responses reach clients
+	if request.IsBase64Encoded {
+		body, err := base64.StdEncoding.DecodeString(request.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode request body: %v", err)
+		}
+		request.Body, request.IsBase64Encoded = string(body), false
+	}
+	return handler(ctx, request)
+}
+
+// handleStreamRecords applies a batch of stream records in order. An error
+// fails the batch and Lambda delivers it again, so records must be safe to
+// apply twice.
+func handleStreamRecords(records []streamRecord) error {
+	var changes []Item
+	for _, r := range records {
+		before, after := r.DynamoDB.OldImage, r.DynamoDB.NewImage
+		switch streamTableName(r.EventSourceARN) {
+		case imageTable:
+			if err := countImageChange(r.EventID, before, after); err != nil {
+				return fmt.Errorf("failed to count %s of image %s: %v", r.EventName, attrString(r.DynamoDB.Keys["ImageGUID"]), err)
+			}
+			if err := indexImageChange(before, after); err != nil {
+				return fmt.Errorf("failed to index %s of image %s: %v", r.EventName, attrString(r.DynamoDB.Keys["ImageGUID"]), err)
+			}
+			changes = append(changes, imageChange(before, after))
+		case projectsTable:
+			changes = append(changes, projectChange(before, after))
+		}
+	}
+	if err := appendChanges(changes); err != nil {
+		return fmt.Errorf("failed to log changes: %v", err)
+	}
+	return nil
+}
+
+// streamTableName returns the table a stream ARN belongs to, e.g.
+// kill-snap-ImageMetadata for
+// arn:aws:dynamodb:us-east-1:123456789012:table/kill-snap-ImageMetadata/stream/2025-01-01T00:00:00.000
+func streamTableName(arn string) string {
+	parts := strings.Split(arn, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// imageChanged handles a write to an image in self-hosted mode or the tests.
+// before is nil for a new image and after is nil for a deleted one.
+func imageChanged(before, after Item) {
+	if err := countImageChange(uuid.New().String(), before, after); err != nil {
+		fmt.Printf("Error counting image change: %v\n", err)
+	}
+	if err := indexImageChange(before, after); err != nil {
+		fmt.Printf("Error indexing image change: %v\n", err)
+	}
+	if err := appendChanges([]Item{imageChange(before, after)}); err != nil {
+		fmt.Printf("Error logging image change: %v\n", err)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Every image has a CaptureDate: when the photo was taken, normalized from
+// EXIF DateTimeOriginal, then DateTime, then the upload time, as camera
+// local time "2006-01-02T15:04:05". It is set at ingest; older images get it
+// from scripts/backfill_capture_date. CaptureDateIndex is keyed by its
+// year (CaptureYear) and the date, so a day, month or year of shooting is
+// one Query; until that index is created (see ImageIndexes in template.yaml)
+// the table is scanned instead. The timeline and taken: queries only see
+// images that have it.
+
+const (
+	captureDateFormat = "2006-01-02T15:04:05"
+	exifDateFormat    = "2006:01:02 15:04:05"
+
+	// The timeline looks for photos taken from this year until next year
+	// (camera clocks are sometimes ahead)
+	timelineFirstYear = 1990
+)
+
+// timelineClock is replaced in tests.
+var timelineClock = time.Now
+
+// captureTime finds when a photo was taken from its EXIF data, falling back
+// to when it was uploaded. ok is false when neither can be parsed.
+func captureTime(exifData map[string]string, inserted string) (time.Time, bool) {
+	for _, field := range []string{"DateTimeOriginal", "DateTime"} {
+		// EXIF strings are sometimes stored quoted
+		if t, err := time.Parse(exifDateFormat, strings.Trim(exifData[field], `"`)); err == nil {
+			return t, true
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, inserted); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// captureDateFields returns the CaptureDate and CaptureYear attributes for
+// a capture time.
+func captureDateFields(t time.Time) (string, string) {
+	return t.Format(captureDateFormat), t.Format("2006")
+}
+
+// takenRangeQuery adds a from/to capture date range to a list request,
+// returning the q query that lists it. The range applies to q if there is
+// one, and otherwise to the state and group filters; like those, it leaves
+// out images in projects unless state is all. from and to are inclusive.
+func takenRangeQuery(q, state, group, from, to string) (string, error) {
+	for _, bound := range []struct{ name, value string }{{"from", from}, {"to", to}} {
+		if bound.value == "" {
+			continue
+		}
+		if _, _, err := parseQueryDate(queryTerm{}, bound.value); err != nil {
+			return "", fmt.Errorf("%s must be a date like 2025, 2025-06 or 2025-06-01", bound.name)
+		}
+	}
+	taken := "taken:" + from + ".." + to
+	if q != "" {
+		return "(" + q + ") AND " + taken, nil
+	}
+
+	terms := []string{taken}
+	switch state {
+	case "", "unreviewed":
+		terms = append(terms, "status:inbox")
+	case "approved", "rejected", "deleted":
+		terms = append(terms, "status:"+state)
+	case "all":
+	default:
+		return "", fmt.Errorf("state must be unreviewed, approved, rejected, deleted or all")
+	}
+	if state != "all" {
+		terms = append(terms, "NOT project")
+	}
+	if group != "" && group != "all" {
+		groupNum, err := strconv.Atoi(group)
+		if err != nil {
+			return "", fmt.Errorf("group must be a number")
+		}
+		terms = append(terms, fmt.Sprintf("group:%d", groupNum))
+	}
+	return strings.Join(terms, " AND "), nil
+}
+
+// TimelinePeriod is the number of photos taken in a year, month or day.
+type TimelinePeriod struct {
+	Period string `json:"period"` // 2025, 2025-06 or 2025-06-01
+	Count  int    `json:"count"`
+}
+
+type TimelineResponse struct {
+	Granularity string           `json:"granularity"` // year, month or day
+	Periods     []TimelinePeriod `json:"periods"`
+}
+
+// countCaptureDates counts the images whose CaptureDate starts with prefix,
+// a year, month or day, by the first keyLen characters of their
+// CaptureDate. Deleted images and images in projects the caller can't see
+// aren't counted. Until CaptureDateIndex is created it scans the table, and
+// an empty prefix counts every year in that one scan.
+func countCaptureDates(prefix string, keyLen int, visible func(string) bool, counts map[string]int) error {
+	count := func(items []map[string]*dynamodb.AttributeValue) {
+		for _, item := range items {
+			var img struct{ CaptureDate, ProjectID string }
+			dynamodbattribute.UnmarshalMap(item, &img)
+			if len(img.CaptureDate) >= keyLen && visible(img.ProjectID) {
+				counts[img.CaptureDate[:keyLen]]++
+			}
+		}
+	}
+	names := map[string]*string{"#status": aws.String("Status")}
+	values := map[string]*dynamodb.AttributeValue{":deleted": {S: aws.String("deleted")}}
+	if !hasImageIndex("CaptureDateIndex") {
+		filter := "attribute_exists(CaptureDate) AND #status <> :deleted"
+		if prefix != "" {
+			filter = "begins_with(CaptureDate, :prefix) AND #status <> :deleted"
+			values[":prefix"] = &dynamodb.AttributeValue{S: aws.String(prefix)}
+		}
+		return scanAllImages(ItemScan{Filter: filter, Projection: "CaptureDate, ProjectID", Names: names, Values: values}, count)
+	}
+
+	values[":year"] = &dynamodb.AttributeValue{S: aws.String(prefix[:4])}
+	values[":prefix"] = &dynamodb.AttributeValue{S: aws.String(prefix)}
+	q := ItemQuery{
+		Index:        "CaptureDateIndex",
+		KeyCondition: "CaptureYear = :year AND begins_with(CaptureDate, :prefix)",
+		Filter:       "#status <> :deleted",
+		Projection:   "CaptureDate, ProjectID",
+		Names:        names,
+		Values:       values,
+	}
+	for {
+		page, err := imageStore.QueryImages(q)
+		if err != nil {
+			return err
+		}
+		count(page.Items)
+		if page.LastKey == nil {
+			return nil
+		}
+		q.StartKey = page.LastKey
+	}
+}
+
+// handleGetTimeline serves GET /api/timeline: photo counts per year, or
+// with year=YYYY per month of that year, or with month=YYYY-MM per day of
+// that month. Periods without photos are left out.
+func handleGetTimeline(caller *Caller, params map[string]string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	visible := projectFilter(caller)
+	counts := make(map[string]int)
+	response := TimelineResponse{Periods: []TimelinePeriod{}}
+
+	var err error
+	switch {
+	case params["month"] != "":
+		if _, parseErr := time.Parse("2006-01", params["month"]); parseErr != nil || len(params["month"]) != len("2006-01") {
+			return errorResponse(400, "month must look like 2025-06", headers)
+		}
+		response.Granularity = "day"
+		err = countCaptureDates(params["month"], len("2006-01-02"), visible, counts)
+	case params["year"] != "":
+		if _, parseErr := time.Parse("2006", params["year"]); parseErr != nil || len(params["year"]) != len("2006") {
+			return errorResponse(400, "year must look like 2025", headers)
+		}
+		response.Granularity = "month"
+		err = countCaptureDates(params["year"], len("2006-01"), visible, counts)
+	case !hasImageIndex("CaptureDateIndex"):
+		response.Granularity = "year"
+		err = countCaptureDates("", len("2006"), visible, counts)
+	default:
+		response.Granularity = "year"
+		for year := timelineFirstYear; year <= timelineClock().Year()+1 && err == nil; year++ {
+			err = countCaptureDates(strconv.Itoa(year), len("2006"), visible, counts)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Error counting capture dates: %v\n", err)
+		return errorResponse(500, "Failed to load timeline", headers)
+	}
+
+	for period, count := range counts {
+		response.Periods = append(response.Periods, TimelinePeriod{Period: period, Count: count})
+	}
+	sort.Slice(response.Periods, func(i, j int) bool { return response.Periods[i].Period < response.Periods[j].Period })
+
+	body, _ := json.Marshal(response)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+)
+
+// timeline fetches GET /api/timeline and returns its periods as "period=count".
+func (env *testEnv) timeline(params string) []string {
+	env.t.Helper()
+	resp := env.call("GET", "/api/timeline?"+params, "")
+	var timeline TimelineResponse
+	if err := json.Unmarshal([]byte(resp.Body), &timeline); err != nil || resp.StatusCode != 200 {
+		env.t.Fatalf("timeline %s: %d %s", params, resp.StatusCode, resp.Body)
+	}
+	var periods []string
+	for _, p := range timeline.Periods {
+		periods = append(periods, fmt.Sprintf("%s=%d", p.Period, p.Count))
+	}
+	return periods
+}
+
+// seedTakenImage seeds an image taken at an EXIF date.
+func (env *testEnv) seedTakenImage(id, taken string, fields map[string]interface{}) {
+	env.t.Helper()
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	fields["EXIFData"] = map[string]string{"DateTimeOriginal": `"` + taken + `"`}
+	env.seedImage(id, fields)
+}
+
+func TestCaptureTime(t *testing.T) {
+	for _, tc := range []struct {
+		exif     map[string]string
+		inserted string
+		want     string
+	}{
+		{map[string]string{"DateTimeOriginal": `"2025:06:01 07:30:00"`, "DateTime": "2025:06:03 10:00:00"}, "2025-07-01T00:00:00Z", "2025-06-01T07:30:00"},
+		{map[string]string{"DateTimeOriginal": "0000:00:00 00:00:00", "DateTime": "2025:06:03 10:00:00"}, "", "2025-06-03T10:00:00"},
+		{nil, "2025-07-01T12:00:00+02:00", "2025-07-01T12:00:00"},
+	} {
+		taken, ok := captureTime(tc.exif, tc.inserted)
+		if date, _ := captureDateFields(taken); !ok || date != tc.want {
+			t.Errorf("captureTime(%v, %q) = %s, %v, want %s", tc.exif, tc.inserted, date, ok, tc.want)
+		}
+	}
+	if _, ok := captureTime(nil, "yesterday"); ok {
+		t.Error("captureTime with no dates: ok = true")
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	env := newTestEnv(t)
+	defer func(clock func() time.Time) { timelineClock = clock }(timelineClock)
+	timelineClock = func() time.Time { return time.Date(2025, 7, 17, 9, 0, 0, 0, time.UTC) }
+
+	env.seedProject("p1", 1)
+	env.seedTakenImage("a", "2024:12:31 23:59:59", nil)
+	env.seedTakenImage("b", "2025:06:01 07:00:00", nil)
+	env.seedTakenImage("c", "2025:06:01 18:00:00", map[string]interface{}{"Status": "approved"})
+	env.seedTakenImage("d", "2025:06:14 09:00:00", map[string]interface{}{"Status": "project", "ProjectID": "p1"})
+	env.seedTakenImage("e", "2025:07:04 12:00:00", nil)
+	env.seedTakenImage("trashed", "2025:06:01 08:00:00", map[string]interface{}{"Status": "deleted"})
+	env.seedTakenImage("future", "2026:01:01 00:00:00", nil)
+	env.login()
+
+	// Counted the same by scanning until CaptureDateIndex is created
+	for _, indexes := range []int{len(imageIndexOrder), 0} {
+		restore := useImageIndexes(t, indexes)
+		for _, tc := range []struct{ params, want string }{
+			{"", "[2024=1 2025=4 2026=1]"},
+			{"year=2025", "[2025-06=3 2025-07=1]"},
+			{"month=2025-06", "[2025-06-01=2 2025-06-14=1]"},
+			{"month=2019-01", "[]"},
+		} {
+			if got := fmt.Sprint(env.timeline(tc.params)); got != tc.want {
+				t.Errorf("timeline %q with %d indexes = %s, want %s", tc.params, indexes, got, tc.want)
+			}
+		}
+		restore()
+	}
+	for _, params := range []string{"year=25", "year=2025-06", "month=2025", "month=2025-13"} {
+		if resp := env.call("GET", "/api/timeline?"+params, ""); resp.StatusCode != 400 {
+			t.Errorf("%s: status = %d, want 400", params, resp.StatusCode)
+		}
+	}
+
+	// Project images only count for members
+	env.seedUser("fred", roleViewer)
+	env.loginAs("fred", testPassword)
+	if got := fmt.Sprint(env.timeline("month=2025-06")); got != "[2025-06-01=2]" {
+		t.Errorf("non-member timeline = %s", got)
+	}
+}
+
+func TestListImagesTakenRange(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedProject("p1", 1)
+	env.seedTakenImage("a", "2025:05:31 23:00:00", nil)
+	env.seedTakenImage("b", "2025:06:01 07:00:00", nil)
+	env.seedTakenImage("c", "2025:06:10 18:00:00", map[string]interface{}{"GroupNumber": 2})
+	env.seedTakenImage("d", "2025:06:10 09:00:00", map[string]interface{}{"Status": "approved", "Reviewed": "true"})
+	env.seedTakenImage("e", "2025:06:12 09:00:00", map[string]interface{}{"Status": "project", "ProjectID": "p1"})
+	env.seedTakenImage("f", "2025:06:11 00:00:00", nil)
+	env.login()
+
+	list := func(params string) string {
+		t.Helper()
+		resp := env.call("GET", "/api/images?"+params, "")
+		var page PaginatedImageResponse
+		if err := json.Unmarshal([]byte(resp.Body), &page); err != nil || resp.StatusCode != 200 {
+			t.Fatalf("%s: %d %s", params, resp.StatusCode, resp.Body)
+		}
+		var ids []string
+		for _, img := range page.Images {
+			ids = append(ids, img.ImageGUID)
+		}
+		sort.Strings(ids)
+		return fmt.Sprint(ids)
+	}
+	// Listed the same from the status partitions until CaptureDateIndex is
+	// created
+	for _, indexes := range []int{len(imageIndexOrder), 0} {
+		restore := useImageIndexes(t, indexes)
+		for _, tc := range []struct{ params, want string }{
+			{"from=2025-06-01&to=2025-06-10", "[b c]"},
+			{"from=2025-06", "[b c f]"},
+			{"to=2025-05", "[a]"},
+			{"from=2025-06-10&to=2025-06-10&group=2", "[c]"},
+			{"from=2025-06&to=2025-06&state=approved", "[d]"},
+			{"from=2025-06&to=2025-06&state=all", "[b c d e f]"},
+			{"from=2025&to=2025&q=" + url.QueryEscape("project:p1"), "[e]"},
+		} {
+			if got := list(tc.params); got != tc.want {
+				t.Errorf("%s with %d indexes: got %s, want %s", tc.params, indexes, got, tc.want)
+			}
+		}
+		restore()
+	}
+
+	for _, params := range []string{"from=June", "to=2025-6-1", "from=2025-06-02&to=2025-06-01", "from=2025&state=lost"} {
+		if resp := env.call("GET", "/api/images?"+params, ""); resp.StatusCode != 400 {
+			t.Errorf("%s: status = %d, want 400", params, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Two-factor authentication uses TOTP (RFC 6238) with the secret on the
+// Users row. Users with TOTPEnabled log in in two steps: the password step
+// returns a short-lived MFA token instead of a session, which POST
+// /api/login/mfa exchanges for tokens together with a current code or a
+// single-use recovery code. When REQUIRE_2FA is set, users who have not
+// enrolled are walked through enrollment at that point instead.
+//
+// Users row attributes:
+//   TOTPSecret     base32 secret of the enrolled authenticator
+//   TOTPEnabled    true once enrollment has been confirmed with a code
+//   TOTPPending    secret offered during enrollment, until confirmed
+//   TOTPLastStep   time step of the last accepted code, so codes can't be replayed
+//   RecoveryCodes  map of SHA-256 recovery code hashes; used codes are removed
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// Codes from one step either side are accepted to allow for clock drift
+	totpSkew   = 1
+	totpIssuer = "Kill-Snap"
+
+	recoveryCodeCount = 10
+
+	tokenTypeMFA = "mfa"
+	mfaTokenTTL  = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// MFAChallenge is returned by the password step of a two-step login. Secret
+// and OTPAuthURL are only set when the user must enroll first.
+type MFAChallenge struct {
+	MFARequired      bool   `json:"mfaRequired"`
+	MFAToken         string `json:"mfaToken"`
+	MFASetupRequired bool   `json:"mfaSetupRequired,omitempty"`
+	Secret           string `json:"secret,omitempty"`
+	OTPAuthURL       string `json:"otpauthUrl,omitempty"`
+}
+
+type MFALoginRequest struct {
+	MFAToken     string `json:"mfaToken"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recoveryCode,omitempty"`
+}
+
+type TOTPEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURL string `json:"otpauthUrl"`
+}
+
+type TOTPStatus struct {
+	Enabled           bool `json:"enabled"`
+	Required          bool `json:"required"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+}
+
+type TOTPCodeRequest struct {
+	Code     string `json:"code,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+func totpURL(username, secret string) string {
+	return fmt.Sprintf("otpauth://totp/%s:%s?secret=%s&issuer=%s&digits=%d&period=%d",
+		url.PathEscape(totpIssuer), url.PathEscape(username), secret, url.QueryEscape(totpIssuer), totpDigits, totpPeriod)
+}
+
+// totpCode computes the code for a time step (RFC 4226 HOTP over the step).
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// matchTOTP returns the time step a code is valid for, if any.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		want, err := totpCode(secret, step)
+		if err == nil && hmac.Equal([]byte(want), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes returns fresh codes and the RecoveryCodes map storing their hashes.
+func newRecoveryCodes() ([]string, *dynamodb.AttributeValue, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make(map[string]*dynamodb.AttributeValue, recoveryCodeCount)
+	for len(codes) < recoveryCodeCount {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(b)) // 8 characters
+		code := raw[:4] + "-" + raw[4:]
+		codes = append(codes, code)
+		hashes[hashRecoveryCode(code)] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	}
+	return codes, &dynamodb.AttributeValue{M: hashes}, nil
+}
+
+func stringAttr(item map[string]*dynamodb.AttributeValue, name string) string {
+	if item[name] == nil {
+		return ""
+	}
+	return aws.StringValue(item[name].S)
+}
+
+// acceptTOTP checks a code against the enrolled secret and records its time
+// step so the same code cannot be used twice.
+func acceptTOTP(username string, userItem map[string]*dynamodb.AttributeValue, code string) bool {
+	step, ok := matchTOTP(stringAttr(userItem, "TOTPSecret"), code, time.Now())
+	if !ok {
+		return false
+	}
+	_, err := userStore.UpdateUser(username, ItemUpdate{
+		Expression: "SET TOTPLastStep = :step",
+		Condition:  "attribute_not_exists(TOTPLastStep) OR TOTPLastStep < :step",
+		Values: map[string]*dynamodb.AttributeValue{
+			":step": {N: aws.String(strconv.FormatInt(step, 10))},
+		},
+	})
+	if err != nil && !strings.Contains(err.Error(), "ConditionalCheckFailed") {
+		fmt.Printf("Failed to record TOTP use for %s: %v\n", username, err)
+	}
+	return err == nil
+}
+
+// useRecoveryCode consumes a recovery code, reporting whether it was valid.
+func useRecoveryCode(username, code string) bool {
+	_, err := userStore.UpdateUser(username, ItemUpdate{
+		Expression: "REMOVE RecoveryCodes.#code",
+		Condition:  "attribute_exists(RecoveryCodes.#code)",
+		Names:      map[string]*string{"#code": aws.String(hashRecoveryCode(code))},
+	})
+	if err != nil && !strings.Contains(err.Error(), "ConditionalCheckFailed") {
+		fmt.Printf("Failed to use recovery code for %s: %v\n", username, err)
+	}
+	return err == nil
+}
+
+// enableTOTP confirms a pending enrollment with a code from the new
+// authenticator and returns the recovery codes.
+func enableTOTP(username string, userItem map[string]*dynamodb.AttributeValue, code string) ([]string, bool, error) {
+	pending := stringAttr(userItem, "TOTPPending")
+	step, ok := matchTOTP(pending, code, time.Now())
+	if pending == "" || !ok {
+		return nil, false, nil
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = userStore.UpdateUser(username, ItemUpdate{
+		Expression: "SET TOTPSecret = :secret, TOTPEnabled = :true, TOTPLastStep = :step, RecoveryCodes = :codes, UpdatedAt = :now REMOVE TOTPPending",
+		Condition:  "TOTPPending = :secret",
+		Values: map[string]*dynamodb.AttributeValue{
+			":secret": {S: aws.String(pending)},
+			":true":   {BOOL: aws.Bool(true)},
+			":step":   {N: aws.String(strconv.FormatInt(step, 10))},
+			":codes":  hashes,
+			":now":    {S: aws.String(time.Now().Format(time.RFC3339))},
+		},
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "ConditionalCheckFailed") {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return codes, true, nil
+}
+
+// beginTOTPEnrollment stores a new pending secret, replacing any earlier one.
+func beginTOTPEnrollment(username string) (TOTPEnrollment, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	_, err = userStore.UpdateUser(username, ItemUpdate{
+		Expression: "SET TOTPPending = :secret",
+		Condition:  "attribute_exists(Username)",
+		Values: map[string]*dynamodb.AttributeValue{
+			":secret": {S: aws.String(secret)},
+		},
+	})
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	return TOTPEnrollment{Secret: secret, OTPAuthURL: totpURL(username, secret)}, nil
+}
+
+// startMFAChallenge answers the password step of a two-step login.
+func startMFAChallenge(user User, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	now := time.Now()
+	mfaToken, err := signToken(jwt.MapClaims{
+		"typ":      tokenTypeMFA,
+		"username": user.Username,
+		"sid":      uuid.New().String(), // Identifies the challenge; there is no session yet
+		"iat":      now.Unix(),
+		"exp":      now.Add(mfaTokenTTL).Unix(),
+	})
+	if err != nil {
+		return errorResponse(500, "Failed to generate token", headers)
+	}
+
+	challenge := MFAChallenge{MFARequired: true, MFAToken: mfaToken}
+	if !user.TOTPEnabled {
+		enrollment, err := beginTOTPEnrollment(user.Username)
+		if err != nil {
+			fmt.Printf("Failed to start TOTP enrollment for %s: %v\n", user.Username, err)
+			return errorResponse(500, "Failed to start two-factor setup", headers)
+		}
+		challenge.MFASetupRequired = true
+		challenge.Secret = enrollment.Secret
+		challenge.OTPAuthURL = enrollment.OTPAuthURL
+	}
+
+	body, _ := json.Marshal(challenge)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// handleLoginMFA completes a two-step login with a TOTP or recovery code.
+// Failed codes count towards the login lockout like failed passwords.
+func handleLoginMFA(request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	var req MFALoginRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return errorResponse(400, "Invalid request body", headers)
+	}
+	claims, ok := parseToken(req.MFAToken, tokenTypeMFA)
+	if !ok {
+		return errorResponse(401, "Login expired, sign in again", headers)
+	}
+	username, _ := claims["username"].(string)
+	if wait := loginLockout(username); wait > 0 {
+		recordLogin(request, username, auditLoginFailed, map[string]interface{}{"reason": "locked out"})
+		return rateLimitedResponse(wait, "Too many failed login attempts, try again later", headers)
+	}
+
+	userItem, err := userStore.GetUser(username)
+	if err != nil || userItem == nil {
+		return errorResponse(401, "Invalid credentials", headers)
+	}
+	account := userFromItem(userItem)
+	if account.Disabled {
+		recordLogin(request, username, auditLoginFailed, map[string]interface{}{"reason": "account disabled"})
+		return errorResponse(403, "Account disabled", headers)
+	}
+
+	var recoveryCodes []string
+	switch {
+	case account.TOTPEnabled && req.RecoveryCode != "":
+		ok = useRecoveryCode(username, req.RecoveryCode)
+	case account.TOTPEnabled:
+		ok = acceptTOTP(username, userItem, req.Code)
+	case require2FA:
+		recoveryCodes, ok, err = enableTOTP(username, userItem, req.Code)
+		if err != nil {
+			fmt.Printf("Failed to enable TOTP for %s: %v\n", username, err)
+			return errorResponse(500, "Failed to enable two-factor authentication", headers)
+		}
+		account.TOTPEnabled = ok
+	default:
+		return errorResponse(400, "Two-factor authentication is not set up", headers)
+	}
+	if !ok {
+		recordLoginFailure(username)
+		recordLogin(request, username, auditLoginFailed, map[string]interface{}{"reason": "invalid code"})
+		return errorResponse(401, "Invalid code", headers)
+	}
+	clearLoginFailures(username)
+
+	response, err := startSession(account, userItem)
+	if err != nil {
+		fmt.Printf("Failed to start session for %s: %v\n", username, err)
+		return errorResponse(500, "Failed to generate token", headers)
+	}
+	response.RecoveryCodes = recoveryCodes
+	method := "totp"
+	if req.RecoveryCode != "" {
+		method = "recovery code"
+	}
+	recordLogin(request, username, auditLogin, map[string]interface{}{"method": method, "role": account.Role})
+
+	body, _ := json.Marshal(response)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+func handleGetTOTPStatus(token string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	username, ok := getUsernameFromToken(token)
+	if !ok {
+		return errorResponse(401, "Invalid token", headers)
+	}
+	userItem, err := userStore.GetUser(username)
+	if err != nil || userItem == nil {
+		return errorResponse(500, "Failed to get two-factor status", headers)
+	}
+	status := TOTPStatus{Enabled: userFromItem(userItem).TOTPEnabled, Required: require2FA}
+	if attr := userItem["RecoveryCodes"]; attr != nil {
+		status.RecoveryCodesLeft = len(attr.M)
+	}
+
+	body, _ := json.Marshal(status)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// handleBeginTOTP starts enrollment for a signed-in user. It is confirmed by
+// handleConfirmTOTP with a code from the authenticator.
+func handleBeginTOTP(token string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	username, ok := getUsernameFromToken(token)
+	if !ok {
+		return errorResponse(401, "Invalid token", headers)
+	}
+	userItem, err := userStore.GetUser(username)
+	if err != nil || userItem == nil {
+		return errorResponse(500, "Failed to start two-factor setup", headers)
+	}
+	if userFromItem(userItem).TOTPEnabled {
+		return errorResponse(409, "Two-factor authentication is already enabled", headers)
+	}
+
+	enrollment, err := beginTOTPEnrollment(username)
+	if err != nil {
+		fmt.Printf("Failed to start TOTP enrollment for %s: %v\n", username, err)
+		return errorResponse(500, "Failed to start two-factor setup", headers)
+	}
+	body, _ := json.Marshal(enrollment)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+func handleConfirmTOTP(token string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	username, ok := getUsernameFromToken(token)
+	if !ok {
+		return errorResponse(401, "Invalid token", headers)
+	}
+	var req TOTPCodeRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return errorResponse(400, "Invalid request body", headers)
+	}
+	userItem, err := userStore.GetUser(username)
+	if err != nil || userItem == nil {
+		return errorResponse(500, "Failed to enable two-factor authentication", headers)
+	}
+	if userFromItem(userItem).TOTPEnabled {
+		return errorResponse(409, "Two-factor authentication is already enabled", headers)
+	}
+
+	codes, ok, err := enableTOTP(username, userItem, req.Code)
+	if err != nil {
+		fmt.Printf("Failed to enable TOTP for %s: %v\n", username, err)
+		return errorResponse(500, "Failed to enable two-factor authentication", headers)
+	}
+	if !ok {
+		return errorResponse(400, "Invalid code", headers)
+	}
+	body, _ := json.Marshal(map[string][]string{"recoveryCodes": codes})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// handleRegenerateRecoveryCodes replaces all recovery codes after checking a
+// current TOTP code.
+func handleRegenerateRecoveryCodes(token string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	username, ok := getUsernameFromToken(token)
+	if !ok {
+		return errorResponse(401, "Invalid token", headers)
+	}
+	var req TOTPCodeRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return errorResponse(400, "Invalid request body", headers)
+	}
+	userItem, err := userStore.GetUser(username)
+	if err != nil || userItem == nil {
+		return errorResponse(500, "Failed to regenerate recovery codes", headers)
+	}
+	if !userFromItem(userItem).TOTPEnabled {
+		return errorResponse(400, "Two-factor authentication is not enabled", headers)
+	}
+	if !acceptTOTP(username, userItem, req.Code) {
+		return errorResponse(403, "Invalid code", headers)
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return errorResponse(500, "Failed to regenerate recovery codes", headers)
+	}
+	_, err = userStore.UpdateUser(username, ItemUpdate{
+		Expression: "SET RecoveryCodes = :codes",
+		Condition:  "attribute_exists(Username)",
+		Values:     map[string]*dynamodb.AttributeValue{":codes": hashes},
+	})
+	if err != nil {
+		fmt.Printf("Failed to regenerate recovery codes for %s: %v\n", username, err)
+		return errorResponse(500, "Failed to regenerate recovery codes", headers)
+	}
+	body, _ := json.Marshal(map[string][]string{"recoveryCodes": codes})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// handleDisableTOTP turns two-factor authentication off for the caller after
+// confirming their password. It is refused while REQUIRE_2FA is set.
+func handleDisableTOTP(token string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	username, ok := getUsernameFromToken(token)
+	if !ok {
+		return errorResponse(401, "Invalid token", headers)
+	}
+	if require2FA {
+		return errorResponse(400, "Two-factor authentication is required for all accounts", headers)
+	}
+	var req TOTPCodeRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return errorResponse(400, "Invalid request body", headers)
+	}
+	userItem, err := userStore.GetUser(username)
+	if err != nil || userItem == nil {
+		return errorResponse(500, "Failed to disable two-factor authentication", headers)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(stringAttr(userItem, "PasswordHash")), []byte(req.Password)); err != nil {
+		return errorResponse(403, "Password is incorrect", headers)
+	}
+	return clearTOTP(username, headers)
+}
+
+// handleResetUserTOTP lets an admin remove a user's enrollment, e.g. after a
+// lost phone. The user enrolls again on their next login if 2FA is required.
+func handleResetUserTOTP(username string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	return clearTOTP(username, headers)
+}
+
+func clearTOTP(username string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	_, err := userStore.UpdateUser(username, ItemUpdate{
+		Expression: "SET UpdatedAt = :now REMOVE TOTPSecret, TOTPEnabled, TOTPPending, TOTPLastStep, RecoveryCodes",
+		Condition:  "attribute_exists(Username)",
+		Values: map[string]*dynamodb.AttributeValue{
+			":now": {S: aws.String(time.Now().Format(time.RFC3339))},
+		},
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "ConditionalCheckFailed") {
+			return errorResponse(404, "User not found", headers)
+		}
+		fmt.Printf("Failed to clear TOTP for %s: %v\n", username, err)
+		return errorResponse(500, "Failed to disable two-factor authentication", headers)
+	}
+
+	body, _ := json.Marshal(map[string]bool{"success": true})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B SHA-1 vectors, truncated to six digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got, err := totpCode(secret, tt.unix/totpPeriod); err != nil || got != tt.want {
+			t.Errorf("totpCode at %d = %s, %v; want %s", tt.unix, got, err, tt.want)
+		}
+	}
+
+	if _, ok := matchTOTP(secret, "287082", time.Unix(59+totpPeriod, 0)); !ok {
+		t.Error("code from the previous step rejected")
+	}
+	if _, ok := matchTOTP(secret, "287082", time.Unix(59+3*totpPeriod, 0)); ok {
+		t.Error("stale code accepted")
+	}
+}
+
+// codeAt returns the TOTP code for the current time step plus offset.
+func codeAt(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+	code, err := totpCode(secret, time.Now().Unix()/totpPeriod+offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// passwordStep runs the first login step and returns the MFA challenge.
+func (env *testEnv) passwordStep(username string) MFAChallenge {
+	env.t.Helper()
+	env.token = ""
+	resp := env.call("POST", "/api/login", fmt.Sprintf(`{"username":%q,"password":%q}`, username, testPassword))
+	var c MFAChallenge
+	json.Unmarshal([]byte(resp.Body), &c)
+	if resp.StatusCode != 200 || !c.MFARequired || c.MFAToken == "" {
+		env.t.Fatalf("password step: %d %s", resp.StatusCode, resp.Body)
+	}
+	return c
+}
+
+func (env *testEnv) mfaStep(mfaToken, field, code string) (LoginResponse, int) {
+	env.t.Helper()
+	body, _ := json.Marshal(map[string]string{"mfaToken": mfaToken, field: code})
+	resp := env.call("POST", "/api/login/mfa", string(body))
+	var lr LoginResponse
+	json.Unmarshal([]byte(resp.Body), &lr)
+	return lr, resp.StatusCode
+}
+
+// enroll turns on TOTP for the logged-in user and returns the secret and
+// recovery codes.
+func (env *testEnv) enroll() (string, []string) {
+	env.t.Helper()
+	resp := env.call("POST", "/api/user/totp", "")
+	var e TOTPEnrollment
+	json.Unmarshal([]byte(resp.Body), &e)
+	if resp.StatusCode != 200 || e.Secret == "" {
+		env.t.Fatalf("begin enrollment: %d %s", resp.StatusCode, resp.Body)
+	}
+	resp = env.call("POST", "/api/user/totp/confirm", fmt.Sprintf(`{"code":%q}`, codeAt(env.t, e.Secret, 0)))
+	var confirmed struct{ RecoveryCodes []string }
+	json.Unmarshal([]byte(resp.Body), &confirmed)
+	if resp.StatusCode != 200 || len(confirmed.RecoveryCodes) != recoveryCodeCount {
+		env.t.Fatalf("confirm enrollment: %d %s", resp.StatusCode, resp.Body)
+	}
+	return e.Secret, confirmed.RecoveryCodes
+}
+
+func TestTOTPLogin(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	if resp := env.call("POST", "/api/user/totp/confirm", `{"code":"000000"}`); resp.StatusCode != 400 {
+		t.Errorf("confirm without enrollment: status = %d, want 400", resp.StatusCode)
+	}
+	secret, recovery := env.enroll()
+	if resp := env.call("POST", "/api/user/totp", ""); resp.StatusCode != 409 {
+		t.Errorf("enroll twice: status = %d, want 409", resp.StatusCode)
+	}
+
+	// The password alone no longer starts a session
+	c := env.passwordStep(testUser)
+	if c.MFASetupRequired || c.Secret != "" {
+		t.Errorf("enrolled user offered setup: %+v", c)
+	}
+	env.token = c.MFAToken
+	if resp := env.call("GET", "/api/images", ""); resp.StatusCode != 401 {
+		t.Errorf("MFA token used as access token: status = %d, want 401", resp.StatusCode)
+	}
+
+	if _, code := env.mfaStep(c.MFAToken, "code", "000000"); code != 401 {
+		t.Errorf("wrong code: status = %d, want 401", code)
+	}
+	// The enrollment code's step was used already, so use the next one
+	next := codeAt(t, secret, 1)
+	lr, code := env.mfaStep(c.MFAToken, "code", next)
+	if code != 200 || lr.Token == "" {
+		t.Fatalf("code step: %d %+v", code, lr)
+	}
+	if _, code := env.mfaStep(env.passwordStep(testUser).MFAToken, "code", next); code != 401 {
+		t.Errorf("replayed code: status = %d, want 401", code)
+	}
+
+	// Recovery codes work once each
+	c = env.passwordStep(testUser)
+	if _, code := env.mfaStep(c.MFAToken, "recoveryCode", recovery[0]); code != 200 {
+		t.Errorf("recovery code: status = %d", code)
+	}
+	if _, code := env.mfaStep(c.MFAToken, "recoveryCode", recovery[0]); code != 401 {
+		t.Errorf("reused recovery code: status = %d, want 401", code)
+	}
+
+	env.token = lr.Token
+	resp := env.call("GET", "/api/user/totp", "")
+	var status TOTPStatus
+	json.Unmarshal([]byte(resp.Body), &status)
+	if !status.Enabled || status.RecoveryCodesLeft != recoveryCodeCount-1 {
+		t.Errorf("status = %+v", status)
+	}
+
+	// Disabling needs the password
+	if resp := env.call("DELETE", "/api/user/totp", `{"password":"wrong"}`); resp.StatusCode != 403 {
+		t.Errorf("disable with wrong password: status = %d, want 403", resp.StatusCode)
+	}
+	if resp := env.call("DELETE", "/api/user/totp", fmt.Sprintf(`{"password":%q}`, testPassword)); resp.StatusCode != 200 {
+		t.Fatalf("disable: %d %s", resp.StatusCode, resp.Body)
+	}
+	env.login()
+}
+
+func TestTOTPCodeFailuresLockOut(t *testing.T) {
+	env := newTestEnv(t)
+	useClock(t)
+	env.login()
+	env.enroll()
+	c := env.passwordStep(testUser)
+	for i := 0; i < loginMaxFailures; i++ {
+		env.mfaStep(c.MFAToken, "code", "000000")
+	}
+	if _, code := env.mfaStep(c.MFAToken, "code", "000000"); code != 429 {
+		t.Errorf("status = %d, want 429", code)
+	}
+}
+
+func TestRequire2FA(t *testing.T) {
+	env := newTestEnv(t)
+	saved := require2FA
+	require2FA = true
+	t.Cleanup(func() { require2FA = saved })
+	env.seedUser("ann", roleReviewer)
+
+	// Unenrolled users enroll as part of logging in
+	c := env.passwordStep("ann")
+	if !c.MFASetupRequired || c.Secret == "" || c.OTPAuthURL == "" {
+		t.Fatalf("challenge = %+v", c)
+	}
+	lr, code := env.mfaStep(c.MFAToken, "code", codeAt(t, c.Secret, 0))
+	if code != 200 || len(lr.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("setup login: %d %+v", code, lr)
+	}
+
+	env.token = lr.Token
+	if resp := env.call("DELETE", "/api/user/totp", fmt.Sprintf(`{"password":%q}`, testPassword)); resp.StatusCode != 400 {
+		t.Errorf("disable while required: status = %d, want 400", resp.StatusCode)
+	}
+
+	// An admin reset sends the user through setup again
+	c = env.passwordStep(testUser)
+	lr, _ = env.mfaStep(c.MFAToken, "code", codeAt(t, c.Secret, 0))
+	env.token = lr.Token
+	if resp := env.call("DELETE", "/api/users/ann/totp", ""); resp.StatusCode != 200 {
+		t.Fatalf("admin reset: %d %s", resp.StatusCode, resp.Body)
+	}
+	if c := env.passwordStep("ann"); !c.MFASetupRequired {
+		t.Errorf("after reset: challenge = %+v", c)
+	}
+}
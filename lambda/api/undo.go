@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/google/uuid"
+)
+
+// Every review decision made through a login session pushes the image's
+// previous state onto that session's undo stack, stored with the session on
+// the user's row so it goes away when the session does. Undoing an image
+// pops its most recent step, restores the review fields and moves the files
+// back to where they were. API tokens have no session and no undo stack.
+
+const (
+	// maxUndoSteps bounds the stack so it cannot grow the user's row without limit
+	maxUndoSteps = 50
+	// maxUndoTrim is the most steps one update drops, keeping its expression
+	// well under DynamoDB's 4KB
+	maxUndoTrim = 25
+)
+
+// UndoStep is an image's state before one review decision.
+type UndoStep struct {
+	StepID      string `json:"stepId" dynamodbav:"StepID"`
+	ImageGUID   string `json:"imageGUID" dynamodbav:"ImageGUID"`
+	Status      string `json:"status,omitempty" dynamodbav:"Status,omitempty"`
+	Reviewed    string `json:"reviewed" dynamodbav:"Reviewed"`
+	GroupNumber int    `json:"groupNumber" dynamodbav:"GroupNumber"`
+	ColorCode   string `json:"colorCode,omitempty" dynamodbav:"ColorCode,omitempty"`
+	Rating      int    `json:"rating" dynamodbav:"Rating"`
+	// The folder the image's files were in
+	Prefix    string `json:"prefix" dynamodbav:"Prefix"`
+	CreatedAt string `json:"createdAt" dynamodbav:"CreatedAt"`
+}
+
+// undoStepFor captures the parts of an image an undo restores.
+func undoStepFor(img ImageResponse) UndoStep {
+	return UndoStep{
+		StepID:      uuid.New().String(),
+		ImageGUID:   img.ImageGUID,
+		Status:      img.Status,
+		Reviewed:    img.Reviewed,
+		GroupNumber: img.GroupNumber,
+		ColorCode:   img.ColorCode,
+		Rating:      img.Rating,
+		Prefix:      path.Dir(img.OriginalFile),
+		CreatedAt:   time.Now().Format(time.RFC3339),
+	}
+}
+
+// pushUndoSteps appends steps to the caller's session stack, dropping the
+// oldest steps once it is full. Of a batch larger than the stack only the
+// last steps are kept.
+func pushUndoSteps(caller *Caller, steps ...UndoStep) error {
+	if caller.SessionID == "" || len(steps) == 0 {
+		return nil
+	}
+	if len(steps) > maxUndoSteps {
+		steps = steps[len(steps)-maxUndoSteps:]
+	}
+	stepsAV := make([]*dynamodb.AttributeValue, len(steps))
+	for i, step := range steps {
+		av, err := dynamodbattribute.MarshalMap(step)
+		if err != nil {
+			return err
+		}
+		stepsAV[i] = &dynamodb.AttributeValue{M: av}
+	}
+	names := map[string]*string{"#sid": aws.String(caller.SessionID)}
+	item, err := userStore.UpdateUser(caller.Username, ItemUpdate{
+		Expression: "SET Sessions.#sid.Undo = list_append(if_not_exists(Sessions.#sid.Undo, :empty), :steps)",
+		Condition:  "attribute_exists(Sessions.#sid)",
+		Names:      names,
+		Values: map[string]*dynamodb.AttributeValue{
+			":empty": {L: []*dynamodb.AttributeValue{}},
+			":steps": {L: stepsAV},
+		},
+		ReturnValues: dynamodb.ReturnValueAllNew,
+	})
+	if err != nil {
+		return err
+	}
+
+	for over := len(userSessions(item)[caller.SessionID].Undo) - maxUndoSteps; over > 0; over -= maxUndoTrim {
+		// Highest index first, so removing one does not shift the next
+		var oldest []string
+		for i := min(over, maxUndoTrim) - 1; i >= 0; i-- {
+			oldest = append(oldest, fmt.Sprintf("Sessions.#sid.Undo[%d]", i))
+		}
+		_, err = userStore.UpdateUser(caller.Username, ItemUpdate{
+			Expression: "REMOVE " + strings.Join(oldest, ", "),
+			Condition:  "attribute_exists(Sessions.#sid)",
+			Names:      names,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// undoStack returns the caller's session stack, oldest step first.
+func undoStack(caller *Caller) ([]UndoStep, error) {
+	userItem, err := userStore.GetUser(caller.Username)
+	if err != nil || userItem == nil {
+		return nil, err
+	}
+	return userSessions(userItem)[caller.SessionID].Undo, nil
+}
+
+// popUndoStep removes a step from the caller's session stack. The condition
+// keeps a concurrent push or pop from making it remove a different step.
+func popUndoStep(caller *Caller, index int, stepID string) error {
+	entry := fmt.Sprintf("Sessions.#sid.Undo[%d]", index)
+	_, err := userStore.UpdateUser(caller.Username, ItemUpdate{
+		Expression: "REMOVE " + entry,
+		Condition:  entry + ".StepID = :step",
+		Names:      map[string]*string{"#sid": aws.String(caller.SessionID)},
+		Values: map[string]*dynamodb.AttributeValue{
+			":step": {S: aws.String(stepID)},
+		},
+	})
+	return err
+}
+
+// handleGetUndoStack lists the steps the caller's session can undo, most
+// recent first.
+func handleGetUndoStack(caller *Caller, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	if caller.SessionID == "" {
+		return errorResponse(400, "Undo is only available to login sessions", headers)
+	}
+	stack, err := undoStack(caller)
+	if err != nil {
+		fmt.Printf("Failed to load undo stack for %s: %v\n", caller.Username, err)
+		return errorResponse(500, "Failed to load undo history", headers)
+	}
+
+	steps := make([]UndoStep, 0, len(stack))
+	for i := len(stack) - 1; i >= 0; i-- {
+		steps = append(steps, stack[i])
+	}
+	body, _ := json.Marshal(steps)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// handleUndoImage reverts the most recent review decision the caller's
+// session made on an image. Restoring absolute values makes a repeated
+// undo harmless, so the step is only popped once the image is restored.
+func handleUndoImage(caller *Caller, imageID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	if caller.SessionID == "" {
+		return errorResponse(400, "Undo is only available to login sessions", headers)
+	}
+	stack, err := undoStack(caller)
+	if err != nil {
+		fmt.Printf("Failed to load undo stack for %s: %v\n", caller.Username, err)
+		return errorResponse(500, "Failed to undo", headers)
+	}
+	index := -1
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i].ImageGUID == imageID {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return errorResponse(404, "Nothing to undo for this image", headers)
+	}
+	step := stack[index]
+
+	imgItem, err := imageStore.GetImage(imageID)
+	if err != nil || imgItem == nil {
+		return errorResponse(404, "Image not found", headers)
+	}
+	var img ImageResponse
+	dynamodbattribute.UnmarshalMap(imgItem, &img)
+	if err := checkImageAccess(caller, img, projectEditor); err != nil {
+		return projectAccessError(err, headers)
+	}
+
+	if img.MoveStatus == "pending" || img.MoveStatus == "moving" || img.MoveJournal != nil {
+		return errorResponse(409, "The image's files are still being moved, try again shortly", headers)
+	}
+	if img.Status != step.Status {
+		switch img.Status {
+		case "deleted":
+			return errorResponse(409, "Image has since been deleted, undelete it instead", headers)
+		case "project":
+			return errorResponse(409, "Image has since been added to a project", headers)
+		}
+	}
+
+	newPaths := map[string]string{
+		"original":     img.OriginalFile,
+		"thumbnail50":  img.Thumbnail50,
+		"thumbnail400": img.Thumbnail400,
+	}
+	moved := path.Dir(img.OriginalFile) != step.Prefix
+	if moved {
+		newPaths, err = moveImageFiles(img, step.Prefix)
+		if err != nil {
+			fmt.Printf("Error moving files back for image %s: %v\n", imageID, err)
+			if errors.Is(err, ErrSourceFileMissing) {
+				return errorResponse(409, "The image's files are missing", headers)
+			}
+			if errors.Is(err, errMoveConflict) {
+				return errorResponse(409, "The image's files are still being moved, try again shortly", headers)
+			}
+			return errorResponse(500, fmt.Sprintf("Failed to move files: %v", err), headers)
+		}
+	}
+
+	updateExpr := "SET GroupNumber = :group, Rating = :rating, Reviewed = :reviewed, OriginalFile = :orig, Thumbnail50 = :t50, Thumbnail400 = :t400, UpdatedDateTime = :updated"
+	values := map[string]*dynamodb.AttributeValue{
+		":group":    {N: aws.String(fmt.Sprintf("%d", step.GroupNumber))},
+		":rating":   {N: aws.String(fmt.Sprintf("%d", step.Rating))},
+		":reviewed": {S: aws.String(step.Reviewed)},
+		":orig":     {S: aws.String(newPaths["original"])},
+		":t50":      {S: aws.String(newPaths["thumbnail50"])},
+		":t400":     {S: aws.String(newPaths["thumbnail400"])},
+		":updated":  {S: aws.String(time.Now().Format(time.RFC3339))},
+		":current":  {S: aws.String(img.OriginalFile)},
+	}
+	removes := []string{"MoveStatus"}
+	if step.Status != "" {
+		updateExpr += ", #status = :status"
+		values[":status"] = &dynamodb.AttributeValue{S: aws.String(step.Status)}
+	} else {
+		removes = append(removes, "#status")
+	}
+	if step.ColorCode != "" {
+		updateExpr += ", ColorCode = :color"
+		values[":color"] = &dynamodb.AttributeValue{S: aws.String(step.ColorCode)}
+	} else {
+		removes = append(removes, "ColorCode")
+	}
+	updateExpr += " REMOVE " + strings.Join(removes, ", ")
+
+	update := ItemUpdate{
+		Expression: updateExpr,
+		// Another request moving the files in the meantime would be overwritten
+		Condition:    "OriginalFile = :current",
+		Names:        map[string]*string{"#status": aws.String("Status")},
+		Values:       values,
+		ReturnValues: dynamodb.ReturnValueAllNew,
+	}
+	if moved {
+		update = closeMoveJournal(update)
+	}
+	updatedItem, err := imageStore.UpdateImage(imageID, bumpVersion(update))
+	if err != nil {
+		if moved {
+			rollbackMoveOf(imageID, step.Prefix)
+		}
+		if isConditionFailed(err) {
+			return errorResponse(409, "Image changed while undoing, try again", headers)
+		}
+		fmt.Printf("Error restoring image %s: %v\n", imageID, err)
+		return errorResponse(500, "Failed to undo", headers)
+	}
+
+	if err := popUndoStep(caller, index, step.StepID); err != nil && !isConditionFailed(err) {
+		fmt.Printf("Failed to pop undo step %s for %s: %v\n", step.StepID, caller.Username, err)
+	}
+
+	var updated ImageResponse
+	dynamodbattribute.UnmarshalMap(updatedItem, &updated)
+	before, after := auditDiff(imageAuditFields(img), imageAuditFields(updated))
+	recordAudit(caller, AuditEvent{Action: auditImageUndo, ImageGUID: imageID, ProjectID: img.ProjectID, Before: before, After: after})
+
+	body, _ := json.Marshal(updated)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
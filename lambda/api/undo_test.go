@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func (env *testEnv) undoStack() []UndoStep {
+	env.t.Helper()
+	resp := env.call("GET", "/api/user/undo", "")
+	var steps []UndoStep
+	if err := json.Unmarshal([]byte(resp.Body), &steps); err != nil || resp.StatusCode != 200 {
+		env.t.Fatalf("undo stack: %d %s", resp.StatusCode, resp.Body)
+	}
+	return steps
+}
+
+func TestUndoReview(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedUser("ann", roleReviewer)
+	env.seedImage("img1", map[string]interface{}{"Rating": 2})
+	env.seedImage("img2", nil)
+	env.loginAs("ann", testPassword)
+
+	// Rate, then approve img1, and reject img2
+	env.call("PUT", "/api/images/img1", `{"rating":4}`)
+	env.call("PUT", "/api/images/img1", `{"groupNumber":3,"reviewed":"true","rating":4}`)
+	env.call("PUT", "/api/images/img2", `{"groupNumber":0,"reviewed":"true"}`)
+	if resp := env.call("POST", "/api/images/img1/undo", ""); resp.StatusCode != 409 {
+		t.Errorf("undo during move: status = %d, want 409", resp.StatusCode)
+	}
+	env.runAsyncMoves()
+	if img := env.image("img1"); img.Status != "approved" {
+		t.Fatalf("img1 not approved: %+v", img)
+	}
+	if steps := env.undoStack(); len(steps) != 3 || steps[0].ImageGUID != "img2" {
+		t.Fatalf("undo stack = %+v", steps)
+	}
+
+	// Undo steps back through img1's decisions, most recent first
+	resp := env.call("POST", "/api/images/img1/undo", "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("undo: %d %s", resp.StatusCode, resp.Body)
+	}
+	img := env.image("img1")
+	if img.Status != "inbox" || img.Reviewed != "false" || img.GroupNumber != 0 || img.Rating != 4 || img.MoveStatus != "" {
+		t.Errorf("after first undo: %+v", img)
+	}
+	for _, suffix := range []string{".jpg", ".50.jpg", ".400.jpg", ".cr2"} {
+		if !objectStore.Exists("images/img1"+suffix) || objectStore.Exists("approved/green/2024/05/06/img1"+suffix) {
+			t.Errorf("img1%s was not moved back", suffix)
+		}
+	}
+	if img.OriginalFile != "images/img1.jpg" {
+		t.Errorf("OriginalFile = %s", img.OriginalFile)
+	}
+
+	env.call("POST", "/api/images/img1/undo", "")
+	if img := env.image("img1"); img.Rating != 2 {
+		t.Errorf("after second undo: rating = %d, want 2", img.Rating)
+	}
+	if resp := env.call("POST", "/api/images/img1/undo", ""); resp.StatusCode != 404 {
+		t.Errorf("nothing left to undo: status = %d, want 404", resp.StatusCode)
+	}
+
+	// The stack belongs to the session, not the user
+	env.loginAs("ann", testPassword)
+	if steps := env.undoStack(); len(steps) != 0 {
+		t.Errorf("new session inherited steps: %+v", steps)
+	}
+	if resp := env.call("POST", "/api/images/img2/undo", ""); resp.StatusCode != 404 {
+		t.Errorf("undo from another session: status = %d, want 404", resp.StatusCode)
+	}
+
+	env.login()
+	page := env.audit("image=img1&action=image.undo")
+	if len(page.Events) != 2 || page.Events[1].Before["status"] != "approved" || page.Events[1].Actor != "ann" {
+		t.Errorf("undo events = %+v", page.Events)
+	}
+}
+
+func TestUndoRefusesLaterChanges(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedImage("img1", nil)
+	env.login()
+	env.call("PUT", "/api/images/img1", `{"groupNumber":0,"reviewed":"true"}`)
+	env.runAsyncMoves()
+	env.call("DELETE", "/api/images/img1", "")
+
+	if resp := env.call("POST", "/api/images/img1/undo", ""); resp.StatusCode != 409 {
+		t.Errorf("undo after delete: status = %d, want 409", resp.StatusCode)
+	}
+	if img := env.image("img1"); img.Status != "deleted" {
+		t.Errorf("deleted image restored: %+v", img)
+	}
+}
+
+func TestUndoStackIsBounded(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedImage("img1", nil)
+	env.login()
+	for i := 0; i < maxUndoSteps+3; i++ {
+		env.call("PUT", "/api/images/img1", fmt.Sprintf(`{"rating":%d}`, i%6))
+	}
+	steps := env.undoStack()
+	if len(steps) != maxUndoSteps {
+		t.Fatalf("stack size = %d, want %d", len(steps), maxUndoSteps)
+	}
+	// The oldest steps were dropped: the first kept one follows rating 2
+	if oldest := steps[len(steps)-1]; oldest.Rating != 2 {
+		t.Errorf("oldest kept step rating = %d, want 2", oldest.Rating)
+	}
+
+	// A batch larger than the stack keeps its last steps
+	var ids []string
+	for i := 0; i < 2*maxUndoSteps; i++ {
+		id := fmt.Sprintf("b%03d", i)
+		env.seedImage(id, nil)
+		ids = append(ids, strconv.Quote(id))
+	}
+	env.batch(`{"imageGUIDs":[` + strings.Join(ids, ",") + `],"patch":{"rating":4}}`)
+	steps = env.undoStack()
+	if len(steps) != maxUndoSteps || steps[0].ImageGUID != "b099" || steps[len(steps)-1].ImageGUID != "b050" {
+		t.Errorf("stack after a batch = %d steps, %s to %s", len(steps), steps[len(steps)-1].ImageGUID, steps[0].ImageGUID)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles, from least to most privileged. Viewers are read-only, reviewers can
+// also rate, review, delete and move images, and admins can do everything,
+// including creating projects and managing users. Within a project, the
+// member's project role (see members.go) decides the rest.
+const (
+	roleViewer   = "viewer"
+	roleReviewer = "reviewer"
+	roleAdmin    = "admin"
+)
+
+var roleRank = map[string]int{roleViewer: 1, roleReviewer: 2, roleAdmin: 3}
+
+const minPasswordLength = 8
+
+func isValidRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// roleAllows reports whether role is at least as privileged as required.
+func roleAllows(role, required string) bool {
+	return isValidRole(role) && roleRank[role] >= roleRank[required]
+}
+
+// requiredRole returns the least privileged role allowed to call a route.
+// Routes not listed explicitly are admin-only, so new write endpoints are
+// locked down until someone decides otherwise.
+func requiredRole(method, path string) string {
+	switch {
+	case strings.HasPrefix(path, "/api/users") || path == "/api/logs" || path == "/api/audit":
+		return roleAdmin
+	case strings.HasPrefix(path, "/api/user/") || path == "/api/logout" || path == "/api/collections" || strings.HasPrefix(path, "/api/collections/") ||
+		path == "/api/jobs" || strings.HasPrefix(path, "/api/jobs/"):
+		// Own settings, password, session, collections and jobs
+		return roleViewer
+	case method == "GET":
+		return roleViewer
+	case strings.HasPrefix(path, "/api/images/"):
+		return roleReviewer
+	case strings.HasPrefix(path, "/api/projects/") && strings.HasSuffix(path, "/images") && method == "POST":
+		return roleReviewer
+	case strings.HasPrefix(path, "/api/projects/"):
+		// Checked against the caller's project role by the handler
+		return roleViewer
+	default:
+		return roleAdmin
+	}
+}
+
+// User is a Users table row as returned by the API. The password hash is
+// deliberately not part of it.
+type User struct {
+	Username string `json:"username" dynamodbav:"Username"`
+	Role     string `json:"role" dynamodbav:"Role"`
+	Disabled bool   `json:"disabled,omitempty" dynamodbav:"Disabled,omitempty"`
+	// TOTPEnabled is set once two-factor enrollment has been confirmed
+	TOTPEnabled bool   `json:"totpEnabled,omitempty" dynamodbav:"TOTPEnabled,omitempty"`
+	CreatedAt   string `json:"createdAt,omitempty" dynamodbav:"CreatedAt,omitempty"`
+	UpdatedAt   string `json:"updatedAt,omitempty" dynamodbav:"UpdatedAt,omitempty"`
+}
+
+type CreateUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+type UpdateUserRequest struct {
+	Role     *string `json:"role,omitempty"`
+	Disabled *bool   `json:"disabled,omitempty"`
+}
+
+type SetPasswordRequest struct {
+	CurrentPassword string `json:"currentPassword,omitempty"`
+	Password        string `json:"password"`
+}
+
+// userFromItem unmarshals a Users row. Rows written before roles existed
+// have no Role and are treated as viewers.
+func userFromItem(item map[string]*dynamodb.AttributeValue) User {
+	var user User
+	dynamodbattribute.UnmarshalMap(item, &user)
+	if !isValidRole(user.Role) {
+		user.Role = roleViewer
+	}
+	return user
+}
+
+func isValidUsername(username string) bool {
+	if username == "" || len(username) > 64 {
+		return false
+	}
+	for _, r := range username {
+		if !(r >= 'a' && r <= 'z') && !(r >= 'A' && r <= 'Z') && !(r >= '0' && r <= '9') && !strings.ContainsRune("._@-", r) {
+			return false
+		}
+	}
+	return true
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func handleListUsers(headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	users := make([]User, 0)
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		page, err := userStore.ScanUsers(ItemScan{
+			Projection: "Username, #role, Disabled, TOTPEnabled, CreatedAt, UpdatedAt",
+			Names:      map[string]*string{"#role": aws.String("Role")},
+			StartKey:   startKey,
+		})
+		if err != nil {
+			fmt.Printf("Error listing users: %v\n", err)
+			return errorResponse(500, "Failed to list users", headers)
+		}
+		for _, item := range page.Items {
+			users = append(users, userFromItem(item))
+		}
+		if page.LastKey == nil {
+			break
+		}
+		startKey = page.LastKey
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+
+	body, _ := json.Marshal(users)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+func handleCreateUser(request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	var req CreateUserRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return errorResponse(400, "Invalid request body", headers)
+	}
+	if !isValidUsername(req.Username) {
+		return errorResponse(400, "Username must be 1-64 letters, digits or . _ @ -", headers)
+	}
+	if !isValidRole(req.Role) {
+		return errorResponse(400, "Role must be admin, reviewer or viewer", headers)
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return errorResponse(400, err.Error(), headers)
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	user := User{Username: req.Username, Role: req.Role, CreatedAt: now, UpdatedAt: now}
+	_, err = userStore.UpdateUser(req.Username, ItemUpdate{
+		Expression: "SET PasswordHash = :hash, #role = :role, CreatedAt = :now, UpdatedAt = :now",
+		Condition:  "attribute_not_exists(Username)",
+		Names:      map[string]*string{"#role": aws.String("Role")},
+		Values: map[string]*dynamodb.AttributeValue{
+			":hash": {S: aws.String(hash)},
+			":role": {S: aws.String(req.Role)},
+			":now":  {S: aws.String(now)},
+		},
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "ConditionalCheckFailed") {
+			return errorResponse(409, "User already exists", headers)
+		}
+		fmt.Printf("Error creating user %s: %v\n", req.Username, err)
+		return errorResponse(500, "Failed to create user", headers)
+	}
+
+	body, _ := json.Marshal(user)
+	return events.APIGatewayProxyResponse{
+		StatusCode: 201,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// handleUpdateUser changes a user's role or disables/re-enables the account.
+// Admins cannot change their own role or disable themselves, which also
+// guarantees at least one admin is always left.
+func handleUpdateUser(token, username string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	var req UpdateUserRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return errorResponse(400, "Invalid request body", headers)
+	}
+	if req.Role == nil && req.Disabled == nil {
+		return errorResponse(400, "Nothing to update", headers)
+	}
+	if req.Role != nil && !isValidRole(*req.Role) {
+		return errorResponse(400, "Role must be admin, reviewer or viewer", headers)
+	}
+	if caller, _ := getUsernameFromToken(token); caller == username {
+		return errorResponse(400, "You cannot change your own role or disable your own account", headers)
+	}
+
+	updateExpr := "SET UpdatedAt = :updated"
+	exprValues := map[string]*dynamodb.AttributeValue{
+		":updated": {S: aws.String(time.Now().Format(time.RFC3339))},
+	}
+	exprNames := make(map[string]*string)
+	signOut := false
+	if req.Role != nil {
+		updateExpr += ", #role = :role"
+		exprNames["#role"] = aws.String("Role")
+		exprValues[":role"] = &dynamodb.AttributeValue{S: req.Role}
+		current, err := userStore.GetUser(username)
+		if err != nil {
+			fmt.Printf("Error getting user %s: %v\n", username, err)
+			return errorResponse(500, "Failed to update user", headers)
+		}
+		// Sessions start again with the new role
+		signOut = current != nil && userFromItem(current).Role != *req.Role
+	}
+	if req.Disabled != nil {
+		updateExpr += ", Disabled = :disabled"
+		exprValues[":disabled"] = &dynamodb.AttributeValue{BOOL: req.Disabled}
+		// Sign the user out everywhere
+		signOut = signOut || *req.Disabled
+	}
+	if signOut {
+		updateExpr += " REMOVE Sessions"
+	}
+
+	updated, err := userStore.UpdateUser(username, ItemUpdate{
+		Expression:   updateExpr,
+		Condition:    "attribute_exists(Username)",
+		Names:        exprNames,
+		Values:       exprValues,
+		ReturnValues: dynamodb.ReturnValueAllNew,
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "ConditionalCheckFailed") {
+			return errorResponse(404, "User not found", headers)
+		}
+		fmt.Printf("Error updating user %s: %v\n", username, err)
+		return errorResponse(500, "Failed to update user", headers)
+	}
+
+	body, _ := json.Marshal(userFromItem(updated))
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// handleResetPassword lets an admin set a new password for any user. The
+// user's existing sessions are revoked and any login lockout is cleared.
+func handleResetPassword(username string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	var req SetPasswordRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return errorResponse(400, "Invalid request body", headers)
+	}
+	resp, err := setPassword(username, req.Password, true, headers)
+	if resp.StatusCode == 200 {
+		// A reset also lifts any lockout from failed logins
+		clearLoginFailures(username)
+	}
+	return resp, err
+}
+
+// handleChangePassword lets any user change their own password after
+// confirming the current one.
+func handleChangePassword(token string, request events.APIGatewayProxyRequest, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	username, ok := getUsernameFromToken(token)
+	if !ok {
+		return errorResponse(401, "Invalid token", headers)
+	}
+
+	var req SetPasswordRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return errorResponse(400, "Invalid request body", headers)
+	}
+
+	userItem, err := userStore.GetUser(username)
+	if err != nil {
+		fmt.Printf("Failed to get user %s: %v\n", username, err)
+		return errorResponse(500, "Failed to change password", headers)
+	}
+	if userItem == nil {
+		return errorResponse(404, "User not found", headers)
+	}
+	var passwordHash string
+	if userItem["PasswordHash"] != nil {
+		passwordHash = aws.StringValue(userItem["PasswordHash"].S)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.CurrentPassword)); err != nil {
+		return errorResponse(403, "Current password is incorrect", headers)
+	}
+
+	return setPassword(username, req.Password, false, headers)
+}
+
+func setPassword(username, password string, revokeSessions bool, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return errorResponse(400, err.Error(), headers)
+	}
+
+	updateExpr := "SET PasswordHash = :hash, UpdatedAt = :updated"
+	if revokeSessions {
+		updateExpr += " REMOVE Sessions"
+	}
+	_, err = userStore.UpdateUser(username, ItemUpdate{
+		Expression: updateExpr,
+		Condition:  "attribute_exists(Username)",
+		Values: map[string]*dynamodb.AttributeValue{
+			":hash":    {S: aws.String(hash)},
+			":updated": {S: aws.String(time.Now().Format(time.RFC3339))},
+		},
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "ConditionalCheckFailed") {
+			return errorResponse(404, "User not found", headers)
+		}
+		fmt.Printf("Error setting password for %s: %v\n", username, err)
+		return errorResponse(500, "Failed to set password", headers)
+	}
+
+	body, _ := json.Marshal(map[string]bool{"success": true})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRoleEnforcement(t *testing.T) {
+	tests := []struct {
+		role         string
+		projectRole  string // role on project trip, if any
+		method, path string
+		body         string
+		wantCode     int
+	}{
+		{roleViewer, "", "GET", "/api/images", "", 200},
+		{roleViewer, "", "GET", "/api/projects", "", 200},
+		{roleViewer, "", "PUT", "/api/user/settings", `{"themeColor":"blue","themeStyle":"dark"}`, 200},
+		{roleViewer, "", "PUT", "/api/images/img1", `{"groupNumber":1}`, 403},
+		{roleViewer, "", "DELETE", "/api/images/img1", "", 403},
+		{roleViewer, "", "POST", "/api/projects/trip/images", `{"imageGUID":"img1"}`, 403},
+		{roleViewer, "", "GET", "/api/logs", "", 403},
+		{roleReviewer, "", "PUT", "/api/images/img1", `{"groupNumber":1}`, 200},
+		{roleReviewer, "", "DELETE", "/api/images/img1", "", 200},
+		{roleReviewer, "", "POST", "/api/projects/trip/images", `{"imageGUID":"img1"}`, 403},
+		{roleReviewer, projectEditor, "POST", "/api/projects/trip/images", `{"imageGUID":"img1"}`, 200},
+		{roleViewer, projectEditor, "POST", "/api/projects/trip/images", `{"imageGUID":"img1"}`, 403},
+		{roleReviewer, "", "POST", "/api/projects", `{"name":"new"}`, 403},
+		{roleReviewer, "", "PUT", "/api/projects/trip", `{"name":"renamed"}`, 403},
+		{roleReviewer, "", "DELETE", "/api/projects/trip", "", 403},
+		{roleReviewer, "", "POST", "/api/projects/trip/generate-zip", "", 403},
+		{roleReviewer, "", "DELETE", "/api/projects/trip/zips", "", 403},
+		{roleViewer, "", "GET", "/api/projects/trip/images", "", 403},
+		{roleViewer, projectViewer, "GET", "/api/projects/trip/images", "", 200},
+		{roleViewer, projectViewer, "PUT", "/api/projects/trip", `{"name":"renamed"}`, 403},
+		{roleViewer, projectEditor, "PUT", "/api/projects/trip", `{"name":"renamed"}`, 200},
+		{roleViewer, projectEditor, "DELETE", "/api/projects/trip", "", 403},
+		{roleViewer, projectOwner, "DELETE", "/api/projects/trip", "", 200},
+		{roleReviewer, "", "GET", "/api/users", "", 403},
+		{roleAdmin, "", "POST", "/api/projects", `{"name":"new"}`, 201},
+		{roleAdmin, "", "DELETE", "/api/projects/trip", "", 200},
+		{roleAdmin, "", "GET", "/api/users", "", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role+" "+tt.projectRole+" "+tt.method+" "+tt.path, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.seedUser("someone", tt.role)
+			env.seedImage("img1", nil)
+			env.seedProject("trip", 0)
+			if tt.projectRole != "" {
+				env.addMember("trip", "someone", tt.projectRole)
+			}
+			env.loginAs("someone", testPassword)
+
+			resp := env.call(tt.method, tt.path, tt.body)
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, tt.wantCode, resp.Body)
+			}
+		})
+	}
+
+	t.Run("role comes from the account, not the token", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.seedImage("img1", nil)
+		env.seedUser("someone", roleViewer)
+		env.loginAs("someone", testPassword)
+		claims, _ := parseToken(env.token, tokenTypeAccess)
+		claims["role"] = roleAdmin
+		token, _ := signToken(claims)
+		env.token = token
+		if resp := env.call("GET", "/api/images", ""); resp.StatusCode != 200 {
+			t.Errorf("GET status = %d, want 200", resp.StatusCode)
+		}
+		if resp := env.call("PUT", "/api/images/img1", `{"groupNumber":1}`); resp.StatusCode != 403 {
+			t.Errorf("PUT status = %d, want 403", resp.StatusCode)
+		}
+	})
+}
+
+func TestUserManagement(t *testing.T) {
+	env := newTestEnv(t)
+	env.login()
+	adminToken := env.token
+
+	steps := []struct {
+		name         string
+		method, path string
+		body         string
+		wantCode     int
+	}{
+		{"create reviewer", "POST", "/api/users", `{"username":"ann","password":"password1","role":"reviewer"}`, 201},
+		{"duplicate", "POST", "/api/users", `{"username":"ann","password":"password1","role":"viewer"}`, 409},
+		{"bad role", "POST", "/api/users", `{"username":"bob","password":"password1","role":"owner"}`, 400},
+		{"short password", "POST", "/api/users", `{"username":"bob","password":"short","role":"viewer"}`, 400},
+		{"bad username", "POST", "/api/users", `{"username":"bob smith","password":"password1","role":"viewer"}`, 400},
+		{"promote", "PUT", "/api/users/ann", `{"role":"admin"}`, 200},
+		{"demote", "PUT", "/api/users/ann", `{"role":"reviewer"}`, 200},
+		{"unknown user", "PUT", "/api/users/ghost", `{"disabled":true}`, 404},
+		{"empty update", "PUT", "/api/users/ann", `{}`, 400},
+		{"disable self", "PUT", "/api/users/" + testUser, `{"disabled":true}`, 400},
+		{"demote self", "PUT", "/api/users/" + testUser, `{"role":"viewer"}`, 400},
+		{"reset password", "PUT", "/api/users/ann/password", `{"password":"password2"}`, 200},
+		{"reset unknown", "PUT", "/api/users/ghost/password", `{"password":"password2"}`, 404},
+	}
+	for _, s := range steps {
+		resp := env.call(s.method, s.path, s.body)
+		if resp.StatusCode != s.wantCode {
+			t.Fatalf("%s: status = %d, want %d: %s", s.name, resp.StatusCode, s.wantCode, resp.Body)
+		}
+	}
+
+	resp := env.call("GET", "/api/users", "")
+	if strings.Contains(resp.Body, "PasswordHash") || strings.Contains(resp.Body, "$2a$") {
+		t.Errorf("user list leaks password hashes: %s", resp.Body)
+	}
+	var users []User
+	json.Unmarshal([]byte(resp.Body), &users)
+	if len(users) != 2 || users[0].Username != testUser || users[1].Username != "ann" || users[1].Role != roleReviewer {
+		t.Fatalf("users = %+v", users)
+	}
+
+	// The reset password works and the login reports the role
+	resp = env.call("POST", "/api/login", `{"username":"ann","password":"password2"}`)
+	var lr LoginResponse
+	json.Unmarshal([]byte(resp.Body), &lr)
+	if resp.StatusCode != 200 || lr.Role != roleReviewer || lr.Username != "ann" {
+		t.Fatalf("login as ann: %d %s", resp.StatusCode, resp.Body)
+	}
+
+	// Users change their own password after confirming the current one
+	env.token = lr.Token
+	if resp := env.call("PUT", "/api/user/password", `{"currentPassword":"wrong","password":"password3"}`); resp.StatusCode != 403 {
+		t.Errorf("wrong current password: status = %d, want 403", resp.StatusCode)
+	}
+	if resp := env.call("PUT", "/api/user/password", `{"currentPassword":"password2","password":"password3"}`); resp.StatusCode != 200 {
+		t.Errorf("change password: status = %d: %s", resp.StatusCode, resp.Body)
+	}
+	if resp := env.call("PUT", "/api/users/ann/password", `{"password":"password4"}`); resp.StatusCode != 403 {
+		t.Errorf("reviewer reset password: status = %d, want 403", resp.StatusCode)
+	}
+
+	// Changing the role signs the user out; setting the same one doesn't
+	env.token = adminToken
+	env.call("PUT", "/api/users/ann", `{"role":"reviewer"}`)
+	env.token = lr.Token
+	if resp := env.call("GET", "/api/images", ""); resp.StatusCode != 200 {
+		t.Errorf("same role: status = %d, want 200", resp.StatusCode)
+	}
+	env.token = adminToken
+	env.call("PUT", "/api/users/ann", `{"role":"viewer"}`)
+	env.token = lr.Token
+	if resp := env.call("GET", "/api/images", ""); resp.StatusCode != 401 {
+		t.Errorf("after role change: status = %d, want 401", resp.StatusCode)
+	}
+
+	// Disabled users cannot log in until re-enabled
+	env.token = adminToken
+	env.call("PUT", "/api/users/ann", `{"disabled":true}`)
+	if resp := env.call("POST", "/api/login", `{"username":"ann","password":"password3"}`); resp.StatusCode != 403 {
+		t.Errorf("disabled login: status = %d, want 403", resp.StatusCode)
+	}
+	env.call("PUT", "/api/users/ann", `{"disabled":false}`)
+	env.loginAs("ann", "password3")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Image and project records carry a Version that goes up by one with every
+// change to them. Writers that read a record and then change it make the write
+// conditional on the version they read, so a change that lands in between
+// fails the write instead of being overwritten. A record written before
+// versions existed has no Version attribute and counts as version 0.
+//
+// Clients see the version as the record's ETag and may send it back in
+// If-Match; a stale If-Match or a lost race gets a 409 with the record as it
+// is now. Async move progress (MoveStatus) and project counters and zips are
+// bookkeeping rather than edits, so they leave the version alone.
+
+// versionRetries is how many times a server-side read-modify-write is redone
+// against a fresh read before giving up on a conflict.
+const versionRetries = 3
+
+// errVersionConflict is returned when a versioned write keeps losing races.
+var errVersionConflict = fmt.Errorf("version conflict")
+
+// addSetAction adds action to the SET clause of expr, starting one if there is
+// none.
+func addSetAction(expr, action string) string {
+	if i := strings.Index(expr, "SET "); i >= 0 {
+		return expr[:i+4] + action + ", " + expr[i+4:]
+	}
+	return "SET " + action + " " + expr
+}
+
+// withValues returns a copy of values with extra added.
+func withValues(values Item, extra Item) Item {
+	out := make(Item, len(values)+len(extra))
+	for k, v := range values {
+		out[k] = v
+	}
+	for k, v := range extra {
+		out[k] = v
+	}
+	return out
+}
+
+// versioned makes u a change to the record at version: it succeeds only if
+// the record is still at that version, and moves it to the next one.
+func versioned(u ItemUpdate, version int) ItemUpdate {
+	u.Expression = addSetAction(u.Expression, "Version = :nextVersion")
+	u.Values = withValues(u.Values, Item{
+		":version":     {N: aws.String(strconv.Itoa(version))},
+		":nextVersion": {N: aws.String(strconv.Itoa(version + 1))},
+	})
+	cond := "Version = :version"
+	if version == 0 {
+		cond = "(attribute_not_exists(Version) OR Version = :version)"
+	}
+	if u.Condition != "" {
+		cond = "(" + u.Condition + ") AND " + cond
+	}
+	u.Condition = cond
+	return u
+}
+
+// bumpVersion makes u move the record to its next version whatever version
+// it is at, for writes whose own condition already guards the change.
+func bumpVersion(u ItemUpdate) ItemUpdate {
+	u.Expression = addSetAction(u.Expression, "Version = if_not_exists(Version, :noVersion) + :versionStep")
+	u.Values = withValues(u.Values, Item{
+		":noVersion":   {N: aws.String("0")},
+		":versionStep": {N: aws.String("1")},
+	})
+	return u
+}
+
+// isConditionFailed reports whether err is a failed condition expression.
+func isConditionFailed(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "ConditionalCheckFailed")
+}
+
+// formatETag returns the strong ETag for a record version.
+func formatETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// ifMatchVersion returns the version the request's If-Match header names.
+// ok is false when there is no header or it is "*", which matches any version.
+func ifMatchVersion(request events.APIGatewayProxyRequest) (version int, ok bool, err error) {
+	value := request.Headers["If-Match"]
+	if value == "" {
+		value = request.Headers["if-match"]
+	}
+	value = strings.TrimSpace(value)
+	if value == "" || value == "*" {
+		return 0, false, nil
+	}
+	value = strings.Trim(strings.TrimPrefix(value, "W/"), `"`)
+	version, err = strconv.Atoi(value)
+	if err != nil || version < 0 {
+		return 0, false, fmt.Errorf("invalid If-Match header")
+	}
+	return version, true, nil
+}
+
+// withETag returns a copy of headers carrying the ETag for version.
+func withETag(headers map[string]string, version int) map[string]string {
+	tagged := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		tagged[k] = v
+	}
+	tagged["ETag"] = formatETag(version)
+	return tagged
+}
+
+// versionConflictResponse is the 409 for a stale If-Match or a lost race. It
+// carries the record as it is now so the client can redo its change on top.
+func versionConflictResponse(message string, current interface{}, version int, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	body, _ := json.Marshal(map[string]interface{}{"error": message, "current": current})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 409,
+		Headers:    withETag(headers, version),
+		Body:       string(body),
+	}, nil
+}
+
+// imageConflictResponse re-reads the image and returns it in a 409.
+func imageConflictResponse(imageID string, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	item, err := withRetry(func() (Item, error) {
+		return imageStore.GetImage(imageID)
+	})
+	if err != nil || item == nil {
+		return errorResponse(409, "Image was changed by another request", headers)
+	}
+	var current ImageResponse
+	dynamodbattribute.UnmarshalMap(item, &current)
+	return versionConflictResponse("Image was changed by another request", current, current.Version, headers)
+}
+
+// updateImageVersioned applies the change build makes to img, conditional on
+// img's version. When another write gets there first it re-reads the image
+// and has build redo the change against the current record. build returns
+// false to leave the image as it is, in which case the returned item is nil.
+func updateImageVersioned(img ImageResponse, build func(cur ImageResponse) (ItemUpdate, bool)) (Item, error) {
+	for attempt := 0; ; attempt++ {
+		u, ok := build(img)
+		if !ok {
+			return nil, nil
+		}
+		u = versioned(u, img.Version)
+		u.ReturnValues = dynamodb.ReturnValueAllNew
+		item, err := withRetry(func() (Item, error) {
+			return imageStore.UpdateImage(img.ImageGUID, u)
+		})
+		if !isConditionFailed(err) {
+			return item, err
+		}
+		if attempt+1 >= versionRetries {
+			return nil, errVersionConflict
+		}
+		current, err := withRetry(func() (Item, error) {
+			return imageStore.GetImage(img.ImageGUID)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			return nil, nil
+		}
+		img = ImageResponse{}
+		dynamodbattribute.UnmarshalMap(current, &img)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// raceOnUpdate runs race just before the first image update whose expression
+// contains match, like another request landing between a read and a write.
+type raceOnUpdate struct {
+	ImageStore
+	match string
+	race  func()
+}
+
+func (s *raceOnUpdate) UpdateImage(id string, u ItemUpdate) (Item, error) {
+	s.raceBefore(u)
+	return s.ImageStore.UpdateImage(id, u)
+}
+
+func (s *raceOnUpdate) UpdateImageAndProject(image, project KeyedUpdate) error {
+	s.raceBefore(image.ItemUpdate)
+	return s.ImageStore.UpdateImageAndProject(image, project)
+}
+
+// raceBefore runs the race, once, before an update matching match.
+func (s *raceOnUpdate) raceBefore(u ItemUpdate) {
+	if s.race != nil && strings.Contains(u.Expression, s.match) {
+		race := s.race
+		s.race = nil
+		race()
+	}
+}
+
+// raceImage sets up store to change the image's rating as the handler is
+// about to make the update matching match.
+func (env *testEnv) raceImage(id, match string, rating int) {
+	inner := imageStore
+	imageStore = &raceOnUpdate{ImageStore: inner, match: match, race: func() {
+		if _, err := inner.UpdateImage(id, bumpVersion(ItemUpdate{
+			Expression: "SET Rating = :r",
+			Values:     map[string]*dynamodb.AttributeValue{":r": {N: aws.String(fmt.Sprint(rating))}},
+		})); err != nil {
+			env.t.Fatal(err)
+		}
+	}}
+}
+
+func conflictBody(t *testing.T, body string) map[string]interface{} {
+	t.Helper()
+	var out struct {
+		Current map[string]interface{} `json:"current"`
+	}
+	if err := json.Unmarshal([]byte(body), &out); err != nil || out.Current == nil {
+		t.Fatalf("conflict body = %s", body)
+	}
+	return out.Current
+}
+
+func TestImageIfMatch(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedImage("img1", nil)
+	env.login()
+
+	if resp := env.call("GET", "/api/images/img1", ""); resp.Headers["ETag"] != `"0"` {
+		t.Fatalf("ETag = %q", resp.Headers["ETag"])
+	}
+	resp := env.callWithHeaders("PUT", "/api/images/img1", `{"rating":3}`, map[string]string{"If-Match": `"0"`})
+	if resp.StatusCode != 200 || resp.Headers["ETag"] != `"1"` {
+		t.Fatalf("update: %d %s %v", resp.StatusCode, resp.Body, resp.Headers)
+	}
+
+	// A stale version is refused with the image as it is now
+	resp = env.callWithHeaders("PUT", "/api/images/img1", `{"rating":5}`, map[string]string{"If-Match": `"0"`})
+	if resp.StatusCode != 409 || resp.Headers["ETag"] != `"1"` {
+		t.Fatalf("stale update: %d %s", resp.StatusCode, resp.Body)
+	}
+	if current := conflictBody(t, resp.Body); current["rating"] != float64(3) || current["version"] != float64(1) {
+		t.Errorf("current = %v", current)
+	}
+
+	for _, value := range []string{"*", `W/"2"`, ""} {
+		if resp := env.callWithHeaders("PUT", "/api/images/img1", `{"rating":4}`, map[string]string{"If-Match": value}); resp.StatusCode != 200 {
+			t.Errorf("If-Match %q: status = %d", value, resp.StatusCode)
+		}
+	}
+	if resp := env.callWithHeaders("PUT", "/api/images/img1", `{"rating":4}`, map[string]string{"If-Match": "abc"}); resp.StatusCode != 400 {
+		t.Errorf("bad If-Match: status = %d, want 400", resp.StatusCode)
+	}
+	if img := env.image("img1"); img.Version != 4 || img.Rating != 4 {
+		t.Errorf("image = %+v", img)
+	}
+}
+
+func TestUpdateImageLosesRace(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedImage("img1", nil)
+	env.login()
+	env.raceImage("img1", "GroupNumber", 5)
+
+	resp := env.call("PUT", "/api/images/img1", `{"groupNumber":2,"reviewed":"true"}`)
+	if resp.StatusCode != 409 {
+		t.Fatalf("status = %d, want 409", resp.StatusCode)
+	}
+	if current := conflictBody(t, resp.Body); current["rating"] != float64(5) {
+		t.Errorf("current = %v", current)
+	}
+	if img := env.image("img1"); img.Reviewed != "false" || img.Rating != 5 || env.runAsyncMoves() != 0 {
+		t.Errorf("losing update was written: %+v", img)
+	}
+}
+
+func TestAsyncMoveKeepsConcurrentChanges(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedImage("img1", nil)
+	env.login()
+	env.call("PUT", "/api/images/img1", `{"groupNumber":1,"reviewed":"true"}`)
+
+	// A rating lands while the files are being moved
+	env.raceImage("img1", "OriginalFile", 4)
+	env.runAsyncMoves()
+
+	img := env.image("img1")
+	if img.Status != "approved" || img.Rating != 4 || img.MoveStatus != "complete" || img.Version != 3 {
+		t.Errorf("image = %+v", img)
+	}
+	env.assertFilesUnder("img1", "approved/red/"+testDatePath)
+}
+
+func TestAddToProjectKeepsConcurrentChanges(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedProject("p1", 0)
+	env.seedImage("img1", map[string]interface{}{"Status": "approved", "Reviewed": "true", "GroupNumber": 1})
+	env.login()
+
+	stale := map[string]string{"If-Match": `"7"`}
+	if resp := env.callWithHeaders("POST", "/api/projects/p1/images", `{"imageGUID":"img1"}`, stale); resp.StatusCode != 409 {
+		t.Fatalf("stale add: status = %d, want 409", resp.StatusCode)
+	}
+
+	env.raceImage("img1", "ProjectID", 2)
+	resp := env.call("POST", "/api/projects/p1/images", `{"imageGUID":"img1"}`)
+	if resp.StatusCode != 200 || !strings.Contains(resp.Body, `"movedCount":1`) {
+		t.Fatalf("add: %d %s", resp.StatusCode, resp.Body)
+	}
+	img := env.image("img1")
+	if img.Status != "project" || img.ProjectID != "p1" || img.Rating != 2 || img.Version != 2 {
+		t.Errorf("image = %+v", img)
+	}
+	if p := env.project("p1"); p.ImageCount != 1 {
+		t.Errorf("image count = %d", p.ImageCount)
+	}
+}
+
+func TestProjectIfMatch(t *testing.T) {
+	env := newTestEnv(t)
+	env.seedProject("p1", 0)
+	env.login()
+
+	resp := env.callWithHeaders("PUT", "/api/projects/p1", `{"name":"Renamed"}`, map[string]string{"If-Match": `"0"`})
+	if resp.StatusCode != 200 || resp.Headers["ETag"] != `"1"` {
+		t.Fatalf("update: %d %s", resp.StatusCode, resp.Body)
+	}
+	resp = env.callWithHeaders("PUT", "/api/projects/p1", `{"name":"Again"}`, map[string]string{"If-Match": `"0"`})
+	if resp.StatusCode != 409 {
+		t.Fatalf("stale update: status = %d, want 409", resp.StatusCode)
+	}
+	if current := conflictBody(t, resp.Body); current["name"] != "Renamed" {
+		t.Errorf("current = %v", current)
+	}
+
+	// Member changes move the version on too
+	env.seedUser("ann", roleReviewer)
+	env.call("PUT", "/api/projects/p1/members/ann", `{"role":"viewer"}`)
+	if p := env.project("p1"); p.Version != 2 || p.Name != "Renamed" {
+		t.Errorf("project = %+v", p)
+	}
+}
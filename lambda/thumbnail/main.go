@@ -47,6 +47,8 @@ type ImageMetadata struct {
 	Status           string            `json:"Status"`
 	Keywords         []string          `json:"Keywords,omitempty"`
 	Description      string            `json:"Description,omitempty"`
+	CaptureDate      string            `json:"CaptureDate,omitempty"` // When the photo was taken, "2006-01-02T15:04:05" camera local time
+	CaptureYear      string            `json:"CaptureYear,omitempty"` // CaptureDateIndex partition key
 	InsertedDateTime string            `json:"InsertedDateTime"`
 	UpdatedDateTime  string            `json:"UpdatedDateTime"`
 }
@@ -593,7 +595,9 @@ func processJpgFile(bucket, key string) error {
 	}
 
 	// Create metadata record
-	now := time.Now().Format(time.RFC3339)
+	uploaded := time.Now()
+	now := uploaded.Format(time.RFC3339)
+	captureDate, captureYear := captureDateFields(exifData, uploaded)
 	metadata := ImageMetadata{
 		ImageGUID:        imageGUID,
 		OriginalFile:     newJpgKey,
@@ -608,6 +612,8 @@ func processJpgFile(bucket, key string) error {
 		FileSize:         fileSize,
 		Reviewed:         "false",
 		Status:           "inbox",
+		CaptureDate:      captureDate,
+		CaptureYear:      captureYear,
 		InsertedDateTime: now,
 		UpdatedDateTime:  now,
 	}
@@ -806,7 +812,9 @@ func processRawWithExtractedJPEG(bucket, rawKey, originalFilename, rawExt string
 	}
 
 	// Create metadata record
-	now := time.Now().Format(time.RFC3339)
+	uploaded := time.Now()
+	now := uploaded.Format(time.RFC3339)
+	captureDate, captureYear := captureDateFields(exifData, uploaded)
 	metadata := ImageMetadata{
 		ImageGUID:        imageGUID,
 		OriginalFile:     newJpgKey,
@@ -821,6 +829,8 @@ func processRawWithExtractedJPEG(bucket, rawKey, originalFilename, rawExt string
 		Height:           height,
 		FileSize:         int64(len(rawData)), // Use RAW file size as the "original" size
 		Reviewed:         "",
+		CaptureDate:      captureDate,
+		CaptureYear:      captureYear,
 		InsertedDateTime: now,
 		UpdatedDateTime:  now,
 	}
@@ -939,6 +949,21 @@ func extractEXIF(body *bytes.Reader) map[string]string {
 	return exifData
 }
 
+// captureDateFields returns the CaptureDate and CaptureYear attributes: when
+// the photo was taken according to its EXIF data, or when it was uploaded if
+// the camera didn't record it. Keep in step with captureTime in the API.
+func captureDateFields(exifData map[string]string, uploaded time.Time) (string, string) {
+	taken := uploaded
+	for _, field := range []string{"DateTimeOriginal", "DateTime"} {
+		// goexif quotes string tags
+		if t, err := time.Parse("2006:01:02 15:04:05", strings.Trim(exifData[field], `"`)); err == nil {
+			taken = t
+			break
+		}
+	}
+	return taken.Format("2006-01-02T15:04:05"), taken.Format("2006")
+}
+
 func findRelatedFiles(bucket, baseName string) ([]string, error) {
 	var relatedFiles []string
 
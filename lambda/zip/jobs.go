@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Zips are started by the API as jobs in the jobs table (see jobs.go in the
+// API). This function claims the job, reports progress on it as zips are
+// made, stops between zips when it is canceled and records how it ended.
+// Requests without a job ID, from before jobs, run untracked.
+
+const maxJobErrors = 100
+
+var errJobCanceled = errors.New("job canceled")
+
+// zipJob reports on the job a zip runs as. Its methods do nothing when there
+// is no job.
+type zipJob struct {
+	id string
+}
+
+func (j zipJob) update(expression, condition string, values map[string]*dynamodb.AttributeValue) error {
+	if j.id == "" {
+		return nil
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	values[":updated"] = &dynamodb.AttributeValue{S: aws.String(now)}
+	input := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(jobsTable),
+		Key:                       map[string]*dynamodb.AttributeValue{"JobID": {S: aws.String(j.id)}},
+		UpdateExpression:          aws.String(stampUpdated(expression)),
+		ExpressionAttributeNames:  map[string]*string{"#status": aws.String("Status")},
+		ExpressionAttributeValues: values,
+	}
+	if condition != "" {
+		input.ConditionExpression = aws.String(condition)
+	}
+	if !strings.Contains(expression+condition, "#status") {
+		input.ExpressionAttributeNames = nil
+	}
+	_, err := ddbClient.UpdateItem(input)
+	return err
+}
+
+// isConditionFailed reports whether err is a failed condition expression.
+func isConditionFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// stampUpdated adds UpdatedAt = :updated to the SET clause of expression.
+func stampUpdated(expression string) string {
+	if rest, ok := strings.CutPrefix(expression, "SET "); ok {
+		return "SET UpdatedAt = :updated, " + rest
+	}
+	return "SET UpdatedAt = :updated " + expression
+}
+
+// claim moves the job from queued to running. It reports false when the job
+// isn't queued, e.g. it was canceled before it started or this is a retried
+// invocation of a job that already ran.
+func (j zipJob) claim() (bool, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	err := j.update("SET #status = :running, StartedAt = :now ADD Attempts :one", "#status = :queued", map[string]*dynamodb.AttributeValue{
+		":running": {S: aws.String("running")},
+		":queued":  {S: aws.String("queued")},
+		":now":     {S: aws.String(now)},
+		":one":     {N: aws.String("1")},
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (j zipJob) setTotal(n int) {
+	if err := j.update("SET Total = :n", "", map[string]*dynamodb.AttributeValue{":n": {N: aws.String(fmt.Sprint(n))}}); err != nil {
+		fmt.Printf("Error updating job %s: %v\n", j.id, err)
+	}
+}
+
+// progress counts images zipped and images that failed.
+func (j zipJob) progress(done, failed int) {
+	err := j.update("ADD Done :done, Failed :failed", "", map[string]*dynamodb.AttributeValue{
+		":done":   {N: aws.String(fmt.Sprint(done))},
+		":failed": {N: aws.String(fmt.Sprint(failed))},
+	})
+	if err != nil {
+		fmt.Printf("Error updating job %s: %v\n", j.id, err)
+	}
+}
+
+// zipFailed records why a zip of count images failed.
+func (j zipJob) zipFailed(zipKey string, count int, zipErr error) {
+	entry, _ := dynamodbattribute.MarshalMap(map[string]string{
+		"Item":  zipKey,
+		"Error": zipErr.Error(),
+		"At":    time.Now().UTC().Format(time.RFC3339),
+	})
+	err := j.update("SET Errors = list_append(if_not_exists(Errors, :none), :error)", "attribute_not_exists(Errors) OR size(Errors) < :max", map[string]*dynamodb.AttributeValue{
+		":none":  {L: []*dynamodb.AttributeValue{}},
+		":error": {L: []*dynamodb.AttributeValue{{M: entry}}},
+		":max":   {N: aws.String(fmt.Sprint(maxJobErrors))},
+	})
+	if err != nil && !isConditionFailed(err) {
+		fmt.Printf("Error updating job %s: %v\n", j.id, err)
+	}
+	j.progress(0, count)
+}
+
+// canceled reports whether cancellation has been requested.
+func (j zipJob) canceled() bool {
+	if j.id == "" {
+		return false
+	}
+	result, err := ddbClient.GetItem(&dynamodb.GetItemInput{
+		TableName:            aws.String(jobsTable),
+		Key:                  map[string]*dynamodb.AttributeValue{"JobID": {S: aws.String(j.id)}},
+		ProjectionExpression: aws.String("CancelRequested"),
+	})
+	if err != nil || result.Item == nil {
+		return false
+	}
+	v := result.Item["CancelRequested"]
+	return v != nil && aws.BoolValue(v.BOOL)
+}
+
+// finish records how the job ended: succeeded without an error, canceled
+// with errJobCanceled and otherwise failed.
+func (j zipJob) finish(runErr error) {
+	status := "succeeded"
+	values := map[string]*dynamodb.AttributeValue{}
+	expression := "SET #status = :status, FinishedAt = :now"
+	if errors.Is(runErr, errJobCanceled) {
+		status = "canceled"
+	} else if runErr != nil {
+		status = "failed"
+		expression += ", Message = :message"
+		values[":message"] = &dynamodb.AttributeValue{S: aws.String(runErr.Error())}
+	}
+	values[":status"] = &dynamodb.AttributeValue{S: aws.String(status)}
+	values[":now"] = &dynamodb.AttributeValue{S: aws.String(time.Now().UTC().Format(time.RFC3339))}
+	if err := j.update(expression, "", values); err != nil {
+		fmt.Printf("Error finishing job %s: %v\n", j.id, err)
+	}
+}
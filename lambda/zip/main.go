@@ -4,6 +4,7 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -30,6 +31,7 @@ var (
 	bucketName   string
 	imageTable   string
 	projectTable string
+	jobsTable    string
 	s3Client     *s3.S3
 	s3Uploader   *s3manager.Uploader
 	ddbClient    *dynamodb.DynamoDB
@@ -38,6 +40,7 @@ var (
 // ZipRequest is the event payload for triggering zip generation
 type ZipRequest struct {
 	ProjectID string `json:"projectId"`
+	JobID     string `json:"jobId,omitempty"`
 }
 
 // Project represents a project record in DynamoDB
@@ -78,6 +81,7 @@ func init() {
 	bucketName = os.Getenv("BUCKET_NAME")
 	imageTable = os.Getenv("IMAGE_TABLE")
 	projectTable = os.Getenv("PROJECT_TABLE")
+	jobsTable = os.Getenv("JOBS_TABLE")
 
 	sess := session.Must(session.NewSession())
 	s3Client = s3.New(sess)
@@ -93,8 +97,27 @@ func getProjectS3Prefix(project Project) string {
 }
 
 func handleRequest(ctx context.Context, request ZipRequest) error {
+	job := zipJob{id: request.JobID}
+	claimed, err := job.claim()
+	if err != nil {
+		return fmt.Errorf("failed to claim job %s: %v", request.JobID, err)
+	}
+	if !claimed {
+		fmt.Printf("Job %s is not queued, not running it\n", request.JobID)
+		return nil
+	}
+	err = generateZips(ctx, request, job)
+	job.finish(err)
+	if errors.Is(err, errJobCanceled) {
+		return nil
+	}
+	return err
+}
+
+func generateZips(ctx context.Context, request ZipRequest, job zipJob) error {
 	fmt.Printf("=== ZIP GENERATION STARTED ===\n")
 	fmt.Printf("Project ID: %s\n", request.ProjectID)
+	fmt.Printf("Job ID: %s\n", request.JobID)
 	fmt.Printf("Bucket: %s\n", bucketName)
 	fmt.Printf("Image Table: %s\n", imageTable)
 	fmt.Printf("Project Table: %s\n", projectTable)
@@ -137,6 +160,7 @@ func handleRequest(ctx context.Context, request ZipRequest) error {
 	}
 
 	fmt.Printf("Found %d images to zip\n", len(images))
+	job.setTotal(len(images))
 	for i, img := range images {
 		fmt.Printf("  [%d] ImageGUID=%s, File=%s, Size=%d bytes\n", i+1, img.ImageGUID, img.OriginalFile, img.FileSize)
 	}
@@ -158,6 +182,15 @@ func handleRequest(ctx context.Context, request ZipRequest) error {
 	var zipFiles []ZipFile
 
 	for i, batch := range batches {
+		// Stop between zips when canceled, keeping those already made
+		if job.canceled() {
+			fmt.Printf("Job canceled after %d of %d zip(s)\n", len(zipFiles), len(batches))
+			if err := updateProjectZipFiles(request.ProjectID, zipFiles); err != nil {
+				return fmt.Errorf("failed to update project zip files: %v", err)
+			}
+			return errJobCanceled
+		}
+
 		var zipKey string
 		// Store zips in root of project folder (projects/{s3Prefix}/)
 		if len(batches) == 1 {
@@ -179,10 +212,12 @@ func handleRequest(ctx context.Context, request ZipRequest) error {
 				CreatedAt:   time.Now().Format(time.RFC3339),
 				Status:      "failed",
 			})
+			job.zipFailed(zipKey, len(batch), err)
 			continue
 		}
 
 		zipFiles = append(zipFiles, *zipInfo)
+		job.progress(zipInfo.ImageCount, zipInfo.FailedCount)
 		fmt.Printf("Created zip: %s (%d bytes, %d images)\n", zipKey, zipInfo.Size, zipInfo.ImageCount)
 	}
 
@@ -0,0 +1,245 @@
+// backfill_capture_date.go - Script to backfill CaptureDate for existing DynamoDB records
+//
+// This migration script sets CaptureDate and CaptureYear on all ImageMetadata
+// records that don't have them, so they appear in the CaptureDateIndex GSI used
+// by GET /api/timeline and date-range listing. The capture date is worked out
+// the same way the thumbnail lambda does at ingest: EXIF DateTimeOriginal, then
+// EXIF DateTime, then InsertedDateTime.
+//
+// It lives in its own directory so it builds apart from the other scripts,
+// whose names it shares. From scripts/:
+//
+// Usage:
+//   go run ./backfill_capture_date                    # Dry run - show what would be updated
+//   go run ./backfill_capture_date -apply             # Apply the updates
+//   go run ./backfill_capture_date -apply -verbose    # Apply with detailed output
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Default configuration
+const (
+	defaultTable  = "kill-snap-ImageMetadata"
+	defaultRegion = "us-east-2"
+)
+
+var (
+	tableName string
+	awsRegion string
+)
+
+func init() {
+	tableName = getEnvOrDefault("IMAGE_TABLE", defaultTable)
+	awsRegion = getEnvOrDefault("AWS_REGION", defaultRegion)
+}
+
+func getEnvOrDefault(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// ImageRecord represents a DynamoDB image metadata record
+type ImageRecord struct {
+	ImageGUID        string            `json:"ImageGUID" dynamodbav:"ImageGUID"`
+	EXIFData         map[string]string `json:"EXIFData,omitempty" dynamodbav:"EXIFData,omitempty"`
+	InsertedDateTime string            `json:"InsertedDateTime,omitempty" dynamodbav:"InsertedDateTime,omitempty"`
+	CaptureDate      string            `json:"CaptureDate,omitempty" dynamodbav:"CaptureDate,omitempty"`
+}
+
+// Stats tracks migration statistics
+type Stats struct {
+	TotalRecords     int
+	AlreadyHasDate   int
+	NeedsUpdate      int
+	FromDateOriginal int
+	FromDateTime     int
+	FromInserted     int
+	NoDate           int
+	ChangedMeanwhile int
+	Errors           int
+}
+
+func main() {
+	apply := flag.Bool("apply", false, "Apply the updates (default is dry-run)")
+	verbose := flag.Bool("verbose", false, "Show detailed output for each record")
+	flag.Parse()
+
+	fmt.Printf("Table: %s\n", tableName)
+	fmt.Printf("Region: %s\n", awsRegion)
+	fmt.Printf("Mode: %s\n", map[bool]string{true: "APPLY", false: "DRY-RUN"}[*apply])
+	fmt.Println()
+
+	// Create AWS session
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(awsRegion),
+	}))
+	ddbClient := dynamodb.New(sess)
+
+	stats := Stats{}
+
+	// Scan all records, reading only what the capture date comes from
+	fmt.Println("Scanning all records...")
+	var lastEvaluatedKey map[string]*dynamodb.AttributeValue
+	pageNum := 0
+
+	for {
+		pageNum++
+		input := &dynamodb.ScanInput{
+			TableName:            aws.String(tableName),
+			ProjectionExpression: aws.String("ImageGUID, EXIFData, InsertedDateTime, CaptureDate"),
+		}
+		if lastEvaluatedKey != nil {
+			input.ExclusiveStartKey = lastEvaluatedKey
+		}
+
+		result, err := ddbClient.Scan(input)
+		if err != nil {
+			fmt.Printf("Error scanning table: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("  Processing page %d (%d records)...\n", pageNum, len(result.Items))
+
+		for _, item := range result.Items {
+			var record ImageRecord
+			if err := dynamodbattribute.UnmarshalMap(item, &record); err != nil {
+				fmt.Printf("    Error unmarshalling record: %v\n", err)
+				stats.Errors++
+				continue
+			}
+
+			stats.TotalRecords++
+
+			// Skip records that already have a CaptureDate
+			if record.CaptureDate != "" {
+				stats.AlreadyHasDate++
+				if *verbose {
+					fmt.Printf("    [SKIP] %s already has CaptureDate=%s\n", record.ImageGUID, record.CaptureDate)
+				}
+				continue
+			}
+
+			taken, source := captureTime(record)
+			if source == "" {
+				stats.NoDate++
+				fmt.Printf("    [NO DATE] %s has no EXIF date or InsertedDateTime\n", record.ImageGUID)
+				continue
+			}
+			captureDate, captureYear := taken.Format("2006-01-02T15:04:05"), taken.Format("2006")
+			stats.NeedsUpdate++
+
+			if *verbose {
+				fmt.Printf("    [UPDATE] %s: CaptureDate=%s (from %s)\n", record.ImageGUID, captureDate, source)
+			}
+
+			// Apply the update if not dry-run
+			if *apply {
+				err := updateCaptureDate(ddbClient, record.ImageGUID, captureDate, captureYear)
+				if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+					// Deleted, or given a CaptureDate since the scan read it
+					stats.ChangedMeanwhile++
+					continue
+				}
+				if err != nil {
+					fmt.Printf("    Error updating %s: %v\n", record.ImageGUID, err)
+					stats.Errors++
+					continue
+				}
+			}
+
+			// Track by source
+			switch source {
+			case "DateTimeOriginal":
+				stats.FromDateOriginal++
+			case "DateTime":
+				stats.FromDateTime++
+			case "InsertedDateTime":
+				stats.FromInserted++
+			}
+		}
+
+		// Check if there are more pages
+		lastEvaluatedKey = result.LastEvaluatedKey
+		if lastEvaluatedKey == nil {
+			break
+		}
+	}
+
+	// Print summary
+	fmt.Println()
+	fmt.Println("=== Summary ===")
+	fmt.Printf("Total records scanned:      %d\n", stats.TotalRecords)
+	fmt.Printf("Already has CaptureDate:    %d\n", stats.AlreadyHasDate)
+	fmt.Printf("Needs CaptureDate:          %d\n", stats.NeedsUpdate)
+	fmt.Printf("No date to use:             %d\n", stats.NoDate)
+	fmt.Println()
+	fmt.Println("CaptureDate taken from:")
+	fmt.Printf("  EXIF DateTimeOriginal:    %d\n", stats.FromDateOriginal)
+	fmt.Printf("  EXIF DateTime:            %d\n", stats.FromDateTime)
+	fmt.Printf("  InsertedDateTime:         %d\n", stats.FromInserted)
+	if stats.ChangedMeanwhile > 0 {
+		fmt.Printf("Changed during the run:     %d\n", stats.ChangedMeanwhile)
+	}
+	if stats.Errors > 0 {
+		fmt.Printf("Errors:                     %d\n", stats.Errors)
+	}
+	fmt.Println()
+
+	if !*apply && stats.NeedsUpdate > 0 {
+		fmt.Println("This was a DRY RUN. To apply these updates, run:")
+		fmt.Println("  go run ./backfill_capture_date -apply")
+		fmt.Println()
+	}
+
+	if *apply && stats.NeedsUpdate > 0 {
+		fmt.Printf("Successfully updated %d records.\n", stats.NeedsUpdate-stats.ChangedMeanwhile-stats.Errors)
+	}
+}
+
+// captureTime finds when a photo was taken, and which attribute said so. It
+// must agree with captureTime in lambda/api/timeline.go.
+func captureTime(record ImageRecord) (time.Time, string) {
+	for _, field := range []string{"DateTimeOriginal", "DateTime"} {
+		// EXIF strings are sometimes stored quoted
+		if t, err := time.Parse("2006:01:02 15:04:05", strings.Trim(record.EXIFData[field], `"`)); err == nil {
+			return t, field
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, record.InsertedDateTime); err == nil {
+		return t, "InsertedDateTime"
+	}
+	return time.Time{}, ""
+}
+
+// updateCaptureDate sets CaptureDate and CaptureYear on a record that still
+// exists and still doesn't have them
+func updateCaptureDate(ddbClient *dynamodb.DynamoDB, imageGUID, captureDate, captureYear string) error {
+	_, err := ddbClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"ImageGUID": {S: aws.String(imageGUID)},
+		},
+		UpdateExpression:    aws.String("SET CaptureDate = :date, CaptureYear = :year"),
+		ConditionExpression: aws.String("attribute_exists(ImageGUID) AND attribute_not_exists(CaptureDate)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":date": {S: aws.String(captureDate)},
+			":year": {S: aws.String(captureYear)},
+		},
+	})
+	return err
+}
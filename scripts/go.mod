@@ -4,11 +4,11 @@ go 1.21
 
 require (
 	github.com/aws/aws-sdk-go v1.55.5
+	github.com/disintegration/imaging v1.6.2
 	github.com/google/uuid v1.6.0
 )
 
 require (
-	github.com/disintegration/imaging v1.6.2 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8 // indirect
 )
@@ -709,20 +709,22 @@ export const ImageGallery: React.FC<ImageGalleryProps> = ({ onLogout }) => {
       handlePropertyChange(img.imageGUID, { groupNumber, colorCode: colorName });
     });
 
-    const results = await Promise.allSettled(
-      imagesToProcess.map(image =>
-        api.updateImage(image.imageGUID, {
-          groupNumber,
-          colorCode: colorName,
-          promoted: false,
-          reviewed: 'true',
-        })
-      )
-    );
+    let failures: number;
+    try {
+      const result = await api.batchUpdateImages(imageIds, {
+        groupNumber,
+        colorCode: colorName,
+        promoted: false,
+        reviewed: 'true',
+      });
+      failures = result.failed;
+    } catch (err) {
+      console.error('Bulk approve failed:', err);
+      failures = imagesToProcess.length;
+    }
 
-    const failures = results.filter(r => r.status === 'rejected');
-    if (failures.length > 0) {
-      showNotification(`${failures.length} of ${imagesToProcess.length} images failed to approve`, 'error');
+    if (failures > 0) {
+      showNotification(`${failures} of ${imagesToProcess.length} images failed to approve`, 'error');
       loadImages();
     } else {
       showNotification(`${imagesToProcess.length} images approved`, 'success');
@@ -779,19 +781,21 @@ export const ImageGallery: React.FC<ImageGalleryProps> = ({ onLogout }) => {
       return next;
     });
 
-    const results = await Promise.allSettled(
-      imagesToProcess.map(image =>
-        api.updateImage(image.imageGUID, {
-          groupNumber: 0,
-          colorCode: 'white',
-          reviewed: 'true',
-        })
-      )
-    );
+    let failures: number;
+    try {
+      const result = await api.batchUpdateImages(imageIds, {
+        groupNumber: 0,
+        colorCode: 'white',
+        reviewed: 'true',
+      });
+      failures = result.failed;
+    } catch (err) {
+      console.error('Bulk reject failed:', err);
+      failures = imagesToProcess.length;
+    }
 
-    const failures = results.filter(r => r.status === 'rejected');
-    if (failures.length > 0) {
-      showNotification(`${failures.length} of ${imagesToProcess.length} images failed to reject`, 'error');
+    if (failures > 0) {
+      showNotification(`${failures} of ${imagesToProcess.length} images failed to reject`, 'error');
     } else {
       showNotification(`${imagesToProcess.length} images rejected`, 'success');
     }
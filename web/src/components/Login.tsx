@@ -1,5 +1,6 @@
-import React, { useState } from 'react';
+import React, { useEffect, useState } from 'react';
 import { authService } from '../services/auth';
+import { MFAChallenge, OIDCConfig } from '../types';
 import './Login.css';
 
 interface LoginProps {
@@ -12,6 +13,47 @@ export const Login: React.FC<LoginProps> = ({ onLoginSuccess }) => {
   const [error, setError] = useState('');
   const [loading, setLoading] = useState(false);
   const [showPassword, setShowPassword] = useState(false);
+  const [challenge, setChallenge] = useState<MFAChallenge | null>(null);
+  const [code, setCode] = useState('');
+  const [useRecoveryCode, setUseRecoveryCode] = useState(false);
+  const [recoveryCodes, setRecoveryCodes] = useState<string[] | null>(null);
+  const [sso, setSSO] = useState<OIDCConfig | null>(null);
+
+  useEffect(() => {
+    authService.getOIDCConfig().then(setSSO).catch(() => setSSO(null));
+
+    // Returning from the identity provider
+    const params = new URLSearchParams(window.location.search);
+    if (!params.has('code') && !params.has('error')) {
+      return;
+    }
+    window.history.replaceState(null, '', window.location.pathname);
+    if (params.has('error')) {
+      setError(params.get('error_description') || 'Single sign-on failed.');
+      return;
+    }
+    setLoading(true);
+    authService
+      .completeSSO(params)
+      .then((done) => {
+        if (done) onLoginSuccess();
+      })
+      .catch((err: any) => {
+        setError(err.response?.data?.error || err.message || 'Single sign-on failed.');
+      })
+      .finally(() => setLoading(false));
+  }, [onLoginSuccess]);
+
+  const handleSSO = async () => {
+    setError('');
+    setLoading(true);
+    try {
+      await authService.startSSO();
+    } catch (err: any) {
+      setError(err.response?.data?.error || 'Single sign-on failed.');
+      setLoading(false);
+    }
+  };
 
   const handleSubmit = async (e: React.FormEvent) => {
     e.preventDefault();
@@ -19,15 +61,120 @@ export const Login: React.FC<LoginProps> = ({ onLoginSuccess }) => {
     setLoading(true);
 
     try {
-      await authService.login({ username, password });
-      onLoginSuccess();
+      const next = await authService.login({ username, password });
+      if (next) {
+        setChallenge(next);
+      } else {
+        onLoginSuccess();
+      }
+    } catch (err: any) {
+      setError(err.response?.data?.error || 'Login failed. Please try again.');
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  const handleCodeSubmit = async (e: React.FormEvent) => {
+    e.preventDefault();
+    if (!challenge) return;
+    setError('');
+    setLoading(true);
+
+    try {
+      const codes = await authService.completeMFA(challenge.mfaToken, code.trim(), useRecoveryCode);
+      if (codes && codes.length > 0) {
+        // Shown once; the user continues after saving them
+        setRecoveryCodes(codes);
+      } else {
+        onLoginSuccess();
+      }
     } catch (err: any) {
+      if (err.response?.status === 401 && err.response?.data?.error !== 'Invalid code') {
+        // The challenge expired; start over with the password
+        setChallenge(null);
+      }
       setError(err.response?.data?.error || 'Login failed. Please try again.');
     } finally {
       setLoading(false);
     }
   };
 
+  if (recoveryCodes) {
+    return (
+      <div className="login-container">
+        <div className="login-box">
+          <h1>Save your recovery codes</h1>
+          <p className="mfa-hint">
+            Each code signs you in once if you lose your authenticator. They won't be shown again.
+          </p>
+          <ul className="recovery-codes">
+            {recoveryCodes.map((c) => (
+              <li key={c}>{c}</li>
+            ))}
+          </ul>
+          <button type="button" onClick={onLoginSuccess}>
+            Continue
+          </button>
+        </div>
+      </div>
+    );
+  }
+
+  if (challenge) {
+    return (
+      <div className="login-container">
+        <div className="login-box">
+          <h1>Two-factor authentication</h1>
+          {challenge.mfaSetupRequired && (
+            <div className="mfa-setup">
+              <p className="mfa-hint">
+                Two-factor authentication is required. Add this key to your authenticator app, then enter the code it shows.
+              </p>
+              <code className="mfa-secret">{challenge.secret}</code>
+              {challenge.otpauthUrl && (
+                <a className="mfa-link" href={challenge.otpauthUrl}>
+                  Open in authenticator app
+                </a>
+              )}
+            </div>
+          )}
+          <form onSubmit={handleCodeSubmit}>
+            <div className="form-group">
+              <label htmlFor="code">{useRecoveryCode ? 'Recovery code' : 'Authentication code'}</label>
+              <input
+                id="code"
+                type="text"
+                inputMode={useRecoveryCode ? 'text' : 'numeric'}
+                autoComplete="one-time-code"
+                value={code}
+                onChange={(e) => setCode(e.target.value)}
+                required
+                autoFocus
+                disabled={loading}
+              />
+            </div>
+            {error && <div className="error">{error}</div>}
+            <button type="submit" disabled={loading}>
+              {loading ? 'Verifying...' : 'Verify'}
+            </button>
+            {!challenge.mfaSetupRequired && (
+              <button
+                type="button"
+                className="mfa-switch"
+                onClick={() => {
+                  setUseRecoveryCode(!useRecoveryCode);
+                  setCode('');
+                }}
+              >
+                {useRecoveryCode ? 'Use authenticator code' : 'Use a recovery code'}
+              </button>
+            )}
+          </form>
+        </div>
+      </div>
+    );
+  }
+
   return (
     <div className="login-container">
       <div className="login-box">
@@ -79,6 +226,11 @@ export const Login: React.FC<LoginProps> = ({ onLoginSuccess }) => {
           <button type="submit" disabled={loading}>
             {loading ? 'Logging in...' : 'Login'}
           </button>
+          {sso?.enabled && (
+            <button type="button" className="sso-btn" onClick={handleSSO} disabled={loading}>
+              Sign in with {sso.displayName || 'SSO'}
+            </button>
+          )}
         </form>
       </div>
     </div>
@@ -1,9 +1,10 @@
 import axios, { AxiosError } from 'axios';
 import { API_BASE_URL, IMAGE_CDN_URL } from '../config';
 import { authService } from './auth';
-import { Image, UpdateImageRequest, Project, AddToProjectRequest, LogsResponse } from '../types';
+import { Image, UpdateImageRequest, Project, AddToProjectRequest, LogsResponse, ProjectMember, ProjectRole, UndoStep, ImageDetail, BatchImagePatch, BatchUpdateResponse, SearchResponse, TimelineResponse, Collection, CollectionFilter, ChangesResponse, Job, JobsResponse, JobStatus, JobType } from '../types';
 
 const RETRY_DELAYS = [300, 600, 1200, 2400]; // Exponential backoff for throttling
+const JOB_POLL_INTERVAL = 1000;
 
 async function withRetry<T>(fn: () => Promise<T>): Promise<T> {
   let lastError: Error | undefined;
@@ -42,8 +43,22 @@ export interface TransferProgressCallback {
 export interface ImageFilters {
   state?: 'unreviewed' | 'approved' | 'rejected' | 'deleted' | 'all';
   group?: number | 'all';
+  // Filter query, e.g. 'rating>=4 AND keyword:heron'; replaces state and group
+  q?: string;
+  // Capture date range, inclusive: 2025, 2025-06 or 2025-06-01
+  from?: string;
+  to?: string;
+  sort?: ImageSort;
+  order?: 'asc' | 'desc';
+  // Attributes returned; review (the default) leaves out descriptions and
+  // most EXIF data, grid also keywords and EXIF dates
+  fields?: ImageFields;
 }
 
+export type ImageSort = 'captured' | 'inserted' | 'rating' | 'filename';
+
+export type ImageFields = 'grid' | 'review' | 'full';
+
 export interface PaginatedImageResponse {
   images: Image[];
   nextCursor?: string;
@@ -64,8 +79,13 @@ export interface SystemStats {
   approvedCount: number;
   rejectedCount: number;
   deletedCount: number;
+  projectCount: number;
+  groups: { group: number; count: number }[];
+  projects: { projectId: string; count: number }[];
+  ingest: { day: string; count: number }[]; // Images added per day, most recent last
   sqsQueueDepth: number;
   sqsDlqDepth: number;
+  reconciledAt?: string;
   lastUpdated: string;
 }
 
@@ -83,6 +103,24 @@ export const api = {
       if (filters?.group !== undefined && filters.group !== 'all') {
         params.append('group', String(filters.group));
       }
+      if (filters?.q) {
+        params.append('q', filters.q);
+      }
+      if (filters?.from) {
+        params.append('from', filters.from);
+      }
+      if (filters?.to) {
+        params.append('to', filters.to);
+      }
+      if (filters?.sort) {
+        params.append('sort', filters.sort);
+      }
+      if (filters?.order) {
+        params.append('order', filters.order);
+      }
+      if (filters?.fields) {
+        params.append('fields', filters.fields);
+      }
       params.append('limit', '500');
       if (cursor) {
         params.append('cursor', cursor);
@@ -110,14 +148,53 @@ export const api = {
     return allImages;
   },
 
-  async updateImage(imageId: string, update: UpdateImageRequest): Promise<void> {
-    await withRetry(() =>
-      axios.put(
+  async getImage(imageId: string, historyCursor?: string): Promise<ImageDetail> {
+    const params = historyCursor ? { historyCursor } : undefined;
+    const response = await withRetry(() =>
+      axios.get<ImageDetail>(
+        `${API_BASE_URL}/api/images/${imageId}`,
+        { headers: authService.getAuthHeader(), params }
+      )
+    );
+    return response.data;
+  },
+
+  // Pass the version the change was made against to have it refused with a
+  // 409 (carrying the current image) if someone else changed the image since.
+  // Resolves to the image's new version.
+  async updateImage(imageId: string, update: UpdateImageRequest, version?: number): Promise<number> {
+    const headers: Record<string, string> = { ...authService.getAuthHeader() };
+    if (version !== undefined) {
+      headers['If-Match'] = `"${version}"`;
+    }
+    const response = await withRetry(() =>
+      axios.put<{ success: boolean; version: number }>(
         `${API_BASE_URL}/api/images/${imageId}`,
         update,
-        { headers: authService.getAuthHeader() }
+        { headers }
       )
     );
+    return response.data.version;
+  },
+
+  // Applies one patch to many images, 100 per request, and returns the
+  // result for each image so only the failures need retrying.
+  async batchUpdateImages(imageIds: string[], patch: BatchImagePatch): Promise<BatchUpdateResponse> {
+    const combined: BatchUpdateResponse = { results: [], succeeded: 0, failed: 0 };
+    for (let i = 0; i < imageIds.length; i += 100) {
+      const chunk = imageIds.slice(i, i + 100);
+      const response = await withRetry(() =>
+        axios.post<BatchUpdateResponse>(
+          `${API_BASE_URL}/api/images/batch`,
+          { imageGUIDs: chunk, patch },
+          { headers: authService.getAuthHeader() }
+        )
+      );
+      combined.results.push(...response.data.results);
+      combined.succeeded += response.data.succeeded;
+      combined.failed += response.data.failed;
+    }
+    return combined;
   },
 
   async deleteImage(imageId: string): Promise<void> {
@@ -139,6 +216,89 @@ export const api = {
     );
   },
 
+  async undoImage(imageId: string): Promise<Image> {
+    const response = await withRetry(() =>
+      axios.post<Image>(
+        `${API_BASE_URL}/api/images/${imageId}/undo`,
+        {},
+        { headers: authService.getAuthHeader() }
+      )
+    );
+    return response.data;
+  },
+
+  // Photo counts per year, or per month of a year, or per day of a month
+  async getTimeline(period?: { year?: string; month?: string }): Promise<TimelineResponse> {
+    const response = await withRetry(() =>
+      axios.get<TimelineResponse>(
+        `${API_BASE_URL}/api/timeline`,
+        { headers: authService.getAuthHeader(), params: period }
+      )
+    );
+    return response.data;
+  },
+
+  async search(q: string, options?: { type?: 'image' | 'project'; limit?: number; cursor?: string }): Promise<SearchResponse> {
+    const response = await withRetry(() =>
+      axios.get<SearchResponse>(
+        `${API_BASE_URL}/api/search`,
+        { headers: authService.getAuthHeader(), params: { q, ...options } }
+      )
+    );
+    return response.data;
+  },
+
+  async getCollections(): Promise<Collection[]> {
+    const response = await axios.get<Collection[]>(
+      `${API_BASE_URL}/api/collections`,
+      { headers: authService.getAuthHeader() }
+    );
+    return response.data;
+  },
+
+  async createCollection(name: string, filter: CollectionFilter): Promise<Collection> {
+    const response = await axios.post<Collection>(
+      `${API_BASE_URL}/api/collections`,
+      { name, filter },
+      { headers: authService.getAuthHeader() }
+    );
+    return response.data;
+  },
+
+  async updateCollection(collectionId: string, name: string, filter: CollectionFilter): Promise<Collection> {
+    const response = await axios.put<Collection>(
+      `${API_BASE_URL}/api/collections/${collectionId}`,
+      { name, filter },
+      { headers: authService.getAuthHeader() }
+    );
+    return response.data;
+  },
+
+  async deleteCollection(collectionId: string): Promise<void> {
+    await axios.delete(
+      `${API_BASE_URL}/api/collections/${collectionId}`,
+      { headers: authService.getAuthHeader() }
+    );
+  },
+
+  async getCollectionImages(collectionId: string, cursor?: string): Promise<PaginatedImageResponse> {
+    const response = await withRetry(() =>
+      axios.get<PaginatedImageResponse>(
+        `${API_BASE_URL}/api/collections/${collectionId}/images`,
+        { headers: authService.getAuthHeader(), params: { limit: 500, cursor } }
+      )
+    );
+    return response.data;
+  },
+
+  async getUndoStack(): Promise<UndoStep[]> {
+    const response = await axios.get<UndoStep[]>(
+      `${API_BASE_URL}/api/user/undo`,
+      { headers: authService.getAuthHeader() }
+    );
+    return response.data;
+  },
+
   async getDownloadUrl(imageId: string): Promise<string> {
     const response = await withRetry(() =>
       axios.get<{ url: string }>(
@@ -179,6 +339,7 @@ export const api = {
     return response.data;
   },
 
+  // Adds a single image (filters.imageGUID); groups go through addToProjectWithProgress
   async addToProject(projectId: string, filters: AddToProjectRequest): Promise<{ movedCount: number }> {
     const response = await withRetry(() =>
       axios.post<{ movedCount: number }>(
@@ -190,89 +351,51 @@ export const api = {
     return response.data;
   },
 
-  async getApprovedImages(filters: AddToProjectRequest): Promise<Image[]> {
-    // Get approved images that match the filter criteria (handles paginated response)
+  async addToProjectWithProgress(
+    projectId: string,
+    filters: AddToProjectRequest,
+    onProgress: TransferProgressCallback
+  ): Promise<{ movedCount: number; failedCount: number }> {
+    // A group, or all approved images, is added by a job; follow its progress
+    const response = await withRetry(() =>
+      axios.post<Job>(
+        `${API_BASE_URL}/api/projects/${projectId}/images`,
+        filters,
+        { headers: authService.getAuthHeader() }
+      )
+    );
+    let job = response.data;
+    while (job.status === 'queued' || job.status === 'running') {
+      await new Promise(resolve => setTimeout(resolve, JOB_POLL_INTERVAL));
+      job = await this.getJob(job.jobId);
+      onProgress('', job.done + job.failed, job.total);
+    }
+    if (job.status === 'failed') {
+      throw new Error(job.message || 'Failed to add images to project');
+    }
+    return { movedCount: job.done, failedCount: job.failed };
+  },
+
+  async getProjectImages(projectId: string, sort?: { sort?: ImageSort; order?: 'asc' | 'desc' }): Promise<Image[]> {
     const allImages: Image[] = [];
     let cursor: string | undefined;
     let hasMore = true;
 
     while (hasMore) {
-      const params = new URLSearchParams();
-      params.append('state', 'approved');
-      if (!filters.all && filters.group !== undefined) {
-        params.append('group', String(filters.group));
-      }
-      params.append('limit', '500');
-      if (cursor) {
-        params.append('cursor', cursor);
-      }
-
       const response = await withRetry(() =>
         axios.get<PaginatedImageResponse>(
-          `${API_BASE_URL}/api/images?${params.toString()}`,
-          { headers: authService.getAuthHeader() }
+          `${API_BASE_URL}/api/projects/${projectId}/images`,
+          { headers: authService.getAuthHeader(), params: { ...sort, limit: 500, cursor } }
         )
       );
-
-      const data = response.data;
-      allImages.push(...data.images);
-      hasMore = data.hasMore;
-      cursor = data.nextCursor;
+      allImages.push(...response.data.images);
+      hasMore = response.data.hasMore;
+      cursor = response.data.nextCursor;
     }
 
     return allImages;
   },
 
-  async addToProjectWithProgress(
-    projectId: string,
-    filters: AddToProjectRequest,
-    onProgress: TransferProgressCallback
-  ): Promise<{ movedCount: number; failedCount: number }> {
-    // First, get the list of images to be moved for progress display
-    const images = await this.getApprovedImages(filters);
-    const totalCount = images.length;
-
-    if (totalCount === 0) {
-      return { movedCount: 0, failedCount: 0 };
-    }
-
-    // Start showing progress with file names
-    // Simulate progress during the bulk transfer
-    let progressIndex = 0;
-    const progressInterval = setInterval(() => {
-      if (progressIndex < images.length) {
-        onProgress(images[progressIndex].originalFile, progressIndex + 1, totalCount);
-        progressIndex++;
-      }
-    }, 100); // Show each file for 100ms minimum
-
-    try {
-      // Perform the actual bulk transfer
-      const result = await this.addToProject(projectId, filters);
-
-      // Clear progress interval
-      clearInterval(progressInterval);
-
-      // Show final progress
-      onProgress(images[images.length - 1]?.originalFile || '', totalCount, totalCount);
-
-      return { movedCount: result.movedCount, failedCount: 0 };
-    } catch (err) {
-      clearInterval(progressInterval);
-      throw err;
-    }
-  },
-
-  async getProjectImages(projectId: string): Promise<Image[]> {
-    const response = await withRetry(() =>
-      axios.get<Image[]>(
-        `${API_BASE_URL}/api/projects/${projectId}/images`,
-        { headers: authService.getAuthHeader() }
-      )
-    );
-    return response.data;
-  },
-
   async regenerateAI(imageId: string): Promise<{ keywords: string[]; description: string }> {
     const response = await withRetry(() =>
       axios.post<{ success: boolean; keywords: string[]; description: string }>(
@@ -284,14 +407,15 @@ export const api = {
     return { keywords: response.data.keywords, description: response.data.description };
   },
 
-  async generateZip(projectId: string): Promise<void> {
-    await withRetry(() =>
-      axios.post(
+  async generateZip(projectId: string): Promise<string> {
+    const response = await withRetry(() =>
+      axios.post<{ jobId: string }>(
         `${API_BASE_URL}/api/projects/${projectId}/generate-zip`,
         {},
         { headers: authService.getAuthHeader() }
       )
     );
+    return response.data.jobId;
   },
 
   async getZipDownload(projectId: string, zipKey: string): Promise<{ url: string; filename: string; size: number }> {
@@ -351,6 +475,35 @@ export const api = {
     );
   },
 
+  async getProjectMembers(projectId: string): Promise<ProjectMember[]> {
+    const response = await withRetry(() =>
+      axios.get<ProjectMember[]>(
+        `${API_BASE_URL}/api/projects/${projectId}/members`,
+        { headers: authService.getAuthHeader() }
+      )
+    );
+    return response.data;
+  },
+
+  async setProjectMember(projectId: string, username: string, role: ProjectRole): Promise<void> {
+    await withRetry(() =>
+      axios.put(
+        `${API_BASE_URL}/api/projects/${projectId}/members/${encodeURIComponent(username)}`,
+        { role },
+        { headers: authService.getAuthHeader() }
+      )
+    );
+  },
+
+  async removeProjectMember(projectId: string, username: string): Promise<void> {
+    await withRetry(() =>
+      axios.delete(
+        `${API_BASE_URL}/api/projects/${projectId}/members/${encodeURIComponent(username)}`,
+        { headers: authService.getAuthHeader() }
+      )
+    );
+  },
+
   async updateProjectArchived(projectId: string, archived: boolean): Promise<void> {
     await withRetry(() =>
       axios.put(
@@ -391,15 +544,86 @@ export const api = {
     }
   },
 
-  async getStats(): Promise<SystemStats> {
+  async getStats(days?: number): Promise<SystemStats> {
     const response = await withRetry(() =>
       axios.get<SystemStats>(`${API_BASE_URL}/api/stats`, {
+        headers: authService.getAuthHeader(),
+        params: days ? { days } : undefined
+      })
+    );
+    return response.data;
+  },
+
+  // Changes since a token from an earlier call, or without one just the
+  // token to start from. Rejects with a 410 when the changes have expired.
+  async getChanges(since?: string, limit?: number): Promise<ChangesResponse> {
+    const response = await withRetry(() =>
+      axios.get<ChangesResponse>(`${API_BASE_URL}/api/changes`, {
+        headers: authService.getAuthHeader(),
+        params: { since, limit }
+      })
+    );
+    return response.data;
+  },
+
+  // Images whose move failed or has been stuck long enough to retry
+  async getFailedMoves(): Promise<Image[]> {
+    const response = await withRetry(() =>
+      axios.get<PaginatedImageResponse>(`${API_BASE_URL}/api/images/failed-moves`, {
+        headers: authService.getAuthHeader()
+      })
+    );
+    return response.data.images;
+  },
+
+  // Resumes or restarts an image's move, returning the move job, or just
+  // rolls it back when the image no longer waits to be moved after review
+  async retryMove(imageGUID: string): Promise<Job | { success: boolean; rolledBack: boolean }> {
+    const response = await axios.post<Job | { success: boolean; rolledBack: boolean }>(
+      `${API_BASE_URL}/api/images/${imageGUID}/retry-move`,
+      {},
+      { headers: authService.getAuthHeader() }
+    );
+    return response.data;
+  },
+
+  async getJobs(filter: { type?: JobType; status?: JobStatus; user?: string } = {}, cursor?: string, limit?: number): Promise<JobsResponse> {
+    const response = await withRetry(() =>
+      axios.get<JobsResponse>(`${API_BASE_URL}/api/jobs`, {
+        headers: authService.getAuthHeader(),
+        params: { ...filter, cursor, limit }
+      })
+    );
+    return response.data;
+  },
+
+  async getJob(jobId: string): Promise<Job> {
+    const response = await withRetry(() =>
+      axios.get<Job>(`${API_BASE_URL}/api/jobs/${jobId}`, {
         headers: authService.getAuthHeader()
       })
     );
     return response.data;
   },
 
+  async cancelJob(jobId: string): Promise<Job> {
+    const response = await axios.post<Job>(
+      `${API_BASE_URL}/api/jobs/${jobId}/cancel`,
+      {},
+      { headers: authService.getAuthHeader() }
+    );
+    return response.data;
+  },
+
+  async retryJob(jobId: string): Promise<Job> {
+    const response = await axios.post<Job>(
+      `${API_BASE_URL}/api/jobs/${jobId}/retry`,
+      {},
+      { headers: authService.getAuthHeader() }
+    );
+    return response.data;
+  },
+
   async getLogs(
     functionName: string,
     hours: number = 1,
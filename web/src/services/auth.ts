@@ -1,22 +1,109 @@
-import axios from 'axios';
+import axios, { AxiosError, InternalAxiosRequestConfig } from 'axios';
 import { API_BASE_URL } from '../config';
-import { LoginRequest, LoginResponse } from '../types';
+import { LoginRequest, LoginResponse, MFAChallenge, OIDCConfig } from '../types';
 
 const AUTH_TOKEN_KEY = 'authToken';
+const REFRESH_TOKEN_KEY = 'refreshToken';
+// The PKCE verifier and state of a single sign-on in progress
+const OIDC_VERIFIER_KEY = 'oidcVerifier';
+const OIDC_STATE_KEY = 'oidcState';
+
+function base64url(bytes: Uint8Array): string {
+  let binary = '';
+  bytes.forEach((b) => {
+    binary += String.fromCharCode(b);
+  });
+  return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+// Shared by concurrent requests that all hit an expired access token
+let refreshInFlight: Promise<string | null> | null = null;
+
+function storeTokens(data: LoginResponse): void {
+  localStorage.setItem(AUTH_TOKEN_KEY, data.token);
+  localStorage.setItem(REFRESH_TOKEN_KEY, data.refreshToken);
+}
+
+function clearTokens(): void {
+  localStorage.removeItem(AUTH_TOKEN_KEY);
+  localStorage.removeItem(REFRESH_TOKEN_KEY);
+}
 
 export const authService = {
-  async login(credentials: LoginRequest): Promise<string> {
-    const response = await axios.post<LoginResponse>(
+  // Returns the second-step challenge for accounts with two-factor
+  // authentication, or null once signed in.
+  async login(credentials: LoginRequest): Promise<MFAChallenge | null> {
+    const response = await axios.post<LoginResponse | MFAChallenge>(
       `${API_BASE_URL}/api/login`,
       credentials
     );
-    const token = response.data.token;
-    localStorage.setItem(AUTH_TOKEN_KEY, token);
-    return token;
+    if ('mfaRequired' in response.data) {
+      return response.data;
+    }
+    storeTokens(response.data);
+    return null;
+  },
+
+  // Completes a two-step login with an authenticator or recovery code.
+  // Returns recovery codes when this login also finished enrollment.
+  async completeMFA(mfaToken: string, code: string, isRecoveryCode: boolean): Promise<string[] | undefined> {
+    const response = await axios.post<LoginResponse>(
+      `${API_BASE_URL}/api/login/mfa`,
+      isRecoveryCode ? { mfaToken, recoveryCode: code } : { mfaToken, code }
+    );
+    storeTokens(response.data);
+    return response.data.recoveryCodes;
+  },
+
+  async getOIDCConfig(): Promise<OIDCConfig> {
+    const response = await axios.get<OIDCConfig>(`${API_BASE_URL}/api/auth/oidc/config`);
+    return response.data;
+  },
+
+  // Sends the browser to the identity provider. It comes back to the app
+  // with ?code=...&state=..., which completeSSO finishes.
+  async startSSO(): Promise<void> {
+    const verifier = base64url(crypto.getRandomValues(new Uint8Array(32)));
+    const digest = await crypto.subtle.digest('SHA-256', new TextEncoder().encode(verifier));
+    const response = await axios.post<{ authorizationUrl: string; state: string }>(
+      `${API_BASE_URL}/api/auth/oidc/start`,
+      { codeChallenge: base64url(new Uint8Array(digest)) }
+    );
+    sessionStorage.setItem(OIDC_VERIFIER_KEY, verifier);
+    sessionStorage.setItem(OIDC_STATE_KEY, response.data.state);
+    window.location.assign(response.data.authorizationUrl);
+  },
+
+  // Returns false when the URL is not a return from the identity provider.
+  async completeSSO(params: URLSearchParams): Promise<boolean> {
+    const code = params.get('code');
+    const state = params.get('state');
+    const verifier = sessionStorage.getItem(OIDC_VERIFIER_KEY);
+    const expectedState = sessionStorage.getItem(OIDC_STATE_KEY);
+    if (!code || !state || !verifier) {
+      return false;
+    }
+    sessionStorage.removeItem(OIDC_VERIFIER_KEY);
+    sessionStorage.removeItem(OIDC_STATE_KEY);
+    if (state !== expectedState) {
+      throw new Error('Sign-in was not started from this browser');
+    }
+    const response = await axios.post<LoginResponse>(`${API_BASE_URL}/api/auth/oidc/callback`, {
+      code,
+      state,
+      codeVerifier: verifier,
+    });
+    storeTokens(response.data);
+    return true;
   },
 
   logout(): void {
-    localStorage.removeItem(AUTH_TOKEN_KEY);
+    const header = this.getAuthHeader();
+    clearTokens();
+    // Revoke the session server-side; the local tokens are gone either way
+    if (header.Authorization) {
+      axios.post(`${API_BASE_URL}/api/logout`, {}, { headers: header }).catch(() => {});
+    }
   },
 
   getToken(): string | null {
@@ -31,4 +118,54 @@ export const authService = {
     const token = this.getToken();
     return token ? { Authorization: `Bearer ${token}` } : {};
   },
+
+  // Exchanges the refresh token for a new token pair. Returns the new access
+  // token, or null when the session has ended.
+  refresh(): Promise<string | null> {
+    const refreshToken = localStorage.getItem(REFRESH_TOKEN_KEY);
+    if (!refreshToken) {
+      return Promise.resolve(null);
+    }
+    if (!refreshInFlight) {
+      refreshInFlight = axios
+        .post<LoginResponse>(`${API_BASE_URL}/api/refresh`, { refreshToken })
+        .then((response) => {
+          storeTokens(response.data);
+          return response.data.token;
+        })
+        .catch(() => {
+          clearTokens();
+          return null;
+        })
+        .finally(() => {
+          refreshInFlight = null;
+        });
+    }
+    return refreshInFlight;
+  },
 };
+
+// Access tokens are short-lived: on a 401, refresh once and replay the request.
+axios.interceptors.response.use(undefined, async (error: AxiosError) => {
+  const config = error.config as (InternalAxiosRequestConfig & { _retried?: boolean }) | undefined;
+  const url = config?.url ?? '';
+  if (
+    error.response?.status !== 401 ||
+    !config ||
+    config._retried ||
+    url.endsWith('/api/login') ||
+    url.endsWith('/api/login/mfa') ||
+    url.includes('/api/auth/oidc/') ||
+    url.endsWith('/api/refresh') ||
+    url.endsWith('/api/logout')
+  ) {
+    return Promise.reject(error);
+  }
+  config._retried = true;
+  const token = await authService.refresh();
+  if (!token) {
+    return Promise.reject(error);
+  }
+  config.headers.set('Authorization', `Bearer ${token}`);
+  return axios(config);
+});
@@ -21,8 +21,54 @@ export interface Image {
   status?: 'inbox' | 'approved' | 'rejected' | 'deleted' | 'project';
   projectId?: string;
   moveStatus?: 'pending' | 'moving' | 'complete' | 'failed';
+  moveJournal?: MoveJournal;
   insertedDateTime?: string;
   updatedDateTime?: string;
+  captureDate?: string;           // When the photo was taken, camera local time (e.g., "2025-06-01T07:30:00")
+  version: number;                // Bumped by every change; sent back as If-Match
+}
+
+// The files of an unfinished move, each from src to dst
+export interface MoveJournal {
+  destPrefix: string;
+  newStatus?: string;             // Set for moves after review
+  files: { kind: 'original' | 'thumbnail50' | 'thumbnail400' | 'raw' | 'related'; src: string; dst: string }[];
+  startedAt: string;
+  updatedAt: string;
+  attempts: number;
+}
+
+export interface AuditEvent {
+  eventId: string;
+  timestamp: string;
+  actor: string;
+  action: string;
+  target: string;
+  imageGUID?: string;
+  projectId?: string;
+  before?: Record<string, unknown>;
+  after?: Record<string, unknown>;
+  requestId?: string;
+  sourceIp?: string;
+}
+
+export interface ImageDetail extends Image {
+  urls: {
+    original: string;
+    thumbnail50: string;
+    thumbnail400: string;
+    raw?: string;
+  };
+  project?: {
+    projectId: string;
+    name: string;
+    myRole: ProjectRole;
+  };
+  history: {
+    events: AuditEvent[];
+    hasMore: boolean;
+    nextCursor?: string;
+  };
 }
 
 export interface LoginRequest {
@@ -32,6 +78,26 @@ export interface LoginRequest {
 
 export interface LoginResponse {
   token: string;
+  refreshToken: string;
+  expiresIn: number;
+  username: string;
+  role: 'admin' | 'reviewer' | 'viewer';
+  // Only returned when two-factor authentication was set up during login
+  recoveryCodes?: string[];
+}
+
+export interface OIDCConfig {
+  enabled: boolean;
+  displayName?: string;
+}
+
+// Returned instead of tokens when the account uses two-factor authentication
+export interface MFAChallenge {
+  mfaRequired: true;
+  mfaToken: string;
+  mfaSetupRequired?: boolean;
+  secret?: string;
+  otpauthUrl?: string;
 }
 
 export interface UpdateImageRequest {
@@ -43,6 +109,148 @@ export interface UpdateImageRequest {
   keywords?: string[];
 }
 
+// Body of a 409 returned when If-Match names an out-of-date version
+export interface VersionConflict<T> {
+  error: string;
+  current: T;
+}
+
+// A saved smart collection; the filter is re-evaluated each time it is listed
+export interface CollectionFilter {
+  state?: 'unreviewed' | 'inbox' | 'approved' | 'rejected' | 'deleted' | 'project';
+  group?: number;
+  minRating?: number;
+  maxRating?: number;
+  keywords?: string[];
+  takenFrom?: string;
+  takenTo?: string;
+  takenWithin?: 'today' | 'this-week' | 'this-month' | 'this-year' | 'last-7-days' | 'last-30-days';
+  camera?: string;
+  inProject?: boolean;
+  query?: string;
+}
+
+export interface Collection {
+  id: string;
+  name: string;
+  filter: CollectionFilter;
+  q: string;
+  createdAt: string;
+  updatedAt?: string;
+}
+
+// One GET /api/search result; image or project is set according to type
+export interface SearchResult {
+  type: 'image' | 'project';
+  id: string;
+  score: number;
+  matched: string[];
+  image?: Image;
+  project?: Project;
+}
+
+export interface TimelinePeriod {
+  period: string;                 // 2025, 2025-06 or 2025-06-01
+  count: number;
+}
+
+export interface TimelineResponse {
+  granularity: 'year' | 'month' | 'day';
+  periods: TimelinePeriod[];
+}
+
+// An entry of the change feed; image and project are left out of deletions
+export interface Change {
+  kind: 'image' | 'project';
+  id: string;
+  action: 'created' | 'updated' | 'moved' | 'deleted';
+  changedAt: string;
+  image?: Image;
+  project?: Project;
+}
+
+export interface ChangesResponse {
+  changes: Change[];
+  nextToken: string;
+  hasMore: boolean;
+}
+
+export type JobType = 'move' | 'add-to-project' | 'zip' | 'backfill-keywords' | 'reconcile-moves' | 'reindex-search';
+export type JobStatus = 'queued' | 'running' | 'succeeded' | 'failed' | 'canceled';
+
+export interface JobError {
+  item: string;
+  error: string;
+  at: string;
+}
+
+export interface Job {
+  jobId: string;
+  type: JobType;
+  status: JobStatus;
+  requestedBy: string;
+  imageGUID?: string;
+  projectId?: string;
+  total: number;
+  done: number;
+  failed: number;
+  errors?: JobError[];
+  message?: string;
+  attempts: number;
+  cancelRequested?: boolean;
+  createdAt: string;
+  startedAt?: string;
+  finishedAt?: string;
+  updatedAt: string;
+}
+
+export interface JobsResponse {
+  jobs: Job[];
+  hasMore: boolean;
+  nextCursor?: string;
+}
+
+export interface SearchResponse {
+  results: SearchResult[];
+  hasMore: boolean;
+  nextCursor?: string;
+}
+
+export interface UndoStep {
+  stepId: string;
+  imageGUID: string;
+  status?: string;
+  reviewed: string;
+  groupNumber: number;
+  colorCode?: string;
+  rating: number;
+  prefix: string;
+  createdAt: string;
+}
+
+export interface BatchImagePatch {
+  groupNumber?: number;
+  colorCode?: string;
+  rating?: number;
+  promoted?: boolean;
+  reviewed?: string;
+  addKeywords?: string[];
+  removeKeywords?: string[];
+}
+
+export interface BatchItemResult {
+  imageGUID: string;
+  success: boolean;
+  status: number;
+  error?: string;
+}
+
+export interface BatchUpdateResponse {
+  results: BatchItemResult[];
+  succeeded: number;
+  failed: number;
+}
+
 export interface Project {
   projectId: string;
   name: string;
@@ -51,6 +259,16 @@ export interface Project {
   imageCount: number;
   zipFiles?: ZipFile[];
   archived?: boolean;
+  members?: Record<string, ProjectRole>;
+  myRole?: ProjectRole;
+  version: number;
+}
+
+export type ProjectRole = 'owner' | 'editor' | 'viewer';
+
+export interface ProjectMember {
+  username: string;
+  role: ProjectRole;
 }
 
 export interface ZipFile {